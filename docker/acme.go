@@ -0,0 +1,522 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Certificates for TLS_DOMAINS come from an ACME CA (Let's Encrypt unless
+// ACME_DIRECTORY says otherwise) through the http-01 challenge, which is
+// answered on HTTP_PORT. This is a small RFC 8555 client rather than a
+// dependency: one account, one certificate covering every domain. The
+// account key and certificate are kept in STATE_DIR/acme, and the
+// certificate is renewed when it has less than 30 days left.
+const (
+	letsEncryptDirectory = "https://acme-v02.api.letsencrypt.org/directory"
+	acmeRenewBefore      = 30 * 24 * time.Hour
+	acmeCheckInterval    = 12 * time.Hour
+	acmeChallengePrefix  = "/.well-known/acme-challenge/"
+)
+
+// How often to poll pending authorizations and orders
+var acmePollInterval = 2 * time.Second
+
+type acmeClient struct {
+	directoryURL string
+	key          *ecdsa.PrivateKey
+	http         *http.Client
+	dir          struct {
+		NewNonce   string `json:"newNonce"`
+		NewAccount string `json:"newAccount"`
+		NewOrder   string `json:"newOrder"`
+	}
+	// The account URL, once registered
+	kid   string
+	nonce string
+}
+
+// An ACME error document (RFC 7807)
+type acmeProblem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+	Status int    `json:"status"`
+}
+
+func (p *acmeProblem) Error() string {
+	return fmt.Sprintf("acme: %s (%s)", p.Detail, strings.TrimPrefix(p.Type, "urn:ietf:params:acme:error:"))
+}
+
+type acmeOrder struct {
+	Status         string   `json:"status"`
+	Authorizations []string `json:"authorizations"`
+	Finalize       string   `json:"finalize"`
+	Certificate    string   `json:"certificate"`
+}
+
+type acmeAuthorization struct {
+	Status     string `json:"status"`
+	Identifier struct {
+		Value string `json:"value"`
+	} `json:"identifier"`
+	Challenges []acmeChallenge `json:"challenges"`
+}
+
+type acmeChallenge struct {
+	Type  string `json:"type"`
+	URL   string `json:"url"`
+	Token string `json:"token"`
+}
+
+func b64(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// The account key as a JWK, with its members in the order RFC 7638
+// thumbprints need
+func (c *acmeClient) jwk() string {
+	pub := c.key.PublicKey
+	return fmt.Sprintf(`{"crv":"P-256","kty":"EC","x":"%s","y":"%s"}`, b64(pub.X.FillBytes(make([]byte, 32))), b64(pub.Y.FillBytes(make([]byte, 32))))
+}
+
+// The response to an http-01 challenge
+func (c *acmeClient) keyAuthorization(token string) string {
+	sum := sha256.Sum256([]byte(c.jwk()))
+	return token + "." + b64(sum[:])
+}
+
+func (c *acmeClient) discover(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.directoryURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("acme directory: %s", resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(&c.dir)
+}
+
+func (c *acmeClient) fetchNonce(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, c.dir.NewNonce, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if c.nonce = resp.Header.Get("Replay-Nonce"); c.nonce == "" {
+		return errors.New("acme: no nonce from " + c.dir.NewNonce)
+	}
+	return nil
+}
+
+// POST a JWS-signed payload; a nil payload is a POST-as-GET. A bad nonce is
+// retried once with the fresh one the server sent back.
+func (c *acmeClient) post(ctx context.Context, url string, payload any) (http.Header, []byte, error) {
+	for attempt := 0; ; attempt++ {
+		header, body, err := c.postOnce(ctx, url, payload)
+		var problem *acmeProblem
+		if attempt == 0 && errors.As(err, &problem) && strings.HasSuffix(problem.Type, ":badNonce") {
+			continue
+		}
+		return header, body, err
+	}
+}
+
+func (c *acmeClient) postOnce(ctx context.Context, url string, payload any) (http.Header, []byte, error) {
+	if c.nonce == "" {
+		if err := c.fetchNonce(ctx); err != nil {
+			return nil, nil, err
+		}
+	}
+	protected := fmt.Sprintf(`{"alg":"ES256","nonce":%q,"url":%q,`, c.nonce, url)
+	if c.kid != "" {
+		protected += fmt.Sprintf(`"kid":%q}`, c.kid)
+	} else {
+		protected += `"jwk":` + c.jwk() + `}`
+	}
+	c.nonce = ""
+	var payload64 string
+	if payload != nil {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return nil, nil, err
+		}
+		payload64 = b64(data)
+	}
+	signingInput := b64([]byte(protected)) + "." + payload64
+	digest := sha256.Sum256([]byte(signingInput))
+	r, s, err := ecdsa.Sign(rand.Reader, c.key, digest[:])
+	if err != nil {
+		return nil, nil, err
+	}
+	jws, _ := json.Marshal(map[string]string{
+		"protected": b64([]byte(protected)),
+		"payload":   payload64,
+		"signature": b64(append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)),
+	})
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(jws))
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Content-Type", "application/jose+json")
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	c.nonce = resp.Header.Get("Replay-Nonce")
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode >= 400 {
+		problem := &acmeProblem{Status: resp.StatusCode}
+		if json.Unmarshal(body, problem) != nil || problem.Detail == "" {
+			problem.Detail = resp.Status
+		}
+		return nil, nil, problem
+	}
+	return resp.Header, body, nil
+}
+
+// Register the account, or look up the existing one for this key
+func (c *acmeClient) register(ctx context.Context, email string) error {
+	account := map[string]any{"termsOfServiceAgreed": true}
+	if email != "" {
+		account["contact"] = []string{"mailto:" + email}
+	}
+	header, _, err := c.post(ctx, c.dir.NewAccount, account)
+	if err != nil {
+		return err
+	}
+	if c.kid = header.Get("Location"); c.kid == "" {
+		return errors.New("acme: no account URL")
+	}
+	return nil
+}
+
+// Poll url until its status leaves pending/processing, decoding it into v
+func (c *acmeClient) poll(ctx context.Context, url string, v any, status func() string) error {
+	for {
+		_, body, err := c.post(ctx, url, nil)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(body, v); err != nil {
+			return err
+		}
+		if s := status(); s != "pending" && s != "processing" {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(acmePollInterval):
+		}
+	}
+}
+
+// Order and download a certificate for domains, answering http-01
+// challenges through challenges. Returns the PEM chain and the PEM key.
+func (c *acmeClient) obtain(ctx context.Context, domains []string, challenges *acmeChallenges) ([]byte, []byte, error) {
+	type identifier struct {
+		Type  string `json:"type"`
+		Value string `json:"value"`
+	}
+	var ids []identifier
+	for _, d := range domains {
+		ids = append(ids, identifier{"dns", d})
+	}
+	header, body, err := c.post(ctx, c.dir.NewOrder, map[string]any{"identifiers": ids})
+	if err != nil {
+		return nil, nil, err
+	}
+	orderURL := header.Get("Location")
+	var order acmeOrder
+	if err := json.Unmarshal(body, &order); err != nil {
+		return nil, nil, err
+	}
+
+	for _, authzURL := range order.Authorizations {
+		if err := c.authorize(ctx, authzURL, challenges); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	certKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: domains[0]},
+		DNSNames: domains,
+	}, certKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, body, err = c.post(ctx, order.Finalize, map[string]string{"csr": b64(csr)}); err != nil {
+		return nil, nil, err
+	}
+	if err := json.Unmarshal(body, &order); err != nil {
+		return nil, nil, err
+	}
+	if order.Status != "valid" {
+		if err := c.poll(ctx, orderURL, &order, func() string { return order.Status }); err != nil {
+			return nil, nil, err
+		}
+	}
+	if order.Status != "valid" || order.Certificate == "" {
+		return nil, nil, fmt.Errorf("acme: order is %s", order.Status)
+	}
+	_, chain, err := c.post(ctx, order.Certificate, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(certKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return chain, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), nil
+}
+
+// Complete one authorization with its http-01 challenge
+func (c *acmeClient) authorize(ctx context.Context, url string, challenges *acmeChallenges) error {
+	var authz acmeAuthorization
+	_, body, err := c.post(ctx, url, nil)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(body, &authz); err != nil {
+		return err
+	}
+	if authz.Status == "valid" {
+		return nil
+	}
+	i := slices.IndexFunc(authz.Challenges, func(ch acmeChallenge) bool { return ch.Type == "http-01" })
+	if i < 0 {
+		return fmt.Errorf("acme: no http-01 challenge for %s", authz.Identifier.Value)
+	}
+	ch := authz.Challenges[i]
+	challenges.set(ch.Token, c.keyAuthorization(ch.Token))
+	defer challenges.set(ch.Token, "")
+
+	if _, _, err := c.post(ctx, ch.URL, struct{}{}); err != nil {
+		return err
+	}
+	if err := c.poll(ctx, url, &authz, func() string { return authz.Status }); err != nil {
+		return err
+	}
+	if authz.Status != "valid" {
+		return fmt.Errorf("acme: authorization for %s is %s", authz.Identifier.Value, authz.Status)
+	}
+	return nil
+}
+
+// Pending http-01 challenge responses by token. Served on HTTP_PORT, which
+// otherwise redirects to HTTPS.
+type acmeChallenges struct {
+	sync.Mutex
+	tokens map[string]string
+}
+
+func (ch *acmeChallenges) set(token, keyAuth string) {
+	ch.Lock()
+	defer ch.Unlock()
+	if ch.tokens == nil {
+		ch.tokens = map[string]string{}
+	}
+	if keyAuth == "" {
+		delete(ch.tokens, token)
+	} else {
+		ch.tokens[token] = keyAuth
+	}
+}
+
+func (ch *acmeChallenges) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if token, ok := strings.CutPrefix(r.URL.Path, acmeChallengePrefix); ok {
+		ch.Lock()
+		keyAuth, found := ch.tokens[token]
+		ch.Unlock()
+		if !found {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, keyAuth)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		sendError(w, http.StatusBadRequest, "Use HTTPS", "")
+		return
+	}
+	host := r.Host
+	if i := strings.LastIndex(host, ":"); i >= 0 && !strings.HasSuffix(host, "]") {
+		host = host[:i]
+	}
+	target := "https://" + host
+	if port != "443" {
+		target += ":" + port
+	}
+	http.Redirect(w, r, target+r.URL.RequestURI(), http.StatusMovedPermanently)
+}
+
+// Keeps a certificate for domains current and hands it to TLS handshakes
+type acmeManager struct {
+	client     *acmeClient
+	email      string
+	domains    []string
+	dir        string
+	challenges acmeChallenges
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+func newACMEManager(dir, directoryURL, email string, domains []string) (*acmeManager, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	key, err := loadOrCreateACMEKey(filepath.Join(dir, "account.key"))
+	if err != nil {
+		return nil, err
+	}
+	m := &acmeManager{
+		client:  &acmeClient{directoryURL: directoryURL, key: key, http: &http.Client{Timeout: 30 * time.Second}},
+		email:   email,
+		domains: domains,
+		dir:     dir,
+	}
+	if cert, err := tls.LoadX509KeyPair(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "cert.key")); err == nil {
+		m.cert = &cert
+	}
+	return m, nil
+}
+
+func loadOrCreateACMEKey(path string) (*ecdsa.PrivateKey, error) {
+	if data, err := os.ReadFile(path); err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("%s: not a PEM key", path)
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return key, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0o600)
+}
+
+func (m *acmeManager) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.cert == nil {
+		return nil, errors.New("no certificate issued yet")
+	}
+	return m.cert, nil
+}
+
+// Whether the current certificate covers every domain for long enough
+func (m *acmeManager) current(now time.Time) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.cert == nil || len(m.cert.Certificate) == 0 {
+		return false
+	}
+	leaf, err := x509.ParseCertificate(m.cert.Certificate[0])
+	if err != nil || now.Add(acmeRenewBefore).After(leaf.NotAfter) {
+		return false
+	}
+	for _, d := range m.domains {
+		if leaf.VerifyHostname(d) != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// Obtain a new certificate unless the current one is still good
+func (m *acmeManager) renew(ctx context.Context) error {
+	if m.current(time.Now()) {
+		return nil
+	}
+	c := m.client
+	if c.dir.NewOrder == "" {
+		if err := c.discover(ctx); err != nil {
+			return err
+		}
+	}
+	if c.kid == "" {
+		if err := c.register(ctx, m.email); err != nil {
+			return err
+		}
+	}
+	chain, key, err := c.obtain(ctx, m.domains, &m.challenges)
+	if err != nil {
+		return err
+	}
+	cert, err := tls.X509KeyPair(chain, key)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(m.dir, "cert.key"), key, 0o600); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(m.dir, "cert.pem"), chain, 0o644); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	m.cert = &cert
+	m.mu.Unlock()
+	log.Printf("ACME: issued certificate for %s", strings.Join(m.domains, ", "))
+	return nil
+}
+
+// Renew in the background, retrying failures sooner than the usual check
+func (m *acmeManager) run(interval time.Duration) {
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+		err := m.renew(ctx)
+		cancel()
+		wait := interval
+		if err != nil {
+			log.Printf("ACME: renewing certificate failed: %v", err)
+			wait = min(interval, 10*time.Minute)
+		}
+		time.Sleep(wait)
+	}
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A minimal ACME CA: it checks every JWS (nonce, URL, and signature),
+// validates http-01 challenges against a URL the test points it at, and
+// issues certificates from its own root
+type fakeACME struct {
+	srv          *httptest.Server
+	challengeURL string
+
+	mu          sync.Mutex
+	nonces      map[string]bool
+	nextNonce   int
+	badNonce    bool
+	accountJWK  map[string]string
+	authzValid  bool
+	token       string
+	orderStatus string
+	domains     []string
+	requests    int
+	caKey       *ecdsa.PrivateKey
+	caCert      *x509.Certificate
+	issuedChain []byte
+}
+
+func newFakeACME(t *testing.T) *fakeACME {
+	f := &fakeACME{nonces: map[string]bool{}, token: "tok-123", badNonce: true}
+	f.caKey, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Fake ACME Root"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, _ := x509.CreateCertificate(rand.Reader, template, template, &f.caKey.PublicKey, f.caKey)
+	f.caCert, _ = x509.ParseCertificate(der)
+	f.srv = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.srv.Close)
+	return f
+}
+
+func (f *fakeACME) newNonce(w http.ResponseWriter) {
+	f.nextNonce++
+	nonce := fmt.Sprintf("nonce-%d", f.nextNonce)
+	f.nonces[nonce] = true
+	w.Header().Set("Replay-Nonce", nonce)
+}
+
+func (f *fakeACME) problem(w http.ResponseWriter, status int, kind, detail string) {
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(acmeProblem{Type: "urn:ietf:params:acme:error:" + kind, Detail: detail})
+}
+
+func (f *fakeACME) serve(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests++
+	base := f.srv.URL
+
+	switch {
+	case r.URL.Path == "/directory":
+		json.NewEncoder(w).Encode(map[string]string{"newNonce": base + "/nonce", "newAccount": base + "/account", "newOrder": base + "/order"})
+		return
+	case r.URL.Path == "/nonce":
+		f.newNonce(w)
+		return
+	}
+
+	var jws struct{ Protected, Payload, Signature string }
+	json.NewDecoder(r.Body).Decode(&jws)
+	header, _ := base64.RawURLEncoding.DecodeString(jws.Protected)
+	var protected struct {
+		Alg, Nonce, URL, Kid string
+		JWK                  map[string]string
+	}
+	json.Unmarshal(header, &protected)
+	f.newNonce(w)
+	if !f.nonces[protected.Nonce] || f.badNonce {
+		f.badNonce = false
+		f.problem(w, http.StatusBadRequest, "badNonce", "stale nonce")
+		return
+	}
+	delete(f.nonces, protected.Nonce)
+	if protected.URL != base+r.URL.Path {
+		f.problem(w, http.StatusBadRequest, "malformed", "url mismatch")
+		return
+	}
+
+	jwk := protected.JWK
+	if r.URL.Path == "/account" {
+		f.accountJWK = jwk
+		w.Header().Set("Location", base+"/acct/1")
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, `{"status":"valid"}`)
+		return
+	}
+	if protected.Kid != base+"/acct/1" {
+		f.problem(w, http.StatusUnauthorized, "unauthorized", "unknown account")
+		return
+	}
+	jwk = f.accountJWK
+	if !verifyES256(jwk, jws.Protected+"."+jws.Payload, jws.Signature) {
+		f.problem(w, http.StatusBadRequest, "malformed", "bad signature")
+		return
+	}
+	payload, _ := base64.RawURLEncoding.DecodeString(jws.Payload)
+
+	order := func() {
+		json.NewEncoder(w).Encode(acmeOrder{Status: f.orderStatus, Authorizations: []string{base + "/authz/1"}, Finalize: base + "/finalize", Certificate: base + "/cert"})
+	}
+	switch r.URL.Path {
+	case "/order":
+		var req struct {
+			Identifiers []struct{ Value string }
+		}
+		json.Unmarshal(payload, &req)
+		f.domains = nil
+		for _, id := range req.Identifiers {
+			f.domains = append(f.domains, id.Value)
+		}
+		f.orderStatus = "pending"
+		w.Header().Set("Location", base+"/order/1")
+		w.WriteHeader(http.StatusCreated)
+		order()
+	case "/authz/1":
+		status := "pending"
+		if f.authzValid {
+			status = "valid"
+		}
+		fmt.Fprintf(w, `{"status":%q,"identifier":{"value":%q},"challenges":[{"type":"dns-01","url":"%s/chal/2","token":"x"},{"type":"http-01","url":"%s/chal/1","token":%q}]}`, status, f.domains[0], base, base, f.token)
+	case "/chal/1":
+		resp, err := http.Get(f.challengeURL + acmeChallengePrefix + f.token)
+		if err == nil {
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			f.authzValid = string(body) == f.token+"."+jwkThumbprint(jwk)
+		}
+		io.WriteString(w, `{"status":"processing"}`)
+	case "/finalize":
+		var req struct{ CSR string }
+		json.Unmarshal(payload, &req)
+		der, _ := base64.RawURLEncoding.DecodeString(req.CSR)
+		csr, err := x509.ParseCertificateRequest(der)
+		if err != nil || !f.authzValid || !slices.Equal(csr.DNSNames, f.domains) {
+			f.problem(w, http.StatusForbidden, "unauthorized", "not authorized")
+			return
+		}
+		leaf := &x509.Certificate{
+			SerialNumber: big.NewInt(2),
+			Subject:      pkix.Name{CommonName: f.domains[0]},
+			DNSNames:     csr.DNSNames,
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+		}
+		leafDER, _ := x509.CreateCertificate(rand.Reader, leaf, f.caCert, csr.PublicKey, f.caKey)
+		f.issuedChain = append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leafDER}), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: f.caCert.Raw})...)
+		f.orderStatus = "processing"
+		order()
+	case "/order/1":
+		if f.orderStatus == "processing" {
+			f.orderStatus = "valid"
+		}
+		order()
+	case "/cert":
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		w.Write(f.issuedChain)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func jwkKey(jwk map[string]string) *ecdsa.PublicKey {
+	x, _ := base64.RawURLEncoding.DecodeString(jwk["x"])
+	y, _ := base64.RawURLEncoding.DecodeString(jwk["y"])
+	return &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+}
+
+func jwkThumbprint(jwk map[string]string) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf(`{"crv":%q,"kty":%q,"x":%q,"y":%q}`, jwk["crv"], jwk["kty"], jwk["x"], jwk["y"])))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func verifyES256(jwk map[string]string, signingInput, signature string) bool {
+	sig, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || len(sig) != 64 {
+		return false
+	}
+	digest := sha256.Sum256([]byte(signingInput))
+	return ecdsa.Verify(jwkKey(jwk), digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:]))
+}
+
+func TestACMEIssuesCertificate(t *testing.T) {
+	old := acmePollInterval
+	acmePollInterval = time.Millisecond
+	t.Cleanup(func() { acmePollInterval = old })
+
+	ca := newFakeACME(t)
+	dir := t.TempDir()
+	domains := []string{"bricks.example", "www.bricks.example"}
+	m, err := newACMEManager(dir, ca.srv.URL+"/directory", "ops@bricks.example", domains)
+	if err != nil {
+		t.Fatalf("newACMEManager: %v", err)
+	}
+	challenges := httptest.NewServer(&m.challenges)
+	defer challenges.Close()
+	ca.challengeURL = challenges.URL
+
+	if _, err := m.getCertificate(nil); err == nil {
+		t.Error("expected no certificate before issuance")
+	}
+	if err := m.renew(context.Background()); err != nil {
+		t.Fatalf("renew: %v", err)
+	}
+	cert, err := m.getCertificate(&tls.ClientHelloInfo{ServerName: "bricks.example"})
+	if err != nil {
+		t.Fatalf("getCertificate: %v", err)
+	}
+	leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+	if !slices.Equal(leaf.DNSNames, domains) {
+		t.Errorf("certificate names %v, want %v", leaf.DNSNames, domains)
+	}
+	if len(m.challenges.tokens) != 0 {
+		t.Error("challenge tokens should be cleared once authorized")
+	}
+
+	// A restart picks up the cached account key and certificate without
+	// going back to the CA
+	ca.mu.Lock()
+	before := ca.requests
+	ca.mu.Unlock()
+	m2, err := newACMEManager(dir, ca.srv.URL+"/directory", "", domains)
+	if err != nil {
+		t.Fatalf("newACMEManager: %v", err)
+	}
+	if err := m2.renew(context.Background()); err != nil {
+		t.Fatalf("renew: %v", err)
+	}
+	ca.mu.Lock()
+	after := ca.requests
+	ca.mu.Unlock()
+	if after != before {
+		t.Errorf("cached certificate should not be reissued, CA saw %d more requests", after-before)
+	}
+	if m2.client.jwk() != m.client.jwk() {
+		t.Error("account key should persist")
+	}
+
+	// Adding a domain means a new certificate
+	m3, _ := newACMEManager(dir, ca.srv.URL+"/directory", "", append(domains, "api.bricks.example"))
+	if m3.current(time.Now()) {
+		t.Error("certificate should not count as current for a new domain")
+	}
+}
+
+func TestACMEChallengeHandler(t *testing.T) {
+	var ch acmeChallenges
+	ch.set("abc", "abc.thumb")
+
+	rec := httptest.NewRecorder()
+	ch.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, acmeChallengePrefix+"abc", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "abc.thumb" {
+		t.Errorf("challenge response %d %q", rec.Code, rec.Body)
+	}
+	rec = httptest.NewRecorder()
+	ch.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, acmeChallengePrefix+"other", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("unknown token: expected 404, got %d", rec.Code)
+	}
+
+	oldPort := port
+	port = "443"
+	t.Cleanup(func() { port = oldPort })
+	rec = httptest.NewRecorder()
+	ch.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://bricks.example:80/render?x=1", nil))
+	if loc := rec.Header().Get("Location"); rec.Code != http.StatusMovedPermanently || loc != "https://bricks.example/render?x=1" {
+		t.Errorf("expected a redirect to HTTPS, got %d %q", rec.Code, loc)
+	}
+	rec = httptest.NewRecorder()
+	ch.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "http://bricks.example/render", strings.NewReader("{}")))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("POST over HTTP: expected 400, got %d", rec.Code)
+	}
+}
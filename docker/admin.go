@@ -0,0 +1,35 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// Admin endpoints are disabled unless ADMIN_TOKEN is set
+var adminToken = getEnv("ADMIN_TOKEN", "")
+
+// Wrap an admin handler so it requires ADMIN_TOKEN, sent either as a bearer
+// token or as the HTTP basic auth password (so browsers can use it too)
+func requireAdmin(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if adminToken == "" {
+			sendError(w, http.StatusForbidden, "Admin endpoints are disabled", "Set ADMIN_TOKEN to enable them")
+			return
+		}
+
+		token := ""
+		if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+			token = strings.TrimPrefix(auth, "Bearer ")
+		} else if _, password, ok := r.BasicAuth(); ok {
+			token = password
+		}
+
+		if subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="lego-renderer admin"`)
+			sendError(w, http.StatusUnauthorized, "Unauthorized", "")
+			return
+		}
+		handler(w, r)
+	}
+}
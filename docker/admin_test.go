@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequireAdmin(t *testing.T) {
+	ok := requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	run := func(token string, setup func(r *http.Request)) int {
+		old := adminToken
+		adminToken = token
+		defer func() { adminToken = old }()
+
+		req := httptest.NewRequest(http.MethodPost, "/admin/selftest", nil)
+		if setup != nil {
+			setup(req)
+		}
+		rec := httptest.NewRecorder()
+		ok(rec, req)
+		return rec.Code
+	}
+
+	if code := run("", nil); code != http.StatusForbidden {
+		t.Errorf("unconfigured: expected 403, got %d", code)
+	}
+	if code := run("secret", nil); code != http.StatusUnauthorized {
+		t.Errorf("no credentials: expected 401, got %d", code)
+	}
+	if code := run("secret", func(r *http.Request) { r.Header.Set("Authorization", "Bearer wrong") }); code != http.StatusUnauthorized {
+		t.Errorf("wrong token: expected 401, got %d", code)
+	}
+	if code := run("secret", func(r *http.Request) { r.Header.Set("Authorization", "Bearer secret") }); code != http.StatusNoContent {
+		t.Errorf("bearer token: expected 204, got %d", code)
+	}
+	if code := run("secret", func(r *http.Request) { r.SetBasicAuth("admin", "secret") }); code != http.StatusNoContent {
+		t.Errorf("basic auth: expected 204, got %d", code)
+	}
+}
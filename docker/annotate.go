@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// With annotate, renders carry classes and data attributes for embedding
+// pages to style and script without reading path geometry:
+//
+//	<svg data-part="3001">                   part renders
+//	<g class="lineset edges" ...>            one per line set: edges, hidden,
+//	                                         ghost, pattern, or object
+//	<path class="fill" ...>                  a face fill
+//	<path class="edge silhouette" ...>       a stroke, by edge type
+//
+// Every drawn edge type gets a line set of its own (as with edgeColors) so
+// strokes can be classed by type; the Edges line set keeps only its fills.
+// An edge of several types is drawn in each. Separate objects' line sets
+// also carry data-object and data-part; see objects.go.
+var svgLinesetStartPattern = regexp.MustCompile(`<g\b[^>]*\bid="ViewLayer_([^"]+)"[^>]*>`)
+
+// Annotate a rendered SVG's line sets. objectRefs maps separate objects'
+// ids to the references they place.
+func applyAnnotations(svg []byte, objectRefs map[string]string) []byte {
+	starts := svgLinesetStartPattern.FindAllSubmatchIndex(svg, -1)
+	if len(starts) == 0 {
+		return svg
+	}
+	var b bytes.Buffer
+	b.Write(svg[:starts[0][0]])
+	for i, m := range starts {
+		end := len(svg)
+		if i+1 < len(starts) {
+			end = starts[i+1][0]
+		}
+		name := string(svg[m[2]:m[3]])
+		kind, edgeClass, attrs := linesetAnnotation(name, objectRefs)
+		// The Edges line set's strokes are drawn again by edge type
+		dropStrokes := name == "Edges"
+
+		tag := svg[m[0]:m[1]]
+		b.WriteString(`<g class="lineset ` + kind + `"` + attrs)
+		b.Write(tag[len("<g"):])
+		b.Write(svgPathPattern.ReplaceAllFunc(svg[m[1]:end], func(path []byte) []byte {
+			if !bytes.Contains(path, []byte(`stroke="none"`)) {
+				if dropStrokes {
+					return nil
+				}
+				return append([]byte(`<path class="`+edgeClass+`"`), path[len("<path"):]...)
+			}
+			return append([]byte(`<path class="fill"`), path[len("<path"):]...)
+		}))
+	}
+	return b.Bytes()
+}
+
+// The class and data attributes for a ViewLayer_<name> line set, and the
+// class for its strokes
+func linesetAnnotation(name string, objectRefs map[string]string) (kind, edgeClass, attrs string) {
+	switch {
+	case strings.HasPrefix(name, "ColorEdges_"):
+		edgeType := strings.TrimPrefix(name, "ColorEdges_")
+		return "edges", "edge " + strings.ReplaceAll(edgeType, "_", "-"), ` data-edge-type="` + escapeXML(edgeType) + `"`
+	case strings.HasPrefix(name, "ObjectEdges_"):
+		id := strings.TrimPrefix(name, "ObjectEdges_")
+		attrs = ` data-object="` + escapeXML(id) + `"`
+		if ref := objectRefs[id]; ref != "" {
+			attrs += ` data-part="` + escapeXML(strings.TrimSuffix(ref, ".dat")) + `"`
+		}
+		return "object", "edge", attrs
+	case name == "Edges":
+		return "edges", "edge", ""
+	}
+	kind = strings.ToLower(strings.TrimSuffix(name, "Edges"))
+	return kind, "edge " + kind, ""
+}
+
+// Mark a part render's root with its part number
+func annotatePart(svg []byte, partNumber string) []byte {
+	loc := svgRootPattern.FindIndex(svg)
+	if loc == nil {
+		return svg
+	}
+	out := make([]byte, 0, len(svg)+len(partNumber)+16)
+	out = append(out, svg[:loc[0]+len("<svg")]...)
+	out = append(out, ` data-part="`+escapeXML(partNumber)+`"`...)
+	return append(out, svg[loc[0]+len("<svg"):]...)
+}
+
+// The references a render's separate objects place, by object id
+func readObjectRefs(objectsFile string) map[string]string {
+	if objectsFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(objectsFile)
+	if err != nil {
+		return nil
+	}
+	var manifest struct {
+		Objects []sceneObject `json:"objects"`
+	}
+	if json.Unmarshal(data, &manifest) != nil {
+		return nil
+	}
+	refs := make(map[string]string, len(manifest.Objects))
+	for _, o := range manifest.Objects {
+		refs[o.ID] = o.Ref
+	}
+	return refs
+}
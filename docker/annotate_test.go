@@ -0,0 +1,54 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestAnnotatedRender(t *testing.T) {
+	annotate := true
+	svg := renderWithFakeBlender(t, RenderRequest{Annotate: &annotate, EdgeColors: &EdgeColors{Crease: "red"}})
+
+	for _, want := range []string{
+		`<g class="lineset edges" id="ViewLayer_Edges"`,
+		`<g class="lineset edges" data-edge-type="silhouette" id="ViewLayer_ColorEdges_silhouette"`,
+		`<path class="fill"`,
+		`<path class="edge silhouette"`,
+		`<path class="edge border"`,
+	} {
+		if !strings.Contains(svg, want) {
+			t.Errorf("missing %s:\n%s", want, svg)
+		}
+	}
+	// The Edges strokes are left to the per-type line sets
+	edges := regexp.MustCompile(`(?s)id="ViewLayer_Edges".*?id="ViewLayer_ColorEdges`).FindString(svg)
+	if strings.Contains(edges, `class="edge`) || !strings.Contains(edges, `class="fill"`) {
+		t.Errorf("expected the Edges line set to keep only its fills:\n%s", edges)
+	}
+	// Colored edge types still get their colors
+	if !regexp.MustCompile(`<path class="edge crease"[^>]*stroke="red"`).MatchString(svg) {
+		t.Errorf("expected red creases:\n%s", svg)
+	}
+}
+
+func TestLinesetAnnotation(t *testing.T) {
+	refs := map[string]string{"1": "3001.dat", "2": "roof.ldr"}
+	for name, want := range map[string][3]string{
+		"HiddenEdges":                  {"hidden", "edge hidden", ""},
+		"GhostEdges":                   {"ghost", "edge ghost", ""},
+		"ColorEdges_material_boundary": {"edges", "edge material-boundary", ` data-edge-type="material_boundary"`},
+		"ObjectEdges_1":                {"object", "edge", ` data-object="1" data-part="3001"`},
+		"ObjectEdges_2":                {"object", "edge", ` data-object="2" data-part="roof.ldr"`},
+	} {
+		kind, edgeClass, attrs := linesetAnnotation(name, refs)
+		if got := [3]string{kind, edgeClass, attrs}; got != want {
+			t.Errorf("%s: got %q, want %q", name, got, want)
+		}
+	}
+
+	svg := annotatePart([]byte(`<?xml version='1.0'?><svg width="10" height="10"></svg>`), "3001")
+	if !strings.Contains(string(svg), `<svg data-part="3001" width="10"`) {
+		t.Errorf("expected the part number on the root: %s", svg)
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// With API_KEYS_FILE set, render endpoints require an API key, sent as a
+// bearer token or in X-API-Key. Each key belongs to a team and may have a
+// monthly quota of Blender renders (cache hits are free) and a cap on
+// concurrent requests. Usage is tracked per key in usage.go.
+var apiKeysFile = getEnv("API_KEYS_FILE", "")
+
+type apiKey struct {
+	Key  string `json:"key"`
+	Name string `json:"name"`
+	// MonthlyQuota limits Blender renders per calendar month (0: unlimited)
+	MonthlyQuota int64 `json:"monthlyQuota"`
+	// MaxConcurrent limits requests in flight (0: unlimited)
+	MaxConcurrent int `json:"maxConcurrent"`
+	// PrivatePartsBytes limits the key's private parts (0: the
+	// PRIVATE_PARTS_BYTES default); see privateparts.go
+	PrivatePartsBytes int64 `json:"privatePartsBytes"`
+
+	inFlight chan struct{}
+}
+
+// Keys by their value; nil when API keys are disabled
+var apiKeys map[string]*apiKey
+
+func loadAPIKeys(path string) (map[string]*apiKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var list []*apiKey
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	keys := make(map[string]*apiKey, len(list))
+	names := make(map[string]bool)
+	for i, k := range list {
+		if k.Key == "" || k.Name == "" {
+			return nil, fmt.Errorf("%s: key %d needs a key and a name", path, i+1)
+		}
+		if keys[k.Key] != nil || names[k.Name] {
+			return nil, fmt.Errorf("%s: duplicate key or name %q", path, k.Name)
+		}
+		if k.MaxConcurrent > 0 {
+			k.inFlight = make(chan struct{}, k.MaxConcurrent)
+		}
+		keys[k.Key] = k
+		names[k.Name] = true
+	}
+	return keys, nil
+}
+
+// Find the key a request authenticates with
+func requestAPIKey(r *http.Request) *apiKey {
+	token := r.Header.Get("X-API-Key")
+	if auth := r.Header.Get("Authorization"); token == "" && strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimPrefix(auth, "Bearer ")
+	}
+	if token == "" {
+		return nil
+	}
+	// Compare fixed-size digests so lookups don't leak key prefixes
+	sum := sha256.Sum256([]byte(token))
+	for value, k := range apiKeys {
+		candidate := sha256.Sum256([]byte(value))
+		if subtle.ConstantTimeCompare(sum[:], candidate[:]) == 1 {
+			return k
+		}
+	}
+	return nil
+}
+
+type apiKeyContextKey struct{}
+
+func apiKeyFromContext(ctx context.Context) *apiKey {
+	k, _ := ctx.Value(apiKeyContextKey{}).(*apiKey)
+	return k
+}
+
+// Wrap a handler so it requires an API key when API keys are enabled, and
+// holds one of the key's concurrency slots while it runs
+func requireAPIKey(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if apiKeys == nil {
+			handler(w, r)
+			return
+		}
+		key := requestAPIKey(r)
+		if key == nil {
+			sendError(w, http.StatusUnauthorized, "API key required", "Send it as Authorization: Bearer <key> or X-API-Key")
+			return
+		}
+		if key.inFlight != nil {
+			select {
+			case key.inFlight <- struct{}{}:
+				defer func() { <-key.inFlight }()
+			default:
+				recordRejected("concurrency")
+				w.Header().Set("Retry-After", "1")
+				sendError(w, http.StatusTooManyRequests, "Too many concurrent requests",
+					fmt.Sprintf("Key %s allows %d at a time", key.Name, key.MaxConcurrent))
+				return
+			}
+		}
+		handler(w, r.WithContext(context.WithValue(r.Context(), apiKeyContextKey{}, key)))
+	}
+}
+
+// Count a Blender render against the request's key, failing once the
+// monthly quota is used up. Requests without a key, and replays, aren't
+// metered, and a render already charged isn't charged again.
+func chargeRender(ctx context.Context) error {
+	key := apiKeyFromContext(ctx)
+	charged, _ := ctx.Value(renderChargedKey{}).(bool)
+	if key == nil || replayMode(ctx) != "" || charged {
+		return nil
+	}
+	return chargeKeyRender(key, time.Now())
+}
+
+// Count a render against key on now's day, failing once the monthly quota
+// is used up
+func chargeKeyRender(key *apiKey, now time.Time) error {
+	usage.Lock()
+	defer usage.Unlock()
+	if key.MonthlyQuota > 0 && monthlyRendersLocked(key.Name, now) >= key.MonthlyQuota {
+		recordRejected("quota")
+		return &RenderError{http.StatusTooManyRequests, "Monthly render quota exceeded",
+			fmt.Sprintf("Key %s is limited to %d renders per month", key.Name, key.MonthlyQuota)}
+	}
+	usageDayLocked(key.Name, now).Renders++
+	return nil
+}
+
+// Give back a render charged on the day of at that didn't happen after all
+func refundRender(key *apiKey, at time.Time) {
+	usage.Lock()
+	defer usage.Unlock()
+	if day := usageDayLocked(key.Name, at); day.Renders > 0 {
+		day.Renders--
+	}
+}
+
+type renderChargedKey struct{}
+
+// Mark ctx's render as charged to its key already, as renderPart does before
+// a caller joins another's identical render
+func withRenderCharged(ctx context.Context) context.Context {
+	return context.WithValue(ctx, renderChargedKey{}, true)
+}
+
+type AccountUsage struct {
+	Name          string `json:"name"`
+	Month         string `json:"month"`
+	Renders       int64  `json:"renders"`
+	MonthlyQuota  int64  `json:"monthlyQuota,omitempty"`
+	Remaining     *int64 `json:"remaining,omitempty"`
+	MaxConcurrent int    `json:"maxConcurrent,omitempty"`
+	InFlight      int    `json:"inFlight"`
+}
+
+// Usage endpoint for the calling key
+func handleAccountUsage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		sendError(w, http.StatusMethodNotAllowed, "Method not allowed", "")
+		return
+	}
+	if apiKeys == nil {
+		sendError(w, http.StatusNotFound, "API keys are disabled", "Set API_KEYS_FILE to enable them")
+		return
+	}
+	key := requestAPIKey(r)
+	if key == nil {
+		sendError(w, http.StatusUnauthorized, "API key required", "Send it as Authorization: Bearer <key> or X-API-Key")
+		return
+	}
+
+	now := time.Now()
+	resp := AccountUsage{
+		Name:          key.Name,
+		Month:         now.UTC().Format("2006-01"),
+		Renders:       monthlyRenders(key.Name, now),
+		MonthlyQuota:  key.MonthlyQuota,
+		MaxConcurrent: key.MaxConcurrent,
+		InFlight:      len(key.inFlight),
+	}
+	if key.MonthlyQuota > 0 {
+		remaining := max(key.MonthlyQuota-resp.Renders, 0)
+		resp.Remaining = &remaining
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
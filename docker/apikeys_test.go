@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Install API keys from a keys file body and start with no usage
+func withAPIKeys(t *testing.T, config string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "keys.json")
+	os.WriteFile(path, []byte(config), 0o644)
+	keys, err := loadAPIKeys(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := apiKeys
+	apiKeys = keys
+	usage.Lock()
+	oldUsage := usage.byKey
+	usage.byKey = make(map[string]map[string]*usageDay)
+	usage.Unlock()
+	t.Cleanup(func() {
+		apiKeys = old
+		usage.Lock()
+		usage.byKey = oldUsage
+		usage.Unlock()
+	})
+}
+
+func TestLoadAPIKeysRejectsBadFiles(t *testing.T) {
+	for name, config := range map[string]string{
+		"not JSON":       `{`,
+		"missing name":   `[{"key":"k1"}]`,
+		"duplicate key":  `[{"key":"k1","name":"a"},{"key":"k1","name":"b"}]`,
+		"duplicate name": `[{"key":"k1","name":"a"},{"key":"k2","name":"a"}]`,
+	} {
+		path := filepath.Join(t.TempDir(), "keys.json")
+		os.WriteFile(path, []byte(config), 0o644)
+		if _, err := loadAPIKeys(path); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestRequireAPIKey(t *testing.T) {
+	withAPIKeys(t, `[{"key":"k1","name":"team-a","maxConcurrent":1}]`)
+
+	release := make(chan struct{})
+	entered := make(chan string, 2)
+	handler := requireAPIKey(func(w http.ResponseWriter, r *http.Request) {
+		if key := apiKeyFromContext(r.Context()); key != nil {
+			entered <- key.Name
+		}
+		<-release
+	})
+	call := func(header, value string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/render", nil)
+		if header != "" {
+			r.Header.Set(header, value)
+		}
+		handler(w, r)
+		return w
+	}
+
+	if w := call("", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("no key: expected 401, got %d", w.Code)
+	}
+	if w := call("X-API-Key", "wrong"); w.Code != http.StatusUnauthorized {
+		t.Errorf("unknown key: expected 401, got %d", w.Code)
+	}
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- call("Authorization", "Bearer k1") }()
+	if name := <-entered; name != "team-a" {
+		t.Errorf("handler saw key %q", name)
+	}
+	w := call("X-API-Key", "k1")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("over the concurrency cap: expected 429 with Retry-After, got %d", w.Code)
+	}
+	close(release)
+	if w := <-done; w.Code != http.StatusOK {
+		t.Errorf("first request: expected 200, got %d", w.Code)
+	}
+	if w := call("X-API-Key", "k1"); w.Code != http.StatusOK {
+		t.Errorf("after the slot was released: expected 200, got %d", w.Code)
+	}
+
+	apiKeys = nil
+	if w := call("", ""); w.Code != http.StatusOK {
+		t.Errorf("keys disabled: expected 200, got %d", w.Code)
+	}
+}
+
+func TestMonthlyQuota(t *testing.T) {
+	withFakeBlender(t)
+	withTestLibrary(t, map[string]string{"3001": "0 Brick 2 x 4\n", "3003": "0 Brick 2 x 2\n"})
+	withRenderCache(t)
+	withAPIKeys(t, `[{"key":"k1","name":"team-a","monthlyQuota":1}]`)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/render", requireAPIKey(handleRender))
+	mux.HandleFunc("/account/usage", handleAccountUsage)
+	call := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("X-API-Key", "k1")
+		mux.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := call(http.MethodPost, "/render", `{"partNumber":"3001"}`); w.Code != http.StatusOK {
+		t.Fatalf("first render: %d %s", w.Code, w.Body)
+	}
+	// Cache hits don't count against the quota
+	if w := call(http.MethodPost, "/render", `{"partNumber":"3001"}`); w.Code != http.StatusOK {
+		t.Errorf("cached render: expected 200, got %d %s", w.Code, w.Body)
+	}
+	if w := call(http.MethodPost, "/render", `{"partNumber":"3003"}`); w.Code != http.StatusTooManyRequests {
+		t.Errorf("over quota: expected 429, got %d %s", w.Code, w.Body)
+	}
+
+	w := call(http.MethodGet, "/account/usage", "")
+	var got AccountUsage
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("usage: %d %s", w.Code, w.Body)
+	}
+	if got.Name != "team-a" || got.Renders != 1 || got.MonthlyQuota != 1 || got.Remaining == nil || *got.Remaining != 0 {
+		t.Errorf("unexpected usage %+v", got)
+	}
+	if got.Month != time.Now().UTC().Format("2006-01") {
+		t.Errorf("usage for month %q", got.Month)
+	}
+}
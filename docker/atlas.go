@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	atlasDefaultSize = 96
+	atlasMaxParts    = 300
+)
+
+type AtlasSprite struct {
+	X      int `json:"x"`
+	Y      int `json:"y"`
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+type AtlasMap struct {
+	Image   string                 `json:"image"`
+	Width   int                    `json:"width"`
+	Height  int                    `json:"height"`
+	Size    int                    `json:"size"`
+	Sprites map[string]AtlasSprite `json:"sprites"`
+	// Missing lists requested parts that aren't in the LDraw library; their
+	// cells are left empty
+	Missing []string `json:"missing,omitempty"`
+}
+
+// atlasLayout places part thumbnails on a square-ish grid of equal cells,
+// in request order
+type atlasLayout struct {
+	keys    []string
+	items   []InventoryItem
+	size    int
+	columns int
+	rows    int
+}
+
+// Atlas endpoint: GET /atlas?parts=3001,3003:4&size=96[&format=svg|png|json][&depth=16]
+func handleAtlas(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		sendError(w, http.StatusMethodNotAllowed, "Method not allowed", "")
+		return
+	}
+
+	layout, err := parseAtlasQuery(r.URL.Query())
+	if err != nil {
+		sendError(w, http.StatusBadRequest, err.Error(), "")
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "svg"
+	}
+	switch format {
+	case "json":
+		// The map is deterministic, so it's served without rendering
+		m := layout.coordinateMap()
+		q := r.URL.Query()
+		q.Set("format", "svg")
+		m.Image = "/atlas?" + q.Encode()
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(m)
+		return
+	case "svg":
+	case "png":
+		if _, err := parsePNGDepth(r.URL.Query().Get("depth")); err != nil {
+			sendError(w, http.StatusBadRequest, err.Error(), "")
+			return
+		}
+	default:
+		sendError(w, http.StatusBadRequest, "format must be svg, png, or json", "")
+		return
+	}
+
+	start := time.Now()
+	base, err := thumbnailOptions(RenderRequest{ColorScheme: r.URL.Query().Get("scheme")})
+	if err != nil {
+		sendError(w, http.StatusBadRequest, err.Error(), "")
+		return
+	}
+	thumbs := renderItems(r.Context(), layout.items, base)
+	if r.Context().Err() != nil {
+		log.Printf("Atlas cancelled: %v", r.Context().Err())
+		return
+	}
+	svg, missing := layout.build(thumbs, base)
+	log.Printf("Atlas: %d sprites at %dpx in %.2fs", len(layout.items), layout.size, time.Since(start).Seconds())
+
+	if len(missing) > 0 {
+		w.Header().Set("X-Missing-Parts", strings.Join(uniqueStrings(missing), ","))
+	}
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+
+	if format == "png" {
+		png, err := convertSVG(r.Context(), "png", [][]byte{svg})
+		if err != nil {
+			log.Printf("Atlas PNG conversion failed: %v", err)
+			sendError(w, http.StatusInternalServerError, "PNG conversion failed", err.Error())
+			return
+		}
+		depth, _ := parsePNGDepth(r.URL.Query().Get("depth"))
+		if png, err = tagPNG(png, renderMetadata("atlas of "+strings.Join(layout.keys, ","), base), depth); err != nil {
+			log.Printf("Atlas PNG tagging failed: %v", err)
+			sendError(w, http.StatusInternalServerError, "PNG conversion failed", err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(png)
+		return
+	}
+	w.Header().Set("Content-Type", "image/svg+xml")
+	writeSVG(w, r, svg)
+}
+
+// Parse parts (comma-separated, each optionally "part:color") and size
+func parseAtlasQuery(q url.Values) (atlasLayout, error) {
+	layout := atlasLayout{size: atlasDefaultSize}
+	if s := q.Get("size"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 16 || n > 512 {
+			return layout, fmt.Errorf("size must be an integer between 16 and 512")
+		}
+		layout.size = n
+	}
+
+	seen := make(map[string]bool)
+	for _, spec := range strings.Split(q.Get("parts"), ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" || seen[spec] {
+			continue
+		}
+		seen[spec] = true
+
+		item := InventoryItem{PartNumber: spec, Quantity: 1}
+		if part, color, ok := strings.Cut(spec, ":"); ok {
+			code, err := strconv.Atoi(color)
+			if err != nil {
+				return layout, fmt.Errorf("invalid color in %q", spec)
+			}
+			if _, ok := lookupColor(code); !ok {
+				return layout, fmt.Errorf("color %d is not a known LDraw color code", code)
+			}
+			item.PartNumber = part
+			item.Color = &code
+		}
+		if item.PartNumber == "" {
+			return layout, fmt.Errorf("invalid part %q", spec)
+		}
+		layout.keys = append(layout.keys, spec)
+		layout.items = append(layout.items, item)
+	}
+	if len(layout.items) == 0 {
+		return layout, fmt.Errorf("parts is required")
+	}
+	if len(layout.items) > atlasMaxParts {
+		return layout, fmt.Errorf("parts must contain at most %d entries", atlasMaxParts)
+	}
+
+	layout.columns = int(math.Ceil(math.Sqrt(float64(len(layout.items)))))
+	layout.rows = (len(layout.items) + layout.columns - 1) / layout.columns
+	return layout, nil
+}
+
+func (l atlasLayout) sprite(i int) AtlasSprite {
+	return AtlasSprite{X: (i % l.columns) * l.size, Y: (i / l.columns) * l.size, Width: l.size, Height: l.size}
+}
+
+func (l atlasLayout) coordinateMap() AtlasMap {
+	m := AtlasMap{
+		Width:   l.columns * l.size,
+		Height:  l.rows * l.size,
+		Size:    l.size,
+		Sprites: make(map[string]AtlasSprite, len(l.keys)),
+	}
+	for i, key := range l.keys {
+		m.Sprites[key] = l.sprite(i)
+		if findPartFile(l.items[i].PartNumber) == "" {
+			m.Missing = append(m.Missing, key)
+		}
+	}
+	return m
+}
+
+// Build the atlas SVG. Each sprite also gets a <view> so that
+// atlas.svg#part-3001 (or #part-3001-4 with a color) shows just that part.
+func (l atlasLayout) build(thumbs map[string]thumbnail, base RenderOptions) ([]byte, []string) {
+	var b strings.Builder
+	var missing []string
+	b.WriteString(svgDocumentStart(float64(l.columns*l.size), float64(l.rows*l.size)))
+	for i, item := range l.items {
+		s := l.sprite(i)
+		fmt.Fprintf(&b, `<view id="part-%s" viewBox="%d %d %d %d" />`+"\n",
+			escapeXML(strings.ReplaceAll(l.keys[i], ":", "-")), s.X, s.Y, s.Width, s.Height)
+		thumb := thumbs[itemKey(item, base)]
+		if thumb.err != nil || thumb.svg == nil {
+			missing = append(missing, item.PartNumber)
+			continue
+		}
+		b.WriteString(embedSVG(thumb.svg, float64(s.X), float64(s.Y), float64(s.Width), float64(s.Height)))
+		b.WriteString("\n")
+	}
+	b.WriteString("</svg>\n")
+	return []byte(b.String()), missing
+}
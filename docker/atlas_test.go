@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestParseAtlasQuery(t *testing.T) {
+	withTestLibrary(t, nil)
+	tooMany := make([]string, atlasMaxParts+1)
+	for i := range tooMany {
+		tooMany[i] = strconv.Itoa(i)
+	}
+
+	layout, err := parseAtlasQuery(url.Values{"parts": {"3001,3003:4, 3024,3001"}, "size": {"64"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(layout.items) != 3 || layout.columns != 2 || layout.rows != 2 || layout.size != 64 {
+		t.Fatalf("unexpected layout %+v", layout)
+	}
+	if c := layout.items[1].Color; c == nil || *c != 4 || layout.items[1].PartNumber != "3003" {
+		t.Errorf("color not parsed: %+v", layout.items[1])
+	}
+	if s := layout.sprite(2); s != (AtlasSprite{X: 0, Y: 64, Width: 64, Height: 64}) {
+		t.Errorf("unexpected third sprite %+v", s)
+	}
+
+	for _, q := range []url.Values{
+		{},
+		{"parts": {"3001"}, "size": {"8"}},
+		{"parts": {"3001:red"}},
+		{"parts": {"3001:999"}},
+		{"parts": {strings.Join(tooMany, ",")}},
+	} {
+		if _, err := parseAtlasQuery(q); err == nil {
+			t.Errorf("expected error for %v", q)
+		}
+	}
+}
+
+func TestAtlasMap(t *testing.T) {
+	withTestLibrary(t, map[string]string{"3001": "0 Brick 2 x 4\n"})
+
+	req := httptest.NewRequest(http.MethodGet, "/atlas?parts=3001,9999&format=json", nil)
+	rec := httptest.NewRecorder()
+	handleAtlas(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	var m AtlasMap
+	if err := json.Unmarshal(rec.Body.Bytes(), &m); err != nil {
+		t.Fatal(err)
+	}
+	if m.Width != 192 || m.Height != 96 || m.Sprites["9999"].X != 96 {
+		t.Errorf("unexpected map %+v", m)
+	}
+	if len(m.Missing) != 1 || m.Missing[0] != "9999" {
+		t.Errorf("unexpected missing parts %v", m.Missing)
+	}
+	if !strings.Contains(m.Image, "format=svg") {
+		t.Errorf("image URL should request the SVG atlas: %s", m.Image)
+	}
+}
+
+func TestAtlasSVG(t *testing.T) {
+	withFakeBlender(t)
+	withTestLibrary(t, map[string]string{"3001": "0 Brick 2 x 4\n"})
+
+	req := httptest.NewRequest(http.MethodGet, "/atlas?parts=3001:4,9999", nil)
+	rec := httptest.NewRecorder()
+	handleAtlas(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	body := rec.Body.String()
+	if !strings.Contains(body, `<view id="part-3001-4" viewBox="0 0 96 96" />`) {
+		t.Errorf("missing sprite view:\n%s", body)
+	}
+	if !strings.Contains(body, `fill="#C91A09"`) {
+		t.Error("sprite not rendered in its color")
+	}
+	if got := rec.Header().Get("X-Missing-Parts"); got != "9999" {
+		t.Errorf("X-Missing-Parts: got %q", got)
+	}
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With AUDIT_LOG set, every request to a rendering endpoint is appended to
+// that file as a line of JSON: who asked, for what, and what they got. The
+// file is only ever appended to, so it holds up in abuse investigations,
+// and a customer's bad render can be reproduced from its request. GET
+// /admin/audit searches it.
+var auditLogPath = getEnv("AUDIT_LOG", "")
+
+const (
+	// JSON request bodies up to this size are logged whole; larger ones,
+	// and uploads, by size and hash
+	auditBodyLimit = 64 << 10
+	// Error responses are logged up to this size
+	auditErrorLimit = 4 << 10
+	auditMaxResults = 1000
+)
+
+type AuditEntry struct {
+	ID         string    `json:"id"`
+	Time       time.Time `json:"time"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Query      string    `json:"query,omitempty"`
+	Key        string    `json:"key,omitempty"`
+	RemoteAddr string    `json:"remoteAddr"`
+	UserAgent  string    `json:"userAgent,omitempty"`
+	// The request body: whole if it's JSON and small enough, and always by
+	// size and SHA-256
+	Body       json.RawMessage `json:"body,omitempty"`
+	BodySize   int64           `json:"bodySize"`
+	BodySHA256 string          `json:"bodySha256,omitempty"`
+	Status     int             `json:"status"`
+	Error      *ErrorResponse  `json:"error,omitempty"`
+	Duration   float64         `json:"durationSeconds"`
+	// The response body as sent, by size and SHA-256 (of the compressed
+	// bytes, with Content-Encoding), and the ETag and X-Cache it had
+	OutputSize   int64  `json:"outputSize"`
+	OutputSHA256 string `json:"outputSha256,omitempty"`
+	ETag         string `json:"etag,omitempty"`
+	Cache        string `json:"cache,omitempty"`
+}
+
+var auditLog = struct {
+	sync.Mutex
+	file *os.File
+}{}
+
+// Open AUDIT_LOG for appending at startup
+func openAuditLog() error {
+	if auditLogPath == "" {
+		return nil
+	}
+	f, err := os.OpenFile(auditLogPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	auditLog.Lock()
+	auditLog.file = f
+	auditLog.Unlock()
+	return nil
+}
+
+func appendAuditEntry(e AuditEntry) {
+	line, _ := json.Marshal(e)
+	auditLog.Lock()
+	defer auditLog.Unlock()
+	if auditLog.file == nil {
+		return
+	}
+	if _, err := auditLog.file.Write(append(line, '\n')); err != nil {
+		log.Printf("Writing audit log failed: %v", err)
+	}
+}
+
+// Reads a request body through, keeping its hash and the start of it
+type auditBody struct {
+	io.ReadCloser
+	hash hash.Hash
+	head bytes.Buffer
+	size int64
+}
+
+func (b *auditBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.hash.Write(p[:n])
+	if keep := auditBodyLimit + 1 - b.head.Len(); keep > 0 {
+		b.head.Write(p[:min(n, keep)])
+	}
+	b.size += int64(n)
+	return n, err
+}
+
+// Records a response's status and hashes its body on the way out
+type auditWriter struct {
+	http.ResponseWriter
+	hash   hash.Hash
+	status int
+	size   int64
+	errBuf bytes.Buffer
+}
+
+func (w *auditWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *auditWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.hash.Write(p)
+	w.size += int64(len(p))
+	if keep := auditErrorLimit - w.errBuf.Len(); w.status >= 400 && keep > 0 {
+		w.errBuf.Write(p[:min(len(p), keep)])
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// For http.ResponseController: flushing streamed responses, and deadlines
+func (w *auditWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Log a rendering route's requests to AUDIT_LOG
+func withAudit(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		auditLog.Lock()
+		enabled := auditLog.file != nil
+		auditLog.Unlock()
+		if !enabled || replayMode(r.Context()) != "" {
+			handler(w, r)
+			return
+		}
+
+		entry := AuditEntry{
+			ID:         newJobID(),
+			Time:       time.Now().UTC(),
+			Method:     r.Method,
+			Path:       r.URL.Path,
+			Query:      r.URL.RawQuery,
+			RemoteAddr: r.RemoteAddr,
+			UserAgent:  r.UserAgent(),
+		}
+		if key := requestAPIKey(r); key != nil {
+			entry.Key = key.Name
+		}
+		body := &auditBody{ReadCloser: r.Body, hash: sha256.New()}
+		r.Body = body
+		aw := &auditWriter{ResponseWriter: w, hash: sha256.New()}
+
+		start := time.Now()
+		handler(aw, r)
+		entry.Duration = time.Since(start).Seconds()
+
+		entry.BodySize = body.size
+		if body.size > 0 {
+			entry.BodySHA256 = hex.EncodeToString(body.hash.Sum(nil))
+			head := body.head.Bytes()
+			if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") && len(head) <= auditBodyLimit && json.Valid(head) {
+				entry.Body = json.RawMessage(head)
+			}
+		}
+		entry.Status = aw.status
+		if entry.Status == 0 {
+			entry.Status = http.StatusOK
+		}
+		if entry.Status >= 400 {
+			var e ErrorResponse
+			if json.Unmarshal(aw.errBuf.Bytes(), &e) == nil && e.Error != "" {
+				entry.Error = &e
+			}
+		}
+		entry.OutputSize = aw.size
+		if aw.size > 0 {
+			entry.OutputSHA256 = hex.EncodeToString(aw.hash.Sum(nil))
+		}
+		entry.ETag = strings.Trim(w.Header().Get("ETag"), `"`)
+		entry.Cache = w.Header().Get("X-Cache")
+		appendAuditEntry(entry)
+	}
+}
+
+// GET /admin/audit: audit log entries, newest first, filtered by key, path
+// (a prefix), status, outputSha256 or etag, and since and until (RFC 3339),
+// up to limit (100 by default)
+func handleAudit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		sendError(w, http.StatusMethodNotAllowed, "Method not allowed", "")
+		return
+	}
+	if auditLogPath == "" {
+		sendError(w, http.StatusConflict, "Audit log is disabled", "Set AUDIT_LOG to enable it")
+		return
+	}
+
+	q := r.URL.Query()
+	var errs fieldErrors
+	limit := 100
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > auditMaxResults {
+			errs.add("limit", "limit must be between 1 and %d", auditMaxResults)
+		}
+		limit = n
+	}
+	status := 0
+	if v := q.Get("status"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			errs.add("status", "status must be an HTTP status code")
+		}
+		status = n
+	}
+	var since, until time.Time
+	for _, p := range []struct {
+		name string
+		t    *time.Time
+	}{{"since", &since}, {"until", &until}} {
+		if v := q.Get(p.name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				errs.add(p.name, "%s must be an RFC 3339 time", p.name)
+			}
+			*p.t = t
+		}
+	}
+	if err := errs.err(); err != nil {
+		sendValidationError(w, err)
+		return
+	}
+	match := func(e AuditEntry) bool {
+		return (q.Get("key") == "" || e.Key == q.Get("key")) &&
+			strings.HasPrefix(e.Path, q.Get("path")) &&
+			(status == 0 || e.Status == status) &&
+			(q.Get("outputSha256") == "" || e.OutputSHA256 == q.Get("outputSha256")) &&
+			(q.Get("etag") == "" || e.ETag == strings.Trim(q.Get("etag"), `"`)) &&
+			(since.IsZero() || !e.Time.Before(since)) &&
+			(until.IsZero() || e.Time.Before(until))
+	}
+
+	entries, err := readAuditLog(auditLogPath, match, limit)
+	if err != nil {
+		sendError(w, http.StatusInternalServerError, "Reading audit log failed", err.Error())
+		return
+	}
+	// Newest first
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"entries": entries})
+}
+
+// The last limit audit log entries that match, oldest first. A line cut
+// short by a crash mid-write is skipped.
+func readAuditLog(path string, match func(AuditEntry) bool, limit int) ([]AuditEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []AuditEntry{}, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	entries := []AuditEntry{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 2*auditBodyLimit+auditErrorLimit+64<<10)
+	for scanner.Scan() {
+		var e AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			continue
+		}
+		if match(e) {
+			if len(entries) == limit {
+				entries = append(entries[:0], entries[1:]...)
+			}
+			entries = append(entries, e)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return entries, nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+// Log rendering requests to a fresh audit log
+func withAuditLog(t *testing.T) string {
+	t.Helper()
+	old := auditLogPath
+	auditLogPath = filepath.Join(t.TempDir(), "audit.jsonl")
+	if err := openAuditLog(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		auditLog.Lock()
+		auditLog.file.Close()
+		auditLog.file = nil
+		auditLog.Unlock()
+		auditLogPath = old
+	})
+	return auditLogPath
+}
+
+func TestAuditLog(t *testing.T) {
+	withFakeBlender(t)
+	withTestLibrary(t, map[string]string{"3001": "0 Brick 2 x 4\n"})
+	withAPIKeys(t, `[{"name": "acme", "key": "k-acme"}]`)
+	withAuditLog(t)
+	oldAdmin := adminToken
+	adminToken = "secret"
+	t.Cleanup(func() { adminToken = oldAdmin })
+	srv := httptest.NewServer(routes())
+	defer srv.Close()
+
+	post := func(body string) {
+		req, _ := http.NewRequest(http.MethodPost, srv.URL+"/render", bytes.NewReader([]byte(body)))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-API-Key", "k-acme")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	post(`{"partNumber": "3001", "thickness": 3}`)
+	post(`{"partNumber": "9999"}`)
+
+	query := func(params string) []AuditEntry {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/admin/audit"+params, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var body struct {
+			Entries []AuditEntry `json:"entries"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		return body.Entries
+	}
+
+	entries := query("")
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries, got %+v", entries)
+	}
+	missing, rendered := entries[0], entries[1]
+	if missing.Status != http.StatusNotFound || missing.Error == nil || missing.Error.Error != "Part not found" {
+		t.Errorf("unexpected entry for a missing part %+v", missing)
+	}
+	if rendered.Status != http.StatusOK || rendered.Key != "acme" || rendered.Path != "/render" || rendered.Cache != "MISS" {
+		t.Errorf("unexpected entry for a render %+v", rendered)
+	}
+	if string(rendered.Body) != `{"partNumber":"3001","thickness":3}` || rendered.BodySHA256 == "" {
+		t.Errorf("unexpected request body %s (%s)", rendered.Body, rendered.BodySHA256)
+	}
+	if rendered.OutputSize == 0 || len(rendered.OutputSHA256) != 64 || rendered.ETag == "" {
+		t.Errorf("unexpected output %+v", rendered)
+	}
+
+	if got := query("?status=404"); len(got) != 1 || got[0].ID != missing.ID {
+		t.Errorf("status filter: got %+v", got)
+	}
+	if got := query("?outputSha256=" + rendered.OutputSHA256); len(got) != 1 || got[0].ID != rendered.ID {
+		t.Errorf("output hash filter: got %+v", got)
+	}
+	if got := query("?limit=1"); len(got) != 1 || got[0].ID != missing.ID {
+		t.Errorf("limit: got %+v", got)
+	}
+	if got := query("?key=someone-else"); len(got) != 0 {
+		t.Errorf("key filter: got %+v", got)
+	}
+}
+
+func TestAuditQueryValidation(t *testing.T) {
+	withAuditLog(t)
+	for _, params := range []string{"?limit=0", "?limit=5000", "?status=ok", "?since=yesterday"} {
+		w := httptest.NewRecorder()
+		handleAudit(w, httptest.NewRequest(http.MethodGet, "/admin/audit"+params, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", params, w.Code)
+		}
+	}
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Batch renders stream their results as newline-delimited JSON, one line
+// per item as soon as it finishes, so a client can use the first part while
+// the rest are still rendering. Each item carries its own status; a part
+// that fails doesn't fail the batch. gRPC clients get the same results from
+// the server-streaming Renderer/RenderBatch RPC (see renderer.proto).
+
+const batchMaxItems = 500
+
+// Items rendered at once within a batch; with a dispatcher they run on
+// different workers
+var batchConcurrency = getEnvInt("BATCH_CONCURRENCY", 2)
+
+type BatchRequest struct {
+	Items []RenderRequest `json:"items"`
+	// ResultURLs returns presigned bucket URLs instead of SVG text; it
+	// needs RESULT_URL_TTL (see store.go)
+	ResultURLs bool `json:"resultUrls"`
+}
+
+// One result line, or stream message
+type BatchResult struct {
+	Index      int    `json:"index"`
+	PartNumber string `json:"partNumber"`
+	// Status is the HTTP status the item would have had from /render
+	Status         int            `json:"status"`
+	SVG            string         `json:"svg,omitempty"`
+	URL            string         `json:"url,omitempty"`
+	URLExpires     *time.Time     `json:"urlExpires,omitempty"`
+	RenderDuration float64        `json:"renderDuration,omitempty"`
+	Cached         bool           `json:"cached,omitempty"`
+	MovedTo        string         `json:"movedTo,omitempty"`
+	Fallback       string         `json:"fallback,omitempty"`
+	Error          *ErrorResponse `json:"error,omitempty"`
+}
+
+// The last line, so a client can tell a finished stream from a cut one
+type BatchSummary struct {
+	Summary struct {
+		Items     int     `json:"items"`
+		Succeeded int     `json:"succeeded"`
+		Failed    int     `json:"failed"`
+		Seconds   float64 `json:"seconds"`
+	} `json:"summary"`
+}
+
+// Batch render endpoint
+func handleRenderBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		sendError(w, http.StatusMethodNotAllowed, "Method not allowed", "")
+		return
+	}
+
+	var req BatchRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	opts, err := req.options()
+	if err != nil {
+		sendValidationError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusOK)
+	// Send the headers now so the client isn't left waiting on the first item
+	rc := http.NewResponseController(w)
+	rc.Flush()
+	enc := json.NewEncoder(w)
+	summary := runBatch(r.Context(), &req, opts, func(result BatchResult) {
+		if enc.Encode(result) == nil {
+			rc.Flush()
+		}
+	})
+	enc.Encode(summary)
+}
+
+// gRPC lego.renderer.v1.Renderer/RenderBatch: the batch endpoint with each
+// result as a stream message, and no summary
+func handleRenderBatchRPC(w http.ResponseWriter, r *http.Request) {
+	serveGRPC(w, r, grpcMaxMessageBytes, func(data []byte, send func([]byte) error) error {
+		var req BatchRequest
+		if err := unmarshalRequest(&req, data); err != nil {
+			return err
+		}
+		opts, err := req.options()
+		if err != nil {
+			return &grpcError{grpcInvalidArgument, err.Error()}
+		}
+		var sendErr error
+		runBatch(r.Context(), &req, opts, func(result BatchResult) {
+			if sendErr == nil {
+				sendErr = send(result.marshalProto())
+			}
+		})
+		return sendErr
+	})
+}
+
+// Check a batch, returning each item's render options
+func (req *BatchRequest) options() ([]RenderOptions, error) {
+	var errs fieldErrors
+	if len(req.Items) == 0 {
+		errs.add("items", "items is required")
+	} else if len(req.Items) > batchMaxItems {
+		errs.add("items", "at most %d items per batch", batchMaxItems)
+	}
+	if req.ResultURLs && !presignedResults() {
+		errs.add("resultUrls", "resultUrls needs RESULT_URL_TTL and an s3:// or gs:// RESULT_STORE")
+	}
+	opts := make([]RenderOptions, len(req.Items))
+	for i := range req.Items {
+		prefix := fmt.Sprintf("items[%d]", i)
+		if req.Items[i].PartNumber == "" {
+			errs.add(prefix+".partNumber", "%s: partNumber is required", prefix)
+		}
+		var err error
+		opts[i], err = req.Items[i].options()
+		errs.merge(prefix, err)
+	}
+	return opts, errs.err()
+}
+
+// Render a batch's items batchConcurrency at a time, handing each result to
+// emit as it finishes. emit runs on the calling goroutine. Items not yet
+// started when ctx ends are skipped.
+func runBatch(ctx context.Context, req *BatchRequest, opts []RenderOptions, emit func(BatchResult)) BatchSummary {
+	start := time.Now()
+	indexes := make(chan int)
+	results := make(chan BatchResult)
+	var wg sync.WaitGroup
+	for n := 0; n < min(max(batchConcurrency, 1), len(req.Items)); n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				results <- renderBatchItem(ctx, i, req.Items[i].PartNumber, opts[i], req.ResultURLs)
+			}
+		}()
+	}
+	go func() {
+		defer close(indexes)
+		for i := range req.Items {
+			select {
+			case indexes <- i:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	var summary BatchSummary
+	for result := range results {
+		summary.Summary.Items++
+		if result.Error == nil {
+			summary.Summary.Succeeded++
+		} else {
+			summary.Summary.Failed++
+		}
+		emit(result)
+	}
+	summary.Summary.Seconds = time.Since(start).Seconds()
+	log.Printf("Batch of %d: %d rendered, %d failed in %.2fs", len(req.Items), summary.Summary.Succeeded, summary.Summary.Failed, summary.Summary.Seconds)
+	return summary
+}
+
+func renderBatchItem(ctx context.Context, i int, partNumber string, opts RenderOptions, presign bool) BatchResult {
+	result := BatchResult{Index: i, PartNumber: partNumber, Status: http.StatusOK, MovedTo: partMovedTo(partNumber, opts), Fallback: partFallback(partNumber, opts)}
+	svg, d, err := renderPart(ctx, partNumber, opts)
+	if err != nil {
+		code, resp := renderErrorResponse(err)
+		result.Status, result.Error = code, &resp
+		return result
+	}
+	result.RenderDuration, result.Cached = d.Seconds(), d == 0
+	if !presign {
+		result.SVG = string(svg)
+		return result
+	}
+	u, expires, err := uploadBatchResult(svg)
+	if err != nil {
+		result.Status, result.Error = http.StatusInternalServerError, &ErrorResponse{Error: "Failed to store the result", Detail: err.Error()}
+		return result
+	}
+	result.URL, result.URLExpires = u, &expires
+	return result
+}
+
+// Put a batch SVG in the result store under its hash, so repeats of the
+// same render share one object, and presign it
+func uploadBatchResult(svg []byte) (string, time.Time, error) {
+	key := "results/" + svgHash(svg) + ".svg"
+	if ok, _ := results.has(key); !ok {
+		if err := results.put(key, svg, "image/svg+xml"); err != nil {
+			return "", time.Time{}, err
+		}
+	}
+	return resultURL(key)
+}
+
+// lego.renderer.v1.RenderBatchRequest. Each item travels as its /render
+// JSON body, decoded as strictly as the HTTP endpoint decodes it.
+func (m *BatchRequest) marshalProto() []byte {
+	var enc protoEncoder
+	for _, item := range m.Items {
+		data, _ := json.Marshal(item)
+		enc.bytes(1, data)
+	}
+	enc.bool(2, m.ResultURLs)
+	return enc.buf
+}
+
+func (m *BatchRequest) unmarshalProto(data []byte) error {
+	return decodeProto(data, func(field int, v uint64, data []byte) error {
+		switch field {
+		case 1:
+			var item RenderRequest
+			dec := json.NewDecoder(bytes.NewReader(data))
+			dec.DisallowUnknownFields()
+			if err := dec.Decode(&item); err != nil {
+				return &grpcError{grpcInvalidArgument, fmt.Sprintf("items[%d]: %v", len(m.Items), err)}
+			}
+			m.Items = append(m.Items, item)
+		case 2:
+			m.ResultURLs = v != 0
+		}
+		return nil
+	})
+}
+
+// lego.renderer.v1.RenderBatchResult; urlExpires is in Unix seconds
+func (m *BatchResult) marshalProto() []byte {
+	var enc protoEncoder
+	enc.int(1, int64(m.Index))
+	enc.string(2, m.PartNumber)
+	enc.int(3, int64(m.Status))
+	enc.string(4, m.SVG)
+	enc.string(5, m.URL)
+	if m.URLExpires != nil {
+		enc.int(6, m.URLExpires.Unix())
+	}
+	enc.double(7, m.RenderDuration)
+	enc.bool(8, m.Cached)
+	enc.string(9, m.MovedTo)
+	enc.string(10, m.Fallback)
+	if m.Error != nil {
+		enc.message(11, m.Error)
+	}
+	return enc.buf
+}
+
+func (m *BatchResult) unmarshalProto(data []byte) error {
+	return decodeProto(data, func(field int, v uint64, data []byte) error {
+		switch field {
+		case 1:
+			m.Index = int(int32(v))
+		case 2:
+			m.PartNumber = string(data)
+		case 3:
+			m.Status = int(int32(v))
+		case 4:
+			m.SVG = string(data)
+		case 5:
+			m.URL = string(data)
+		case 6:
+			expires := time.Unix(int64(v), 0).UTC()
+			m.URLExpires = &expires
+		case 7:
+			m.RenderDuration = protoDouble(v)
+		case 8:
+			m.Cached = v != 0
+		case 9:
+			m.MovedTo = string(data)
+		case 10:
+			m.Fallback = string(data)
+		case 11:
+			m.Error = &ErrorResponse{}
+			return m.Error.unmarshalProto(data)
+		}
+		return nil
+	})
+}
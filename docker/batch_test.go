@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestRenderBatchStreamsResults(t *testing.T) {
+	withFakeBlender(t)
+	withTestLibrary(t, map[string]string{"3001": "0 Brick 2 x 4\n", "3003": "0 Brick 2 x 2\n"})
+
+	body := `{"items":[{"partNumber":"3001"},{"partNumber":"9999"},{"partNumber":"3003","fillColor":"#ff0000"}]}`
+	w := httptest.NewRecorder()
+	routes().ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/render/batch", strings.NewReader(body)))
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/x-ndjson" {
+		t.Fatalf("expected an NDJSON stream, got %d %q: %s", w.Code, w.Header().Get("Content-Type"), w.Body.String())
+	}
+
+	results := map[int]BatchResult{}
+	var summary BatchSummary
+	scanner := bufio.NewScanner(w.Body)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if strings.HasPrefix(string(line), `{"summary"`) {
+			json.Unmarshal(line, &summary)
+			continue
+		}
+		var result BatchResult
+		if err := json.Unmarshal(line, &result); err != nil {
+			t.Fatalf("bad line %q: %v", line, err)
+		}
+		results[result.Index] = result
+	}
+	if len(results) != 3 {
+		t.Fatalf("expected 3 results, got %d", len(results))
+	}
+	for _, i := range []int{0, 2} {
+		if r := results[i]; r.Status != http.StatusOK || !strings.Contains(r.SVG, "<svg") || r.Error != nil {
+			t.Errorf("item %d: %+v", i, r)
+		}
+	}
+	if r := results[1]; r.Status != http.StatusNotFound || r.Error == nil || r.Error.Error != "Part not found" || r.PartNumber != "9999" {
+		t.Errorf("missing part: %+v", r)
+	}
+	if s := summary.Summary; s.Items != 3 || s.Succeeded != 2 || s.Failed != 1 {
+		t.Errorf("unexpected summary %+v", s)
+	}
+}
+
+func TestRenderBatchValidates(t *testing.T) {
+	for body, field := range map[string]string{
+		`{"items":[]}`: "items",
+		`{"items":[{"partNumber":"3001"},{"fillColor":"nope"}]}`: "items[1].partNumber",
+		`{"items":[{"partNumber":"3001","thickness":99}]}`:       "items[0].thickness",
+	} {
+		w := httptest.NewRecorder()
+		handleRenderBatch(w, httptest.NewRequest(http.MethodPost, "/render/batch", strings.NewReader(body)))
+		var resp ErrorResponse
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		found := false
+		for _, f := range resp.Fields {
+			found = found || f.Field == field
+		}
+		if w.Code != http.StatusBadRequest || !found {
+			t.Errorf("%s: expected 400 naming %s, got %d %+v", body, field, w.Code, resp.Fields)
+		}
+	}
+}
+
+func TestRenderBatchYieldsEachResultWhenReady(t *testing.T) {
+	withTestLibrary(t, map[string]string{"3001": "0 Brick 2 x 4\n", "3003": "0 Brick 2 x 2\n"})
+	d, srv := withDispatcher(t)
+	worker := d.register("w1", 2)
+
+	resp, err := http.Post(srv.URL+"/render/batch", "application/json", strings.NewReader(`{"items":[{"partNumber":"3001"},{"partNumber":"3003"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	tasks := map[string]*dispatchTask{}
+	for len(tasks) < 2 {
+		task, err := d.pull(context.Background(), worker.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if task != nil {
+			tasks[task.PartNumber] = task
+		}
+	}
+
+	// The second item finishes first and is sent while the first renders
+	d.complete(worker.ID, jobUpdate{ID: tasks["3003"].ID, Status: jobDone, SVG: "<svg>3003</svg>", RenderSeconds: 1})
+	lines := bufio.NewReader(resp.Body)
+	line, err := lines.ReadBytes('\n')
+	var first BatchResult
+	if err != nil || json.Unmarshal(line, &first) != nil || first.Index != 1 {
+		t.Fatalf("expected item 1 first, got %q, %v", line, err)
+	}
+	d.complete(worker.ID, jobUpdate{ID: tasks["3001"].ID, Status: jobFailed, StatusCode: http.StatusInternalServerError, Error: &ErrorResponse{Error: "Blender crashed"}})
+	line, _ = lines.ReadBytes('\n')
+	var second BatchResult
+	if json.Unmarshal(line, &second) != nil || second.Index != 0 || second.Status != http.StatusInternalServerError {
+		t.Errorf("unexpected second result %q", line)
+	}
+}
+
+func TestRenderBatchRPC(t *testing.T) {
+	withFakeBlender(t)
+	withTestLibrary(t, map[string]string{"3001": "0 Brick 2 x 4\n"})
+	withAPIKeys(t, `[{"name": "acme", "key": "k-acme"}]`)
+	srv := newTestGRPCServer(t, routes())
+	client := newGRPCClient(srv.URL, http.Header{"X-Api-Key": {"k-acme"}})
+
+	req := BatchRequest{Items: []RenderRequest{{PartNumber: "3001"}, {PartNumber: "9999"}}}
+	results := map[int]BatchResult{}
+	err := client.call(context.Background(), "/lego.renderer.v1.Renderer/RenderBatch", req.marshalProto(), dispatchResultMaxBytes, func(msg []byte) error {
+		var result BatchResult
+		if err := result.unmarshalProto(msg); err != nil {
+			return err
+		}
+		results[result.Index] = result
+		return nil
+	})
+	if err != nil || len(results) != 2 {
+		t.Fatalf("got %d results, %v", len(results), err)
+	}
+	if r := results[0]; r.Status != http.StatusOK || !strings.Contains(r.SVG, "<svg") || r.Error != nil {
+		t.Errorf("unexpected result for 3001: %+v", r)
+	}
+	if r := results[1]; r.Status != http.StatusNotFound || r.Error == nil || r.SVG != "" {
+		t.Errorf("expected 9999 to fail on its own, got %+v", r)
+	}
+
+	// An invalid batch fails the call
+	bad := BatchRequest{Items: []RenderRequest{{FillColor: "nope"}}}
+	err = client.call(context.Background(), "/lego.renderer.v1.Renderer/RenderBatch", bad.marshalProto(), dispatchResultMaxBytes, func([]byte) error { return nil })
+	if grpcErrorCode(err) != grpcInvalidArgument || !strings.Contains(err.Error(), "partNumber is required") {
+		t.Errorf("expected INVALID_ARGUMENT, got %v", err)
+	}
+	err = newGRPCClient(srv.URL, nil).call(context.Background(), "/lego.renderer.v1.Renderer/RenderBatch", req.marshalProto(), dispatchResultMaxBytes, func([]byte) error { return nil })
+	if grpcErrorCode(err) != grpcUnauthenticated {
+		t.Errorf("without a key: expected UNAUTHENTICATED, got %v", err)
+	}
+}
+
+func TestBatchProtoRoundTrip(t *testing.T) {
+	fill := 0.5
+	in := BatchRequest{Items: []RenderRequest{{PartNumber: "3001", FillOpacity: &fill}, {PartNumber: "3003"}}, ResultURLs: true}
+	var out BatchRequest
+	if err := out.unmarshalProto(in.marshalProto()); err != nil {
+		t.Fatal(err)
+	}
+	if len(out.Items) != 2 || out.Items[0].PartNumber != "3001" || out.Items[0].FillOpacity == nil || *out.Items[0].FillOpacity != 0.5 || !out.ResultURLs {
+		t.Errorf("round trip gave %+v", out)
+	}
+	var enc protoEncoder
+	enc.string(1, `{"partNumber":"3001","bogus":1}`)
+	if err := (&BatchRequest{}).unmarshalProto(enc.buf); grpcErrorCode(err) != grpcInvalidArgument || !strings.Contains(err.Error(), "items[0]") {
+		t.Errorf("expected an unknown field to be INVALID_ARGUMENT, got %v", err)
+	}
+}
+
+func TestRenderBatchResultURLs(t *testing.T) {
+	withFakeBlender(t)
+	withTestLibrary(t, map[string]string{"3001": "0 Brick 2 x 4\n"})
+
+	body := `{"items":[{"partNumber":"3001"}],"resultUrls":true}`
+	w := httptest.NewRecorder()
+	handleRenderBatch(w, httptest.NewRequest(http.MethodPost, "/render/batch", strings.NewReader(body)))
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "RESULT_URL_TTL") {
+		t.Errorf("without a bucket: expected 400, got %d %s", w.Code, w.Body.String())
+	}
+
+	fake, _ := withPresignedResults(t)
+	w = httptest.NewRecorder()
+	handleRenderBatch(w, httptest.NewRequest(http.MethodPost, "/render/batch", strings.NewReader(body)))
+	var result BatchResult
+	json.Unmarshal([]byte(strings.SplitN(w.Body.String(), "\n", 2)[0]), &result)
+	if result.Status != http.StatusOK || result.SVG != "" || !strings.Contains(result.URL, "X-Amz-Signature=") || result.URLExpires == nil {
+		t.Fatalf("expected a URL instead of the SVG, got %+v", result)
+	}
+	u, _ := url.Parse(result.URL)
+	if svg, ok := fake.objects[u.Path]; !ok || !strings.Contains(string(svg), "<svg") {
+		t.Errorf("expected the SVG at %s", u.Path)
+	}
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Freestyle exports every edge as a dense polyline. With a curve tolerance
+// set, each path is first simplified (Ramer-Douglas-Peucker), which turns
+// straight edges into single segments and leaves the vertices of curved
+// ones. The simplified polyline is split at corners, and each run of
+// vertices is fitted with cubic Béziers (Schneider's algorithm from Graphics
+// Gems, 1990) passing within the tolerance of them.
+
+// Turns sharper than this between consecutive segments are kept as corners
+const bezierCornerAngle = 50 * math.Pi / 180
+
+var svgPathDataPattern = regexp.MustCompile(`\sd="([^"]*)"`)
+
+type point struct{ X, Y float64 }
+
+func (p point) add(q point) point     { return point{p.X + q.X, p.Y + q.Y} }
+func (p point) sub(q point) point     { return point{p.X - q.X, p.Y - q.Y} }
+func (p point) scale(s float64) point { return point{p.X * s, p.Y * s} }
+func (p point) dot(q point) float64   { return p.X*q.X + p.Y*q.Y }
+func (p point) dist(q point) float64  { return math.Hypot(p.X-q.X, p.Y-q.Y) }
+func (p point) normalize() point      { return p.scale(1 / math.Max(math.Hypot(p.X, p.Y), 1e-12)) }
+func (p point) isZero() bool          { return p.X == 0 && p.Y == 0 }
+func (p point) equal(q point) bool    { return p.dist(q) < 1e-9 }
+
+func bezierPoint(b [4]point, t float64) point {
+	mt := 1 - t
+	return b[0].scale(mt * mt * mt).add(b[1].scale(3 * mt * mt * t)).add(b[2].scale(3 * mt * t * t)).add(b[3].scale(t * t * t))
+}
+
+type polyline struct {
+	points []point
+	closed bool
+}
+
+// Refit every polyline path in an SVG within tolerance pixels. Paths using
+// anything but M, L, and Z commands are left alone.
+func fitSVGCurves(svg []byte, tolerance float64) []byte {
+	if tolerance <= 0 {
+		return svg
+	}
+	return svgPathPattern.ReplaceAllFunc(svg, func(path []byte) []byte {
+		return svgPathDataPattern.ReplaceAllFunc(path, func(m []byte) []byte {
+			d := svgPathDataPattern.FindSubmatch(m)[1]
+			lines, ok := parsePolylines(string(d))
+			if !ok {
+				return m
+			}
+			var b bytes.Buffer
+			b.WriteString(` d="`)
+			b.WriteString(fitPathData(lines, tolerance))
+			b.WriteByte('"')
+			return b.Bytes()
+		})
+	})
+}
+
+// Parse path data made only of moveto, lineto, and closepath commands
+func parsePolylines(d string) ([]polyline, bool) {
+	tokens := strings.FieldsFunc(d, func(r rune) bool { return r == ' ' || r == ',' || r == '\t' || r == '\n' })
+	var lines []polyline
+	var cur *polyline
+	for i := 0; i < len(tokens); i++ {
+		switch tok := tokens[i]; tok {
+		case "M", "m":
+			if tok == "m" {
+				return nil, false
+			}
+			lines = append(lines, polyline{})
+			cur = &lines[len(lines)-1]
+		case "L":
+		case "z", "Z":
+			if cur == nil {
+				return nil, false
+			}
+			cur.closed = true
+		default:
+			if cur == nil || i+1 >= len(tokens) {
+				return nil, false
+			}
+			x, err1 := strconv.ParseFloat(tok, 64)
+			y, err2 := strconv.ParseFloat(tokens[i+1], 64)
+			if err1 != nil || err2 != nil {
+				return nil, false
+			}
+			cur.points = append(cur.points, point{x, y})
+			i++
+		}
+	}
+	return lines, len(lines) > 0
+}
+
+func fitPathData(lines []polyline, tolerance float64) string {
+	var b strings.Builder
+	for _, line := range lines {
+		pts := simplifyPolyline(dedupePoints(line.points), tolerance)
+		if len(pts) == 0 {
+			continue
+		}
+		if b.Len() > 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString("M ")
+		writePoint(&b, pts[0])
+		for _, run := range splitAtCorners(pts) {
+			if len(run) == 2 {
+				b.WriteString(" L ")
+				writePoint(&b, run[len(run)-1])
+				continue
+			}
+			for _, c := range fitCurve(run, tolerance) {
+				b.WriteString(" C ")
+				writePoint(&b, c[1])
+				b.WriteByte(' ')
+				writePoint(&b, c[2])
+				b.WriteByte(' ')
+				writePoint(&b, c[3])
+			}
+		}
+		if line.closed {
+			b.WriteString(" z")
+		}
+	}
+	return b.String()
+}
+
+func writePoint(b *strings.Builder, p point) {
+	b.WriteString(strconv.FormatFloat(p.X, 'f', 2, 64))
+	b.WriteByte(',')
+	b.WriteString(strconv.FormatFloat(p.Y, 'f', 2, 64))
+}
+
+func dedupePoints(pts []point) []point {
+	var out []point
+	for _, p := range pts {
+		if len(out) == 0 || !out[len(out)-1].equal(p) {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// Ramer-Douglas-Peucker: drop points within tolerance of the simplified line
+func simplifyPolyline(pts []point, tolerance float64) []point {
+	if len(pts) < 3 {
+		return pts
+	}
+	first, last := pts[0], pts[len(pts)-1]
+	worst, index := 0.0, 0
+	for i := 1; i < len(pts)-1; i++ {
+		if d := segmentDistance(pts[i], first, last); d > worst {
+			worst, index = d, i
+		}
+	}
+	if worst <= tolerance {
+		return []point{first, last}
+	}
+	left := simplifyPolyline(pts[:index+1], tolerance)
+	return append(left[:len(left)-1], simplifyPolyline(pts[index:], tolerance)...)
+}
+
+// Distance from p to the segment a-b
+func segmentDistance(p, a, b point) float64 {
+	ab := b.sub(a)
+	lengthSq := ab.dot(ab)
+	if lengthSq < 1e-18 {
+		return p.dist(a)
+	}
+	t := math.Max(0, math.Min(1, p.sub(a).dot(ab)/lengthSq))
+	return p.dist(a.add(ab.scale(t)))
+}
+
+// Split a polyline into runs that share their end points at corners
+func splitAtCorners(pts []point) [][]point {
+	var runs [][]point
+	start := 0
+	for i := 1; i < len(pts)-1; i++ {
+		in := pts[i].sub(pts[i-1]).normalize()
+		out := pts[i+1].sub(pts[i]).normalize()
+		if math.Acos(math.Max(-1, math.Min(1, in.dot(out)))) > bezierCornerAngle {
+			runs = append(runs, pts[start:i+1])
+			start = i
+		}
+	}
+	if len(pts) > 1 {
+		runs = append(runs, pts[start:])
+	}
+	return runs
+}
+
+// Fit a run of points with cubic Béziers, returned as control point quads
+func fitCurve(pts []point, tolerance float64) [][4]point {
+	if len(pts) < 2 {
+		return nil
+	}
+	left := pts[1].sub(pts[0]).normalize()
+	right := pts[len(pts)-2].sub(pts[len(pts)-1]).normalize()
+	return fitCubic(pts, left, right, tolerance*tolerance)
+}
+
+func fitCubic(pts []point, left, right point, errSq float64) [][4]point {
+	if len(pts) == 2 {
+		d := pts[0].dist(pts[1]) / 3
+		return [][4]point{{pts[0], pts[0].add(left.scale(d)), pts[1].add(right.scale(d)), pts[1]}}
+	}
+
+	u := chordLengths(pts)
+	bez := generateBezier(pts, u, left, right)
+	maxErr, split := maxBezierError(pts, bez, u)
+	if maxErr < errSq {
+		return [][4]point{bez}
+	}
+	if maxErr < errSq*4 {
+		for i := 0; i < 4; i++ {
+			u = reparameterize(pts, bez, u)
+			bez = generateBezier(pts, u, left, right)
+			if maxErr, split = maxBezierError(pts, bez, u); maxErr < errSq {
+				return [][4]point{bez}
+			}
+		}
+	}
+
+	center := pts[split-1].sub(pts[split+1]).normalize()
+	if center.isZero() {
+		center = pts[split-1].sub(pts[split]).normalize()
+	}
+	curves := fitCubic(pts[:split+1], left, center, errSq)
+	return append(curves, fitCubic(pts[split:], center.scale(-1), right, errSq)...)
+}
+
+// Least-squares control points for fixed end tangents
+func generateBezier(pts []point, u []float64, left, right point) [4]point {
+	first, last := pts[0], pts[len(pts)-1]
+	var c [2][2]float64
+	var x [2]float64
+	for i, p := range pts {
+		t := u[i]
+		mt := 1 - t
+		b0, b1, b2, b3 := mt*mt*mt, 3*mt*mt*t, 3*mt*t*t, t*t*t
+		a1, a2 := left.scale(b1), right.scale(b2)
+		c[0][0] += a1.dot(a1)
+		c[0][1] += a1.dot(a2)
+		c[1][1] += a2.dot(a2)
+		tmp := p.sub(first.scale(b0 + b1)).sub(last.scale(b2 + b3))
+		x[0] += a1.dot(tmp)
+		x[1] += a2.dot(tmp)
+	}
+	c[1][0] = c[0][1]
+
+	det := c[0][0]*c[1][1] - c[1][0]*c[0][1]
+	alphaL, alphaR := 0.0, 0.0
+	if math.Abs(det) > 1e-12 {
+		alphaL = (x[0]*c[1][1] - x[1]*c[0][1]) / det
+		alphaR = (c[0][0]*x[1] - c[1][0]*x[0]) / det
+	}
+	// Fall back to the chord heuristic when the fit is degenerate or
+	// overshoots into a loop
+	if seg := first.dist(last); alphaL < seg*1e-6 || alphaR < seg*1e-6 || alphaL > seg || alphaR > seg {
+		alphaL, alphaR = seg/3, seg/3
+	}
+	return [4]point{first, first.add(left.scale(alphaL)), last.add(right.scale(alphaR)), last}
+}
+
+func chordLengths(pts []point) []float64 {
+	u := make([]float64, len(pts))
+	for i := 1; i < len(pts); i++ {
+		u[i] = u[i-1] + pts[i].dist(pts[i-1])
+	}
+	total := u[len(u)-1]
+	for i := range u {
+		u[i] /= total
+	}
+	return u
+}
+
+// Squared distance of the worst-fitting point, and its index
+func maxBezierError(pts []point, bez [4]point, u []float64) (float64, int) {
+	maxErr, split := 0.0, len(pts)/2
+	for i := 1; i < len(pts)-1; i++ {
+		d := bezierPoint(bez, u[i]).sub(pts[i])
+		if e := d.dot(d); e >= maxErr {
+			maxErr, split = e, i
+		}
+	}
+	return maxErr, split
+}
+
+// One Newton-Raphson step toward each point's nearest parameter
+func reparameterize(pts []point, bez [4]point, u []float64) []float64 {
+	next := make([]float64, len(u))
+	for i, p := range pts {
+		t := u[i]
+		q := bezierPoint(bez, t)
+		mt := 1 - t
+		d1 := bez[1].sub(bez[0]).scale(3 * mt * mt).add(bez[2].sub(bez[1]).scale(6 * mt * t)).add(bez[3].sub(bez[2]).scale(3 * t * t))
+		d2 := bez[2].sub(bez[1].scale(2)).add(bez[0]).scale(6 * mt).add(bez[3].sub(bez[2].scale(2)).add(bez[1]).scale(6 * t))
+		num := q.sub(p).dot(d1)
+		den := d1.dot(d1) + q.sub(p).dot(d2)
+		if math.Abs(den) < 1e-12 {
+			next[i] = t
+			continue
+		}
+		next[i] = math.Max(0, math.Min(1, t-num/den))
+	}
+	return next
+}
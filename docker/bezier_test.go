@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Distance from p to the closest of many samples along the curve
+func distanceToCurve(p point, curves [][4]point) float64 {
+	best := math.Inf(1)
+	for _, c := range curves {
+		for i := 0; i <= 200; i++ {
+			best = math.Min(best, bezierPoint(c, float64(i)/200).dist(p))
+		}
+	}
+	return best
+}
+
+func TestFitCurveArc(t *testing.T) {
+	var pts []point
+	for i := 0; i <= 40; i++ {
+		a := math.Pi * float64(i) / 40
+		pts = append(pts, point{100 + 50*math.Cos(a), 100 + 30*math.Sin(a)})
+	}
+	curves := fitCurve(pts, 0.5)
+	if len(curves) == 0 || len(curves) > 4 {
+		t.Fatalf("expected a few curves for a half ellipse, got %d", len(curves))
+	}
+	for _, p := range pts {
+		if d := distanceToCurve(p, curves); d > 0.5+1e-3 {
+			t.Errorf("point %v is %.3fpx from the fit", p, d)
+		}
+	}
+}
+
+func TestSplitAtCorners(t *testing.T) {
+	square := []point{{0, 0}, {10, 0}, {20, 0}, {20, 10}, {20, 20}, {0, 20}}
+	runs := splitAtCorners(square)
+	if len(runs) != 3 {
+		t.Fatalf("expected 3 runs, got %d: %v", len(runs), runs)
+	}
+	if runs[0][len(runs[0])-1] != runs[1][0] {
+		t.Error("runs should share their corner points")
+	}
+}
+
+func TestFitSVGCurves(t *testing.T) {
+	var d strings.Builder
+	d.WriteString(" M")
+	for i := 0; i <= 30; i++ {
+		a := 2 * math.Pi * float64(i) / 30
+		fmt.Fprintf(&d, " %.3f, %.3f", 50+20*math.Cos(a), 50+20*math.Sin(a))
+	}
+	d.WriteString("  z ")
+	svg := `<svg xmlns="http://www.w3.org/2000/svg" width="100" height="100"><path fill="none" stroke="black" d="` + d.String() + `" /><path d="M 0 0 A 5 5 0 0 1 10 10" /></svg>`
+
+	got := string(fitSVGCurves([]byte(svg), 0.5))
+	if !strings.Contains(got, " C ") || !strings.Contains(got, ` z" />`) {
+		t.Errorf("circle should be refit as closed curves:\n%s", got)
+	}
+	if !strings.Contains(got, `d="M 0 0 A 5 5 0 0 1 10 10"`) {
+		t.Errorf("paths with other commands should be untouched:\n%s", got)
+	}
+	if string(fitSVGCurves([]byte(svg), 0)) != svg {
+		t.Error("tolerance 0 should leave the SVG unchanged")
+	}
+}
+
+// The golden studs shrink to far fewer path nodes
+func TestFitSVGCurvesGolden(t *testing.T) {
+	svg, err := os.ReadFile(filepath.Join("..", "examples", "6141-round-plate-1x1.svg"))
+	if err != nil {
+		t.Skip("golden example not available")
+	}
+	fitted := fitSVGCurves(svg, 0.5)
+	if len(fitted) >= len(svg)*3/4 {
+		t.Errorf("fitting saved too little: %d -> %d bytes", len(svg), len(fitted))
+	}
+	if err := checkSVG(fitted); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// LDraw color 16 means "inherit the color of the referencing line"
+const ldrawMainColor = 16
+
+// Submodel nesting deeper than this is treated as a reference cycle
+const bomMaxDepth = 64
+
+type BOMLine struct {
+	PartNumber string `json:"partNumber"`
+	Color      int    `json:"color"`
+	ColorName  string `json:"colorName,omitempty"`
+	Quantity   int    `json:"quantity"`
+}
+
+type BillOfMaterials struct {
+	Parts      []BOMLine `json:"parts"`
+	TotalParts int       `json:"totalParts"`
+	// Submodels lists the MPD subfiles that were expanded
+	Submodels []string `json:"submodels"`
+	// Unresolved lists referenced .ldr/.mpd files missing from the upload
+	Unresolved []string `json:"unresolved,omitempty"`
+}
+
+// BOM endpoint: upload a model (as for /render/model) and get its parts
+// list as JSON, or rendered as a contact sheet with format=svg|pdf
+func handleModelBOM(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		sendError(w, http.StatusMethodNotAllowed, "Method not allowed", "")
+		return
+	}
+
+	data, err := readUpload(w, r, modelMaxBytes)
+	if err != nil {
+		sendError(w, http.StatusBadRequest, "Invalid upload", err.Error())
+		return
+	}
+	if len(data) == 0 {
+		sendError(w, http.StatusBadRequest, "Model file is required", "")
+		return
+	}
+
+	model, format, err := normalizeModel(data)
+	if err != nil {
+		sendError(w, http.StatusBadRequest, "Unsupported model file", err.Error())
+		return
+	}
+	bom := extractBOM(model)
+	log.Printf("BOM for uploaded %s model: %d lines, %d parts", format, len(bom.Parts), bom.TotalParts)
+
+	sheetFormat := r.URL.Query().Get("format")
+	if sheetFormat == "" || sheetFormat == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Model-Format", format)
+		json.NewEncoder(w).Encode(bom)
+		return
+	}
+
+	// Sheet options come from a multipart "options" field as /render/sheet
+	// JSON; items come from the model
+	var req ContactSheetRequest
+	if opts := r.FormValue("options"); opts != "" {
+		if err := json.Unmarshal([]byte(opts), &req); err != nil {
+			sendError(w, http.StatusBadRequest, "Invalid options JSON", err.Error())
+			return
+		}
+	}
+	req.Format = sheetFormat
+	if page := r.URL.Query().Get("page"); page != "" {
+		n, err := strconv.Atoi(page)
+		if err != nil {
+			sendError(w, http.StatusBadRequest, "page must be an integer", "")
+			return
+		}
+		req.Page = n
+	}
+	if req.Title == "" {
+		req.Title = "Bill of materials"
+	}
+	req.Items = bom.items()
+	if len(req.Items) == 0 {
+		sendError(w, http.StatusUnprocessableEntity, "Model contains no parts", "")
+		return
+	}
+
+	base, err := req.validate()
+	if err != nil {
+		sendValidationError(w, err)
+		return
+	}
+	w.Header().Set("X-Model-Format", format)
+	writeContactSheet(w, r, req, base)
+}
+
+// Contact sheet items for a BOM. Direct colors (0x2RRGGBB) have no LDConfig
+// entry, so those lines render with the default fill.
+func (bom BillOfMaterials) items() []InventoryItem {
+	items := make([]InventoryItem, 0, len(bom.Parts))
+	for _, line := range bom.Parts {
+		item := InventoryItem{PartNumber: line.PartNumber, Quantity: line.Quantity}
+		if _, ok := lookupColor(line.Color); ok {
+			color := line.Color
+			item.Color = &color
+		}
+		items = append(items, item)
+	}
+	return items
+}
+
+// Walk a normalized LDR/MPD model from its main file and count every part
+// reference by part number and resolved color. MPD subfiles are expanded as
+// submodels unless they are .dat files or their header marks them as parts
+// (Stud.io custom parts are inlined this way).
+func extractBOM(model []byte) BillOfMaterials {
+	main, files := splitMPD(model)
+
+	counts := make(map[BOMLine]int)
+	expanded := make(map[string]bool)
+	unresolved := make(map[string]bool)
+
+	var walk func(name string, color, depth int)
+	walk = func(name string, color, depth int) {
+		if depth > bomMaxDepth {
+			return
+		}
+		for _, line := range files[name] {
+			fields := strings.Fields(line)
+			if len(fields) < 15 || fields[0] != "1" {
+				continue
+			}
+			lineColor, err := strconv.ParseInt(fields[1], 0, 64)
+			if err != nil {
+				continue
+			}
+			c := int(lineColor)
+			if c == ldrawMainColor {
+				c = color
+			}
+			ref := strings.Join(fields[14:], " ")
+			key := mpdKey(ref)
+
+			if sub, ok := files[key]; ok && path.Ext(key) != ".dat" && !isPartFile(sub) {
+				expanded[key] = true
+				walk(key, c, depth+1)
+				continue
+			}
+			if ext := path.Ext(key); ext == ".ldr" || ext == ".mpd" {
+				unresolved[ref] = true
+				continue
+			}
+			counts[BOMLine{PartNumber: partNumberFromRef(ref), Color: c}]++
+		}
+	}
+	walk(main, ldrawMainColor, 0)
+
+	bom := BillOfMaterials{Parts: []BOMLine{}, Submodels: []string{}}
+	for line, n := range counts {
+		line.Quantity = n
+		if c, ok := lookupColor(line.Color); ok {
+			line.ColorName = c.Name
+		}
+		bom.Parts = append(bom.Parts, line)
+		bom.TotalParts += n
+	}
+	sort.Slice(bom.Parts, func(i, j int) bool {
+		a, b := bom.Parts[i], bom.Parts[j]
+		if a.PartNumber != b.PartNumber {
+			return a.PartNumber < b.PartNumber
+		}
+		return a.Color < b.Color
+	})
+	for name := range expanded {
+		bom.Submodels = append(bom.Submodels, name)
+	}
+	sort.Strings(bom.Submodels)
+	for ref := range unresolved {
+		bom.Unresolved = append(bom.Unresolved, ref)
+	}
+	sort.Strings(bom.Unresolved)
+	return bom
+}
+
+// Split a model into its MPD subfiles keyed by normalized name, returning
+// the main (first) file's key. Plain LDR files become a single entry; in an
+// MPD, lines before the first FILE are ignored.
+func splitMPD(model []byte) (string, map[string][]string) {
+	files := make(map[string][]string)
+	main, current := "", ""
+	if !isMPD(model) {
+		main, current = "<model>", "<model>"
+	}
+	for _, line := range strings.Split(string(model), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 3 && fields[0] == "0" && fields[1] == "FILE" {
+			current = mpdKey(strings.Join(fields[2:], " "))
+			if main == "" {
+				main = current
+			}
+			continue
+		}
+		if len(fields) >= 2 && fields[0] == "0" && fields[1] == "NOFILE" {
+			current = ""
+			continue
+		}
+		if current != "" {
+			files[current] = append(files[current], line)
+		}
+	}
+	return main, files
+}
+
+// MPD references are case-insensitive and may use either path separator
+func mpdKey(name string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(name), `\`, "/"))
+}
+
+// A subfile is a part (not a submodel) if its header says so
+func isPartFile(lines []string) bool {
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) >= 3 && fields[0] == "0" && (fields[1] == "!LDRAW_ORG" || fields[1] == "LDRAW_ORG") {
+			return strings.Contains(fields[2], "Part") || strings.Contains(fields[2], "Shortcut")
+		}
+		if len(fields) > 0 && fields[0] != "0" {
+			break
+		}
+	}
+	return false
+}
+
+// "3001.dat" -> "3001"; "s\3001s01.dat" keeps its directory
+func partNumberFromRef(ref string) string {
+	ref = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(ref), `\`, "/"))
+	if path.Ext(ref) == ".dat" {
+		ref = ref[:len(ref)-len(path.Ext(ref))]
+	}
+	return ref
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+const testMPD = `0 Leading comment
+0 FILE house.ldr
+0 House
+1 4 0 0 0 1 0 0 0 1 0 0 0 1 3001.dat
+1 1 0 0 0 1 0 0 0 1 0 0 0 1 Wall.ldr
+1 0 0 0 0 1 0 0 0 1 0 0 0 1 wall.ldr
+1 15 0 0 0 1 0 0 0 1 0 0 0 1 custom1.dat
+1 16 0 0 0 1 0 0 0 1 0 0 0 1 missing.ldr
+0 NOFILE
+0 FILE wall.ldr
+1 16 0 0 0 1 0 0 0 1 0 0 0 1 3001.DAT
+1 4 0 0 0 1 0 0 0 1 0 0 0 1 3003.dat
+0 NOFILE
+0 FILE custom1.dat
+0 Custom part
+1 16 0 0 0 1 0 0 0 1 0 0 0 1 s\custom1s01.dat
+0 NOFILE
+`
+
+func TestExtractBOM(t *testing.T) {
+	withTestLibrary(t, nil)
+	bom := extractBOM([]byte(testMPD))
+
+	want := []BOMLine{
+		{PartNumber: "3001", Color: 0, ColorName: "Black", Quantity: 1},
+		{PartNumber: "3001", Color: 1, Quantity: 1},
+		{PartNumber: "3001", Color: 4, ColorName: "Red", Quantity: 1},
+		{PartNumber: "3003", Color: 4, ColorName: "Red", Quantity: 2},
+		{PartNumber: "custom1", Color: 15, Quantity: 1},
+	}
+	if !reflect.DeepEqual(bom.Parts, want) {
+		t.Errorf("parts:\n got %+v\nwant %+v", bom.Parts, want)
+	}
+	if bom.TotalParts != 6 {
+		t.Errorf("expected 6 parts, got %d", bom.TotalParts)
+	}
+	if !reflect.DeepEqual(bom.Submodels, []string{"wall.ldr"}) {
+		t.Errorf("unexpected submodels %v", bom.Submodels)
+	}
+	if !reflect.DeepEqual(bom.Unresolved, []string{"missing.ldr"}) {
+		t.Errorf("unexpected unresolved %v", bom.Unresolved)
+	}
+
+	// Color 1 isn't in the test LDConfig, so it renders with the default fill
+	items := bom.items()
+	if items[1].Color != nil || items[0].Color == nil || *items[0].Color != 0 {
+		t.Errorf("unexpected sheet item colors: %+v", items)
+	}
+}
+
+func TestExtractBOMPlainLDR(t *testing.T) {
+	withTestLibrary(t, nil)
+	bom := extractBOM([]byte("0 Two bricks\n1 4 0 0 0 1 0 0 0 1 0 0 0 1 3001.dat\n1 4 0 -24 0 1 0 0 0 1 0 0 0 1 3001.dat\n"))
+	want := []BOMLine{{PartNumber: "3001", Color: 4, ColorName: "Red", Quantity: 2}}
+	if !reflect.DeepEqual(bom.Parts, want) {
+		t.Errorf("got %+v, want %+v", bom.Parts, want)
+	}
+}
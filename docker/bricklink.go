@@ -0,0 +1,310 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Optional JSON file mapping BrickLink part numbers to LDraw part numbers,
+// for parts whose numbers differ and which Rebrickable can't resolve
+var brickLinkPartMapFile = getEnv("BRICKLINK_PART_MAP", "")
+
+const wantedListMaxBytes = 4 << 20
+
+// Built-in BrickLink color ID to LDraw color code table for common colors.
+// When Rebrickable is configured its full color list is used instead.
+var brickLinkColors = map[int]int{
+	1: 15, 2: 19, 3: 14, 4: 25, 5: 4, 6: 2, 7: 1, 8: 6, 9: 7, 10: 8,
+	11: 0, 12: 47, 13: 40, 14: 33, 15: 43, 16: 42, 17: 36, 18: 38, 19: 46, 20: 34,
+	21: 334, 22: 383, 23: 13, 24: 22, 25: 12, 26: 100, 27: 216, 28: 92, 33: 18, 34: 27,
+	36: 10, 38: 17, 39: 3, 40: 11, 41: 118, 42: 73, 43: 110, 46: 21, 47: 5, 48: 378,
+	55: 379, 58: 335, 59: 320, 63: 272, 69: 28, 71: 26, 80: 288, 85: 72, 86: 71, 88: 70,
+	89: 85, 90: 78, 95: 179, 103: 226, 104: 29, 105: 212, 110: 191, 115: 297, 120: 308, 150: 84,
+	152: 322, 153: 321, 154: 31, 156: 30, 158: 326, 159: 329, 160: 330,
+}
+
+// BrickLink XML as used by wanted lists and store inventory uploads
+type brickLinkInventory struct {
+	Items []struct {
+		ItemType string `xml:"ITEMTYPE"`
+		ItemID   string `xml:"ITEMID"`
+		Color    int    `xml:"COLOR"`
+		MinQty   int    `xml:"MINQTY"`
+		Qty      int    `xml:"QTY"`
+	} `xml:"ITEM"`
+}
+
+// WantedListLot is one BrickLink lot and its LDraw mapping
+type WantedListLot struct {
+	Lot            int    `json:"lot"`
+	ItemType       string `json:"itemType"`
+	BrickLinkID    string `json:"brickLinkId"`
+	BrickLinkColor int    `json:"brickLinkColor"`
+	Quantity       int    `json:"quantity"`
+	PartNumber     string `json:"partNumber,omitempty"`
+	Color          *int   `json:"color,omitempty"`
+	Reason         string `json:"reason,omitempty"`
+}
+
+// WantedListReport separates lots that can be rendered from those that can't.
+// Mapped lots whose color couldn't be mapped render with the default fill and
+// are listed in UnmappedColors.
+type WantedListReport struct {
+	Mapped         []WantedListLot `json:"mapped"`
+	Unmapped       []WantedListLot `json:"unmapped"`
+	UnmappedColors []WantedListLot `json:"unmappedColors"`
+}
+
+var (
+	brickLinkPartMapOnce sync.Once
+	brickLinkPartMap     map[string]string
+
+	brickLinkLookupMu    sync.Mutex
+	brickLinkLookupCache = make(map[string]string)
+)
+
+// Wanted list endpoint: POST /render/wantedlist?format=svg|pdf|zip|report
+func handleWantedList(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		sendError(w, http.StatusMethodNotAllowed, "Method not allowed", "")
+		return
+	}
+
+	data, err := readUpload(w, r, wantedListMaxBytes)
+	if err != nil {
+		sendError(w, http.StatusBadRequest, "Invalid upload", err.Error())
+		return
+	}
+
+	var inv brickLinkInventory
+	if err := xml.Unmarshal(data, &inv); err != nil {
+		sendError(w, http.StatusBadRequest, "Invalid BrickLink XML", err.Error())
+		return
+	}
+	if len(inv.Items) == 0 {
+		sendError(w, http.StatusBadRequest, "Wanted list contains no items", "")
+		return
+	}
+
+	report := mapWantedList(r.Context(), inv)
+	log.Printf("Wanted list: %d lots, %d mapped, %d unmapped", len(inv.Items), len(report.Mapped), len(report.Unmapped))
+
+	format := r.URL.Query().Get("format")
+	if format == "report" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(report)
+		return
+	}
+	if len(report.Mapped) == 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(report)
+		return
+	}
+
+	items := make([]InventoryItem, len(report.Mapped))
+	for i, lot := range report.Mapped {
+		items[i] = InventoryItem{
+			PartNumber: lot.PartNumber,
+			Color:      lot.Color,
+			Quantity:   lot.Quantity,
+			Label:      lot.BrickLinkID,
+		}
+	}
+
+	w.Header().Set("X-Unmapped-Lots", fmt.Sprintf("%d", len(report.Unmapped)))
+
+	if format == "zip" {
+		writeWantedListZip(w, r, items, report)
+		return
+	}
+
+	req := ContactSheetRequest{Title: "Wanted List", Items: items, Format: format}
+	base, err := req.validate()
+	if err != nil {
+		sendValidationError(w, err)
+		return
+	}
+	writeContactSheet(w, r, req, base)
+}
+
+// Map every lot to an LDraw part and color
+func mapWantedList(ctx context.Context, inv brickLinkInventory) WantedListReport {
+	colors := brickLinkColors
+	if rebrickableAPIKey != "" {
+		if rb, err := rebrickableBrickLinkColors(ctx); err == nil {
+			colors = rb
+		} else {
+			log.Printf("Falling back to built-in BrickLink colors: %v", err)
+		}
+	}
+
+	report := WantedListReport{Mapped: []WantedListLot{}, Unmapped: []WantedListLot{}, UnmappedColors: []WantedListLot{}}
+	for i, item := range inv.Items {
+		lot := WantedListLot{
+			Lot:            i + 1,
+			ItemType:       strings.ToUpper(strings.TrimSpace(item.ItemType)),
+			BrickLinkID:    strings.TrimSpace(item.ItemID),
+			BrickLinkColor: item.Color,
+			Quantity:       max(item.MinQty, item.Qty, 1),
+		}
+
+		if lot.ItemType != "P" {
+			lot.Reason = fmt.Sprintf("item type %q is not a part", lot.ItemType)
+			report.Unmapped = append(report.Unmapped, lot)
+			continue
+		}
+
+		lot.PartNumber = mapBrickLinkPart(ctx, lot.BrickLinkID)
+		if lot.PartNumber == "" {
+			lot.Reason = "no LDraw equivalent found"
+			report.Unmapped = append(report.Unmapped, lot)
+			continue
+		}
+
+		// BrickLink color 0 means "not applicable"
+		if item.Color != 0 {
+			if code, ok := colors[item.Color]; ok {
+				if _, known := lookupColor(code); known {
+					lot.Color = &code
+				}
+			}
+			if lot.Color == nil {
+				report.UnmappedColors = append(report.UnmappedColors, lot)
+			}
+		}
+		report.Mapped = append(report.Mapped, lot)
+	}
+	return report
+}
+
+// Map a BrickLink part number to a part in the LDraw library, trying the
+// operator map, the library itself, then Rebrickable
+func mapBrickLinkPart(ctx context.Context, id string) string {
+	brickLinkPartMapOnce.Do(loadBrickLinkPartMap)
+	if mapped, ok := brickLinkPartMap[strings.ToLower(id)]; ok {
+		return mapped
+	}
+	if findPartFile(id) != "" {
+		return id
+	}
+	if rebrickableAPIKey == "" {
+		return ""
+	}
+
+	brickLinkLookupMu.Lock()
+	cached, ok := brickLinkLookupCache[id]
+	brickLinkLookupMu.Unlock()
+	if ok {
+		return cached
+	}
+
+	part, err := rebrickablePartForBrickLink(ctx, id)
+	if err != nil {
+		log.Printf("Rebrickable lookup for BrickLink part %s failed: %v", id, err)
+		return ""
+	}
+	if part != "" && findPartFile(part) == "" {
+		part = ""
+	}
+	brickLinkLookupMu.Lock()
+	brickLinkLookupCache[id] = part
+	brickLinkLookupMu.Unlock()
+	return part
+}
+
+func loadBrickLinkPartMap() {
+	brickLinkPartMap = make(map[string]string)
+	if brickLinkPartMapFile == "" {
+		return
+	}
+	data, err := os.ReadFile(brickLinkPartMapFile)
+	if err != nil {
+		log.Printf("Failed to read BrickLink part map: %v", err)
+		return
+	}
+	var m map[string]string
+	if err := json.Unmarshal(data, &m); err != nil {
+		log.Printf("Failed to parse BrickLink part map: %v", err)
+		return
+	}
+	for bl, ldraw := range m {
+		brickLinkPartMap[strings.ToLower(bl)] = ldraw
+	}
+	log.Printf("Loaded %d BrickLink part mappings", len(brickLinkPartMap))
+}
+
+// Write one labelled SVG per lot plus the mapping report as a ZIP archive
+func writeWantedListZip(w http.ResponseWriter, r *http.Request, items []InventoryItem, report WantedListReport) {
+	req := ContactSheetRequest{Items: items, Columns: 1, Rows: 1}
+	base, err := req.validate()
+	if err != nil {
+		sendValidationError(w, err)
+		return
+	}
+
+	thumbs := renderItems(r.Context(), items, base)
+	if r.Context().Err() != nil {
+		return
+	}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for i, item := range items {
+		lot := report.Mapped[i]
+		name := fmt.Sprintf("%03d-%s-%d.svg", lot.Lot, sanitizeFilename(lot.BrickLinkID), lot.BrickLinkColor)
+		f, err := zw.Create(name)
+		if err != nil {
+			sendError(w, http.StatusInternalServerError, "Failed to build archive", err.Error())
+			return
+		}
+		f.Write(buildContactSheetPage(ContactSheetRequest{Title: fmt.Sprintf("Lot %d", lot.Lot), Columns: 1, Rows: 1}, []InventoryItem{item}, thumbs, base, 1, 1))
+	}
+	if f, err := zw.Create("report.json"); err == nil {
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		enc.Encode(report)
+	}
+	if err := zw.Close(); err != nil {
+		sendError(w, http.StatusInternalServerError, "Failed to build archive", err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="wantedlist.zip"`)
+	w.Write(buf.Bytes())
+}
+
+// Read an uploaded file from a multipart "file" field or the raw request body
+func readUpload(w http.ResponseWriter, r *http.Request, maxBytes int64) ([]byte, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxBytes)
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		return io.ReadAll(file)
+	}
+	return io.ReadAll(r.Body)
+}
+
+// Helper: keep only characters that are safe in archive file names
+func sanitizeFilename(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.' {
+			return r
+		}
+		return '_'
+	}, s)
+}
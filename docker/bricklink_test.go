@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"testing"
+)
+
+const testWantedList = `<?xml version="1.0" encoding="UTF-8"?>
+<INVENTORY>
+  <ITEM><ITEMTYPE>P</ITEMTYPE><ITEMID>3001</ITEMID><COLOR>5</COLOR><MINQTY>4</MINQTY></ITEM>
+  <ITEM><ITEMTYPE>P</ITEMTYPE><ITEMID>3001</ITEMID><COLOR>999</COLOR></ITEM>
+  <ITEM><ITEMTYPE>P</ITEMTYPE><ITEMID>xyz123</ITEMID><COLOR>11</COLOR></ITEM>
+  <ITEM><ITEMTYPE>M</ITEMTYPE><ITEMID>sw0001</ITEMID></ITEM>
+</INVENTORY>`
+
+func TestMapWantedList(t *testing.T) {
+	withTestLibrary(t, map[string]string{"3001": "0 Brick  2 x  4\n"})
+	oldKey := rebrickableAPIKey
+	rebrickableAPIKey = ""
+	defer func() { rebrickableAPIKey = oldKey }()
+
+	var inv brickLinkInventory
+	if err := xml.Unmarshal([]byte(testWantedList), &inv); err != nil {
+		t.Fatalf("parsing wanted list: %v", err)
+	}
+
+	report := mapWantedList(context.Background(), inv)
+
+	if len(report.Mapped) != 2 {
+		t.Fatalf("expected 2 mapped lots, got %+v", report.Mapped)
+	}
+	red := report.Mapped[0]
+	if red.PartNumber != "3001" || red.Color == nil || *red.Color != 4 || red.Quantity != 4 {
+		t.Errorf("unexpected mapping for red 3001: %+v", red)
+	}
+	if len(report.UnmappedColors) != 1 || report.UnmappedColors[0].BrickLinkColor != 999 {
+		t.Errorf("expected BrickLink color 999 to be reported, got %+v", report.UnmappedColors)
+	}
+
+	if len(report.Unmapped) != 2 {
+		t.Fatalf("expected 2 unmapped lots, got %+v", report.Unmapped)
+	}
+	if report.Unmapped[0].BrickLinkID != "xyz123" || report.Unmapped[1].ItemType != "M" {
+		t.Errorf("unexpected unmapped lots: %+v", report.Unmapped)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+)
+
+// Part renders are cached in the result store (see store.go) under
+// renders/: on disk under STATE_DIR/renders by default. Entries are keyed by
+// the part, every render option, and the render version (script and
+// library), so upgrades never serve stale output. Renders are canonical (see
+// canonicalizeSVG), so a cached SVG is byte-identical to a fresh one.
+var renderCache = newRenderCache(results)
+
+type resultCache struct {
+	store resultStore
+	// Hottest entries, in front of the store
+	memory *lruCache
+}
+
+// A nil cache (no result store) misses every lookup and stores nothing
+func newRenderCache(store resultStore) *resultCache {
+	if store == nil {
+		return nil
+	}
+	return &resultCache{store: store, memory: newLRUCache(int64(renderMemoryCacheBytes))}
+}
+
+var renderVersionValue atomic.Value
+
+// Version of everything a render depends on besides its request: the render
+// script and the LDraw library. It's computed on first use and refreshed by
+// the popular-part scheduler, which watches it for changes.
+func renderVersion() string {
+	if v, ok := renderVersionValue.Load().(string); ok {
+		return v
+	}
+	return refreshRenderVersion()
+}
+
+func refreshRenderVersion() string {
+	v := libraryRenderVersion(ldrawPath)
+	renderVersionValue.Store(v)
+	// The script may have changed under the snapshots too (see library.go)
+	snapshotVersions.Lock()
+	clear(snapshotVersions.byName)
+	snapshotVersions.Unlock()
+	return v
+}
+
+// The render version for renders from the library at root
+func libraryRenderVersion(root string) string {
+	h := sha256.New()
+	if script, err := os.ReadFile(renderScript); err == nil {
+		h.Write(script)
+	}
+	// A library update ships a new LDConfig.ldr and touches the parts
+	// directory; hashing every part file would take too long
+	if config, err := os.ReadFile(filepath.Join(root, "LDConfig.ldr")); err == nil {
+		h.Write(config)
+	}
+	if info, err := os.Stat(filepath.Join(root, "parts")); err == nil {
+		fmt.Fprintf(h, "%d", info.ModTime().UnixNano())
+	}
+	return hex.EncodeToString(h.Sum(nil)[:8])
+}
+
+// Identify a part render request, independent of the render version
+func renderRequestKey(partNumber string, opts RenderOptions) string {
+	params, _ := json.Marshal(opts)
+	return strings.ToLower(partNumber) + "\n" + string(params)
+}
+
+// Cache key for a part render, under the version of the library it renders
+// from (see library.go). A part changed by a library update (see
+// libupdate.go) has a revision, which its key includes.
+func renderCacheKey(partNumber string, opts RenderOptions) string {
+	version := renderVersionFor(opts.LibraryVersion)
+	if rev := partRevision(partNumber); rev > 0 && opts.LibraryVersion == "" {
+		version += fmt.Sprintf("+%d", rev)
+	}
+	sum := sha256.Sum256([]byte(version + "\n" + renderRequestKey(partNumber, opts)))
+	return hex.EncodeToString(sum[:])
+}
+
+func (c *resultCache) path(key string) string {
+	return "renders/" + key[:2] + "/" + key + ".svg"
+}
+
+func (c *resultCache) get(key string) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+	if svg, ok := c.memory.get(key); ok {
+		recordCacheLookup("memory")
+		return svg, true
+	}
+	svg, err := c.store.get(c.path(key))
+	if err != nil {
+		if !errors.Is(err, errNotStored) {
+			log.Printf("Render cache read failed: %v", err)
+		}
+		recordCacheLookup("")
+		return nil, false
+	}
+	recordCacheLookup("disk")
+	c.memory.put(key, svg)
+	return svg, true
+}
+
+func (c *resultCache) has(key string) bool {
+	if c == nil {
+		return false
+	}
+	if _, ok := c.memory.get(key); ok {
+		return true
+	}
+	ok, _ := c.store.has(c.path(key))
+	return ok
+}
+
+// Store a render. Its compressed variants are stored by encodedSVG on the
+// first request for each encoding.
+func (c *resultCache) put(key string, svg []byte) error {
+	if c == nil {
+		return nil
+	}
+	c.memory.put(key, svg)
+	return c.store.put(c.path(key), svg, "image/svg+xml")
+}
+
+// A cached render's compressed variants sit beside it, named for the hash
+// of the SVG they compress, so a render that differs from the cached one (a
+// fresh replay) is never served the cached one's variant
+func (c *resultCache) encodedPath(key, hash, encoding string) string {
+	ext := map[string]string{"gzip": ".gz", "br": ".br"}[encoding]
+	return "renders/" + key[:2] + "/" + key + "." + hash[:16] + ".svg" + ext
+}
+
+func (c *resultCache) getEncoded(key, hash, encoding string) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+	path := c.encodedPath(key, hash, encoding)
+	if body, ok := c.memory.get(path); ok {
+		return body, true
+	}
+	body, err := c.store.get(path)
+	if err != nil {
+		return nil, false
+	}
+	c.memory.put(path, body)
+	return body, true
+}
+
+func (c *resultCache) putEncoded(key, hash, encoding string, body []byte) {
+	if c == nil {
+		return
+	}
+	path := c.encodedPath(key, hash, encoding)
+	c.memory.put(path, body)
+	if err := c.store.put(path, body, "application/octet-stream"); err != nil {
+		log.Printf("Failed to cache %s response: %v", encoding, err)
+	}
+}
+
+// Write a file via a rename so readers never see a partial file
+func writeFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("creating dir: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Entries and bytes held in memory
+func (c *resultCache) memoryStats() (int, int64) {
+	if c == nil {
+		return 0, 0
+	}
+	return c.memory.stats()
+}
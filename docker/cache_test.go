@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"os"
+	"testing"
+)
+
+func withRenderCache(t *testing.T) *resultCache {
+	t.Helper()
+	old := renderCache
+	renderCache = newRenderCache(dirStore{dir: t.TempDir()})
+	t.Cleanup(func() { renderCache = old })
+	return renderCache
+}
+
+func TestRenderPartCache(t *testing.T) {
+	capture := withFakeBlender(t)
+	withTestLibrary(t, map[string]string{"3001": "0 Brick 2 x 4\n"})
+	cache := withRenderCache(t)
+
+	req := RenderRequest{}
+	opts, _ := req.options()
+	first, _, err := renderPart(context.Background(), "3001", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cache.has(renderCacheKey("3001", opts)) {
+		t.Fatal("render was not cached")
+	}
+
+	// A hit doesn't run Blender
+	os.Remove(capture)
+	again, d, err := renderPart(context.Background(), "3001", opts)
+	if err != nil || string(again) != string(first) || d != 0 {
+		t.Errorf("expected the cached render, got %d bytes in %v (%v)", len(again), d, err)
+	}
+	if _, err := os.Stat(capture); err == nil {
+		t.Error("cache hit should not render")
+	}
+
+	opts.Thickness = 3
+	if cache.has(renderCacheKey("3001", opts)) || renderCacheKey("3001", opts) == renderCacheKey("3002", opts) {
+		t.Error("keys should cover the part and its options")
+	}
+}
+
+func TestNilRenderCache(t *testing.T) {
+	var cache *resultCache
+	if err := cache.put("abc", []byte("<svg/>")); err != nil {
+		t.Error(err)
+	}
+	if _, ok := cache.get("abc"); ok || cache.has("abc") {
+		t.Error("a nil cache should always miss")
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Freestyle's SVG writer is not stable across Blender versions: attribute
+// order, number formatting, and generator comments all drift between
+// releases. Renders are canonicalized before any other post-processing so
+// identical inputs give byte-identical SVGs, which caching and ETags rely
+// on. Element order is paint order and is kept as exported, and the ids
+// are lineset and layer names, which are already stable.
+
+// Path coordinates are kept to a thousandth of a pixel. Requests can ask
+// for fewer decimal places with precision, which is applied after every
+// other post-processing step.
+const canonicalPrecision = 3
+
+var (
+	svgCommentPattern  = regexp.MustCompile(`(?s)<!--.*?-->\s*`)
+	svgMetadataPattern = regexp.MustCompile(`(?s)<metadata\b.*?</metadata>\s*|<metadata\b[^>]*/>\s*`)
+	svgStartTagPattern = regexp.MustCompile(`<([A-Za-z][\w:.-]*)(\s[^<>]*?)?\s*(/?)>`)
+	svgPathNumPattern  = regexp.MustCompile(`[-+]?(?:\d+\.?\d*|\.\d+)(?:[eE][-+]?\d+)?`)
+)
+
+// Rewrite a rendered SVG in canonical form: comments and metadata (where
+// exporters put timestamps and version strings) are dropped, attributes
+// are sorted, and path data is reformatted at a fixed precision.
+func canonicalizeSVG(svg []byte) []byte {
+	svg = bytes.ReplaceAll(svg, []byte("\r\n"), []byte("\n"))
+	svg = svgCommentPattern.ReplaceAll(svg, nil)
+	svg = svgMetadataPattern.ReplaceAll(svg, nil)
+	return svgStartTagPattern.ReplaceAllFunc(svg, canonicalStartTag)
+}
+
+func canonicalStartTag(tag []byte) []byte {
+	m := svgStartTagPattern.FindSubmatch(tag)
+	name, rest, selfClosing := string(m[1]), string(m[2]), len(m[3]) > 0
+
+	type attr struct{ name, value string }
+	var attrs []attr
+	for _, a := range svgAttrPattern.FindAllStringSubmatch(rest, -1) {
+		attrs = append(attrs, attr{a[1], a[2]})
+	}
+	// Leave tags with anything the pattern doesn't cover (single-quoted
+	// values, stray text) as they are
+	if strings.TrimSpace(svgAttrPattern.ReplaceAllString(rest, "")) != "" {
+		return tag
+	}
+
+	sort.SliceStable(attrs, func(i, j int) bool {
+		ri, rj := canonicalAttrRank(attrs[i].name), canonicalAttrRank(attrs[j].name)
+		if ri != rj {
+			return ri < rj
+		}
+		return attrs[i].name < attrs[j].name
+	})
+
+	var b strings.Builder
+	b.WriteByte('<')
+	b.WriteString(name)
+	for _, a := range attrs {
+		value := a.value
+		if a.name == "d" {
+			value = canonicalPathData(value)
+		}
+		b.WriteByte(' ')
+		b.WriteString(a.name)
+		b.WriteString(`="`)
+		b.WriteString(value)
+		b.WriteByte('"')
+	}
+	if selfClosing {
+		b.WriteString(" />")
+	} else {
+		b.WriteByte('>')
+	}
+	return []byte(b.String())
+}
+
+// Namespace declarations lead, then the id, then everything else by name.
+// Path data goes last so the short attributes stay readable.
+func canonicalAttrRank(name string) int {
+	switch {
+	case name == "xmlns" || strings.HasPrefix(name, "xmlns:"):
+		return 0
+	case name == "id":
+		return 1
+	case name == "d":
+		return 3
+	}
+	return 2
+}
+
+// Reformat path data as "M x,y x,y z", with every number at the canonical
+// precision. Data that doesn't parse is returned unchanged.
+func canonicalPathData(d string) string {
+	return pathDataAt(d, canonicalPrecision)
+}
+
+// Round a rendered SVG's path data to fewer decimal places than canonical
+func applyPrecision(svg []byte, precision int) []byte {
+	if precision >= canonicalPrecision {
+		return svg
+	}
+	return svgPathPattern.ReplaceAllFunc(svg, func(path []byte) []byte {
+		return svgPathDataPattern.ReplaceAllFunc(path, func(m []byte) []byte {
+			d := svgPathDataPattern.FindSubmatch(m)[1]
+			return []byte(` d="` + pathDataAt(string(d), precision) + `"`)
+		})
+	})
+}
+
+func pathDataAt(d string, precision int) string {
+	var b strings.Builder
+	var args []string
+	command := byte(0)
+	flush := func() {
+		if command == 0 {
+			return
+		}
+		if b.Len() > 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteByte(command)
+		// Coordinate pairs are joined with a comma; arcs and the
+		// single-axis lines are plain lists
+		paired := !strings.ContainsRune("HhVvAa", rune(command)) && len(args)%2 == 0
+		for i, arg := range args {
+			if paired && i%2 == 1 {
+				b.WriteByte(',')
+			} else {
+				b.WriteByte(' ')
+			}
+			b.WriteString(arg)
+		}
+		args = args[:0]
+	}
+
+	for i := 0; i < len(d); {
+		c := d[i]
+		switch {
+		case c == ' ' || c == ',' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case strings.IndexByte("MmLlHhVvCcSsQqTtAaZz", c) >= 0:
+			flush()
+			command = c
+			i++
+		default:
+			loc := svgPathNumPattern.FindStringIndex(d[i:])
+			if loc == nil || loc[0] != 0 || command == 0 {
+				return d
+			}
+			v, err := strconv.ParseFloat(d[i:i+loc[1]], 64)
+			if err != nil {
+				return d
+			}
+			args = append(args, formatPathNumber(v, precision))
+			i += loc[1]
+		}
+	}
+	flush()
+	return b.String()
+}
+
+func formatPathNumber(v float64, precision int) string {
+	s := strconv.FormatFloat(v, 'f', precision, 64)
+	if strings.Contains(s, ".") {
+		s = strings.TrimRight(strings.TrimRight(s, "0"), ".")
+	}
+	if s == "-0" || math.IsNaN(v) {
+		s = "0"
+	}
+	return s
+}
+
+// A strong ETag for a render. Canonical output makes it stable across
+// re-renders and Blender upgrades.
+func svgETag(svg []byte) string {
+	return `"` + svgHash(svg) + `"`
+}
+
+func svgHash(svg []byte) string {
+	sum := sha256.Sum256(svg)
+	return hex.EncodeToString(sum[:16])
+}
+
+// Whether an If-None-Match header lists the ETag (or is "*")
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == "*" {
+			return true
+		}
+	}
+	return false
+}
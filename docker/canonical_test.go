@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCanonicalizeSVG(t *testing.T) {
+	// The same drawing as two exporter versions might write it
+	a := "<?xml version='1.0' encoding='utf-8'?>\r\n<!-- Created with Blender 3.6.2 on 2026-01-01 -->\r\n" +
+		`<svg xmlns="http://www.w3.org/2000/svg" version="1.1" width="64" height="64">` + "\r\n" +
+		"<metadata><dc:date>2026-01-01</dc:date></metadata>\r\n" +
+		`<path stroke="black" fill="none" d=" M 0.000, 10.000 20.0004, -0.0001  z " /></svg>`
+	b := "<?xml version='1.0' encoding='utf-8'?>\n" +
+		`<svg width="64" height="64" version="1.1" xmlns="http://www.w3.org/2000/svg">` + "\n" +
+		`<path d="M0,10L20,0Z" fill="none" stroke="black"/></svg>`
+
+	gotA, gotB := canonicalizeSVG([]byte(a)), canonicalizeSVG([]byte(b))
+	want := "<?xml version='1.0' encoding='utf-8'?>\n" +
+		`<svg xmlns="http://www.w3.org/2000/svg" height="64" version="1.1" width="64">` + "\n" +
+		`<path fill="none" stroke="black" d="M 0,10 20,0 z" /></svg>`
+	if string(gotA) != want {
+		t.Errorf("got:\n%s\nwant:\n%s", gotA, want)
+	}
+	// Different path commands stay different; everything else matches
+	if strings.Replace(string(gotB), "M 0,10 L 20,0 Z", "M 0,10 20,0 z", 1) != want {
+		t.Errorf("got:\n%s\nwant:\n%s", gotB, want)
+	}
+}
+
+func TestCanonicalPathData(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{" M 30.720, 334.774 30.720, 570.552  z  M 1.0, 2.0 ", "M 30.72,334.774 30.72,570.552 z M 1,2"},
+		{"M 0 0 C 1.23456 2 3 4 5e1 6", "M 0,0 C 1.235,2 3,4 50,6"},
+		{"M 0 0 H 10 V -0.0001 A 5 5 0 0 1 10 10", "M 0,0 H 10 V 0 A 5 5 0 0 1 10 10"},
+		{"M 0 0 L x", "M 0 0 L x"},
+	}
+	for _, tt := range tests {
+		if got := canonicalPathData(tt.in); got != tt.want {
+			t.Errorf("canonicalPathData(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestApplyPrecision(t *testing.T) {
+	svg := []byte(`<g><path d="M 30.72,334.774 30.726,570.552 z" fill="none" stroke-width="1.125" /></g>`)
+	if got := applyPrecision(svg, canonicalPrecision); !bytes.Equal(got, svg) {
+		t.Errorf("expected canonical precision unchanged: %s", got)
+	}
+	want := `<g><path d="M 30.7,334.8 30.7,570.6 z" fill="none" stroke-width="1.125" /></g>`
+	if got := string(applyPrecision(svg, 1)); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	for _, p := range []int{-1, 4} {
+		req := RenderRequest{Precision: &p}
+		if _, err := req.options(); err == nil {
+			t.Errorf("expected an error for precision %d", p)
+		}
+	}
+}
+
+// The golden examples are stored canonicalized
+func TestGoldenFilesAreCanonical(t *testing.T) {
+	files, _ := filepath.Glob(filepath.Join("..", "examples", "*.svg"))
+	for _, file := range files {
+		svg, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(canonicalizeSVG(svg), svg) {
+			t.Errorf("%s is not in canonical form", filepath.Base(file))
+		}
+	}
+}
+
+func TestRenderETag(t *testing.T) {
+	withFakeBlender(t)
+	withTestLibrary(t, map[string]string{"3001": "0 Brick 2 x 4\n"})
+
+	render := func(etag string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/render", strings.NewReader(`{"partNumber":"3001"}`))
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		w := httptest.NewRecorder()
+		handleRender(w, req)
+		return w
+	}
+
+	first := render("")
+	etag := first.Header().Get("ETag")
+	if first.Code != http.StatusOK || etag == "" {
+		t.Fatalf("status %d, ETag %q", first.Code, etag)
+	}
+	if etag != svgETag(first.Body.Bytes()) {
+		t.Error("ETag should hash the response body")
+	}
+	if again := render(""); again.Header().Get("ETag") != etag {
+		t.Error("identical renders should share an ETag")
+	}
+	if cached := render(`"other", ` + etag); cached.Code != http.StatusNotModified || cached.Body.Len() != 0 {
+		t.Errorf("expected 304 with no body, got %d", cached.Code)
+	}
+}
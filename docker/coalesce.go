@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Identical renders (same render cache key) that arrive while one is already
+// running wait for it instead of starting Blender again, so a burst of
+// requests for a thumbnail after a cache flush costs one render. Callers
+// that joined another's render get its result with no render duration.
+// Anything charged to a caller's key happens before it joins (see
+// renderPart), so a flight only carries the render's own outcome.
+
+type renderFlight struct {
+	done chan struct{}
+	svg  []byte
+	d    time.Duration
+	err  error
+}
+
+// Renders in progress by cache key
+var renderFlights = struct {
+	sync.Mutex
+	byKey map[string]*renderFlight
+}{byKey: map[string]*renderFlight{}}
+
+// Run render for key, or wait for the identical render already running. If
+// that render is abandoned by its own caller, the next waiter takes over.
+func coalesceRender(ctx context.Context, key string, render func() ([]byte, time.Duration, error)) ([]byte, time.Duration, error) {
+	for {
+		renderFlights.Lock()
+		f, ok := renderFlights.byKey[key]
+		if !ok {
+			f = &renderFlight{done: make(chan struct{})}
+			renderFlights.byKey[key] = f
+			renderFlights.Unlock()
+
+			f.svg, f.d, f.err = render()
+			renderFlights.Lock()
+			delete(renderFlights.byKey, key)
+			renderFlights.Unlock()
+			close(f.done)
+			return f.svg, f.d, f.err
+		}
+		renderFlights.Unlock()
+
+		select {
+		case <-f.done:
+		case <-ctx.Done():
+			return nil, 0, ctx.Err()
+		}
+		// The leader's own cancellation or deadline isn't this caller's
+		if (errors.Is(f.err, context.Canceled) || errors.Is(f.err, context.DeadlineExceeded)) && ctx.Err() == nil {
+			continue
+		}
+		recordRenderCoalesced()
+		if f.err != nil {
+			recordKeyUsage(ctx, func(u *usageDay) { u.Errors++ })
+		}
+		return f.svg, 0, f.err
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCoalesceRender(t *testing.T) {
+	before := metrics.RendersCoalesced
+	var calls atomic.Int32
+	release := make(chan struct{})
+	render := func() ([]byte, time.Duration, error) {
+		calls.Add(1)
+		<-release
+		return []byte("<svg/>"), time.Second, nil
+	}
+
+	var wg sync.WaitGroup
+	durations := make([]time.Duration, 5)
+	for i := range durations {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			svg, d, err := coalesceRender(context.Background(), "k", render)
+			if err != nil || string(svg) != "<svg/>" {
+				t.Errorf("got %q, %v", svg, err)
+			}
+			durations[i] = d
+		}()
+	}
+	// Let every caller reach the flight before it lands
+	for {
+		renderFlights.Lock()
+		_, started := renderFlights.byKey["k"]
+		renderFlights.Unlock()
+		if started && calls.Load() == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if n := calls.Load(); n != 1 {
+		t.Errorf("expected one render, got %d", n)
+	}
+	rendered := 0
+	for _, d := range durations {
+		if d > 0 {
+			rendered++
+		}
+	}
+	if rendered != 1 || metrics.RendersCoalesced-before != 4 {
+		t.Errorf("expected one render and four joined, got %v and %d", durations, metrics.RendersCoalesced-before)
+	}
+
+	// Later calls render again
+	release = make(chan struct{})
+	close(release)
+	if _, d, _ := coalesceRender(context.Background(), "k", render); d == 0 || calls.Load() != 2 {
+		t.Errorf("expected a fresh render once the first finished")
+	}
+}
+
+func TestCoalesceRenderHandsOver(t *testing.T) {
+	leaderCtx, cancel := context.WithCancel(context.Background())
+	started := make(chan struct{})
+	leaderDone := make(chan struct{})
+	go func() {
+		defer close(leaderDone)
+		coalesceRender(leaderCtx, "handover", func() ([]byte, time.Duration, error) {
+			close(started)
+			<-leaderCtx.Done()
+			return nil, 0, leaderCtx.Err()
+		})
+	}()
+	<-started
+
+	result := make(chan string)
+	go func() {
+		svg, _, err := coalesceRender(context.Background(), "handover", func() ([]byte, time.Duration, error) {
+			return []byte("<svg>mine</svg>"), time.Second, nil
+		})
+		if err != nil {
+			t.Error(err)
+		}
+		result <- string(svg)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	// The first caller gives up; the waiter renders for itself
+	cancel()
+	<-leaderDone
+	if svg := <-result; svg != "<svg>mine</svg>" {
+		t.Errorf("expected the waiter to take over, got %q", svg)
+	}
+
+	// A waiter that gives up returns at once
+	block := make(chan struct{})
+	defer close(block)
+	go coalesceRender(context.Background(), "stuck", func() ([]byte, time.Duration, error) {
+		<-block
+		return nil, 0, nil
+	})
+	for {
+		renderFlights.Lock()
+		_, ok := renderFlights.byKey["stuck"]
+		renderFlights.Unlock()
+		if ok {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	ctx, cancelWait := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancelWait()
+	if _, _, err := coalesceRender(ctx, "stuck", nil); err != context.DeadlineExceeded {
+		t.Errorf("expected the waiter's deadline, got %v", err)
+	}
+}
+
+func TestCoalesceRenderChargesEachKey(t *testing.T) {
+	withFakeBlender(t)
+	withTestLibrary(t, map[string]string{"3001": "0 Brick 2 x 4\n"})
+	withRenderCache(t)
+	withAPIKeys(t, `[{"key":"ka","name":"team-a","monthlyQuota":1},{"key":"kb","name":"team-b","monthlyQuota":5}]`)
+	ctxA := context.WithValue(context.Background(), apiKeyContextKey{}, apiKeys["ka"])
+	ctxB := context.WithValue(context.Background(), apiKeyContextKey{}, apiKeys["kb"])
+	if err := chargeRender(ctxA); err != nil {
+		t.Fatal(err)
+	}
+
+	// A render of 3001 in flight, standing in for team-a's
+	opts, _ := (&RenderRequest{}).options()
+	f := &renderFlight{done: make(chan struct{})}
+	renderFlights.Lock()
+	renderFlights.byKey[renderCacheKey("3001", opts)] = f
+	renderFlights.Unlock()
+
+	result := make(chan error)
+	go func() {
+		svg, _, err := renderPart(ctxB, "3001", opts)
+		if err == nil && string(svg) != "<svg>shared</svg>" {
+			err = fmt.Errorf("got %q", svg)
+		}
+		result <- err
+	}()
+	// team-a is over quota, so it's refused on its own account rather than
+	// joining, and team-b is charged before it joins
+	ctx, cancel := context.WithTimeout(ctxA, time.Second)
+	defer cancel()
+	_, _, err := renderPart(ctx, "3001", opts)
+	var re *RenderError
+	if !errors.As(err, &re) || re.Status != http.StatusTooManyRequests || !strings.Contains(re.Detail, "team-a") {
+		t.Errorf("team-a: expected its own 429, got %v", err)
+	}
+	for deadline := time.Now().Add(time.Second); monthlyRenders("team-b", time.Now()) != 1; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("team-b wasn't charged before joining")
+		}
+	}
+
+	f.svg, f.d = []byte("<svg>shared</svg>"), time.Second
+	renderFlights.Lock()
+	delete(renderFlights.byKey, renderCacheKey("3001", opts))
+	renderFlights.Unlock()
+	close(f.done)
+	if err := <-result; err != nil {
+		t.Errorf("team-b: %v", err)
+	}
+	if n := monthlyRenders("team-a", time.Now()); n != 1 {
+		t.Errorf("team-a charged %d renders, want 1", n)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"regexp"
+)
+
+// Dark-mode palette. Default black/currentColor strokes turn light and
+// white fills turn dark gray, so a render stays visible on dark pages;
+// colored fills are left alone.
+const (
+	darkBackground = "#121212"
+	darkStroke     = "#e6e6e6"
+	darkFill       = "#2a2a2a"
+)
+
+var (
+	svgBackgroundPattern = regexp.MustCompile(`<rect\b[^>]*\bwidth="100%"[^>]*>`)
+	svgWhiteFillPattern  = regexp.MustCompile(`\bfill="(?:white|#fff|#ffffff|#FFFFFF)"`)
+	svgDarkStrokePattern = regexp.MustCompile(`\bstroke="(?:currentColor|black|#000|#000000)"`)
+)
+
+// The style embedded by colorScheme "auto": the same rewrites as "dark",
+// applied only when the viewer prefers a dark color scheme
+const colorSchemeStyle = `<style>@media (prefers-color-scheme: dark) {
+rect[width="100%"][fill="white"] { fill: ` + darkBackground + ` }
+path[stroke="currentColor"], path[stroke="black"], path[stroke="#000"], path[stroke="#000000"] { stroke: ` + darkStroke + ` }
+path[fill="white"], path[fill="#fff"], path[fill="#ffffff"], path[fill="#FFFFFF"] { fill: ` + darkFill + ` }
+}</style>
+`
+
+// Apply a validated color scheme (light, dark, or auto) to a rendered SVG.
+// Light is the render as-is.
+func applyColorScheme(svg []byte, scheme string) []byte {
+	switch scheme {
+	case "dark":
+		svg = svgBackgroundPattern.ReplaceAllFunc(svg, func(rect []byte) []byte {
+			return svgWhiteFillPattern.ReplaceAll(rect, []byte(`fill="`+darkBackground+`"`))
+		})
+		svg = svgPathPattern.ReplaceAllFunc(svg, func(path []byte) []byte {
+			path = svgWhiteFillPattern.ReplaceAll(path, []byte(`fill="`+darkFill+`"`))
+			return svgDarkStrokePattern.ReplaceAll(path, []byte(`stroke="`+darkStroke+`"`))
+		})
+		return svg
+	case "auto":
+		loc := svgRootPattern.FindIndex(svg)
+		if loc == nil {
+			return svg
+		}
+		out := make([]byte, 0, len(svg)+len(colorSchemeStyle)+1)
+		out = append(out, svg[:loc[1]]...)
+		out = append(out, '\n')
+		out = append(out, colorSchemeStyle...)
+		return append(out, svg[loc[1]:]...)
+	}
+	return svg
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+const testSchemeSVG = `<?xml version='1.0' encoding='utf-8'?>
+<svg xmlns="http://www.w3.org/2000/svg" width="64" height="64">
+<rect width="100%" height="100%" fill="white" /><g id="ViewLayer_Edges">
+<path stroke="none" fill-opacity="1.0" fill="white" d="M 0 0 z" />
+<path stroke="none" fill-opacity="1.0" fill="#C91A09" d="M 0 0 z" />
+<path fill="none" stroke-width="2.0" stroke="currentColor" d="M 0 0 L 1 1" />
+<path fill="none" stroke-width="2.0" stroke="#4a90d9" d="M 0 0 L 1 1" />
+</g>
+</svg>
+`
+
+func TestApplyColorSchemeDark(t *testing.T) {
+	got := string(applyColorScheme([]byte(testSchemeSVG), "dark"))
+	for _, want := range []string{
+		`<rect width="100%" height="100%" fill="` + darkBackground + `" />`,
+		`fill="` + darkFill + `" d=`,
+		`fill="#C91A09"`,
+		`stroke="` + darkStroke + `"`,
+		`stroke="#4a90d9"`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("dark SVG is missing %s:\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, `fill="white"`) || strings.Contains(got, "currentColor") {
+		t.Errorf("light colors left in dark SVG:\n%s", got)
+	}
+	if err := checkSVG([]byte(got)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestApplyColorSchemeAuto(t *testing.T) {
+	got := applyColorScheme([]byte(testSchemeSVG), "auto")
+	if !strings.Contains(string(got), "@media (prefers-color-scheme: dark)") ||
+		!strings.Contains(string(got), `fill="white"`) {
+		t.Errorf("auto SVG should keep light colors and add a dark media query:\n%s", got)
+	}
+	if err := checkSVG(got); err != nil {
+		t.Error(err)
+	}
+	if string(applyColorScheme([]byte(testSchemeSVG), "light")) != testSchemeSVG {
+		t.Error("light scheme should leave the render unchanged")
+	}
+}
+
+func TestColorSchemeOption(t *testing.T) {
+	for scheme, want := range map[string]string{"": "light", "dark": "dark", "auto": "auto"} {
+		req := RenderRequest{ColorScheme: scheme}
+		opts, err := req.options()
+		if err != nil || opts.ColorScheme != want {
+			t.Errorf("colorScheme %q: got %q, %v", scheme, opts.ColorScheme, err)
+		}
+	}
+	req := RenderRequest{ColorScheme: "sepia"}
+	if _, err := req.options(); err == nil {
+		t.Error("expected an error for an unknown color scheme")
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const colorwaysMaxColors = 200
+
+type ColorwaysRequest struct {
+	RenderRequest
+	// Colors are LDraw color codes (numbers) or CSS colors (strings)
+	Colors []ColorwayColor `json:"colors"`
+	Format string          `json:"format"`
+}
+
+// ColorwayColor is either an LDraw color code or a CSS fill color
+type ColorwayColor struct {
+	Code *int
+	CSS  string
+}
+
+func (c *ColorwayColor) UnmarshalJSON(data []byte) error {
+	var code int
+	if err := json.Unmarshal(data, &code); err == nil {
+		c.Code = &code
+		return nil
+	}
+	if err := json.Unmarshal(data, &c.CSS); err != nil || c.CSS == "" {
+		return errors.New("colors must be LDraw color codes or CSS color strings")
+	}
+	return nil
+}
+
+// A resolved variant: the file name and fill it is emitted with
+type colorway struct {
+	Name        string  `json:"name"`
+	Code        *int    `json:"code,omitempty"`
+	ColorName   string  `json:"colorName,omitempty"`
+	FillColor   string  `json:"fillColor"`
+	FillOpacity float64 `json:"fillOpacity"`
+	Finish      string  `json:"finish,omitempty"`
+	SVG         string  `json:"svg,omitempty"`
+	finishColor string
+}
+
+// Fill paths are the ones the script writes with stroke="none"
+var (
+	svgPathPattern        = regexp.MustCompile(`<path\b[^>]*>`)
+	svgFillAttrPattern    = regexp.MustCompile(`\sfill="[^"]*"`)
+	svgOpacityAttrPattern = regexp.MustCompile(`\sfill-opacity="[^"]*"`)
+)
+
+// Colorways endpoint: render one part once and re-emit it in many fills
+func handleColorways(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		sendError(w, http.StatusMethodNotAllowed, "Method not allowed", "")
+		return
+	}
+
+	var req ColorwaysRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	var errs fieldErrors
+	if req.PartNumber == "" {
+		errs.add("partNumber", "partNumber is required")
+	}
+	if req.Format == "" {
+		req.Format = "zip"
+	}
+	if req.Format != "zip" && req.Format != "json" {
+		errs.add("format", "format must be zip or json")
+	}
+	opts, err := req.options()
+	errs.merge("", err)
+	if err := errs.err(); err != nil {
+		sendValidationError(w, err)
+		return
+	}
+	variants, err := resolveColorways(req.Colors, opts)
+	if err != nil {
+		sendError(w, http.StatusBadRequest, err.Error(), "")
+		return
+	}
+
+	// Geometry is rendered once per distinct opacity: translucent fills
+	// switch on hidden edges in the render script, so they need their own run
+	start := time.Now()
+	base := make(map[float64][]byte)
+	renders := 0
+	for i := range variants {
+		v := &variants[i]
+		svg, ok := base[v.FillOpacity]
+		if !ok {
+			o := opts
+			o.FillColor, o.FillOpacity = v.FillColor, v.FillOpacity
+			// Finishes and CSS variables are applied per variant below
+			o.Finish, o.FinishColor, o.CSSVariables = "", "", false
+			svg, _, err = renderPart(r.Context(), req.PartNumber, o)
+			if err != nil {
+				sendRenderError(w, err)
+				return
+			}
+			base[v.FillOpacity] = svg
+			renders++
+		}
+		finished := opts
+		finished.FillColor, finished.Finish, finished.FinishColor = v.FillColor, v.Finish, v.finishColor
+		variant := applyFinish(recolorSVG(svg, v.FillColor, v.FillOpacity), finished)
+		if opts.CSSVariables {
+			variant = applyCSSVariables(variant)
+		}
+		v.SVG = string(variant)
+	}
+	log.Printf("Colorways for %s: %d variants from %d renders in %.2fs", req.PartNumber, len(variants), renders, time.Since(start).Seconds())
+	w.Header().Set("X-Render-Count", strconv.Itoa(renders))
+
+	if req.Format == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"partNumber": req.PartNumber, "variants": variants})
+		return
+	}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, v := range variants {
+		f, err := zw.Create(sanitizeFilename(req.PartNumber) + "-" + v.Name + ".svg")
+		if err != nil {
+			sendError(w, http.StatusInternalServerError, "Failed to build archive", err.Error())
+			return
+		}
+		f.Write([]byte(v.SVG))
+	}
+	if err := zw.Close(); err != nil {
+		sendError(w, http.StatusInternalServerError, "Failed to build archive", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s-colorways.zip"`, sanitizeFilename(req.PartNumber)))
+	w.Write(buf.Bytes())
+}
+
+// Resolve requested colors to fills. LDraw colors bring their own alpha;
+// CSS colors use the request's fillOpacity.
+func resolveColorways(colors []ColorwayColor, opts RenderOptions) ([]colorway, error) {
+	if len(colors) == 0 {
+		return nil, errors.New("colors is required")
+	}
+	if len(colors) > colorwaysMaxColors {
+		return nil, fmt.Errorf("colors must contain at most %d entries", colorwaysMaxColors)
+	}
+
+	var variants []colorway
+	seen := make(map[string]bool)
+	for i, c := range colors {
+		v := colorway{FillColor: c.CSS, FillOpacity: opts.FillOpacity}
+		if c.Code != nil {
+			ldraw, ok := lookupColor(*c.Code)
+			if !ok {
+				return nil, fmt.Errorf("colors[%d]: %d is not a known LDraw color code", i, *c.Code)
+			}
+			v.Code = c.Code
+			v.ColorName = ldraw.Name
+			v.FillColor = ldraw.Value
+			v.Name = strconv.Itoa(*c.Code)
+			v.Finish, v.finishColor = ldraw.Finish, ldraw.FinishValue
+			if ldraw.Alpha < 255 && opts.FillOpacity == 1.0 {
+				v.FillOpacity = float64(ldraw.Alpha) / 255
+			}
+		} else {
+			css, ok := normalizeCSSColor(c.CSS)
+			if !ok {
+				return nil, fmt.Errorf("colors[%d]: invalid CSS color %q", i, c.CSS)
+			}
+			v.FillColor = css
+			v.Name = sanitizeFilename(strings.TrimPrefix(css, "#"))
+		}
+		if seen[v.Name] {
+			continue
+		}
+		seen[v.Name] = true
+		variants = append(variants, v)
+	}
+	return variants, nil
+}
+
+// Rewrite the fill (and fill opacity) of every fill path in a rendered SVG
+func recolorSVG(svg []byte, fill string, opacity float64) []byte {
+	opacityAttr := "1.0"
+	if opacity < 1.0 {
+		opacityAttr = fmt.Sprintf("%.4f", opacity)
+	}
+	return svgPathPattern.ReplaceAllFunc(svg, func(path []byte) []byte {
+		if !bytes.Contains(path, []byte(`stroke="none"`)) {
+			return path
+		}
+		path = svgFillAttrPattern.ReplaceAllFunc(path, func(m []byte) []byte {
+			return []byte(string(m[0]) + `fill="` + escapeXML(fill) + `"`)
+		})
+		return svgOpacityAttrPattern.ReplaceAllFunc(path, func(m []byte) []byte {
+			return []byte(string(m[0]) + `fill-opacity="` + opacityAttr + `"`)
+		})
+	})
+}
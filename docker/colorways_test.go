@@ -0,0 +1,96 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRecolorSVG(t *testing.T) {
+	svg, err := os.ReadFile(filepath.Join("..", "examples", "3001-brick-2x4.svg"))
+	if err != nil {
+		t.Skip("golden example not available")
+	}
+
+	out := string(recolorSVG(svg, "#C91A09", 0.5))
+	if strings.Contains(out, `fill="white" fill-opacity="1.0" fill_rule="evenodd" stroke="none"`) {
+		t.Error("fill paths were not recolored")
+	}
+	if !strings.Contains(out, `fill="#C91A09" fill-opacity="0.5000" fill_rule="evenodd" stroke="none"`) {
+		t.Error("recolored fill path not found")
+	}
+	if !strings.Contains(out, `<rect fill="white" height="100%" width="100%" />`) {
+		t.Error("background should keep its fill")
+	}
+	if strings.Count(out, `fill="none"`) != strings.Count(string(svg), `fill="none"`) {
+		t.Error("stroke paths should be untouched")
+	}
+}
+
+func TestResolveColorways(t *testing.T) {
+	withTestLibrary(t, nil)
+	req := RenderRequest{}
+	opts, _ := req.options()
+
+	four, clear := 4, 47
+	variants, err := resolveColorways([]ColorwayColor{{Code: &four}, {Code: &clear}, {CSS: "#ff00ff"}, {Code: &four}}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(variants) != 3 {
+		t.Fatalf("expected 3 deduplicated variants, got %+v", variants)
+	}
+	if v := variants[1]; v.FillColor != "#FCFCFC" || v.FillOpacity != 128.0/255 || v.ColorName != "Trans_Clear" {
+		t.Errorf("unexpected translucent variant %+v", v)
+	}
+	if v := variants[2]; v.Name != "ff00ff" || v.FillOpacity != 1 {
+		t.Errorf("unexpected CSS variant %+v", v)
+	}
+
+	unknown := 999
+	if _, err := resolveColorways([]ColorwayColor{{Code: &unknown}}, opts); err == nil {
+		t.Error("expected error for unknown color code")
+	}
+	if _, err := resolveColorways([]ColorwayColor{{CSS: `red" onload="x`}}, opts); err == nil {
+		t.Error("expected error for unsafe CSS color")
+	}
+}
+
+func TestColorways(t *testing.T) {
+	withFakeBlender(t)
+	withTestLibrary(t, map[string]string{"3001": "0 Brick 2 x 4\n"})
+
+	body := `{"partNumber": "3001", "colors": [4, 0, 47, "#ff00ff"]}`
+	rec := httptest.NewRecorder()
+	handleColorways(rec, httptest.NewRequest(http.MethodPost, "/render/colorways", strings.NewReader(body)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	// One opaque render and one translucent render
+	if got := rec.Header().Get("X-Render-Count"); got != "2" {
+		t.Errorf("X-Render-Count: got %q, want 2", got)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(rec.Body.Bytes()), int64(rec.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fills := map[string]string{"3001-4.svg": `fill="#C91A09"`, "3001-0.svg": `fill="#1B2A34"`, "3001-47.svg": `fill="#FCFCFC"`, "3001-ff00ff.svg": `fill="#ff00ff"`}
+	if len(zr.File) != len(fills) {
+		t.Fatalf("expected %d files, got %d", len(fills), len(zr.File))
+	}
+	for _, f := range zr.File {
+		rc, _ := f.Open()
+		var buf bytes.Buffer
+		buf.ReadFrom(rc)
+		rc.Close()
+		if want, ok := fills[f.Name]; !ok || !strings.Contains(buf.String(), want) {
+			t.Errorf("%s: expected %s", f.Name, want)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// Comparisons superimpose two parts, such as the mold variants 3001 and
+// 3001old, in strokes of their own. The first part is the model and the
+// second a separate object (see objects.go), drawn in the
+// ViewLayer_ObjectEdges_1 line set; each part's line sets get its opacity.
+// Parts line up by their origins, or with align bbox by the centers of
+// their bounding boxes.
+
+// The comparison's default strokes: LDraw red and blue
+var compareDefaultStrokes = [2]string{"#c91a09", "#0055bf"}
+
+// CompareRequest is the body of /render/compare: the /render options
+// (without partNumber) plus the two parts
+type CompareRequest struct {
+	RenderRequest
+	Parts []ComparePart `json:"parts"`
+	// Align is origin (default) or bbox
+	Align string `json:"align"`
+}
+
+// ComparePart is one side of a comparison
+type ComparePart struct {
+	PartNumber string   `json:"partNumber"`
+	Stroke     string   `json:"stroke"`
+	Opacity    *float64 `json:"opacity"`
+}
+
+// Comparison endpoint: render two parts superimposed
+func handleRenderCompare(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		sendError(w, http.StatusMethodNotAllowed, "Method not allowed", "")
+		return
+	}
+
+	var req CompareRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	var errs fieldErrors
+	if req.PartNumber != "" {
+		errs.add("partNumber", "comparisons take their parts in parts[].partNumber")
+	}
+	if len(req.Parts) != 2 {
+		errs.add("parts", "parts must list exactly 2 parts")
+	}
+	if req.Align == "" {
+		req.Align = "origin"
+	}
+	if req.Align != "origin" && req.Align != "bbox" {
+		errs.add("align", "align must be origin or bbox")
+	}
+	opts, err := req.options()
+	errs.merge("", err)
+	format, dpi, err := req.output(opts)
+	errs.merge("", err)
+	var strokes [2]string
+	var opacities [2]float64
+	for i, p := range req.Parts {
+		if i >= 2 {
+			break
+		}
+		field := fmt.Sprintf("parts[%d]", i)
+		if _, ok := cleanPartNumber(p.PartNumber); !ok {
+			errs.add(field+".partNumber", "%q is not an LDraw part number", p.PartNumber)
+		}
+		if strokes[i], err = validateColorField(field+".stroke", p.Stroke); err != nil {
+			errs.add(field+".stroke", "%v", err)
+		} else if strokes[i] == "" {
+			strokes[i] = compareDefaultStrokes[i]
+		}
+		opacities[i] = 1
+		if p.Opacity != nil {
+			opacities[i] = *p.Opacity
+		}
+		if opacities[i] <= 0 || opacities[i] > 1 {
+			errs.add(field+".opacity", "opacity must be above 0 and at most 1")
+		}
+	}
+	if err := errs.err(); err != nil {
+		sendValidationError(w, err)
+		return
+	}
+
+	// Each part is a one-line scene at the origin
+	var models [2][]byte
+	for i, p := range req.Parts {
+		if models[i], _, err = buildSceneModel([]ScenePart{{PartNumber: p.PartNumber}}, nil); err != nil {
+			sendRenderError(w, err)
+			return
+		}
+	}
+	modelFile, _, _, cleanup, err := writeModelFile(models[0], nil)
+	if err != nil {
+		recordError()
+		sendError(w, http.StatusInternalServerError, "Failed to write model", err.Error())
+		return
+	}
+	defer cleanup()
+	object := sceneObject{ID: "1", Ref: req.Parts[1].PartNumber, Model: string(models[1]), Stroke: strokes[1]}
+	if req.Align == "bbox" {
+		object.Align = "bbox"
+	}
+	if opts.ObjectsFile, err = writeObjectsFile(filepath.Dir(modelFile), []sceneObject{object}); err != nil {
+		recordError()
+		sendError(w, http.StatusInternalServerError, "Failed to write model", err.Error())
+		return
+	}
+	opts.StrokeColor = strokes[0]
+	opts.Normalize = "off"
+
+	label := "comparison of " + req.Parts[0].PartNumber + " and " + req.Parts[1].PartNumber
+	start := time.Now()
+	svgContent, renderDuration, err := renderFile(r.Context(), label, modelFile, opts)
+	if err != nil {
+		sendRenderError(w, err)
+		return
+	}
+	log.Printf("Total request duration: %.2fs", time.Since(start).Seconds())
+	svgContent = applyLinesetOpacity(svgContent, opacities)
+	if opts.Metadata {
+		svgContent = embedSVGMetadata(svgContent, renderMetadata(label, opts))
+	}
+
+	w.Header().Set("X-Render-Duration", fmt.Sprintf("%.2fs", renderDuration.Seconds()))
+	if format == "png" {
+		png, err := rasterizeRender(r.Context(), label, svgContent, opts, dpi)
+		if err != nil {
+			sendRenderError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(png)
+		return
+	}
+	w.Header().Set("Content-Type", "image/svg+xml")
+	writeSVG(w, r, svgContent)
+}
+
+// Give a comparison's line sets their part's opacity: the object's line
+// set is the second part's, and every other the first's
+func applyLinesetOpacity(svg []byte, opacities [2]float64) []byte {
+	return svgLinesetStartPattern.ReplaceAllFunc(svg, func(tag []byte) []byte {
+		name := string(svgLinesetStartPattern.FindSubmatch(tag)[1])
+		opacity := opacities[0]
+		if name == "ObjectEdges_1" {
+			opacity = opacities[1]
+		}
+		if opacity >= 1 {
+			return tag
+		}
+		return append([]byte(`<g opacity="`+strconv.FormatFloat(opacity, 'f', -1, 64)+`"`), tag[len("<g"):]...)
+	})
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestApplyLinesetOpacity(t *testing.T) {
+	svg := []byte(`<svg><g id="ViewLayer_Edges" inkscape:groupmode="lineset"></g><g id="ViewLayer_ObjectEdges_1" inkscape:groupmode="lineset"></g></svg>`)
+	out := string(applyLinesetOpacity(svg, [2]float64{1, 0.5}))
+	if !strings.Contains(out, `<g id="ViewLayer_Edges" inkscape:groupmode="lineset">`) {
+		t.Errorf("expected the opaque part's line set untouched: %s", out)
+	}
+	if !strings.Contains(out, `<g opacity="0.5" id="ViewLayer_ObjectEdges_1"`) {
+		t.Errorf("expected the second part's line set at 0.5: %s", out)
+	}
+
+	out = string(applyLinesetOpacity(svg, [2]float64{0.25, 1}))
+	if !strings.Contains(out, `<g opacity="0.25" id="ViewLayer_Edges"`) || strings.Contains(out, `opacity="1"`) {
+		t.Errorf("expected only the first part's line set at 0.25: %s", out)
+	}
+}
+
+func TestRenderCompare(t *testing.T) {
+	withFakeBlender(t)
+	withTestLibrary(t, map[string]string{"3001": "0 Brick 2 x 4\n", "3001old": "0 Brick 2 x 4 with Three Cross Supports\n"})
+
+	for _, tt := range []struct {
+		body   string
+		status int
+	}{
+		{`{"parts":[{"partNumber":"3001"},{"partNumber":"3001old","opacity":0.5}],"align":"bbox"}`, http.StatusOK},
+		{`{"parts":[{"partNumber":"3001"},{"partNumber":"9999"}]}`, http.StatusNotFound},
+		{`{"parts":[{"partNumber":"3001"}]}`, http.StatusBadRequest},
+		{`{"partNumber":"3001","parts":[{"partNumber":"3001"},{"partNumber":"3001old"}]}`, http.StatusBadRequest},
+		{`{"parts":[{"partNumber":"3001"},{"partNumber":"3001old"}],"align":"center"}`, http.StatusBadRequest},
+		{`{"parts":[{"partNumber":"3001","stroke":"bogus"},{"partNumber":"3001old"}]}`, http.StatusBadRequest},
+		{`{"parts":[{"partNumber":"3001","opacity":0},{"partNumber":"3001old"}]}`, http.StatusBadRequest},
+	} {
+		w := httptest.NewRecorder()
+		routes().ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/render/compare", strings.NewReader(tt.body)))
+		if w.Code != tt.status {
+			t.Errorf("%s: status %d, want %d: %s", tt.body, w.Code, tt.status, w.Body.String())
+		}
+		if w.Code == http.StatusOK && !strings.Contains(w.Body.String(), `<g opacity="0.5" id="ViewLayer_ObjectEdges_1"`) {
+			t.Errorf("expected the second part's line set at 0.5, got %s", w.Body.String())
+		}
+	}
+}
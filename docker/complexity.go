@@ -0,0 +1,29 @@
+package main
+
+// A part's complexity, read from its LDraw files rather than rendered: how
+// many triangles Blender will import (quads count as two) once every
+// subfile is expanded, how many distinct subfiles that takes, and how
+// deeply they nest. Render time follows the triangle count closely.
+type PartComplexity struct {
+	Triangles int64 `json:"triangles"`
+	Lines     int64 `json:"lines"`
+	Subfiles  int   `json:"subfiles"`
+	Depth     int   `json:"depth"`
+	// Subfile references not found in the library
+	Missing int `json:"missing,omitempty"`
+}
+
+// A part file's complexity, from its geometry (see geometry.go)
+func partComplexity(path string) (PartComplexity, error) {
+	g, err := partGeometry(path)
+	if err != nil {
+		return PartComplexity{}, err
+	}
+	return PartComplexity{
+		Triangles: g.Triangles + 2*g.Quads,
+		Lines:     g.Lines + g.CondLines,
+		Subfiles:  g.Subfiles,
+		Depth:     g.Depth,
+		Missing:   g.Missing,
+	}, nil
+}
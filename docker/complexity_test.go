@@ -0,0 +1,44 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPartComplexity(t *testing.T) {
+	dir := withTestLibrary(t, map[string]string{
+		"3001": "0 Brick 2 x 4\n" +
+			"1 16 0 0 0 1 0 0 0 1 0 0 0 1 s\\3001s01.dat\n" +
+			"1 16 0 0 0 1 0 0 0 1 0 0 0 1 s\\3001s01.dat\n" +
+			"1 16 0 0 0 1 0 0 0 1 0 0 0 1 stud.dat\n" +
+			"1 16 0 0 0 1 0 0 0 1 0 0 0 1 nosuch.dat\n" +
+			"3 16 0 0 0 1 0 0 0 1 0\n",
+		"s/3001s01": "0 ~Brick 2 x 4 Subpart\n" +
+			"1 16 0 0 0 1 0 0 0 1 0 0 0 1 stud.dat\n" +
+			"4 16 0 0 0 1 0 0 1 1 0 0 1 0\n",
+		"loop": "0 Loop\n1 16 0 0 0 1 0 0 0 1 0 0 0 1 loop.dat\n3 16 0 0 0 1 0 0 0 1 0\n",
+	})
+	os.WriteFile(filepath.Join(dir, "p", "stud.dat"), []byte("0 Stud\n3 16 0 0 0 1 0 0 0 1 0\n3 16 0 0 0 1 0 0 0 1 0\n2 24 0 0 0 1 0 0\n"), 0o644)
+
+	c, err := partComplexity(filepath.Join(dir, "parts", "3001.dat"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 1 own triangle, 2 subparts of (2 + 2 for the stud), and a stud
+	want := PartComplexity{Triangles: 11, Lines: 3, Subfiles: 2, Depth: 2, Missing: 1}
+	if c != want {
+		t.Errorf("got %+v, want %+v", c, want)
+	}
+
+	c, _ = partComplexity(filepath.Join(dir, "parts", "loop.dat"))
+	if c.Triangles != 1 || c.Depth != 1 {
+		t.Errorf("unexpected complexity of a reference cycle %+v", c)
+	}
+
+	// An edited file is read again
+	os.WriteFile(filepath.Join(dir, "parts", "3001.dat"), []byte("0 Brick 2 x 4\n4 16 0 0 0 1 0 0 1 1 0 0 1 0\n"), 0o644)
+	if c, _ := partComplexity(filepath.Join(dir, "parts", "3001.dat")); c.Triangles != 2 || c.Subfiles != 0 {
+		t.Errorf("expected the edited part's complexity, got %+v", c)
+	}
+}
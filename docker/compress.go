@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Freestyle SVGs are verbose and compress about 10:1. Responses are sent
+// with gzip or brotli when the client accepts them. Brotli goes through the
+// brotli CLI, like PDF and PNG output go through rsvg-convert, and is only
+// offered when the binary is installed. With a render cache, the compressed
+// variants of cached part renders are stored next to them, so hits are
+// served without compressing again. Other SVGs (models, scenes, sheets) are
+// one-offs, compressed for each response and never stored.
+var brotliBin = getEnv("BROTLI_BIN", "brotli")
+
+var (
+	brotliOnce  sync.Once
+	brotliFound bool
+)
+
+func brotliAvailable() bool {
+	brotliOnce.Do(func() {
+		_, err := exec.LookPath(brotliBin)
+		brotliFound = err == nil
+	})
+	return brotliFound
+}
+
+// Encodings the server can produce, most preferred first
+func supportedEncodings() []string {
+	if brotliAvailable() {
+		return []string{"br", "gzip"}
+	}
+	return []string{"gzip"}
+}
+
+// Pick a response encoding from an Accept-Encoding header: the supported
+// encoding with the highest q-value, preferring earlier ones on a tie. ""
+// means identity.
+func negotiateEncoding(header string, supported []string) string {
+	quality := make(map[string]float64)
+	wildcard := -1.0
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+				q = parsed
+			}
+		}
+		if name == "*" {
+			wildcard = q
+		} else {
+			quality[name] = q
+		}
+	}
+
+	best, bestQ := "", 0.0
+	for _, enc := range supported {
+		q, ok := quality[enc]
+		if !ok {
+			q = wildcard
+		}
+		if q > bestQ {
+			best, bestQ = enc, q
+		}
+	}
+	return best
+}
+
+// Compress an SVG with gzip or brotli
+func compressSVG(ctx context.Context, encoding string, svg []byte) ([]byte, error) {
+	switch encoding {
+	case "gzip":
+		var buf bytes.Buffer
+		zw, _ := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+		zw.Write(svg)
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case "br":
+		ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		defer cancel()
+		cmd := exec.CommandContext(ctx, brotliBin, "--stdout", "--quality=11", "-")
+		cmd.Stdin = bytes.NewReader(svg)
+		var out, stderr bytes.Buffer
+		cmd.Stdout = &out
+		cmd.Stderr = &stderr
+		if err := cmd.Run(); err != nil {
+			return nil, fmt.Errorf("brotli: %v: %s", err, stderr.String())
+		}
+		return out.Bytes(), nil
+	}
+	return nil, fmt.Errorf("unsupported encoding %q", encoding)
+}
+
+// Write an SVG response body in the best encoding the client accepts. The
+// caller sets any other headers first.
+func writeSVG(w http.ResponseWriter, r *http.Request, svg []byte) {
+	writeCachedSVG(w, r, svg, "")
+}
+
+// writeSVG for a part render under cacheKey in the render cache, whose
+// compressed variants are kept with it
+func writeCachedSVG(w http.ResponseWriter, r *http.Request, svg []byte, cacheKey string) {
+	w.Header().Add("Vary", "Accept-Encoding")
+	if encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"), supportedEncodings()); encoding != "" {
+		body, err := encodedSVG(r.Context(), encoding, svg, cacheKey)
+		if err == nil {
+			w.Header().Set("Content-Encoding", encoding)
+			w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+			w.Write(body)
+			return
+		}
+		// Fall back to an uncompressed response
+		log.Printf("Compressing response with %s failed: %v", encoding, err)
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(svg)))
+	w.Write(svg)
+}
+
+// The compressed form of an SVG: stored beside the render cache's entry for
+// cacheKey when it has one, and compressed afresh otherwise
+func encodedSVG(ctx context.Context, encoding string, svg []byte, cacheKey string) ([]byte, error) {
+	if cacheKey == "" {
+		return compressSVG(ctx, encoding, svg)
+	}
+	hash := svgHash(svg)
+	if body, ok := renderCache.getEncoded(cacheKey, hash, encoding); ok {
+		return body, nil
+	}
+	body, err := compressSVG(ctx, encoding, svg)
+	if err != nil {
+		return nil, err
+	}
+	if renderCache.has(cacheKey) {
+		renderCache.putEncoded(cacheKey, hash, encoding, body)
+	}
+	return body, nil
+}
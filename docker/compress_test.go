@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	both := []string{"br", "gzip"}
+	tests := []struct {
+		header    string
+		supported []string
+		want      string
+	}{
+		{"", both, ""},
+		{"gzip, deflate, br", both, "br"},
+		{"gzip, deflate, br", []string{"gzip"}, "gzip"},
+		{"br;q=0.5, gzip", both, "gzip"},
+		{"GZIP;q=0.8", both, "gzip"},
+		{"br;q=0, gzip;q=0", both, ""},
+		{"*", both, "br"},
+		{"identity, *;q=0", both, ""},
+		{"deflate", both, ""},
+	}
+	for _, tt := range tests {
+		if got := negotiateEncoding(tt.header, tt.supported); got != tt.want {
+			t.Errorf("negotiateEncoding(%q, %v) = %q, want %q", tt.header, tt.supported, got, tt.want)
+		}
+	}
+}
+
+// Stand in for the brotli CLI with a script that copies stdin, prefixed so
+// the "compressed" output is recognizable
+func withFakeBrotli(t *testing.T) {
+	t.Helper()
+	script := filepath.Join(t.TempDir(), "brotli")
+	os.WriteFile(script, []byte("#!/bin/sh\nprintf 'BR:'\ncat\n"), 0o755)
+	old := brotliBin
+	brotliBin = script
+	brotliOnce = sync.Once{}
+	t.Cleanup(func() {
+		brotliBin = old
+		brotliOnce = sync.Once{}
+	})
+}
+
+func TestWriteSVG(t *testing.T) {
+	withFakeBrotli(t)
+	svg := []byte(`<svg xmlns="http://www.w3.org/2000/svg">` + strings.Repeat(`<path d="M 0,0 10,10" />`, 100) + `</svg>`)
+
+	send := func(accept string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Accept-Encoding", accept)
+		w := httptest.NewRecorder()
+		writeSVG(w, r, svg)
+		if w.Header().Get("Vary") != "Accept-Encoding" {
+			t.Error("responses should vary on Accept-Encoding")
+		}
+		return w
+	}
+
+	w := send("gzip")
+	if w.Header().Get("Content-Encoding") != "gzip" || w.Body.Len() >= len(svg)/5 {
+		t.Fatalf("expected a small gzip body, got %q and %d bytes", w.Header().Get("Content-Encoding"), w.Body.Len())
+	}
+	zr, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := io.ReadAll(zr); !bytes.Equal(got, svg) {
+		t.Error("gzip body does not decompress to the SVG")
+	}
+
+	if w := send("gzip, br"); w.Header().Get("Content-Encoding") != "br" || !bytes.Equal(w.Body.Bytes(), append([]byte("BR:"), svg...)) {
+		t.Errorf("expected the brotli body, got %q", w.Header().Get("Content-Encoding"))
+	}
+	if w := send(""); w.Header().Get("Content-Encoding") != "" || !bytes.Equal(w.Body.Bytes(), svg) {
+		t.Error("expected an uncompressed body")
+	}
+}
+
+func TestCachedEncodings(t *testing.T) {
+	withFakeBrotli(t)
+	cache := withRenderCache(t)
+	svg := []byte(`<svg xmlns="http://www.w3.org/2000/svg"></svg>`)
+	key := renderCacheKey("3001", RenderOptions{})
+	if err := cache.put(key, svg); err != nil {
+		t.Fatal(err)
+	}
+	// Compressed on the first request for an encoding, not when stored
+	hash := svgHash(svg)
+	if ok, _ := cache.store.has(cache.encodedPath(key, hash, "gzip")); ok {
+		t.Error("expected no gzip variant before a request for one")
+	}
+	if _, err := encodedSVG(context.Background(), "gzip", svg, key); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := cache.store.has(cache.encodedPath(key, hash, "gzip")); !ok {
+		t.Errorf("gzip variant was not stored: %v", err)
+	}
+	if ok, _ := cache.store.has(cache.encodedPath(key, hash, "br")); ok {
+		t.Error("expected no br variant before a request for one")
+	}
+	cache.store.put(cache.encodedPath(key, hash, "br"), []byte("stored"), "")
+	cache.memory = newLRUCache(1 << 10)
+	if body, err := encodedSVG(context.Background(), "br", svg, key); err != nil || string(body) != "stored" {
+		t.Errorf("expected the stored variant, got %q (%v)", body, err)
+	}
+
+	// A render that differs from the cached one isn't served its variant,
+	// and one that isn't cached leaves no variant
+	fresh := []byte(`<svg xmlns="http://www.w3.org/2000/svg"><path/></svg>`)
+	uncached := renderCacheKey("3003", RenderOptions{})
+	for _, k := range []string{key, uncached} {
+		if body, err := encodedSVG(context.Background(), "br", fresh, k); err != nil || !bytes.Equal(body, append([]byte("BR:"), fresh...)) {
+			t.Fatalf("got %q, %v", body, err)
+		}
+	}
+	if ok, _ := cache.store.has(cache.encodedPath(uncached, svgHash(fresh), "br")); ok {
+		t.Error("expected no variant of an uncached render")
+	}
+}
+
+func TestWriteSVGStoresNothing(t *testing.T) {
+	withFakeBrotli(t)
+	cache := withRenderCache(t)
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	writeSVG(httptest.NewRecorder(), r, []byte(`<svg xmlns="http://www.w3.org/2000/svg"><!-- upload --></svg>`))
+	if n, _ := cache.memory.stats(); n != 0 {
+		t.Errorf("expected nothing cached for a one-off SVG, got %d entries", n)
+	}
+	if entries, _ := os.ReadDir(cache.store.(dirStore).dir); len(entries) != 0 {
+		t.Errorf("expected nothing stored for a one-off SVG, got %v", entries)
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"cmp"
+	"slices"
+)
+
+// Two import-stage controls for parts whose lines come out wrong. bfc
+// picks the face winding: render_part.py makes normals consistent after
+// import (recalculate, the default), which fixes parts without BFC
+// statements, or keeps the winding the importer read from them (ldraw),
+// for certified parts that recalculation turns inside out. condlines picks
+// where curved surfaces get outlines, the job LDraw's conditional lines
+// do: Freestyle finds silhouettes on the faces, so they fall on mesh edges
+// where a conditional line would show (mesh, the default), or on the
+// smoothed normals, cutting across faces for rounder curves on coarse
+// primitives (smooth).
+var (
+	bfcModes      = []string{"recalculate", "ldraw"}
+	condlineModes = []string{"mesh", "smooth"}
+)
+
+// Check a request's bfc and condlines and copy them into opts, the first
+// mode of each by default
+func applyImportModes(opts *RenderOptions, bfc, condlines string) error {
+	var errs fieldErrors
+	opts.BFC, opts.Condlines = cmp.Or(bfc, bfcModes[0]), cmp.Or(condlines, condlineModes[0])
+	if !slices.Contains(bfcModes, opts.BFC) {
+		errs.add("bfc", "bfc must be recalculate or ldraw")
+	}
+	if !slices.Contains(condlineModes, opts.Condlines) {
+		errs.add("condlines", "condlines must be mesh or smooth")
+	}
+	return errs.err()
+}
+
+// The bfc and condlines arguments render_part.py takes; options the
+// request didn't set are the defaults
+func scriptImportModes(opts RenderOptions) (bfc, condlines string) {
+	return cmp.Or(opts.BFC, bfcModes[0]), cmp.Or(opts.Condlines, condlineModes[0])
+}
@@ -0,0 +1,19 @@
+package main
+
+import "testing"
+
+func TestApplyImportModes(t *testing.T) {
+	var opts RenderOptions
+	if err := applyImportModes(&opts, "", ""); err != nil || opts.BFC != "recalculate" || opts.Condlines != "mesh" {
+		t.Errorf("expected the defaults, got %q %q, %v", opts.BFC, opts.Condlines, err)
+	}
+	if err := applyImportModes(&opts, "ldraw", "smooth"); err != nil || opts.BFC != "ldraw" || opts.Condlines != "smooth" {
+		t.Errorf("got %q %q, %v", opts.BFC, opts.Condlines, err)
+	}
+	if err := applyImportModes(&opts, "cull", "type5"); err == nil {
+		t.Error("expected unknown modes refused")
+	}
+	if bfc, condlines := scriptImportModes(RenderOptions{}); bfc != "recalculate" || condlines != "mesh" {
+		t.Errorf("expected unset modes as the defaults, got %q %q", bfc, condlines)
+	}
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Contact sheet layout in SVG user units (px)
+const (
+	sheetMargin      = 24.0
+	sheetHeader      = 48.0
+	sheetCellWidth   = 180.0
+	sheetThumbSize   = 150.0
+	sheetLabelHeight = 40.0
+	sheetMaxItems    = 1000
+)
+
+type ContactSheetRequest struct {
+	Title   string          `json:"title"`
+	Items   []InventoryItem `json:"items"`
+	Columns int             `json:"columns"`
+	Rows    int             `json:"rows"`
+	Format  string          `json:"format"`
+	Page    int             `json:"page"`
+	// Render holds base render options applied to every thumbnail;
+	// its partNumber is ignored.
+	Render *RenderRequest `json:"render"`
+}
+
+// InventoryItem is one line of a set inventory
+type InventoryItem struct {
+	PartNumber string `json:"partNumber"`
+	Color      *int   `json:"color"`
+	Quantity   int    `json:"quantity"`
+	// Label replaces the part number in the sheet caption
+	Label string `json:"label,omitempty"`
+}
+
+// A rendered (or failed) thumbnail for one part/color combination
+type thumbnail struct {
+	svg []byte
+	err error
+}
+
+// Contact sheet endpoint
+func handleContactSheet(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		sendError(w, http.StatusMethodNotAllowed, "Method not allowed", "")
+		return
+	}
+
+	var req ContactSheetRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	base, err := req.validate()
+	if err != nil {
+		sendValidationError(w, err)
+		return
+	}
+	writeContactSheet(w, r, req, base)
+}
+
+// Render a validated contact sheet request and write the SVG page or PDF
+func writeContactSheet(w http.ResponseWriter, r *http.Request, req ContactSheetRequest, base RenderOptions) {
+	start := time.Now()
+	perPage := req.Columns * req.Rows
+	totalPages := (len(req.Items) + perPage - 1) / perPage
+
+	if req.Format == "svg" && req.Page > totalPages {
+		sendError(w, http.StatusBadRequest, fmt.Sprintf("page must be between 1 and %d", totalPages), "")
+		return
+	}
+
+	// SVG output is a single page; PDF output contains every page
+	first, last := 0, totalPages
+	if req.Format == "svg" {
+		first, last = req.Page-1, req.Page
+	}
+
+	var pages [][]byte
+	var missing []string
+	for page := first; page < last; page++ {
+		end := min((page+1)*perPage, len(req.Items))
+		items := req.Items[page*perPage : end]
+
+		thumbs := renderItems(r.Context(), items, base)
+		if r.Context().Err() != nil {
+			log.Printf("Contact sheet cancelled: %v", r.Context().Err())
+			return
+		}
+		for _, item := range items {
+			if thumbs[itemKey(item, base)].err != nil {
+				missing = append(missing, item.PartNumber)
+			}
+		}
+		pages = append(pages, buildContactSheetPage(req, items, thumbs, base, page+1, totalPages))
+	}
+
+	log.Printf("Contact sheet: %d items, %d pages in %.2fs", len(req.Items), len(pages), time.Since(start).Seconds())
+
+	if len(missing) > 0 {
+		w.Header().Set("X-Missing-Parts", strings.Join(uniqueStrings(missing), ","))
+	}
+	w.Header().Set("X-Total-Pages", strconv.Itoa(totalPages))
+
+	if req.Format == "pdf" {
+		pdf, err := convertSVG(r.Context(), "pdf", pages)
+		if err != nil {
+			log.Printf("Contact sheet PDF conversion failed: %v", err)
+			sendError(w, http.StatusInternalServerError, "PDF conversion failed", err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/pdf")
+		w.Write(pdf)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/svg+xml")
+	writeSVG(w, r, pages[0])
+}
+
+// Apply defaults and validate, returning the base thumbnail render options
+func (req *ContactSheetRequest) validate() (RenderOptions, error) {
+	var errs fieldErrors
+	if len(req.Items) == 0 {
+		errs.add("items", "items is required")
+	}
+	if len(req.Items) > sheetMaxItems {
+		errs.add("items", "items must contain at most %d entries", sheetMaxItems)
+	}
+	for i := range req.Items {
+		item := &req.Items[i]
+		if item.PartNumber == "" {
+			errs.add(fmt.Sprintf("items[%d].partNumber", i), "items[%d].partNumber is required", i)
+		}
+		if item.Quantity == 0 {
+			item.Quantity = 1
+		}
+		if item.Quantity < 0 {
+			errs.add(fmt.Sprintf("items[%d].quantity", i), "items[%d].quantity must be positive", i)
+		}
+		if item.Color != nil {
+			if _, ok := lookupColor(*item.Color); !ok {
+				errs.add(fmt.Sprintf("items[%d].color", i), "items[%d].color %d is not a known LDraw color code", i, *item.Color)
+			}
+		}
+	}
+
+	if req.Columns == 0 {
+		req.Columns = 6
+	}
+	if req.Columns < 1 || req.Columns > 20 {
+		errs.add("columns", "columns must be between 1 and 20")
+	}
+	if req.Rows == 0 {
+		req.Rows = 8
+	}
+	if req.Rows < 1 || req.Rows > 50 {
+		errs.add("rows", "rows must be between 1 and 50")
+	}
+
+	if req.Format == "" {
+		req.Format = "svg"
+	}
+	if req.Format != "svg" && req.Format != "pdf" {
+		errs.add("format", "format must be svg or pdf")
+	}
+	if req.Page == 0 {
+		req.Page = 1
+	}
+	if req.Page < 1 {
+		errs.add("page", "page must be positive")
+	}
+
+	// Thumbnails are small, so render at a lower resolution to keep strokes
+	// visible once scaled down into a grid cell
+	render := RenderRequest{}
+	if req.Render != nil {
+		render = *req.Render
+	}
+	thumbRes := 256
+	if render.ResolutionX == nil {
+		render.ResolutionX = &thumbRes
+	}
+	if render.ResolutionY == nil {
+		render.ResolutionY = &thumbRes
+	}
+	opts, err := render.options()
+	errs.merge("render", err)
+	return opts, errs.err()
+}
+
+// Render options for a single inventory item, with its LDraw color applied
+func itemOptions(item InventoryItem, base RenderOptions) RenderOptions {
+	opts := base
+	if item.Color != nil {
+		if c, ok := lookupColor(*item.Color); ok {
+			opts.FillColor = c.Value
+			if c.Alpha < 255 && opts.FillOpacity == 1.0 {
+				opts.FillOpacity = float64(c.Alpha) / 255
+			}
+			opts.Finish, opts.FinishColor = c.Finish, c.FinishValue
+		}
+	}
+	return opts
+}
+
+func itemKey(item InventoryItem, base RenderOptions) string {
+	opts := itemOptions(item, base)
+	return fmt.Sprintf("%s|%s|%.4f|%s", strings.ToLower(item.PartNumber), opts.FillColor, opts.FillOpacity, opts.Finish)
+}
+
+// Render each distinct part/color combination once. Failures are recorded
+// per thumbnail so that one bad part doesn't fail the whole batch.
+func renderItems(ctx context.Context, items []InventoryItem, base RenderOptions) map[string]thumbnail {
+	thumbs := make(map[string]thumbnail)
+	for _, item := range items {
+		key := itemKey(item, base)
+		if _, ok := thumbs[key]; ok {
+			continue
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		svg, _, err := renderPart(ctx, item.PartNumber, itemOptions(item, base))
+		thumbs[key] = thumbnail{svg: svg, err: err}
+	}
+	return thumbs
+}
+
+// Build one page of the contact sheet as an SVG document
+func buildContactSheetPage(req ContactSheetRequest, items []InventoryItem, thumbs map[string]thumbnail, base RenderOptions, page, totalPages int) []byte {
+	cellHeight := sheetThumbSize + sheetLabelHeight
+	width := 2*sheetMargin + float64(req.Columns)*sheetCellWidth
+	height := 2*sheetMargin + sheetHeader + float64(req.Rows)*cellHeight
+
+	var b strings.Builder
+	b.WriteString(svgDocumentStart(width, height))
+	fmt.Fprintf(&b, `<rect width="100%%" height="100%%" fill="white" />`+"\n")
+
+	title := req.Title
+	if title == "" {
+		title = "Inventory"
+	}
+	fmt.Fprintf(&b, `<text x="%g" y="%g" font-family="sans-serif" font-size="20" font-weight="bold" fill="black">%s</text>`+"\n",
+		sheetMargin, sheetMargin+24, escapeXML(title))
+	fmt.Fprintf(&b, `<text x="%g" y="%g" font-family="sans-serif" font-size="12" fill="#666666" text-anchor="end">Page %d of %d</text>`+"\n",
+		width-sheetMargin, sheetMargin+24, page, totalPages)
+
+	for i, item := range items {
+		col := i % req.Columns
+		row := i / req.Columns
+		x := sheetMargin + float64(col)*sheetCellWidth
+		y := sheetMargin + sheetHeader + float64(row)*cellHeight
+		thumbX := x + (sheetCellWidth-sheetThumbSize)/2
+
+		thumb := thumbs[itemKey(item, base)]
+		if thumb.err == nil && thumb.svg != nil {
+			b.WriteString(embedSVG(thumb.svg, thumbX, y, sheetThumbSize, sheetThumbSize))
+			b.WriteString("\n")
+		} else {
+			fmt.Fprintf(&b, `<rect x="%g" y="%g" width="%g" height="%g" fill="none" stroke="#cc0000" stroke-dasharray="4 4" />`+"\n",
+				thumbX+8, y+8, sheetThumbSize-16, sheetThumbSize-16)
+			fmt.Fprintf(&b, `<text x="%g" y="%g" font-family="sans-serif" font-size="12" fill="#cc0000" text-anchor="middle">not rendered</text>`+"\n",
+				x+sheetCellWidth/2, y+sheetThumbSize/2)
+		}
+
+		label := item.PartNumber
+		if item.Label != "" {
+			label = item.Label
+		}
+		if item.Quantity > 1 {
+			label = fmt.Sprintf("%s ×%d", label, item.Quantity)
+		}
+		fmt.Fprintf(&b, `<text x="%g" y="%g" font-family="sans-serif" font-size="14" font-weight="bold" fill="black" text-anchor="middle">%s</text>`+"\n",
+			x+sheetCellWidth/2, y+sheetThumbSize+16, escapeXML(label))
+		if item.Color != nil {
+			if c, ok := lookupColor(*item.Color); ok {
+				fmt.Fprintf(&b, `<text x="%g" y="%g" font-family="sans-serif" font-size="11" fill="#666666" text-anchor="middle">%s</text>`+"\n",
+					x+sheetCellWidth/2, y+sheetThumbSize+32, escapeXML(strings.ReplaceAll(c.Name, "_", " ")))
+			}
+		}
+	}
+
+	b.WriteString("</svg>\n")
+	return []byte(b.String())
+}
+
+// Helper: sorted unique values
+func uniqueStrings(values []string) []string {
+	seen := make(map[string]bool)
+	var out []string
+	for _, v := range values {
+		if !seen[v] {
+			seen[v] = true
+			out = append(out, v)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestContactSheetDefaults(t *testing.T) {
+	req := ContactSheetRequest{Items: []InventoryItem{{PartNumber: "3001"}}}
+	opts, err := req.validate()
+	if err != nil {
+		t.Fatalf("validate: %v", err)
+	}
+	if req.Columns != 6 || req.Rows != 8 || req.Format != "svg" || req.Page != 1 {
+		t.Errorf("unexpected defaults: columns=%d rows=%d format=%s page=%d", req.Columns, req.Rows, req.Format, req.Page)
+	}
+	if req.Items[0].Quantity != 1 {
+		t.Errorf("expected quantity default of 1, got %d", req.Items[0].Quantity)
+	}
+	if opts.ResolutionX != 256 || opts.ResolutionY != 256 {
+		t.Errorf("expected 256x256 thumbnails, got %dx%d", opts.ResolutionX, opts.ResolutionY)
+	}
+}
+
+func TestContactSheetValidation(t *testing.T) {
+	tests := map[string]ContactSheetRequest{
+		"no items":         {},
+		"missing part":     {Items: []InventoryItem{{Quantity: 2}}},
+		"negative qty":     {Items: []InventoryItem{{PartNumber: "3001", Quantity: -1}}},
+		"too many columns": {Items: []InventoryItem{{PartNumber: "3001"}}, Columns: 21},
+		"bad format":       {Items: []InventoryItem{{PartNumber: "3001"}}, Format: "gif"},
+	}
+	for name, req := range tests {
+		if _, err := req.validate(); err == nil {
+			t.Errorf("%s: expected validation error", name)
+		}
+	}
+}
+
+func TestContactSheetPage(t *testing.T) {
+	thumb := []byte(`<?xml version='1.0' encoding='utf-8'?>
+<svg xmlns="http://www.w3.org/2000/svg" xmlns:inkscape="http://www.inkscape.org/namespaces/inkscape" version="1.1" width="256" height="256">
+    <rect width="100%" height="100%" fill="white" /><g id="ViewLayer_Edges" inkscape:groupmode="lineset"><path d="M 0,0 10,10" /></g>
+</svg>
+`)
+	req := ContactSheetRequest{
+		Title: `Set <script>alert("x")</script>`,
+		Items: []InventoryItem{
+			{PartNumber: "3001", Quantity: 4},
+			{PartNumber: "9999x"},
+		},
+	}
+	base, err := req.validate()
+	if err != nil {
+		t.Fatalf("validate: %v", err)
+	}
+	thumbs := map[string]thumbnail{
+		itemKey(req.Items[0], base): {svg: thumb},
+		itemKey(req.Items[1], base): {err: errors.New("not found")},
+	}
+
+	page := buildContactSheetPage(req, req.Items, thumbs, base, 1, 1)
+
+	// The composed page must be well-formed XML
+	dec := xml.NewDecoder(bytes.NewReader(page))
+	for {
+		if _, err := dec.Token(); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("page is not well-formed XML: %v\n%s", err, page)
+		}
+	}
+
+	s := string(page)
+	if strings.Contains(s, "<script>") {
+		t.Error("title was not escaped")
+	}
+	if !strings.Contains(s, "3001 ×4") {
+		t.Error("missing quantity label")
+	}
+	if !strings.Contains(s, `viewBox="0 0 256 256"`) {
+		t.Error("thumbnail was not embedded with its own viewBox")
+	}
+	if !strings.Contains(s, "not rendered") {
+		t.Error("missing placeholder for failed thumbnail")
+	}
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Contract tests for the Go <-> render_part.py interface. testdata/
+// render_contract.json is the golden schema: fake_blender.py checks the
+// arguments the server sends against it, and these tests check that the
+// script's argument parsing and SVG output agree with it.
+
+type renderContract struct {
+	Args []struct {
+		Name string `json:"name"`
+		Type string `json:"type"`
+	} `json:"args"`
+	Progress struct {
+		Marker string   `json:"marker"`
+		Phases []string `json:"phases"`
+	} `json:"progress"`
+	Output struct {
+		Root                  string   `json:"root"`
+		RootAttributes        []string `json:"rootAttributes"`
+		Groups                []string `json:"groups"`
+		OptionalGroups        []string `json:"optionalGroups"`
+		OptionalGroupPrefixes []string `json:"optionalGroupPrefixes"`
+		FillPathAttributes    []string `json:"fillPathAttributes"`
+		StrokePathAttributes  []string `json:"strokePathAttributes"`
+	} `json:"output"`
+}
+
+func loadRenderContract(t *testing.T) renderContract {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", "render_contract.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var c renderContract
+	if err := json.Unmarshal(data, &c); err != nil {
+		t.Fatalf("parsing render contract: %v", err)
+	}
+	return c
+}
+
+// Swap Blender for the contract stub, returning the path it dumps the
+// received arguments to
+func withFakeBlender(t *testing.T) string {
+	t.Helper()
+	if _, err := exec.LookPath("python3"); err != nil {
+		t.Skip("python3 not available")
+	}
+	stub, err := filepath.Abs(filepath.Join("testdata", "fake_blender.py"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := blenderBin
+	blenderBin = stub
+	t.Cleanup(func() { blenderBin = old })
+	// The stub reads test libraries in private temp dirs
+	withSandbox(t, "", -1)
+
+	capture := filepath.Join(t.TempDir(), "args.json")
+	t.Setenv("FAKE_BLENDER_CAPTURE", capture)
+	return capture
+}
+
+func TestRenderScriptArgs(t *testing.T) {
+	capture := withFakeBlender(t)
+	input := filepath.Join(t.TempDir(), "3001.dat")
+	os.WriteFile(input, []byte("0 Brick 2 x 4\n"), 0o644)
+
+	f := func(v float64) *float64 { return &v }
+	i := func(v int) *int { return &v }
+	b := func(v bool) *bool { return &v }
+
+	tests := []struct {
+		name string
+		req  RenderRequest
+		want map[string]string
+	}{
+		{"defaults", RenderRequest{}, map[string]string{
+			"thickness": "2.0", "fill_color": "white", "camera_lat": "30.000000", "camera_lon": "45.000000",
+			"resolution_x": "1024", "resolution_y": "1024", "padding": "0.030000", "crease_angle": "135.000000",
+			"edge_types": "silhouette,crease,border", "fill_opacity": "1.000000", "stroke_color": "currentColor",
+			"normalize": "auto", "ghost_file": "", "fill_mode": "uniform", "line_style": "clean", "sketch_jitter": "0.000000",
+			"shading_file": "", "raster_file": "", "toon_bands": "3", "ao_file": "",
+			"line_taper": "0.000000", "line_fade": "0.000000", "crease_weight": "0.000000", "backbone_stretch": "0.000000",
+			"dash_pattern": "none", "line_style_plugin": "", "color_edge_types": "none",
+			"objects_file": "", "frame_file": "", "supersample": "1",
+			"mirror": "none", "transform": "none", "section_plane": "none",
+			"hidden_edge_opacity": "0.000000", "hidden_edge_dash": "none",
+			"bfc": "recalculate", "condlines": "mesh", "line_pressure": "0.000000",
+			"depth_cue": "off",
+		}},
+		{"supersample", RenderRequest{Supersample: i(3)}, map[string]string{"supersample": "3"}},
+		{"mirror", RenderRequest{Mirror: "zx"}, map[string]string{"mirror": "xz"}},
+		{"transform", RenderRequest{Transform: &ModelTransform{Rotation: &[3]float64{90, 0, 0}, Scale: &[3]float64{2, 1, 1}}},
+			map[string]string{"transform": "2,0,0,0,0,-1,0,1,0"}},
+		{"showHiddenEdges", RenderRequest{ShowHiddenEdges: b(true)}, map[string]string{
+			"hidden_edge_opacity": "0.350000", "hidden_edge_dash": "4,3",
+		}},
+		{"hiddenEdgeStyle", RenderRequest{ShowHiddenEdges: b(true), HiddenEdgeStyle: &HiddenEdgeStyle{Opacity: f(0.8), Dash: []int{}}},
+			map[string]string{"hidden_edge_opacity": "0.800000", "hidden_edge_dash": "none"}},
+		{"import modes", RenderRequest{BFC: "ldraw", Condlines: "smooth"}, map[string]string{"bfc": "ldraw", "condlines": "smooth"}},
+		{"depthCue", RenderRequest{DepthCue: &DepthCue{}}, map[string]string{"depth_cue": "on", "stroke_color": "#000000"}},
+		{"sectionPlane", RenderRequest{SectionPlane: &SectionPlane{Origin: [3]float64{0, -12, 0}, Normal: [3]float64{0, 0, -2}}},
+			map[string]string{"section_plane": "0,-12,0,0,0,-1"}},
+		{"sketch", RenderRequest{Style: "sketch", SketchJitter: f(7.5)}, map[string]string{
+			"line_style": "sketch", "sketch_jitter": "7.500000",
+		}},
+		{"wireframe", RenderRequest{Style: "wireframe", FillOpacity: f(0.3)}, map[string]string{
+			"line_style": "wireframe", "fill_opacity": "0.300000",
+		}},
+		{"line style", RenderRequest{LineStyle: &LineStyle{
+			Taper: f(0.5), Fade: f(1), CreaseWeight: f(1.5), BackboneStretch: f(4), Dash: []int{6, 3, 1, 3}, Pressure: f(2),
+		}}, map[string]string{
+			"line_taper": "0.500000", "line_fade": "1.000000", "crease_weight": "1.500000", "backbone_stretch": "4.000000",
+			"dash_pattern": "6,3,1,3", "line_pressure": "2.000000",
+		}},
+		{"every option", RenderRequest{
+			Thickness: 0.5, FillColor: "#4a90d9", FillOpacity: f(0.25), StrokeColor: "cyan",
+			CameraLatitude: f(-90), CameraLongitude: f(-360), ResolutionX: i(64), ResolutionY: i(4096),
+			Padding: f(0.5), CreaseAngle: f(0),
+			EdgeTypes: &EdgeTypes{Silhouette: b(false), Crease: b(false), Border: b(false), Contour: b(true),
+				ExternalContour: b(true), EdgeMark: b(true), MaterialBoundary: b(true)},
+			NormalizeOrientation: b(false),
+		}, map[string]string{
+			"thickness": "0.5", "fill_color": "#4a90d9", "camera_lat": "-90.000000", "camera_lon": "-360.000000",
+			"resolution_x": "64", "resolution_y": "4096", "padding": "0.500000", "crease_angle": "0.000000",
+			"edge_types": "contour,external_contour,edge_mark,material_boundary", "fill_opacity": "0.250000", "stroke_color": "cyan",
+			"normalize": "off",
+		}},
+		{"no edges", RenderRequest{
+			EdgeTypes: &EdgeTypes{Silhouette: b(false), Crease: b(false), Border: b(false)},
+		}, map[string]string{"edge_types": "none"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts, err := tt.req.options()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, _, err := renderFile(context.Background(), "contract", input, opts); err != nil {
+				t.Fatalf("contract stub rejected arguments: %v", err)
+			}
+
+			data, err := os.ReadFile(capture)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got map[string]string
+			json.Unmarshal(data, &got)
+			if got["input_file"] != input || got["ldraw_path"] != ldrawPath {
+				t.Errorf("unexpected paths: %v", got)
+			}
+			for name, want := range tt.want {
+				if got[name] != want {
+					t.Errorf("%s: got %q, want %q", name, got[name], want)
+				}
+			}
+		})
+	}
+}
+
+func TestRenderScriptRejectsContractViolation(t *testing.T) {
+	withFakeBlender(t)
+	input := filepath.Join(t.TempDir(), "3001.dat")
+	os.WriteFile(input, []byte("0 Brick 2 x 4\n"), 0o644)
+
+	req := RenderRequest{}
+	opts, _ := req.options()
+	opts.EdgeTypes = "silhouette,outline"
+	_, _, err := renderFile(context.Background(), "contract", input, opts)
+	if err == nil || !strings.Contains(err.Error(), "unknown edge type") {
+		t.Fatalf("expected contract violation, got %v", err)
+	}
+}
+
+// Every field the script returns must parse back to what was requested
+func TestRenderScriptOutput(t *testing.T) {
+	withFakeBlender(t)
+	contract := loadRenderContract(t)
+	input := filepath.Join(t.TempDir(), "3001.dat")
+	os.WriteFile(input, []byte("0 Brick 2 x 4\n"), 0o644)
+
+	res := 512
+	opacity := 0.5
+	req := RenderRequest{Thickness: 3.5, FillColor: "#e74c3c", FillOpacity: &opacity, StrokeColor: "black", ResolutionX: &res}
+	opts, _ := req.options()
+	svg, _, err := renderFile(context.Background(), "contract", input, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := checkRenderOutput(t, contract, svg)
+	if w, h := svgSize(svg); w != 512 || h != 1024 {
+		t.Errorf("svgSize: got %gx%g, want 512x1024", w, h)
+	}
+	fill, stroke := out.fills[0], out.strokes[0]
+	if fill["fill"] != "#e74c3c" || fill["fill-opacity"] != "0.5" {
+		t.Errorf("unexpected fill attributes %v", fill)
+	}
+	if stroke["stroke"] != "black" || stroke["stroke-width"] != "3.5" {
+		t.Errorf("unexpected stroke attributes %v", stroke)
+	}
+	if err := checkSVG(svg); err != nil {
+		t.Error(err)
+	}
+}
+
+// The real script's output, as captured in the golden examples, must match
+// the same output contract
+func TestGoldenFilesMatchContract(t *testing.T) {
+	contract := loadRenderContract(t)
+	files, _ := filepath.Glob(filepath.Join("..", "examples", "*.svg"))
+	if len(files) == 0 {
+		t.Skip("no golden examples")
+	}
+	for _, file := range files {
+		t.Run(filepath.Base(file), func(t *testing.T) {
+			svg, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out := checkRenderOutput(t, contract, svg)
+			if len(out.strokes) == 0 {
+				t.Error("no stroke paths")
+			}
+		})
+	}
+}
+
+// render_part.py's parse_args must read the contract's arguments in order
+func TestRenderScriptParsesContractArgs(t *testing.T) {
+	script, err := os.ReadFile(filepath.Join("..", "scripts", "render_part.py"))
+	if err != nil {
+		t.Skip("render_part.py not available")
+	}
+	contract := loadRenderContract(t)
+
+	re := regexp.MustCompile(`"(\w+)":\s*(?:(float|int)\()?argv\[(\d+)\]`)
+	matches := re.FindAllStringSubmatch(string(script), -1)
+	if len(matches) != len(contract.Args) {
+		t.Fatalf("render_part.py reads %d arguments, contract has %d", len(matches), len(contract.Args))
+	}
+	for i, m := range matches {
+		spec := contract.Args[i]
+		if idx, _ := strconv.Atoi(m[3]); idx != i {
+			t.Errorf("%s: read from argv[%d], want argv[%d]", m[1], idx, i)
+		}
+		if m[1] != spec.Name {
+			t.Errorf("argv[%d]: script calls it %q, contract %q", i, m[1], spec.Name)
+		}
+		wantParse := ""
+		if spec.Type == "float" || spec.Type == "int" {
+			wantParse = spec.Type
+		}
+		if m[2] != wantParse {
+			t.Errorf("%s: script parses as %q, contract type is %s", spec.Name, m[2], spec.Type)
+		}
+	}
+}
+
+// render_part.py must report the contract's progress phases, in order, with
+// the marker the server parses
+func TestRenderScriptReportsContractProgress(t *testing.T) {
+	script, err := os.ReadFile(filepath.Join("..", "scripts", "render_part.py"))
+	if err != nil {
+		t.Skip("render_part.py not available")
+	}
+	contract := loadRenderContract(t)
+	if contract.Progress.Marker+" " != progressMarker {
+		t.Errorf("contract marker %q, server parses %q", contract.Progress.Marker, progressMarker)
+	}
+	if !strings.Contains(string(script), `print(f"`+progressMarker+`{phase} {percent}"`) {
+		t.Error("render_part.py doesn't print the progress marker")
+	}
+	var phases []string
+	for _, m := range regexp.MustCompile(`report_progress\("(\w+)", (\d+)\)`).FindAllStringSubmatch(string(script), -1) {
+		phases = append(phases, m[1])
+	}
+	if strings.Join(phases, ",") != strings.Join(contract.Progress.Phases, ",") {
+		t.Errorf("render_part.py reports %v, contract has %v", phases, contract.Progress.Phases)
+	}
+}
+
+// Progress lines reach the render's callback, followed by post-processing
+func TestRenderReportsProgress(t *testing.T) {
+	withFakeBlender(t)
+	contract := loadRenderContract(t)
+	input := filepath.Join(t.TempDir(), "3001.dat")
+	os.WriteFile(input, []byte("0 Brick 2 x 4\n"), 0o644)
+
+	var phases []string
+	ctx := withProgress(context.Background(), func(phase string, percent int) {
+		phases = append(phases, phase)
+	})
+	req := RenderRequest{}
+	opts, _ := req.options()
+	if _, _, err := renderFile(ctx, "progress", input, opts); err != nil {
+		t.Fatal(err)
+	}
+	want := append(append([]string{}, contract.Progress.Phases...), "postprocess")
+	if strings.Join(phases, ",") != strings.Join(want, ",") {
+		t.Errorf("reported %v, want %v", phases, want)
+	}
+}
+
+type renderOutput struct {
+	fills, strokes []map[string]string
+}
+
+// Check an SVG against the output contract and collect its fill and stroke
+// path attributes
+func checkRenderOutput(t *testing.T, contract renderContract, svg []byte) renderOutput {
+	t.Helper()
+	spec := contract.Output
+	allowed := make(map[string]bool)
+	for _, g := range append(append([]string{}, spec.Groups...), spec.OptionalGroups...) {
+		allowed[g] = true
+	}
+
+	var out renderOutput
+	groups := make(map[string]bool)
+	var stack []string
+	dec := xml.NewDecoder(bytes.NewReader(svg))
+	for depth := 0; ; {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("malformed SVG: %v", err)
+		}
+		switch el := tok.(type) {
+		case xml.StartElement:
+			attrs := make(map[string]string)
+			for _, a := range el.Attr {
+				attrs[a.Name.Local] = a.Value
+			}
+			if depth == 0 {
+				if el.Name.Local != spec.Root {
+					t.Fatalf("root element is %q, want %q", el.Name.Local, spec.Root)
+				}
+				for _, name := range spec.RootAttributes {
+					if _, err := strconv.ParseFloat(attrs[name], 64); err != nil {
+						t.Errorf("root %s=%q is not numeric", name, attrs[name])
+					}
+				}
+			}
+			id := attrs["id"]
+			if el.Name.Local == "g" {
+				if !allowed[id] && !slices.ContainsFunc(spec.OptionalGroupPrefixes, func(p string) bool { return strings.HasPrefix(id, p) }) {
+					t.Errorf("unexpected group %q", id)
+				}
+				groups[id] = true
+			}
+			if el.Name.Local == "path" && len(stack) > 0 {
+				switch stack[len(stack)-1] {
+				case "fills":
+					requireAttrs(t, "fill path", attrs, spec.FillPathAttributes)
+					if v, err := strconv.ParseFloat(attrs["fill-opacity"], 64); err != nil || v < 0 || v > 1 {
+						t.Errorf("fill-opacity %q is not in [0, 1]", attrs["fill-opacity"])
+					}
+					out.fills = append(out.fills, attrs)
+				case "strokes":
+					requireAttrs(t, "stroke path", attrs, spec.StrokePathAttributes)
+					if _, err := strconv.ParseFloat(attrs["stroke-width"], 64); err != nil {
+						t.Errorf("stroke-width %q is not numeric", attrs["stroke-width"])
+					}
+					out.strokes = append(out.strokes, attrs)
+				}
+			}
+			stack = append(stack, id)
+			depth++
+		case xml.EndElement:
+			stack = stack[:len(stack)-1]
+			depth--
+		}
+	}
+	for _, g := range spec.Groups {
+		if !groups[g] {
+			t.Errorf("missing group %q", g)
+		}
+	}
+	return out
+}
+
+func requireAttrs(t *testing.T, what string, attrs map[string]string, names []string) {
+	t.Helper()
+	for _, name := range names {
+		if _, ok := attrs[name]; !ok {
+			t.Errorf("%s is missing %s", what, name)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"regexp"
+	"strings"
+	"syscall"
+)
+
+// Blender failures are classified from the exit status and output so that
+// responses and metrics say what went wrong instead of passing raw stderr
+// through. Each render is its own Blender process, so there's no daemon to
+// restart; a render that crashes is retried once, since segfaults in the
+// Freestyle exporter are usually not reproducible.
+const (
+	causeTimeout      = "timeout"
+	causeSegfault     = "segfault"
+	causeOutOfMemory  = "out_of_memory"
+	causeMissingAddon = "missing_addon"
+	causeImporter     = "importer_error"
+	causeNoOutput     = "no_output"
+	causeUnknown      = "unknown"
+)
+
+// Every cause, in the order metrics list them
+var blenderFailureCauses = []string{causeTimeout, causeSegfault, causeOutOfMemory, causeMissingAddon, causeImporter, causeNoOutput, causeUnknown}
+
+var blenderFailureMessages = map[string]string{
+	causeTimeout:      "Rendering timed out",
+	causeSegfault:     "Blender crashed",
+	causeOutOfMemory:  "Blender ran out of memory",
+	causeMissingAddon: "Blender addon missing",
+	causeImporter:     "LDraw import failed",
+	causeNoOutput:     "Blender produced no SVG",
+	causeUnknown:      "Rendering failed",
+}
+
+// Output patterns, checked in order; the first match wins
+var blenderFailurePatterns = []struct {
+	cause   string
+	pattern *regexp.Regexp
+}{
+	{causeSegfault, regexp.MustCompile(`Segmentation fault|SIGSEGV|Writing: \S+\.crash\.txt`)},
+	{causeOutOfMemory, regexp.MustCompile(`(?i)MemoryError|std::bad_alloc|out of memory|unable to allocate|malloc returns null`)},
+	{causeMissingAddon, regexp.MustCompile(`Add-on not loaded|addon not found|No module named|importldraw" (?:error, )?could not be found|render_freestyle_svg.*(?:not found|failed)`)},
+	{causeImporter, regexp.MustCompile(`(?is)Traceback.*(?:importldraw|import_ldraw|loadldraw)`)},
+	{causeImporter, regexp.MustCompile(`(?i)error[^\n]*\.(?:dat|ldr|mpd)\b`)},
+	{causeNoOutput, regexp.MustCompile(`expected SVG not found`)},
+}
+
+// BlenderError is a classified Blender failure. It responds 500 with the
+// cause alongside the usual error and detail.
+type BlenderError struct {
+	Cause   string
+	Message string
+	Detail  string
+}
+
+func (e *BlenderError) Error() string {
+	if e.Detail == "" {
+		return e.Message
+	}
+	return e.Message + ": " + e.Detail
+}
+
+func newBlenderError(cause, detail string) *BlenderError {
+	return &BlenderError{cause, blenderFailureMessages[cause], detail}
+}
+
+// Classify a failed Blender run from its error (nil when Blender exited
+// cleanly but wrote nothing) and its combined output
+func classifyBlenderFailure(ctx context.Context, runErr error, output string) string {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return causeTimeout
+	}
+	var exitErr *exec.ExitError
+	if errors.As(runErr, &exitErr) {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			switch status.Signal() {
+			case syscall.SIGSEGV, syscall.SIGBUS, syscall.SIGABRT:
+				return causeSegfault
+			case syscall.SIGKILL:
+				// Nothing here kills Blender but the timeout and job
+				// cancellation, which were handled already, so it's the
+				// kernel's OOM killer
+				return causeOutOfMemory
+			}
+		}
+		// Shells report a signal death as 128 + the signal number
+		switch exitErr.ExitCode() {
+		case 128 + int(syscall.SIGSEGV):
+			return causeSegfault
+		case 128 + int(syscall.SIGKILL):
+			return causeOutOfMemory
+		}
+	}
+	for _, p := range blenderFailurePatterns {
+		if p.pattern.MatchString(output) {
+			return p.cause
+		}
+	}
+	if runErr == nil {
+		return causeNoOutput
+	}
+	return causeUnknown
+}
+
+// The last lines of Blender's output, enough to explain a failure without
+// echoing the whole log
+func outputTail(output string, lines int) string {
+	all := strings.Split(strings.TrimRight(output, "\n"), "\n")
+	if len(all) > lines {
+		all = all[len(all)-lines:]
+	}
+	return strings.Join(all, "\n")
+}
+
+// Record a Blender failure by its cause
+func recordBlenderFailure(cause string) {
+	metrics.Lock()
+	metrics.BlenderFailures[cause]++
+	metrics.Unlock()
+
+	for _, s := range metricsSinks {
+		s.Count("blender_failures", 1, "cause:"+cause)
+	}
+}
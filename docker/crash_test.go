@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// Install a shell script as Blender. Its output file is $6.
+func withBlenderScript(t *testing.T, script string) {
+	t.Helper()
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not available")
+	}
+	path := filepath.Join(t.TempDir(), "blender")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+script+"\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	old := blenderBin
+	blenderBin = path
+	t.Cleanup(func() { blenderBin = old })
+	withSandbox(t, "", -1)
+}
+
+func TestClassifyBlenderFailure(t *testing.T) {
+	withTestLibrary(t, map[string]string{"3001": "0 Brick 2 x 4\n"})
+	req := RenderRequest{}
+	opts, _ := req.options()
+
+	for name, tc := range map[string]struct {
+		script string
+		cause  string
+	}{
+		"segfault signal": {`kill -SEGV $$`, causeSegfault},
+		"crash log":       {`echo "Writing: /tmp/blender.crash.txt" >&2; exit 1`, causeSegfault},
+		"oom killer":      {`kill -KILL $$`, causeOutOfMemory},
+		"memory error":    {`echo "MemoryError" >&2; exit 1`, causeOutOfMemory},
+		"missing addon": {`echo "Add-on not loaded: \"ImportLDraw\", cause: No module named 'ImportLDraw'" >&2
+echo 'AttributeError: Calling operator "bpy.ops.import_scene.importldraw" error, could not be found' >&2`, causeMissingAddon},
+		"importer traceback": {`echo "Traceback (most recent call last):" >&2
+echo '  File "/app/render_part.py", line 90, in import_ldraw_part' >&2
+echo "ValueError: bad line" >&2`, causeImporter},
+		"no svg":  {`echo "Error: expected SVG not found at /tmp/x0001.svg"`, causeNoOutput},
+		"silent":  {`exit 0`, causeNoOutput},
+		"unknown": {`echo "something else" >&2; exit 3`, causeUnknown},
+	} {
+		withBlenderScript(t, tc.script)
+		_, _, err := renderPart(context.Background(), "3001", opts)
+		var be *BlenderError
+		if !errors.As(err, &be) {
+			t.Errorf("%s: expected a BlenderError, got %v", name, err)
+			continue
+		}
+		if be.Cause != tc.cause {
+			t.Errorf("%s: classified as %s, want %s (%s)", name, be.Cause, tc.cause, be.Detail)
+		}
+	}
+}
+
+func TestBlenderCrashRetry(t *testing.T) {
+	withTestLibrary(t, map[string]string{"3001": "0 Brick 2 x 4\n"})
+	marker := filepath.Join(t.TempDir(), "crashed")
+	withBlenderScript(t, `if [ ! -e `+marker+` ]; then touch `+marker+`; kill -SEGV $$; fi
+echo '<svg xmlns="http://www.w3.org/2000/svg" width="10" height="10"></svg>' > "$6"`)
+
+	metrics.Lock()
+	before := metrics.BlenderFailures[causeSegfault]
+	metrics.Unlock()
+
+	req := RenderRequest{}
+	opts, _ := req.options()
+	if _, _, err := renderPart(context.Background(), "3001", opts); err != nil {
+		t.Fatalf("expected the retry to succeed, got %v", err)
+	}
+	metrics.Lock()
+	after := metrics.BlenderFailures[causeSegfault]
+	metrics.Unlock()
+	if after != before+1 {
+		t.Errorf("expected the crash to be counted once, went from %d to %d", before, after)
+	}
+}
+
+func TestSendRenderErrorCause(t *testing.T) {
+	w := httptest.NewRecorder()
+	sendRenderError(w, newBlenderError(causeOutOfMemory, "Killed"))
+	var resp ErrorResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if w.Code != 500 || resp.Cause != causeOutOfMemory || resp.Error != "Blender ran out of memory" || resp.Detail != "Killed" {
+		t.Errorf("unexpected response %d %+v", w.Code, resp)
+	}
+}
+
+func TestOutputTail(t *testing.T) {
+	if got := outputTail("a\nb\nc\nd\n", 2); got != "c\nd" {
+		t.Errorf("got %q", got)
+	}
+	if got := outputTail("", 2); got != "" {
+		t.Errorf("got %q", got)
+	}
+}
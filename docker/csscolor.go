@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Colors from requests end up in SVG attributes (and in the render script's
+// output), so they're checked against the CSS color grammar rather than
+// escaped: a named color, currentColor, transparent, #rgb[a], #rrggbb[aa],
+// or rgb[a]()/hsl[a]() with numeric arguments. Functional colors are
+// rewritten in the comma-separated form, with no whitespace.
+
+var (
+	hexColorPattern  = regexp.MustCompile(`^#(?:[0-9a-fA-F]{3,4}|[0-9a-fA-F]{6}|[0-9a-fA-F]{8})$`)
+	funcColorPattern = regexp.MustCompile(`^(?i:(rgba?|hsla?))\((.*)\)$`)
+	// A number, optionally a percentage or (for hues) an angle in degrees
+	colorArgPattern = regexp.MustCompile(`^[+-]?(?:[0-9]+(?:\.[0-9]*)?|\.[0-9]+)(?:e[+-]?[0-9]+)?(%|deg)?$`)
+)
+
+// CSS Color Module Level 4 named colors
+var cssColorNames = map[string]bool{}
+
+func init() {
+	for _, name := range strings.Fields(`aliceblue antiquewhite aqua aquamarine azure beige bisque black
+		blanchedalmond blue blueviolet brown burlywood cadetblue chartreuse chocolate coral
+		cornflowerblue cornsilk crimson cyan darkblue darkcyan darkgoldenrod darkgray darkgreen
+		darkgrey darkkhaki darkmagenta darkolivegreen darkorange darkorchid darkred darksalmon
+		darkseagreen darkslateblue darkslategray darkslategrey darkturquoise darkviolet deeppink
+		deepskyblue dimgray dimgrey dodgerblue firebrick floralwhite forestgreen fuchsia gainsboro
+		ghostwhite gold goldenrod gray green greenyellow grey honeydew hotpink indianred indigo
+		ivory khaki lavender lavenderblush lawngreen lemonchiffon lightblue lightcoral lightcyan
+		lightgoldenrodyellow lightgray lightgreen lightgrey lightpink lightsalmon lightseagreen
+		lightskyblue lightslategray lightslategrey lightsteelblue lightyellow lime limegreen linen
+		magenta maroon mediumaquamarine mediumblue mediumorchid mediumpurple mediumseagreen
+		mediumslateblue mediumspringgreen mediumturquoise mediumvioletred midnightblue mintcream
+		mistyrose moccasin navajowhite navy oldlace olive olivedrab orange orangered orchid
+		palegoldenrod palegreen paleturquoise palevioletred papayawhip peachpuff peru pink plum
+		powderblue purple rebeccapurple red rosybrown royalblue saddlebrown salmon sandybrown
+		seagreen seashell sienna silver skyblue slateblue slategray slategrey snow springgreen
+		steelblue tan teal thistle tomato turquoise violet wheat white whitesmoke yellow
+		yellowgreen`) {
+		cssColorNames[name] = true
+	}
+}
+
+// Validate a CSS color and return it in canonical form
+func normalizeCSSColor(s string) (string, bool) {
+	s = strings.TrimSpace(s)
+	lower := strings.ToLower(s)
+	switch {
+	case lower == "currentcolor":
+		return "currentColor", true
+	case lower == "transparent" || cssColorNames[lower]:
+		return lower, true
+	case hexColorPattern.MatchString(s):
+		return lower, true
+	}
+
+	m := funcColorPattern.FindStringSubmatch(s)
+	if m == nil {
+		return "", false
+	}
+	fn := strings.ToLower(m[1])
+	args, ok := splitColorArgs(m[2])
+	if !ok || (len(args) != 3 && len(args) != 4) {
+		return "", false
+	}
+	hsl := strings.HasPrefix(fn, "hsl")
+	for i, arg := range args {
+		arg = strings.ToLower(arg)
+		u := colorArgPattern.FindStringSubmatch(arg)
+		if u == nil {
+			return "", false
+		}
+		// Only hues take degrees, and saturation and lightness are
+		// percentages
+		if (u[1] == "deg" && !(hsl && i == 0)) || (hsl && (i == 1 || i == 2) && u[1] != "%") {
+			return "", false
+		}
+		args[i] = arg
+	}
+	if len(args) == 4 {
+		fn = strings.TrimSuffix(fn, "a") + "a"
+	} else {
+		fn = strings.TrimSuffix(fn, "a")
+	}
+	return fn + "(" + strings.Join(args, ",") + ")", true
+}
+
+// Split functional color arguments in either the legacy comma syntax
+// ("1, 2, 3, 0.5") or the space syntax with a slash before alpha
+// ("1 2 3 / 0.5")
+func splitColorArgs(s string) ([]string, bool) {
+	s = strings.TrimSpace(s)
+	if strings.Contains(s, ",") {
+		if strings.Contains(s, "/") {
+			return nil, false
+		}
+		parts := strings.Split(s, ",")
+		for i := range parts {
+			parts[i] = strings.TrimSpace(parts[i])
+			if parts[i] == "" || strings.ContainsAny(parts[i], " \t\n") {
+				return nil, false
+			}
+		}
+		return parts, true
+	}
+	color, alpha, hasAlpha := strings.Cut(s, "/")
+	parts := strings.Fields(color)
+	if hasAlpha {
+		a := strings.Fields(alpha)
+		if len(parts) != 3 || len(a) != 1 {
+			return nil, false
+		}
+		parts = append(parts, a[0])
+	}
+	return parts, true
+}
+
+// Check a request's color field and return its canonical form ("" when
+// unset)
+func validateColorField(name, value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+	canonical, ok := normalizeCSSColor(value)
+	if !ok {
+		return "", fmt.Errorf("%s must be a CSS color (a name, #hex, rgb(), or hsl()), got %q", name, value)
+	}
+	return canonical, nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNormalizeCSSColor(t *testing.T) {
+	tests := map[string]string{
+		"red":                       "red",
+		"  RebeccaPurple ":          "rebeccapurple",
+		"currentcolor":              "currentColor",
+		"transparent":               "transparent",
+		"#FFF":                      "#fff",
+		"#ffff":                     "#ffff",
+		"#0055BF":                   "#0055bf",
+		"#0055bf80":                 "#0055bf80",
+		"rgb(255, 0, 0)":            "rgb(255,0,0)",
+		"RGB(100%,0%,0%)":           "rgb(100%,0%,0%)",
+		"rgb(1 2 3 / 0.5)":          "rgba(1,2,3,0.5)",
+		"rgba(1, 2, 3)":             "rgb(1,2,3)",
+		"rgba(1, 2, 3, .25)":        "rgba(1,2,3,.25)",
+		"hsl(120, 50%, 25%)":        "hsl(120,50%,25%)",
+		"hsl(120deg 50% 25% / 50%)": "hsla(120deg,50%,25%,50%)",
+	}
+	for in, want := range tests {
+		got, ok := normalizeCSSColor(in)
+		if !ok || got != want {
+			t.Errorf("normalizeCSSColor(%q) = %q, %v; want %q", in, got, ok, want)
+		}
+	}
+}
+
+func TestNormalizeCSSColorRejectsInjection(t *testing.T) {
+	for _, in := range []string{
+		"",
+		"notacolor",
+		`red" onload="alert(1)`,
+		`red"/><script>alert(1)</script>`,
+		"</svg><script>alert(1)</script>",
+		"#ff000",
+		"#ggg",
+		"url(javascript:alert(1))",
+		"url(#x)",
+		"expression(alert(1))",
+		"rgb(1,2,3);fill:url(#x)",
+		"rgb(1,2,3) red",
+		"rgb(1,2)",
+		"rgb(1,2,3,4,5)",
+		"rgb(1, 2 3)",
+		"rgb(1,2,3 / 0.5)",
+		"rgb(a,b,c)",
+		"rgb(1deg,2,3)",
+		"hsl(120,50,25)",
+		"var(--evil)",
+		"red\nstroke",
+	} {
+		if got, ok := normalizeCSSColor(in); ok {
+			t.Errorf("normalizeCSSColor(%q) accepted as %q", in, got)
+		}
+	}
+}
+
+func TestOptionsValidatesColors(t *testing.T) {
+	req := RenderRequest{FillColor: "RGB(1 2 3)", StrokeColor: "#ABC"}
+	opts, err := req.options()
+	if err != nil {
+		t.Fatalf("options: %v", err)
+	}
+	if opts.FillColor != "rgb(1,2,3)" || opts.StrokeColor != "#abc" {
+		t.Errorf("expected canonical colors, got fill=%q stroke=%q", opts.FillColor, opts.StrokeColor)
+	}
+
+	for _, req := range []RenderRequest{
+		{FillColor: `red" onload="alert(1)`},
+		{StrokeColor: "url(javascript:alert(1))"},
+	} {
+		_, err := req.options()
+		if err == nil || !strings.Contains(err.Error(), "must be a CSS color") {
+			t.Errorf("fill=%q stroke=%q: expected a color error, got %v", req.FillColor, req.StrokeColor, err)
+		}
+	}
+}
+
+func TestRecolorSVGEscapesFill(t *testing.T) {
+	svg := []byte(`<svg><g id="ViewLayer_Fills"><path d="M 0,0" fill="white" fill-opacity="1.0" stroke="none" /></g></svg>`)
+	out := string(recolorSVG(svg, `x" onload="alert(1)`, 1))
+	if strings.Contains(out, `" onload="`) {
+		t.Errorf("expected the fill to be escaped, got %s", out)
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"html/template"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// GET /admin is a small HTML dashboard for operators: the prewarm queue,
+// the renders in flight and the prewarm worker, the last few renders with
+// thumbnails, and the tail of the error log. It's a single server-rendered
+// page that refreshes itself, so it needs no assets or JavaScript.
+const (
+	dashboardRecentRenders = 24
+	dashboardErrorLines    = 50
+	// Renders bigger than this are listed without a thumbnail
+	dashboardMaxThumbBytes = 256 << 10
+)
+
+type recentRender struct {
+	Label    string
+	At       time.Time
+	Duration time.Duration
+	Error    string
+	svg      []byte
+}
+
+type activeRender struct {
+	Label      string
+	Started    time.Time
+	Background bool
+	KeyName    string
+}
+
+var dashboard = struct {
+	sync.Mutex
+	recent []recentRender
+	active map[int64]*activeRender
+	nextID int64
+}{active: make(map[int64]*activeRender)}
+
+// Track a Blender render while it runs; call the returned function with its
+// result when it's done
+func trackRender(ctx context.Context, label string) func(svg []byte, err error) {
+	render := &activeRender{Label: label, Started: time.Now(), Background: isLowPriority(ctx)}
+	if key := apiKeyFromContext(ctx); key != nil {
+		render.KeyName = key.Name
+	}
+	dashboard.Lock()
+	id := dashboard.nextID
+	dashboard.nextID++
+	dashboard.active[id] = render
+	dashboard.Unlock()
+
+	return func(svg []byte, err error) {
+		done := recentRender{Label: label, At: time.Now(), Duration: time.Since(render.Started)}
+		if err != nil {
+			done.Error = err.Error()
+		} else if len(svg) <= dashboardMaxThumbBytes {
+			done.svg = svg
+		}
+		dashboard.Lock()
+		delete(dashboard.active, id)
+		dashboard.recent = append(dashboard.recent, done)
+		if n := len(dashboard.recent); n > dashboardRecentRenders {
+			dashboard.recent = dashboard.recent[n-dashboardRecentRenders:]
+		}
+		dashboard.Unlock()
+	}
+}
+
+// The server has no log levels, so error lines are the ones that say so
+var errorLinePattern = regexp.MustCompile(`(?i)\b(fail|failed|failure|error|errors|timed out|timeout|panic)\b`)
+
+// Log output tee that keeps the last error lines for the dashboard
+type errorLogTail struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+var errorLog = &errorLogTail{}
+
+func (t *errorLogTail) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, line := range bytes.Split(bytes.TrimRight(p, "\n"), []byte("\n")) {
+		if errorLinePattern.Match(line) {
+			t.lines = append(t.lines, string(line))
+		}
+	}
+	if n := len(t.lines); n > dashboardErrorLines {
+		t.lines = t.lines[n-dashboardErrorLines:]
+	}
+	return len(p), nil
+}
+
+func (t *errorLogTail) tail() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]string(nil), t.lines...)
+}
+
+type dashboardRender struct {
+	recentRender
+	Thumbnail template.URL
+}
+
+type dashboardPage struct {
+	Now          time.Time
+	QueueDepth   int
+	QueueSize    int
+	WorkerState  string
+	Active       []activeRender
+	Recent       []dashboardRender
+	Errors       []string
+	RendersTotal int64
+	ErrorsTotal  int64
+}
+
+var dashboardTemplate = template.Must(template.New("dashboard").Funcs(template.FuncMap{
+	"seconds": func(d time.Duration) string { return strconv.FormatFloat(d.Seconds(), 'f', 1, 64) + "s" },
+	"clock":   func(t time.Time) string { return t.UTC().Format("15:04:05") },
+	"since":   time.Since,
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="5">
+<title>LEGO Part Renderer</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+h2 { margin-top: 1.5em; font-size: 1.1em; }
+table { border-collapse: collapse; }
+td, th { padding: 0.25em 0.75em; text-align: left; border-bottom: 1px solid #ddd; }
+.stats span { margin-right: 2em; }
+.renders { display: flex; flex-wrap: wrap; gap: 0.75em; }
+.render { width: 120px; font-size: 0.8em; text-align: center; }
+.render img, .render .missing { width: 112px; height: 112px; border: 1px solid #ddd; background: white; }
+.render .missing { display: flex; align-items: center; justify-content: center; color: #c00; }
+pre { background: #f6f6f6; padding: 1em; overflow-x: auto; font-size: 0.85em; }
+</style>
+</head>
+<body>
+<h1>LEGO Part Renderer</h1>
+<p class="stats">
+<span>Prewarm queue: <b>{{.QueueDepth}}</b> / {{.QueueSize}}</span>
+<span>Renders: <b>{{.RendersTotal}}</b></span>
+<span>Errors: <b>{{.ErrorsTotal}}</b></span>
+<span>Updated {{clock .Now}} UTC</span>
+</p>
+
+<h2>Workers</h2>
+<table>
+<tr><th>Worker</th><th>State</th><th>Since</th></tr>
+<tr><td>prewarm</td><td>{{.WorkerState}}</td><td></td></tr>
+{{range .Active}}<tr><td>{{if .Background}}background{{else}}request{{end}}{{with .KeyName}} ({{.}}){{end}}</td><td>rendering {{.Label}}</td><td>{{seconds (since .Started)}}</td></tr>
+{{end}}</table>
+
+<h2>Recent renders</h2>
+<div class="renders">
+{{range .Recent}}<div class="render">{{if .Thumbnail}}<img src="{{.Thumbnail}}" alt="{{.Label}}">{{else}}<div class="missing">{{if .Error}}failed{{else}}too large{{end}}</div>{{end}}
+<div>{{.Label}}</div><div>{{clock .At}} · {{seconds .Duration}}</div>{{with .Error}}<div title="{{.}}">error</div>{{end}}</div>
+{{else}}<p>No renders yet.</p>
+{{end}}</div>
+
+<h2>Error log</h2>
+{{if .Errors}}<pre>{{range .Errors}}{{.}}
+{{end}}</pre>{{else}}<p>No errors logged.</p>{{end}}
+</body>
+</html>
+`))
+
+// Admin dashboard page
+func handleDashboard(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		sendError(w, http.StatusMethodNotAllowed, "Method not allowed", "")
+		return
+	}
+
+	page := dashboardPage{
+		Now:         time.Now(),
+		QueueDepth:  len(prewarmQueue),
+		QueueSize:   prewarmQueueSize,
+		WorkerState: prewarmWorkerState(),
+		Errors:      errorLog.tail(),
+	}
+	metrics.Lock()
+	page.RendersTotal, page.ErrorsTotal = metrics.RendersTotal, metrics.Errors
+	metrics.Unlock()
+
+	dashboard.Lock()
+	for _, a := range dashboard.active {
+		page.Active = append(page.Active, *a)
+	}
+	// Newest first
+	for i := len(dashboard.recent) - 1; i >= 0; i-- {
+		entry := dashboardRender{recentRender: dashboard.recent[i]}
+		if entry.svg != nil {
+			entry.Thumbnail = template.URL("data:image/svg+xml;base64," + base64.StdEncoding.EncodeToString(entry.svg))
+		}
+		page.Recent = append(page.Recent, entry)
+	}
+	dashboard.Unlock()
+	sort.Slice(page.Active, func(i, j int) bool { return page.Active[i].Started.Before(page.Active[j].Started) })
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	dashboardTemplate.Execute(w, page)
+}
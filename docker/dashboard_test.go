@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func resetDashboard(t *testing.T) {
+	t.Helper()
+	dashboard.Lock()
+	dashboard.recent = nil
+	dashboard.Unlock()
+	t.Cleanup(func() {
+		dashboard.Lock()
+		dashboard.recent = nil
+		dashboard.Unlock()
+	})
+}
+
+func TestTrackRender(t *testing.T) {
+	resetDashboard(t)
+
+	done := trackRender(withLowPriority(context.Background()), "3001")
+	dashboard.Lock()
+	active := len(dashboard.active)
+	dashboard.Unlock()
+	if active != 1 {
+		t.Fatalf("expected 1 render in flight, got %d", active)
+	}
+	done([]byte("<svg />"), nil)
+	trackRender(context.Background(), "3003")(nil, errors.New("Rendering failed"))
+	for i := 0; i < dashboardRecentRenders-1; i++ {
+		trackRender(context.Background(), "3004")([]byte("<svg />"), nil)
+	}
+
+	dashboard.Lock()
+	defer dashboard.Unlock()
+	if len(dashboard.active) != 0 {
+		t.Errorf("finished renders should leave the in-flight list")
+	}
+	if len(dashboard.recent) != dashboardRecentRenders {
+		t.Errorf("expected the last %d renders, got %d", dashboardRecentRenders, len(dashboard.recent))
+	}
+	if dashboard.recent[0].Label != "3003" || dashboard.recent[0].Error == "" {
+		t.Errorf("oldest kept render should be the failed 3003, got %+v", dashboard.recent[0])
+	}
+}
+
+func TestErrorLogTail(t *testing.T) {
+	tail := &errorLogTail{}
+	tail.Write([]byte("2026/01/02 10:00:00 Rendered 3001 in 5.10s\n"))
+	tail.Write([]byte("2026/01/02 10:00:01 Render failed for 3001: boom\n2026/01/02 10:00:02 Render timeout for 3003\n"))
+	for i := 0; i < dashboardErrorLines; i++ {
+		tail.Write([]byte("2026/01/02 10:00:03 Failed to save usage: disk full\n"))
+	}
+	lines := tail.tail()
+	if len(lines) != dashboardErrorLines {
+		t.Fatalf("expected %d lines, got %d", dashboardErrorLines, len(lines))
+	}
+	for _, line := range lines {
+		if strings.Contains(line, "Rendered 3001") {
+			t.Errorf("non-error line kept: %q", line)
+		}
+	}
+}
+
+func TestHandleDashboard(t *testing.T) {
+	resetDashboard(t)
+	trackRender(context.Background(), "3001")([]byte(`<svg xmlns="http://www.w3.org/2000/svg" />`), nil)
+	trackRender(context.Background(), "<script>")(nil, errors.New("Part not found"))
+
+	w := httptest.NewRecorder()
+	handleDashboard(w, httptest.NewRequest(http.MethodGet, "/admin", nil))
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/html") {
+		t.Fatalf("%d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	body := w.Body.String()
+	for _, want := range []string{"Prewarm queue", `<img src="data:image/svg`, "3001", "&lt;script&gt;"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("dashboard is missing %q", want)
+		}
+	}
+	if strings.Contains(body, "<script>") {
+		t.Error("labels should be escaped")
+	}
+}
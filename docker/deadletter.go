@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Jobs that fail for good, after any retries, are kept in a dead-letter
+// list on the API node that took them, so they can be requeued once the
+// cause is fixed (a library update adding a missing part, say). The list
+// holds the last QUEUE_DEADLETTER_SIZE failures and, like jobs, is lost on
+// restart.
+var queueDeadLetterSize = getEnvInt("QUEUE_DEADLETTER_SIZE", 1000)
+
+type DeadLetter struct {
+	JobID      string         `json:"jobId"`
+	PartNumber string         `json:"partNumber"`
+	Key        string         `json:"key,omitempty"`
+	Request    RenderRequest  `json:"request"`
+	FailedAt   time.Time      `json:"failedAt"`
+	StatusCode int            `json:"statusCode"`
+	Error      *ErrorResponse `json:"error,omitempty"`
+	Attempts   []JobAttempt   `json:"attempts"`
+	// Times the job was requeued from here before
+	Requeues int `json:"requeues"`
+
+	job *queuedJob
+}
+
+// Dead letters, oldest first
+var deadLetters = struct {
+	sync.Mutex
+	list []*DeadLetter
+}{}
+
+// Add a job that just failed for good. Callers hold the jobs lock.
+func deadLetterLocked(job *queuedJob) {
+	if job.Status != jobFailed {
+		return
+	}
+	refundJobLocked(job)
+	d := &DeadLetter{
+		JobID:      job.ID,
+		PartNumber: job.PartNumber,
+		Request:    job.request,
+		FailedAt:   *job.FinishedAt,
+		StatusCode: job.statusCode,
+		Error:      job.Error,
+		Attempts:   append([]JobAttempt{}, job.Attempts...),
+		Requeues:   job.requeues,
+		job:        job,
+	}
+	if job.key != nil {
+		d.Key = job.key.Name
+	}
+	deadLetters.Lock()
+	defer deadLetters.Unlock()
+	deadLetters.list = append(deadLetters.list, d)
+	if n := len(deadLetters.list); n > queueDeadLetterSize {
+		deadLetters.list = append([]*DeadLetter(nil), deadLetters.list[n-queueDeadLetterSize:]...)
+	}
+}
+
+// Take dead letters for a job ID, or every one for a part number ("" for
+// all), out of the list
+func takeDeadLetters(id, partNumber string) []*DeadLetter {
+	deadLetters.Lock()
+	defer deadLetters.Unlock()
+	var taken []*DeadLetter
+	kept := deadLetters.list[:0]
+	for _, d := range deadLetters.list {
+		if (id != "" && d.JobID == id) || (id == "" && (partNumber == "" || d.PartNumber == partNumber)) {
+			taken = append(taken, d)
+		} else {
+			kept = append(kept, d)
+		}
+	}
+	clear(deadLetters.list[len(kept):])
+	deadLetters.list = kept
+	return taken
+}
+
+// Put a dead job back on the queue under its own ID, with its attempt
+// history and a fresh set of retries
+func requeueDeadLetter(d *DeadLetter) (JobStatus, error) {
+	jobs.Lock()
+	job := d.job
+	now := time.Now()
+	job.Status, job.Phase, job.Progress = jobQueued, jobQueued, 0
+	job.StartedAt, job.FinishedAt, job.NextAttemptAt = nil, nil, nil
+	job.Error, job.statusCode, job.Worker = nil, 0, ""
+	job.attempt++
+	job.requeues++
+	job.retryBase, job.queuedAt = job.attempt, now
+	// An operator's requeue is charged past the key's quota
+	if job.key != nil {
+		recordKeyUsage(jobKeyContext(job.key), func(d *usageDay) { d.Renders++ })
+		job.chargedAt = now
+	}
+	jobs.byID[job.ID] = job
+	data, _ := json.Marshal(jobMessage{ID: job.ID, Attempt: job.attempt, Request: job.request})
+	status := jobStatusView(job.JobStatus, false)
+	jobs.Unlock()
+
+	if err := jobQueue.publish(jobSubject("jobs"), data); err != nil {
+		return status, err
+	}
+	log.Printf("Job %s: requeued from the dead-letter list (attempt %d)", job.ID, job.attempt)
+	return status, nil
+}
+
+// Dead-letter list endpoint. ?part= filters it.
+func handleDeadLetters(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		sendError(w, http.StatusMethodNotAllowed, "Method not allowed", "")
+		return
+	}
+	part := r.URL.Query().Get("part")
+
+	list := []DeadLetter{}
+	deadLetters.Lock()
+	for i := len(deadLetters.list) - 1; i >= 0; i-- {
+		if d := deadLetters.list[i]; part == "" || d.PartNumber == part {
+			list = append(list, *d)
+		}
+	}
+	deadLetters.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"deadLetters": list})
+}
+
+// Requeue endpoint: POST /admin/deadletter/{id}/requeue for one job, or
+// POST /admin/deadletter/requeue for every one (?part= to limit it to a part)
+func handleRequeueDeadLetters(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		sendError(w, http.StatusMethodNotAllowed, "Method not allowed", "")
+		return
+	}
+	if jobQueue == nil {
+		sendError(w, http.StatusConflict, "Job queue is disabled", "Set QUEUE_MODE=api and QUEUE_URL to enable it")
+		return
+	}
+	id := r.PathValue("id")
+	taken := takeDeadLetters(id, r.URL.Query().Get("part"))
+	if id != "" && len(taken) == 0 {
+		sendError(w, http.StatusNotFound, "Dead letter not found", "")
+		return
+	}
+
+	requeued := []JobStatus{}
+	for i, d := range taken {
+		status, err := requeueDeadLetter(d)
+		if err != nil {
+			// Put back what wasn't sent; this one is failed again by
+			// QUEUE_JOB_TIMEOUT
+			jobs.Lock()
+			for _, rest := range taken[i+1:] {
+				deadLetterLocked(rest.job)
+			}
+			jobs.Unlock()
+			recordRejected("queue_unavailable")
+			sendError(w, http.StatusServiceUnavailable, "Job queue unavailable", err.Error())
+			return
+		}
+		requeued = append(requeued, status)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"requeued": requeued})
+}
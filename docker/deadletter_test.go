@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func listDeadLetters(t *testing.T, query string) []DeadLetter {
+	t.Helper()
+	w := httptest.NewRecorder()
+	handleDeadLetters(w, httptest.NewRequest(http.MethodGet, "/admin/deadletter"+query, nil))
+	var resp struct{ DeadLetters []DeadLetter }
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp.DeadLetters
+}
+
+func TestDeadLetterRequeue(t *testing.T) {
+	withJobQueue(t)
+	failJob := func(status JobStatus, attempt int) {
+		u, _ := json.Marshal(jobUpdate{ID: status.ID, Attempt: attempt, Status: jobFailed, StatusCode: http.StatusNotFound, Error: &ErrorResponse{Error: "Part not found"}})
+		handleJobUpdate("", u)
+	}
+
+	missing := submitJob(t, `{"partNumber":"3001","maxRetries":1}`)
+	failJob(missing, 1)
+	other := submitJob(t, `{"partNumber":"3002"}`)
+	failJob(other, 1)
+	// Cancelled jobs aren't dead
+	callJobs(http.MethodDelete, submitJob(t, `{"partNumber":"3003"}`).StatusURL, "")
+
+	list := listDeadLetters(t, "")
+	if len(list) != 2 || list[0].JobID != other.ID || list[1].JobID != missing.ID {
+		t.Fatalf("expected both failed jobs, newest first, got %+v", list)
+	}
+	if d := list[1]; d.StatusCode != http.StatusNotFound || d.Error == nil || len(d.Attempts) != 1 || d.Request.PartNumber != "3001" {
+		t.Errorf("unexpected dead letter %+v", d)
+	}
+	if list := listDeadLetters(t, "?part=3002"); len(list) != 1 || list[0].JobID != other.ID {
+		t.Errorf("?part: got %+v", list)
+	}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/admin/deadletter/"+missing.ID+"/requeue", nil)
+	r.SetPathValue("id", missing.ID)
+	handleRequeueDeadLetters(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("requeue: expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var status JobStatus
+	json.Unmarshal(callJobs(http.MethodGet, missing.StatusURL, "").Body.Bytes(), &status)
+	if status.Status != jobQueued || status.Error != nil || len(status.Attempts) != 1 {
+		t.Errorf("expected the job queued again with its history, got %+v", status)
+	}
+	if list := listDeadLetters(t, ""); len(list) != 1 || list[0].JobID != other.ID {
+		t.Errorf("expected the requeued job out of the list, got %+v", list)
+	}
+
+	// Failing again puts it back, with the requeue counted
+	failJob(missing, 2)
+	list = listDeadLetters(t, "?part=3001")
+	if len(list) != 1 || list[0].Requeues != 1 || len(list[0].Attempts) != 2 {
+		t.Errorf("expected the job back after one requeue, got %+v", list)
+	}
+
+	// Requeue everything
+	w = httptest.NewRecorder()
+	handleRequeueDeadLetters(w, httptest.NewRequest(http.MethodPost, "/admin/deadletter/requeue", nil))
+	var resp struct{ Requeued []JobStatus }
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if w.Code != http.StatusOK || len(resp.Requeued) != 2 || len(listDeadLetters(t, "")) != 0 {
+		t.Errorf("expected both requeued, got %d %s", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodPost, "/admin/deadletter/nope/requeue", nil)
+	r.SetPathValue("id", "nope")
+	handleRequeueDeadLetters(w, r)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("unknown dead letter: expected 404, got %d", w.Code)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// /render with debug true answers with a JSON envelope of diagnostics
+// around the SVG instead of the SVG alone: the part file the number
+// resolved to, the options after defaults and profiles, Blender's
+// arguments and output, and how long each phase took. A debug render
+// always runs Blender here, bypassing the cache (and not filling it), the
+// dispatcher, and identical renders in flight.
+
+// The /render body: a render request, and whether to debug it
+type debugRenderRequest struct {
+	RenderRequest
+	Debug bool `json:"debug"`
+}
+
+type DebugRenderResponse struct {
+	SVG      string         `json:"svg,omitempty"`
+	Error    *ErrorResponse `json:"error,omitempty"`
+	PartFile string         `json:"partFile,omitempty"`
+	Options  RenderOptions  `json:"options"`
+	// Blender's runs: more than one if it crashed and was retried
+	Blender []BlenderRun `json:"blender"`
+	Phases  []DebugPhase `json:"phases"`
+	Total   float64      `json:"totalSeconds"`
+}
+
+type BlenderRun struct {
+	Args   []string `json:"args"`
+	Stdout string   `json:"stdout"`
+	Stderr string   `json:"stderr"`
+}
+
+// A phase of the render and its duration in seconds: blender (until the
+// script's first progress line), the script's phases (import, prepare,
+// freestyle, export), and postprocess
+type DebugPhase struct {
+	Phase   string  `json:"phase"`
+	Seconds float64 `json:"seconds"`
+}
+
+// What a debug render collects as it goes
+type renderDebug struct {
+	mu       sync.Mutex
+	partFile string
+	runs     []BlenderRun
+	// When each phase started, in order, and when the last one ended
+	marks []debugMark
+	end   time.Time
+}
+
+type debugMark struct {
+	phase string
+	at    time.Time
+}
+
+type renderDebugKey struct{}
+
+func withRenderDebug(ctx context.Context, d *renderDebug) context.Context {
+	return context.WithValue(ctx, renderDebugKey{}, d)
+}
+
+// The render's debug collector, or nil outside a debug render
+func renderDebugFrom(ctx context.Context) *renderDebug {
+	d, _ := ctx.Value(renderDebugKey{}).(*renderDebug)
+	return d
+}
+
+// Note that a phase started, unless it already has
+func (d *renderDebug) mark(phase string) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, m := range d.marks {
+		if m.phase == phase {
+			return
+		}
+	}
+	d.marks = append(d.marks, debugMark{phase, time.Now()})
+}
+
+func (d *renderDebug) finish() {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	d.end = time.Now()
+	d.mu.Unlock()
+}
+
+func (d *renderDebug) recordRun(args []string, stdout, stderr string) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	d.runs = append(d.runs, BlenderRun{Args: args, Stdout: stdout, Stderr: stderr})
+	d.mu.Unlock()
+}
+
+func (d *renderDebug) setPartFile(path string) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	d.partFile = path
+	d.mu.Unlock()
+}
+
+// The phases and their durations, each until the next one started
+func (d *renderDebug) phases() []DebugPhase {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	phases := []DebugPhase{}
+	for i, m := range d.marks {
+		end := d.end
+		if i+1 < len(d.marks) {
+			end = d.marks[i+1].at
+		}
+		if end.IsZero() {
+			end = time.Now()
+		}
+		phases = append(phases, DebugPhase{m.phase, end.Sub(m.at).Seconds()})
+	}
+	return phases
+}
+
+// Render a part for /render with debug, answering with the envelope
+func sendDebugRender(w http.ResponseWriter, r *http.Request, partNumber string, opts RenderOptions) {
+	d := &renderDebug{}
+	start := time.Now()
+	svg, _, err := renderPart(withRenderDebug(r.Context(), d), partNumber, opts)
+
+	status := http.StatusOK
+	resp := DebugRenderResponse{SVG: string(svg), PartFile: d.partFile, Options: applyPartOverride(partNumber, opts), Blender: d.runs, Phases: d.phases()}
+	if resp.Blender == nil {
+		resp.Blender = []BlenderRun{}
+	}
+	if err != nil {
+		var e ErrorResponse
+		status, e = renderErrorResponse(err)
+		resp.Error = &e
+	}
+	resp.Total = time.Since(start).Seconds()
+	// Temp paths are nobody's business here either
+	resp.Options.GhostFile, resp.Options.ObjectsFile = "", ""
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestDebugRender(t *testing.T) {
+	withFakeBlender(t)
+	withTestLibrary(t, map[string]string{"3001": "0 Brick 2 x 4\n"})
+	cache := withRenderCache(t)
+	srv := httptest.NewServer(routes())
+	defer srv.Close()
+
+	post := func(body string) *http.Response {
+		resp, err := http.Post(srv.URL+"/render", "application/json", bytes.NewReader([]byte(body)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	resp := post(`{"partNumber": "3001", "debug": true, "thickness": 2}`)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/json" {
+		t.Fatalf("status %d, content type %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	var body DebugRenderResponse
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(body.SVG, "<svg") || body.Error != nil {
+		t.Errorf("expected the SVG and no error, got %+v", body)
+	}
+	if filepath.Base(body.PartFile) != "3001.dat" {
+		t.Errorf("unexpected part file %q", body.PartFile)
+	}
+	if body.Options.Thickness != 2 {
+		t.Errorf("expected the effective options, got %+v", body.Options)
+	}
+	if len(body.Blender) != 1 || !slices.Contains(body.Blender[0].Args, "--background") || !strings.Contains(body.Blender[0].Stdout, "PROGRESS") {
+		t.Errorf("unexpected Blender runs %+v", body.Blender)
+	}
+	var phases []string
+	for _, p := range body.Phases {
+		phases = append(phases, p.Phase)
+	}
+	if want := []string{"blender", "import", "prepare", "freestyle", "export", "postprocess"}; !slices.Equal(phases, want) {
+		t.Errorf("phases %v, want %v", phases, want)
+	}
+	opts, _ := (&RenderRequest{Thickness: 2}).options()
+	if cache.has(renderCacheKey("3001", opts)) {
+		t.Error("a debug render filled the cache")
+	}
+
+	resp = post(`{"partNumber": "3001", "debug": true, "format": "png"}`)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected 400 for a debug PNG, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+)
+
+// A request's depthCue fades strokes toward a tint the farther they are
+// from the camera, like atmospheric perspective, so the near and far edges
+// of dense parts (Technic beams, frames) read apart. render_part.py draws
+// the Edges line set's strokes in gray by depth, black nearest and white
+// farthest (see apply_depth_cue), and the server mixes each stroke's color
+// toward the tint by its gray times strength. Mixing needs hex colors, so
+// the stroke color is black unless the request sets one.
+type DepthCue struct {
+	// Tint is a #rrggbb color, usually the background's
+	Tint string `json:"tint"`
+	// Strength is how far the farthest strokes go toward the tint, 0-1
+	Strength *float64 `json:"strength"`
+}
+
+const (
+	defaultDepthCueTint     = "#ffffff"
+	defaultDepthCueStrength = 0.8
+	depthCueStroke          = "#000000"
+)
+
+// The grays render_part.py draws depth-cued strokes in
+var svgGrayStrokePattern = regexp.MustCompile(`\sstroke="rgb\((\d+),\s*(\d+),\s*(\d+)\)"`)
+
+// Check a depth cue and copy it into opts, given whether the request set
+// its own stroke color
+func (dc *DepthCue) apply(opts *RenderOptions, strokeSet bool) error {
+	var errs fieldErrors
+	opts.DepthCueTint, opts.DepthCueStrength = defaultDepthCueTint, defaultDepthCueStrength
+	if dc.Tint != "" {
+		opts.DepthCueTint = dc.Tint
+		if _, _, _, ok := parseHexColor(dc.Tint); !ok {
+			errs.add("tint", "tint must be a #rrggbb color")
+		}
+	}
+	if dc.Strength != nil {
+		opts.DepthCueStrength = *dc.Strength
+		if !(opts.DepthCueStrength >= 0 && opts.DepthCueStrength <= 1) {
+			errs.add("strength", "strength must be between 0 and 1")
+		}
+	}
+	if !strokeSet {
+		opts.StrokeColor = depthCueStroke
+	} else if _, _, _, ok := parseHexColor(opts.StrokeColor); !ok {
+		errs.add("strokeColor", "depthCue needs strokeColor as a #rrggbb color")
+	}
+	return errs.err()
+}
+
+// The depth_cue argument render_part.py takes
+func scriptDepthCue(opts RenderOptions) string {
+	if opts.DepthCueTint == "" {
+		return "off"
+	}
+	return "on"
+}
+
+// Tint depth-cued strokes: each gray becomes the stroke color mixed toward
+// the tint by its lightness
+func applyDepthCue(svg []byte, opts RenderOptions) []byte {
+	if opts.DepthCueTint == "" {
+		return svg
+	}
+	return svgGrayStrokePattern.ReplaceAllFunc(svg, func(attr []byte) []byte {
+		m := svgGrayStrokePattern.FindSubmatch(attr)
+		if string(m[1]) != string(m[2]) || string(m[2]) != string(m[3]) {
+			return attr
+		}
+		gray, _ := strconv.Atoi(string(m[1]))
+		return []byte(` stroke="` + mixColor(opts.StrokeColor, opts.DepthCueTint, opts.DepthCueStrength*float64(gray)/255) + `"`)
+	})
+}
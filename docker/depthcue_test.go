@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDepthCueValidates(t *testing.T) {
+	f := func(v float64) *float64 { return &v }
+	for _, tt := range []struct {
+		name string
+		req  RenderRequest
+		ok   bool
+	}{
+		{"defaults", RenderRequest{DepthCue: &DepthCue{}}, true},
+		{"hex stroke", RenderRequest{StrokeColor: "#333333", DepthCue: &DepthCue{Tint: "#e0e8f0", Strength: f(0.5)}}, true},
+		{"named tint", RenderRequest{DepthCue: &DepthCue{Tint: "white"}}, false},
+		{"named stroke", RenderRequest{StrokeColor: "navy", DepthCue: &DepthCue{}}, false},
+		{"strength", RenderRequest{DepthCue: &DepthCue{Strength: f(1.5)}}, false},
+	} {
+		opts, err := tt.req.options()
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: got %v", tt.name, err)
+		}
+		if err == nil && tt.req.StrokeColor == "" && opts.StrokeColor != depthCueStroke {
+			t.Errorf("%s: expected a black stroke, got %q", tt.name, opts.StrokeColor)
+		}
+	}
+}
+
+func TestDepthCuedRender(t *testing.T) {
+	withFakeBlender(t)
+	input := filepath.Join(t.TempDir(), "3001.dat")
+	os.WriteFile(input, []byte("0 Brick 2 x 4\n"), 0o644)
+
+	req := RenderRequest{DepthCue: &DepthCue{}}
+	opts, err := req.options()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _, err := renderFile(context.Background(), "contract", input, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The near stroke keeps its color; the one halfway back is 0.8 x 128/255
+	// of the way to white
+	svg := string(data)
+	if !strings.Contains(svg, `stroke="#000000"`) || !strings.Contains(svg, `stroke="#666666"`) || strings.Contains(svg, "rgb(") {
+		t.Errorf("expected the far stroke tinted:\n%s", svg)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+)
+
+// GET /parts/{number}/dimensions gives a part's size for listings and
+// sorting: its bounding box (see geometry.go) as width (x), depth (z), and
+// height (y), in LDU, millimeters, studs, and plates. The height includes
+// any studs on top.
+type PartDimensions struct {
+	PartNumber string     `json:"partNumber"`
+	LDU        Dimensions `json:"ldu"`
+	MM         Dimensions `json:"mm"`
+	Studs      Dimensions `json:"studs"`
+	Plates     Dimensions `json:"plates"`
+}
+
+type Dimensions struct {
+	Width  float64 `json:"width"`
+	Depth  float64 `json:"depth"`
+	Height float64 `json:"height"`
+}
+
+// A plate is 8 LDU high (a brick is 3 plates)
+const ldrawPlateLDU = 8
+
+func handlePartDimensions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		sendError(w, http.StatusMethodNotAllowed, "Method not allowed", "")
+		return
+	}
+	partNumber, partFile, err := resolvePart(r.PathValue("number"))
+	if err != nil {
+		sendRenderError(w, err)
+		return
+	}
+	setPartHeaders(w, r.PathValue("number"), RenderOptions{})
+	geometry, err := partGeometry(partFile)
+	if err != nil {
+		sendError(w, http.StatusInternalServerError, "Reading part failed", err.Error())
+		return
+	}
+	if geometry.BoundingBox == nil {
+		sendError(w, http.StatusUnprocessableEntity, "Part has no geometry", partNumber)
+		return
+	}
+
+	size := geometry.BoundingBox.Size
+	in := func(unit float64) Dimensions {
+		// Past a thousandth is the library's rounding, not the part's size
+		round := func(v float64) float64 { return math.Round(v/unit*1000) / 1000 }
+		return Dimensions{Width: round(size[0]), Depth: round(size[2]), Height: round(size[1])}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(PartDimensions{
+		PartNumber: partNumber,
+		LDU:        in(1),
+		MM:         in(1 / mmPerLDU),
+		Studs:      in(ldrawStudLDU),
+		Plates:     in(ldrawPlateLDU),
+	})
+}
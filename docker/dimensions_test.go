@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPartDimensions(t *testing.T) {
+	withTestLibrary(t, map[string]string{
+		// A 2 x 4 brick's body and the top of a stud
+		"3001":  "0 Brick 2 x 4\n2 24 -40 0 -20 40 24 20\n2 24 0 -4 0 0 0 0\n",
+		"empty": "0 Nothing\n",
+	})
+	get := func(part string) (int, PartDimensions) {
+		req := httptest.NewRequest(http.MethodGet, "/parts/"+part+"/dimensions", nil)
+		req.SetPathValue("number", part)
+		w := httptest.NewRecorder()
+		handlePartDimensions(w, req)
+		var dims PartDimensions
+		json.Unmarshal(w.Body.Bytes(), &dims)
+		return w.Code, dims
+	}
+
+	status, dims := get("3001")
+	if status != http.StatusOK {
+		t.Fatalf("status %d", status)
+	}
+	want := PartDimensions{
+		PartNumber: "3001",
+		LDU:        Dimensions{80, 40, 28},
+		MM:         Dimensions{32, 16, 11.2},
+		Studs:      Dimensions{4, 2, 1.4},
+		Plates:     Dimensions{10, 5, 3.5},
+	}
+	if dims != want {
+		t.Errorf("got %+v, want %+v", dims, want)
+	}
+
+	if status, _ := get("empty"); status != http.StatusUnprocessableEntity {
+		t.Errorf("expected 422 for a part without geometry, got %d", status)
+	}
+	if status, _ := get("9999"); status != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown part, got %d", status)
+	}
+}
@@ -0,0 +1,869 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A dispatcher spreads part renders over workers that register with it.
+// With DISPATCH_MODE=dispatcher, renderPart sends cache misses to a worker
+// instead of running Blender, so every endpoint that renders parts scales
+// out. Workers (DISPATCH_MODE=worker) register at DISPATCHER_URL with their
+// capacity and pull jobs by long polling, so the dispatcher never has to
+// reach them. The same part prefers the same worker, for its warm caches,
+// and a worker that stops polling and heartbeating has its jobs handed to
+// others. Workers call the dispatcher's lego.renderer.v1.Dispatcher gRPC
+// service (see grpc.go and renderer.proto).
+var (
+	dispatchMode          = getEnv("DISPATCH_MODE", "")
+	dispatcherURL         = getEnv("DISPATCHER_URL", "")
+	dispatchToken         = getEnv("DISPATCH_TOKEN", "")
+	dispatchWorkerTimeout = getEnvDuration("DISPATCH_WORKER_TIMEOUT", 30*time.Second)
+)
+
+const (
+	dispatchService = "/lego.renderer.v1.Dispatcher/"
+	// Attempts at a job before it fails, when its workers keep disappearing
+	dispatchMaxAttempts = 3
+	// Most a worker's pull waits for a job before answering with none
+	dispatchPollWait = 20 * time.Second
+	// Results carry a whole SVG, so they get more room than other requests
+	dispatchResultMaxBytes = 64 << 20
+)
+
+// The dispatcher, when DISPATCH_MODE=dispatcher
+var activeDispatcher *dispatcher
+
+// This node's dispatch worker, when DISPATCH_MODE=worker
+var dispatchWorkerNode *dispatchClient
+
+var errUnknownWorker = errors.New("unknown worker")
+
+// Check the dispatch configuration at startup
+func validateDispatch() error {
+	switch dispatchMode {
+	case "":
+		return nil
+	case "dispatcher":
+	case "worker":
+		u, err := url.Parse(dispatcherURL)
+		if dispatcherURL == "" || err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return errors.New("DISPATCH_MODE=worker needs DISPATCHER_URL, the dispatcher's http(s) URL")
+		}
+		if workerConcurrency < 1 {
+			return errors.New("WORKER_CONCURRENCY must be at least 1")
+		}
+	default:
+		return fmt.Errorf("unknown DISPATCH_MODE %q (want dispatcher, worker, or empty)", dispatchMode)
+	}
+	if dispatchToken == "" {
+		return fmt.Errorf("DISPATCH_MODE=%s needs DISPATCH_TOKEN, shared by the dispatcher and its workers", dispatchMode)
+	}
+	return nil
+}
+
+func startDispatch() {
+	switch dispatchMode {
+	case "dispatcher":
+		activeDispatcher = newDispatcher()
+		go activeDispatcher.run(dispatchWorkerTimeout / 2)
+	case "worker":
+		name, _ := os.Hostname()
+		dispatchWorkerNode = newDispatchClient(dispatcherURL, dispatchToken, name, workerConcurrency)
+		go dispatchWorkerNode.run()
+	}
+}
+
+// A render handed to a worker
+type dispatchTask struct {
+	ID         string        `json:"id"`
+	PartNumber string        `json:"partNumber"`
+	Options    RenderOptions `json:"options"`
+}
+
+type dispatchJob struct {
+	dispatchTask
+	queued   time.Time
+	worker   string
+	attempts int
+	done     chan jobUpdate
+}
+
+type dispatchWorker struct {
+	ID         string    `json:"id"`
+	Name       string    `json:"name"`
+	Capacity   int       `json:"capacity"`
+	Registered time.Time `json:"registered"`
+	LastSeen   time.Time `json:"lastSeen"`
+	Running    int       `json:"running"`
+	Completed  int64     `json:"completed"`
+	Failed     int64     `json:"failed"`
+
+	// Pulls waiting for a job
+	polling  int
+	assigned map[string]*dispatchJob
+}
+
+type dispatcher struct {
+	mu      sync.Mutex
+	workers map[string]*dispatchWorker
+	pending []*dispatchJob
+	// Closed and replaced whenever there's a new job for waiting pulls
+	wake chan struct{}
+}
+
+func newDispatcher() *dispatcher {
+	return &dispatcher{workers: map[string]*dispatchWorker{}, wake: make(chan struct{})}
+}
+
+func (d *dispatcher) wakeLocked() {
+	close(d.wake)
+	d.wake = make(chan struct{})
+}
+
+func (d *dispatcher) register(name string, capacity int) *dispatchWorker {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := time.Now().UTC()
+	w := &dispatchWorker{ID: newJobID(), Name: name, Capacity: capacity, Registered: now, LastSeen: now, assigned: map[string]*dispatchJob{}}
+	d.workers[w.ID] = w
+	log.Printf("Dispatch: worker %s (%s, capacity %d) registered", w.ID, name, capacity)
+	return w
+}
+
+// Remove a worker, handing its jobs to others
+func (d *dispatcher) removeLocked(w *dispatchWorker, why string) {
+	delete(d.workers, w.ID)
+	log.Printf("Dispatch: worker %s (%s) %s with %d jobs running", w.ID, w.Name, why, len(w.assigned))
+	var requeued []*dispatchJob
+	for _, job := range w.assigned {
+		if job.attempts >= dispatchMaxAttempts {
+			job.done <- jobUpdate{ID: job.ID, Status: jobFailed, StatusCode: http.StatusBadGateway,
+				Error: &ErrorResponse{Error: "Render worker lost", Detail: fmt.Sprintf("Gave up after %d workers failed to finish the render", job.attempts)}}
+			continue
+		}
+		job.worker = ""
+		requeued = append(requeued, job)
+	}
+	// Jobs that were already running go ahead of new ones
+	sort.Slice(requeued, func(i, j int) bool { return requeued[i].queued.Before(requeued[j].queued) })
+	d.pending = append(requeued, d.pending...)
+	if len(requeued) > 0 {
+		d.wakeLocked()
+	}
+}
+
+func (d *dispatcher) deregister(id string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	w := d.workers[id]
+	if w == nil {
+		return errUnknownWorker
+	}
+	d.removeLocked(w, "left")
+	return nil
+}
+
+// Note that a worker is alive
+func (d *dispatcher) heartbeat(id string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	w := d.workers[id]
+	if w == nil {
+		return errUnknownWorker
+	}
+	w.LastSeen = time.Now().UTC()
+	return nil
+}
+
+// Drop workers that haven't been heard from within DISPATCH_WORKER_TIMEOUT
+func (d *dispatcher) expire(now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, w := range d.workers {
+		if now.Sub(w.LastSeen) > dispatchWorkerTimeout {
+			d.removeLocked(w, "timed out")
+		}
+	}
+}
+
+func (d *dispatcher) run(interval time.Duration) {
+	for range time.Tick(interval) {
+		d.expire(time.Now())
+	}
+}
+
+// The worker a part's renders go to while it's free: the highest
+// rendezvous hash of the part and worker name, so adding or losing a worker
+// only moves its own parts, and a worker that registers again (under the
+// same host name) gets them back
+func (d *dispatcher) preferredLocked(partNumber string) *dispatchWorker {
+	var best *dispatchWorker
+	var bestScore uint64
+	for _, w := range d.workers {
+		h := fnv.New64a()
+		io.WriteString(h, partNumber)
+		io.WriteString(h, w.Name)
+		if score := h.Sum64(); best == nil || score > bestScore || score == bestScore && w.ID < best.ID {
+			best, bestScore = w, score
+		}
+	}
+	return best
+}
+
+// The oldest pending job w should take: one for a part it's preferred for,
+// or one whose preferred worker isn't waiting for work
+func (d *dispatcher) takeLocked(w *dispatchWorker) *dispatchJob {
+	for i, job := range d.pending {
+		if pref := d.preferredLocked(job.PartNumber); pref == w || pref.polling == 0 {
+			d.pending = append(d.pending[:i], d.pending[i+1:]...)
+			job.worker = w.ID
+			job.attempts++
+			if job.attempts == 1 {
+				recordJobQueueWait(time.Since(job.queued))
+			}
+			w.assigned[job.ID] = job
+			w.Running = len(w.assigned)
+			return job
+		}
+	}
+	return nil
+}
+
+// Wait up to dispatchPollWait for a job for worker id; nil if none came
+func (d *dispatcher) pull(ctx context.Context, id string) (*dispatchTask, error) {
+	timeout := time.NewTimer(dispatchPollWait)
+	defer timeout.Stop()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for {
+		w := d.workers[id]
+		if w == nil {
+			return nil, errUnknownWorker
+		}
+		w.LastSeen = time.Now().UTC()
+		if job := d.takeLocked(w); job != nil {
+			task := job.dispatchTask
+			return &task, nil
+		}
+
+		w.polling++
+		wake := d.wake
+		d.mu.Unlock()
+		var expired bool
+		select {
+		case <-wake:
+		case <-ctx.Done():
+			expired = true
+		case <-timeout.C:
+			expired = true
+		}
+		d.mu.Lock()
+		w.polling--
+		if expired {
+			return nil, nil
+		}
+	}
+}
+
+// Record a worker's result for a job
+func (d *dispatcher) complete(id string, u jobUpdate) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	w := d.workers[id]
+	if w == nil {
+		return errUnknownWorker
+	}
+	w.LastSeen = time.Now().UTC()
+	job := w.assigned[u.ID]
+	if job == nil {
+		// Cancelled, or already handed to another worker
+		return nil
+	}
+	delete(w.assigned, u.ID)
+	w.Running = len(w.assigned)
+	if u.Status == jobDone {
+		w.Completed++
+	} else {
+		w.Failed++
+	}
+	job.done <- u
+	return nil
+}
+
+// Forget a job whose request went away
+func (d *dispatcher) cancel(job *dispatchJob) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for i, pending := range d.pending {
+		if pending == job {
+			d.pending = append(d.pending[:i], d.pending[i+1:]...)
+			return
+		}
+	}
+	if w := d.workers[job.worker]; w != nil {
+		delete(w.assigned, job.ID)
+		w.Running = len(w.assigned)
+	}
+}
+
+// Render a part on a worker
+func (d *dispatcher) render(ctx context.Context, partNumber string, opts RenderOptions) ([]byte, time.Duration, error) {
+	job := &dispatchJob{
+		dispatchTask: dispatchTask{ID: newJobID(), PartNumber: partNumber, Options: opts},
+		queued:       time.Now(),
+		done:         make(chan jobUpdate, 1),
+	}
+	d.mu.Lock()
+	if len(d.workers) == 0 {
+		d.mu.Unlock()
+		recordRejected("no_workers")
+		return nil, 0, &RenderError{http.StatusServiceUnavailable, "No render workers", "No workers are registered with the dispatcher"}
+	}
+	d.pending = append(d.pending, job)
+	d.wakeLocked()
+	d.mu.Unlock()
+
+	select {
+	case u := <-job.done:
+		if u.Status != jobDone {
+			resp := ErrorResponse{Error: "Rendering failed"}
+			if u.Error != nil {
+				resp = *u.Error
+			}
+			code := u.StatusCode
+			if code == 0 {
+				code = http.StatusInternalServerError
+			}
+			return nil, 0, &RenderError{code, resp.Error, resp.Detail}
+		}
+		return []byte(u.SVG), time.Duration(u.RenderSeconds * float64(time.Second)), nil
+	case <-ctx.Done():
+		d.cancel(job)
+		return nil, 0, ctx.Err()
+	}
+}
+
+type dispatchedKey struct{}
+
+// Mark a context as rendering a dispatched job, which is never dispatched
+// again
+func withDispatched(ctx context.Context) context.Context {
+	return context.WithValue(ctx, dispatchedKey{}, true)
+}
+
+// Whether renderPart should hand ctx's render to a worker
+func shouldDispatch(ctx context.Context) bool {
+	dispatched, _ := ctx.Value(dispatchedKey{}).(bool)
+	return activeDispatcher != nil && !dispatched
+}
+
+// Render a part through the dispatcher, metered like a local render
+func dispatchRender(ctx context.Context, partNumber string, opts RenderOptions) ([]byte, time.Duration, error) {
+	if err := chargeRender(ctx); err != nil {
+		return nil, 0, err
+	}
+	done := trackRender(ctx, partNumber)
+	svg, d, err := activeDispatcher.render(ctx, partNumber, opts)
+	done(svg, err)
+	recordKeyUsage(ctx, func(u *usageDay) {
+		u.ComputeSeconds += d.Seconds()
+		if err != nil {
+			u.Errors++
+		}
+	})
+	if err == nil && d > 0 {
+		recordRender(d)
+	}
+	return svg, d, err
+}
+
+type DispatchStatus struct {
+	Workers []*dispatchWorker `json:"workers"`
+	Pending int               `json:"pending"`
+}
+
+func (d *dispatcher) status() DispatchStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	status := DispatchStatus{Workers: []*dispatchWorker{}, Pending: len(d.pending)}
+	for _, w := range d.workers {
+		worker := *w
+		status.Workers = append(status.Workers, &worker)
+	}
+	sort.Slice(status.Workers, func(i, j int) bool { return status.Workers[i].Registered.Before(status.Workers[j].Registered) })
+	return status
+}
+
+// Whether a request carries DISPATCH_TOKEN as a bearer token
+func hasDispatchToken(r *http.Request) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(dispatchToken)) == 1
+}
+
+// Worker listing endpoint, with DISPATCH_TOKEN as a bearer token
+func handleDispatchWorkers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		sendError(w, http.StatusMethodNotAllowed, "Method not allowed", "")
+		return
+	}
+	if activeDispatcher == nil {
+		sendError(w, http.StatusConflict, "Dispatcher is disabled", "Set DISPATCH_MODE=dispatcher to enable it")
+		return
+	}
+	if !hasDispatchToken(r) {
+		sendError(w, http.StatusUnauthorized, "Unauthorized", "")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(activeDispatcher.status())
+}
+
+// lego.renderer.v1.RegisterRequest
+type WorkerRegistration struct {
+	Name     string
+	Capacity int
+}
+
+func (m *WorkerRegistration) marshalProto() []byte {
+	var enc protoEncoder
+	enc.string(1, m.Name)
+	enc.int(2, int64(m.Capacity))
+	return enc.buf
+}
+
+func (m *WorkerRegistration) unmarshalProto(data []byte) error {
+	return decodeProto(data, func(field int, v uint64, data []byte) error {
+		switch field {
+		case 1:
+			m.Name = string(data)
+		case 2:
+			m.Capacity = int(int32(v))
+		}
+		return nil
+	})
+}
+
+// lego.renderer.v1.RegisterResponse
+type WorkerRegistered struct {
+	ID string
+	// How often the worker should heartbeat while it's busy rendering
+	HeartbeatSeconds float64
+}
+
+func (m *WorkerRegistered) marshalProto() []byte {
+	var enc protoEncoder
+	enc.string(1, m.ID)
+	enc.double(2, m.HeartbeatSeconds)
+	return enc.buf
+}
+
+func (m *WorkerRegistered) unmarshalProto(data []byte) error {
+	return decodeProto(data, func(field int, v uint64, data []byte) error {
+		switch field {
+		case 1:
+			m.ID = string(data)
+		case 2:
+			m.HeartbeatSeconds = protoDouble(v)
+		}
+		return nil
+	})
+}
+
+// lego.renderer.v1.WorkerRequest, naming the calling worker
+type workerRequest struct {
+	WorkerID string
+}
+
+func (m *workerRequest) marshalProto() []byte {
+	var enc protoEncoder
+	enc.string(1, m.WorkerID)
+	return enc.buf
+}
+
+func (m *workerRequest) unmarshalProto(data []byte) error {
+	return decodeProto(data, func(field int, v uint64, data []byte) error {
+		if field == 1 {
+			m.WorkerID = string(data)
+		}
+		return nil
+	})
+}
+
+// lego.renderer.v1.Task. The options travel as their JSON, since dispatcher
+// and workers run the same server.
+func (m *dispatchTask) marshalProto() []byte {
+	var enc protoEncoder
+	enc.string(1, m.ID)
+	enc.string(2, m.PartNumber)
+	options, _ := json.Marshal(m.Options)
+	enc.bytes(3, options)
+	return enc.buf
+}
+
+func (m *dispatchTask) unmarshalProto(data []byte) error {
+	return decodeProto(data, func(field int, v uint64, data []byte) error {
+		switch field {
+		case 1:
+			m.ID = string(data)
+		case 2:
+			m.PartNumber = string(data)
+		case 3:
+			if err := json.Unmarshal(data, &m.Options); err != nil {
+				return &grpcError{grpcInvalidArgument, "task options: " + err.Error()}
+			}
+		}
+		return nil
+	})
+}
+
+// lego.renderer.v1.PullResponse; Task is nil when none came in time
+type pullResponse struct {
+	Task *dispatchTask
+}
+
+func (m *pullResponse) marshalProto() []byte {
+	var enc protoEncoder
+	if m.Task != nil {
+		enc.message(1, m.Task)
+	}
+	return enc.buf
+}
+
+func (m *pullResponse) unmarshalProto(data []byte) error {
+	return decodeProto(data, func(field int, v uint64, data []byte) error {
+		if field == 1 {
+			m.Task = &dispatchTask{}
+			return m.Task.unmarshalProto(data)
+		}
+		return nil
+	})
+}
+
+// lego.renderer.v1.CompleteRequest: a worker's result for a job, done
+// unless it carries an error
+type completeRequest struct {
+	WorkerID string
+	Result   jobUpdate
+}
+
+func (m *completeRequest) marshalProto() []byte {
+	var enc protoEncoder
+	enc.string(1, m.WorkerID)
+	enc.string(2, m.Result.ID)
+	enc.string(3, m.Result.SVG)
+	enc.double(4, m.Result.RenderSeconds)
+	enc.bool(5, m.Result.Cached)
+	enc.int(6, int64(m.Result.StatusCode))
+	if m.Result.Status != jobDone {
+		resp := ErrorResponse{Error: "Rendering failed"}
+		if m.Result.Error != nil {
+			resp = *m.Result.Error
+		}
+		enc.message(7, &resp)
+	}
+	return enc.buf
+}
+
+func (m *completeRequest) unmarshalProto(data []byte) error {
+	m.Result.Status = jobDone
+	return decodeProto(data, func(field int, v uint64, data []byte) error {
+		switch field {
+		case 1:
+			m.WorkerID = string(data)
+		case 2:
+			m.Result.ID = string(data)
+		case 3:
+			m.Result.SVG = string(data)
+		case 4:
+			m.Result.RenderSeconds = protoDouble(v)
+		case 5:
+			m.Result.Cached = v != 0
+		case 6:
+			m.Result.StatusCode = int(int32(v))
+		case 7:
+			m.Result.Status, m.Result.Error = jobFailed, &ErrorResponse{}
+			return m.Result.Error.unmarshalProto(data)
+		}
+		return nil
+	})
+}
+
+// The Dispatcher service's methods. Pull is a long poll, up to
+// dispatchPollWait.
+func handleDispatchRPC(w http.ResponseWriter, r *http.Request) {
+	method := r.PathValue("method")
+	maxBytes := grpcMaxMessageBytes
+	if method == "Complete" {
+		// Results carry a whole SVG
+		maxBytes = dispatchResultMaxBytes
+	}
+	serveGRPC(w, r, maxBytes, func(req []byte, send func([]byte) error) error {
+		if activeDispatcher == nil {
+			return &grpcError{grpcFailedPrecondition, "Dispatcher is disabled; set DISPATCH_MODE=dispatcher to enable it"}
+		}
+		if !hasDispatchToken(r) {
+			return &grpcError{grpcUnauthenticated, "Send DISPATCH_TOKEN as a bearer token"}
+		}
+		resp, err := activeDispatcher.serveRPC(r.Context(), method, req)
+		if errors.Is(err, errUnknownWorker) {
+			return &grpcError{grpcNotFound, "Unknown worker; register again"}
+		}
+		if err != nil {
+			return err
+		}
+		return send(resp.marshalProto())
+	})
+}
+
+func (d *dispatcher) serveRPC(ctx context.Context, method string, data []byte) (protoMessage, error) {
+	switch method {
+	case "Register":
+		var req WorkerRegistration
+		if err := unmarshalRequest(&req, data); err != nil {
+			return nil, err
+		}
+		var errs fieldErrors
+		if req.Name == "" {
+			errs.add("name", "name is required")
+		}
+		if req.Capacity < 1 {
+			errs.add("capacity", "capacity must be at least 1")
+		}
+		if err := errs.err(); err != nil {
+			return nil, &grpcError{grpcInvalidArgument, err.Error()}
+		}
+		worker := d.register(req.Name, req.Capacity)
+		return &WorkerRegistered{ID: worker.ID, HeartbeatSeconds: (dispatchWorkerTimeout / 3).Seconds()}, nil
+	case "Deregister", "Heartbeat", "Pull":
+		var req workerRequest
+		if err := unmarshalRequest(&req, data); err != nil {
+			return nil, err
+		}
+		switch method {
+		case "Deregister":
+			return protoEmpty{}, d.deregister(req.WorkerID)
+		case "Heartbeat":
+			return protoEmpty{}, d.heartbeat(req.WorkerID)
+		}
+		task, err := d.pull(ctx, req.WorkerID)
+		return &pullResponse{Task: task}, err
+	case "Complete":
+		var req completeRequest
+		if err := unmarshalRequest(&req, data); err != nil {
+			return nil, err
+		}
+		return protoEmpty{}, d.complete(req.WorkerID, req.Result)
+	}
+	return nil, &grpcError{grpcUnimplemented, "unknown method Dispatcher/" + method}
+}
+
+// A worker's connection to the dispatcher
+type dispatchClient struct {
+	url, name   string
+	concurrency int
+	rpc         *grpcClient
+
+	mu        sync.Mutex
+	id        string
+	heartbeat time.Duration
+	inFlight  int
+	running   int
+	stopped   bool
+	stopping  chan struct{}
+}
+
+func newDispatchClient(dispatcherURL, token, name string, concurrency int) *dispatchClient {
+	return &dispatchClient{
+		url:         strings.TrimSuffix(dispatcherURL, "/"),
+		name:        name,
+		concurrency: concurrency,
+		rpc:         newGRPCClient(dispatcherURL, http.Header{"Authorization": {"Bearer " + token}}),
+		stopping:    make(chan struct{}),
+	}
+}
+
+// Call a Dispatcher method, within a pull's wait and then some
+func (c *dispatchClient) call(ctx context.Context, method string, req, resp protoMessage) error {
+	ctx, cancel := context.WithTimeout(ctx, dispatchPollWait+30*time.Second)
+	defer cancel()
+	return c.rpc.unary(ctx, dispatchService+method, req, resp, dispatchResultMaxBytes)
+}
+
+// Register, unless another pull loop already replaced stale
+func (c *dispatchClient) register(stale string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.id != stale {
+		return nil
+	}
+	var reg WorkerRegistered
+	if err := c.call(context.Background(), "Register", &WorkerRegistration{c.name, c.concurrency}, &reg); err != nil {
+		return err
+	}
+	c.id, c.heartbeat = reg.ID, time.Duration(reg.HeartbeatSeconds*float64(time.Second))
+	log.Printf("Dispatch: registered with %s as %s", c.url, c.id)
+	return nil
+}
+
+func (c *dispatchClient) currentID() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.id
+}
+
+// Register, then pull jobs with one loop per slot until stopped
+func (c *dispatchClient) run() {
+	for wait := time.Second; ; wait = min(2*wait, 30*time.Second) {
+		err := c.register("")
+		if err == nil {
+			break
+		}
+		log.Printf("Dispatch: registering with %s failed: %v", c.url, err)
+		select {
+		case <-c.stopping:
+			return
+		case <-time.After(wait):
+		}
+	}
+	go c.heartbeats()
+	c.mu.Lock()
+	c.running = c.concurrency
+	c.mu.Unlock()
+	for i := 0; i < c.concurrency; i++ {
+		go c.pullLoop()
+	}
+}
+
+func (c *dispatchClient) heartbeats() {
+	for {
+		c.mu.Lock()
+		interval, id := c.heartbeat, c.id
+		c.mu.Unlock()
+		if id == "" {
+			return
+		}
+		time.Sleep(max(interval, time.Second))
+		if c.currentID() != id {
+			continue
+		}
+		err := c.call(context.Background(), "Heartbeat", &workerRequest{id}, protoEmpty{})
+		if grpcErrorCode(err) == grpcNotFound {
+			c.register(id)
+		} else if err != nil {
+			log.Printf("Dispatch: heartbeat failed: %v", err)
+		}
+	}
+}
+
+func (c *dispatchClient) pullLoop() {
+	defer c.loopDone()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-c.stopping
+		cancel()
+	}()
+
+	for wait := time.Second; ctx.Err() == nil; {
+		id := c.currentID()
+		var resp pullResponse
+		err := c.call(ctx, "Pull", &workerRequest{id}, &resp)
+		switch {
+		case ctx.Err() != nil:
+			return
+		case grpcErrorCode(err) == grpcNotFound:
+			// The dispatcher restarted or gave up on us
+			if err := c.register(id); err != nil {
+				log.Printf("Dispatch: registering failed: %v", err)
+			}
+			continue
+		case err != nil:
+			log.Printf("Dispatch: pulling a job failed: %v", err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(wait):
+			}
+			wait = min(2*wait, 30*time.Second)
+			continue
+		case resp.Task != nil:
+			c.render(id, *resp.Task)
+		}
+		wait = time.Second
+	}
+}
+
+// The last pull loop out leaves the dispatcher
+func (c *dispatchClient) loopDone() {
+	c.mu.Lock()
+	c.running--
+	last := c.running == 0
+	id := c.id
+	if last {
+		c.id = ""
+	}
+	c.mu.Unlock()
+	if last && id != "" {
+		c.call(context.Background(), "Deregister", &workerRequest{id}, protoEmpty{})
+		log.Printf("Dispatch: left %s", c.url)
+	}
+}
+
+func (c *dispatchClient) render(id string, task dispatchTask) {
+	c.mu.Lock()
+	c.inFlight++
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		c.inFlight--
+		c.mu.Unlock()
+	}()
+
+	// Dispatched jobs are library parts; nothing else on disk is reachable
+	task.Options.GhostFile, task.Options.ObjectsFile = "", ""
+	u := jobUpdate{ID: task.ID, Status: jobDone, Worker: c.name}
+	svg, d, err := renderPart(withDispatched(context.Background()), task.PartNumber, task.Options)
+	if err != nil {
+		code, resp := renderErrorResponse(err)
+		u.Status, u.StatusCode, u.Error = jobFailed, code, &resp
+	} else {
+		u.SVG, u.RenderSeconds, u.Cached = string(svg), d.Seconds(), d == 0
+	}
+	for attempt := 0; attempt < 3; attempt++ {
+		if err = c.call(context.Background(), "Complete", &completeRequest{id, u}, protoEmpty{}); err == nil {
+			return
+		}
+		time.Sleep(time.Second)
+	}
+	log.Printf("Dispatch: returning job %s failed: %v", task.ID, err)
+}
+
+// Stop pulling jobs; the ones already running finish and are returned
+func (c *dispatchClient) stop() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.stopped {
+		c.stopped = true
+		close(c.stopping)
+	}
+}
+
+// Jobs being rendered
+func (c *dispatchClient) busy() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.inFlight
+}
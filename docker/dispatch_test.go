@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Run a dispatcher behind the real routes
+func withDispatcher(t *testing.T) (*dispatcher, *httptest.Server) {
+	t.Helper()
+	oldToken := dispatchToken
+	dispatchToken = "dispatch-secret"
+	activeDispatcher = newDispatcher()
+	srv := newTestGRPCServer(t, routes())
+	t.Cleanup(func() {
+		srv.Close()
+		activeDispatcher = nil
+		dispatchToken = oldToken
+	})
+	return activeDispatcher, srv
+}
+
+func waitForWorkers(t *testing.T, d *dispatcher, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(d.status().Workers) != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d workers, have %d", n, len(d.status().Workers))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDispatchRendersOnWorker(t *testing.T) {
+	withFakeBlender(t)
+	withTestLibrary(t, map[string]string{"3001": "0 Brick 2 x 4\n"})
+	d, srv := withDispatcher(t)
+
+	worker := newDispatchClient(srv.URL, dispatchToken, "w1", 2)
+	go worker.run()
+	waitForWorkers(t, d, 1)
+
+	req := RenderRequest{}
+	opts, _ := req.options()
+	svg, _, err := renderPart(context.Background(), "3001", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(svg), "<svg") {
+		t.Errorf("unexpected render:\n%s", svg)
+	}
+	// Out-of-contract arguments make the fake Blender fail on the worker
+	_, _, err = renderPart(context.Background(), "3001", RenderOptions{Thickness: -1})
+	var re *RenderError
+	if !errors.As(err, &re) || re.Status != http.StatusInternalServerError {
+		t.Errorf("expected the worker's render error, got %v", err)
+	}
+	if status := d.status(); status.Workers[0].Completed != 1 || status.Workers[0].Failed != 1 || status.Workers[0].Name != "w1" {
+		t.Errorf("unexpected worker status %+v", status.Workers[0])
+	}
+
+	// Stopping leaves the dispatcher once running jobs are done
+	worker.stop()
+	waitForWorkers(t, d, 0)
+	if _, _, err := d.render(context.Background(), "3001", opts); !errors.As(err, &re) || re.Status != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 with no workers, got %v", err)
+	}
+}
+
+func TestDispatchAffinity(t *testing.T) {
+	d := newDispatcher()
+	d.register("a", 1)
+	d.register("b", 1)
+	before := map[string]string{}
+	for i := 0; i < 200; i++ {
+		part := fmt.Sprint(3000 + i)
+		before[part] = d.preferredLocked(part).Name
+	}
+	d.register("c", 1)
+	moved := 0
+	for part, name := range before {
+		switch pref := d.preferredLocked(part).Name; pref {
+		case name:
+		case "c":
+			moved++
+		default:
+			t.Errorf("%s moved from %s to %s", part, name, pref)
+		}
+	}
+	if moved == 0 || moved > 120 {
+		t.Errorf("%d of 200 parts moved to the new worker", moved)
+	}
+}
+
+func TestDispatchPrefersWarmWorker(t *testing.T) {
+	d := newDispatcher()
+	a, b := d.register("a", 1), d.register("b", 1)
+	// Find a part that prefers b
+	part := "3001"
+	for i := 0; d.preferredLocked(part) != b; i++ {
+		part = fmt.Sprint(3001 + i)
+	}
+	go d.render(context.Background(), part, RenderOptions{})
+
+	// While b is waiting, a leaves b's part alone
+	pulled := make(chan *dispatchTask, 1)
+	go func() {
+		task, _ := d.pull(context.Background(), b.ID)
+		pulled <- task
+	}()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		d.mu.Lock()
+		ready := b.polling > 0 || len(b.assigned) > 0
+		d.mu.Unlock()
+		if ready || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	d.mu.Lock()
+	taken := d.takeLocked(a)
+	d.mu.Unlock()
+	if taken != nil {
+		t.Errorf("a took %s from its preferred worker", taken.PartNumber)
+	}
+	if task := <-pulled; task == nil || task.PartNumber != part {
+		t.Errorf("b got %+v, want %s", task, part)
+	}
+}
+
+func TestDispatchFailover(t *testing.T) {
+	d := newDispatcher()
+	w1 := d.register("w1", 1)
+	result := make(chan error, 1)
+	go func() {
+		_, _, err := d.render(context.Background(), "3001", RenderOptions{})
+		result <- err
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	task, err := d.pull(ctx, w1.ID)
+	if err != nil || task == nil {
+		t.Fatalf("pull: %v, %v", task, err)
+	}
+
+	// w1 goes quiet; its job goes to the next worker
+	d.expire(time.Now().Add(dispatchWorkerTimeout + time.Second))
+	if _, err := d.pull(ctx, w1.ID); !errors.Is(err, errUnknownWorker) {
+		t.Errorf("expected the expired worker to be forgotten, got %v", err)
+	}
+	w2 := d.register("w2", 1)
+	retry, err := d.pull(ctx, w2.ID)
+	if err != nil || retry == nil || retry.ID != task.ID {
+		t.Fatalf("expected %s to be handed to w2, got %+v, %v", task.ID, retry, err)
+	}
+	// A late result from w1 is dropped
+	if err := d.complete(w1.ID, jobUpdate{ID: task.ID, Status: jobDone, SVG: "<svg>w1</svg>"}); !errors.Is(err, errUnknownWorker) {
+		t.Errorf("expected w1's result to be rejected, got %v", err)
+	}
+	d.complete(w2.ID, jobUpdate{ID: task.ID, Status: jobDone, SVG: "<svg/>"})
+	if err := <-result; err != nil {
+		t.Errorf("render: %v", err)
+	}
+}
+
+func TestDispatchGivesUp(t *testing.T) {
+	d := newDispatcher()
+	result := make(chan error, 1)
+	d.register("w0", 1)
+	go func() {
+		_, _, err := d.render(context.Background(), "3001", RenderOptions{})
+		result <- err
+	}()
+	for i := 0; i < dispatchMaxAttempts; i++ {
+		w := d.register(fmt.Sprint("w", i+1), 1)
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		task, err := d.pull(ctx, w.ID)
+		cancel()
+		if err != nil || task == nil {
+			t.Fatalf("attempt %d: %v, %v", i+1, task, err)
+		}
+		d.mu.Lock()
+		d.removeLocked(w, "crashed")
+		d.mu.Unlock()
+	}
+	var re *RenderError
+	if err := <-result; !errors.As(err, &re) || re.Status != http.StatusBadGateway {
+		t.Errorf("expected 502 after %d lost workers, got %v", dispatchMaxAttempts, err)
+	}
+}
+
+func TestDispatchCancel(t *testing.T) {
+	d := newDispatcher()
+	d.register("w1", 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, _, err := d.render(ctx, "3001", RenderOptions{}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the request's deadline, got %v", err)
+	}
+	if n := d.status().Pending; n != 0 {
+		t.Errorf("%d jobs left pending", n)
+	}
+}
+
+func TestDispatchEndpointsRequireToken(t *testing.T) {
+	call := func(srv *httptest.Server, token string) int {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/dispatch/workers", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	disabled := httptest.NewServer(routes())
+	defer disabled.Close()
+	if code := call(disabled, ""); code != http.StatusConflict {
+		t.Errorf("disabled: expected 409, got %d", code)
+	}
+	_, srv := withDispatcher(t)
+	if code := call(srv, "wrong"); code != http.StatusUnauthorized {
+		t.Errorf("wrong token: expected 401, got %d", code)
+	}
+	if code := call(srv, dispatchToken); code != http.StatusOK {
+		t.Errorf("expected 200, got %d", code)
+	}
+}
+
+func TestDispatchRPCStatus(t *testing.T) {
+	disabled := newTestGRPCServer(t, routes())
+	register := func(srv *httptest.Server, token string, reg WorkerRegistration) error {
+		client := newGRPCClient(srv.URL, http.Header{"Authorization": {"Bearer " + token}})
+		var resp WorkerRegistered
+		return client.unary(context.Background(), dispatchService+"Register", &reg, &resp, grpcMaxMessageBytes)
+	}
+	if code := grpcErrorCode(register(disabled, "", WorkerRegistration{"w1", 1})); code != grpcFailedPrecondition {
+		t.Errorf("disabled: expected FAILED_PRECONDITION, got %d", code)
+	}
+	_, srv := withDispatcher(t)
+	for _, tc := range []struct {
+		token string
+		reg   WorkerRegistration
+		want  grpcCode
+	}{
+		{"wrong", WorkerRegistration{"w1", 1}, grpcUnauthenticated},
+		{dispatchToken, WorkerRegistration{"w1", 0}, grpcInvalidArgument},
+		{dispatchToken, WorkerRegistration{"w1", 1}, grpcOK},
+	} {
+		if code := grpcErrorCode(register(srv, tc.token, tc.reg)); code != tc.want {
+			t.Errorf("%+v: got code %d", tc, code)
+		}
+	}
+
+	client := newGRPCClient(srv.URL, http.Header{"Authorization": {"Bearer " + dispatchToken}})
+	err := client.unary(context.Background(), dispatchService+"Heartbeat", &workerRequest{"nobody"}, protoEmpty{}, grpcMaxMessageBytes)
+	if grpcErrorCode(err) != grpcNotFound {
+		t.Errorf("unknown worker: expected NOT_FOUND, got %v", err)
+	}
+	err = client.unary(context.Background(), dispatchService+"Steal", &workerRequest{}, protoEmpty{}, grpcMaxMessageBytes)
+	if grpcErrorCode(err) != grpcUnimplemented {
+		t.Errorf("unknown method: expected UNIMPLEMENTED, got %v", err)
+	}
+	// A request that doesn't decode is the worker's fault, and not retried
+	for _, method := range []string{"Register", "Heartbeat", "Pull", "Complete"} {
+		err := client.call(context.Background(), dispatchService+method, []byte{0x0b}, grpcMaxMessageBytes, func([]byte) error { return nil })
+		if grpcErrorCode(err) != grpcInvalidArgument {
+			t.Errorf("malformed %s: expected INVALID_ARGUMENT, got %v", method, err)
+		}
+	}
+}
+
+func TestValidateDispatch(t *testing.T) {
+	oldMode, oldURL, oldToken := dispatchMode, dispatcherURL, dispatchToken
+	t.Cleanup(func() { dispatchMode, dispatcherURL, dispatchToken = oldMode, oldURL, oldToken })
+	for _, tc := range []struct {
+		mode, url, token, wantErr string
+	}{
+		{"", "", "", ""},
+		{"dispatcher", "", "s", ""},
+		{"worker", "http://dispatcher:5346", "s", ""},
+		{"dispatcher", "", "", "DISPATCH_TOKEN"},
+		{"worker", "", "s", "DISPATCHER_URL"},
+		{"worker", "grpc://dispatcher:50051", "s", "DISPATCHER_URL"},
+		{"leader", "", "s", "unknown DISPATCH_MODE"},
+	} {
+		dispatchMode, dispatcherURL, dispatchToken = tc.mode, tc.url, tc.token
+		err := validateDispatch()
+		if tc.wantErr == "" && err != nil || tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)) {
+			t.Errorf("%+v: got %v", tc, err)
+		}
+	}
+}
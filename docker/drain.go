@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// On SIGTERM the server drains instead of exiting mid-render: /readyz starts
+// failing so Kubernetes takes the pod out of its Services, the server keeps
+// serving for DRAIN_DELAY while that propagates, then stops accepting
+// connections and waits up to DRAIN_TIMEOUT for in-flight renders, a job
+// worker's renders, and the current prewarm render to finish. The pod's
+// terminationGracePeriodSeconds needs to cover both.
+var (
+	drainDelay   = getEnvDuration("DRAIN_DELAY", 5*time.Second)
+	drainTimeout = getEnvDuration("DRAIN_TIMEOUT", 10*time.Minute)
+)
+
+// How often a drain checks whether renders have finished
+var drainPollInterval = 250 * time.Millisecond
+
+var drain struct {
+	sync.Mutex
+	started time.Time
+	reason  string
+}
+
+// Set while the prewarm worker is rendering
+var prewarmBusy atomic.Bool
+
+func draining() bool {
+	drain.Lock()
+	defer drain.Unlock()
+	return !drain.started.IsZero()
+}
+
+// Stop taking new work: fail readiness, leave the job queue and the
+// dispatcher, and pause prewarming. False if a drain was already under way.
+func startDrain(reason string) bool {
+	drain.Lock()
+	defer drain.Unlock()
+	if !drain.started.IsZero() {
+		return false
+	}
+	drain.started, drain.reason = time.Now(), reason
+	log.Printf("Draining (%s)", reason)
+	if jobWorkerNode != nil {
+		jobWorkerNode.stop()
+	}
+	if dispatchWorkerNode != nil {
+		dispatchWorkerNode.stop()
+	}
+	return true
+}
+
+type DrainStatus struct {
+	Draining  bool       `json:"draining"`
+	Reason    string     `json:"reason,omitempty"`
+	StartedAt *time.Time `json:"startedAt,omitempty"`
+	// Renders still running: for requests, for queued jobs this node is
+	// working on, and prewarming
+	Renders    int64 `json:"renders"`
+	WorkerJobs int   `json:"workerJobs"`
+	Prewarming bool  `json:"prewarming"`
+	// Prewarm jobs that will be dropped
+	PrewarmPending int `json:"prewarmPending"`
+}
+
+func (s DrainStatus) idle() bool {
+	return s.Renders == 0 && s.WorkerJobs == 0 && !s.Prewarming
+}
+
+func drainStatus() DrainStatus {
+	drain.Lock()
+	status := DrainStatus{Draining: !drain.started.IsZero(), Reason: drain.reason}
+	if status.Draining {
+		started := drain.started.UTC()
+		status.StartedAt = &started
+	}
+	drain.Unlock()
+	status.Renders = foregroundRenders.Load()
+	if jobWorkerNode != nil {
+		status.WorkerJobs += jobWorkerNode.busy()
+	}
+	if dispatchWorkerNode != nil {
+		status.WorkerJobs += dispatchWorkerNode.busy()
+	}
+	status.Prewarming = prewarmBusy.Load()
+	status.PrewarmPending = len(prewarmQueue)
+	return status
+}
+
+// Wait for renders to finish, or for ctx to end
+func waitForRenders(ctx context.Context) error {
+	for !drainStatus().idle() {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(drainPollInterval):
+		}
+	}
+	return nil
+}
+
+// Drain and shut down server on SIGTERM or SIGINT. A second signal exits
+// immediately.
+func shutdownOnSignal(server *http.Server) {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-signals
+	go func() {
+		<-signals
+		log.Fatalf("Second signal, exiting without finishing the drain")
+	}()
+
+	drainAndShutdown(server, sig.String())
+}
+
+// Drain, stop server, and save state
+func drainAndShutdown(server *http.Server, reason string) {
+	startDrain(reason)
+	time.Sleep(drainDelay)
+	ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+	// Shutdown waits for in-flight requests, and so the renders behind them
+	err := server.Shutdown(ctx)
+	if err == nil {
+		err = waitForRenders(ctx)
+	}
+	if err != nil {
+		status := drainStatus()
+		log.Printf("Drain timed out after %s with %d renders and %d jobs running", drainTimeout, status.Renders, status.WorkerJobs)
+	} else {
+		log.Printf("Drained")
+	}
+	if n := stopPrewarm(); n > 0 {
+		log.Printf("Dropped %d prewarm jobs", n)
+	}
+
+	if stateDir != "" {
+		if err := saveUsage(stateDir); err != nil {
+			log.Printf("Failed to save usage: %v", err)
+		}
+		if err := saveRenderHistory(stateDir); err != nil {
+			log.Printf("Failed to save render history: %v", err)
+		}
+		if prewarmPopular > 0 {
+			if err := savePopular(stateDir); err != nil {
+				log.Printf("Failed to save popular parts: %v", err)
+			}
+		}
+	}
+}
+
+// Readiness endpoint: fails while draining so load balancers stop sending
+// traffic. Unlike /health it doesn't check Blender, so it's cheap to probe.
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if draining() {
+		sendError(w, http.StatusServiceUnavailable, "Draining", "")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ready"})
+}
+
+// Manual drain endpoint: POST starts a drain without exiting, so the pod
+// can be taken out of rotation and replaced once its renders finish; GET
+// (and repeated POSTs) report progress
+func handleDrain(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		startDrain("admin request")
+	default:
+		sendError(w, http.StatusMethodNotAllowed, "Method not allowed", "")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(drainStatus())
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func resetDrain(t *testing.T) {
+	t.Helper()
+	oldDelay, oldPoll := drainDelay, drainPollInterval
+	drainDelay, drainPollInterval = 0, 10*time.Millisecond
+	t.Cleanup(func() {
+		drain.Lock()
+		drain.started, drain.reason = time.Time{}, ""
+		drain.Unlock()
+		drainDelay, drainPollInterval = oldDelay, oldPoll
+	})
+}
+
+func TestReadyzFailsWhileDraining(t *testing.T) {
+	resetDrain(t)
+	old := adminToken
+	adminToken = "secret"
+	t.Cleanup(func() { adminToken = old })
+	call := func(method, path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(method, path, nil)
+		r.Header.Set("Authorization", "Bearer secret")
+		routes().ServeHTTP(w, r)
+		return w
+	}
+
+	if w := call(http.MethodGet, "/readyz"); w.Code != http.StatusOK {
+		t.Fatalf("expected ready, got %d", w.Code)
+	}
+	var status DrainStatus
+	json.Unmarshal(call(http.MethodGet, "/admin/drain").Body.Bytes(), &status)
+	if status.Draining {
+		t.Fatal("GET started a drain")
+	}
+
+	json.Unmarshal(call(http.MethodPost, "/admin/drain").Body.Bytes(), &status)
+	if !status.Draining || status.Reason != "admin request" || status.StartedAt == nil {
+		t.Errorf("unexpected drain status %+v", status)
+	}
+	if w := call(http.MethodGet, "/readyz"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 while draining, got %d", w.Code)
+	}
+	if startDrain("again") {
+		t.Error("a second drain should not restart the first")
+	}
+}
+
+func TestWaitForRenders(t *testing.T) {
+	resetDrain(t)
+	foregroundRenders.Add(1)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+	if err := waitForRenders(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected to time out with a render running, got %v", err)
+	}
+	foregroundRenders.Add(-1)
+	if err := waitForRenders(context.Background()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDrainFinishesInFlightRequests(t *testing.T) {
+	resetDrain(t)
+	started := make(chan struct{})
+	srv := startTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		foregroundRenders.Add(1)
+		defer foregroundRenders.Add(-1)
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		io.WriteString(w, "rendered")
+	}))
+
+	var body []byte
+	var err error
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		var resp *http.Response
+		if resp, err = http.Get(srv.URL); err == nil {
+			body, err = io.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+	}()
+	<-started
+	drainAndShutdown(srv.Config, "test")
+	if n := foregroundRenders.Load(); n != 0 {
+		t.Errorf("shut down with %d renders running", n)
+	}
+	wg.Wait()
+	if err != nil || string(body) != "rendered" {
+		t.Errorf("in-flight request cut off: %q, %v", body, err)
+	}
+}
+
+// Records subscriptions, for checking when a worker takes jobs
+type recordingBroker struct {
+	mu   sync.Mutex
+	subs map[int]string
+	next int
+}
+
+func (b *recordingBroker) publish(string, []byte) error { return nil }
+
+func (b *recordingBroker) subscribe(subject, _ string, _ func(string, []byte)) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.next++
+	b.subs[b.next] = subject
+	return b.next, nil
+}
+
+func (b *recordingBroker) unsubscribe(sid int) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.subs, sid)
+	return nil
+}
+
+// Subscriptions to subject
+func (b *recordingBroker) subscribed(subject string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n := 0
+	for _, s := range b.subs {
+		if s == subject {
+			n++
+		}
+	}
+	return n
+}
+
+func TestDrainStopsJobWorker(t *testing.T) {
+	resetDrain(t)
+	broker := &recordingBroker{subs: map[int]string{}}
+	w, err := startJobWorker(broker, "w1", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jobWorkerNode = w
+	t.Cleanup(func() { jobWorkerNode = nil })
+
+	// A job that fails without rendering
+	data, _ := json.Marshal(jobMessage{ID: "j1", Request: RenderRequest{PartNumber: "../x"}})
+	w.receive("", data)
+	startDrain("test")
+	if n := broker.subscribed(jobSubject("jobs")); n != 0 {
+		t.Errorf("worker still subscribed while draining")
+	}
+	// Running jobs can still be cancelled
+	if n := broker.subscribed(jobSubject("cancel")); n != 1 {
+		t.Errorf("worker stopped listening for cancellations")
+	}
+	if err := waitForRenders(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := broker.subscribed(jobSubject("jobs")); n != 0 {
+		t.Errorf("worker resubscribed after its job finished")
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Per-edge-type stroke colors. render_part.py draws each colored edge type
+// a second time, on top, in a stroke-only line set of its own
+// (ViewLayer_ColorEdges_<type>), and the strokes in those groups are
+// recolored here. Where an edge is of several colored types, the later one
+// in the script's order wins.
+type EdgeColors struct {
+	Silhouette       string `json:"silhouette"`
+	Crease           string `json:"crease"`
+	Border           string `json:"border"`
+	Contour          string `json:"contour"`
+	ExternalContour  string `json:"externalContour"`
+	EdgeMark         string `json:"edgeMark"`
+	MaterialBoundary string `json:"materialBoundary"`
+}
+
+var (
+	svgLinesetGroupPattern = regexp.MustCompile(`\bid="ViewLayer_`)
+	svgStrokeAttrPattern   = regexp.MustCompile(`\sstroke="[^"]*"`)
+)
+
+// Check the colors and set them in opts, by script edge type name. "fill"
+// is the render's fill color. Only edge types being drawn can be colored.
+func (ec *EdgeColors) apply(opts *RenderOptions) error {
+	var errs fieldErrors
+	var pairs []string
+	drawn := strings.Split(opts.EdgeTypes, ",")
+	for _, c := range []struct{ field, edgeType, color string }{
+		{"silhouette", "silhouette", ec.Silhouette},
+		{"crease", "crease", ec.Crease},
+		{"border", "border", ec.Border},
+		{"contour", "contour", ec.Contour},
+		{"externalContour", "external_contour", ec.ExternalContour},
+		{"edgeMark", "edge_mark", ec.EdgeMark},
+		{"materialBoundary", "material_boundary", ec.MaterialBoundary},
+	} {
+		if c.color == "" {
+			continue
+		}
+		color := opts.FillColor
+		if c.color != "fill" {
+			var err error
+			if color, err = validateColorField(c.field, c.color); err != nil {
+				errs.add(c.field, "%v", err)
+				continue
+			}
+		}
+		if !slices.Contains(drawn, c.edgeType) {
+			errs.add(c.field, "%s isn't among the edge types drawn (see edgeTypes)", c.field)
+			continue
+		}
+		pairs = append(pairs, c.edgeType+"="+color)
+	}
+	opts.EdgeColors = strings.Join(pairs, ";")
+	return errs.err()
+}
+
+// Split RenderOptions.EdgeColors into edge types and colors
+func splitEdgeColors(edgeColors string) (types, colors []string) {
+	if edgeColors == "" {
+		return nil, nil
+	}
+	for _, pair := range strings.Split(edgeColors, ";") {
+		edgeType, color, _ := strings.Cut(pair, "=")
+		types, colors = append(types, edgeType), append(colors, color)
+	}
+	return types, colors
+}
+
+// The color_edge_types argument render_part.py takes. Annotated renders
+// have every edge type drawn on its own; see annotate.go.
+func scriptColorEdgeTypes(opts RenderOptions) string {
+	if opts.Annotate {
+		return opts.EdgeTypes
+	}
+	types, _ := splitEdgeColors(opts.EdgeColors)
+	if len(types) == 0 {
+		return "none"
+	}
+	return strings.Join(types, ",")
+}
+
+// Recolor the strokes in each ColorEdges group
+func applyEdgeColors(svg []byte, edgeColors string) []byte {
+	types, colors := splitEdgeColors(edgeColors)
+	for i, edgeType := range types {
+		color := colors[i]
+		start := bytes.Index(svg, []byte(`id="ViewLayer_ColorEdges_`+edgeType+`"`))
+		if start < 0 {
+			continue
+		}
+		// The group runs to the next line set's
+		end := len(svg)
+		if next := svgLinesetGroupPattern.FindIndex(svg[start+1:]); next != nil {
+			end = start + 1 + next[0]
+		}
+		group := svgPathPattern.ReplaceAllFunc(svg[start:end], func(path []byte) []byte {
+			return svgStrokeAttrPattern.ReplaceAllFunc(path, func(m []byte) []byte {
+				if bytes.HasSuffix(m, []byte(`"none"`)) {
+					return m
+				}
+				return []byte(string(m[0]) + `stroke="` + escapeXML(color) + `"`)
+			})
+		})
+		svg = append(svg[:start:start], append(group, svg[end:]...)...)
+	}
+	return svg
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestEdgeColorsValidate(t *testing.T) {
+	b := func(v bool) *bool { return &v }
+	for name, req := range map[string]RenderRequest{
+		"edgeColors.crease":  {EdgeColors: &EdgeColors{Crease: "not a color"}},
+		"edgeColors.contour": {EdgeColors: &EdgeColors{Contour: "red"}},
+		"edgeColors.border": {EdgeColors: &EdgeColors{Border: "red"},
+			EdgeTypes: &EdgeTypes{Border: b(false)}},
+	} {
+		_, err := req.options()
+		var fe fieldErrors
+		if !errors.As(err, &fe) || len(fe) != 1 || fe[0].Field != name {
+			t.Errorf("expected an error on %s, got %v", name, err)
+		}
+	}
+
+	req := RenderRequest{FillColor: "#4a90d9", EdgeColors: &EdgeColors{Crease: "RED", Silhouette: "fill"}}
+	opts, err := req.options()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.EdgeColors != "silhouette=#4a90d9;crease=red" || scriptColorEdgeTypes(opts) != "silhouette,crease" {
+		t.Errorf("unexpected edge colors %q", opts.EdgeColors)
+	}
+}
+
+func TestEdgeColorsRecolorTheirLineSets(t *testing.T) {
+	svg := renderWithFakeBlender(t, RenderRequest{StrokeColor: "black", EdgeColors: &EdgeColors{Crease: "#ff0000"}})
+	group := regexp.MustCompile(`(?s)id="ViewLayer_ColorEdges_crease".*?</g>`).FindString(svg)
+	if group == "" || !strings.Contains(group, `stroke="#ff0000"`) || strings.Contains(group, `stroke="black"`) {
+		t.Errorf("expected the crease line set recolored:\n%s", svg)
+	}
+	if strings.Contains(svg, "ColorEdges_silhouette") {
+		t.Errorf("expected only the crease line set:\n%s", svg)
+	}
+	if edges := svg[strings.Index(svg, `id="ViewLayer_Edges"`):strings.Index(svg, `id="ViewLayer_ColorEdges_crease"`)]; !strings.Contains(edges, `stroke="black"`) {
+		t.Errorf("expected the Edges strokes left alone:\n%s", svg)
+	}
+}
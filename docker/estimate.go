@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// GET /parts/{number}/estimate predicts how long a part takes to render and
+// how big the SVG will be, for batch schedulers planning work. A part
+// rendered before is predicted from its own renders; any other part from
+// its complexity (see complexity.go), by a linear fit of the parts rendered
+// so far. The history is saved to STATE_DIR/render-history.json.
+const (
+	renderHistoryFile = "render-history.json"
+	// Each part's figures average about this many of its latest renders
+	renderHistoryWindow = 20
+	// Beyond this many parts, the least rendered are forgotten
+	renderHistoryMaxParts = 20000
+	// Parts of distinct complexity needed to fit a model
+	estimateMinSamples = 3
+)
+
+type renderHistoryEntry struct {
+	Renders   int64   `json:"renders"`
+	Seconds   float64 `json:"seconds"`
+	Bytes     float64 `json:"bytes"`
+	Triangles int64   `json:"triangles"`
+}
+
+var renderHistory = struct {
+	sync.Mutex
+	byPart map[string]*renderHistoryEntry
+	dirty  bool
+}{byPart: map[string]*renderHistoryEntry{}}
+
+type RenderEstimate struct {
+	PartNumber string `json:"partNumber"`
+	// Blender's render time, with default options, and the SVG's size
+	Seconds float64 `json:"seconds"`
+	Bytes   int64   `json:"bytes"`
+	// history (the part's own renders), model (fit to its complexity),
+	// average (of every part, with too few to fit), or none (nothing has
+	// rendered yet, and seconds and bytes are 0)
+	Basis string `json:"basis"`
+	// The renders (history) or parts (model, average) it's based on
+	Samples    int64          `json:"samples"`
+	Complexity PartComplexity `json:"complexity"`
+}
+
+// Note a fresh render of a part
+func recordPartRender(partNumber, partFile string, d time.Duration, size int) {
+	complexity, err := partComplexity(partFile)
+	if err != nil {
+		return
+	}
+	renderHistory.Lock()
+	defer renderHistory.Unlock()
+	e, ok := renderHistory.byPart[partNumber]
+	if !ok {
+		if len(renderHistory.byPart) >= renderHistoryMaxParts {
+			for k, e := range renderHistory.byPart {
+				if e.Renders <= 1 {
+					delete(renderHistory.byPart, k)
+				}
+			}
+		}
+		e = &renderHistoryEntry{}
+		renderHistory.byPart[partNumber] = e
+	}
+	// A running mean at first, then a moving average
+	e.Renders++
+	weight := 1 / float64(min(e.Renders, renderHistoryWindow))
+	e.Seconds += (d.Seconds() - e.Seconds) * weight
+	e.Bytes += (float64(size) - e.Bytes) * weight
+	e.Triangles = complexity.Triangles
+	renderHistory.dirty = true
+}
+
+func estimateRender(partNumber string, complexity PartComplexity) RenderEstimate {
+	est := RenderEstimate{PartNumber: partNumber, Basis: "none", Complexity: complexity}
+	renderHistory.Lock()
+	defer renderHistory.Unlock()
+	if e, ok := renderHistory.byPart[partNumber]; ok {
+		est.Seconds, est.Bytes, est.Basis, est.Samples = e.Seconds, int64(e.Bytes), "history", e.Renders
+		return est
+	}
+	if len(renderHistory.byPart) == 0 {
+		return est
+	}
+
+	// Least squares of seconds and bytes on triangles
+	var n, sx, sxx, sy, sxy, sb, sxb float64
+	minSeconds, minBytes := -1.0, -1.0
+	distinct := map[int64]bool{}
+	for _, e := range renderHistory.byPart {
+		x := float64(e.Triangles)
+		n++
+		sx += x
+		sxx += x * x
+		sy += e.Seconds
+		sxy += x * e.Seconds
+		sb += e.Bytes
+		sxb += x * e.Bytes
+		distinct[e.Triangles] = true
+		if minSeconds < 0 || e.Seconds < minSeconds {
+			minSeconds = e.Seconds
+		}
+		if minBytes < 0 || e.Bytes < minBytes {
+			minBytes = e.Bytes
+		}
+	}
+	est.Samples = int64(n)
+	variance := n*sxx - sx*sx
+	if len(distinct) < estimateMinSamples || variance == 0 {
+		est.Seconds, est.Bytes, est.Basis = sy/n, int64(sb/n), "average"
+		return est
+	}
+	x := float64(complexity.Triangles)
+	predict := func(sy, sxy, floor float64) float64 {
+		slope := (n*sxy - sx*sy) / variance
+		v := (sy-slope*sx)/n + slope*x
+		// Smaller than anything seen is more likely the fit than the part
+		return max(v, floor)
+	}
+	est.Seconds = predict(sy, sxy, minSeconds)
+	est.Bytes = int64(predict(sb, sxb, minBytes))
+	est.Basis = "model"
+	return est
+}
+
+func handlePartEstimate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		sendError(w, http.StatusMethodNotAllowed, "Method not allowed", "")
+		return
+	}
+	partNumber, partFile, err := resolvePart(r.PathValue("number"))
+	if err != nil {
+		sendRenderError(w, err)
+		return
+	}
+	setPartHeaders(w, r.PathValue("number"), RenderOptions{})
+	complexity, err := partComplexity(partFile)
+	if err != nil {
+		sendError(w, http.StatusInternalServerError, "Reading part failed", err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(estimateRender(partNumber, complexity))
+}
+
+func saveRenderHistory(dir string) error {
+	renderHistory.Lock()
+	data, err := json.Marshal(renderHistory.byPart)
+	renderHistory.dirty = false
+	renderHistory.Unlock()
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(dir, renderHistoryFile), data)
+}
+
+// Load the saved history; a missing file is no renders yet
+func loadRenderHistory(dir string) error {
+	data, err := os.ReadFile(filepath.Join(dir, renderHistoryFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	byPart := map[string]*renderHistoryEntry{}
+	if err := json.Unmarshal(data, &byPart); err != nil {
+		return err
+	}
+	renderHistory.Lock()
+	renderHistory.byPart = byPart
+	renderHistory.dirty = false
+	renderHistory.Unlock()
+	return nil
+}
+
+// Save the history whenever it has changed, every interval
+func runRenderHistorySaver(dir string, interval time.Duration) {
+	for range time.Tick(interval) {
+		renderHistory.Lock()
+		dirty := renderHistory.dirty
+		renderHistory.Unlock()
+		if !dirty {
+			continue
+		}
+		if err := saveRenderHistory(dir); err != nil {
+			log.Printf("Failed to save render history: %v", err)
+		}
+	}
+}
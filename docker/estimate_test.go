@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func withRenderHistory(t *testing.T) {
+	t.Helper()
+	renderHistory.Lock()
+	old := renderHistory.byPart
+	renderHistory.byPart = map[string]*renderHistoryEntry{}
+	renderHistory.Unlock()
+	t.Cleanup(func() {
+		renderHistory.Lock()
+		renderHistory.byPart = old
+		renderHistory.Unlock()
+	})
+}
+
+// A part of n triangles
+func trianglesPart(n int) string {
+	return "0 Part\n" + strings.Repeat("3 16 0 0 0 1 0 0 0 1 0\n", n)
+}
+
+func TestPartEstimate(t *testing.T) {
+	dir := withTestLibrary(t, map[string]string{
+		"a": trianglesPart(10), "b": trianglesPart(20), "c": trianglesPart(30), "d": trianglesPart(40),
+	})
+	withRenderHistory(t)
+	estimate := func(part string) (int, RenderEstimate) {
+		req := httptest.NewRequest(http.MethodGet, "/parts/"+part+"/estimate", nil)
+		req.SetPathValue("number", part)
+		w := httptest.NewRecorder()
+		handlePartEstimate(w, req)
+		var est RenderEstimate
+		json.Unmarshal(w.Body.Bytes(), &est)
+		return w.Code, est
+	}
+
+	if _, est := estimate("d"); est.Basis != "none" || est.Complexity.Triangles != 40 {
+		t.Errorf("expected no basis before any render, got %+v", est)
+	}
+	// Seconds are 1 + triangles/10, bytes 1000 + 100 per triangle
+	for _, p := range []struct {
+		part      string
+		triangles int
+	}{{"a", 10}, {"b", 20}, {"c", 30}} {
+		d := time.Duration(float64(time.Second) * (1 + float64(p.triangles)/10))
+		recordPartRender(p.part, filepath.Join(dir, "parts", p.part+".dat"), d, 1000+100*p.triangles)
+	}
+	recordPartRender("a", filepath.Join(dir, "parts", "a.dat"), 2*time.Second, 2000)
+
+	if _, est := estimate("a"); est.Basis != "history" || est.Samples != 2 || est.Seconds != 2 || est.Bytes != 2000 {
+		t.Errorf("expected the part's own average, got %+v", est)
+	}
+	_, est := estimate("d")
+	if est.Basis != "model" || est.Samples != 3 || est.Bytes < 4900 || est.Bytes > 5100 || math.Abs(est.Seconds-5) > 0.5 {
+		t.Errorf("expected a prediction from complexity, got %+v", est)
+	}
+
+	if status, _ := estimate("nosuch"); status != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown part, got %d", status)
+	}
+}
+
+func TestRenderHistoryPersistence(t *testing.T) {
+	dir := withTestLibrary(t, map[string]string{"3001": trianglesPart(12)})
+	withRenderHistory(t)
+	recordPartRender("3001", filepath.Join(dir, "parts", "3001.dat"), 2*time.Second, 5000)
+
+	state := t.TempDir()
+	if err := saveRenderHistory(state); err != nil {
+		t.Fatal(err)
+	}
+	withRenderHistory(t)
+	if err := loadRenderHistory(state); err != nil {
+		t.Fatal(err)
+	}
+	renderHistory.Lock()
+	e := renderHistory.byPart["3001"]
+	renderHistory.Unlock()
+	if e == nil || e.Renders != 1 || e.Seconds != 2 || e.Triangles != 12 {
+		t.Errorf("history not restored: %+v", e)
+	}
+	if err := loadRenderHistory(t.TempDir()); err != nil {
+		t.Errorf("a missing history should load empty: %v", err)
+	}
+}
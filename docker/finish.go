@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Line art is flat-filled, so LDraw material finishes are suggested with
+// SVG paint servers on the fill paths: a banded highlight gradient for
+// chrome, a softer one for metallic and pearlescent colors, and a dotted
+// pattern in the particle color for glitter and speckle. Transparent colors
+// get their opacity from the color's ALPHA, as for any LDraw color.
+
+// Map an LDConfig finish keyword to the style it renders with ("" is flat)
+func finishStyle(finish string) string {
+	switch strings.ToUpper(finish) {
+	case "CHROME":
+		return "chrome"
+	case "METAL", "MATTE_METALLIC":
+		return "metal"
+	case "PEARLESCENT":
+		return "pearl"
+	case "GLITTER":
+		return "glitter"
+	case "SPECKLE":
+		return "speckle"
+	}
+	return ""
+}
+
+// Apply the render's finish to its fill paths. Renders without a finish, or
+// with per-part LDraw fills, are returned unchanged.
+func applyFinish(svg []byte, opts RenderOptions) []byte {
+	style := finishStyle(opts.Finish)
+	if style == "" || opts.FillMode == "ldraw" {
+		return svg
+	}
+	loc := svgRootPattern.FindIndex(svg)
+	if loc == nil {
+		return svg
+	}
+
+	// The id includes the colors so finishes stay distinct when several
+	// renders are embedded in one sheet
+	id := "finish-" + style + "-" + colorID(opts.FillColor)
+	if opts.FinishColor != "" && (style == "glitter" || style == "speckle") {
+		id += "-" + colorID(opts.FinishColor)
+	}
+	defs := finishDefs(style, id, opts.FillColor, opts.FinishColor)
+
+	svg = svgPathPattern.ReplaceAllFunc(svg, func(path []byte) []byte {
+		if !bytes.Contains(path, []byte(`stroke="none"`)) {
+			return path
+		}
+		return svgFillAttrPattern.ReplaceAllFunc(path, func(m []byte) []byte {
+			return []byte(string(m[0]) + `fill="url(#` + id + `)"`)
+		})
+	})
+
+	out := make([]byte, 0, len(svg)+len(defs)+1)
+	out = append(out, svg[:loc[1]]...)
+	out = append(out, '\n')
+	out = append(out, defs...)
+	return append(out, svg[loc[1]:]...)
+}
+
+func finishDefs(style, id, base, particle string) string {
+	var b strings.Builder
+	b.WriteString("<defs>")
+	switch style {
+	case "chrome":
+		fmt.Fprintf(&b, `<linearGradient id="%s" x1="0" y1="0" x2="1" y2="1">`, id)
+		for _, s := range []struct {
+			offset float64
+			color  string
+		}{
+			{0, mixColor(base, "#ffffff", 0.6)},
+			{0.4, base},
+			{0.5, mixColor(base, "#ffffff", 0.85)},
+			{0.6, mixColor(base, "#000000", 0.35)},
+			{1, base},
+		} {
+			fmt.Fprintf(&b, `<stop offset="%g" stop-color="%s" />`, s.offset, escapeXML(s.color))
+		}
+		b.WriteString("</linearGradient>")
+	case "metal", "pearl":
+		highlight := 0.35
+		if style == "pearl" {
+			highlight = 0.2
+		}
+		fmt.Fprintf(&b, `<linearGradient id="%s" x1="0" y1="0" x2="1" y2="1">`, id)
+		fmt.Fprintf(&b, `<stop offset="0" stop-color="%s" />`, escapeXML(mixColor(base, "#ffffff", highlight)))
+		fmt.Fprintf(&b, `<stop offset="1" stop-color="%s" />`, escapeXML(mixColor(base, "#000000", highlight/2)))
+		b.WriteString("</linearGradient>")
+	case "glitter", "speckle":
+		if particle == "" {
+			particle = mixColor(base, "#ffffff", 0.5)
+		}
+		// Glitter is sparse fine flecks; speckle is denser, larger dots
+		size, radius := 8.0, 0.7
+		if style == "speckle" {
+			size, radius = 6, 1.0
+		}
+		fmt.Fprintf(&b, `<pattern id="%s" width="%g" height="%g" patternUnits="userSpaceOnUse">`, id, size, size)
+		fmt.Fprintf(&b, `<rect width="%g" height="%g" fill="%s" />`, size, size, escapeXML(base))
+		fmt.Fprintf(&b, `<circle cx="%g" cy="%g" r="%g" fill="%s" />`, size/4, size/4, radius, escapeXML(particle))
+		fmt.Fprintf(&b, `<circle cx="%g" cy="%g" r="%g" fill="%s" />`, size*3/4, size*5/8, radius*0.8, escapeXML(particle))
+		b.WriteString("</pattern>")
+	}
+	b.WriteString("</defs>\n")
+	return b.String()
+}
+
+// Blend a #RRGGBB color toward another by t (0-1). Other CSS colors can't be
+// mixed here and are returned as-is.
+func mixColor(color, toward string, t float64) string {
+	r1, g1, b1, ok1 := parseHexColor(color)
+	r2, g2, b2, ok2 := parseHexColor(toward)
+	if !ok1 || !ok2 {
+		return color
+	}
+	mix := func(a, b float64) int { return int(a + (b-a)*t + 0.5) }
+	return fmt.Sprintf("#%02X%02X%02X", mix(r1, r2), mix(g1, g2), mix(b1, b2))
+}
+
+func parseHexColor(s string) (r, g, b float64, ok bool) {
+	hex := strings.TrimPrefix(s, "#")
+	if len(hex) != 6 || hex == s {
+		return 0, 0, 0, false
+	}
+	n, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil {
+		return 0, 0, 0, false
+	}
+	return float64(n >> 16), float64(n >> 8 & 0xff), float64(n & 0xff), true
+}
+
+// Reduce a CSS color to characters safe in an XML id
+func colorID(color string) string {
+	var b strings.Builder
+	for _, c := range color {
+		if c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' {
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
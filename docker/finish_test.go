@@ -0,0 +1,78 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestApplyFinish(t *testing.T) {
+	tests := []struct {
+		finish, particle string
+		want             []string
+	}{
+		{"CHROME", "", []string{`<linearGradient id="finish-chrome-BBA53D"`, `fill="url(#finish-chrome-BBA53D)"`}},
+		{"MATTE_METALLIC", "", []string{`<linearGradient id="finish-metal-BBA53D"`}},
+		{"GLITTER", "#923978", []string{`<pattern id="finish-glitter-BBA53D-923978"`, `<circle cx="2" cy="2" r="0.7" fill="#923978" />`}},
+		{"SPECKLE", "", []string{`<pattern id="finish-speckle-BBA53D"`, `patternUnits="userSpaceOnUse"`}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.finish, func(t *testing.T) {
+			opts := RenderOptions{FillColor: "#BBA53D", FillMode: "uniform", Finish: tt.finish, FinishColor: tt.particle}
+			got := applyFinish([]byte(testSchemeSVG), opts)
+			for _, want := range tt.want {
+				if !strings.Contains(string(got), want) {
+					t.Errorf("missing %s:\n%s", want, got)
+				}
+			}
+			// Strokes keep their paint
+			if !strings.Contains(string(got), `stroke="currentColor"`) || strings.Count(string(got), "url(#") != 2 {
+				t.Errorf("only fill paths should use the finish:\n%s", got)
+			}
+			if err := checkSVG(got); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+
+	for _, opts := range []RenderOptions{
+		{FillColor: "#BBA53D", Finish: "RUBBER"},
+		{FillColor: "#BBA53D", Finish: "CHROME", FillMode: "ldraw"},
+	} {
+		if got := applyFinish([]byte(testSchemeSVG), opts); string(got) != testSchemeSVG {
+			t.Errorf("%+v should render flat", opts)
+		}
+	}
+}
+
+func TestMixColor(t *testing.T) {
+	if got := mixColor("#000000", "#ffffff", 0.5); got != "#808080" {
+		t.Errorf("got %s", got)
+	}
+	if got := mixColor("steelblue", "#ffffff", 0.5); got != "steelblue" {
+		t.Errorf("named colors can't be mixed, got %s", got)
+	}
+}
+
+func TestRenderRequestColor(t *testing.T) {
+	withTestLibrary(t, nil)
+	code := 114
+	req := RenderRequest{Color: &code}
+	opts, err := req.options()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.FillColor != "#DF6695" || opts.FillOpacity != 128.0/255 || opts.Finish != "GLITTER" || opts.FinishColor != "#923978" {
+		t.Errorf("unexpected options %+v", opts)
+	}
+
+	opacity := 1.0
+	req = RenderRequest{Color: &code, FillColor: "pink", FillOpacity: &opacity}
+	if opts, _ = req.options(); opts.FillColor != "pink" || opts.FillOpacity != 1 || opts.Finish != "GLITTER" {
+		t.Errorf("explicit fill should win: %+v", opts)
+	}
+
+	code = 9999
+	if _, err := req.options(); err == nil {
+		t.Error("expected an error for an unknown color")
+	}
+}
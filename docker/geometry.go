@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GET /parts/{number}/stats reports a part's geometry as read from its
+// LDraw files, with every subfile expanded: its triangles, quads, and
+// lines, the subfiles and primitives it uses, and its bounding box. The
+// reading is cached until the file or the library changes, and also backs
+// the complexity estimates use (see complexity.go).
+type PartStats struct {
+	PartNumber string `json:"partNumber"`
+	PartGeometry
+}
+
+type PartGeometry struct {
+	Triangles int64 `json:"triangles"`
+	Quads     int64 `json:"quads"`
+	Lines     int64 `json:"lines"`
+	// Conditional lines, which only show along silhouettes
+	CondLines int64 `json:"condLines"`
+	// Distinct files referenced, however deep, and how deeply they nest
+	Subfiles int `json:"subfiles"`
+	Depth    int `json:"depth"`
+	// Subfile references not found in the library
+	Missing int `json:"missing,omitempty"`
+	// Placements of each primitive (a file in p/, by its name there)
+	Primitives map[string]int64 `json:"primitives"`
+	// Nil for a part with no geometry
+	BoundingBox *BoundingBox `json:"boundingBox"`
+}
+
+// A box on the LDraw axes (-y is up), in LDU; 20 LDU is a stud's pitch.
+// Subfile boxes are transformed by their corners, which is exact for the
+// axis-aligned placements nearly all parts use and a little loose for others.
+type BoundingBox struct {
+	Min  [3]float64 `json:"min"`
+	Max  [3]float64 `json:"max"`
+	Size [3]float64 `json:"size"`
+	// Size in studs (20 LDU) on each axis
+	Studs [3]float64 `json:"studs"`
+}
+
+const ldrawStudLDU = 20
+
+// Nesting beyond this is a reference cycle, not a part
+const geometryMaxDepth = 32
+
+// Geometry by part file, kept until the file or the library changes
+var partGeometries = struct {
+	sync.Mutex
+	byPath map[string]geometryEntry
+}{byPath: map[string]geometryEntry{}}
+
+type geometryEntry struct {
+	modTime  time.Time
+	size     int64
+	version  string
+	geometry PartGeometry
+}
+
+func handlePartStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		sendError(w, http.StatusMethodNotAllowed, "Method not allowed", "")
+		return
+	}
+	partNumber, partFile, err := resolvePart(r.PathValue("number"))
+	if err != nil {
+		sendRenderError(w, err)
+		return
+	}
+	setPartHeaders(w, r.PathValue("number"), RenderOptions{})
+	geometry, err := partGeometry(partFile)
+	if err != nil {
+		sendError(w, http.StatusInternalServerError, "Reading part failed", err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(PartStats{partNumber, geometry})
+}
+
+// A part file's geometry, from the cache if it's unchanged
+func partGeometry(path string) (PartGeometry, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return PartGeometry{}, err
+	}
+	version := renderVersion()
+	partGeometries.Lock()
+	e, ok := partGeometries.byPath[path]
+	partGeometries.Unlock()
+	if ok && e.modTime.Equal(info.ModTime()) && e.size == info.Size() && e.version == version {
+		return e.geometry, nil
+	}
+
+	g := analyzeGeometry(path)
+	partGeometries.Lock()
+	partGeometries.byPath[path] = geometryEntry{info.ModTime(), info.Size(), version, g}
+	partGeometries.Unlock()
+	return g, nil
+}
+
+// A file's geometry in its own coordinates
+type fileGeometry struct {
+	triangles, quads, lines, condLines int64
+	depth                              int
+	primitives                         map[string]int64
+	hasBox                             bool
+	min, max                           [3]float64
+}
+
+func (g *fileGeometry) addPoint(p [3]float64) {
+	if !g.hasBox {
+		g.min, g.max, g.hasBox = p, p, true
+		return
+	}
+	for i := range p {
+		g.min[i], g.max[i] = math.Min(g.min[i], p[i]), math.Max(g.max[i], p[i])
+	}
+}
+
+// Walk a file and its subfiles, each read once however often it's used
+func analyzeGeometry(path string) PartGeometry {
+	primitivesDir := filepath.Join(ldrawPath, "p") + string(filepath.Separator)
+	memo := map[string]*fileGeometry{}
+	missing := map[string]bool{}
+	var walk func(path string, level int) *fileGeometry
+	walk = func(path string, level int) *fileGeometry {
+		if g, ok := memo[path]; ok {
+			return g
+		}
+		// Marks the file as being walked, so a cycle counts as empty
+		memo[path] = &fileGeometry{}
+		g := &fileGeometry{primitives: map[string]int64{}}
+		if level > geometryMaxDepth {
+			return g
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return g
+		}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) == 0 {
+				continue
+			}
+			points := 0
+			switch fields[0] {
+			case "1":
+				if len(fields) < 15 {
+					continue
+				}
+				ref := strings.Join(fields[14:], " ")
+				sub := findPartFile(partNumberFromRef(ref))
+				if sub == "" {
+					missing[mpdKey(ref)] = true
+					continue
+				}
+				m, ok := parseFloats(fields[2:14])
+				if !ok {
+					continue
+				}
+				s := walk(sub, level+1)
+				g.triangles += s.triangles
+				g.quads += s.quads
+				g.lines += s.lines
+				g.condLines += s.condLines
+				g.depth = max(g.depth, s.depth+1)
+				if name, ok := strings.CutPrefix(sub, primitivesDir); ok {
+					g.primitives[strings.TrimSuffix(strings.ToLower(filepath.ToSlash(name)), ".dat")]++
+				}
+				for name, n := range s.primitives {
+					g.primitives[name] += n
+				}
+				if s.hasBox {
+					for _, corner := range boxCorners(s.min, s.max) {
+						g.addPoint(transformPoint(m, corner))
+					}
+				}
+			case "2":
+				g.lines++
+				points = 2
+			case "3":
+				g.triangles++
+				points = 3
+			case "4":
+				g.quads++
+				points = 4
+			case "5":
+				// The control points aren't drawn
+				g.condLines++
+				points = 2
+			}
+			if points > 0 && len(fields) >= 2+3*points {
+				if v, ok := parseFloats(fields[2 : 2+3*points]); ok {
+					for i := 0; i < points; i++ {
+						g.addPoint([3]float64{v[3*i], v[3*i+1], v[3*i+2]})
+					}
+				}
+			}
+		}
+		f.Close()
+		memo[path] = g
+		return g
+	}
+
+	top := walk(path, 0)
+	geometry := PartGeometry{
+		Triangles:  top.triangles,
+		Quads:      top.quads,
+		Lines:      top.lines,
+		CondLines:  top.condLines,
+		Subfiles:   len(memo) - 1,
+		Depth:      top.depth,
+		Missing:    len(missing),
+		Primitives: top.primitives,
+	}
+	if top.hasBox {
+		box := &BoundingBox{Min: top.min, Max: top.max}
+		for i := range box.Size {
+			box.Size[i] = box.Max[i] - box.Min[i]
+			box.Studs[i] = box.Size[i] / ldrawStudLDU
+		}
+		geometry.BoundingBox = box
+	}
+	return geometry
+}
+
+func parseFloats(fields []string) ([]float64, bool) {
+	v := make([]float64, len(fields))
+	for i, f := range fields {
+		x, err := strconv.ParseFloat(f, 64)
+		if err != nil || math.IsNaN(x) || math.IsInf(x, 0) {
+			return nil, false
+		}
+		v[i] = x
+	}
+	return v, true
+}
+
+// A point placed by a type 1 line's x y z a b c d e f g h i
+func transformPoint(m []float64, p [3]float64) [3]float64 {
+	return [3]float64{
+		m[0] + m[3]*p[0] + m[4]*p[1] + m[5]*p[2],
+		m[1] + m[6]*p[0] + m[7]*p[1] + m[8]*p[2],
+		m[2] + m[9]*p[0] + m[10]*p[1] + m[11]*p[2],
+	}
+}
+
+func boxCorners(lo, hi [3]float64) [8][3]float64 {
+	var corners [8][3]float64
+	for i := range corners {
+		for axis := 0; axis < 3; axis++ {
+			if i&(1<<axis) == 0 {
+				corners[i][axis] = lo[axis]
+			} else {
+				corners[i][axis] = hi[axis]
+			}
+		}
+	}
+	return corners
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestPartStats(t *testing.T) {
+	dir := withTestLibrary(t, map[string]string{
+		"3003": "0 Brick 2 x 2\n" +
+			"2 24 -20 0 -20 20 24 20\n" +
+			"1 16 10 0 10 1 0 0 0 1 0 0 0 1 stud.dat\n" +
+			"1 16 -10 0 -10 0 0 1 0 1 0 -1 0 0 stud.dat\n" +
+			"1 16 0 -10 0 2 0 0 0 2 0 0 0 2 48\\1-4cyli.dat\n",
+	})
+	os.MkdirAll(filepath.Join(dir, "p", "48"), 0o755)
+	os.WriteFile(filepath.Join(dir, "p", "stud.dat"), []byte("0 Stud\n4 16 -6 0 -6 6 0 -6 6 0 6 -6 0 6\n5 24 6 0 0 6 -4 0 0 0 0 0 0 0\n"), 0o644)
+	os.WriteFile(filepath.Join(dir, "p", "48", "1-4cyli.dat"), []byte("0 Cylinder 0.25\n3 16 0 0 0 1 0 0 0 0 1\n"), 0o644)
+
+	req := httptest.NewRequest(http.MethodGet, "/parts/3003/stats", nil)
+	req.SetPathValue("number", "3003")
+	w := httptest.NewRecorder()
+	handlePartStats(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	var stats PartStats
+	if err := json.Unmarshal(w.Body.Bytes(), &stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.PartNumber != "3003" || stats.Triangles != 1 || stats.Quads != 2 || stats.Lines != 1 || stats.CondLines != 2 || stats.Subfiles != 2 || stats.Depth != 1 {
+		t.Errorf("unexpected counts %+v", stats)
+	}
+	if want := map[string]int64{"stud": 2, "48/1-4cyli": 1}; !reflect.DeepEqual(stats.Primitives, want) {
+		t.Errorf("primitives %v, want %v", stats.Primitives, want)
+	}
+	want := &BoundingBox{Min: [3]float64{-20, -10, -20}, Max: [3]float64{20, 24, 20}, Size: [3]float64{40, 34, 40}, Studs: [3]float64{2, 1.7, 2}}
+	if !reflect.DeepEqual(stats.BoundingBox, want) {
+		t.Errorf("bounding box %+v, want %+v", stats.BoundingBox, want)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/parts/9999/stats", nil)
+	req.SetPathValue("number", "9999")
+	w = httptest.NewRecorder()
+	handlePartStats(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown part, got %d", w.Code)
+	}
+}
+
+func TestTransformPoint(t *testing.T) {
+	// A quarter turn about y, then moved along x
+	m := []float64{10, 0, 0, 0, 0, 1, 0, 1, 0, -1, 0, 0}
+	if got := transformPoint(m, [3]float64{1, 2, 3}); got != [3]float64{13, 2, -1} {
+		t.Errorf("got %v", got)
+	}
+}
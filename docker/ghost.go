@@ -0,0 +1,117 @@
+package main
+
+import (
+	"strings"
+)
+
+// MLCad helper meta commands in the main model:
+//
+//	0 GHOST <line>            a helper part, drawn translucent with dashed edges
+//	0 BUFEXCHG <A-Z> STORE    remember the parts placed so far
+//	0 BUFEXCHG <A-Z> RETRIEVE go back to the stored parts, removing the
+//	                          temporary assembly placed since the STORE
+//
+// Submodels are rendered as written; these commands only apply to the main
+// file, as in instruction steps.
+
+// Split a normalized model into the geometry drawn normally and the ghosted
+// geometry, replaying buffer exchanges. The ghost model is nil when there's
+// nothing to ghost. Both models keep the MPD subfiles so ghosted lines can
+// place submodels.
+func splitGhosts(model []byte) (solid, ghost []byte) {
+	text := string(model)
+	if !strings.Contains(text, "GHOST") && !strings.Contains(text, "BUFEXCHG") {
+		return model, nil
+	}
+
+	header, main, rest := splitMainFile(model)
+	var solidLines, ghostLines []string
+	for _, line := range main {
+		fields := strings.Fields(line)
+		if len(fields) >= 3 && fields[0] == "0" && fields[1] == "GHOST" {
+			_, after, _ := strings.Cut(line, "GHOST")
+			ghostLines = append(ghostLines, strings.TrimSpace(after))
+			continue
+		}
+		solidLines = append(solidLines, line)
+	}
+
+	solid = joinModel(header, solidLines, rest)
+	if len(ghostLines) > 0 {
+		ghost = joinModel(header, ghostLines, rest)
+	}
+	return solid, ghost
+}
+
+// Split a normalized model into its main file's FILE line (if it has one),
+// the main file's lines with buffer exchanges replayed, and the subfiles
+// after it, for joinModel
+func splitMainFile(model []byte) (header, main, rest []string) {
+	text := string(model)
+	var buffers map[string][]string
+	inMain := !isMPD(model)
+	mainDone := false
+	for _, line := range strings.Split(strings.TrimSuffix(text, "\n"), "\n") {
+		fields := strings.Fields(line)
+		isMeta := len(fields) >= 2 && fields[0] == "0"
+
+		if isMeta && (fields[1] == "FILE" || fields[1] == "NOFILE") {
+			if inMain {
+				inMain, mainDone = false, true
+				if fields[1] == "NOFILE" {
+					continue
+				}
+			} else if !mainDone && fields[1] == "FILE" {
+				header = append(header, line)
+				inMain = true
+				continue
+			}
+		}
+		if !inMain {
+			if mainDone {
+				rest = append(rest, line)
+			}
+			continue
+		}
+
+		if isMeta && fields[1] == "BUFEXCHG" && len(fields) >= 4 {
+			buffer := strings.ToUpper(fields[2])
+			switch strings.ToUpper(fields[3]) {
+			case "STORE":
+				if buffers == nil {
+					buffers = make(map[string][]string)
+				}
+				buffers[buffer] = append([]string(nil), main...)
+				continue
+			case "RETRIEVE":
+				if stored, ok := buffers[buffer]; ok {
+					main = append([]string(nil), stored...)
+				}
+				continue
+			}
+		}
+		main = append(main, line)
+	}
+	return header, main, rest
+}
+
+// Reassemble a model from its main file lines and trailing subfiles
+func joinModel(header, main, rest []string) []byte {
+	var b strings.Builder
+	for _, line := range header {
+		b.WriteString(line)
+		b.WriteByte('\n')
+	}
+	for _, line := range main {
+		b.WriteString(line)
+		b.WriteByte('\n')
+	}
+	if len(header) > 0 {
+		b.WriteString("0 NOFILE\n")
+	}
+	for _, line := range rest {
+		b.WriteString(line)
+		b.WriteByte('\n')
+	}
+	return []byte(b.String())
+}
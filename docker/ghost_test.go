@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestSplitGhosts(t *testing.T) {
+	plain := []byte("0 Brick\n1 4 0 0 0 1 0 0 0 1 0 0 0 1 3001.dat\n")
+	if solid, ghost := splitGhosts(plain); string(solid) != string(plain) || ghost != nil {
+		t.Errorf("model without helpers should pass through, got %q / %q", solid, ghost)
+	}
+
+	solid, ghost := splitGhosts([]byte(`0 Helpers
+1 4 0 0 0 1 0 0 0 1 0 0 0 1 3001.dat
+0 GHOST 1 15 0 -24 0 1 0 0 0 1 0 0 0 1 3003.dat
+0 BUFEXCHG A STORE
+1 1 0 -48 0 1 0 0 0 1 0 0 0 1 3004.dat
+0 BUFEXCHG A RETRIEVE
+1 2 0 -72 0 1 0 0 0 1 0 0 0 1 3005.dat
+`))
+	if got, want := string(solid), "0 Helpers\n1 4 0 0 0 1 0 0 0 1 0 0 0 1 3001.dat\n1 2 0 -72 0 1 0 0 0 1 0 0 0 1 3005.dat\n"; got != want {
+		t.Errorf("solid model:\n%s\nwant:\n%s", got, want)
+	}
+	if got, want := string(ghost), "1 15 0 -24 0 1 0 0 0 1 0 0 0 1 3003.dat\n"; got != want {
+		t.Errorf("ghost model: got %q, want %q", got, want)
+	}
+}
+
+func TestSplitGhostsMPD(t *testing.T) {
+	solid, ghost := splitGhosts([]byte(`0 FILE main.ldr
+1 4 0 0 0 1 0 0 0 1 0 0 0 1 3001.dat
+0 GHOST 1 16 0 -24 0 1 0 0 0 1 0 0 0 1 jig.ldr
+0 NOFILE
+0 FILE jig.ldr
+0 GHOST 1 16 0 0 0 1 0 0 0 1 0 0 0 1 3003.dat
+0 NOFILE
+`))
+	if strings.Contains(string(solid), "jig.ldr\n0 NOFILE\n0 FILE") || !strings.Contains(string(solid), "0 FILE jig.ldr\n0 GHOST") {
+		t.Errorf("submodels should be kept as written:\n%s", solid)
+	}
+	if !strings.HasPrefix(string(ghost), "0 FILE main.ldr\n1 16 0 -24 0 1 0 0 0 1 0 0 0 1 jig.ldr\n0 NOFILE\n0 FILE jig.ldr\n") {
+		t.Errorf("unexpected ghost model:\n%s", ghost)
+	}
+	if strings.Count(string(solid), "0 NOFILE") != 2 || strings.Count(string(ghost), "0 NOFILE") != 2 {
+		t.Errorf("each file should end with one NOFILE:\n%s\n%s", solid, ghost)
+	}
+}
+
+// A step that only retrieves a buffer still gets its own page
+func TestParseStepsBufferExchange(t *testing.T) {
+	m := parseSteps([]byte(`1 4 0 0 0 1 0 0 0 1 0 0 0 1 3001.dat
+0 BUFEXCHG A STORE
+0 STEP
+1 1 0 -24 0 1 0 0 0 1 0 0 0 1 3004.dat
+0 STEP
+0 BUFEXCHG A RETRIEVE
+0 STEP
+0 GHOST 1 1 0 -24 0 1 0 0 0 1 0 0 0 1 3004.dat
+0 STEP
+`))
+	if len(m.steps) != 4 {
+		t.Fatalf("expected 4 steps, got %d", len(m.steps))
+	}
+	solid, _ := splitGhosts(m.stepModel(0, 2))
+	if !strings.Contains(string(solid), "3004.dat") {
+		t.Errorf("temporary assembly should show before the retrieve:\n%s", solid)
+	}
+	solid, ghost := splitGhosts(m.stepModel(0, 4))
+	if strings.Contains(string(solid), "3004.dat") || !strings.Contains(string(ghost), "3004.dat") {
+		t.Errorf("temporary assembly should be removed and ghosted:\n%s\n%s", solid, ghost)
+	}
+	if added := extractBOM(m.stepModel(3, 4)); len(added.Parts) != 0 {
+		t.Errorf("ghosted parts shouldn't be listed as added: %+v", added.Parts)
+	}
+}
+
+func TestRenderGhostFile(t *testing.T) {
+	capture := withFakeBlender(t)
+	contract := loadRenderContract(t)
+
+	modelFile, ghostFile, _, cleanup, err := writeModelFile([]byte("1 4 0 0 0 1 0 0 0 1 0 0 0 1 3001.dat\n0 GHOST 1 4 0 -24 0 1 0 0 0 1 0 0 0 1 3001.dat\n"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	if ghostFile == "" {
+		t.Fatal("expected a ghost file")
+	}
+
+	opts, _ := (&RenderRequest{}).options()
+	opts.GhostFile = ghostFile
+	svg, _, err := renderFile(context.Background(), "ghost", modelFile, opts)
+	if err != nil {
+		t.Fatalf("contract stub rejected arguments: %v", err)
+	}
+
+	data, _ := os.ReadFile(capture)
+	var got map[string]string
+	json.Unmarshal(data, &got)
+	if got["ghost_file"] != ghostFile {
+		t.Errorf("ghost_file: got %q, want %q", got["ghost_file"], ghostFile)
+	}
+	out := checkRenderOutput(t, contract, svg)
+	if len(out.fills) != 2 || out.fills[1]["fill-opacity"] != "0.5000" || out.strokes[1]["stroke-dasharray"] == "" {
+		t.Errorf("unexpected ghost styling: %v %v", out.fills, out.strokes)
+	}
+}
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// The dispatcher and batch renders also speak gRPC, on the same port as
+// everything else: the server accepts HTTP/2 with TLS or in the clear
+// (h2c, prior knowledge), and gRPC calls are POSTs to
+// /<package>.<Service>/<Method>. The project carries no dependencies, so
+// this is the small part of gRPC it needs over net/http: uncompressed
+// length-prefixed messages, grpc-status trailers, and the protocol buffer
+// wire format for the messages in renderer.proto.
+
+// Largest message accepted unless a method allows more, as gRPC's default
+const grpcMaxMessageBytes = 4 << 20
+
+type grpcCode int
+
+const (
+	grpcOK                 grpcCode = 0
+	grpcCanceled           grpcCode = 1
+	grpcUnknown            grpcCode = 2
+	grpcInvalidArgument    grpcCode = 3
+	grpcDeadlineExceeded   grpcCode = 4
+	grpcNotFound           grpcCode = 5
+	grpcResourceExhausted  grpcCode = 8
+	grpcFailedPrecondition grpcCode = 9
+	grpcUnimplemented      grpcCode = 12
+	grpcInternal           grpcCode = 13
+	grpcUnavailable        grpcCode = 14
+	grpcUnauthenticated    grpcCode = 16
+)
+
+// A call's non-OK status
+type grpcError struct {
+	Code    grpcCode
+	Message string
+}
+
+func (e *grpcError) Error() string {
+	return fmt.Sprintf("grpc: %s (code %d)", e.Message, e.Code)
+}
+
+func grpcErrorCode(err error) grpcCode {
+	var ge *grpcError
+	switch {
+	case err == nil:
+		return grpcOK
+	case errors.As(err, &ge):
+		return ge.Code
+	case errors.Is(err, context.Canceled):
+		return grpcCanceled
+	case errors.Is(err, context.DeadlineExceeded):
+		return grpcDeadlineExceeded
+	}
+	return grpcInternal
+}
+
+func isGRPCContentType(contentType string) bool {
+	return contentType == "application/grpc" || strings.HasPrefix(contentType, "application/grpc+proto") || strings.HasPrefix(contentType, "application/grpc;")
+}
+
+// Read one length-prefixed message; io.EOF when the stream ends between
+// messages. The length comes off the wire, so it's checked before
+// allocating.
+func readGRPCMessage(r io.Reader, maxBytes int) ([]byte, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return nil, err
+	}
+	if prefix[0] != 0 {
+		return nil, &grpcError{grpcUnimplemented, "compressed messages aren't supported"}
+	}
+	n := binary.BigEndian.Uint32(prefix[1:])
+	if uint64(n) > uint64(maxBytes) {
+		return nil, &grpcError{grpcResourceExhausted, fmt.Sprintf("%d byte message exceeds %d", n, maxBytes)}
+	}
+	msg := make([]byte, n)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return msg, nil
+}
+
+func writeGRPCMessage(w io.Writer, msg []byte) error {
+	prefix := [5]byte{}
+	binary.BigEndian.PutUint32(prefix[1:], uint32(len(msg)))
+	if _, err := w.Write(prefix[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(msg)
+	return err
+}
+
+// grpc-message is percent-encoded outside printable ASCII
+func grpcEncodeMessage(msg string) string {
+	var b strings.Builder
+	for i := 0; i < len(msg); i++ {
+		if c := msg[i]; c < 0x20 || c > 0x7e || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// Serve a gRPC call: read its request message, of at most maxBytes, and
+// call handle with it and a function that sends a response message.
+// handle's error, a *grpcError or not, becomes the call's status.
+func serveGRPC(w http.ResponseWriter, r *http.Request, maxBytes int, handle func(req []byte, send func(msg []byte) error) error) {
+	if r.Method != http.MethodPost || r.ProtoMajor != 2 || !isGRPCContentType(r.Header.Get("Content-Type")) {
+		sendError(w, http.StatusUnsupportedMediaType, "Not a gRPC call", "gRPC calls are HTTP/2 POSTs of application/grpc")
+		return
+	}
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+	w.WriteHeader(http.StatusOK)
+	rc := http.NewResponseController(w)
+	rc.Flush()
+
+	req, err := readGRPCMessage(r.Body, maxBytes)
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		err = &grpcError{grpcInvalidArgument, "missing request message"}
+	}
+	if err == nil {
+		err = handle(req, func(msg []byte) error {
+			if err := writeGRPCMessage(w, msg); err != nil {
+				return err
+			}
+			return rc.Flush()
+		})
+	}
+	w.Header().Set("Grpc-Status", strconv.Itoa(int(grpcErrorCode(err))))
+	if err != nil {
+		msg := err.Error()
+		var ge *grpcError
+		if errors.As(err, &ge) {
+			msg = ge.Message
+		}
+		w.Header().Set("Grpc-Message", grpcEncodeMessage(msg))
+	}
+}
+
+// A client for one server's gRPC methods
+type grpcClient struct {
+	url    string
+	header http.Header
+	client *http.Client
+}
+
+// A client for the server at baseURL, over h2c for http:// URLs, that
+// sends header with every call
+func newGRPCClient(baseURL string, header http.Header) *grpcClient {
+	protocols := new(http.Protocols)
+	protocols.SetHTTP2(true)
+	protocols.SetUnencryptedHTTP2(true)
+	return &grpcClient{
+		url:    strings.TrimSuffix(baseURL, "/"),
+		header: header,
+		client: &http.Client{Transport: &http.Transport{Protocols: protocols}},
+	}
+}
+
+// Call method ("/package.Service/Method") with req, handing each response
+// message, of at most maxBytes, to recv. Transport failures are
+// Unavailable.
+func (c *grpcClient) call(ctx context.Context, method string, req []byte, maxBytes int, recv func(msg []byte) error) error {
+	var body bytes.Buffer
+	writeGRPCMessage(&body, req)
+	hreq, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url+method, &body)
+	if err != nil {
+		return err
+	}
+	for name, values := range c.header {
+		hreq.Header[name] = values
+	}
+	hreq.Header.Set("Content-Type", "application/grpc")
+	hreq.Header.Set("TE", "trailers")
+	resp, err := c.client.Do(hreq)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return &grpcError{grpcUnavailable, err.Error()}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !isGRPCContentType(resp.Header.Get("Content-Type")) {
+		return &grpcError{grpcCodeForHTTP(resp.StatusCode), "unexpected HTTP response " + resp.Status}
+	}
+	for {
+		msg, err := readGRPCMessage(resp.Body, maxBytes)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if grpcErrorCode(err) == grpcInternal {
+				err = &grpcError{grpcUnavailable, err.Error()}
+			}
+			return err
+		}
+		if err := recv(msg); err != nil {
+			return err
+		}
+	}
+
+	// A call that fails before any message may send its status as headers
+	status := resp.Trailer.Get("Grpc-Status")
+	message := resp.Trailer.Get("Grpc-Message")
+	if status == "" {
+		status, message = resp.Header.Get("Grpc-Status"), resp.Header.Get("Grpc-Message")
+	}
+	code, err := strconv.Atoi(status)
+	if err != nil {
+		return &grpcError{grpcInternal, "missing grpc-status"}
+	}
+	if code != int(grpcOK) {
+		if decoded, err := url.PathUnescape(message); err == nil {
+			message = decoded
+		}
+		return &grpcError{grpcCode(code), message}
+	}
+	return nil
+}
+
+// Call a unary method, decoding its response into resp
+func (c *grpcClient) unary(ctx context.Context, method string, req protoMessage, resp protoMessage, maxBytes int) error {
+	got := false
+	err := c.call(ctx, method, req.marshalProto(), maxBytes, func(msg []byte) error {
+		got = true
+		return resp.unmarshalProto(msg)
+	})
+	if err == nil && !got {
+		err = &grpcError{grpcInternal, "no response message"}
+	}
+	return err
+}
+
+// The status a gRPC client gives a call answered with plain HTTP
+func grpcCodeForHTTP(status int) grpcCode {
+	switch status {
+	case http.StatusBadRequest:
+		return grpcInternal
+	case http.StatusUnauthorized:
+		return grpcUnauthenticated
+	case http.StatusNotFound:
+		return grpcUnimplemented
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return grpcUnavailable
+	}
+	return grpcUnknown
+}
+
+// A message in renderer.proto
+type protoMessage interface {
+	marshalProto() []byte
+	unmarshalProto(data []byte) error
+}
+
+// Decode a call's request message into m. A request that doesn't decode is
+// the caller's mistake, not the server's, so it's INVALID_ARGUMENT whatever
+// the decoder returned.
+func unmarshalRequest(m protoMessage, data []byte) error {
+	err := m.unmarshalProto(data)
+	if err == nil {
+		return nil
+	}
+	msg := err.Error()
+	var ge *grpcError
+	if errors.As(err, &ge) {
+		msg = ge.Message
+	}
+	return &grpcError{grpcInvalidArgument, msg}
+}
+
+// An empty message, for methods with nothing to say
+type protoEmpty struct{}
+
+func (protoEmpty) marshalProto() []byte { return nil }
+
+func (protoEmpty) unmarshalProto(data []byte) error {
+	return decodeProto(data, func(int, uint64, []byte) error { return nil })
+}
+
+// lego.renderer.v1.Error
+func (e *ErrorResponse) marshalProto() []byte {
+	var enc protoEncoder
+	enc.string(1, e.Error)
+	enc.string(2, e.Detail)
+	enc.string(3, e.Cause)
+	return enc.buf
+}
+
+func (e *ErrorResponse) unmarshalProto(data []byte) error {
+	return decodeProto(data, func(field int, v uint64, data []byte) error {
+		switch field {
+		case 1:
+			e.Error = string(data)
+		case 2:
+			e.Detail = string(data)
+		case 3:
+			e.Cause = string(data)
+		}
+		return nil
+	})
+}
+
+// Protocol buffer wire format encoding. Zero values are left out, as
+// proto3 does for scalar fields.
+type protoEncoder struct {
+	buf []byte
+}
+
+func (e *protoEncoder) tag(field, wireType int) {
+	e.buf = binary.AppendUvarint(e.buf, uint64(field)<<3|uint64(wireType))
+}
+
+// An int32, int64, or uint64 field
+func (e *protoEncoder) int(field int, v int64) {
+	if v != 0 {
+		e.tag(field, 0)
+		e.buf = binary.AppendUvarint(e.buf, uint64(v))
+	}
+}
+
+func (e *protoEncoder) bool(field int, v bool) {
+	if v {
+		e.int(field, 1)
+	}
+}
+
+func (e *protoEncoder) double(field int, v float64) {
+	if v != 0 {
+		e.tag(field, 1)
+		e.buf = binary.LittleEndian.AppendUint64(e.buf, math.Float64bits(v))
+	}
+}
+
+func (e *protoEncoder) bytes(field int, v []byte) {
+	if len(v) > 0 {
+		e.tag(field, 2)
+		e.buf = binary.AppendUvarint(e.buf, uint64(len(v)))
+		e.buf = append(e.buf, v...)
+	}
+}
+
+func (e *protoEncoder) string(field int, v string) {
+	e.bytes(field, []byte(v))
+}
+
+// An embedded message, sent even when empty so its presence shows
+func (e *protoEncoder) message(field int, m protoMessage) {
+	data := m.marshalProto()
+	e.tag(field, 2)
+	e.buf = binary.AppendUvarint(e.buf, uint64(len(data)))
+	e.buf = append(e.buf, data...)
+}
+
+// Call fn with each field of a message: v holds varint and fixed-width
+// values, data length-delimited ones. Fields fn doesn't know it ignores.
+func decodeProto(data []byte, fn func(field int, v uint64, data []byte) error) error {
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 || key>>3 == 0 || key>>3 > math.MaxInt32 {
+			return &grpcError{grpcInvalidArgument, "malformed message"}
+		}
+		data = data[n:]
+		field := int(key >> 3)
+		var v uint64
+		var value []byte
+		switch key & 7 {
+		case 0:
+			v, n = binary.Uvarint(data)
+			if n <= 0 {
+				return &grpcError{grpcInvalidArgument, "malformed varint"}
+			}
+			data = data[n:]
+		case 1:
+			if len(data) < 8 {
+				return &grpcError{grpcInvalidArgument, "malformed fixed64"}
+			}
+			v, data = binary.LittleEndian.Uint64(data), data[8:]
+		case 2:
+			size, n := binary.Uvarint(data)
+			if n <= 0 || size > uint64(len(data)-n) {
+				return &grpcError{grpcInvalidArgument, "malformed length"}
+			}
+			value, data = data[n:n+int(size)], data[n+int(size):]
+		case 5:
+			if len(data) < 4 {
+				return &grpcError{grpcInvalidArgument, "malformed fixed32"}
+			}
+			v, data = uint64(binary.LittleEndian.Uint32(data)), data[4:]
+		default:
+			return &grpcError{grpcInvalidArgument, fmt.Sprintf("unsupported wire type %d", key&7)}
+		}
+		if err := fn(field, v, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func protoDouble(v uint64) float64 {
+	return math.Float64frombits(v)
+}
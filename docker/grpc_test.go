@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// A test server that speaks h2c, as the real one does
+func newTestGRPCServer(t *testing.T, handler http.Handler) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewUnstartedServer(handler)
+	srv.Config.Protocols = serverProtocols()
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestProtoRoundTrip(t *testing.T) {
+	in := completeRequest{WorkerID: "w1", Result: jobUpdate{ID: "j1", Status: jobFailed, StatusCode: -1, RenderSeconds: 1.5,
+		Error: &ErrorResponse{Error: "Part not found", Detail: "9999"}}}
+	var out completeRequest
+	if err := out.unmarshalProto(in.marshalProto()); err != nil {
+		t.Fatal(err)
+	}
+	if out.WorkerID != "w1" || out.Result.ID != "j1" || out.Result.Status != jobFailed || out.Result.StatusCode != -1 || out.Result.RenderSeconds != 1.5 || out.Result.Error == nil || out.Result.Error.Error != "Part not found" || out.Result.Error.Detail != "9999" {
+		t.Errorf("round trip gave %+v", out)
+	}
+
+	done := completeRequest{Result: jobUpdate{ID: "j2", Status: jobDone, SVG: "<svg/>", Cached: true}}
+	out = completeRequest{}
+	out.unmarshalProto(done.marshalProto())
+	if out.Result.Status != jobDone || out.Result.SVG != "<svg/>" || !out.Result.Cached || out.Result.Error != nil {
+		t.Errorf("round trip gave %+v", out)
+	}
+
+	// An empty pull response is told apart from an empty task
+	var pull pullResponse
+	pull.unmarshalProto((&pullResponse{Task: &dispatchTask{}}).marshalProto())
+	if pull.Task == nil {
+		t.Error("expected the empty task to survive")
+	}
+}
+
+func TestDecodeProtoRejectsMalformed(t *testing.T) {
+	for _, data := range [][]byte{
+		{0x0a, 0x05, 'a'},        // length past the end
+		{0x0a, 0xff, 0xff, 0xff}, // truncated length
+		{0x09, 1, 2, 3},          // truncated fixed64
+		{0x0b},                   // group wire type
+		{0x00, 0x01},             // field 0
+		{0x0a, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x01}, // huge length
+	} {
+		if err := decodeProto(data, func(int, uint64, []byte) error { return nil }); grpcErrorCode(err) != grpcInvalidArgument {
+			t.Errorf("% x: expected INVALID_ARGUMENT, got %v", data, err)
+		}
+	}
+}
+
+// A message whose decoder fails with a plain error
+type brokenMessage struct{ protoEmpty }
+
+func (brokenMessage) unmarshalProto([]byte) error { return errors.New("bad options") }
+
+func TestUnmarshalRequest(t *testing.T) {
+	var ge *grpcError
+	if err := unmarshalRequest(brokenMessage{}, nil); !errors.As(err, &ge) || ge.Code != grpcInvalidArgument || ge.Message != "bad options" {
+		t.Errorf("expected INVALID_ARGUMENT, got %v", err)
+	}
+	if err := unmarshalRequest(&workerRequest{}, []byte{0x0b}); !errors.As(err, &ge) || ge.Code != grpcInvalidArgument || ge.Message != "unsupported wire type 3" {
+		t.Errorf("expected the decoder's message, got %v", err)
+	}
+	if err := unmarshalRequest(&workerRequest{}, (&workerRequest{"w1"}).marshalProto()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestReadGRPCMessage(t *testing.T) {
+	var buf bytes.Buffer
+	writeGRPCMessage(&buf, []byte("hello"))
+	if msg, err := readGRPCMessage(&buf, 5); err != nil || string(msg) != "hello" {
+		t.Errorf("got %q, %v", msg, err)
+	}
+	// The length is checked before anything is allocated for it
+	if _, err := readGRPCMessage(bytes.NewReader([]byte{0, 0xff, 0xff, 0xff, 0xff}), grpcMaxMessageBytes); grpcErrorCode(err) != grpcResourceExhausted {
+		t.Errorf("expected RESOURCE_EXHAUSTED, got %v", err)
+	}
+	if _, err := readGRPCMessage(bytes.NewReader([]byte{1, 0, 0, 0, 0}), grpcMaxMessageBytes); grpcErrorCode(err) != grpcUnimplemented {
+		t.Errorf("expected compressed messages to be UNIMPLEMENTED, got %v", err)
+	}
+}
+
+func TestServeGRPC(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/test.Echo/{method}", func(w http.ResponseWriter, r *http.Request) {
+		serveGRPC(w, r, 16, func(req []byte, send func([]byte) error) error {
+			if r.PathValue("method") == "Fail" {
+				return &grpcError{grpcNotFound, "no such part: 100% gone"}
+			}
+			send(req)
+			return send(bytes.ToUpper(req))
+		})
+	})
+	srv := newTestGRPCServer(t, mux)
+	client := newGRPCClient(srv.URL, nil)
+
+	var got []string
+	err := client.call(context.Background(), "/test.Echo/Twice", []byte("brick"), 16, func(msg []byte) error {
+		got = append(got, string(msg))
+		return nil
+	})
+	if err != nil || strings.Join(got, ",") != "brick,BRICK" {
+		t.Errorf("got %v, %v", got, err)
+	}
+	var ge *grpcError
+	err = client.call(context.Background(), "/test.Echo/Fail", nil, 16, func([]byte) error { return nil })
+	if !errors.As(err, &ge) || ge.Code != grpcNotFound || ge.Message != "no such part: 100% gone" {
+		t.Errorf("expected the handler's status, got %v", err)
+	}
+	err = client.call(context.Background(), "/test.Echo/Twice", bytes.Repeat([]byte("x"), 17), 16, func([]byte) error { return nil })
+	if grpcErrorCode(err) != grpcResourceExhausted {
+		t.Errorf("expected an oversized request to be refused, got %v", err)
+	}
+
+	// Plain HTTP/1.1 isn't gRPC
+	resp, err := http.Post(srv.URL+"/test.Echo/Twice", "application/grpc", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnsupportedMediaType {
+		t.Errorf("HTTP/1.1: expected 415, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"math"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Hatching shades a render like an engraving. Given a shading_file,
+// render_part.py writes the outline of every face turned toward the camera
+// and how squarely it faces the light (see the contract's shading section);
+// the faces are drawn back to front between the Edges fills and strokes,
+// each in its fill color with a hatch pattern for its shade. Lit faces are
+// left plain, then come hatching, cross-hatching, and dense cross-hatching
+// in the strokes' color. Ambient occlusion baked into fills uses the same
+// faces; see occlusion.go.
+var hatchBands = []float64{0.75, 0.5, 0.25}
+
+var svgStrokesGroupPattern = regexp.MustCompile(`<g\b[^>]*\bid="strokes"[^>]*>`)
+
+// The face shading render_part.py exports
+type faceShading struct {
+	Width  int          `json:"width"`
+	Height int          `json:"height"`
+	Faces  []shadedFace `json:"faces"`
+}
+
+type shadedFace struct {
+	// Outline as x, y pairs in SVG pixels
+	Points []float64 `json:"points"`
+	// 0 faces away from the light, 1 straight at it
+	Shade float64 `json:"shade"`
+	// Set for per-part LDraw fills
+	Fill string `json:"fill,omitempty"`
+}
+
+func readFaceShading(path string) (*faceShading, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var shading faceShading
+	if err := json.Unmarshal(data, &shading); err != nil {
+		return nil, err
+	}
+	return &shading, nil
+}
+
+// The hatch pattern for a shade, 0 for none
+func hatchLevel(shade float64) int {
+	for i, band := range hatchBands {
+		if shade >= band {
+			return i
+		}
+	}
+	return len(hatchBands)
+}
+
+// Draw shaded faces into a rendered SVG: hatched, occluded, or both.
+// Renders without shading are returned unchanged.
+func applyFaceShading(svg []byte, shading *faceShading, occlusion image.Image, opts RenderOptions) []byte {
+	if shading == nil {
+		return svg
+	}
+	root := svgRootPattern.FindIndex(svg)
+	edges := bytes.Index(svg, []byte(`id="ViewLayer_Edges"`))
+	if root == nil || edges < 0 {
+		return svg
+	}
+	strokes := svgStrokesGroupPattern.FindIndex(svg[edges:])
+	if strokes == nil {
+		return svg
+	}
+	at := edges + strokes[0]
+
+	// The ids include the stroke color, like finishes, so several renders
+	// can share a sheet
+	id := "hatch-" + colorID(opts.StrokeColor)
+	defs := ""
+	if opts.Hatching {
+		defs = hatchDefs(id, opts.StrokeColor, opts.Thickness)
+	}
+	if opts.AmbientOcclusion != "fills" {
+		occlusion = nil
+	}
+
+	var b, gradients strings.Builder
+	seen := make(map[string]bool)
+	b.WriteString(`<g id="faces">`)
+	for _, face := range shading.Faces {
+		d := facePath(face.Points)
+		if d == "" {
+			continue
+		}
+		fill := opts.FillColor
+		if face.Fill != "" && opts.FillMode == "ldraw" {
+			fill = face.Fill
+		}
+		opacity := ""
+		if opts.FillOpacity < 1 {
+			opacity = fmt.Sprintf(` fill-opacity="%g"`, opts.FillOpacity)
+		}
+		fmt.Fprintf(&b, `<path d="%s" fill="%s"%s stroke="none" />`, d, escapeXML(fill), opacity)
+		if occlusion != nil {
+			overlay, gradientID, gradient := occlusionOverlay(occlusion, face.Points, d)
+			if gradientID != "" && !seen[gradientID] {
+				seen[gradientID] = true
+				gradients.WriteString(gradient)
+			}
+			b.WriteString(overlay)
+		}
+		if level := hatchLevel(face.Shade); opts.Hatching && level > 0 {
+			fmt.Fprintf(&b, `<path d="%s" fill="url(#%s-%d)" stroke="none" />`, d, id, level)
+		}
+	}
+	b.WriteString("</g>\n")
+	if gradients.Len() > 0 {
+		defs += "<defs>" + gradients.String() + "</defs>"
+	}
+
+	out := make([]byte, 0, len(svg)+len(defs)+b.Len()+1)
+	out = append(out, svg[:root[1]]...)
+	out = append(out, '\n')
+	out = append(out, defs...)
+	out = append(out, svg[root[1]:at]...)
+	out = append(out, b.String()...)
+	return append(out, svg[at:]...)
+}
+
+// A closed path through a face's outline, or "" if it isn't a polygon
+func facePath(points []float64) string {
+	if len(points) < 6 || len(points)%2 != 0 {
+		return ""
+	}
+	var b strings.Builder
+	for i := 0; i < len(points); i += 2 {
+		x, y := points[i], points[i+1]
+		if math.IsNaN(x) || math.IsInf(x, 0) || math.IsNaN(y) || math.IsInf(y, 0) {
+			return ""
+		}
+		switch i {
+		case 0:
+			b.WriteString("M ")
+		case 2:
+			b.WriteString(" L ")
+		default:
+			b.WriteByte(' ')
+		}
+		fmt.Fprintf(&b, "%g %g", x, y)
+	}
+	b.WriteString(" Z")
+	return b.String()
+}
+
+// One pattern per hatch level: diagonal lines, then crossed, then crossed
+// closer together. The spacing and weight follow the line thickness.
+func hatchDefs(id, stroke string, thickness float64) string {
+	spacing := math.Max(4, 3*thickness)
+	width := math.Max(0.5, thickness/2)
+	var b strings.Builder
+	b.WriteString("<defs>")
+	for level := 1; level <= len(hatchBands); level++ {
+		s := spacing
+		if level == len(hatchBands) {
+			s *= 0.6
+		}
+		h := s / 2
+		d := fmt.Sprintf("M %g 0 L %g %g", h, h, s)
+		if level > 1 {
+			d += fmt.Sprintf(" M 0 %g L %g %g", h, s, h)
+		}
+		fmt.Fprintf(&b, `<pattern id="%s-%d" width="%g" height="%g" patternUnits="userSpaceOnUse" patternTransform="rotate(45)">`+
+			`<path d="%s" fill="none" stroke="%s" stroke-width="%g" /></pattern>`,
+			id, level, s, s, d, escapeXML(stroke), width)
+	}
+	b.WriteString("</defs>")
+	return b.String()
+}
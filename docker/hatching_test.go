@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestHatchLevel(t *testing.T) {
+	for shade, want := range map[float64]int{1: 0, 0.75: 0, 0.6: 1, 0.3: 2, 0.1: 3, 0: 3} {
+		if got := hatchLevel(shade); got != want {
+			t.Errorf("shade %g: got level %d, want %d", shade, got, want)
+		}
+	}
+}
+
+func TestHatchedRender(t *testing.T) {
+	withFakeBlender(t)
+	input := filepath.Join(t.TempDir(), "3001.dat")
+	os.WriteFile(input, []byte("0 Brick 2 x 4\n"), 0o644)
+
+	hatching := true
+	req := RenderRequest{Hatching: &hatching, StrokeColor: "black"}
+	opts, err := req.options()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _, err := renderFile(context.Background(), "contract", input, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	svg := string(data)
+	if err := checkSVG(data); err != nil {
+		t.Error(err)
+	}
+
+	// The faces go over the fills and under the strokes, back to front,
+	// and only the dark one is hatched
+	fills, hatched, strokes := strings.Index(svg, `id="fills"`), strings.Index(svg, `<g id="faces">`), strings.Index(svg, `id="strokes"`)
+	if fills < 0 || hatched < fills || strokes < hatched {
+		t.Fatalf("expected hatching between the fills and strokes:\n%s", svg)
+	}
+	dark := strings.Index(svg, `<path d="M 0 0 L 10 0 10 10 Z" fill="white" stroke="none" /><path d="M 0 0 L 10 0 10 10 Z" fill="url(#hatch-black-3)"`)
+	lit := strings.Index(svg, `<path d="M 0 0 L 10 10 0 10 Z" fill="white" stroke="none" /></g>`)
+	if dark < 0 || lit < dark {
+		t.Errorf("expected the dark face cross-hatched under the lit one:\n%s", svg)
+	}
+	if strings.Count(svg, `<pattern id="hatch-black-`) != 3 {
+		t.Errorf("expected three hatch patterns:\n%s", svg)
+	}
+
+	// Without hatching the script isn't asked for shading
+	opts.Hatching = false
+	if data, _, _ := renderFile(context.Background(), "contract", input, opts); strings.Contains(string(data), "hatch") {
+		t.Errorf("unexpected hatching:\n%s", data)
+	}
+}
+
+func TestFacePath(t *testing.T) {
+	if d := facePath([]float64{1.5, 2, 3, 4, 5, 6, 7, 8}); d != "M 1.5 2 L 3 4 5 6 7 8 Z" {
+		t.Errorf("got %q", d)
+	}
+	for _, points := range [][]float64{nil, {1, 2, 3, 4}, {1, 2, 3, 4, 5}} {
+		if d := facePath(points); d != "" {
+			t.Errorf("%v: expected no path, got %q", points, d)
+		}
+	}
+}
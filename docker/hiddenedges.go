@@ -0,0 +1,54 @@
+package main
+
+// showHiddenEdges draws the edges behind faces for opaque parts too, which
+// otherwise only translucent fills show: interior tubes, ribs, and
+// anti-stud geometry for QA comparing mold revisions. render_part.py draws
+// them in the ViewLayer_HiddenEdges line set, over the visible edges, dimmed
+// and dashed like hidden lines in a technical drawing. hiddenEdgeStyle sets
+// the opacity and dashes.
+type HiddenEdgeStyle struct {
+	// Opacity is above 0 and at most 1
+	Opacity *float64 `json:"opacity"`
+	// Dash is dash and gap lengths in pixels: one to three pairs, or empty
+	// for solid lines
+	Dash []int `json:"dash"`
+}
+
+// Hidden edges are drawn this way unless the request says otherwise
+const (
+	defaultHiddenEdgeOpacity = 0.35
+	defaultHiddenEdgeDash    = "4,3"
+)
+
+// Set opts' hidden edges from a request's showHiddenEdges and style
+func applyHiddenEdges(opts *RenderOptions, show *bool, style *HiddenEdgeStyle) error {
+	var errs fieldErrors
+	if show == nil || !*show {
+		if style != nil {
+			errs.add("hiddenEdgeStyle", "hiddenEdgeStyle needs showHiddenEdges")
+		}
+		return errs.err()
+	}
+	opts.HiddenEdgeOpacity, opts.HiddenEdgeDash = defaultHiddenEdgeOpacity, defaultHiddenEdgeDash
+	if style == nil {
+		return nil
+	}
+	if style.Opacity != nil {
+		opts.HiddenEdgeOpacity = *style.Opacity
+		if !(opts.HiddenEdgeOpacity > 0 && opts.HiddenEdgeOpacity <= 1) {
+			errs.add("hiddenEdgeStyle.opacity", "opacity must be above 0 and at most 1")
+		}
+	}
+	switch {
+	case style.Dash == nil:
+	case len(style.Dash) == 0:
+		opts.HiddenEdgeDash = ""
+	default:
+		pattern, err := dashPattern(style.Dash)
+		if err != nil {
+			errs.add("hiddenEdgeStyle.dash", "%v", err)
+		}
+		opts.HiddenEdgeDash = pattern
+	}
+	return errs.err()
+}
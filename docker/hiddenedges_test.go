@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestApplyHiddenEdges(t *testing.T) {
+	yes, no := true, false
+	f := func(v float64) *float64 { return &v }
+	for _, tt := range []struct {
+		name    string
+		show    *bool
+		style   *HiddenEdgeStyle
+		opacity float64
+		dash    string
+		ok      bool
+	}{
+		{"off", nil, nil, 0, "", true},
+		{"defaults", &yes, nil, defaultHiddenEdgeOpacity, defaultHiddenEdgeDash, true},
+		{"styled", &yes, &HiddenEdgeStyle{Opacity: f(0.5), Dash: []int{2, 2}}, 0.5, "2,2", true},
+		{"solid", &yes, &HiddenEdgeStyle{Dash: []int{}}, defaultHiddenEdgeOpacity, "", true},
+		{"style without show", &no, &HiddenEdgeStyle{Opacity: f(0.5)}, 0, "", false},
+		{"zero opacity", &yes, &HiddenEdgeStyle{Opacity: f(0)}, 0, defaultHiddenEdgeDash, false},
+		{"odd dash", &yes, &HiddenEdgeStyle{Dash: []int{4}}, defaultHiddenEdgeOpacity, "", false},
+	} {
+		var opts RenderOptions
+		err := applyHiddenEdges(&opts, tt.show, tt.style)
+		if (err == nil) != tt.ok || opts.HiddenEdgeOpacity != tt.opacity || opts.HiddenEdgeDash != tt.dash {
+			t.Errorf("%s: got %g %q, %v", tt.name, opts.HiddenEdgeOpacity, opts.HiddenEdgeDash, err)
+		}
+	}
+}
+
+func TestHiddenEdgesRender(t *testing.T) {
+	withFakeBlender(t)
+	input := filepath.Join(t.TempDir(), "3001.dat")
+	os.WriteFile(input, []byte("0 Brick 2 x 4\n"), 0o644)
+
+	show := true
+	req := RenderRequest{ShowHiddenEdges: &show}
+	opts, err := req.options()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _, err := renderFile(context.Background(), "contract", input, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Opaque parts draw them over the visible edges
+	svg := string(data)
+	edges, hidden := strings.Index(svg, `id="ViewLayer_Edges"`), strings.Index(svg, `id="ViewLayer_HiddenEdges"`)
+	if edges < 0 || hidden < edges {
+		t.Errorf("expected hidden edges after the visible ones:\n%s", svg)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Durations are kept as histograms so /metrics shows the tail, not just the
+// mean: Blender renders, time prewarm jobs wait in the queue, and SVG
+// post-processing (canonicalizing, curve fitting, finishes, color schemes).
+// Bucket upper bounds are in seconds and can be overridden with a
+// comma-separated list in RENDER_DURATION_BUCKETS, QUEUE_WAIT_BUCKETS, and
+// POSTPROCESS_BUCKETS.
+var (
+	renderDurationBuckets = getEnvBuckets("RENDER_DURATION_BUCKETS", []float64{1, 2, 5, 10, 15, 20, 30, 45, 60, 90, 120})
+	queueWaitBuckets      = getEnvBuckets("QUEUE_WAIT_BUCKETS", []float64{0.1, 0.5, 1, 5, 10, 30, 60, 300, 900, 3600})
+	postprocessBuckets    = getEnvBuckets("POSTPROCESS_BUCKETS", []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5})
+)
+
+// A fixed-bucket histogram. It isn't safe for concurrent use; the ones in
+// Metrics are guarded by its lock.
+type histogram struct {
+	bounds []float64
+	// counts[i] is observations <= bounds[i] and > bounds[i-1]; the last
+	// one is everything above the top bound
+	counts []int64
+	sum    float64
+	count  int64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]int64, len(bounds)+1)}
+}
+
+func (h *histogram) observe(seconds float64) {
+	h.counts[sort.SearchFloat64s(h.bounds, seconds)]++
+	h.sum += seconds
+	h.count++
+}
+
+func (h *histogram) mean() float64 {
+	if h.count == 0 {
+		return 0
+	}
+	return h.sum / float64(h.count)
+}
+
+type HistogramBucket struct {
+	// Le is the bucket's upper bound in seconds; the last bucket is unbounded
+	Le    *float64 `json:"le"`
+	Count int64    `json:"count"`
+}
+
+type HistogramMetrics struct {
+	// Buckets are cumulative, like Prometheus's
+	Buckets []HistogramBucket `json:"buckets"`
+	Sum     float64           `json:"sum"`
+	Count   int64             `json:"count"`
+}
+
+func (h *histogram) snapshot() HistogramMetrics {
+	m := HistogramMetrics{Sum: h.sum, Count: h.count}
+	var cumulative int64
+	for i, c := range h.counts {
+		cumulative += c
+		b := HistogramBucket{Count: cumulative}
+		if i < len(h.bounds) {
+			b.Le = &h.bounds[i]
+		}
+		m.Buckets = append(m.Buckets, b)
+	}
+	return m
+}
+
+// Write a histogram in the Prometheus text exposition format
+func (h *histogram) writePrometheus(w io.Writer, name, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s histogram\n", name)
+	var cumulative int64
+	for i, c := range h.counts {
+		cumulative += c
+		le := "+Inf"
+		if i < len(h.bounds) {
+			le = strconv.FormatFloat(h.bounds[i], 'g', -1, 64)
+		}
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", name, le, cumulative)
+	}
+	fmt.Fprintf(w, "%s_sum %g\n", name, h.sum)
+	fmt.Fprintf(w, "%s_count %d\n", name, h.count)
+}
+
+// Parse bucket bounds: positive, strictly increasing seconds
+func parseBuckets(s string) ([]float64, error) {
+	var bounds []float64
+	for _, part := range strings.Split(s, ",") {
+		v, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return nil, err
+		}
+		if v <= 0 || (len(bounds) > 0 && v <= bounds[len(bounds)-1]) {
+			return nil, fmt.Errorf("bounds must be positive and increasing")
+		}
+		bounds = append(bounds, v)
+	}
+	return bounds, nil
+}
+
+func getEnvBuckets(key string, defaultValue []float64) []float64 {
+	if value := os.Getenv(key); value != "" {
+		if bounds, err := parseBuckets(value); err == nil {
+			return bounds
+		}
+		log.Printf("Ignoring invalid %s=%q", key, value)
+	}
+	return defaultValue
+}
+
+// Record how long a prewarm job waited between being queued and starting
+func recordQueueWait(d time.Duration) {
+	metrics.Lock()
+	metrics.QueueWait.observe(d.Seconds())
+	metrics.Unlock()
+
+	for _, s := range metricsSinks {
+		s.Timing("queue_wait", d)
+	}
+}
+
+// Record the time spent post-processing a rendered SVG
+func recordPostprocess(d time.Duration) {
+	metrics.Lock()
+	metrics.Postprocess.observe(d.Seconds())
+	metrics.Unlock()
+
+	for _, s := range metricsSinks {
+		s.Timing("postprocess_duration", d)
+	}
+}
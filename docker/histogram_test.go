@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHistogram(t *testing.T) {
+	h := newHistogram([]float64{1, 5, 10})
+	for _, v := range []float64{0.5, 1, 3, 12, 60} {
+		h.observe(v)
+	}
+	m := h.snapshot()
+	want := []int64{2, 3, 3, 5}
+	if len(m.Buckets) != len(want) {
+		t.Fatalf("expected %d buckets, got %d", len(want), len(m.Buckets))
+	}
+	for i, b := range m.Buckets {
+		if b.Count != want[i] {
+			t.Errorf("bucket %d: expected cumulative count %d, got %d", i, want[i], b.Count)
+		}
+	}
+	if m.Buckets[3].Le != nil || *m.Buckets[0].Le != 1 {
+		t.Errorf("unexpected bounds %+v", m.Buckets)
+	}
+	if m.Count != 5 || m.Sum != 76.5 || h.mean() != 15.3 {
+		t.Errorf("count %d, sum %g, mean %g", m.Count, m.Sum, h.mean())
+	}
+
+	var b strings.Builder
+	h.writePrometheus(&b, "test_seconds", "Test.")
+	for _, line := range []string{
+		"# TYPE test_seconds histogram",
+		`test_seconds_bucket{le="1"} 2`,
+		`test_seconds_bucket{le="10"} 3`,
+		`test_seconds_bucket{le="+Inf"} 5`,
+		"test_seconds_sum 76.5",
+		"test_seconds_count 5",
+	} {
+		if !strings.Contains(b.String(), line+"\n") {
+			t.Errorf("missing %q in:\n%s", line, b.String())
+		}
+	}
+}
+
+func TestParseBuckets(t *testing.T) {
+	bounds, err := parseBuckets("0.5, 1,30")
+	if err != nil || len(bounds) != 3 || bounds[0] != 0.5 || bounds[2] != 30 {
+		t.Errorf("got %v, %v", bounds, err)
+	}
+	for _, bad := range []string{"", "1,x", "5,1", "1,1", "0,1", "-1"} {
+		if _, err := parseBuckets(bad); err == nil {
+			t.Errorf("%q: expected an error", bad)
+		}
+	}
+}
+
+func TestMetricsHistograms(t *testing.T) {
+	w := httptest.NewRecorder()
+	handleMetrics(w, httptest.NewRequest(http.MethodGet, "/metrics?format=prometheus", nil))
+	for _, name := range []string{"render_duration_seconds", "queue_wait_seconds", "postprocess_seconds"} {
+		if !strings.Contains(w.Body.String(), "# TYPE lego_renderer_"+name+" histogram\n") {
+			t.Errorf("Prometheus output is missing the %s histogram", name)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	handleMetrics(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	var resp MetricsResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(resp.RenderDuration.Buckets); n != len(renderDurationBuckets)+1 {
+		t.Errorf("expected %d render duration buckets, got %d", len(renderDurationBuckets)+1, n)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// Connections are bounded so slow or idle clients can't tie up the server:
+// request headers must arrive within READ_HEADER_TIMEOUT and the whole
+// request within READ_TIMEOUT, responses get WRITE_TIMEOUT, and keep-alive
+// connections close after IDLE_TIMEOUT. Rendering routes can legitimately
+// take minutes (a contact sheet is a render per part), so they get
+// RENDER_WRITE_TIMEOUT instead. HTTPS connections negotiate HTTP/2, and
+// plain ones may use it with prior knowledge, for gRPC (see grpc.go).
+var (
+	readHeaderTimeout  = getEnvDuration("READ_HEADER_TIMEOUT", 10*time.Second)
+	readTimeout        = getEnvDuration("READ_TIMEOUT", time.Minute)
+	writeTimeout       = getEnvDuration("WRITE_TIMEOUT", 30*time.Second)
+	renderWriteTimeout = getEnvDuration("RENDER_WRITE_TIMEOUT", 15*time.Minute)
+	idleTimeout        = getEnvDuration("IDLE_TIMEOUT", 2*time.Minute)
+	maxHeaderBytes     = getEnvInt("MAX_HEADER_BYTES", 64<<10)
+)
+
+func newServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: readHeaderTimeout,
+		ReadTimeout:       readTimeout,
+		WriteTimeout:      writeTimeout,
+		IdleTimeout:       idleTimeout,
+		MaxHeaderBytes:    maxHeaderBytes,
+		Protocols:         serverProtocols(),
+	}
+}
+
+// HTTP/1.1, and HTTP/2 with TLS or in the clear, which gRPC needs
+func serverProtocols() *http.Protocols {
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(true)
+	protocols.SetHTTP2(true)
+	protocols.SetUnencryptedHTTP2(true)
+	return protocols
+}
+
+// Every route. Handlers check their own methods.
+func routes() *http.ServeMux {
+	mux := http.NewServeMux()
+	handle := func(pattern string, handler http.HandlerFunc) {
+		mux.HandleFunc(pattern, handler)
+	}
+	render := func(pattern string, handler http.HandlerFunc) {
+		mux.HandleFunc(pattern, withWriteTimeout(renderWriteTimeout, withAudit(withLatency(withProvenance(handler)))))
+	}
+
+	handle("/", handleRoot)
+	render("/render", requireAPIKey(handleRender))
+	render("/render/batch", requireAPIKey(handleRenderBatch))
+	render("/lego.renderer.v1.Renderer/RenderBatch", requireAPIKey(handleRenderBatchRPC))
+	render("/render/sheet", requireAPIKey(handleContactSheet))
+	render("/render/colorways", requireAPIKey(handleColorways))
+	render("/render/wantedlist", requireAPIKey(handleWantedList))
+	render("/render/model", requireAPIKey(handleRenderModel))
+	render("/render/model/bom", requireAPIKey(handleModelBOM))
+	render("/render/model/steps", requireAPIKey(handleRenderSteps))
+	render("/render/scene", requireAPIKey(handleRenderScene))
+	render("/render/compare", requireAPIKey(handleRenderCompare))
+	handle("/render/prepare", requireAPIKey(handleRenderPrepare))
+	handle("/render/validate", requireAPIKey(handleRenderValidate))
+	render("/r/{part}/{file}", requireAPIKey(handlePreparedRender))
+	render("/s/{file}", handleSignedRender)
+	render("/sets/{setNumber}/render", requireAPIKey(handleSetRender))
+	render("/atlas", requireAPIKey(handleAtlas))
+	render("/og/{file}", handleOGImage)
+	handle("/jobs", requireAPIKey(handleSubmitJob))
+	handle("/jobs/{id}", requireAPIKey(handleJob))
+	handle("/jobs/{id}/result", requireAPIKey(handleJobResult))
+	handle("/dispatch/workers", handleDispatchWorkers)
+	// gRPC; Pull is a long poll, so not timed as a rendering request
+	mux.HandleFunc("/lego.renderer.v1.Dispatcher/{method}", withWriteTimeout(renderWriteTimeout, handleDispatchRPC))
+	handle("/account/usage", handleAccountUsage)
+	handle("/account/parts", requireAPIKey(handlePrivateParts))
+	handle("/account/parts/{name...}", requireAPIKey(handlePrivatePart))
+	handle("/parts/{number}/estimate", requireAPIKey(handlePartEstimate))
+	handle("/parts/{number}/stats", requireAPIKey(handlePartStats))
+	handle("/parts/{number}/dimensions", requireAPIKey(handlePartDimensions))
+	handle("/profiles", handleProfiles)
+	handle("/line-style-plugins", handleLineStylePlugins)
+	handle("/libraries", handleLibraries)
+	handle("/health", handleHealth)
+	handle("/readyz", handleReadyz)
+	handle("/version", handleVersion)
+	handle("/metrics", handleMetrics)
+	handle("/admin", requireAdmin(handleDashboard))
+	render("/admin/selftest", requireAdmin(handleSelfTest))
+	handle("/admin/prewarm", requireAdmin(handlePrewarm))
+	handle("/admin/sign", requireAdmin(handleSign))
+	handle("/admin/usage", requireAdmin(handleUsage))
+	handle("/admin/audit", requireAdmin(handleAudit))
+	render("/admin/replay/{auditId}", requireAdmin(handleReplay))
+	handle("/admin/drain", requireAdmin(handleDrain))
+	handle("/admin/library/update", requireAdmin(handleLibraryUpdate))
+	handle("/admin/webhooks/deliveries", requireAdmin(handleWebhookDeliveries))
+	handle("/admin/deadletter", requireAdmin(handleDeadLetters))
+	handle("/admin/deadletter/requeue", requireAdmin(handleRequeueDeadLetters))
+	handle("/admin/deadletter/{id}/requeue", requireAdmin(handleRequeueDeadLetters))
+	return mux
+}
+
+// Give a handler longer than the server's write timeout to respond
+func withWriteTimeout(timeout time.Duration, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Unsupported only for writers that have no deadline to extend
+		http.NewResponseController(w).SetWriteDeadline(time.Now().Add(timeout))
+		handler(w, r)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Serve handler with newServer's settings
+func startTestServer(t *testing.T, handler http.Handler) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewUnstartedServer(handler)
+	srv.Config = newServer("", handler)
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestServerDropsSlowHeaders(t *testing.T) {
+	old := readHeaderTimeout
+	readHeaderTimeout = 50 * time.Millisecond
+	t.Cleanup(func() { readHeaderTimeout = old })
+	srv := startTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// Send the start of a request and never finish the headers
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: x\r\n")
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	start := time.Now()
+	if _, err := io.ReadAll(conn); err != nil {
+		t.Fatalf("expected the server to close the connection, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("connection held for %v", elapsed)
+	}
+}
+
+func TestRenderRoutesOutlastWriteTimeout(t *testing.T) {
+	old := writeTimeout
+	writeTimeout = 50 * time.Millisecond
+	t.Cleanup(func() { writeTimeout = old })
+
+	slow := func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(150 * time.Millisecond)
+		io.WriteString(w, "done")
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/quick", slow)
+	mux.HandleFunc("/render", withWriteTimeout(time.Second, slow))
+	srv := startTestServer(t, mux)
+
+	resp, err := http.Get(srv.URL + "/render")
+	if err != nil {
+		t.Fatalf("render route: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "done" {
+		t.Errorf("render route body %q", body)
+	}
+
+	if resp, err := http.Get(srv.URL + "/quick"); err == nil {
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err == nil && string(body) == "done" {
+			t.Error("expected the write timeout to cut off a slow response on other routes")
+		}
+	}
+}
+
+func TestNewServerSettings(t *testing.T) {
+	srv := newServer(":0", nil)
+	if srv.MaxHeaderBytes != maxHeaderBytes || srv.IdleTimeout != idleTimeout || srv.ReadTimeout != readTimeout {
+		t.Errorf("server not configured from the environment: %+v", srv)
+	}
+}
+
+func TestRoutes(t *testing.T) {
+	mux := routes()
+	for path, want := range map[string]string{
+		"/render":                "/render",
+		"/render/model/steps":    "/render/model/steps",
+		"/render/validate":       "/render/validate",
+		"/parts/3001/estimate":   "/parts/{number}/estimate",
+		"/parts/3001/stats":      "/parts/{number}/stats",
+		"/parts/3001/dimensions": "/parts/{number}/dimensions",
+		"/r/3001/abc.svg":        "/r/{part}/{file}",
+		"/sets/75192-1/render":   "/sets/{setNumber}/render",
+		"/admin/usage":           "/admin/usage",
+		"/admin/library/update":  "/admin/library/update",
+		"/libraries":             "/libraries",
+		"/account/parts/s/x01":   "/account/parts/{name...}",
+		"/health":                "/health",
+		"/version":               "/version",
+		"/no/such/endpoint/here": "/",
+	} {
+		_, pattern := mux.Handler(httptest.NewRequest(http.MethodGet, path, nil))
+		if pattern != want {
+			t.Errorf("%s routed to %q, want %q", path, pattern, want)
+		}
+	}
+}
@@ -0,0 +1,930 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// Renders can be handed to a fleet of workers through a message broker
+// instead of running on the node that took the request. QUEUE_MODE=api
+// accepts jobs at POST /jobs and tracks their status and results,
+// QUEUE_MODE=worker renders jobs from the queue, and "both" does both. Only
+// NATS is supported (QUEUE_URL=nats://host:4222); RabbitMQ would need an
+// AMQP client, which this project doesn't carry. Core NATS doesn't persist
+// messages, so a job that isn't finished within QUEUE_JOB_TIMEOUT (say,
+// because no worker was listening) fails.
+//
+// Finished jobs are kept for QUEUE_RESULT_TTL (QUEUE_FAILED_TTL for failed
+// and cancelled ones), and a done job's SVG for QUEUE_OUTPUT_TTL, which can
+// be shorter. A sweeper forgets them every QUEUE_SWEEP_INTERVAL.
+//
+// Jobs can ask for failed renders to be retried (maxRetries), waiting
+// retryBackoffSeconds before the first retry and twice as long before each
+// one after, up to the server's QUEUE_MAX_RETRIES and QUEUE_MAX_RETRY_BACKOFF.
+var (
+	queueMode            = getEnv("QUEUE_MODE", "")
+	queueURL             = getEnv("QUEUE_URL", "")
+	queueSubject         = getEnv("QUEUE_SUBJECT", "lego_renderer")
+	queueJobTimeout      = getEnvDuration("QUEUE_JOB_TIMEOUT", 15*time.Minute)
+	queueResultTTL       = getEnvDuration("QUEUE_RESULT_TTL", time.Hour)
+	queueFailedTTL       = getEnvDuration("QUEUE_FAILED_TTL", queueResultTTL)
+	queueOutputTTL       = getEnvDuration("QUEUE_OUTPUT_TTL", queueResultTTL)
+	queueSweepInterval   = getEnvDuration("QUEUE_SWEEP_INTERVAL", time.Minute)
+	queueRetryBackoff    = getEnvDuration("QUEUE_RETRY_BACKOFF", 30*time.Second)
+	queueMaxRetries      = getEnvInt("QUEUE_MAX_RETRIES", 5)
+	queueMaxRetryBackoff = getEnvDuration("QUEUE_MAX_RETRY_BACKOFF", 10*time.Minute)
+	workerConcurrency    = getEnvInt("WORKER_CONCURRENCY", 1)
+)
+
+// What the job queue needs from a message broker
+type jobBroker interface {
+	publish(subject string, data []byte) error
+	subscribe(subject, queue string, handler func(subject string, data []byte)) (int, error)
+	unsubscribe(sid int) error
+}
+
+// The broker API nodes publish jobs to; nil unless QUEUE_MODE includes api
+var jobQueue jobBroker
+
+// This node's worker; nil unless QUEUE_MODE includes worker
+var jobWorkerNode *jobWorker
+
+// Workers share jobs as one NATS queue group
+const jobQueueGroup = "workers"
+
+const (
+	jobQueued    = "queued"
+	jobRunning   = "running"
+	jobDone      = "done"
+	jobFailed    = "failed"
+	jobCancelled = "cancelled"
+)
+
+// Sent to every worker when a job is cancelled
+type jobCancel struct {
+	ID string `json:"id"`
+}
+
+// A job submission: a render request, optionally where to report the
+// result (see webhooks.go), and how to retry failed renders
+type JobRequest struct {
+	RenderRequest
+	CallbackURL         string   `json:"callbackUrl"`
+	MaxRetries          int      `json:"maxRetries"`
+	RetryBackoffSeconds *float64 `json:"retryBackoffSeconds"`
+}
+
+// A job as published to workers. Attempt counts from 1 and comes back on
+// the worker's updates, so a late update from an earlier attempt is ignored.
+type jobMessage struct {
+	ID      string        `json:"id"`
+	Attempt int           `json:"attempt,omitempty"`
+	Request RenderRequest `json:"request"`
+}
+
+// A worker's report on a job
+type jobUpdate struct {
+	ID            string  `json:"id"`
+	Attempt       int     `json:"attempt,omitempty"`
+	Status        string  `json:"status"`
+	Worker        string  `json:"worker"`
+	SVG           string  `json:"svg,omitempty"`
+	RenderSeconds float64 `json:"renderSeconds,omitempty"`
+	Cached        bool    `json:"cached,omitempty"`
+	// Phase and Progress report a running render; see progress.go
+	Phase    string `json:"phase,omitempty"`
+	Progress int    `json:"progress,omitempty"`
+	// Stored means the worker put the SVG in the result store itself, Size
+	// bytes of it
+	Stored     bool           `json:"stored,omitempty"`
+	Size       int64          `json:"size,omitempty"`
+	StatusCode int            `json:"statusCode,omitempty"`
+	Error      *ErrorResponse `json:"error,omitempty"`
+}
+
+type JobStatus struct {
+	ID          string     `json:"id"`
+	Status      string     `json:"status"`
+	PartNumber  string     `json:"partNumber"`
+	SubmittedAt time.Time  `json:"submittedAt"`
+	StartedAt   *time.Time `json:"startedAt,omitempty"`
+	FinishedAt  *time.Time `json:"finishedAt,omitempty"`
+	Worker      string     `json:"worker,omitempty"`
+	// Phase is queued, starting, a render phase (import, prepare,
+	// freestyle, export, postprocess), or done; Progress is its percentage
+	Phase    string `json:"phase"`
+	Progress int    `json:"progress"`
+	// RenderDuration is Blender's time in seconds; 0 for cached results
+	RenderDuration float64        `json:"renderDuration,omitempty"`
+	Error          *ErrorResponse `json:"error,omitempty"`
+	StatusURL      string         `json:"statusUrl"`
+	ResultURL      string         `json:"resultUrl"`
+	// With RESULT_URL_TTL, a presigned URL to fetch the SVG from the bucket
+	DownloadURL     string     `json:"downloadUrl,omitempty"`
+	DownloadExpires *time.Time `json:"downloadExpires,omitempty"`
+	// Every attempt at the render so far, and when the next retry is due
+	MaxRetries    int          `json:"maxRetries,omitempty"`
+	Attempts      []JobAttempt `json:"attempts"`
+	NextAttemptAt *time.Time   `json:"nextAttemptAt,omitempty"`
+}
+
+type JobAttempt struct {
+	Attempt    int            `json:"attempt"`
+	Status     string         `json:"status"`
+	Worker     string         `json:"worker,omitempty"`
+	StartedAt  *time.Time     `json:"startedAt,omitempty"`
+	FinishedAt *time.Time     `json:"finishedAt,omitempty"`
+	StatusCode int            `json:"statusCode,omitempty"`
+	Error      *ErrorResponse `json:"error,omitempty"`
+}
+
+type queuedJob struct {
+	JobStatus
+	key        *apiKey
+	request    RenderRequest
+	statusCode int
+	// The attempt under way, the one its retries count from (a requeue from
+	// the dead-letter list starts afresh), the wait before the first retry,
+	// and when the attempt was published, for QUEUE_JOB_TIMEOUT
+	attempt      int
+	retryBase    int
+	retryBackoff time.Duration
+	// Times it was requeued from the dead-letter list
+	requeues int
+	queuedAt time.Time
+	svg      []byte
+	// The SVG is in the result store rather than svg
+	stored bool
+	// The SVG's size, and whether it was dropped after QUEUE_OUTPUT_TTL
+	size          int64
+	outputExpired bool
+	callbackURL   string
+	// When the render was charged to key, zero once it's refunded
+	chargedAt time.Time
+}
+
+// Give back the render charged when the job was queued, for a job that
+// finished without one: served from the cache, dead-lettered, or cancelled.
+// Callers hold the jobs lock.
+func refundJobLocked(job *queuedJob) {
+	if job.key != nil && !job.chargedAt.IsZero() {
+		refundRender(job.key, job.chargedAt)
+		job.chargedAt = time.Time{}
+	}
+}
+
+// Jobs this API node submitted, until QUEUE_RESULT_TTL or QUEUE_FAILED_TTL
+// after they finish
+var jobs = struct {
+	sync.Mutex
+	byID map[string]*queuedJob
+}{byID: map[string]*queuedJob{}}
+
+func jobSubject(kind string) string {
+	return queueSubject + "." + kind
+}
+
+// Where a finished job's SVG is kept in the result store
+func jobResultKey(id string) string {
+	return "jobs/" + id + ".svg"
+}
+
+// Check the queue configuration at startup
+func validateQueue() error {
+	switch queueMode {
+	case "":
+		return nil
+	case "api", "worker", "both":
+	default:
+		return fmt.Errorf("unknown QUEUE_MODE %q (want api, worker, both, or empty)", queueMode)
+	}
+	u, err := url.Parse(queueURL)
+	switch {
+	case queueURL == "":
+		return fmt.Errorf("QUEUE_MODE=%s needs QUEUE_URL", queueMode)
+	case err != nil:
+		return fmt.Errorf("QUEUE_URL: %w", err)
+	case u.Scheme == "amqp" || u.Scheme == "amqps":
+		return fmt.Errorf("QUEUE_URL: RabbitMQ isn't supported; use a nats:// URL")
+	case u.Scheme != "nats":
+		return fmt.Errorf("QUEUE_URL: unsupported scheme %q (want nats)", u.Scheme)
+	}
+	if workerConcurrency < 1 {
+		return fmt.Errorf("WORKER_CONCURRENCY must be at least 1")
+	}
+	if queueMaxRetries < 0 || queueMaxRetryBackoff <= 0 {
+		return fmt.Errorf("QUEUE_MAX_RETRIES can't be negative and QUEUE_MAX_RETRY_BACKOFF must be positive")
+	}
+	if queueOutputTTL > queueResultTTL {
+		return fmt.Errorf("QUEUE_OUTPUT_TTL (%s) can't be longer than QUEUE_RESULT_TTL (%s)", queueOutputTTL, queueResultTTL)
+	}
+	if queueSweepInterval <= 0 {
+		return fmt.Errorf("QUEUE_SWEEP_INTERVAL must be positive")
+	}
+	return nil
+}
+
+// Connect to the broker and start the API side, the worker side, or both
+func startJobQueue() error {
+	name, _ := os.Hostname()
+	conn, err := dialNATS(queueURL, "lego-renderer "+name)
+	if err != nil {
+		return err
+	}
+	if queueMode == "api" || queueMode == "both" {
+		if err := startJobAPI(conn); err != nil {
+			return err
+		}
+		go sweepJobs(queueSweepInterval)
+	}
+	if queueMode == "worker" || queueMode == "both" {
+		if jobWorkerNode, err = startJobWorker(conn, name, workerConcurrency); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Submit jobs through b and follow workers' updates on them
+func startJobAPI(b jobBroker) error {
+	if _, err := b.subscribe(jobSubject("updates.*"), "", handleJobUpdate); err != nil {
+		return err
+	}
+	jobQueue = b
+	return nil
+}
+
+func newJobID() string {
+	id := make([]byte, 12)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// Render request context for a job's API key, for usage accounting
+func jobKeyContext(key *apiKey) context.Context {
+	return context.WithValue(context.Background(), apiKeyContextKey{}, key)
+}
+
+// Apply a worker's update to a job this node submitted
+func handleJobUpdate(_ string, data []byte) {
+	var u jobUpdate
+	if err := json.Unmarshal(data, &u); err != nil {
+		log.Printf("Ignoring malformed job update: %v", err)
+		return
+	}
+	if !jobPending(u.ID) {
+		return
+	}
+	// Finished SVGs go to the result store, when there is one, rather than
+	// staying in memory. That's done before the job is marked done so its
+	// result is there as soon as its status says so.
+	stored, size := u.Stored, u.Size
+	if !stored {
+		size = int64(len(u.SVG))
+	}
+	if u.Status == jobDone && results != nil && !stored {
+		if err := results.put(jobResultKey(u.ID), []byte(u.SVG), "image/svg+xml"); err != nil {
+			log.Printf("Job %s: storing the result failed, keeping it in memory: %v", u.ID, err)
+		} else {
+			stored = true
+		}
+	}
+
+	jobs.Lock()
+	job := jobs.byID[u.ID]
+	// Workers older than retries don't send the attempt
+	if job == nil || job.FinishedAt != nil || (u.Attempt != 0 && u.Attempt != job.attempt) {
+		jobs.Unlock()
+		// A result for a job cancelled while it finished
+		if stored && u.Status == jobDone {
+			removeJobResults([]string{u.ID})
+		}
+		return
+	}
+	now := time.Now().UTC()
+	job.Worker = u.Worker
+	attempt := currentAttemptLocked(job, now)
+	attempt.Worker = u.Worker
+	switch u.Status {
+	case jobRunning:
+		if job.Status != jobRunning {
+			recordJobQueueWait(now.Sub(job.queuedAt))
+			job.Status, job.Phase, job.Progress = jobRunning, "starting", 0
+			job.NextAttemptAt = nil
+			if job.StartedAt == nil {
+				job.StartedAt = &now
+			}
+		}
+		// Markers only move forward, though a retried render starts over
+		if u.Phase != "" && u.Progress >= job.Progress {
+			job.Phase, job.Progress = u.Phase, u.Progress
+		}
+	case jobDone:
+		job.Status, job.FinishedAt = jobDone, &now
+		job.Phase, job.Progress = jobDone, 100
+		job.RenderDuration, job.stored, job.size = u.RenderSeconds, stored, size
+		if !stored {
+			job.svg = []byte(u.SVG)
+		}
+		if u.Cached {
+			refundJobLocked(job)
+		}
+		attempt.Status, attempt.FinishedAt = jobDone, &now
+	case jobFailed:
+		attempt.Status, attempt.FinishedAt = jobFailed, &now
+		attempt.StatusCode, attempt.Error = u.StatusCode, u.Error
+		if retryJobLocked(job, u.StatusCode, now) {
+			next := *job.NextAttemptAt
+			jobs.Unlock()
+			log.Printf("Job %s: attempt %d failed, retrying at %s", u.ID, attempt.Attempt, next.Format(time.RFC3339))
+			return
+		}
+		job.Status, job.FinishedAt = jobFailed, &now
+		job.statusCode, job.Error = u.StatusCode, u.Error
+		deadLetterLocked(job)
+	}
+	if job.FinishedAt != nil {
+		notifyJobFinishedLocked(job)
+	}
+	key := job.key
+	jobs.Unlock()
+
+	switch u.Status {
+	case jobDone:
+		// The render was charged when the job was queued
+		recordKeyUsage(jobKeyContext(key), func(d *usageDay) {
+			if u.Cached {
+				d.CacheHits++
+			} else {
+				d.ComputeSeconds += u.RenderSeconds
+			}
+		})
+	case jobFailed:
+		recordKeyUsage(jobKeyContext(key), func(d *usageDay) { d.Errors++ })
+	}
+}
+
+// Whether a job this node submitted is still waiting for its result
+func jobPending(id string) bool {
+	jobs.Lock()
+	defer jobs.Unlock()
+	job := jobs.byID[id]
+	return job != nil && job.FinishedAt == nil
+}
+
+// The history entry for a job's current attempt. Callers hold the jobs lock.
+func currentAttemptLocked(job *queuedJob, now time.Time) *JobAttempt {
+	if n := len(job.Attempts); n > 0 && job.Attempts[n-1].Attempt == job.attempt {
+		return &job.Attempts[n-1]
+	}
+	job.Attempts = append(job.Attempts, JobAttempt{Attempt: job.attempt, Status: jobRunning, StartedAt: &now})
+	return &job.Attempts[len(job.Attempts)-1]
+}
+
+// Schedule another attempt at a failed job if it has retries left and the
+// failure might not happen again: the render's own errors (bad options, a
+// missing part) are final. Callers hold the jobs lock.
+func retryJobLocked(job *queuedJob, statusCode int, now time.Time) bool {
+	if job.attempt-job.retryBase >= job.MaxRetries || (statusCode != 0 && statusCode < 500) {
+		return false
+	}
+	delay := jobRetryDelay(job.retryBackoff, job.attempt)
+	next := now.Add(delay)
+	job.attempt++
+	job.Status, job.Phase, job.Progress = jobQueued, "retrying", 0
+	job.NextAttemptAt, job.queuedAt = &next, next
+	id, attempt := job.ID, job.attempt
+	time.AfterFunc(delay, func() { requeueJob(id, attempt) })
+	return true
+}
+
+// The wait before retry n: the job's backoff, doubled for each retry
+// before it, up to QUEUE_MAX_RETRY_BACKOFF
+func jobRetryDelay(backoff time.Duration, n int) time.Duration {
+	delay := backoff
+	for i := 1; i < n && delay < queueMaxRetryBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, queueMaxRetryBackoff)
+}
+
+// Publish a job's next attempt, unless it was cancelled while it waited
+func requeueJob(id string, attempt int) {
+	jobs.Lock()
+	job := jobs.byID[id]
+	if job == nil || job.FinishedAt != nil || job.attempt != attempt {
+		jobs.Unlock()
+		return
+	}
+	job.NextAttemptAt, job.queuedAt = nil, time.Now()
+	data, _ := json.Marshal(jobMessage{ID: id, Attempt: attempt, Request: job.request})
+	jobs.Unlock()
+
+	if err := jobQueue.publish(jobSubject("jobs"), data); err != nil {
+		// QUEUE_JOB_TIMEOUT fails it if this was the last chance
+		log.Printf("Job %s: publishing attempt %d failed: %v", id, attempt, err)
+	}
+}
+
+// Forget expired jobs every interval, so they're reclaimed even when no
+// one looks them up
+func sweepJobs(interval time.Duration) {
+	for range time.Tick(interval) {
+		jobs.Lock()
+		unstored := expireJobsLocked(time.Now())
+		jobs.Unlock()
+		removeJobResults(unstored)
+	}
+}
+
+// Fail unfinished jobs past QUEUE_JOB_TIMEOUT, drop done jobs' SVGs past
+// QUEUE_OUTPUT_TTL, and forget finished jobs past QUEUE_RESULT_TTL or
+// QUEUE_FAILED_TTL. Callers hold the jobs lock, and pass the IDs returned,
+// of jobs whose stored results were dropped, to removeJobResults once they
+// release it.
+func expireJobsLocked(now time.Time) (unstored []string) {
+	var expired int
+	var reclaimed int64
+	for id, job := range jobs.byID {
+		switch {
+		case job.FinishedAt != nil:
+			age, ttl := now.Sub(*job.FinishedAt), queueResultTTL
+			if job.Status != jobDone {
+				ttl = queueFailedTTL
+			}
+			if job.Status == jobDone && !job.outputExpired && (age > queueOutputTTL || age > ttl) {
+				if job.stored {
+					unstored = append(unstored, id)
+				}
+				reclaimed += dropJobOutputLocked(job)
+			}
+			if age > ttl {
+				delete(jobs.byID, id)
+				expired++
+			}
+		case now.Sub(job.queuedAt) > queueJobTimeout:
+			finished := now.UTC()
+			job.Status, job.FinishedAt = jobFailed, &finished
+			job.statusCode = http.StatusGatewayTimeout
+			job.Error = &ErrorResponse{Error: "Job timed out", Detail: fmt.Sprintf("Not finished within %s; is a worker running?", queueJobTimeout)}
+			deadLetterLocked(job)
+			notifyJobFinishedLocked(job)
+		}
+	}
+	if expired > 0 || reclaimed > 0 {
+		recordJobsExpired(expired, reclaimed)
+	}
+	return unstored
+}
+
+// Free a done job's SVG, returning its size. Callers hold the jobs lock.
+func dropJobOutputLocked(job *queuedJob) int64 {
+	job.svg, job.stored, job.outputExpired = nil, false, true
+	return job.size
+}
+
+// Send a finished job's webhook, if it asked for one. Callers hold the jobs
+// lock.
+func notifyJobFinishedLocked(job *queuedJob) {
+	if job.callbackURL != "" {
+		sendJobWebhook(job.callbackURL, jobStatusView(job.JobStatus, job.stored))
+	}
+}
+
+// A job's status as shown to clients, with a download URL when results are
+// handed out that way
+func jobStatusView(status JobStatus, stored bool) JobStatus {
+	status.Attempts = append([]JobAttempt{}, status.Attempts...)
+	if stored && presignedResults() {
+		if u, expires, err := resultURL(jobResultKey(status.ID)); err == nil {
+			status.DownloadURL, status.DownloadExpires = u, &expires
+		}
+	}
+	return status
+}
+
+func removeJobResults(ids []string) {
+	for _, id := range ids {
+		if err := results.remove(jobResultKey(id)); err != nil {
+			log.Printf("Job %s: removing the stored result failed: %v", id, err)
+		}
+	}
+}
+
+// Look up a job for the request's API key
+func lookupJob(r *http.Request) (*queuedJob, bool) {
+	jobs.Lock()
+	unstored := expireJobsLocked(time.Now())
+	job := jobs.byID[r.PathValue("id")]
+	jobs.Unlock()
+	removeJobResults(unstored)
+	if job == nil {
+		return nil, false
+	}
+	if key := apiKeyFromContext(r.Context()); key != job.key {
+		return nil, false
+	}
+	return job, true
+}
+
+// Job submission endpoint
+func handleSubmitJob(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		sendError(w, http.StatusMethodNotAllowed, "Method not allowed", "")
+		return
+	}
+	if jobQueue == nil {
+		sendError(w, http.StatusConflict, "Job queue is disabled", "Set QUEUE_MODE=api and QUEUE_URL to enable it")
+		return
+	}
+
+	var req JobRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	var errs fieldErrors
+	if req.PartNumber == "" {
+		errs.add("partNumber", "partNumber is required")
+	} else if _, ok := cleanPartNumber(req.PartNumber); !ok {
+		errs.add("partNumber", "%q is not an LDraw part number", req.PartNumber)
+	}
+	if req.CallbackURL != "" {
+		if err := validateCallbackURL(req.CallbackURL); err != nil {
+			errs.add("callbackUrl", "%s", err)
+		}
+	}
+	if req.MaxRetries < 0 || req.MaxRetries > queueMaxRetries {
+		errs.add("maxRetries", "maxRetries must be between 0 and %d", queueMaxRetries)
+	}
+	backoff := queueRetryBackoff
+	if req.RetryBackoffSeconds != nil {
+		backoff = time.Duration(*req.RetryBackoffSeconds * float64(time.Second))
+		if *req.RetryBackoffSeconds < 0 || backoff > queueMaxRetryBackoff {
+			errs.add("retryBackoffSeconds", "retryBackoffSeconds must be between 0 and %g", queueMaxRetryBackoff.Seconds())
+		}
+	}
+	_, err := req.options()
+	errs.merge("", err)
+	if err := errs.err(); err != nil {
+		sendValidationError(w, err)
+		return
+	}
+
+	// The render is charged now, so a key can't queue past its quota
+	key := apiKeyFromContext(r.Context())
+	now := time.Now()
+	var chargedAt time.Time
+	if key != nil {
+		if err := chargeKeyRender(key, now); err != nil {
+			sendRenderError(w, err)
+			return
+		}
+		chargedAt = now
+	}
+
+	id := newJobID()
+	data, _ := json.Marshal(jobMessage{ID: id, Attempt: 1, Request: req.RenderRequest})
+	job := &queuedJob{
+		JobStatus: JobStatus{
+			ID:          id,
+			Status:      jobQueued,
+			Phase:       jobQueued,
+			PartNumber:  req.PartNumber,
+			SubmittedAt: now.UTC(),
+			StatusURL:   "/jobs/" + id,
+			ResultURL:   "/jobs/" + id + "/result",
+			MaxRetries:  req.MaxRetries,
+			Attempts:    []JobAttempt{},
+		},
+		key:          key,
+		request:      req.RenderRequest,
+		attempt:      1,
+		retryBase:    1,
+		retryBackoff: backoff,
+		queuedAt:     now,
+		callbackURL:  req.CallbackURL,
+		chargedAt:    chargedAt,
+	}
+	// Registered before publishing so a fast worker's updates aren't lost
+	jobs.Lock()
+	unstored := expireJobsLocked(time.Now())
+	jobs.byID[id] = job
+	status := jobStatusView(job.JobStatus, false)
+	jobs.Unlock()
+	removeJobResults(unstored)
+
+	if err := jobQueue.publish(jobSubject("jobs"), data); err != nil {
+		jobs.Lock()
+		delete(jobs.byID, id)
+		refundJobLocked(job)
+		jobs.Unlock()
+		recordRejected("queue_unavailable")
+		sendError(w, http.StatusServiceUnavailable, "Job queue unavailable", err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", status.StatusURL)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(status)
+}
+
+// Job endpoint: GET for its status, DELETE to cancel it
+func handleJob(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		handleJobStatus(w, r)
+	case http.MethodDelete:
+		handleCancelJob(w, r)
+	default:
+		sendError(w, http.StatusMethodNotAllowed, "Method not allowed", "")
+	}
+}
+
+// Job cancellation. A job that hasn't started is dropped by whichever worker
+// receives it; a running one has its Blender process killed. Either way the
+// job is finished here at once, and later updates from workers are ignored.
+func handleCancelJob(w http.ResponseWriter, r *http.Request) {
+	job, ok := lookupJob(r)
+	if !ok {
+		sendError(w, http.StatusNotFound, "Job not found", "")
+		return
+	}
+	jobs.Lock()
+	if job.FinishedAt != nil {
+		status := job.Status
+		jobs.Unlock()
+		sendError(w, http.StatusConflict, "Job already finished", "Job is "+status)
+		return
+	}
+	now := time.Now().UTC()
+	job.Status, job.FinishedAt, job.NextAttemptAt = jobCancelled, &now, nil
+	if n := len(job.Attempts); n > 0 && job.Attempts[n-1].FinishedAt == nil {
+		job.Attempts[n-1].Status, job.Attempts[n-1].FinishedAt = jobCancelled, &now
+	}
+	job.statusCode = http.StatusGone
+	job.Error = &ErrorResponse{Error: "Job cancelled"}
+	refundJobLocked(job)
+	notifyJobFinishedLocked(job)
+	status := jobStatusView(job.JobStatus, job.stored)
+	jobs.Unlock()
+
+	recordJobCancelled()
+	data, _ := json.Marshal(jobCancel{ID: status.ID})
+	if err := jobQueue.publish(jobSubject("cancel"), data); err != nil {
+		log.Printf("Job %s: sending the cancellation failed: %v", status.ID, err)
+	}
+	log.Printf("Job %s: cancelled", status.ID)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// Job status endpoint
+func handleJobStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		sendError(w, http.StatusMethodNotAllowed, "Method not allowed", "")
+		return
+	}
+	job, ok := lookupJob(r)
+	if !ok {
+		sendError(w, http.StatusNotFound, "Job not found", "")
+		return
+	}
+	jobs.Lock()
+	status := jobStatusView(job.JobStatus, job.stored)
+	jobs.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// Job result endpoint: the SVG once done, the render error if it failed
+func handleJobResult(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		sendError(w, http.StatusMethodNotAllowed, "Method not allowed", "")
+		return
+	}
+	job, ok := lookupJob(r)
+	if !ok {
+		sendError(w, http.StatusNotFound, "Job not found", "")
+		return
+	}
+	jobs.Lock()
+	status, code, svg, stored, expired := job.JobStatus, job.statusCode, job.svg, job.stored, job.outputExpired
+	jobs.Unlock()
+
+	switch status.Status {
+	case jobDone:
+		if expired {
+			sendError(w, http.StatusGone, "Result expired", fmt.Sprintf("Job results are kept for %s", queueOutputTTL))
+			return
+		}
+		if stored && presignedResults() {
+			u, _, err := resultURL(jobResultKey(status.ID))
+			if err != nil {
+				sendError(w, http.StatusInternalServerError, "Failed to sign the result URL", err.Error())
+				return
+			}
+			w.Header().Set("Cache-Control", "no-store")
+			http.Redirect(w, r, u, http.StatusTemporaryRedirect)
+			return
+		}
+		if stored {
+			var err error
+			if svg, err = results.get(jobResultKey(status.ID)); err != nil {
+				sendError(w, http.StatusInternalServerError, "Failed to read the job result", err.Error())
+				return
+			}
+		}
+		sendRender(w, r, svg, time.Duration(status.RenderDuration*float64(time.Second)), "")
+	case jobFailed, jobCancelled:
+		resp := ErrorResponse{Error: "Rendering failed"}
+		if status.Error != nil {
+			resp = *status.Error
+		}
+		if code == 0 {
+			code = http.StatusInternalServerError
+		}
+		sendErrorResponse(w, code, resp)
+	default:
+		w.Header().Set("Retry-After", "2")
+		sendError(w, http.StatusConflict, "Job not finished", "Job is "+status.Status)
+	}
+}
+
+// Renders jobs from the queue. A worker only holds a subscription while it
+// has a free slot, so the broker hands jobs to idle workers instead of
+// queuing them behind a busy one.
+type jobWorker struct {
+	broker      jobBroker
+	name        string
+	concurrency int
+
+	mu       sync.Mutex
+	sid      int
+	inFlight int
+	stopped  bool
+	// Cancel functions for the jobs being rendered
+	running map[string]context.CancelFunc
+	// Jobs cancelled before they reached this worker, and when
+	cancelled map[string]time.Time
+}
+
+func startJobWorker(b jobBroker, name string, concurrency int) (*jobWorker, error) {
+	w := &jobWorker{broker: b, name: name, concurrency: concurrency,
+		running: map[string]context.CancelFunc{}, cancelled: map[string]time.Time{}}
+	if _, err := b.subscribe(jobSubject("cancel"), "", w.cancel); err != nil {
+		return nil, err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w, w.subscribeLocked()
+}
+
+// Stop rendering a cancelled job, or remember to skip it if it arrives
+// later
+func (w *jobWorker) cancel(_ string, data []byte) {
+	var c jobCancel
+	if err := json.Unmarshal(data, &c); err != nil {
+		log.Printf("Ignoring malformed job cancellation: %v", err)
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if cancel, ok := w.running[c.ID]; ok {
+		log.Printf("Job %s: cancelled, stopping its render", c.ID)
+		cancel()
+		return
+	}
+	now := time.Now()
+	for id, at := range w.cancelled {
+		if now.Sub(at) > queueJobTimeout {
+			delete(w.cancelled, id)
+		}
+	}
+	w.cancelled[c.ID] = now
+}
+
+func (w *jobWorker) subscribeLocked() error {
+	sid, err := w.broker.subscribe(jobSubject("jobs"), jobQueueGroup, w.receive)
+	if err == nil {
+		w.sid = sid
+	}
+	return err
+}
+
+// Stop taking jobs; the ones already running finish
+func (w *jobWorker) stop() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.stopped = true
+	if w.sid != 0 {
+		w.broker.unsubscribe(w.sid)
+		w.sid = 0
+	}
+}
+
+// Jobs being rendered
+func (w *jobWorker) busy() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.inFlight
+}
+
+func (w *jobWorker) receive(_ string, data []byte) {
+	var job jobMessage
+	if err := json.Unmarshal(data, &job); err != nil {
+		log.Printf("Ignoring malformed job: %v", err)
+		return
+	}
+	w.mu.Lock()
+	if _, ok := w.cancelled[job.ID]; ok {
+		delete(w.cancelled, job.ID)
+		w.mu.Unlock()
+		log.Printf("Job %s: skipping, it was cancelled", job.ID)
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	w.running[job.ID] = cancel
+	w.inFlight++
+	if w.inFlight >= w.concurrency && w.sid != 0 {
+		w.broker.unsubscribe(w.sid)
+		w.sid = 0
+	}
+	w.mu.Unlock()
+	go w.run(ctx, job)
+}
+
+func (w *jobWorker) run(ctx context.Context, job jobMessage) {
+	defer func() {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		w.running[job.ID]()
+		delete(w.running, job.ID)
+		w.inFlight--
+		if w.sid == 0 && w.inFlight < w.concurrency && !w.stopped {
+			if err := w.subscribeLocked(); err != nil {
+				log.Printf("Resubscribing to jobs failed: %v", err)
+			}
+		}
+	}()
+
+	w.report(jobUpdate{ID: job.ID, Attempt: job.Attempt, Status: jobRunning})
+	log.Printf("Job %s: rendering %s", job.ID, job.Request.PartNumber)
+	ctx = withProgress(ctx, func(phase string, percent int) {
+		w.report(jobUpdate{ID: job.ID, Attempt: job.Attempt, Status: jobRunning, Phase: phase, Progress: percent})
+	})
+	opts, err := job.Request.options()
+	var svg []byte
+	var d time.Duration
+	if err == nil {
+		svg, d, err = renderPart(ctx, job.Request.PartNumber, opts)
+	} else {
+		err = &RenderError{http.StatusBadRequest, err.Error(), ""}
+	}
+	if ctx.Err() != nil {
+		// The API node already finished the job
+		log.Printf("Job %s: render stopped", job.ID)
+		return
+	}
+	if err != nil {
+		w.fail(job, err)
+		return
+	}
+	update := jobUpdate{ID: job.ID, Attempt: job.Attempt, Status: jobDone, SVG: string(svg), RenderSeconds: d.Seconds(), Cached: d == 0}
+	// Handing out URLs, the worker uploads the SVG itself so it doesn't
+	// pass through the broker and the API node on the way
+	if presignedResults() {
+		if err := results.put(jobResultKey(job.ID), svg, "image/svg+xml"); err != nil {
+			log.Printf("Job %s: uploading the result failed, sending it instead: %v", job.ID, err)
+		} else {
+			update.SVG, update.Stored, update.Size = "", true, int64(len(svg))
+		}
+	}
+	if err := w.report(update); err != nil {
+		w.fail(job, &RenderError{http.StatusInternalServerError, "Failed to return the result", err.Error()})
+	}
+}
+
+func (w *jobWorker) fail(job jobMessage, err error) {
+	code, resp := renderErrorResponse(err)
+	w.report(jobUpdate{ID: job.ID, Attempt: job.Attempt, Status: jobFailed, StatusCode: code, Error: &resp})
+}
+
+func (w *jobWorker) report(u jobUpdate) error {
+	u.Worker = w.name
+	data, _ := json.Marshal(u)
+	err := w.broker.publish(jobSubject("updates."+u.ID), data)
+	if err != nil {
+		log.Printf("Job %s: reporting %s failed: %v", u.ID, u.Status, err)
+	}
+	return err
+}
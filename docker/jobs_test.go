@@ -0,0 +1,461 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Start the API side of the job queue on a fake NATS server
+func withJobQueue(t *testing.T) *fakeNATS {
+	t.Helper()
+	s := newFakeNATS(t)
+	if err := startJobAPI(dialTestNATS(t, s.url())); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		jobQueue = nil
+		jobs.Lock()
+		jobs.byID = map[string]*queuedJob{}
+		jobs.Unlock()
+		deadLetters.Lock()
+		deadLetters.list = nil
+		deadLetters.Unlock()
+	})
+	return s
+}
+
+func callJobs(method, path, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	routes().ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+	return w
+}
+
+func submitJob(t *testing.T, body string) JobStatus {
+	t.Helper()
+	w := callJobs(http.MethodPost, "/jobs", body)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d: %s", w.Code, w.Body.String())
+	}
+	var status JobStatus
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+	if status.Status != jobQueued || w.Header().Get("Location") != status.StatusURL {
+		t.Errorf("unexpected submission response %+v, Location %q", status, w.Header().Get("Location"))
+	}
+	return status
+}
+
+// Poll a job's status until it finishes
+func waitForJob(t *testing.T, status JobStatus) JobStatus {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		w := callJobs(http.MethodGet, status.StatusURL, "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("status: expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+		json.Unmarshal(w.Body.Bytes(), &status)
+		if status.FinishedAt != nil {
+			return status
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job still %s", status.Status)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestJobQueueRendersOnWorker(t *testing.T) {
+	withFakeBlender(t)
+	withTestLibrary(t, map[string]string{"3001": "0 Brick 2 x 4\n"})
+	s := withJobQueue(t)
+
+	status := submitJob(t, `{"partNumber":"3001"}`)
+	// Nothing is listening yet, so the job waits
+	if w := callJobs(http.MethodGet, status.ResultURL, ""); w.Code != http.StatusConflict {
+		t.Errorf("unfinished result: expected 409, got %d", w.Code)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	worker := dialTestNATS(t, s.url())
+	if _, err := startJobWorker(worker, "w1", 1); err != nil {
+		t.Fatal(err)
+	}
+	flushNATS(t, worker)
+	status = submitJob(t, `{"partNumber":"3001"}`)
+	status = waitForJob(t, status)
+	if status.Status != jobDone || status.Worker != "w1" || status.StartedAt == nil || status.FinishedAt == nil {
+		t.Fatalf("unexpected status %+v", status)
+	}
+	w := callJobs(http.MethodGet, status.ResultURL, "")
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "image/svg+xml") || !strings.Contains(w.Body.String(), "<svg") {
+		t.Errorf("result: %d %q\n%s", w.Code, w.Header().Get("Content-Type"), w.Body.String())
+	}
+
+	failed := waitForJob(t, submitJob(t, `{"partNumber":"9999"}`))
+	if failed.Status != jobFailed || failed.Error == nil {
+		t.Fatalf("expected a missing part to fail, got %+v", failed)
+	}
+	if w := callJobs(http.MethodGet, failed.ResultURL, ""); w.Code != http.StatusNotFound {
+		t.Errorf("failed result: expected the render's 404, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := callJobs(http.MethodGet, "/jobs/nope", ""); w.Code != http.StatusNotFound {
+		t.Errorf("unknown job: expected 404, got %d", w.Code)
+	}
+}
+
+func TestJobQueueTimesOut(t *testing.T) {
+	withJobQueue(t)
+	old := queueJobTimeout
+	queueJobTimeout = 10 * time.Millisecond
+	t.Cleanup(func() { queueJobTimeout = old })
+
+	status := submitJob(t, `{"partNumber":"3001"}`)
+	time.Sleep(20 * time.Millisecond)
+	if status = waitForJob(t, status); status.Status != jobFailed {
+		t.Fatalf("expected the job to time out, got %+v", status)
+	}
+	if w := callJobs(http.MethodGet, status.ResultURL, ""); w.Code != http.StatusGatewayTimeout {
+		t.Errorf("expected 504, got %d", w.Code)
+	}
+}
+
+func TestSubmitJobValidates(t *testing.T) {
+	if w := callJobs(http.MethodPost, "/jobs", `{"partNumber":"3001"}`); w.Code != http.StatusConflict {
+		t.Errorf("queue disabled: expected 409, got %d", w.Code)
+	}
+	withJobQueue(t)
+	w := callJobs(http.MethodPost, "/jobs", `{"partNumber":"../3001","fillColor":"nope"}`)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", w.Code)
+	}
+	var resp ErrorResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if len(resp.Fields) != 2 {
+		t.Errorf("expected both fields reported, got %+v", resp.Fields)
+	}
+}
+
+func TestJobSubmissionReservesQuota(t *testing.T) {
+	withJobQueue(t)
+	withAPIKeys(t, `[{"key":"k1","name":"team-a","monthlyQuota":2}]`)
+	call := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("X-API-Key", "k1")
+		routes().ServeHTTP(w, r)
+		return w
+	}
+	submit := func() *httptest.ResponseRecorder { return call(http.MethodPost, "/jobs", `{"partNumber":"3001"}`) }
+	id := func(w *httptest.ResponseRecorder) string {
+		var status JobStatus
+		if w.Code != http.StatusAccepted || json.Unmarshal(w.Body.Bytes(), &status) != nil {
+			t.Fatalf("expected 202, got %d: %s", w.Code, w.Body.String())
+		}
+		return status.ID
+	}
+	renders := func() int64 { return monthlyRenders("team-a", time.Now()) }
+
+	first, second := id(submit()), id(submit())
+	if w := submit(); w.Code != http.StatusTooManyRequests || renders() != 2 {
+		t.Fatalf("expected the third job refused with 2 charged, got %d with %d", w.Code, renders())
+	}
+
+	// Jobs that don't render give their charge back
+	handleJobUpdate("", []byte(`{"id":"`+first+`","status":"failed","statusCode":404,"error":{"error":"Part not found"}}`))
+	if n := renders(); n != 1 {
+		t.Errorf("after a dead-lettered job: %d charged, want 1", n)
+	}
+	third := id(submit())
+	if w := call(http.MethodDelete, "/jobs/"+second, ""); w.Code != http.StatusOK || renders() != 1 {
+		t.Errorf("after a cancelled job: status %d, %d charged, want 1", w.Code, renders())
+	}
+	handleJobUpdate("", []byte(`{"id":"`+third+`","status":"done","svg":"<svg/>","cached":true}`))
+	if n := renders(); n != 0 {
+		t.Errorf("after a cached job: %d charged, want 0", n)
+	}
+	fourth := id(submit())
+	handleJobUpdate("", []byte(`{"id":"`+fourth+`","status":"done","svg":"<svg/>","renderSeconds":1}`))
+	if n := renders(); n != 1 {
+		t.Errorf("after a rendered job: %d charged, want 1", n)
+	}
+}
+
+func TestValidateQueue(t *testing.T) {
+	oldMode, oldURL := queueMode, queueURL
+	t.Cleanup(func() { queueMode, queueURL = oldMode, oldURL })
+	for _, tc := range []struct {
+		mode, url, wantErr string
+	}{
+		{"", "", ""},
+		{"both", "nats://localhost:4222", ""},
+		{"sideways", "nats://localhost", "unknown QUEUE_MODE"},
+		{"api", "", "needs QUEUE_URL"},
+		{"worker", "amqp://guest@localhost", "RabbitMQ"},
+		{"worker", "redis://localhost", "unsupported scheme"},
+	} {
+		queueMode, queueURL = tc.mode, tc.url
+		err := validateQueue()
+		if tc.wantErr == "" && err != nil || tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)) {
+			t.Errorf("QUEUE_MODE=%q QUEUE_URL=%q: got %v, want %q", tc.mode, tc.url, err, tc.wantErr)
+		}
+	}
+
+	oldOutput := queueOutputTTL
+	t.Cleanup(func() { queueOutputTTL = oldOutput })
+	queueMode, queueURL, queueOutputTTL = "api", "nats://localhost", queueResultTTL+time.Minute
+	if err := validateQueue(); err == nil || !strings.Contains(err.Error(), "QUEUE_OUTPUT_TTL") {
+		t.Errorf("expected an output TTL longer than the job's to be rejected, got %v", err)
+	}
+}
+
+func TestJobReportsProgress(t *testing.T) {
+	withJobQueue(t)
+	status := submitJob(t, `{"partNumber":"3001"}`)
+	if status.Phase != jobQueued || status.Progress != 0 {
+		t.Errorf("expected a queued job at 0%%, got %s %d", status.Phase, status.Progress)
+	}
+
+	current := func() JobStatus {
+		var s JobStatus
+		json.Unmarshal(callJobs(http.MethodGet, status.StatusURL, "").Body.Bytes(), &s)
+		return s
+	}
+	for _, u := range []jobUpdate{
+		{Status: jobRunning},
+		{Status: jobRunning, Phase: "freestyle", Progress: 50},
+		// A stale marker doesn't move progress back
+		{Status: jobRunning, Phase: "prepare", Progress: 30},
+	} {
+		u.ID = status.ID
+		data, _ := json.Marshal(u)
+		handleJobUpdate("", data)
+	}
+	if s := current(); s.Status != jobRunning || s.Phase != "freestyle" || s.Progress != 50 {
+		t.Errorf("expected freestyle at 50%%, got %s %s %d", s.Status, s.Phase, s.Progress)
+	}
+
+	handleJobUpdate("", []byte(`{"id":"`+status.ID+`","status":"done","svg":"<svg/>"}`))
+	if s := current(); s.Phase != jobDone || s.Progress != 100 {
+		t.Errorf("expected done at 100%%, got %s %d", s.Phase, s.Progress)
+	}
+}
+
+func TestCancelQueuedJob(t *testing.T) {
+	withJobQueue(t)
+	before := metrics.JobsCancelled
+	status := submitJob(t, `{"partNumber":"3001"}`)
+
+	w := callJobs(http.MethodDelete, status.StatusURL, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	json.Unmarshal(w.Body.Bytes(), &status)
+	if status.Status != jobCancelled || status.FinishedAt == nil {
+		t.Fatalf("expected a cancelled job, got %+v", status)
+	}
+	if metrics.JobsCancelled != before+1 {
+		t.Errorf("expected jobs_cancelled to count it")
+	}
+	// A worker finishing it anyway doesn't bring it back
+	handleJobUpdate("", []byte(`{"id":"`+status.ID+`","status":"done","svg":"<svg/>"}`))
+	if w := callJobs(http.MethodGet, status.ResultURL, ""); w.Code != http.StatusGone {
+		t.Errorf("cancelled result: expected 410, got %d", w.Code)
+	}
+	if w := callJobs(http.MethodDelete, status.StatusURL, ""); w.Code != http.StatusConflict {
+		t.Errorf("second cancel: expected 409, got %d", w.Code)
+	}
+	if w := callJobs(http.MethodDelete, "/jobs/nope", ""); w.Code != http.StatusNotFound {
+		t.Errorf("unknown job: expected 404, got %d", w.Code)
+	}
+}
+
+func TestCancelRunningJob(t *testing.T) {
+	withFakeBlender(t)
+	t.Setenv("FAKE_BLENDER_SLEEP", "30")
+	withTestLibrary(t, map[string]string{"3001": "0 Brick 2 x 4\n"})
+	s := withJobQueue(t)
+	conn := dialTestNATS(t, s.url())
+	worker, err := startJobWorker(conn, "w1", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	flushNATS(t, conn)
+	failures := metrics.Errors
+
+	status := submitJob(t, `{"partNumber":"3001"}`)
+	deadline := time.Now().Add(5 * time.Second)
+	for status.Status != jobRunning {
+		if time.Now().After(deadline) {
+			t.Fatalf("job never started: %+v", status)
+		}
+		time.Sleep(10 * time.Millisecond)
+		json.Unmarshal(callJobs(http.MethodGet, status.StatusURL, "").Body.Bytes(), &status)
+	}
+	if w := callJobs(http.MethodDelete, status.StatusURL, ""); w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// Blender is killed and the worker freed well before the stub wakes
+	for {
+		worker.mu.Lock()
+		free := worker.inFlight == 0 && len(worker.running) == 0
+		worker.mu.Unlock()
+		if free {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("worker still busy with the cancelled job")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if metrics.Errors != failures {
+		t.Errorf("a cancelled render shouldn't count as an error")
+	}
+	if status = waitForJob(t, status); status.Status != jobCancelled {
+		t.Errorf("expected the job to stay cancelled, got %+v", status)
+	}
+}
+
+func TestJobRetention(t *testing.T) {
+	withJobQueue(t)
+	oldDone, oldFailed, oldOutput := queueResultTTL, queueFailedTTL, queueOutputTTL
+	queueResultTTL, queueFailedTTL, queueOutputTTL = time.Hour, 10*time.Minute, 30*time.Minute
+	t.Cleanup(func() { queueResultTTL, queueFailedTTL, queueOutputTTL = oldDone, oldFailed, oldOutput })
+	expired, reclaimed := metrics.JobsExpired, metrics.JobBytesReclaimed
+
+	done := submitJob(t, `{"partNumber":"3001"}`)
+	handleJobUpdate("", []byte(`{"id":"`+done.ID+`","status":"done","svg":"<svg>3001</svg>"}`))
+	failed := submitJob(t, `{"partNumber":"3001"}`)
+	handleJobUpdate("", []byte(`{"id":"`+failed.ID+`","status":"failed","statusCode":404}`))
+	sweep := func(after time.Duration) {
+		jobs.Lock()
+		unstored := expireJobsLocked(time.Now().Add(after))
+		jobs.Unlock()
+		removeJobResults(unstored)
+	}
+
+	// Failed jobs go first
+	sweep(20 * time.Minute)
+	if w := callJobs(http.MethodGet, failed.StatusURL, ""); w.Code != http.StatusNotFound {
+		t.Errorf("failed job: expected it forgotten, got %d", w.Code)
+	}
+	if w := callJobs(http.MethodGet, done.ResultURL, ""); w.Code != http.StatusOK {
+		t.Errorf("done job: expected its result, got %d", w.Code)
+	}
+
+	// Then the done job's SVG, while its record stays
+	sweep(45 * time.Minute)
+	if w := callJobs(http.MethodGet, done.ResultURL, ""); w.Code != http.StatusGone {
+		t.Errorf("expired result: expected 410, got %d", w.Code)
+	}
+	if w := callJobs(http.MethodGet, done.StatusURL, ""); w.Code != http.StatusOK {
+		t.Errorf("done job: expected its status, got %d", w.Code)
+	}
+	if n := metrics.JobBytesReclaimed - reclaimed; n != int64(len("<svg>3001</svg>")) {
+		t.Errorf("expected the SVG's bytes reclaimed, got %d", n)
+	}
+
+	sweep(2 * time.Hour)
+	if w := callJobs(http.MethodGet, done.StatusURL, ""); w.Code != http.StatusNotFound {
+		t.Errorf("done job: expected it forgotten, got %d", w.Code)
+	}
+	if n := metrics.JobsExpired - expired; n != 2 {
+		t.Errorf("expected 2 jobs expired, got %d", n)
+	}
+	if n := metrics.JobBytesReclaimed - reclaimed; n != int64(len("<svg>3001</svg>")) {
+		t.Errorf("an SVG was reclaimed twice: %d bytes", n)
+	}
+}
+
+func TestJobRetries(t *testing.T) {
+	s := withJobQueue(t)
+	conn := dialTestNATS(t, s.url())
+	published := make(chan jobMessage, 10)
+	conn.subscribe(jobSubject("jobs"), "", func(_ string, data []byte) {
+		var m jobMessage
+		json.Unmarshal(data, &m)
+		published <- m
+	})
+	flushNATS(t, conn)
+	next := func() jobMessage {
+		t.Helper()
+		select {
+		case m := <-published:
+			return m
+		case <-time.After(5 * time.Second):
+			t.Fatal("job not published")
+			return jobMessage{}
+		}
+	}
+	current := func(status JobStatus) JobStatus {
+		json.Unmarshal(callJobs(http.MethodGet, status.StatusURL, "").Body.Bytes(), &status)
+		return status
+	}
+	fail := func(m jobMessage, code int) {
+		u, _ := json.Marshal(jobUpdate{ID: m.ID, Attempt: m.Attempt, Status: jobFailed, Worker: "w1", StatusCode: code, Error: &ErrorResponse{Error: "Rendering failed"}})
+		handleJobUpdate("", u)
+	}
+
+	status := submitJob(t, `{"partNumber":"3001","maxRetries":2,"retryBackoffSeconds":0.01}`)
+	m := next()
+	if m.Attempt != 1 {
+		t.Fatalf("expected attempt 1, got %+v", m)
+	}
+	fail(m, http.StatusInternalServerError)
+	if status = current(status); status.Status != jobQueued || status.Phase != "retrying" || status.NextAttemptAt == nil {
+		t.Errorf("expected a retry to be scheduled, got %+v", status)
+	}
+	m = next()
+	if m.Attempt != 2 {
+		t.Fatalf("expected attempt 2, got %+v", m)
+	}
+	// A late update from the first attempt is ignored
+	fail(jobMessage{ID: m.ID, Attempt: 1}, http.StatusInternalServerError)
+	handleJobUpdate("", []byte(`{"id":"`+m.ID+`","attempt":2,"status":"done","svg":"<svg/>"}`))
+	status = current(status)
+	if status.Status != jobDone || len(status.Attempts) != 2 || status.Attempts[0].Status != jobFailed || status.Attempts[0].StatusCode != http.StatusInternalServerError || status.Attempts[1].Status != jobDone {
+		t.Errorf("expected a failed then a done attempt, got %+v", status)
+	}
+
+	// The render's own errors aren't retried
+	status = submitJob(t, `{"partNumber":"3001","maxRetries":2,"retryBackoffSeconds":0.01}`)
+	fail(next(), http.StatusNotFound)
+	if status = current(status); status.Status != jobFailed || len(status.Attempts) != 1 {
+		t.Errorf("expected a 404 to fail at once, got %+v", status)
+	}
+
+	// Nor is a job out of retries
+	status = submitJob(t, `{"partNumber":"3001","retryBackoffSeconds":0.01}`)
+	fail(next(), http.StatusInternalServerError)
+	if status = current(status); status.Status != jobFailed {
+		t.Errorf("expected a job without retries to fail, got %+v", status)
+	}
+}
+
+func TestJobRetryLimits(t *testing.T) {
+	withJobQueue(t)
+	for _, body := range []string{
+		`{"partNumber":"3001","maxRetries":-1}`,
+		`{"partNumber":"3001","maxRetries":99}`,
+		`{"partNumber":"3001","maxRetries":1,"retryBackoffSeconds":86400}`,
+	} {
+		if w := callJobs(http.MethodPost, "/jobs", body); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", body, w.Code)
+		}
+	}
+
+	oldMax := queueMaxRetryBackoff
+	queueMaxRetryBackoff = 10 * time.Second
+	t.Cleanup(func() { queueMaxRetryBackoff = oldMax })
+	for n, want := range map[int]time.Duration{1: 3 * time.Second, 2: 6 * time.Second, 3: 10 * time.Second} {
+		if d := jobRetryDelay(3*time.Second, n); d != want {
+			t.Errorf("retry %d: got %v, want %v", n, d, want)
+		}
+	}
+}
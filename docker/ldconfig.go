@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// LDrawColor is a single !COLOUR definition from LDConfig.ldr.
+type LDrawColor struct {
+	Code      int    `json:"code"`
+	Name      string `json:"name"`
+	Value     string `json:"value"`
+	Edge      string `json:"edge"`
+	Alpha     int    `json:"alpha"`
+	Luminance int    `json:"luminance,omitempty"`
+	// Finish is the material keyword (CHROME, PEARLESCENT, RUBBER,
+	// MATTE_METALLIC, METAL) or the MATERIAL type (GLITTER, SPECKLE).
+	Finish string `json:"finish,omitempty"`
+	// FinishValue is the GLITTER or SPECKLE particle color
+	FinishValue string `json:"finishValue,omitempty"`
+}
+
+var (
+	ldrawColorsOnce sync.Once
+	ldrawColors     map[int]LDrawColor
+)
+
+// Look up an LDraw color code, loading LDConfig.ldr on first use
+func lookupColor(code int) (LDrawColor, bool) {
+	ldrawColorsOnce.Do(func() {
+		f, err := os.Open(filepath.Join(ldrawPath, "LDConfig.ldr"))
+		if err != nil {
+			log.Printf("Failed to load LDraw colors: %v", err)
+			ldrawColors = map[int]LDrawColor{}
+			return
+		}
+		defer f.Close()
+		ldrawColors = parseLDConfig(f)
+		log.Printf("Loaded %d LDraw colors", len(ldrawColors))
+	})
+	c, ok := ldrawColors[code]
+	return c, ok
+}
+
+// Parse the !COLOUR meta commands of an LDConfig.ldr file
+func parseLDConfig(r io.Reader) map[int]LDrawColor {
+	colors := make(map[int]LDrawColor)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || fields[0] != "0" || fields[1] != "!COLOUR" {
+			continue
+		}
+
+		c := LDrawColor{Name: fields[2], Code: -1, Alpha: 255}
+	attrs:
+		for i := 3; i < len(fields); i++ {
+			next := ""
+			if i+1 < len(fields) {
+				next = fields[i+1]
+			}
+			switch fields[i] {
+			case "CODE":
+				if n, err := strconv.Atoi(next); err == nil {
+					c.Code = n
+				}
+				i++
+			case "VALUE":
+				c.Value = next
+				i++
+			case "EDGE":
+				c.Edge = next
+				i++
+			case "ALPHA":
+				if n, err := strconv.Atoi(next); err == nil {
+					c.Alpha = n
+				}
+				i++
+			case "LUMINANCE":
+				if n, err := strconv.Atoi(next); err == nil {
+					c.Luminance = n
+				}
+				i++
+			case "CHROME", "PEARLESCENT", "RUBBER", "MATTE_METALLIC", "METAL":
+				c.Finish = fields[i]
+			case "MATERIAL":
+				// MATERIAL parameters have their own VALUE/ALPHA keys, so stop here
+				c.Finish = next
+				for j := i + 2; j+1 < len(fields); j++ {
+					if fields[j] == "VALUE" {
+						c.FinishValue = fields[j+1]
+						break
+					}
+				}
+				break attrs
+			}
+		}
+
+		if c.Code >= 0 && c.Value != "" {
+			colors[c.Code] = c
+		}
+	}
+	return colors
+}
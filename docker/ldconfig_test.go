@@ -0,0 +1,68 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const testLDConfig = `0 LDraw.org Configuration File
+0 // LEGOid  26 - Black
+0 !COLOUR Black                                                 CODE   0   VALUE #1B2A34   EDGE #808080
+0 !COLOUR Red                                                   CODE   4   VALUE #C91A09   EDGE #333333
+0 !COLOUR Trans_Clear                                           CODE  47   VALUE #FCFCFC   EDGE #C3C3C3   ALPHA 128
+0 !COLOUR Chrome_Gold                                           CODE 334   VALUE #BBA53D   EDGE #BBB23D                               CHROME
+0 !COLOUR Glitter_Trans_Dark_Pink                               CODE 114   VALUE #DF6695   EDGE #9A2A66   ALPHA 128                   MATERIAL GLITTER VALUE #923978 FRACTION 0.17 VFRACTION 0.2 SIZE 1
+0 !COLOUR Glow_In_Dark_Opaque                                   CODE  21   VALUE #E0FFB0   EDGE #A4C2A4   ALPHA 250   LUMINANCE 15
+`
+
+func TestParseLDConfig(t *testing.T) {
+	colors := parseLDConfig(strings.NewReader(testLDConfig))
+	if len(colors) != 6 {
+		t.Fatalf("expected 6 colors, got %d", len(colors))
+	}
+
+	tests := []LDrawColor{
+		{Code: 0, Name: "Black", Value: "#1B2A34", Edge: "#808080", Alpha: 255},
+		{Code: 4, Name: "Red", Value: "#C91A09", Edge: "#333333", Alpha: 255},
+		{Code: 47, Name: "Trans_Clear", Value: "#FCFCFC", Edge: "#C3C3C3", Alpha: 128},
+		{Code: 334, Name: "Chrome_Gold", Value: "#BBA53D", Edge: "#BBB23D", Alpha: 255, Finish: "CHROME"},
+		{Code: 114, Name: "Glitter_Trans_Dark_Pink", Value: "#DF6695", Edge: "#9A2A66", Alpha: 128, Finish: "GLITTER", FinishValue: "#923978"},
+		{Code: 21, Name: "Glow_In_Dark_Opaque", Value: "#E0FFB0", Edge: "#A4C2A4", Alpha: 250, Luminance: 15},
+	}
+	for _, want := range tests {
+		if got := colors[want.Code]; got != want {
+			t.Errorf("color %d: got %+v, want %+v", want.Code, got, want)
+		}
+	}
+}
+
+// Point ldrawPath at a temporary library containing testLDConfig and the
+// given part files (name without .dat -> contents)
+func withTestLibrary(t *testing.T, parts map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "parts"), 0o755)
+	os.MkdirAll(filepath.Join(dir, "p"), 0o755)
+	if err := os.WriteFile(filepath.Join(dir, "LDConfig.ldr"), []byte(testLDConfig), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range parts {
+		path := filepath.Join(dir, "parts", name+".dat")
+		os.MkdirAll(filepath.Dir(path), 0o755)
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	oldPath := ldrawPath
+	ldrawPath = dir
+	ldrawColorsOnce = sync.Once{}
+	t.Cleanup(func() {
+		ldrawPath = oldPath
+		ldrawColorsOnce = sync.Once{}
+	})
+	return dir
+}
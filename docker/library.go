@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// LDRAW_LIBRARIES is a directory of LDraw library snapshots kept side by
+// side, one subdirectory each named for its release ("2024-01"). A render's
+// libraryVersion picks one, so catalog images made against it stay the same
+// while other renders use the current library at LDRAW_PATH. Snapshots are
+// read only: each has its own render version, and library updates (see
+// libupdate.go) only merge into LDRAW_PATH.
+var ldrawLibraries = getEnv("LDRAW_LIBRARIES", "")
+
+// Render versions of the snapshots, reset with the current library's
+var snapshotVersions = struct {
+	sync.Mutex
+	byName map[string]string
+}{byName: map[string]string{}}
+
+type LibrariesResponse struct {
+	Current   LibraryInfo   `json:"current"`
+	Snapshots []LibraryInfo `json:"snapshots"`
+}
+
+type LibraryInfo struct {
+	// The snapshot's libraryVersion; empty for the current library
+	Name string `json:"name,omitempty"`
+	// The UPDATE date in its LDConfig.ldr
+	Version string `json:"version"`
+	Parts   int    `json:"parts"`
+}
+
+// The library a libraryVersion names: a snapshot, or LDRAW_PATH for ""
+func libraryPath(name string) string {
+	if name == "" {
+		return ldrawPath
+	}
+	return filepath.Join(ldrawLibraries, name)
+}
+
+// The snapshots in LDRAW_LIBRARIES, sorted by name
+func librarySnapshots() []string {
+	if ldrawLibraries == "" {
+		return nil
+	}
+	entries, err := os.ReadDir(ldrawLibraries)
+	if err != nil {
+		return nil
+	}
+	var names []string
+	for _, e := range entries {
+		if !e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		if info, err := os.Stat(filepath.Join(ldrawLibraries, e.Name(), "parts")); err == nil && info.IsDir() {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Check a request's libraryVersion names a snapshot
+func checkLibraryVersion(name string) error {
+	if name == "" {
+		return nil
+	}
+	for _, snapshot := range librarySnapshots() {
+		if snapshot == name {
+			return nil
+		}
+	}
+	if ldrawLibraries == "" {
+		return fmt.Errorf("libraryVersion needs LDRAW_LIBRARIES")
+	}
+	return fmt.Errorf("unknown libraryVersion %q; see GET /libraries", name)
+}
+
+// The render version for renders from a library (see renderVersion)
+func renderVersionFor(name string) string {
+	if name == "" {
+		return renderVersion()
+	}
+	snapshotVersions.Lock()
+	defer snapshotVersions.Unlock()
+	v, ok := snapshotVersions.byName[name]
+	if !ok {
+		v = libraryRenderVersion(libraryPath(name))
+		snapshotVersions.byName[name] = v
+	}
+	return v
+}
+
+func handleLibraries(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		sendError(w, http.StatusMethodNotAllowed, "Method not allowed", "")
+		return
+	}
+	resp := LibrariesResponse{
+		Current:   LibraryInfo{Version: libraryVersionOf(ldrawPath), Parts: libraryPartCountOf(ldrawPath)},
+		Snapshots: []LibraryInfo{},
+	}
+	for _, name := range librarySnapshots() {
+		root := libraryPath(name)
+		resp.Snapshots = append(resp.Snapshots, LibraryInfo{Name: name, Version: libraryVersionOf(root), Parts: libraryPartCountOf(root)})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Point LDRAW_LIBRARIES at snapshots of name -> part -> content, each with
+// the test LDConfig.ldr stamped with its name as the UPDATE date
+func withLibrarySnapshots(t *testing.T, snapshots map[string]map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, parts := range snapshots {
+		root := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Join(root, "parts"), 0o755)
+		config := "0 LDraw.org Configuration File\n0 !LDRAW_ORG Configuration UPDATE " + name + "\n" + testLDConfig
+		if err := os.WriteFile(filepath.Join(root, "LDConfig.ldr"), []byte(config), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		for part, content := range parts {
+			if err := os.WriteFile(filepath.Join(root, "parts", part+".dat"), []byte(content), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	old := ldrawLibraries
+	ldrawLibraries = dir
+	refreshRenderVersion()
+	t.Cleanup(func() {
+		ldrawLibraries = old
+		refreshRenderVersion()
+	})
+	return dir
+}
+
+func TestLibraryVersionOption(t *testing.T) {
+	withTestLibrary(t, map[string]string{"3001": "0 Brick 2 x 4\n"})
+	if _, err := (&RenderRequest{LibraryVersion: "2023-06"}).options(); err == nil {
+		t.Error("expected libraryVersion to need LDRAW_LIBRARIES")
+	}
+	withLibrarySnapshots(t, map[string]map[string]string{"2023-06": {"3001": "0 Brick 2 x 4\n"}})
+
+	for _, name := range []string{"2024-01", "..", "../2023-06", "2023-06/parts"} {
+		if _, err := (&RenderRequest{LibraryVersion: name}).options(); err == nil {
+			t.Errorf("expected libraryVersion %q to be rejected", name)
+		}
+	}
+	opts, err := (&RenderRequest{LibraryVersion: "2023-06"}).options()
+	if err != nil || opts.LibraryVersion != "2023-06" {
+		t.Errorf("options = %+v, %v", opts.LibraryVersion, err)
+	}
+}
+
+func TestResolveFromSnapshot(t *testing.T) {
+	dir := withTestLibrary(t, map[string]string{
+		"3001":    "0 Brick 2 x 4\n",
+		"3001old": "0 ~Moved to 3001\n1 16 0 0 0 1 0 0 0 1 0 0 0 1 3001.dat\n",
+	})
+	snapshots := withLibrarySnapshots(t, map[string]map[string]string{
+		"2023-06": {"3001old": "0 Brick 2 x 4 (old)\n", "3002": "0 Brick 2 x 3\n"},
+	})
+	snapshot := RenderOptions{LibraryVersion: "2023-06"}
+
+	// A part renumbered since stays under its old number in the snapshot
+	if part, file, _, err := resolvePartFor("3001old", snapshot); err != nil || part != "3001old" || file != filepath.Join(snapshots, "2023-06", "parts", "3001old.dat") {
+		t.Errorf("3001old resolved to %s (%s, %v) in the snapshot", part, file, err)
+	}
+	if part, file, _, _ := resolvePartFor("3001old", RenderOptions{}); part != "3001" || file != filepath.Join(dir, "parts", "3001.dat") {
+		t.Errorf("3001old resolved to %s (%s) in the current library", part, file)
+	}
+	if _, _, _, err := resolvePartFor("3002", RenderOptions{}); err == nil {
+		t.Error("expected a snapshot's part not to be found in the current library")
+	}
+	if to := partMovedTo("3001old", snapshot); to != "" {
+		t.Errorf("partMovedTo in the snapshot = %q, want none", to)
+	}
+}
+
+func TestSnapshotCacheKeys(t *testing.T) {
+	dir := withTestLibrary(t, map[string]string{"3001": "0 Brick 2 x 4\n"})
+	withLibrarySnapshots(t, map[string]map[string]string{"2023-06": {"3001": "0 Brick 2 x 4\n"}})
+	current, _ := (&RenderRequest{}).options()
+	snapshot, _ := (&RenderRequest{LibraryVersion: "2023-06"}).options()
+
+	currentKey, snapshotKey := renderCacheKey("3001", current), renderCacheKey("3001", snapshot)
+	if currentKey == snapshotKey {
+		t.Fatal("expected renders from a snapshot to be cached apart")
+	}
+	// A new current library leaves the snapshot's renders cached
+	os.WriteFile(filepath.Join(dir, "LDConfig.ldr"), []byte("0 !LDRAW_ORG Configuration UPDATE 2024-02\n"+testLDConfig), 0o644)
+	refreshRenderVersion()
+	if renderCacheKey("3001", current) == currentKey {
+		t.Error("expected the current library's key to change with it")
+	}
+	if renderCacheKey("3001", snapshot) != snapshotKey {
+		t.Error("expected the snapshot's key to stay the same")
+	}
+}
+
+func TestRenderFromSnapshot(t *testing.T) {
+	capture := withFakeBlender(t)
+	withTestLibrary(t, map[string]string{"3001": "0 Brick 2 x 4\n"})
+	snapshots := withLibrarySnapshots(t, map[string]map[string]string{"2023-06": {"3001": "0 Brick 2 x 4\n"}})
+
+	w := httptest.NewRecorder()
+	handleRender(w, httptest.NewRequest(http.MethodPost, "/render", bytes.NewReader([]byte(`{"partNumber": "3001", "libraryVersion": "2023-06"}`))))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	if v := w.Header().Get("X-Library-Version"); v != "2023-06" {
+		t.Errorf("X-Library-Version %q, want the snapshot's", v)
+	}
+	data, err := os.ReadFile(capture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var args map[string]string
+	json.Unmarshal(data, &args)
+	if want := filepath.Join(snapshots, "2023-06"); args["ldraw_path"] != want {
+		t.Errorf("rendered with library %q, want %q", args["ldraw_path"], want)
+	}
+}
+
+func TestLibraries(t *testing.T) {
+	withTestLibrary(t, map[string]string{"3001": "0 Brick 2 x 4\n"})
+	dir := withLibrarySnapshots(t, map[string]map[string]string{
+		"2023-06": {"3001": "0 Brick 2 x 4\n"},
+		"2024-01": {"3001": "0 Brick 2 x 4\n", "3002": "0 Brick 2 x 3\n"},
+	})
+	// Not a library
+	os.MkdirAll(filepath.Join(dir, "scratch"), 0o755)
+
+	w := httptest.NewRecorder()
+	handleLibraries(w, httptest.NewRequest(http.MethodGet, "/libraries", nil))
+	var resp LibrariesResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Current.Parts != 1 || len(resp.Snapshots) != 2 {
+		t.Fatalf("unexpected libraries %+v", resp)
+	}
+	if s := resp.Snapshots[1]; s.Name != "2024-01" || s.Version != "2024-01" || s.Parts != 2 {
+		t.Errorf("unexpected snapshot %+v", s)
+	}
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// POST /admin/library/update merges an official parts update archive
+// (lcadYYNN.zip) into the library in place. Replacing the library would
+// change the render version and invalidate every cached render; instead
+// the parts directory keeps its time, and each part that uses a changed
+// file, directly or through its subparts and primitives, gets a new
+// revision that renderCacheKey includes. The revisions are kept with the
+// library, in .part-revisions.json, so they stay in step with it.
+const (
+	libraryUpdateMaxBytes = 256 << 20
+	libraryRevisionsFile  = ".part-revisions.json"
+)
+
+type LibraryUpdateResponse struct {
+	// Library files the update added and changed, e.g. "parts/3001.dat"
+	Added     []string `json:"added"`
+	Updated   []string `json:"updated"`
+	Unchanged int      `json:"unchanged"`
+	// Archive entries that aren't library files (models, notes)
+	Skipped []string `json:"skipped,omitempty"`
+	// Parts whose cached renders no longer apply
+	Invalidated []string `json:"invalidated"`
+	// Popular renders of those parts queued to render again
+	Queued        int    `json:"queued"`
+	RenderVersion string `json:"renderVersion"`
+}
+
+// One library file from an update archive
+type libraryUpdateFile struct {
+	name    string // relative to the library, e.g. "parts/s/3001s01.dat"
+	content []byte
+}
+
+// Updates run one at a time
+var libraryUpdateMu sync.Mutex
+
+var libraryRevisions = struct {
+	sync.RWMutex
+	// The library they were loaded from
+	path   string
+	loaded bool
+	saved  partRevisions
+}{}
+
+type partRevisions struct {
+	Updates int            `json:"updates"`
+	Parts   map[string]int `json:"parts"`
+}
+
+func handleLibraryUpdate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		sendError(w, http.StatusMethodNotAllowed, "Method not allowed", "")
+		return
+	}
+	data, err := readUpload(w, r, libraryUpdateMaxBytes)
+	if err != nil {
+		sendError(w, http.StatusBadRequest, "Invalid upload", err.Error())
+		return
+	}
+	files, skipped, err := readLibraryUpdate(data)
+	if err != nil {
+		sendValidationError(w, err)
+		return
+	}
+
+	resp, err := applyLibraryUpdate(files)
+	resp.Skipped = skipped
+	if err != nil {
+		sendError(w, http.StatusInternalServerError, "Merging the update failed", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// Read and check every library file in an update archive. Entries may sit
+// under a top-level ldraw/ directory, as official archives have them; ones
+// outside parts/ and p/ (other than LDConfig.ldr) are skipped.
+func readLibraryUpdate(data []byte) ([]libraryUpdateFile, []string, error) {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading update archive: %v", err)
+	}
+	var (
+		files   []libraryUpdateFile
+		skipped []string
+		errs    fieldErrors
+	)
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		name := f.Name
+		if len(name) > 6 && strings.EqualFold(name[:6], "ldraw/") {
+			name = name[6:]
+		}
+		if !libraryUpdatePath(name) {
+			skipped = append(skipped, f.Name)
+			continue
+		}
+		if path.Clean(name) != name || !f.Mode().IsRegular() {
+			errs.add(f.Name, "%s: not a plain library path", f.Name)
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			errs.add(f.Name, "%s: %v", f.Name, err)
+			continue
+		}
+		content, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			errs.add(f.Name, "%s: %v", f.Name, err)
+			continue
+		}
+		if !isLDrawText(content) || !hasLDrawOrgHeader(content) {
+			errs.add(f.Name, "%s: not an official LDraw file", f.Name)
+			continue
+		}
+		files = append(files, libraryUpdateFile{name, content})
+	}
+	if err := errs.err(); err != nil {
+		return nil, nil, err
+	}
+	if len(files) == 0 {
+		return nil, nil, fieldErrors{{Message: "update archive has no library files"}}
+	}
+	return files, skipped, nil
+}
+
+// Whether an archive path (without ldraw/) is one an update may write
+func libraryUpdatePath(name string) bool {
+	if strings.EqualFold(name, "LDConfig.ldr") {
+		return true
+	}
+	if !strings.HasPrefix(name, "parts/") && !strings.HasPrefix(name, "p/") {
+		return false
+	}
+	return strings.EqualFold(path.Ext(name), ".dat")
+}
+
+// Official files carry a "0 !LDRAW_ORG" header line before any geometry
+func hasLDrawOrgHeader(content []byte) bool {
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] != "0" {
+			return false
+		}
+		if len(fields) >= 2 && fields[1] == "!LDRAW_ORG" {
+			return true
+		}
+	}
+	return false
+}
+
+// Write an update's changed files into the library and invalidate the
+// renders of the parts that use them. Files written before a failure still
+// invalidate their parts.
+func applyLibraryUpdate(files []libraryUpdateFile) (LibraryUpdateResponse, error) {
+	libraryUpdateMu.Lock()
+	defer libraryUpdateMu.Unlock()
+
+	resp := LibraryUpdateResponse{Added: []string{}, Updated: []string{}, Invalidated: []string{}}
+	partsDir := filepath.Join(ldrawPath, "parts")
+	partsInfo, statErr := os.Stat(partsDir)
+
+	changed := map[string]bool{}
+	var err error
+	for _, f := range files {
+		dest := filepath.Join(ldrawPath, filepath.FromSlash(f.name))
+		old, readErr := os.ReadFile(dest)
+		if readErr == nil && bytes.Equal(old, f.content) {
+			resp.Unchanged++
+			continue
+		}
+		if err = writeFileAtomic(dest, f.content); err != nil {
+			err = fmt.Errorf("%s: %w", f.name, err)
+			break
+		}
+		if readErr == nil {
+			resp.Updated = append(resp.Updated, f.name)
+		} else {
+			resp.Added = append(resp.Added, f.name)
+		}
+		changed[f.name] = true
+	}
+
+	// The parts directory's time is part of the render version; keep it so
+	// the renders of parts the update didn't touch stay cached
+	if statErr == nil {
+		os.Chtimes(partsDir, partsInfo.ModTime(), partsInfo.ModTime())
+	}
+	if len(changed) > 0 {
+		parts, scanErr := partsUsing(changed)
+		if scanErr != nil && err == nil {
+			err = scanErr
+		}
+		if revErr := bumpPartRevisions(parts); revErr != nil && err == nil {
+			err = revErr
+		}
+		resp.Invalidated = parts
+		// Subfile geometry may have changed under an unchanged part file
+		partGeometries.Lock()
+		clear(partGeometries.byPath)
+		partGeometries.Unlock()
+		resp.Queued = rewarmPopular(parts)
+		log.Printf("Library update: %d added, %d updated, %d parts invalidated", len(resp.Added), len(resp.Updated), len(parts))
+	}
+	resp.RenderVersion = refreshRenderVersion()
+	return resp, err
+}
+
+// The parts (files directly in parts/) that are, or use, any of the
+// changed library files, sorted
+func partsUsing(changed map[string]bool) ([]string, error) {
+	// Subfile references are relative to parts/ or p/, with backslashes
+	usedBy := map[string][]string{}
+	parts := map[string]bool{}
+	for _, dir := range []string{"parts", "p"} {
+		root := filepath.Join(ldrawPath, dir)
+		err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() || !strings.EqualFold(filepath.Ext(p), ".dat") {
+				return err
+			}
+			rel, _ := filepath.Rel(root, p)
+			ref := strings.ToLower(filepath.ToSlash(rel))
+			if dir == "parts" && !strings.Contains(ref, "/") {
+				parts[ref] = true
+			}
+			for _, sub := range subfileRefs(p) {
+				usedBy[sub] = append(usedBy[sub], ref)
+			}
+			return nil
+		})
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	seen := map[string]bool{}
+	var queue []string
+	for name := range changed {
+		ref, ok := strings.CutPrefix(strings.ToLower(name), "parts/")
+		if !ok {
+			// LDConfig.ldr changes the render version instead
+			if ref, ok = strings.CutPrefix(strings.ToLower(name), "p/"); !ok {
+				continue
+			}
+		}
+		if !seen[ref] {
+			seen[ref] = true
+			queue = append(queue, ref)
+		}
+	}
+	for len(queue) > 0 {
+		ref := queue[0]
+		queue = queue[1:]
+		for _, user := range usedBy[ref] {
+			if !seen[user] {
+				seen[user] = true
+				queue = append(queue, user)
+			}
+		}
+	}
+	result := []string{}
+	for ref := range seen {
+		if parts[ref] {
+			result = append(result, strings.TrimSuffix(ref, ".dat"))
+		}
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+// The files a library file references, as lowercase slash paths
+func subfileRefs(file string) []string {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	var refs []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 15 && fields[0] == "1" {
+			refs = append(refs, strings.ToLower(strings.ReplaceAll(strings.Join(fields[14:], " "), `\`, "/")))
+		}
+	}
+	return refs
+}
+
+// The library's revisions, loaded on first use (and again if LDRAW_PATH
+// changes). Call with libraryRevisions locked.
+func loadPartRevisions() {
+	if libraryRevisions.loaded && libraryRevisions.path == ldrawPath {
+		return
+	}
+	saved := partRevisions{Parts: map[string]int{}}
+	if data, err := os.ReadFile(filepath.Join(ldrawPath, libraryRevisionsFile)); err == nil {
+		if err := json.Unmarshal(data, &saved); err != nil {
+			log.Printf("Failed to read part revisions: %v", err)
+		}
+		if saved.Parts == nil {
+			saved.Parts = map[string]int{}
+		}
+	}
+	libraryRevisions.path, libraryRevisions.loaded, libraryRevisions.saved = ldrawPath, true, saved
+}
+
+// A part's revision: the number of the last update that changed it, or 0
+func partRevision(partNumber string) int {
+	libraryRevisions.RLock()
+	if libraryRevisions.loaded && libraryRevisions.path == ldrawPath {
+		defer libraryRevisions.RUnlock()
+		return libraryRevisions.saved.Parts[strings.ToLower(partNumber)]
+	}
+	libraryRevisions.RUnlock()
+	libraryRevisions.Lock()
+	defer libraryRevisions.Unlock()
+	loadPartRevisions()
+	return libraryRevisions.saved.Parts[strings.ToLower(partNumber)]
+}
+
+// Give parts a new revision and save them with the library
+func bumpPartRevisions(parts []string) error {
+	libraryRevisions.Lock()
+	defer libraryRevisions.Unlock()
+	loadPartRevisions()
+	saved := &libraryRevisions.saved
+	saved.Updates++
+	for _, part := range parts {
+		saved.Parts[part] = saved.Updates
+	}
+	data, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(ldrawPath, libraryRevisionsFile), data)
+}
+
+// Queue the popular renders of updated parts, as the scheduler does after a
+// render version change. Returns how many were queued.
+func rewarmPopular(parts []string) int {
+	if prewarmPopular <= 0 || renderCache == nil {
+		return 0
+	}
+	updated := map[string]bool{}
+	for _, part := range parts {
+		updated[part] = true
+	}
+	queued := 0
+	for _, e := range topPopular(prewarmPopular) {
+		if updated[strings.ToLower(e.PartNumber)] && !renderCache.has(renderCacheKey(e.PartNumber, e.Options)) && enqueuePrewarm(prewarmJob{partNumber: e.PartNumber, opts: e.Options}) {
+			queued++
+		}
+	}
+	return queued
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// An update archive of name -> content
+func testUpdateArchive(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, content := range files {
+		f, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write([]byte(content))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func postLibraryUpdate(archive []byte) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/admin/library/update", bytes.NewReader(archive))
+	r.Header.Set("Content-Type", "application/zip")
+	handleLibraryUpdate(w, r)
+	return w
+}
+
+func TestLibraryUpdate(t *testing.T) {
+	stud := "0 Stud\n0 !LDRAW_ORG Primitive\n2 24 0 0 0 1 0 0\n"
+	dir := withTestLibrary(t, map[string]string{
+		"3001":       "0 Brick 2 x 4\n1 16 0 0 0 1 0 0 0 1 0 0 0 1 s\\3001s01.dat\n",
+		"s/3001s01":  "0 ~Brick 2 x 4 without Front Face\n",
+		"3002":       "0 Brick 2 x 3\n1 16 0 0 0 1 0 0 0 1 0 0 0 1 stud.dat\n",
+		"3003":       "0 Brick 2 x 2\n",
+		"3001-stand": "0 Brick 2 x 4 on a stand\n1 16 0 0 0 1 0 0 0 1 0 0 0 1 3001.dat\n",
+	})
+	if err := os.WriteFile(filepath.Join(dir, "p", "stud.dat"), []byte(stud), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	version := refreshRenderVersion()
+	opts, _ := (&RenderRequest{}).options()
+	before := map[string]string{}
+	for _, part := range []string{"3001", "3001-stand", "3002", "3003"} {
+		before[part] = renderCacheKey(part, opts)
+	}
+
+	w := postLibraryUpdate(testUpdateArchive(t, map[string]string{
+		"ldraw/parts/s/3001s01.dat":   "0 ~Brick 2 x 4 without Front Face\n0 !LDRAW_ORG Subpart UPDATE 2024-01\n2 24 0 0 0 1 0 0\n",
+		"ldraw/parts/3004.dat":        "0 Brick 1 x 2\n0 !LDRAW_ORG Part UPDATE 2024-01\n",
+		"ldraw/p/stud.dat":            stud,
+		"ldraw/models/Note2401CA.txt": "Release notes\n",
+		"ldraw/models/Pyramid.ldr":    "0 Pyramid\n",
+	}))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	var resp LibraryUpdateResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(resp.Added, []string{"parts/3004.dat"}) || !reflect.DeepEqual(resp.Updated, []string{"parts/s/3001s01.dat"}) || resp.Unchanged != 1 || len(resp.Skipped) != 2 {
+		t.Errorf("unexpected merge %+v", resp)
+	}
+	if !reflect.DeepEqual(resp.Invalidated, []string{"3001", "3001-stand", "3004"}) {
+		t.Errorf("invalidated %v, want 3001, 3001-stand, and 3004", resp.Invalidated)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "parts", "3004.dat")); err != nil {
+		t.Errorf("expected the new part in the library: %v", err)
+	}
+
+	// Only the parts using the changed subpart render afresh
+	if resp.RenderVersion != version {
+		t.Errorf("render version changed from %s to %s", version, resp.RenderVersion)
+	}
+	for part, key := range before {
+		changed := renderCacheKey(part, opts) != key
+		if want := part == "3001" || part == "3001-stand"; changed != want {
+			t.Errorf("%s cache key changed: %v, want %v", part, changed, want)
+		}
+	}
+
+	// The revisions survive a restart
+	libraryRevisions.Lock()
+	libraryRevisions.loaded = false
+	libraryRevisions.Unlock()
+	if rev := partRevision("3001"); rev != 1 {
+		t.Errorf("3001 revision after reload = %d, want 1", rev)
+	}
+}
+
+func TestLibraryUpdateRejects(t *testing.T) {
+	dir := withTestLibrary(t, map[string]string{"3001": "0 Brick 2 x 4\n"})
+
+	for name, archive := range map[string][]byte{
+		"not a zip": []byte("PK nonsense"),
+		"unofficial file": testUpdateArchive(t, map[string]string{
+			"ldraw/parts/3005.dat": "0 Brick 1 x 1\n0 !LDRAW_ORG Part\n",
+			"ldraw/parts/3001.dat": "0 Brick 2 x 4\n",
+		}),
+		"escaping path": testUpdateArchive(t, map[string]string{"parts/../../evil.dat": "0 Evil\n0 !LDRAW_ORG Part\n"}),
+		"no parts":      testUpdateArchive(t, map[string]string{"ldraw/models/Note2401CA.txt": "Release notes\n"}),
+	} {
+		if w := postLibraryUpdate(archive); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", name, w.Code)
+		}
+	}
+	// Nothing from a rejected archive is merged
+	if _, err := os.Stat(filepath.Join(dir, "parts", "3005.dat")); err == nil {
+		t.Error("expected a rejected archive to merge nothing")
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// A request's lineStyle sets Freestyle modifiers on its lines beyond their
+// thickness. render_part.py adds them to every line set, after a style's
+// own (see apply_line_modifiers): taper and fade thin and fade strokes
+// toward both ends, creaseWeight thickens creases the sharper they are,
+// backboneStretch lengthens strokes past their ends, dash breaks them
+// into dashes, and pressure thickens them where the surface curves, for a
+// drawn look on organic parts like plants and animals.
+type LineStyle struct {
+	// Taper thins stroke ends to (1 - taper) of the thickness, 0-1
+	Taper *float64 `json:"taper"`
+	// Fade fades stroke ends to (1 - fade) opacity, 0-1
+	Fade *float64 `json:"fade"`
+	// CreaseWeight adds up to this many times the thickness at the
+	// sharpest creases, 0-4
+	CreaseWeight *float64 `json:"creaseWeight"`
+	// BackboneStretch extends both ends of every stroke, in pixels, 0-50
+	BackboneStretch *float64 `json:"backboneStretch"`
+	// Dash is dash and gap lengths in pixels: one to three pairs
+	Dash []int `json:"dash"`
+	// Pressure adds up to this many times the thickness where the surface
+	// curves most, 0-4
+	Pressure *float64 `json:"pressure"`
+}
+
+// The longest dash or gap, in pixels
+const maxDashLength = 500
+
+// Check a line style and copy it into opts
+func (ls *LineStyle) apply(opts *RenderOptions) error {
+	var errs fieldErrors
+	for _, f := range []struct {
+		name  string
+		value *float64
+		max   float64
+		dst   *float64
+		unit  string
+	}{
+		{"taper", ls.Taper, 1, &opts.LineTaper, ""},
+		{"fade", ls.Fade, 1, &opts.LineFade, ""},
+		{"creaseWeight", ls.CreaseWeight, 4, &opts.CreaseWeight, ""},
+		{"backboneStretch", ls.BackboneStretch, 50, &opts.BackboneStretch, " pixels"},
+		{"pressure", ls.Pressure, 4, &opts.LinePressure, ""},
+	} {
+		if f.value == nil {
+			continue
+		}
+		if *f.value < 0 || *f.value > f.max {
+			errs.add(f.name, "%s must be between 0 and %g%s", f.name, f.max, f.unit)
+		}
+		*f.dst = *f.value
+	}
+
+	if ls.Dash != nil {
+		pattern, err := dashPattern(ls.Dash)
+		if err != nil {
+			errs.add("dash", "%v", err)
+		}
+		opts.DashPattern = pattern
+	}
+	return errs.err()
+}
+
+// Check dash and gap lengths and join them as render_part.py takes them
+func dashPattern(dash []int) (string, error) {
+	if len(dash) == 0 || len(dash)%2 != 0 || len(dash) > 6 {
+		return "", fmt.Errorf("dash must be one to three dash, gap pairs")
+	}
+	lengths := make([]string, len(dash))
+	for i, n := range dash {
+		if n < 1 || n > maxDashLength {
+			return "", fmt.Errorf("dash lengths must be between 1 and %d pixels", maxDashLength)
+		}
+		lengths[i] = strconv.Itoa(n)
+	}
+	return strings.Join(lengths, ","), nil
+}
+
+// The dash_pattern argument render_part.py takes
+func scriptDashPattern(pattern string) string {
+	if pattern == "" {
+		return "none"
+	}
+	return pattern
+}
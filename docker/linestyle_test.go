@@ -0,0 +1,40 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestLineStyleValidates(t *testing.T) {
+	f := func(v float64) *float64 { return &v }
+	for name, ls := range map[string]LineStyle{
+		"lineStyle.taper":           {Taper: f(1.5)},
+		"lineStyle.fade":            {Fade: f(-0.1)},
+		"lineStyle.creaseWeight":    {CreaseWeight: f(5)},
+		"lineStyle.backboneStretch": {BackboneStretch: f(51)},
+		"lineStyle.dash":            {Dash: []int{6, 3, 2}},
+		"lineStyle.pressure":        {Pressure: f(4.5)},
+	} {
+		req := RenderRequest{LineStyle: &ls}
+		_, err := req.options()
+		var fe fieldErrors
+		if !errors.As(err, &fe) || len(fe) != 1 || fe[0].Field != name {
+			t.Errorf("expected an error on %s, got %v", name, err)
+		}
+	}
+	for _, dash := range [][]int{{}, {0, 3}, {6, 3, 6, 3, 6, 3, 6, 3}, {600, 1}} {
+		req := RenderRequest{LineStyle: &LineStyle{Dash: dash}}
+		if _, err := req.options(); err == nil {
+			t.Errorf("dash %v: expected an error", dash)
+		}
+	}
+
+	req := RenderRequest{LineStyle: &LineStyle{Taper: f(0.8), Dash: []int{4, 2}}}
+	opts, err := req.options()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.LineTaper != 0.8 || opts.DashPattern != "4,2" || scriptDashPattern("") != "none" {
+		t.Errorf("unexpected line options %+v", opts)
+	}
+}
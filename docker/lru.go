@@ -0,0 +1,87 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+)
+
+// Thumbnail traffic asks for the same few hundred renders over and over, so
+// a small in-memory LRU sits in front of the disk cache and saves a file
+// read per hit. It's bounded by the total size of the SVGs it holds.
+var renderMemoryCacheBytes = getEnvInt("RENDER_MEMORY_CACHE_BYTES", 16<<20)
+
+type lruCache struct {
+	mu       sync.Mutex
+	maxBytes int64
+	bytes    int64
+	// Most recently used at the front
+	order *list.List
+	items map[string]*list.Element
+}
+
+type lruEntry struct {
+	key   string
+	value []byte
+}
+
+// A nil cache (a budget of 0) holds nothing
+func newLRUCache(maxBytes int64) *lruCache {
+	if maxBytes <= 0 {
+		return nil
+	}
+	return &lruCache{maxBytes: maxBytes, order: list.New(), items: make(map[string]*list.Element)}
+}
+
+func (c *lruCache) get(key string) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	return el.Value.(*lruEntry).value, true
+}
+
+// Add or replace an entry, evicting the least recently used ones to stay in
+// budget. Values bigger than the whole budget aren't kept.
+func (c *lruCache) put(key string, value []byte) {
+	if c == nil || int64(len(value)) > c.maxBytes {
+		return
+	}
+	c.mu.Lock()
+	if el, ok := c.items[key]; ok {
+		c.bytes -= int64(len(el.Value.(*lruEntry).value))
+		c.order.Remove(el)
+	}
+	c.items[key] = c.order.PushFront(&lruEntry{key, value})
+	c.bytes += int64(len(value))
+
+	evicted := 0
+	for c.bytes > c.maxBytes {
+		el := c.order.Back()
+		entry := el.Value.(*lruEntry)
+		c.order.Remove(el)
+		delete(c.items, entry.key)
+		c.bytes -= int64(len(entry.value))
+		evicted++
+	}
+	c.mu.Unlock()
+
+	if evicted > 0 {
+		recordCacheEvictions(evicted)
+	}
+}
+
+// Number of entries and their total size
+func (c *lruCache) stats() (int, int64) {
+	if c == nil {
+		return 0, 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len(), c.bytes
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLRUCache(t *testing.T) {
+	c := newLRUCache(10)
+	c.put("a", []byte("aaaa"))
+	c.put("b", []byte("bbbb"))
+	c.get("a") // b is now the least recently used
+
+	metrics.Lock()
+	before := metrics.CacheMemoryEvictions
+	metrics.Unlock()
+
+	c.put("c", []byte("cccc"))
+	if _, ok := c.get("b"); ok {
+		t.Error("b should have been evicted")
+	}
+	for _, key := range []string{"a", "c"} {
+		if _, ok := c.get(key); !ok {
+			t.Errorf("%s should still be cached", key)
+		}
+	}
+	if entries, bytes := c.stats(); entries != 2 || bytes != 8 {
+		t.Errorf("got %d entries in %d bytes", entries, bytes)
+	}
+	metrics.Lock()
+	evicted := metrics.CacheMemoryEvictions - before
+	metrics.Unlock()
+	if evicted != 1 {
+		t.Errorf("expected 1 eviction recorded, got %d", evicted)
+	}
+
+	// Replacing an entry updates its size; oversized values are skipped
+	c.put("a", []byte("a"))
+	c.put("huge", []byte(strings.Repeat("x", 11)))
+	if _, bytes := c.stats(); bytes != 5 {
+		t.Errorf("expected 5 bytes, got %d", bytes)
+	}
+
+	var none *lruCache
+	none.put("a", []byte("a"))
+	if _, ok := none.get("a"); ok || newLRUCache(0) != nil {
+		t.Error("a zero budget should disable the cache")
+	}
+}
+
+func TestRenderCacheMemoryTier(t *testing.T) {
+	cache := withRenderCache(t)
+	cache.put("abcd", []byte("<svg/>"))
+	cache.store.remove(cache.path("abcd"))
+	if svg, ok := cache.get("abcd"); !ok || string(svg) != "<svg/>" {
+		t.Error("recent entries should be served from memory")
+	}
+
+	// Store hits are promoted into memory
+	cache.memory = newLRUCache(1 << 10)
+	cache.store.put(cache.path("efgh"), []byte("<svg></svg>"), "image/svg+xml")
+	cache.get("efgh")
+	if entries, _ := cache.memoryStats(); entries != 1 {
+		t.Errorf("expected the store hit in memory, got %d entries", entries)
+	}
+}
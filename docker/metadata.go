@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Outputs can describe themselves for asset pipelines and cache audits:
+// what was rendered, by which service version from which LDraw library, and
+// with which options. Renders with metadata get a JSON-LD <metadata> block;
+// PNG outputs always carry the same facts as tEXt chunks (see pngtags.go).
+
+// serviceVersion is set at build time:
+//
+//	go build -ldflags "-X main.serviceVersion=v1.2.3"
+var serviceVersion = "dev"
+
+// The LDraw library release, read afresh since the library can be updated
+// under a running server
+func libraryVersion() string {
+	return libraryVersionOf(ldrawPath)
+}
+
+// The release of the library at root
+func libraryVersionOf(root string) string {
+	f, err := os.Open(filepath.Join(root, "LDConfig.ldr"))
+	if err != nil {
+		return "unknown"
+	}
+	defer f.Close()
+	return parseLibraryVersion(f)
+}
+
+// The UPDATE date in LDConfig.ldr's !LDRAW_ORG header, which every library
+// release updates
+func parseLibraryVersion(r io.Reader) string {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		// The header comes before the colors
+		if len(fields) > 0 && fields[0] != "0" || len(fields) >= 2 && fields[1] == "!COLOUR" {
+			break
+		}
+		if len(fields) >= 2 && (fields[1] == "!LDRAW_ORG" || fields[1] == "LDRAW_ORG") {
+			for i, f := range fields[:len(fields)-1] {
+				if f == "UPDATE" {
+					return fields[i+1]
+				}
+			}
+		}
+	}
+	return "unknown"
+}
+
+// A render's metadata, as JSON-LD with schema.org terms where there are
+// some
+type RenderMetadata struct {
+	Context map[string]string `json:"@context"`
+	Type    string            `json:"@type"`
+	// The part number, or a description of an uploaded model
+	Identifier string `json:"identifier"`
+	Creator    struct {
+		Type            string `json:"@type"`
+		Name            string `json:"name"`
+		SoftwareVersion string `json:"softwareVersion"`
+	} `json:"creator"`
+	IsBasedOn struct {
+		Type    string `json:"@type"`
+		Name    string `json:"name"`
+		Version string `json:"version"`
+	} `json:"isBasedOn"`
+	// The cache's version of the script and library; see renderVersion
+	RenderVersion    string        `json:"lego:renderVersion"`
+	RenderParameters RenderOptions `json:"lego:renderParameters"`
+}
+
+func renderMetadata(subject string, opts RenderOptions) RenderMetadata {
+	m := RenderMetadata{
+		Context:       map[string]string{"@vocab": "https://schema.org/", "lego": "https://github.com/breckenedge/lego-part-renderer#"},
+		Type:          "ImageObject",
+		Identifier:    subject,
+		RenderVersion: renderVersionFor(opts.LibraryVersion),
+	}
+	m.Creator.Type, m.Creator.Name, m.Creator.SoftwareVersion = "SoftwareApplication", "lego-part-renderer", serviceVersion
+	m.IsBasedOn.Type, m.IsBasedOn.Name, m.IsBasedOn.Version = "Dataset", "LDraw parts library", libraryVersionOf(libraryPath(opts.LibraryVersion))
+	// Temp paths are nobody's business
+	opts.GhostFile, opts.ObjectsFile = "", ""
+	m.RenderParameters = opts
+	return m
+}
+
+// Put metadata in a <metadata> element at the start of an SVG
+func embedSVGMetadata(svg []byte, meta RenderMetadata) []byte {
+	loc := svgRootPattern.FindIndex(svg)
+	if loc == nil {
+		return svg
+	}
+	// json.Marshal escapes <, >, and &, so the JSON is safe as text
+	data, _ := json.Marshal(meta)
+	block := `<metadata id="render-metadata" data-type="application/ld+json">` + string(data) + "</metadata>\n"
+	out := make([]byte, 0, len(svg)+len(block)+1)
+	out = append(out, svg[:loc[1]]...)
+	out = append(out, '\n')
+	out = append(out, block...)
+	return append(out, svg[loc[1]:]...)
+}
+
+// The tEXt chunks for metadata, as keyword and text
+func (m RenderMetadata) pngText() [][2]string {
+	params, _ := json.Marshal(m.RenderParameters)
+	return [][2]string{
+		{"Title", m.Identifier},
+		{"Software", m.Creator.Name + " " + m.Creator.SoftwareVersion},
+		{"Source", m.IsBasedOn.Name + " " + m.IsBasedOn.Version},
+		{"Render version", m.RenderVersion},
+		{"Render parameters", string(params)},
+	}
+}
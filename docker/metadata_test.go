@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestParseLibraryVersion(t *testing.T) {
+	for config, want := range map[string]string{
+		"0 LDraw.org Configuration File\n0 Name: LDConfig.ldr\n0 !LDRAW_ORG Configuration UPDATE 2024-07-31\n0 !COLOUR Black CODE 0\n": "2024-07-31",
+		testLDConfig: "unknown",
+	} {
+		if got := parseLibraryVersion(strings.NewReader(config)); got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}
+}
+
+func TestRenderPartMetadata(t *testing.T) {
+	withFakeBlender(t)
+	withTestLibrary(t, map[string]string{"3001": "0 Brick 2 x 4\n"})
+	old := serviceVersion
+	serviceVersion = "v1.2.3"
+	t.Cleanup(func() { serviceVersion = old })
+
+	on := true
+	opts, _ := (&RenderRequest{Metadata: &on, FillColor: "red"}).options()
+	svg, _, err := renderPart(context.Background(), "3001", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := regexp.MustCompile(`<metadata id="render-metadata" data-type="application/ld\+json">([^<]*)</metadata>`).FindSubmatch(svg)
+	if m == nil {
+		t.Fatalf("no metadata:\n%s", svg)
+	}
+	var meta RenderMetadata
+	if err := json.Unmarshal(m[1], &meta); err != nil {
+		t.Fatal(err)
+	}
+	if meta.Identifier != "3001" || meta.Creator.SoftwareVersion != "v1.2.3" || meta.RenderVersion != renderVersion() ||
+		meta.RenderParameters.FillColor != "red" || meta.IsBasedOn.Version != "unknown" {
+		t.Errorf("unexpected metadata %+v", meta)
+	}
+}
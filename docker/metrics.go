@@ -0,0 +1,283 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// StatsD/DogStatsD export is enabled by setting STATSD_ADDR (host:port), or
+// by the Datadog agent's DD_AGENT_HOST and DD_DOGSTATSD_PORT. Gauges are
+// sent every STATSD_INTERVAL.
+var (
+	statsdAddr     = getEnv("STATSD_ADDR", datadogAgentAddr())
+	statsdPrefix   = getEnv("STATSD_PREFIX", "lego_renderer.")
+	statsdTags     = getEnv("STATSD_TAGS", "")
+	statsdInterval = getEnvDuration("STATSD_INTERVAL", 10*time.Second)
+)
+
+// The DogStatsD address the Datadog agent's environment variables give,
+// or "" without DD_AGENT_HOST
+func datadogAgentAddr() string {
+	host := os.Getenv("DD_AGENT_HOST")
+	if host == "" {
+		return ""
+	}
+	return net.JoinHostPort(host, getEnv("DD_DOGSTATSD_PORT", "8125"))
+}
+
+// metricsSink receives every metric event as it happens. The in-process
+// Metrics struct backs the pull-based /metrics endpoint (JSON and Prometheus);
+// sinks push the same events elsewhere, and gauges every STATSD_INTERVAL.
+type metricsSink interface {
+	Count(name string, delta int64, tags ...string)
+	Timing(name string, d time.Duration, tags ...string)
+	Gauge(name string, value float64, tags ...string)
+}
+
+var metricsSinks []metricsSink
+
+// Configure push sinks from the environment
+func initMetricsSinks() {
+	if statsdAddr != "" {
+		sink, err := newStatsdSink(statsdAddr, statsdPrefix, splitTags(statsdTags))
+		if err != nil {
+			log.Printf("StatsD disabled: %v", err)
+		} else {
+			metricsSinks = append(metricsSinks, sink)
+			log.Printf("Emitting StatsD metrics to %s", statsdAddr)
+		}
+	}
+	if len(metricsSinks) > 0 {
+		go func() {
+			for range time.Tick(statsdInterval) {
+				reportGauges()
+			}
+		}()
+	}
+}
+
+// Send the /metrics gauges to the push sinks
+func reportGauges() {
+	sat := saturation()
+	entries, bytes := renderCache.memoryStats()
+	for _, s := range metricsSinks {
+		for _, q := range queueNames {
+			s.Gauge("queue_depth", float64(sat.QueueDepth[q]), "queue:"+q)
+		}
+		s.Gauge("active_renders", float64(sat.ActiveRenders))
+		if sat.DispatchWorkers != nil {
+			s.Gauge("dispatch_workers", float64(*sat.DispatchWorkers))
+			s.Gauge("dispatch_workers_busy", float64(*sat.DispatchWorkersBusy))
+		}
+		s.Gauge("memory_cache_entries", float64(entries))
+		s.Gauge("memory_cache_bytes", float64(bytes))
+	}
+}
+
+// Record a successful render
+func recordRender(d time.Duration) {
+	metrics.Lock()
+	metrics.RendersTotal++
+	metrics.RenderDuration.observe(d.Seconds())
+	metrics.RenderLatency.observe(time.Now(), d.Seconds())
+	metrics.Unlock()
+
+	for _, s := range metricsSinks {
+		s.Count("renders_total", 1)
+		s.Timing("render_duration", d)
+	}
+}
+
+// Record a failed request
+func recordError() {
+	metrics.Lock()
+	metrics.Errors++
+	metrics.Unlock()
+
+	for _, s := range metricsSinks {
+		s.Count("errors", 1)
+	}
+}
+
+// Record a render that joined an identical one already running
+func recordRenderCoalesced() {
+	metrics.Lock()
+	metrics.RendersCoalesced++
+	metrics.Unlock()
+
+	for _, s := range metricsSinks {
+		s.Count("renders_coalesced", 1)
+	}
+}
+
+// Record a render cache lookup by the tier that answered it ("memory" or
+// "disk"; "" is a miss)
+func recordCacheLookup(tier string) {
+	name := "cache_misses"
+	metrics.Lock()
+	switch tier {
+	case "memory":
+		metrics.CacheMemoryHits++
+		name = "cache_memory_hits"
+	case "disk":
+		metrics.CacheDiskHits++
+		name = "cache_disk_hits"
+	default:
+		metrics.CacheMisses++
+	}
+	metrics.Unlock()
+
+	for _, s := range metricsSinks {
+		s.Count(name, 1)
+	}
+}
+
+// Record entries evicted from the in-memory render cache
+func recordCacheEvictions(n int) {
+	metrics.Lock()
+	metrics.CacheMemoryEvictions += int64(n)
+	metrics.Unlock()
+
+	for _, s := range metricsSinks {
+		s.Count("cache_memory_evictions", int64(n))
+	}
+}
+
+// Record a queued job cancelled by its client
+func recordJobCancelled() {
+	metrics.Lock()
+	metrics.JobsCancelled++
+	metrics.Unlock()
+
+	for _, s := range metricsSinks {
+		s.Count("jobs_cancelled", 1)
+	}
+}
+
+// Record finished jobs forgotten and the bytes of results dropped by the
+// retention sweep
+func recordJobsExpired(jobs int, bytes int64) {
+	metrics.Lock()
+	metrics.JobsExpired += int64(jobs)
+	metrics.JobBytesReclaimed += bytes
+	metrics.Unlock()
+
+	for _, s := range metricsSinks {
+		s.Count("jobs_expired", int64(jobs))
+		s.Count("job_bytes_reclaimed", bytes)
+	}
+}
+
+// statsdSink writes DogStatsD-compatible UDP packets. Tags use the DogStatsD
+// "|#" extension and are only sent when configured.
+type statsdSink struct {
+	conn   net.Conn
+	prefix string
+	tags   []string
+}
+
+func newStatsdSink(addr, prefix string, tags []string) (*statsdSink, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &statsdSink{conn: conn, prefix: prefix, tags: tags}, nil
+}
+
+func (s *statsdSink) Count(name string, delta int64, tags ...string) {
+	s.send(fmt.Sprintf("%s%s:%d|c", s.prefix, name, delta), tags)
+}
+
+func (s *statsdSink) Timing(name string, d time.Duration, tags ...string) {
+	s.send(fmt.Sprintf("%s%s:%.3f|ms", s.prefix, name, float64(d.Microseconds())/1000), tags)
+}
+
+func (s *statsdSink) Gauge(name string, value float64, tags ...string) {
+	s.send(fmt.Sprintf("%s%s:%g|g", s.prefix, name, value), tags)
+}
+
+// UDP writes are fire-and-forget; a missing agent must never slow renders
+func (s *statsdSink) send(line string, tags []string) {
+	all := append(append([]string{}, s.tags...), tags...)
+	if len(all) > 0 {
+		line += "|#" + strings.Join(all, ",")
+	}
+	s.conn.Write([]byte(line))
+}
+
+func splitTags(s string) []string {
+	var tags []string
+	for _, t := range strings.Split(s, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			tags = append(tags, t)
+		}
+	}
+	return tags
+}
+
+// Prometheus scrapers ask for text/plain or OpenMetrics; everyone else gets JSON
+func wantsPrometheus(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	return r.URL.Query().Get("format") == "prometheus" ||
+		strings.Contains(accept, "text/plain") || strings.Contains(accept, "application/openmetrics-text")
+}
+
+// Write metrics in the Prometheus text exposition format
+func writePrometheusMetrics(w http.ResponseWriter) {
+	sat := saturation()
+	metrics.RLock()
+	defer metrics.RUnlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	fmt.Fprintf(w, "# HELP lego_renderer_renders_total Successful Blender renders.\n")
+	fmt.Fprintf(w, "# TYPE lego_renderer_renders_total counter\n")
+	fmt.Fprintf(w, "lego_renderer_renders_total %d\n", metrics.RendersTotal)
+	fmt.Fprintf(w, "# HELP lego_renderer_errors_total Failed render requests.\n")
+	fmt.Fprintf(w, "# TYPE lego_renderer_errors_total counter\n")
+	fmt.Fprintf(w, "lego_renderer_errors_total %d\n", metrics.Errors)
+	fmt.Fprintf(w, "# HELP lego_renderer_renders_coalesced_total Renders answered by an identical one already running.\n")
+	fmt.Fprintf(w, "# TYPE lego_renderer_renders_coalesced_total counter\n")
+	fmt.Fprintf(w, "lego_renderer_renders_coalesced_total %d\n", metrics.RendersCoalesced)
+	metrics.RenderDuration.writePrometheus(w, "lego_renderer_render_duration_seconds", "Blender render duration.")
+	metrics.QueueWait.writePrometheus(w, "lego_renderer_queue_wait_seconds", "Time prewarm jobs wait in the queue.")
+	metrics.Postprocess.writePrometheus(w, "lego_renderer_postprocess_seconds", "SVG post-processing duration.")
+	metrics.JobQueueWait.writePrometheus(w, "lego_renderer_job_queue_wait_seconds", "Time queued jobs and dispatched renders wait for a worker.")
+	now := time.Now()
+	metrics.RenderLatency.writePrometheus(w, now, "lego_renderer_render_duration_quantile_seconds", "Blender render duration percentiles over sliding windows.")
+	metrics.RequestLatency.writePrometheus(w, now, "lego_renderer_request_duration_quantile_seconds", "Rendering request duration percentiles over sliding windows.")
+	fmt.Fprintf(w, "# HELP lego_renderer_blender_failures_total Failed Blender runs by cause.\n")
+	fmt.Fprintf(w, "# TYPE lego_renderer_blender_failures_total counter\n")
+	for _, cause := range blenderFailureCauses {
+		fmt.Fprintf(w, "lego_renderer_blender_failures_total{cause=\"%s\"} %d\n", cause, metrics.BlenderFailures[cause])
+	}
+	fmt.Fprintf(w, "# HELP lego_renderer_cache_lookups_total Render cache lookups by the tier that answered.\n")
+	fmt.Fprintf(w, "# TYPE lego_renderer_cache_lookups_total counter\n")
+	fmt.Fprintf(w, "lego_renderer_cache_lookups_total{result=\"memory\"} %d\n", metrics.CacheMemoryHits)
+	fmt.Fprintf(w, "lego_renderer_cache_lookups_total{result=\"disk\"} %d\n", metrics.CacheDiskHits)
+	fmt.Fprintf(w, "lego_renderer_cache_lookups_total{result=\"miss\"} %d\n", metrics.CacheMisses)
+	fmt.Fprintf(w, "# HELP lego_renderer_memory_cache_evictions_total Renders evicted from the in-memory cache.\n")
+	fmt.Fprintf(w, "# TYPE lego_renderer_memory_cache_evictions_total counter\n")
+	fmt.Fprintf(w, "lego_renderer_memory_cache_evictions_total %d\n", metrics.CacheMemoryEvictions)
+	fmt.Fprintf(w, "# HELP lego_renderer_jobs_cancelled_total Queued jobs cancelled before they finished.\n")
+	fmt.Fprintf(w, "# TYPE lego_renderer_jobs_cancelled_total counter\n")
+	fmt.Fprintf(w, "lego_renderer_jobs_cancelled_total %d\n", metrics.JobsCancelled)
+	fmt.Fprintf(w, "# HELP lego_renderer_jobs_expired_total Finished jobs forgotten after their retention period.\n")
+	fmt.Fprintf(w, "# TYPE lego_renderer_jobs_expired_total counter\n")
+	fmt.Fprintf(w, "lego_renderer_jobs_expired_total %d\n", metrics.JobsExpired)
+	fmt.Fprintf(w, "# HELP lego_renderer_job_reclaimed_bytes_total Bytes of job results dropped after their retention period.\n")
+	fmt.Fprintf(w, "# TYPE lego_renderer_job_reclaimed_bytes_total counter\n")
+	fmt.Fprintf(w, "lego_renderer_job_reclaimed_bytes_total %d\n", metrics.JobBytesReclaimed)
+	entries, bytes := renderCache.memoryStats()
+	fmt.Fprintf(w, "# HELP lego_renderer_memory_cache_entries Renders held in the in-memory cache.\n")
+	fmt.Fprintf(w, "# TYPE lego_renderer_memory_cache_entries gauge\n")
+	fmt.Fprintf(w, "lego_renderer_memory_cache_entries %d\n", entries)
+	fmt.Fprintf(w, "# HELP lego_renderer_memory_cache_bytes Size of the renders in the in-memory cache.\n")
+	fmt.Fprintf(w, "# TYPE lego_renderer_memory_cache_bytes gauge\n")
+	fmt.Fprintf(w, "lego_renderer_memory_cache_bytes %d\n", bytes)
+	sat.writePrometheus(w, metrics.Rejected)
+}
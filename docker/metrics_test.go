@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatsdSink(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer pc.Close()
+
+	sink, err := newStatsdSink(pc.LocalAddr().String(), "lego.", []string{"env:test"})
+	if err != nil {
+		t.Fatalf("newStatsdSink: %v", err)
+	}
+
+	sink.Count("renders_total", 1)
+	sink.Timing("render_duration", 1500*time.Millisecond, "part:3001")
+	sink.Gauge("queue_depth", 7, "queue:jobs")
+
+	want := []string{
+		"lego.renders_total:1|c|#env:test",
+		"lego.render_duration:1500.000|ms|#env:test,part:3001",
+		"lego.queue_depth:7|g|#env:test,queue:jobs",
+	}
+	buf := make([]byte, 512)
+	for _, w := range want {
+		pc.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := pc.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("reading packet: %v", err)
+		}
+		if got := string(buf[:n]); got != w {
+			t.Errorf("got %q, want %q", got, w)
+		}
+	}
+}
+
+func TestSplitTags(t *testing.T) {
+	got := splitTags(" env:prod, ,region:us ")
+	if strings.Join(got, "|") != "env:prod|region:us" {
+		t.Errorf("unexpected tags %v", got)
+	}
+}
+
+// Records the events sent to it
+type recordingSink struct {
+	events []string
+}
+
+func (r *recordingSink) Count(name string, delta int64, tags ...string) {
+	r.events = append(r.events, fmt.Sprintf("%s %d %v", name, delta, tags))
+}
+
+func (r *recordingSink) Timing(name string, d time.Duration, tags ...string) {
+	r.events = append(r.events, fmt.Sprintf("%s %v %v", name, d, tags))
+}
+
+func (r *recordingSink) Gauge(name string, value float64, tags ...string) {
+	r.events = append(r.events, fmt.Sprintf("%s %g %v", name, value, tags))
+}
+
+func TestReportGauges(t *testing.T) {
+	sink := &recordingSink{}
+	old := metricsSinks
+	metricsSinks = []metricsSink{sink}
+	defer func() { metricsSinks = old }()
+
+	reportGauges()
+	got := strings.Join(sink.events, "\n")
+	for _, want := range []string{"queue_depth 0 [queue:prewarm]", "queue_depth 0 [queue:dispatch]", "active_renders 0 []", "memory_cache_bytes 0 []"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("missing %q in gauges:\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, "dispatch_workers") {
+		t.Errorf("expected no dispatcher gauges without a dispatcher:\n%s", got)
+	}
+}
+
+func TestDatadogAgentAddr(t *testing.T) {
+	t.Setenv("DD_AGENT_HOST", "")
+	if addr := datadogAgentAddr(); addr != "" {
+		t.Errorf("expected no address without DD_AGENT_HOST, got %q", addr)
+	}
+	t.Setenv("DD_AGENT_HOST", "datadog-agent")
+	if addr := datadogAgentAddr(); addr != "datadog-agent:8125" {
+		t.Errorf("got %q", addr)
+	}
+	t.Setenv("DD_DOGSTATSD_PORT", "9125")
+	if addr := datadogAgentAddr(); addr != "datadog-agent:9125" {
+		t.Errorf("got %q", addr)
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Persistent state (caches, job stores, artifacts) lives under STATE_DIR.
+// An empty value keeps the service fully stateless.
+var (
+	stateDir         = getEnv("STATE_DIR", "")
+	stateBackupsKeep = getEnvInt("STATE_BACKUPS_KEEP", 3)
+)
+
+const (
+	stateVersionFile = "VERSION"
+	stateBackupsDir  = ".backups"
+	// The render cache (see cache.go) is rebuilt on demand, so backups
+	// leave it out
+	stateRendersDir = "renders"
+)
+
+// A migration upgrades the state directory from Version-1 to Version.
+type migration struct {
+	Version     int
+	Description string
+	Up          func(dir string) error
+}
+
+// migrations must be ordered by version, starting at 1 and without gaps.
+// Add new entries at the end whenever an on-disk format changes.
+var migrations = []migration{
+	{1, "record state format version", func(dir string) error { return nil }},
+}
+
+type stateVersion struct {
+	Version    int       `json:"version"`
+	MigratedAt time.Time `json:"migrated_at"`
+}
+
+// Bring the state directory up to the latest format. Before the first
+// pending migration runs, the current state is copied to a backup; if any
+// migration fails, the state is restored from it and the version is left
+// unchanged.
+func migrateState(dir string, migrations []migration) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("creating state dir: %w", err)
+	}
+
+	current, err := readStateVersion(dir)
+	if err != nil {
+		return err
+	}
+	latest := len(migrations)
+	if current > latest {
+		return fmt.Errorf("state version %d is newer than this server supports (%d); restore a backup from %s or upgrade the server",
+			current, latest, filepath.Join(dir, stateBackupsDir))
+	}
+	if current == latest {
+		log.Printf("State at %s is up to date (version %d)", dir, current)
+		return nil
+	}
+
+	backup := filepath.Join(dir, stateBackupsDir, fmt.Sprintf("v%d-%s", current, time.Now().UTC().Format("20060102T150405Z")))
+	if err := copyState(dir, backup); err != nil {
+		return fmt.Errorf("backing up state: %w", err)
+	}
+	log.Printf("Backed up state version %d to %s", current, backup)
+
+	for _, m := range migrations[current:] {
+		log.Printf("Migrating state to version %d: %s", m.Version, m.Description)
+		err := m.Up(dir)
+		if err == nil {
+			err = writeStateVersion(dir, m.Version)
+		}
+		if err != nil {
+			if rerr := restoreState(backup, dir); rerr != nil {
+				return fmt.Errorf("migration %d failed: %v; rollback also failed: %v", m.Version, err, rerr)
+			}
+			return fmt.Errorf("migration %d failed and state was rolled back to version %d: %w", m.Version, current, err)
+		}
+	}
+
+	pruneStateBackups(filepath.Join(dir, stateBackupsDir), stateBackupsKeep)
+	log.Printf("State migrated from version %d to %d", current, latest)
+	return nil
+}
+
+func readStateVersion(dir string) (int, error) {
+	data, err := os.ReadFile(filepath.Join(dir, stateVersionFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("reading state version: %w", err)
+	}
+	var v stateVersion
+	if err := json.Unmarshal(data, &v); err != nil {
+		return 0, fmt.Errorf("parsing state version: %w", err)
+	}
+	return v.Version, nil
+}
+
+// Write the version file atomically so a crash never leaves it half-written
+func writeStateVersion(dir string, version int) error {
+	data, _ := json.Marshal(stateVersion{Version: version, MigratedAt: time.Now().UTC()})
+	tmp := filepath.Join(dir, stateVersionFile+".tmp")
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return fmt.Errorf("writing state version: %w", err)
+	}
+	return os.Rename(tmp, filepath.Join(dir, stateVersionFile))
+}
+
+// Copy everything in the state dir except the backups themselves and the
+// render cache
+func copyState(src, dst string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(src, path)
+		if rel == stateBackupsDir || rel == stateRendersDir {
+			return filepath.SkipDir
+		}
+		target := filepath.Join(dst, rel)
+		if info.IsDir() {
+			return os.MkdirAll(target, info.Mode().Perm())
+		}
+		return copyFile(path, target, info.Mode().Perm())
+	})
+}
+
+// Replace the state dir contents (except backups and the render cache) with
+// a backup
+func restoreState(backup, dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.Name() == stateBackupsDir || e.Name() == stateRendersDir {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(dir, e.Name())); err != nil {
+			return err
+		}
+	}
+	return copyState(backup, dir)
+}
+
+// Remove all but the newest keep backups
+func pruneStateBackups(dir string, keep int) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	var names []string
+	for _, e := range entries {
+		if e.IsDir() {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return backupTime(names[i]).Before(backupTime(names[j]))
+	})
+	for len(names) > keep {
+		log.Printf("Removing old state backup %s", names[0])
+		os.RemoveAll(filepath.Join(dir, names[0]))
+		names = names[1:]
+	}
+}
+
+func backupTime(name string) time.Time {
+	for i := len(name) - 1; i >= 0; i-- {
+		if name[i] == '-' {
+			t, _ := time.Parse("20060102T150405Z", name[i+1:])
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func copyFile(src, dst string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
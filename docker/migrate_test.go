@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMigrateState(t *testing.T) {
+	dir := t.TempDir()
+	var ran []int
+	ms := []migration{
+		{1, "first", func(dir string) error { ran = append(ran, 1); return nil }},
+		{2, "second", func(dir string) error {
+			ran = append(ran, 2)
+			return os.WriteFile(filepath.Join(dir, "layout"), []byte("v2"), 0o644)
+		}},
+	}
+
+	if err := migrateState(dir, ms); err != nil {
+		t.Fatalf("migrateState: %v", err)
+	}
+	if v, _ := readStateVersion(dir); v != 2 {
+		t.Fatalf("expected version 2, got %d", v)
+	}
+	if len(ran) != 2 {
+		t.Fatalf("expected both migrations to run, ran %v", ran)
+	}
+
+	// Running again is a no-op
+	if err := migrateState(dir, ms); err != nil {
+		t.Fatalf("second migrateState: %v", err)
+	}
+	if len(ran) != 2 {
+		t.Fatalf("migrations re-ran: %v", ran)
+	}
+}
+
+func TestMigrateStateRollback(t *testing.T) {
+	dir := t.TempDir()
+	ok := []migration{{1, "first", func(dir string) error {
+		return os.WriteFile(filepath.Join(dir, "data"), []byte("original"), 0o644)
+	}}}
+	if err := migrateState(dir, ok); err != nil {
+		t.Fatalf("migrateState: %v", err)
+	}
+
+	failing := append(ok, migration{2, "broken", func(dir string) error {
+		os.WriteFile(filepath.Join(dir, "data"), []byte("half-migrated"), 0o644)
+		return errors.New("boom")
+	}})
+	if err := migrateState(dir, failing); err == nil {
+		t.Fatal("expected migration error")
+	}
+
+	if v, _ := readStateVersion(dir); v != 1 {
+		t.Errorf("expected version to stay at 1, got %d", v)
+	}
+	data, _ := os.ReadFile(filepath.Join(dir, "data"))
+	if string(data) != "original" {
+		t.Errorf("expected state to be rolled back, got %q", data)
+	}
+}
+
+// The server's migrations, then a fixture that rewrites usage.json and the
+// render cache before failing
+func TestMigrateStateBackupAndRollback(t *testing.T) {
+	dir := t.TempDir()
+	render := filepath.Join(dir, stateRendersDir, "ab", "abcd.svg")
+	usage := filepath.Join(dir, "usage.json")
+	os.MkdirAll(filepath.Dir(render), 0o755)
+	os.WriteFile(render, []byte("<svg/>"), 0o644)
+	os.WriteFile(usage, []byte(`{"k1": 1}`), 0o644)
+	if err := migrateState(dir, migrations); err != nil {
+		t.Fatal(err)
+	}
+
+	failing := append(append([]migration{}, migrations...), migration{len(migrations) + 1, "rewrite usage", func(dir string) error {
+		os.WriteFile(usage, []byte(`{"k1": {"renders": 1}}`), 0o644)
+		os.WriteFile(render, []byte("<svg>new</svg>"), 0o644)
+		return errors.New("boom")
+	}})
+	if err := migrateState(dir, failing); err == nil {
+		t.Fatal("expected the fixture migration to fail")
+	}
+	if v, _ := readStateVersion(dir); v != len(migrations) {
+		t.Errorf("expected version to stay at %d, got %d", len(migrations), v)
+	}
+	if data, _ := os.ReadFile(usage); string(data) != `{"k1": 1}` {
+		t.Errorf("expected usage.json rolled back, got %s", data)
+	}
+	// The render cache is neither backed up nor restored
+	if data, _ := os.ReadFile(render); string(data) != "<svg>new</svg>" {
+		t.Errorf("expected the render cache left alone, got %s", data)
+	}
+	backups, _ := filepath.Glob(filepath.Join(dir, stateBackupsDir, "*"))
+	for _, b := range backups {
+		if _, err := os.Stat(filepath.Join(b, stateRendersDir)); err == nil {
+			t.Errorf("backup %s includes the render cache", b)
+		}
+		if _, err := os.Stat(filepath.Join(b, "usage.json")); err != nil {
+			t.Errorf("backup %s is missing usage.json", b)
+		}
+	}
+}
+
+func TestMigrateStatePrunesBackups(t *testing.T) {
+	dir := t.TempDir()
+	old := stateBackupsKeep
+	stateBackupsKeep = 2
+	t.Cleanup(func() { stateBackupsKeep = old })
+	for _, name := range []string{"v0-20240101T000000Z", "v1-20240201T000000Z", "v2-20240301T000000Z"} {
+		os.MkdirAll(filepath.Join(dir, stateBackupsDir, name), 0o755)
+	}
+
+	if err := migrateState(dir, migrations); err != nil {
+		t.Fatal(err)
+	}
+	entries, _ := os.ReadDir(filepath.Join(dir, stateBackupsDir))
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 backups kept, got %d", len(entries))
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	// Listed by name, so this run's backup comes first
+	newest := "v0-" + time.Now().UTC().Format("20060102")
+	if !strings.HasPrefix(names[0], newest) || names[1] != "v2-20240301T000000Z" {
+		t.Errorf("expected the newest backups kept, got %v", names)
+	}
+}
+
+func TestMigrateStateRejectsNewerVersion(t *testing.T) {
+	dir := t.TempDir()
+	if err := writeStateVersion(dir, 5); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrateState(dir, migrations); err == nil {
+		t.Fatal("expected error for state newer than the server")
+	}
+}
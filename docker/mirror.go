@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// mirror reflects the model across one or more of the LDraw axes before
+// it's framed, for the other hand of a left/right pair (wings, panels,
+// wedge plates) when the library only has one of them. "x" swaps left and
+// right, "y" top and bottom, and "z" front and back; axes combine, so
+// "xz" is a half turn about Y. The reflection comes after orientation
+// normalization and applies to ghosts and separate objects alike.
+const mirrorAxes = "xyz"
+
+// Check a mirror value and put its axes in canonical order: "none" for no
+// reflection, otherwise some of x, y, and z
+func parseMirror(value string) (string, error) {
+	if value == "" || value == "none" {
+		return "none", nil
+	}
+	var axes strings.Builder
+	for _, axis := range mirrorAxes {
+		switch strings.Count(value, string(axis)) {
+		case 0:
+		case 1:
+			axes.WriteRune(axis)
+		default:
+			return "", fmt.Errorf("mirror names %c twice", axis)
+		}
+	}
+	if axes.Len() != len(value) {
+		return "", fmt.Errorf("mirror must be none or some of x, y, and z")
+	}
+	return axes.String(), nil
+}
+
+// The mirror argument render_part.py takes; options the request didn't set
+// are none
+func scriptMirror(mirror string) string {
+	if mirror == "" {
+		return "none"
+	}
+	return mirror
+}
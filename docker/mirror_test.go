@@ -0,0 +1,24 @@
+package main
+
+import "testing"
+
+func TestParseMirror(t *testing.T) {
+	for _, tt := range []struct {
+		value, want string
+		ok          bool
+	}{
+		{"", "none", true},
+		{"none", "none", true},
+		{"x", "x", true},
+		{"zx", "xz", true},
+		{"yzx", "xyz", true},
+		{"xx", "", false},
+		{"w", "", false},
+		{"x,y", "", false},
+	} {
+		got, err := parseMirror(tt.value)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("parseMirror(%q) = %q, %v", tt.value, got, err)
+		}
+	}
+}
@@ -0,0 +1,451 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Stud.io protects .io archives with a fixed ZipCrypto password
+var studioPassword = getEnv("STUDIO_IO_PASSWORD", "soho0909")
+
+const modelMaxBytes = 16 << 20
+
+// Model file formats accepted by /render/model
+const (
+	modelFormatLDraw  = "ldraw"
+	modelFormatStudio = "studio"
+	modelFormatLDCad  = "ldcad"
+)
+
+// ModelRequest is the multipart "options" field of /render/model: the
+// /render options plus the MPD submodel to render
+type ModelRequest struct {
+	RenderRequest
+	// Submodel names the 0 FILE section to render instead of the main model
+	Submodel string `json:"submodel"`
+	// ColorOverrides maps subfile references ("3001.dat", "roof.ldr", or
+	// "*" for every other part) to LDraw color codes. Setting any fills
+	// parts with their LDraw colors instead of fillColor.
+	ColorOverrides map[string]int `json:"colorOverrides"`
+	// PartColors maps subfile references to fill and stroke colors for the
+	// parts they place, drawn as separate objects; see objects.go
+	PartColors map[string]PartColors `json:"partColors"`
+}
+
+// Model render endpoint: upload an LDraw (.ldr/.mpd), Stud.io (.io), or
+// LDCad model and render it as SVG
+func handleRenderModel(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		sendError(w, http.StatusMethodNotAllowed, "Method not allowed", "")
+		return
+	}
+
+	data, err := readUpload(w, r, modelMaxBytes)
+	if err != nil {
+		sendError(w, http.StatusBadRequest, "Invalid upload", err.Error())
+		return
+	}
+	if len(data) == 0 {
+		sendError(w, http.StatusBadRequest, "Model file is required", "")
+		return
+	}
+
+	// Render options come from a multipart "options" field as /render JSON
+	var req ModelRequest
+	if opts := r.FormValue("options"); opts != "" {
+		if err := json.Unmarshal([]byte(opts), &req); err != nil {
+			sendError(w, http.StatusBadRequest, "Invalid options JSON", err.Error())
+			return
+		}
+	}
+	opts, err := req.options()
+	if err != nil {
+		sendValidationError(w, err)
+		return
+	}
+
+	model, format, err := normalizeModel(data)
+	if err != nil {
+		sendError(w, http.StatusBadRequest, "Unsupported model file", err.Error())
+		return
+	}
+	label := "uploaded " + format + " model"
+	if req.Submodel != "" {
+		if model, err = selectSubmodel(model, req.Submodel); err != nil {
+			sendRenderError(w, err)
+			return
+		}
+		label += " submodel " + req.Submodel
+	}
+	if len(req.ColorOverrides) > 0 {
+		overrides, err := validateColorOverrides(req.ColorOverrides)
+		if err != nil {
+			sendError(w, http.StatusBadRequest, err.Error(), "")
+			return
+		}
+		model = applyColorOverrides(model, overrides)
+		opts.FillMode = "ldraw"
+	}
+	partColors, err := validatePartColors(req.PartColors)
+	if err != nil {
+		sendError(w, http.StatusBadRequest, err.Error(), "")
+		return
+	}
+
+	modelFile, ghostFile, objectsFile, cleanup, err := writeModelFile(model, partColors)
+	if err != nil {
+		recordError()
+		sendError(w, http.StatusInternalServerError, "Failed to write model", err.Error())
+		return
+	}
+	defer cleanup()
+	opts.GhostFile, opts.ObjectsFile = ghostFile, objectsFile
+
+	start := time.Now()
+	svgContent, renderDuration, err := renderFile(r.Context(), label, modelFile, opts)
+	if err != nil {
+		sendRenderError(w, err)
+		return
+	}
+	log.Printf("Total request duration: %.2fs", time.Since(start).Seconds())
+	if opts.Metadata {
+		svgContent = embedSVGMetadata(svgContent, renderMetadata(label, opts))
+	}
+
+	w.Header().Set("Content-Type", "image/svg+xml")
+	w.Header().Set("X-Model-Format", format)
+	w.Header().Set("X-Render-Duration", fmt.Sprintf("%.2fs", renderDuration.Seconds()))
+	writeSVG(w, r, svgContent)
+}
+
+// Write a normalized model to a temp directory. MPD files get the .mpd
+// extension so the importer treats embedded FILE sections as subfiles.
+// GHOST lines go to a separate ghost file, and parts with their own colors
+// to an objects file; either is returned as "" if there's nothing in it.
+func writeModelFile(model []byte, partColors map[string]PartColors) (string, string, string, func(), error) {
+	dir, err := os.MkdirTemp("", "model-*")
+	if err != nil {
+		return "", "", "", nil, err
+	}
+	cleanup := func() { os.RemoveAll(dir) }
+
+	ext := ".ldr"
+	if isMPD(model) {
+		ext = ".mpd"
+	}
+	solid, ghost := splitGhosts(model)
+	solid, objects := splitObjects(solid, partColors)
+	modelFile := filepath.Join(dir, "model"+ext)
+	if err := os.WriteFile(modelFile, solid, 0o644); err != nil {
+		cleanup()
+		return "", "", "", nil, err
+	}
+	ghostFile := ""
+	if ghost != nil {
+		ghostFile = filepath.Join(dir, "ghost"+ext)
+		if err := os.WriteFile(ghostFile, ghost, 0o644); err != nil {
+			cleanup()
+			return "", "", "", nil, err
+		}
+	}
+	objectsFile := ""
+	if len(objects) > 0 {
+		if objectsFile, err = writeObjectsFile(dir, objects); err != nil {
+			cleanup()
+			return "", "", "", nil, err
+		}
+	}
+	return modelFile, ghostFile, objectsFile, cleanup, nil
+}
+
+// Detect the model format and return plain LDraw (LDR or MPD) text
+func normalizeModel(data []byte) ([]byte, string, error) {
+	if bytes.HasPrefix(data, []byte("PK\x03\x04")) {
+		model, err := extractStudioModel(data)
+		if err != nil {
+			return nil, "", err
+		}
+		return cleanLDraw(model), modelFormatStudio, nil
+	}
+
+	if !isLDrawText(data) {
+		return nil, "", errors.New("file is neither LDraw text nor a Stud.io archive")
+	}
+	format := modelFormatLDraw
+	if bytes.Contains(data, []byte("0 !LDCAD")) {
+		format = modelFormatLDCad
+	}
+	return cleanLDraw(data), format, nil
+}
+
+// Strip editor-specific meta commands and normalize line endings. LDCad
+// and Stud.io store their own metadata (flex path points, texture blobs) as
+// 0-lines that the importer doesn't need; geometry is left untouched.
+func cleanLDraw(data []byte) []byte {
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	var out bytes.Buffer
+	for _, line := range strings.Split(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[0] == "0" {
+			if fields[1] == "!LDCAD" || strings.HasPrefix(strings.TrimPrefix(fields[1], "!"), "PE_TEX_") {
+				continue
+			}
+		}
+		out.WriteString(strings.TrimRight(line, " \t\r"))
+		out.WriteByte('\n')
+	}
+	return bytes.TrimRight(out.Bytes(), "\n")
+}
+
+// Make the named MPD submodel the main model by moving its FILE section
+// first. The other sections stay, as the submodel may place them.
+func selectSubmodel(model []byte, name string) ([]byte, error) {
+	if !isMPD(model) {
+		return nil, &RenderError{http.StatusBadRequest, "Model has no submodels", "submodel requires an MPD model"}
+	}
+
+	var sections []string
+	var current strings.Builder
+	for _, line := range strings.SplitAfter(string(model), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 3 && fields[0] == "0" && fields[1] == "FILE" && current.Len() > 0 {
+			sections = append(sections, current.String())
+			current.Reset()
+		}
+		current.WriteString(line)
+	}
+	sections = append(sections, current.String())
+
+	var names []string
+	for i, section := range sections {
+		first, _, _ := strings.Cut(section, "\n")
+		fields := strings.Fields(first)
+		if len(fields) < 3 || fields[0] != "0" || fields[1] != "FILE" {
+			continue
+		}
+		sectionName := strings.Join(fields[2:], " ")
+		if mpdKey(sectionName) != mpdKey(name) {
+			names = append(names, sectionName)
+			continue
+		}
+		if i == 0 {
+			return model, nil
+		}
+		if !strings.HasSuffix(section, "\n") {
+			section += "\n"
+		}
+		reordered := section + strings.Join(sections[:i], "") + strings.Join(sections[i+1:], "")
+		return []byte(reordered), nil
+	}
+	return nil, &RenderError{http.StatusNotFound, "Submodel not found", fmt.Sprintf("%s is not in the model; it has %s", name, strings.Join(names, ", "))}
+}
+
+func isMPD(data []byte) bool {
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[0] == "0" && fields[1] == "FILE" {
+			return true
+		}
+	}
+	return false
+}
+
+// LDraw files are text where every non-blank line starts with a line type 0-5
+func isLDrawText(data []byte) bool {
+	lines := 0
+	for _, line := range strings.Split(string(bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if line[0] < '0' || line[0] > '5' {
+			return false
+		}
+		lines++
+	}
+	return lines > 0
+}
+
+// Extract the LDraw model from a Stud.io .io archive. Custom parts bundled
+// under CustomParts/ are inlined as MPD subfiles so they resolve without
+// touching the shared library.
+func extractStudioModel(data []byte) ([]byte, error) {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, fmt.Errorf("reading Stud.io archive: %v", err)
+	}
+
+	files := make(map[string]*zip.File)
+	for _, f := range zr.File {
+		files[f.Name] = f
+	}
+
+	modelEntry := files["model.ldr"]
+	if modelEntry == nil {
+		return nil, errors.New("Stud.io archive has no model.ldr")
+	}
+	// Entries inflate, so what they extract to is capped as the upload is
+	remaining := int64(modelMaxBytes)
+	model, err := readZipEntry(modelEntry, remaining)
+	if err != nil {
+		return nil, err
+	}
+	remaining -= int64(len(model))
+
+	var custom []string
+	for name := range files {
+		if strings.HasPrefix(name, "CustomParts/") && strings.HasSuffix(strings.ToLower(name), ".dat") {
+			custom = append(custom, name)
+		}
+	}
+	if len(custom) == 0 {
+		return model, nil
+	}
+	sort.Strings(custom)
+
+	var mpd bytes.Buffer
+	if !isMPD(model) {
+		mpd.WriteString("0 FILE model.ldr\n")
+	}
+	mpd.Write(bytes.TrimRight(model, "\r\n"))
+	mpd.WriteString("\n")
+	for _, name := range custom {
+		content, err := readZipEntry(files[name], remaining)
+		if err != nil {
+			return nil, err
+		}
+		remaining -= int64(len(content))
+		fmt.Fprintf(&mpd, "0 NOFILE\n0 FILE %s\n", customPartReference(name))
+		mpd.Write(bytes.TrimRight(content, "\r\n"))
+		mpd.WriteString("\n")
+	}
+	mpd.WriteString("0 NOFILE\n")
+	return mpd.Bytes(), nil
+}
+
+// Turn CustomParts/parts/s/foo.dat into the reference name "s\foo.dat"
+func customPartReference(name string) string {
+	rel := strings.TrimPrefix(name, "CustomParts/")
+	for _, dir := range []string{"parts/", "p/"} {
+		if strings.HasPrefix(rel, dir) {
+			rel = strings.TrimPrefix(rel, dir)
+			break
+		}
+	}
+	return strings.ReplaceAll(path.Clean(rel), "/", `\`)
+}
+
+// Read a zip entry of at most limit bytes, decrypting traditional PKWARE
+// (ZipCrypto) encryption with the Stud.io password when the entry is
+// encrypted. The size in the entry's header isn't trusted past the check up
+// front; reads stop at the limit whatever it says.
+func readZipEntry(f *zip.File, limit int64) ([]byte, error) {
+	tooLarge := fmt.Errorf("%s: Stud.io archive extracts to more than %d bytes", f.Name, modelMaxBytes)
+	if limit < 0 || f.UncompressedSize64 > uint64(limit) {
+		return nil, tooLarge
+	}
+	readLimited := func(r io.Reader) ([]byte, error) {
+		content, err := io.ReadAll(io.LimitReader(r, limit+1))
+		if err == nil && int64(len(content)) > limit {
+			return nil, tooLarge
+		}
+		return content, err
+	}
+
+	if f.Flags&0x1 == 0 {
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+		return readLimited(rc)
+	}
+
+	raw, err := f.OpenRaw()
+	if err != nil {
+		return nil, err
+	}
+	encrypted, err := io.ReadAll(raw)
+	if err != nil {
+		return nil, err
+	}
+	if len(encrypted) < 12 {
+		return nil, fmt.Errorf("%s: truncated encryption header", f.Name)
+	}
+
+	plain := zipCryptoDecrypt(encrypted, []byte(studioPassword))[12:]
+	var content []byte
+	switch f.Method {
+	case zip.Store:
+		if int64(len(plain)) > limit {
+			return nil, tooLarge
+		}
+		content = plain
+	case zip.Deflate:
+		content, err = readLimited(flate.NewReader(bytes.NewReader(plain)))
+		if err == tooLarge {
+			return nil, err
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: decrypting with the Stud.io password failed: %v", f.Name, err)
+		}
+	default:
+		return nil, fmt.Errorf("%s: unsupported compression method %d", f.Name, f.Method)
+	}
+
+	if crc32.ChecksumIEEE(content) != f.CRC32 {
+		return nil, fmt.Errorf("%s: checksum mismatch after decryption", f.Name)
+	}
+	return content, nil
+}
+
+// zipCryptoKeys implements the traditional PKWARE stream cipher
+type zipCryptoKeys [3]uint32
+
+func newZipCryptoKeys(password []byte) *zipCryptoKeys {
+	k := &zipCryptoKeys{305419896, 591751049, 878082192}
+	for _, b := range password {
+		k.update(b)
+	}
+	return k
+}
+
+func (k *zipCryptoKeys) update(b byte) {
+	k[0] = crc32Update(k[0], b)
+	k[1] = (k[1]+(k[0]&0xff))*134775813 + 1
+	k[2] = crc32Update(k[2], byte(k[1]>>24))
+}
+
+func (k *zipCryptoKeys) stream() byte {
+	t := k[2] | 2
+	return byte((t * (t ^ 1)) >> 8)
+}
+
+func crc32Update(crc uint32, b byte) uint32 {
+	return crc32.IEEETable[(crc^uint32(b))&0xff] ^ (crc >> 8)
+}
+
+func zipCryptoDecrypt(data, password []byte) []byte {
+	k := newZipCryptoKeys(password)
+	out := make([]byte, len(data))
+	for i, c := range data {
+		p := c ^ k.stream()
+		k.update(p)
+		out[i] = p
+	}
+	return out
+}
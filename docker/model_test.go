@@ -0,0 +1,182 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"errors"
+	"hash/crc32"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// Build a .io-style archive with ZipCrypto-encrypted, stored entries
+func buildStudioArchive(t *testing.T, entries map[string]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, content := range entries {
+		plain := append(make([]byte, 12), content...)
+		k := newZipCryptoKeys([]byte(studioPassword))
+		enc := make([]byte, len(plain))
+		for i, p := range plain {
+			enc[i] = p ^ k.stream()
+			k.update(p)
+		}
+		w, err := zw.CreateRaw(&zip.FileHeader{
+			Name:               name,
+			Method:             zip.Store,
+			Flags:              0x1,
+			CRC32:              crc32.ChecksumIEEE([]byte(content)),
+			CompressedSize64:   uint64(len(enc)),
+			UncompressedSize64: uint64(len(content)),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(enc)
+	}
+	zw.Close()
+	return buf.Bytes()
+}
+
+func TestNormalizeStudioModel(t *testing.T) {
+	archive := buildStudioArchive(t, map[string]string{
+		"model.ldr":                          "0 My MOC\r\n0 PE_TEX_PATH -1\r\n1 4 0 0 0 1 0 0 0 1 0 0 0 1 3001.dat\r\n1 15 0 -24 0 1 0 0 0 1 0 0 0 1 custom1.dat\r\n",
+		"CustomParts/parts/custom1.dat":      "0 Custom part\n1 16 0 0 0 1 0 0 0 1 0 0 0 1 s\\custom1s01.dat\n",
+		"CustomParts/parts/s/custom1s01.dat": "0 Custom subpart\n3 16 0 0 0 1 0 0 0 0 1\n",
+	})
+
+	model, format, err := normalizeModel(archive)
+	if err != nil {
+		t.Fatalf("normalizeModel: %v", err)
+	}
+	if format != modelFormatStudio {
+		t.Errorf("expected studio format, got %s", format)
+	}
+
+	s := string(model)
+	for _, want := range []string{
+		"0 FILE model.ldr\n",
+		"1 4 0 0 0 1 0 0 0 1 0 0 0 1 3001.dat\n",
+		"0 FILE custom1.dat\n",
+		"0 FILE s\\custom1s01.dat\n",
+	} {
+		if !strings.Contains(s, want) {
+			t.Errorf("normalized model missing %q:\n%s", want, s)
+		}
+	}
+	if strings.Contains(s, "PE_TEX") || strings.Contains(s, "\r") {
+		t.Errorf("Stud.io metadata or CRLF left in model:\n%s", s)
+	}
+	if !isMPD(model) {
+		t.Error("model with custom parts should be an MPD")
+	}
+}
+
+func TestNormalizeLDCadModel(t *testing.T) {
+	in := "0 FILE main.ldr\n0 !LDCAD PATH_POINT [type=bezier]\n1 0 0 0 0 1 0 0 0 1 0 0 0 1 3001.dat\n0 NOFILE\n"
+	model, format, err := normalizeModel([]byte(in))
+	if err != nil {
+		t.Fatalf("normalizeModel: %v", err)
+	}
+	if format != modelFormatLDCad {
+		t.Errorf("expected ldcad format, got %s", format)
+	}
+	if strings.Contains(string(model), "!LDCAD") {
+		t.Errorf("LDCad meta left in model:\n%s", model)
+	}
+	if !strings.Contains(string(model), "3001.dat") {
+		t.Errorf("geometry was stripped:\n%s", model)
+	}
+}
+
+func TestNormalizeModelRejectsGarbage(t *testing.T) {
+	if _, _, err := normalizeModel([]byte("<html>not a model</html>")); err == nil {
+		t.Error("expected error for non-LDraw input")
+	}
+}
+
+func TestSelectSubmodel(t *testing.T) {
+	mpd := []byte("0 FILE house.ldr\n1 16 0 0 0 1 0 0 0 1 0 0 0 1 Roof.ldr\n0 NOFILE\n0 FILE roof.ldr\n1 16 0 0 0 1 0 0 0 1 0 0 0 1 3003.dat\n0 NOFILE\n0 FILE 3003.dat\n0 !LDRAW_ORG Unofficial_Part\n0 NOFILE\n")
+
+	got, err := selectSubmodel(mpd, "Roof.LDR")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "0 FILE roof.ldr\n1 16 0 0 0 1 0 0 0 1 0 0 0 1 3003.dat\n0 NOFILE\n0 FILE house.ldr\n1 16 0 0 0 1 0 0 0 1 0 0 0 1 Roof.ldr\n0 NOFILE\n0 FILE 3003.dat\n0 !LDRAW_ORG Unofficial_Part\n0 NOFILE\n"
+	if string(got) != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+	if bom := extractBOM(got); bom.TotalParts != 1 || len(bom.Submodels) != 0 {
+		t.Errorf("selected submodel should be the main model: %+v", bom)
+	}
+
+	var re *RenderError
+	_, err = selectSubmodel(mpd, "wall.ldr")
+	if !errors.As(err, &re) || re.Status != http.StatusNotFound || !strings.Contains(re.Detail, "house.ldr, roof.ldr") {
+		t.Errorf("expected not found listing submodels, got %v", err)
+	}
+	_, err = selectSubmodel([]byte("1 4 0 0 0 1 0 0 0 1 0 0 0 1 3001.dat\n"), "roof.ldr")
+	if !errors.As(err, &re) || re.Status != http.StatusBadRequest {
+		t.Errorf("expected bad request for a plain LDR model, got %v", err)
+	}
+}
+
+func TestStudioArchiveExtractionLimit(t *testing.T) {
+	huge := bytes.Repeat([]byte("0 // padding\n"), modelMaxBytes/13+1)
+	var deflated bytes.Buffer
+	fw, _ := flate.NewWriter(&deflated, flate.BestCompression)
+	fw.Write(huge)
+	fw.Close()
+	encrypt := func(plain []byte) []byte {
+		plain = append(make([]byte, 12), plain...)
+		k := newZipCryptoKeys([]byte(studioPassword))
+		enc := make([]byte, len(plain))
+		for i, p := range plain {
+			enc[i] = p ^ k.stream()
+			k.update(p)
+		}
+		return enc
+	}
+
+	for name, c := range map[string]struct {
+		flags uint16
+		body  []byte
+		size  uint64
+	}{
+		"oversized entry": {0, deflated.Bytes(), uint64(len(huge))},
+		// archive/zip checks only unencrypted entries against their sizes
+		"understated size": {0x1, encrypt(deflated.Bytes()), 100},
+	} {
+		var buf bytes.Buffer
+		zw := zip.NewWriter(&buf)
+		w, err := zw.CreateRaw(&zip.FileHeader{
+			Name:               "model.ldr",
+			Method:             zip.Deflate,
+			Flags:              c.flags,
+			CRC32:              crc32.ChecksumIEEE(huge),
+			CompressedSize64:   uint64(len(c.body)),
+			UncompressedSize64: c.size,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(c.body)
+		zw.Close()
+		if len(buf.Bytes()) > modelMaxBytes {
+			t.Fatalf("%s: the archive itself is over the upload limit", name)
+		}
+		if _, _, err := normalizeModel(buf.Bytes()); err == nil || !strings.Contains(err.Error(), "extracts to more than") {
+			t.Errorf("%s: expected the entry to be refused, got %v", name, err)
+		}
+	}
+
+	// The cap covers every entry together
+	half := strings.Repeat("0 // padding\n", modelMaxBytes/26+1)
+	archive := buildStudioArchive(t, map[string]string{"model.ldr": half, "CustomParts/parts/a.dat": half, "CustomParts/parts/b.dat": half})
+	if _, _, err := normalizeModel(archive); err == nil || !strings.Contains(err.Error(), "extracts to more than") {
+		t.Errorf("expected the archive's total to be refused, got %v", err)
+	}
+}
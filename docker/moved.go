@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// When a part is renumbered, the library keeps its old number as a stub
+// titled "~Moved to <new number>" that only references the new part. Older
+// inventories still ask for the old numbers, so a stub is followed to the
+// part it names, which renders and caches under its own number. Single part
+// responses say so in X-Part-Moved-To.
+
+// Stubs pointing at stubs are followed this far
+const maxPartMoves = 8
+
+// The part a "~Moved to" stub names, or false if the file isn't one
+func movedTo(partFile string) (string, bool) {
+	f, err := os.Open(partFile)
+	if err != nil {
+		return "", false
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		// The title is the first line
+		title, ok := strings.CutPrefix(line, "0 ")
+		if !ok {
+			return "", false
+		}
+		target, ok := strings.CutPrefix(strings.TrimSpace(title), "~Moved to ")
+		if !ok {
+			return "", false
+		}
+		target, ok = cleanPartNumber(partNumberFromRef(target))
+		return target, ok
+	}
+	return "", false
+}
+
+// Follow a part's moves, returning its current number and file. A move to
+// a part the library doesn't have, or round in a circle, stops at the stub.
+func followMoves(root, partNumber, partFile string) (string, string) {
+	seen := map[string]bool{strings.ToLower(partNumber): true}
+	for i := 0; i < maxPartMoves; i++ {
+		target, ok := movedTo(partFile)
+		if !ok || seen[target] {
+			break
+		}
+		file := findLibraryPart(root, target)
+		if file == "" {
+			break
+		}
+		seen[target] = true
+		partNumber, partFile = target, file
+	}
+	return partNumber, partFile
+}
+
+// Set X-Part-Moved-To on a part's response if its number has moved, and
+// X-Part-Fallback if a render with opts uses its base part instead (see
+// printfallback.go). A render from a library snapshot has its provenance
+// headers set for the snapshot (see library.go).
+func setPartHeaders(w http.ResponseWriter, partNumber string, opts RenderOptions) {
+	if opts.LibraryVersion != "" {
+		w.Header().Set("X-Library-Version", libraryVersionOf(libraryPath(opts.LibraryVersion)))
+		w.Header().Set("X-Render-Version", renderVersionFor(opts.LibraryVersion))
+	}
+	if to := partMovedTo(partNumber, opts); to != "" {
+		w.Header().Set("X-Part-Moved-To", to)
+	}
+	if base := partFallback(partNumber, opts); base != "" {
+		w.Header().Set("X-Part-Fallback", base)
+	}
+}
+
+// The number a part has moved to in the library opts render from, or "" if
+// it hasn't (or isn't found)
+func partMovedTo(partNumber string, opts RenderOptions) string {
+	clean, ok := cleanPartNumber(partNumber)
+	if !ok {
+		return ""
+	}
+	resolved, _, err := resolveLibraryPart(libraryPath(opts.LibraryVersion), partNumber)
+	if err != nil || strings.EqualFold(resolved, clean) {
+		return ""
+	}
+	return resolved
+}
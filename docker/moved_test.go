@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolveMovedPart(t *testing.T) {
+	dir := withTestLibrary(t, map[string]string{
+		"3001":    "0 Brick 2 x 4\n",
+		"3001old": "0 ~Moved to 3001\n0 Name: 3001old.dat\n1 16 0 0 0 1 0 0 0 1 0 0 0 1 3001.dat\n",
+		"older":   "\n0 ~Moved to 3001old\n",
+		"gone":    "0 ~Moved to 99999\n",
+		"loopa":   "0 ~Moved to loopb\n",
+		"loopb":   "0 ~Moved to loopa\n",
+	})
+
+	for _, c := range []struct{ part, want string }{
+		{"3001old", "3001"},
+		{"older", "3001"},
+		{"3001", "3001"},
+		// A move to a missing part stays on the stub
+		{"gone", "gone"},
+		{"loopa", "loopb"},
+	} {
+		got, file, err := resolvePart(c.part)
+		if err != nil || got != c.want || file != filepath.Join(dir, "parts", c.want+".dat") {
+			t.Errorf("%s resolved to %s (%s, %v), want %s", c.part, got, file, err, c.want)
+		}
+	}
+	if to := partMovedTo("3001old", RenderOptions{}); to != "3001" {
+		t.Errorf("partMovedTo 3001old = %q", to)
+	}
+	if to := partMovedTo("3001", RenderOptions{}); to != "" {
+		t.Errorf("partMovedTo 3001 = %q, want none", to)
+	}
+}
+
+func TestRenderMovedPart(t *testing.T) {
+	withFakeBlender(t)
+	withTestLibrary(t, map[string]string{
+		"3001":    "0 Brick 2 x 4\n",
+		"3001old": "0 ~Moved to 3001\n1 16 0 0 0 1 0 0 0 1 0 0 0 1 3001.dat\n",
+	})
+	cache := withRenderCache(t)
+
+	w := httptest.NewRecorder()
+	handleRender(w, httptest.NewRequest(http.MethodPost, "/render", bytes.NewReader([]byte(`{"partNumber": "3001old"}`))))
+	if w.Code != http.StatusOK || w.Header().Get("X-Part-Moved-To") != "3001" {
+		t.Fatalf("status %d, X-Part-Moved-To %q", w.Code, w.Header().Get("X-Part-Moved-To"))
+	}
+	opts, _ := (&RenderRequest{}).options()
+	if !cache.has(renderCacheKey("3001", opts)) {
+		t.Error("expected the render cached under the part's new number")
+	}
+
+	w = httptest.NewRecorder()
+	handleRenderBatch(w, httptest.NewRequest(http.MethodPost, "/render/batch", bytes.NewReader([]byte(`{"items": [{"partNumber": "3001old"}, {"partNumber": "3001"}]}`))))
+	dec := json.NewDecoder(w.Body)
+	moved := map[string]string{}
+	for i := 0; i < 2; i++ {
+		var result BatchResult
+		if err := dec.Decode(&result); err != nil {
+			t.Fatal(err)
+		}
+		moved[result.PartNumber] = result.MovedTo
+	}
+	if moved["3001old"] != "3001" || moved["3001"] != "" {
+		t.Errorf("unexpected batch moves %v", moved)
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A core NATS client, just enough of the text protocol for the job queue:
+// CONNECT, PUB, SUB (with queue groups), UNSUB, and PING/PONG. It reconnects
+// with backoff and resubscribes when the connection drops; messages
+// published while it's down are lost, as with any core NATS client.
+type natsConn struct {
+	addr, name string
+	user, pass string
+	token      string
+
+	mu         sync.Mutex
+	conn       net.Conn
+	w          *bufio.Writer
+	subs       map[int]*natsSub
+	nextSID    int
+	maxPayload int
+	closed     bool
+}
+
+type natsSub struct {
+	subject, queue string
+	handler        func(subject string, data []byte)
+}
+
+// Default max_payload, until the server's INFO says otherwise
+const natsDefaultMaxPayload = 1 << 20
+
+func dialNATS(rawURL, name string) (*natsConn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "nats" {
+		return nil, fmt.Errorf("unsupported NATS URL scheme %q", u.Scheme)
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "4222")
+	}
+	c := &natsConn{addr: addr, name: name, subs: map[int]*natsSub{}, maxPayload: natsDefaultMaxPayload}
+	if u.User != nil {
+		if pass, ok := u.User.Password(); ok {
+			c.user, c.pass = u.User.Username(), pass
+		} else {
+			c.token = u.User.Username()
+		}
+	}
+	r, err := c.connect()
+	if err != nil {
+		return nil, err
+	}
+	go c.readLoop(r)
+	return c, nil
+}
+
+// Open the connection, handshake, and resubscribe
+func (c *natsConn) connect() (*bufio.Reader, error) {
+	conn, err := net.DialTimeout("tcp", c.addr, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	r := bufio.NewReader(conn)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		conn.Close()
+		return nil, fmt.Errorf("nats: expected INFO, got %q", strings.TrimSpace(line))
+	}
+	c.readInfo(line)
+
+	options := map[string]any{"verbose": false, "pedantic": false, "lang": "go", "version": "1.0.0", "protocol": 1, "name": c.name}
+	if c.user != "" {
+		options["user"], options["pass"] = c.user, c.pass
+	}
+	if c.token != "" {
+		options["auth_token"] = c.token
+	}
+	connect, _ := json.Marshal(options)
+	w := bufio.NewWriter(conn)
+	fmt.Fprintf(w, "CONNECT %s\r\nPING\r\n", connect)
+	if err := w.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		line = strings.TrimSpace(line)
+		if line == "PONG" {
+			break
+		}
+		if strings.HasPrefix(line, "-ERR") {
+			conn.Close()
+			return nil, fmt.Errorf("nats: %s", strings.Trim(strings.TrimPrefix(line, "-ERR"), " '"))
+		}
+	}
+	conn.SetDeadline(time.Time{})
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conn, c.w = conn, w
+	for sid, sub := range c.subs {
+		c.writeSub(sid, sub)
+	}
+	return r, w.Flush()
+}
+
+func (c *natsConn) readInfo(line string) {
+	var info struct {
+		MaxPayload int `json:"max_payload"`
+	}
+	if json.Unmarshal([]byte(strings.TrimPrefix(line, "INFO ")), &info) == nil && info.MaxPayload > 0 {
+		c.mu.Lock()
+		c.maxPayload = info.MaxPayload
+		c.mu.Unlock()
+	}
+}
+
+// Dispatch messages until the connection fails, then reconnect
+func (c *natsConn) readLoop(r *bufio.Reader) {
+	for {
+		err := c.read(r)
+		c.mu.Lock()
+		closed := c.closed
+		c.conn.Close()
+		c.mu.Unlock()
+		if closed {
+			return
+		}
+		log.Printf("NATS connection to %s lost: %v", c.addr, err)
+		for wait := time.Second; ; wait = min(2*wait, 30*time.Second) {
+			time.Sleep(wait)
+			if c.isClosed() {
+				return
+			}
+			if r, err = c.connect(); err == nil {
+				log.Printf("NATS reconnected to %s", c.addr)
+				break
+			}
+			log.Printf("NATS reconnect to %s failed: %v", c.addr, err)
+		}
+	}
+}
+
+func (c *natsConn) read(r *bufio.Reader) error {
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		switch {
+		case strings.HasPrefix(line, "MSG "):
+			// MSG <subject> <sid> [reply-to] <#bytes>
+			fields := strings.Fields(line)
+			if len(fields) < 4 {
+				return fmt.Errorf("nats: malformed %q", line)
+			}
+			sid, _ := strconv.Atoi(fields[2])
+			n, err := strconv.Atoi(fields[len(fields)-1])
+			c.mu.Lock()
+			maxPayload := c.maxPayload
+			c.mu.Unlock()
+			// The size comes off the wire, so check it before allocating
+			if err != nil || n < 0 || n > maxPayload {
+				return fmt.Errorf("nats: malformed %q", line)
+			}
+			data := make([]byte, n+2)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return err
+			}
+			c.mu.Lock()
+			sub := c.subs[sid]
+			c.mu.Unlock()
+			if sub != nil {
+				sub.handler(fields[1], data[:n])
+			}
+		case line == "PING":
+			c.mu.Lock()
+			c.w.WriteString("PONG\r\n")
+			err := c.w.Flush()
+			c.mu.Unlock()
+			if err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, "INFO "):
+			c.readInfo(line)
+		case strings.HasPrefix(line, "-ERR"):
+			log.Printf("NATS error: %s", strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+		}
+	}
+}
+
+func (c *natsConn) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+func (c *natsConn) writeSub(sid int, sub *natsSub) {
+	if sub.queue != "" {
+		fmt.Fprintf(c.w, "SUB %s %s %d\r\n", sub.subject, sub.queue, sid)
+	} else {
+		fmt.Fprintf(c.w, "SUB %s %d\r\n", sub.subject, sid)
+	}
+}
+
+func (c *natsConn) publish(subject string, data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(data) > c.maxPayload {
+		return fmt.Errorf("nats: %d byte message exceeds the server's max_payload of %d", len(data), c.maxPayload)
+	}
+	fmt.Fprintf(c.w, "PUB %s %d\r\n", subject, len(data))
+	c.w.Write(data)
+	c.w.WriteString("\r\n")
+	return c.w.Flush()
+}
+
+// Subscribe handler to subject, sharing messages with the rest of queue if
+// it's set. Handlers run on the read loop and must not block.
+func (c *natsConn) subscribe(subject, queue string, handler func(subject string, data []byte)) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.nextSID++
+	sub := &natsSub{subject, queue, handler}
+	c.subs[c.nextSID] = sub
+	c.writeSub(c.nextSID, sub)
+	return c.nextSID, c.w.Flush()
+}
+
+func (c *natsConn) unsubscribe(sid int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.subs[sid]; !ok {
+		return errors.New("nats: unknown subscription")
+	}
+	delete(c.subs, sid)
+	fmt.Fprintf(c.w, "UNSUB %d\r\n", sid)
+	return c.w.Flush()
+}
+
+func (c *natsConn) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	c.conn.Close()
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// An in-process NATS server with the parts of the protocol natsConn uses:
+// wildcard subjects, queue groups (round robin), UNSUB, and PING
+type fakeNATS struct {
+	ln         net.Listener
+	maxPayload int
+
+	mu       sync.Mutex
+	clients  map[*fakeNATSClient]bool
+	connects []map[string]any
+	next     int
+	nextID   int
+}
+
+type fakeNATSClient struct {
+	id   int
+	conn net.Conn
+	mu   sync.Mutex
+	w    *bufio.Writer
+	subs map[string][2]string // sid -> subject, queue
+}
+
+func newFakeNATS(t *testing.T) *fakeNATS {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeNATS{ln: ln, maxPayload: 1 << 20, clients: map[*fakeNATSClient]bool{}}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	t.Cleanup(func() {
+		ln.Close()
+		s.dropClients()
+	})
+	return s
+}
+
+func (s *fakeNATS) url() string {
+	return "nats://" + s.ln.Addr().String()
+}
+
+func (s *fakeNATS) dropClients() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.clients {
+		c.conn.Close()
+		delete(s.clients, c)
+	}
+}
+
+func (s *fakeNATS) serve(conn net.Conn) {
+	c := &fakeNATSClient{conn: conn, w: bufio.NewWriter(conn), subs: map[string][2]string{}}
+	s.mu.Lock()
+	s.nextID++
+	c.id = s.nextID
+	s.clients[c] = true
+	maxPayload := s.maxPayload
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.clients, c)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+
+	c.write(fmt.Sprintf("INFO {\"server_id\":\"fake\",\"max_payload\":%d}\r\n", maxPayload))
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "CONNECT":
+			var options map[string]any
+			json.Unmarshal([]byte(strings.TrimPrefix(strings.TrimSpace(line), "CONNECT ")), &options)
+			s.mu.Lock()
+			s.connects = append(s.connects, options)
+			s.mu.Unlock()
+		case "PING":
+			c.write("PONG\r\n")
+		case "SUB":
+			s.mu.Lock()
+			if len(fields) == 4 {
+				c.subs[fields[3]] = [2]string{fields[1], fields[2]}
+			} else {
+				c.subs[fields[2]] = [2]string{fields[1], ""}
+			}
+			s.mu.Unlock()
+		case "UNSUB":
+			s.mu.Lock()
+			delete(c.subs, fields[1])
+			s.mu.Unlock()
+		case "PUB":
+			n, _ := strconv.Atoi(fields[len(fields)-1])
+			data := make([]byte, n+2)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return
+			}
+			s.deliver(fields[1], data[:n])
+		}
+	}
+}
+
+func (s *fakeNATS) deliver(subject string, data []byte) {
+	type target struct {
+		c   *fakeNATSClient
+		sid string
+	}
+	s.mu.Lock()
+	var plain []target
+	groups := map[string][]target{}
+	for c := range s.clients {
+		for sid, sub := range c.subs {
+			if !natsSubjectMatches(sub[0], subject) {
+				continue
+			}
+			if sub[1] == "" {
+				plain = append(plain, target{c, sid})
+			} else {
+				groups[sub[1]] = append(groups[sub[1]], target{c, sid})
+			}
+		}
+	}
+	for _, members := range groups {
+		sort.Slice(members, func(i, j int) bool { return members[i].c.id < members[j].c.id })
+		s.next++
+		plain = append(plain, members[s.next%len(members)])
+	}
+	s.mu.Unlock()
+	for _, t := range plain {
+		t.c.write(fmt.Sprintf("MSG %s %s %d\r\n%s\r\n", subject, t.sid, len(data), data))
+	}
+}
+
+func (c *fakeNATSClient) write(s string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.w.WriteString(s)
+	c.w.Flush()
+}
+
+func natsSubjectMatches(pattern, subject string) bool {
+	p, s := strings.Split(pattern, "."), strings.Split(subject, ".")
+	for i, token := range p {
+		if token == ">" {
+			return len(s) > i
+		}
+		if i >= len(s) || (token != "*" && token != s[i]) {
+			return false
+		}
+	}
+	return len(p) == len(s)
+}
+
+func dialTestNATS(t *testing.T, url string) *natsConn {
+	t.Helper()
+	c, err := dialNATS(url, "test")
+	if err != nil {
+		t.Fatalf("dialNATS: %v", err)
+	}
+	t.Cleanup(c.close)
+	return c
+}
+
+// Collect messages from a subscription
+func collect(t *testing.T, c *natsConn, subject, queue string) (chan string, int) {
+	t.Helper()
+	got := make(chan string, 16)
+	sid, err := c.subscribe(subject, queue, func(subject string, data []byte) { got <- subject + " " + string(data) })
+	if err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+	return got, sid
+}
+
+func expectMessage(t *testing.T, got chan string, want string) {
+	t.Helper()
+	select {
+	case msg := <-got:
+		if msg != want {
+			t.Errorf("got message %q, want %q", msg, want)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("timed out waiting for %q", want)
+	}
+}
+
+// Round-trip a PING so the server has seen everything sent before it
+func flushNATS(t *testing.T, c *natsConn) {
+	t.Helper()
+	ready, sid := collect(t, c, "flush.test", "")
+	c.publish("flush.test", nil)
+	expectMessage(t, ready, "flush.test ")
+	c.unsubscribe(sid)
+}
+
+func TestNATSPubSub(t *testing.T) {
+	s := newFakeNATS(t)
+	pub := dialTestNATS(t, s.url())
+	sub := dialTestNATS(t, s.url())
+
+	got, sid := collect(t, sub, "jobs.*", "")
+	flushNATS(t, sub)
+	pub.publish("jobs.a", []byte("hello"))
+	expectMessage(t, got, "jobs.a hello")
+
+	sub.unsubscribe(sid)
+	flushNATS(t, sub)
+	pub.publish("jobs.b", []byte("ignored"))
+	flushNATS(t, pub)
+	select {
+	case msg := <-got:
+		t.Errorf("unexpected message after unsubscribing: %q", msg)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestNATSQueueGroup(t *testing.T) {
+	s := newFakeNATS(t)
+	pub := dialTestNATS(t, s.url())
+	a, b := dialTestNATS(t, s.url()), dialTestNATS(t, s.url())
+	gotA, _ := collect(t, a, "work", "workers")
+	gotB, _ := collect(t, b, "work", "workers")
+	flushNATS(t, a)
+	flushNATS(t, b)
+
+	for i := 0; i < 4; i++ {
+		pub.publish("work", []byte(strconv.Itoa(i)))
+	}
+	deadline := time.After(3 * time.Second)
+	counts := map[string]int{}
+	for n := 0; n < 4; n++ {
+		select {
+		case <-gotA:
+			counts["a"]++
+		case <-gotB:
+			counts["b"]++
+		case <-deadline:
+			t.Fatalf("got %v of 4 messages", counts)
+		}
+	}
+	if counts["a"] != 2 || counts["b"] != 2 {
+		t.Errorf("expected the group to share messages, got %v", counts)
+	}
+}
+
+func TestNATSMaxPayload(t *testing.T) {
+	s := newFakeNATS(t)
+	s.mu.Lock()
+	s.maxPayload = 10
+	s.mu.Unlock()
+	c := dialTestNATS(t, s.url())
+	if err := c.publish("big", []byte(strings.Repeat("x", 11))); err == nil || !strings.Contains(err.Error(), "max_payload") {
+		t.Errorf("expected a max_payload error, got %v", err)
+	}
+}
+
+func TestNATSRejectsOversizedMessage(t *testing.T) {
+	c := &natsConn{subs: map[int]*natsSub{}, maxPayload: 10}
+	for _, line := range []string{"MSG big 1 11\r\n", "MSG big 1 -1\r\n", "MSG big 1 9223372036854775807\r\n"} {
+		err := c.read(bufio.NewReader(strings.NewReader(line)))
+		if err == nil || !strings.Contains(err.Error(), "malformed") {
+			t.Errorf("%q: expected a malformed error, got %v", strings.TrimSpace(line), err)
+		}
+	}
+}
+
+func TestNATSAuth(t *testing.T) {
+	s := newFakeNATS(t)
+	dialTestNATS(t, strings.Replace(s.url(), "nats://", "nats://secret@", 1))
+	dialTestNATS(t, strings.Replace(s.url(), "nats://", "nats://user:pw@", 1))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.connects) != 2 || s.connects[0]["auth_token"] != "secret" || s.connects[1]["user"] != "user" || s.connects[1]["pass"] != "pw" {
+		t.Errorf("unexpected CONNECT options %v", s.connects)
+	}
+	if _, err := dialNATS("tls://localhost:4222", "test"); err == nil {
+		t.Error("expected an error for an unsupported scheme")
+	}
+}
+
+func TestNATSReconnect(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits for the reconnect backoff")
+	}
+	s := newFakeNATS(t)
+	sub := dialTestNATS(t, s.url())
+	got, _ := collect(t, sub, "after.>", "")
+
+	s.dropClients()
+	pub := dialTestNATS(t, s.url())
+	// The subscriber reconnects after a second and resubscribes
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		pub.publish("after.drop", []byte("hi"))
+		select {
+		case msg := <-got:
+			if msg != "after.drop hi" {
+				t.Errorf("unexpected message %q", msg)
+			}
+			return
+		case <-time.After(100 * time.Millisecond):
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("subscriber did not reconnect")
+		}
+	}
+}
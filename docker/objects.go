@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Model renders can give placed parts colors of their own with partColors,
+// keyed by subfile reference like colorOverrides. The main model's lines
+// placing a colored reference are split out into a separate object, one
+// per reference, which render_part.py imports and draws in a line set of
+// its own (ViewLayer_ObjectEdges_<id>) in that object's fill and stroke.
+// Like ghosts, only the main model is split; a colored submodel reference
+// colors the whole submodel.
+type PartColors struct {
+	Fill   string `json:"fill"`
+	Stroke string `json:"stroke"`
+}
+
+// Each separate object is imported and drawn on its own
+const maxSeparateObjects = 32
+
+// An entry of the objects file render_part.py reads; see the contract's
+// objects section
+type sceneObject struct {
+	ID     string `json:"id"`
+	Ref    string `json:"ref"`
+	Model  string `json:"model"`
+	MPD    bool   `json:"mpd,omitempty"`
+	Fill   string `json:"fill,omitempty"`
+	Stroke string `json:"stroke,omitempty"`
+	// Align "bbox" centers the object's bounding box on the model's; see
+	// compare.go
+	Align string `json:"align,omitempty"`
+}
+
+// Check part colors and normalize their keys to subfile references as
+// matched by splitObjects
+func validatePartColors(colors map[string]PartColors) (map[string]PartColors, error) {
+	if len(colors) > maxSeparateObjects {
+		return nil, fmt.Errorf("partColors: at most %d references can be colored", maxSeparateObjects)
+	}
+	normalized := make(map[string]PartColors, len(colors))
+	for ref, c := range colors {
+		key := colorOverrideKey(ref)
+		if mpdKey(ref) == "" || key == colorOverrideDefault {
+			return nil, fmt.Errorf("partColors: %q is not a subfile reference", ref)
+		}
+		fill, err := validateColorField(fmt.Sprintf("partColors[%q].fill", ref), c.Fill)
+		if err != nil {
+			return nil, err
+		}
+		stroke, err := validateColorField(fmt.Sprintf("partColors[%q].stroke", ref), c.Stroke)
+		if err != nil {
+			return nil, err
+		}
+		if fill == "" && stroke == "" {
+			return nil, fmt.Errorf("partColors[%q]: set fill, stroke, or both", ref)
+		}
+		normalized[key] = PartColors{Fill: fill, Stroke: stroke}
+	}
+	return normalized, nil
+}
+
+// Split the main model's lines placing colored references into separate
+// objects, in the order they're first placed. References that aren't
+// placed get no object.
+func splitObjects(model []byte, colors map[string]PartColors) ([]byte, []sceneObject) {
+	if len(colors) == 0 {
+		return model, nil
+	}
+	header, main, rest := splitMainFile(model)
+	var kept []string
+	var order []string
+	placed := make(map[string][]string)
+	for _, line := range main {
+		fields := strings.Fields(line)
+		if len(fields) >= 15 && fields[0] == "1" {
+			ref := mpdKey(strings.Join(fields[14:], " "))
+			if _, ok := colors[ref]; ok {
+				if placed[ref] == nil {
+					order = append(order, ref)
+				}
+				placed[ref] = append(placed[ref], line)
+				continue
+			}
+		}
+		kept = append(kept, line)
+	}
+	if len(order) == 0 {
+		return model, nil
+	}
+
+	objects := make([]sceneObject, len(order))
+	for i, ref := range order {
+		objects[i] = sceneObject{
+			ID:     strconv.Itoa(i + 1),
+			Ref:    ref,
+			Model:  string(joinModel(header, placed[ref], rest)),
+			MPD:    len(header) > 0,
+			Fill:   colors[ref].Fill,
+			Stroke: colors[ref].Stroke,
+		}
+	}
+	return joinModel(header, kept, rest), objects
+}
+
+// Write separate objects to dir for render_part.py, returning the file
+func writeObjectsFile(dir string, objects []sceneObject) (string, error) {
+	data, err := json.Marshal(map[string][]sceneObject{"objects": objects})
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, "objects.json")
+	return path, os.WriteFile(path, data, 0o644)
+}
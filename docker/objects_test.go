@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+)
+
+const testObjectsMPD = `0 FILE main.ldr
+1 4 0 0 0 1 0 0 0 1 0 0 0 1 3001.dat
+1 1 0 -24 0 1 0 0 0 1 0 0 0 1 roof.ldr
+1 4 40 0 0 1 0 0 0 1 0 0 0 1 3001.dat
+1 15 0 -48 0 1 0 0 0 1 0 0 0 1 3003.dat
+0 NOFILE
+0 FILE roof.ldr
+1 2 0 0 0 1 0 0 0 1 0 0 0 1 3039.dat
+0 NOFILE
+`
+
+func TestValidatePartColors(t *testing.T) {
+	for _, colors := range []map[string]PartColors{
+		{"3001": {Fill: "not a color"}},
+		{"3001": {Stroke: "#12"}},
+		{"3001": {}},
+		{"*": {Fill: "red"}},
+		{" ": {Fill: "red"}},
+	} {
+		if _, err := validatePartColors(colors); err == nil {
+			t.Errorf("%v: expected an error", colors)
+		}
+	}
+	got, err := validatePartColors(map[string]PartColors{`S\3001S01`: {Fill: "RED"}, "Roof.LDR": {Stroke: "#0055BF"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got["s/3001s01.dat"].Fill != "red" || got["roof.ldr"].Stroke != "#0055bf" {
+		t.Errorf("unexpected normalized colors %v", got)
+	}
+}
+
+func TestSplitObjects(t *testing.T) {
+	colors := map[string]PartColors{"roof.ldr": {Fill: "green"}, "3001.dat": {Fill: "red", Stroke: "black"}, "3040.dat": {Fill: "blue"}}
+	solid, objects := splitObjects([]byte(testObjectsMPD), colors)
+
+	if strings.Contains(string(solid), "3001.dat") || strings.Contains(string(solid), "1 1 0 -24") || !strings.Contains(string(solid), "3003.dat") {
+		t.Errorf("expected only 3003 left in the main model:\n%s", solid)
+	}
+	// In the order placed, with no object for the unplaced 3040
+	if len(objects) != 2 || objects[0].ID != "1" || objects[0].Fill != "red" || objects[1].Fill != "green" {
+		t.Fatalf("unexpected objects %+v", objects)
+	}
+	if n := strings.Count(objects[0].Model, "3001.dat"); n != 2 || !objects[0].MPD {
+		t.Errorf("expected both 3001s in the first object:\n%s", objects[0].Model)
+	}
+	// Submodels stay available to the objects placing them
+	if !strings.Contains(objects[1].Model, "0 FILE roof.ldr") || !strings.HasPrefix(objects[1].Model, "0 FILE main.ldr\n") {
+		t.Errorf("expected the roof submodel with the second object:\n%s", objects[1].Model)
+	}
+
+	if solid, objects := splitObjects([]byte(testObjectsMPD), nil); string(solid) != testObjectsMPD || objects != nil {
+		t.Error("expected a model without part colors left alone")
+	}
+}
+
+func TestRenderSeparateObjects(t *testing.T) {
+	withFakeBlender(t)
+	contract := loadRenderContract(t)
+
+	colors, _ := validatePartColors(map[string]PartColors{"3001": {Fill: "#c91a09", Stroke: "#333333"}})
+	modelFile, _, objectsFile, cleanup, err := writeModelFile([]byte(testObjectsMPD), colors)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	data, _ := os.ReadFile(objectsFile)
+	var manifest struct{ Objects []sceneObject }
+	if err := json.Unmarshal(data, &manifest); err != nil || len(manifest.Objects) != 1 {
+		t.Fatalf("unexpected objects file %s: %v", data, err)
+	}
+
+	opts, _ := (&RenderRequest{}).options()
+	opts.ObjectsFile = objectsFile
+	svg, _, err := renderFile(context.Background(), "objects", modelFile, opts)
+	if err != nil {
+		t.Fatalf("contract stub rejected arguments: %v", err)
+	}
+	out := checkRenderOutput(t, contract, svg)
+	if !strings.Contains(string(svg), `id="ViewLayer_ObjectEdges_1"`) || len(out.fills) != 2 ||
+		out.fills[1]["fill"] != "#c91a09" || out.strokes[1]["stroke"] != "#333333" {
+		t.Errorf("expected the 3001s in their own colors: %v %v", out.fills, out.strokes)
+	}
+}
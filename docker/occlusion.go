@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+)
+
+// Ambient occlusion darkens the places light has trouble reaching: between
+// studs, inside tubes, under overhangs. Given an ao_file, render_part.py
+// writes Cycles' occlusion pass as a PNG (white where the part is open,
+// darker where it's occluded, transparent off the part). With
+// ambientOcclusion raster it's multiplied into the toon raster; with fills
+// each exported face gets a black overlay following the occlusion at its
+// corners, as a linear gradient from its most to its least occluded.
+
+// The share of full black a fully occluded spot is darkened by
+const occlusionStrength = 0.6
+
+// Faces occluded less than this everywhere are left alone, and faces whose
+// corners vary by less get a flat overlay instead of a gradient
+const occlusionThreshold = 0.02
+
+func readOcclusion(path string) (image.Image, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return png.Decode(f)
+}
+
+// How occluded a pixel is, 0 (open) to 1. Off the part counts as open.
+func occlusionAt(img image.Image, x, y int) float64 {
+	if !image.Pt(x, y).In(img.Bounds()) {
+		return 0
+	}
+	c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+	if c.A == 0 {
+		return 0
+	}
+	return 1 - float64(c.R)/255
+}
+
+// Darken a PNG raster by an occlusion pass, scaled to fit if their sizes
+// differ
+func occludeRaster(raster []byte, occlusion image.Image) ([]byte, error) {
+	src, err := png.Decode(bytes.NewReader(raster))
+	if err != nil {
+		return nil, err
+	}
+	b, ob := src.Bounds(), occlusion.Bounds()
+	out := image.NewNRGBA(b)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.NRGBAModel.Convert(src.At(x, y)).(color.NRGBA)
+			ox := ob.Min.X + (x-b.Min.X)*ob.Dx()/b.Dx()
+			oy := ob.Min.Y + (y-b.Min.Y)*ob.Dy()/b.Dy()
+			k := 1 - occlusionStrength*occlusionAt(occlusion, ox, oy)
+			c.R, c.G, c.B = uint8(float64(c.R)*k+0.5), uint8(float64(c.G)*k+0.5), uint8(float64(c.B)*k+0.5)
+			out.SetNRGBA(x, y, c)
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, out); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// The overlay darkening a face (path data d) by its occlusion, or "" if
+// it's open, with the gradient it fills with, if any. Gradient ids come
+// from their content, so repeats share one definition.
+func occlusionOverlay(occlusion image.Image, points []float64, d string) (overlay, gradientID, gradient string) {
+	n := len(points) / 2
+	var cx, cy float64
+	for i := 0; i < n; i++ {
+		cx, cy = cx+points[2*i]/float64(n), cy+points[2*i+1]/float64(n)
+	}
+	// Corners are sampled a little inside the face, clear of its edges
+	type sample struct{ x, y, occlusion float64 }
+	var lo, hi sample
+	for i := 0; i < n; i++ {
+		x, y := points[2*i]+(cx-points[2*i])*0.2, points[2*i+1]+(cy-points[2*i+1])*0.2
+		s := sample{x, y, occlusionAt(occlusion, int(x), int(y))}
+		if i == 0 || s.occlusion < lo.occlusion {
+			lo = s
+		}
+		if i == 0 || s.occlusion > hi.occlusion {
+			hi = s
+		}
+	}
+	if hi.occlusion < occlusionThreshold {
+		return "", "", ""
+	}
+	if hi.occlusion-lo.occlusion < occlusionThreshold {
+		return fmt.Sprintf(`<path d="%s" fill="black" fill-opacity="%.3f" stroke="none" />`,
+			d, occlusionStrength*(lo.occlusion+hi.occlusion)/2), "", ""
+	}
+
+	body := fmt.Sprintf(` gradientUnits="userSpaceOnUse" x1="%.1f" y1="%.1f" x2="%.1f" y2="%.1f">`+
+		`<stop offset="0" stop-color="black" stop-opacity="%.3f" />`+
+		`<stop offset="1" stop-color="black" stop-opacity="%.3f" /></linearGradient>`,
+		hi.x, hi.y, lo.x, lo.y, occlusionStrength*hi.occlusion, occlusionStrength*lo.occlusion)
+	h := fnv.New32a()
+	h.Write([]byte(body))
+	gradientID = fmt.Sprintf("ao-%08x", h.Sum32())
+	return fmt.Sprintf(`<path d="%s" fill="url(#%s)" stroke="none" />`, d, gradientID), gradientID,
+		`<linearGradient id="` + gradientID + `"` + body
+}
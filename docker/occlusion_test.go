@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"image/png"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func renderWithFakeBlender(t *testing.T, req RenderRequest) string {
+	t.Helper()
+	withFakeBlender(t)
+	input := filepath.Join(t.TempDir(), "3001.dat")
+	os.WriteFile(input, []byte("0 Brick 2 x 4\n"), 0o644)
+	opts, err := req.options()
+	if err != nil {
+		t.Fatal(err)
+	}
+	svg, _, err := renderFile(context.Background(), "contract", input, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(svg)
+}
+
+func TestOccludedToonRaster(t *testing.T) {
+	res := 64
+	svg := renderWithFakeBlender(t, RenderRequest{Style: "toon", AmbientOcclusion: "raster", ResolutionX: &res, ResolutionY: &res})
+	m := regexp.MustCompile(`base64,([^"]+)"`).FindStringSubmatch(svg)
+	if m == nil {
+		t.Fatalf("no embedded raster:\n%s", svg)
+	}
+	data, _ := base64.StdEncoding.DecodeString(m[1])
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The stub's raster is white and its pass half occluded from x = 10
+	if r, _, _, _ := img.At(0, 0).RGBA(); r>>8 != 255 {
+		t.Errorf("expected the open corner left white, got %d", r>>8)
+	}
+	if r, _, _, _ := img.At(30, 30).RGBA(); r>>8 < 170 || r>>8 > 190 {
+		t.Errorf("expected the occluded side darkened to about 180, got %d", r>>8)
+	}
+}
+
+func TestOcclusionFills(t *testing.T) {
+	res := 64
+	svg := renderWithFakeBlender(t, RenderRequest{AmbientOcclusion: "fills", ResolutionX: &res, ResolutionY: &res})
+	faces := strings.Index(svg, `<g id="faces">`)
+	if faces < 0 || strings.Contains(svg, "hatch-") {
+		t.Fatalf("expected unhatched faces:\n%s", svg)
+	}
+	gradients := regexp.MustCompile(`<linearGradient id="(ao-[0-9a-f]{8})"`).FindAllStringSubmatch(svg, -1)
+	if len(gradients) != 2 {
+		t.Fatalf("expected a gradient per face:\n%s", svg)
+	}
+	for _, g := range gradients {
+		if !strings.Contains(svg[faces:], `fill="url(#`+g[1]+`)"`) {
+			t.Errorf("gradient %s isn't used:\n%s", g[1], svg)
+		}
+	}
+}
+
+func TestOcclusionValidates(t *testing.T) {
+	for _, req := range []RenderRequest{
+		{AmbientOcclusion: "everywhere"},
+		{AmbientOcclusion: "raster"},
+		{Style: "toon", AmbientOcclusion: "fills"},
+	} {
+		if _, err := req.options(); err == nil || !strings.Contains(err.Error(), "ambientOcclusion") {
+			t.Errorf("%+v: expected an ambientOcclusion error, got %v", req, err)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Social preview cards are rendered at the Open Graph recommended size
+const (
+	ogWidth  = 1200
+	ogHeight = 630
+)
+
+// OG_TEMPLATE points at a text/template SVG document replacing the built-in
+// card layout. See ogCard for the fields and functions it can use.
+var ogTemplatePath = getEnv("OG_TEMPLATE", "")
+
+const ogDefaultTemplate = `<?xml version='1.0' encoding='utf-8'?>
+<svg xmlns="http://www.w3.org/2000/svg" xmlns:inkscape="http://www.inkscape.org/namespaces/inkscape" version="1.1" width="{{.Width}}" height="{{.Height}}" viewBox="0 0 {{.Width}} {{.Height}}">
+<rect width="100%" height="100%" fill="#f4f4f4" />
+<rect x="40" y="40" width="550" height="550" rx="16" fill="white" stroke="#dddddd" />
+{{render 65 65 500 500}}
+<text x="640" y="250" font-family="sans-serif" font-size="28" fill="#666666">Part {{xml .PartNumber}}</text>
+{{range $i, $line := wrap .Name 24}}<text x="640" y="{{add 310 (mul $i 56)}}" font-family="sans-serif" font-size="48" font-weight="bold" fill="black">{{xml $line}}</text>
+{{end}}{{if .ColorName}}<text x="640" y="560" font-family="sans-serif" font-size="24" fill="#666666">{{xml .ColorName}}</text>
+{{end}}</svg>
+`
+
+// ogCard is the data an OG template is executed with. Templates also get
+// xml (escape text), render x y w h (the part render scaled into a box),
+// wrap text n (split into lines of at most n characters), add, and mul.
+type ogCard struct {
+	PartNumber string
+	Name       string
+	ColorName  string
+	Width      int
+	Height     int
+}
+
+// Open Graph image endpoint: GET /og/{partNumber}.png[?color=4][&depth=16]
+func handleOGImage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		sendError(w, http.StatusMethodNotAllowed, "Method not allowed", "")
+		return
+	}
+	partNumber, ok := strings.CutSuffix(r.PathValue("file"), ".png")
+	if !ok || partNumber == "" {
+		sendError(w, http.StatusNotFound, "Not found", "Open Graph images are served as /og/{partNumber}.png")
+		return
+	}
+
+	card := ogCard{PartNumber: partNumber, Width: ogWidth, Height: ogHeight}
+	depth, err := parsePNGDepth(r.URL.Query().Get("depth"))
+	if err != nil {
+		sendError(w, http.StatusBadRequest, err.Error(), "")
+		return
+	}
+	req := RenderRequest{}
+	if c := r.URL.Query().Get("color"); c != "" {
+		code, err := strconv.Atoi(c)
+		color, known := lookupColor(code)
+		if err != nil || !known {
+			sendError(w, http.StatusBadRequest, "color must be a known LDraw color code", "")
+			return
+		}
+		req.FillColor = color.Value
+		card.ColorName = strings.ReplaceAll(color.Name, "_", " ")
+	}
+	opts, err := req.options()
+	if err != nil {
+		sendValidationError(w, err)
+		return
+	}
+
+	tmpl, err := loadOGTemplate()
+	if err != nil {
+		log.Printf("Invalid OG template: %v", err)
+		sendError(w, http.StatusInternalServerError, "Invalid OG template", err.Error())
+		return
+	}
+
+	start := time.Now()
+	setPartHeaders(w, partNumber, opts)
+	svg, renderDuration, err := renderPart(r.Context(), partNumber, opts)
+	if err != nil {
+		sendRenderError(w, err)
+		return
+	}
+	if _, partFile, _, err := resolvePartFor(partNumber, opts); err == nil {
+		card.Name = partDescription(partFile)
+	}
+	if card.Name == "" {
+		card.Name = partNumber
+	}
+
+	page, err := buildOGCard(tmpl, card, svg)
+	if err != nil {
+		log.Printf("OG template failed for %s: %v", partNumber, err)
+		sendError(w, http.StatusInternalServerError, "OG template failed", err.Error())
+		return
+	}
+	png, err := convertSVG(r.Context(), "png", [][]byte{page})
+	if err != nil {
+		log.Printf("OG PNG conversion failed: %v", err)
+		sendError(w, http.StatusInternalServerError, "PNG conversion failed", err.Error())
+		return
+	}
+	if png, err = tagPNG(png, renderMetadata(partNumber, opts), depth); err != nil {
+		log.Printf("OG PNG tagging failed for %s: %v", partNumber, err)
+		sendError(w, http.StatusInternalServerError, "PNG conversion failed", err.Error())
+		return
+	}
+	log.Printf("OG image for %s in %.2fs", partNumber, time.Since(start).Seconds())
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	setCacheHeader(w, renderDuration)
+	w.Write(png)
+}
+
+// Parse OG_TEMPLATE, or the built-in card. The file is read on every
+// request so template edits take effect without a restart.
+func loadOGTemplate() (*template.Template, error) {
+	text := ogDefaultTemplate
+	if ogTemplatePath != "" {
+		data, err := os.ReadFile(ogTemplatePath)
+		if err != nil {
+			return nil, err
+		}
+		text = string(data)
+	}
+	// render is replaced per card in buildOGCard
+	return template.New("og").Funcs(template.FuncMap{
+		"xml":    escapeXML,
+		"wrap":   wrapText,
+		"add":    func(a, b int) int { return a + b },
+		"mul":    func(a, b int) int { return a * b },
+		"render": func(x, y, w, h float64) string { return "" },
+	}).Parse(text)
+}
+
+func buildOGCard(tmpl *template.Template, card ogCard, svg []byte) ([]byte, error) {
+	tmpl = tmpl.Funcs(template.FuncMap{
+		"render": func(x, y, w, h float64) string { return embedSVG(svg, x, y, w, h) },
+	})
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, card); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// A part's description is the comment on its first line ("0 Brick 2 x 4")
+func partDescription(partFile string) string {
+	if partFile == "" {
+		return ""
+	}
+	f, err := os.Open(partFile)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	if !scanner.Scan() {
+		return ""
+	}
+	line := strings.TrimSpace(strings.TrimPrefix(scanner.Text(), "\xef\xbb\xbf"))
+	if desc, ok := strings.CutPrefix(line, "0 "); ok {
+		return strings.TrimSpace(desc)
+	}
+	return ""
+}
+
+// Split text into lines of at most n characters at spaces, for templates
+// (SVG text doesn't wrap). Single words longer than n stay whole.
+func wrapText(text string, n int) []string {
+	var lines []string
+	var line string
+	for _, word := range strings.Fields(text) {
+		switch {
+		case line == "":
+			line = word
+		case len(line)+1+len(word) <= n:
+			line += " " + word
+		default:
+			lines = append(lines, line)
+			line = word
+		}
+	}
+	if line != "" {
+		lines = append(lines, line)
+	}
+	return lines
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestBuildOGCard(t *testing.T) {
+	tmpl, err := loadOGTemplate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	render := []byte(`<svg xmlns="http://www.w3.org/2000/svg" width="1024" height="1024"><path d="M 0 0 L 10 10" stroke="black" /></svg>`)
+	card := ogCard{PartNumber: "3001", Name: "Brick 2 x 4 with <Studs> & Tubes", ColorName: "Bright Red", Width: ogWidth, Height: ogHeight}
+
+	page, err := buildOGCard(tmpl, card, render)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkSVG(page); err != nil {
+		t.Fatalf("card is not a valid SVG: %v\n%s", err, page)
+	}
+	if w, h := svgSize(page); w != ogWidth || h != ogHeight {
+		t.Errorf("card size %gx%g, want %dx%d", w, h, ogWidth, ogHeight)
+	}
+	for _, want := range []string{"Part 3001", "Brick 2 x 4 with &lt;Studs&gt;", "Bright Red", `viewBox="0 0 1024 1024"`} {
+		if !strings.Contains(string(page), want) {
+			t.Errorf("card is missing %q", want)
+		}
+	}
+}
+
+func TestOGTemplateFromFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "card.svg")
+	os.WriteFile(path, []byte(`<svg xmlns="http://www.w3.org/2000/svg" width="{{.Width}}" height="{{.Height}}"><title>{{xml .Name}}</title>{{render 0 0 630 630}}</svg>`), 0o644)
+	old := ogTemplatePath
+	ogTemplatePath = path
+	t.Cleanup(func() { ogTemplatePath = old })
+
+	tmpl, err := loadOGTemplate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, err := buildOGCard(tmpl, ogCard{Name: "Plate 1 x 2", Width: ogWidth, Height: ogHeight}, []byte(`<svg width="64" height="64"></svg>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(page), "<title>Plate 1 x 2</title>") || !strings.Contains(string(page), `width="630.00"`) {
+		t.Errorf("unexpected card:\n%s", page)
+	}
+}
+
+func TestPartDescription(t *testing.T) {
+	withTestLibrary(t, map[string]string{"3001": "0 Brick  2 x  4\n0 Name: 3001.dat\n"})
+	if got := partDescription(findPartFile("3001")); got != "Brick  2 x  4" {
+		t.Errorf("got %q", got)
+	}
+	if got := partDescription(""); got != "" {
+		t.Errorf("missing part: got %q", got)
+	}
+}
+
+func TestWrapText(t *testing.T) {
+	got := wrapText("Technic Beam 1 x 15 Thick with Extraordinarily Long Name", 16)
+	want := []string{"Technic Beam 1 x", "15 Thick with", "Extraordinarily", "Long Name"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestOGImageRequiresPNG(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/og/{file}", handleOGImage)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/og/3001.jpg", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("status %d, want 404", rec.Code)
+	}
+}
+
+func TestOGImageDepth(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/og/{file}", handleOGImage)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/og/3001.png?depth=12", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("status %d, want 400", rec.Code)
+	}
+}
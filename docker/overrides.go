@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// colorOverrideDefault keys the color for every part without its own override
+const colorOverrideDefault = "*"
+
+// Check that color overrides use known LDraw colors and normalize their
+// keys to subfile references as matched by applyColorOverrides
+func validateColorOverrides(overrides map[string]int) (map[string]int, error) {
+	normalized := make(map[string]int, len(overrides))
+	for ref, code := range overrides {
+		if _, ok := lookupColor(code); !ok {
+			return nil, fmt.Errorf("colorOverrides[%q]: %d is not a known LDraw color code", ref, code)
+		}
+		if mpdKey(ref) == "" {
+			return nil, fmt.Errorf("colorOverrides: empty subfile reference")
+		}
+		normalized[colorOverrideKey(ref)] = code
+	}
+	return normalized, nil
+}
+
+// "3001" and "3001.DAT" both match a "3001.dat" reference
+func colorOverrideKey(ref string) string {
+	key := mpdKey(ref)
+	if key != colorOverrideDefault && !strings.Contains(key, ".") {
+		key += ".dat"
+	}
+	return key
+}
+
+// Recolor the type 1 lines of a normalized model whose subfile reference has
+// an override, in the main model and every submodel. The "*" override
+// applies to the remaining part references. A recolored submodel is
+// recolored whole: the lines inside it switch to the inherited color (16).
+func applyColorOverrides(model []byte, overrides map[string]int) []byte {
+	_, files := splitMPD(model)
+	isSubmodel := func(ref string) bool {
+		lines, ok := files[ref]
+		return ok && !isPartFile(lines)
+	}
+
+	// Collect the submodels placed, directly or nested, by overridden references
+	inherited := make(map[string]bool)
+	var inherit func(ref string)
+	inherit = func(ref string) {
+		if inherited[ref] || !isSubmodel(ref) {
+			return
+		}
+		inherited[ref] = true
+		for _, line := range files[ref] {
+			if fields := strings.Fields(line); len(fields) >= 15 && fields[0] == "1" {
+				inherit(mpdKey(strings.Join(fields[14:], " ")))
+			}
+		}
+	}
+	for ref := range overrides {
+		inherit(ref)
+	}
+
+	current := ""
+	if !isMPD(model) {
+		current = "<model>"
+	}
+	lines := strings.SplitAfter(string(model), "\n")
+	for i, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) >= 3 && fields[0] == "0" && fields[1] == "FILE" {
+			current = mpdKey(strings.Join(fields[2:], " "))
+			continue
+		}
+		if len(fields) < 15 || fields[0] != "1" {
+			continue
+		}
+		ref := mpdKey(strings.Join(fields[14:], " "))
+		code, ok := overrides[ref]
+		switch {
+		case ok:
+		case inherited[current]:
+			code = 16
+		case isSubmodel(ref):
+			continue
+		default:
+			if code, ok = overrides[colorOverrideDefault]; !ok {
+				continue
+			}
+		}
+		lines[i] = replaceLineColor(line, fields[1], code)
+	}
+	return []byte(strings.Join(lines, ""))
+}
+
+// Swap the color field (the second field) of a type 1 line
+func replaceLineColor(line, color string, code int) string {
+	start := strings.Index(line, "1") + 1
+	offset := strings.Index(line[start:], color)
+	if offset < 0 {
+		return line
+	}
+	at := start + offset
+	return line[:at] + strconv.Itoa(code) + line[at+len(color):]
+}
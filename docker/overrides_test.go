@@ -0,0 +1,69 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+const testOverridesMPD = `0 FILE house.ldr
+1 4 0 0 0 1 0 0 0 1 0 0 0 1 3001.dat
+1 1 0 -24 0 1 0 0 0 1 0 0 0 1 3003.DAT
+1 15 0 -48 0 1 0 0 0 1 0 0 0 1 roof.ldr
+1 14 0 -96 0 1 0 0 0 1 0 0 0 1 chimney.ldr
+0 NOFILE
+0 FILE roof.ldr
+1 16 0 0 0 1 0 0 0 1 0 0 0 1 3039.dat
+1 2 0 0 20 1 0 0 0 1 0 0 0 1 3039.dat
+0 NOFILE
+0 FILE chimney.ldr
+1 0 0 0 0 1 0 0 0 1 0 0 0 1 3005.dat
+0 NOFILE
+`
+
+func TestApplyColorOverrides(t *testing.T) {
+	withTestLibrary(t, nil)
+	overrides, err := validateColorOverrides(map[string]int{"3003": 4, "roof.ldr": 4, "*": 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := string(applyColorOverrides([]byte(testOverridesMPD), overrides))
+	want := strings.NewReplacer(
+		// Default for parts without their own override
+		"1 4 0 0 0 1 0 0 0 1 0 0 0 1 3001.dat", "1 0 0 0 0 1 0 0 0 1 0 0 0 1 3001.dat",
+		"1 1 0 -24", "1 4 0 -24",
+		// The overridden submodel is recolored whole
+		"1 15 0 -48", "1 4 0 -48",
+		"1 2 0 0 20", "1 16 0 0 20",
+	).Replace(testOverridesMPD)
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	// The submodel without an override keeps its placement color
+	if !strings.Contains(got, "1 14 0 -96") {
+		t.Error("chimney placement should keep its color")
+	}
+	bom := extractBOM([]byte(got))
+	for _, line := range bom.Parts {
+		if line.PartNumber == "3039" && (line.Color != 4 || line.Quantity != 2) {
+			t.Errorf("roof parts should all be red: %+v", bom.Parts)
+		}
+	}
+}
+
+func TestValidateColorOverrides(t *testing.T) {
+	withTestLibrary(t, nil)
+	if _, err := validateColorOverrides(map[string]int{"3001": 9999}); err == nil {
+		t.Error("expected an error for an unknown color")
+	}
+	if _, err := validateColorOverrides(map[string]int{" ": 4}); err == nil {
+		t.Error("expected an error for an empty reference")
+	}
+	got, err := validateColorOverrides(map[string]int{`S\3001S01`: 4, "Wall.LDR": 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got["s/3001s01.dat"] != 4 || got["wall.ldr"] != 0 {
+		t.Errorf("unexpected keys %v", got)
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PART_OVERRIDES_FILE maps part numbers to the render options they always
+// need, such as a camera angle that shows a wheel's tread or a thicker
+// line for a thin panel, so callers don't have to know. It's JSON, or YAML
+// (.yaml, .yml) in a simple subset, of part number to request options:
+//
+//	{"3641": {"cameraLatitude": 10, "cameraLongitude": 80}}
+//
+// An override sets the options a render left at their defaults; options the
+// caller chose stay. The file is checked at startup, where an invalid one
+// stops the server, and read again whenever it changes; a broken edit
+// keeps the previous overrides. Dispatch and queue workers apply overrides
+// themselves, so give them the same file.
+var partOverridesFile = getEnv("PART_OVERRIDES_FILE", "")
+
+// How often renders look at the file's modification time
+const partOverridesCheckInterval = 10 * time.Second
+
+type partOverride struct {
+	opts RenderOptions
+	// The RenderOptions fields the override sets
+	fields []int
+}
+
+var partOverrides = struct {
+	sync.Mutex
+	byPart  map[string]partOverride
+	modTime time.Time
+	checked time.Time
+}{}
+
+// Load PART_OVERRIDES_FILE at startup
+func loadPartOverrides() error {
+	if partOverridesFile == "" {
+		return nil
+	}
+	info, err := os.Stat(partOverridesFile)
+	if err != nil {
+		return err
+	}
+	byPart, err := readPartOverrides(partOverridesFile)
+	if err != nil {
+		return err
+	}
+	partOverrides.Lock()
+	partOverrides.byPart, partOverrides.modTime, partOverrides.checked = byPart, info.ModTime(), time.Now()
+	partOverrides.Unlock()
+	log.Printf("Part overrides: %d", len(byPart))
+	return nil
+}
+
+func readPartOverrides(path string) (map[string]partOverride, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if ext := strings.ToLower(filepath.Ext(path)); ext == ".yaml" || ext == ".yml" {
+		if data, err = yamlToJSON(data); err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", path, err)
+		}
+	}
+	var requests map[string]RenderRequest
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&requests); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+
+	defaults, _ := (&RenderRequest{}).options()
+	byPart := make(map[string]partOverride, len(requests))
+	for part, req := range requests {
+		clean, ok := cleanPartNumber(part)
+		if !ok {
+			return nil, fmt.Errorf("%q is not an LDraw part number", part)
+		}
+		if req.PartNumber != "" {
+			return nil, fmt.Errorf("part %s: partNumber can't be set in an override", part)
+		}
+		opts, err := req.options()
+		if err != nil {
+			return nil, fmt.Errorf("part %s: %w", part, err)
+		}
+		o := partOverride{opts: opts}
+		v, d := reflect.ValueOf(opts), reflect.ValueOf(defaults)
+		for i := 0; i < v.NumField(); i++ {
+			if !v.Field(i).Equal(d.Field(i)) {
+				o.fields = append(o.fields, i)
+			}
+		}
+		byPart[strings.ToLower(clean)] = o
+	}
+	return byPart, nil
+}
+
+// Read the file again if it has changed since it was last looked at
+func refreshPartOverrides() {
+	partOverrides.Lock()
+	defer partOverrides.Unlock()
+	if time.Since(partOverrides.checked) < partOverridesCheckInterval {
+		return
+	}
+	partOverrides.checked = time.Now()
+	info, err := os.Stat(partOverridesFile)
+	if err != nil || info.ModTime().Equal(partOverrides.modTime) {
+		return
+	}
+	byPart, err := readPartOverrides(partOverridesFile)
+	if err != nil {
+		log.Printf("Reloading part overrides failed, keeping the old ones: %v", err)
+		return
+	}
+	partOverrides.byPart, partOverrides.modTime = byPart, info.ModTime()
+	log.Printf("Reloaded %d part overrides from %s", len(byPart), partOverridesFile)
+}
+
+// A part's options with its override filled in where they're defaults
+func applyPartOverride(partNumber string, opts RenderOptions) RenderOptions {
+	if partOverridesFile == "" {
+		return opts
+	}
+	refreshPartOverrides()
+	partOverrides.Lock()
+	o, ok := partOverrides.byPart[strings.ToLower(partNumber)]
+	partOverrides.Unlock()
+	if !ok {
+		return opts
+	}
+	defaults, _ := (&RenderRequest{}).options()
+	v, d, src := reflect.ValueOf(&opts).Elem(), reflect.ValueOf(defaults), reflect.ValueOf(o.opts)
+	for _, i := range o.fields {
+		if v.Field(i).Equal(d.Field(i)) {
+			v.Field(i).Set(src.Field(i))
+		}
+	}
+	return opts
+}
+
+// Convert the YAML an overrides file needs to JSON: nested block mappings
+// of scalars (numbers, true, false, null, and plain or quoted strings), and
+// # comments. Lists, flow style, anchors, and multi-line strings aren't
+// supported.
+func yamlToJSON(data []byte) ([]byte, error) {
+	type level struct {
+		indent int
+		m      map[string]any
+	}
+	root := map[string]any{}
+	stack := []level{{-1, root}}
+	// The mapping the last line's key opened, if any
+	var open map[string]any
+	for n, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimRight(line, " \t\r")
+		trimmed := strings.TrimLeft(line, " ")
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") || trimmed == "---" {
+			continue
+		}
+		if strings.HasPrefix(trimmed, "\t") {
+			return nil, fmt.Errorf("line %d: indent with spaces, not tabs", n+1)
+		}
+		indent := len(line) - len(trimmed)
+		// A key with nothing indented under it is an empty mapping
+		if open != nil && indent > stack[len(stack)-1].indent {
+			stack = append(stack, level{indent, open})
+		}
+		open = nil
+		if stack[0].indent < 0 {
+			stack[0].indent = indent
+		}
+		for len(stack) > 1 && indent < stack[len(stack)-1].indent {
+			stack = stack[:len(stack)-1]
+		}
+		if indent != stack[len(stack)-1].indent {
+			return nil, fmt.Errorf("line %d: inconsistent indentation", n+1)
+		}
+
+		key, value, err := splitYAMLPair(trimmed)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n+1, err)
+		}
+		m := stack[len(stack)-1].m
+		if _, dup := m[key]; dup {
+			return nil, fmt.Errorf("line %d: duplicate key %q", n+1, key)
+		}
+		if value == "" {
+			open = map[string]any{}
+			m[key] = open
+			continue
+		}
+		if m[key], err = yamlScalar(value); err != nil {
+			return nil, fmt.Errorf("line %d: %w", n+1, err)
+		}
+	}
+	return json.Marshal(root)
+}
+
+// "key: value" with an optional trailing comment; value is "" for a key
+// that opens a mapping
+func splitYAMLPair(line string) (string, string, error) {
+	var key, rest string
+	if line[0] == '"' || line[0] == '\'' {
+		end := strings.IndexByte(line[1:], line[0])
+		if end < 0 {
+			return "", "", fmt.Errorf("unterminated quoted key")
+		}
+		key, rest = line[1:end+1], line[end+2:]
+		if !strings.HasPrefix(rest, ":") {
+			return "", "", fmt.Errorf("expected a colon after the key")
+		}
+		rest = rest[1:]
+	} else {
+		var ok bool
+		key, rest, ok = strings.Cut(line, ":")
+		if !ok {
+			return "", "", fmt.Errorf("expected key: value")
+		}
+		key = strings.TrimSpace(key)
+	}
+	if rest != "" && rest[0] != ' ' {
+		return "", "", fmt.Errorf("expected a space after the colon")
+	}
+	rest = strings.TrimSpace(rest)
+	switch {
+	case strings.HasPrefix(rest, "#"):
+		rest = ""
+	case rest != "" && rest[0] != '"' && rest[0] != '\'':
+		if i := strings.Index(rest, " #"); i >= 0 {
+			rest = strings.TrimSpace(rest[:i])
+		}
+	}
+	return key, rest, nil
+}
+
+func yamlScalar(value string) (any, error) {
+	switch {
+	case value[0] == '"':
+		end := strings.LastIndexByte(value, '"')
+		if end == 0 {
+			return nil, fmt.Errorf("unterminated string")
+		}
+		return strconv.Unquote(value[:end+1])
+	case value[0] == '\'':
+		end := strings.LastIndexByte(value, '\'')
+		if end == 0 {
+			return nil, fmt.Errorf("unterminated string")
+		}
+		return strings.ReplaceAll(value[1:end], "''", "'"), nil
+	case value == "true" || value == "false":
+		return value == "true", nil
+	case value == "null" || value == "~":
+		return nil, nil
+	case strings.ContainsAny(value[:1], "[{&*!|>"):
+		return nil, fmt.Errorf("%q: only plain scalars and nested mappings are supported", value)
+	}
+	if f, err := strconv.ParseFloat(value, 64); err == nil {
+		return f, nil
+	}
+	return value, nil
+}
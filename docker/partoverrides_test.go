@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Point PART_OVERRIDES_FILE at a file of the given name and contents
+func withPartOverrides(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	os.WriteFile(path, []byte(content), 0o644)
+	old := partOverridesFile
+	partOverridesFile = path
+	t.Cleanup(func() {
+		partOverridesFile = old
+		partOverrides.Lock()
+		partOverrides.byPart = nil
+		partOverrides.Unlock()
+	})
+	if err := loadPartOverrides(); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestApplyPartOverride(t *testing.T) {
+	path := withPartOverrides(t, "overrides.json", `{"3641": {"cameraLatitude": 10, "thickness": 4}}`)
+	defaults, _ := (&RenderRequest{}).options()
+
+	opts := applyPartOverride("3641", defaults)
+	if opts.CameraLatitude != 10 || opts.Thickness != 4 || opts.CameraLongitude != defaults.CameraLongitude {
+		t.Errorf("override not applied: %+v", opts)
+	}
+	chosen, _ := (&RenderRequest{Thickness: 3}).options()
+	if opts := applyPartOverride("3641", chosen); opts.Thickness != 3 || opts.CameraLatitude != 10 {
+		t.Errorf("expected the caller's thickness to stay, got %+v", opts)
+	}
+	if opts := applyPartOverride("3001", defaults); opts != defaults {
+		t.Errorf("a part without an override changed: %+v", opts)
+	}
+
+	// Edits are picked up; broken ones are ignored
+	reload := func(content string, modTime time.Time) {
+		os.WriteFile(path, []byte(content), 0o644)
+		os.Chtimes(path, modTime, modTime)
+		partOverrides.Lock()
+		partOverrides.checked = time.Time{}
+		partOverrides.Unlock()
+	}
+	reload(`{"3641": {"cameraLatitude": 20}}`, time.Now().Add(time.Minute))
+	if opts := applyPartOverride("3641", defaults); opts.CameraLatitude != 20 || opts.Thickness != defaults.Thickness {
+		t.Errorf("edited override not applied: %+v", opts)
+	}
+	reload(`{"3641": {"thickness": 99}}`, time.Now().Add(2*time.Minute))
+	if opts := applyPartOverride("3641", defaults); opts.CameraLatitude != 20 {
+		t.Errorf("expected an invalid edit to keep the old overrides, got %+v", opts)
+	}
+}
+
+func TestLoadPartOverridesErrors(t *testing.T) {
+	for name, content := range map[string]string{
+		"bad-options.json": `{"3641": {"thickness": 99}}`,
+		"bad-part.json":    `{"../etc": {"thickness": 3}}`,
+		"unknown.json":     `{"3641": {"cameraAngle": 3}}`,
+		"list.yaml":        "3641:\n  - 1\n",
+	} {
+		path := filepath.Join(t.TempDir(), name)
+		os.WriteFile(path, []byte(content), 0o644)
+		if _, err := readPartOverrides(path); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestPartOverridesYAML(t *testing.T) {
+	got, err := yamlToJSON([]byte(`# Wheels show their tread
+"3641":
+  cameraLatitude: 10   # nearly side on
+  strokeColor: '#333'
+  edgeTypes:
+    contour: true
+
+4073:
+  fillColor: "red # not a comment"
+  metadata: false
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v, want map[string]any
+	json.Unmarshal(got, &v)
+	json.Unmarshal([]byte(`{"3641": {"cameraLatitude": 10, "strokeColor": "#333", "edgeTypes": {"contour": true}},
+		"4073": {"fillColor": "red # not a comment", "metadata": false}}`), &want)
+	if !reflect.DeepEqual(v, want) {
+		t.Errorf("got %s", got)
+	}
+
+	for _, bad := range []string{"a:\n  b: 1\n c: 2\n", "a: [1, 2]\n", "a:1\n", "a: 1\na: 2\n"} {
+		if _, err := yamlToJSON([]byte(bad)); err == nil {
+			t.Errorf("expected an error for %q", bad)
+		}
+	}
+}
+
+func TestRenderPartOverride(t *testing.T) {
+	withFakeBlender(t)
+	withTestLibrary(t, map[string]string{"3641": "0 Tyre\n"})
+	cache := withRenderCache(t)
+	withPartOverrides(t, "overrides.yaml", "3641:\n  cameraLatitude: 10\n")
+
+	opts, _ := (&RenderRequest{}).options()
+	if _, _, err := renderPart(context.Background(), "3641", opts); err != nil {
+		t.Fatal(err)
+	}
+	overridden := opts
+	overridden.CameraLatitude = 10
+	if !cache.has(renderCacheKey("3641", overridden)) || cache.has(renderCacheKey("3641", opts)) {
+		t.Error("expected the render to use the part's override")
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Line style plugins let operators extend render_part.py without forking
+// it. Every <name>.py in LINE_STYLE_PLUGINS_DIR is a plugin, selected with
+// "lineStylePlugin": "<name>" on a render request. The script imports it
+// and calls, if defined:
+//
+//	apply(linestyle, args)  once per line set, after the built-in modifiers
+//	postprocess(svg_path, args)  on the finished SVG
+//
+// where args is the script's parsed arguments. The directory is read at
+// startup; a plugin's digest goes into the cache key, so editing one (and
+// restarting) renders afresh. Plugins run with Blender's privileges, so
+// only operators should be able to write the directory.
+var lineStylePluginsDir = getEnv("LINE_STYLE_PLUGINS_DIR", "")
+
+type LineStylePlugin struct {
+	Name string `json:"name"`
+	// SHA-256 of the script, shortened
+	Digest string `json:"digest"`
+	path   string
+}
+
+var pluginNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+
+// Plugins by name
+var lineStylePlugins = map[string]LineStylePlugin{}
+
+// Read LINE_STYLE_PLUGINS_DIR into the registry
+func loadLineStylePlugins() error {
+	if lineStylePluginsDir == "" {
+		return nil
+	}
+	files, err := filepath.Glob(filepath.Join(lineStylePluginsDir, "*.py"))
+	if err != nil {
+		return err
+	}
+	plugins := make(map[string]LineStylePlugin, len(files))
+	for _, file := range files {
+		name := strings.TrimSuffix(filepath.Base(file), ".py")
+		if !pluginNamePattern.MatchString(name) {
+			return fmt.Errorf("%s: plugin names are lowercase letters, digits, - and _", file)
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(data)
+		plugins[name] = LineStylePlugin{Name: name, Digest: hex.EncodeToString(sum[:8]), path: file}
+	}
+	if len(plugins) == 0 {
+		return fmt.Errorf("no plugins (*.py) in %s", lineStylePluginsDir)
+	}
+	lineStylePlugins = plugins
+	return nil
+}
+
+// Check a request's plugin name against the registry
+func lookupLineStylePlugin(name string) (LineStylePlugin, error) {
+	p, ok := lineStylePlugins[name]
+	if !ok {
+		return p, fmt.Errorf("unknown line style plugin %q (see GET /line-style-plugins)", name)
+	}
+	return p, nil
+}
+
+// The script for a render's plugin, if it has one. Renders can run on
+// other nodes (dispatch, the job queue), which must have the same plugin.
+func lineStylePluginFile(opts RenderOptions) (string, error) {
+	if opts.LineStylePlugin == "" {
+		return "", nil
+	}
+	p, ok := lineStylePlugins[opts.LineStylePlugin]
+	if !ok || p.Digest != opts.LineStylePluginDigest {
+		return "", &RenderError{http.StatusInternalServerError, "Line style plugin unavailable",
+			fmt.Sprintf("%s isn't installed on this node, or differs from the requesting node's", opts.LineStylePlugin)}
+	}
+	return p.path, nil
+}
+
+// Plugin registry endpoint
+func handleLineStylePlugins(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		sendError(w, http.StatusMethodNotAllowed, "Method not allowed", "")
+		return
+	}
+	list := make([]LineStylePlugin, 0, len(lineStylePlugins))
+	for _, p := range lineStylePlugins {
+		list = append(list, p)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"plugins": list})
+}
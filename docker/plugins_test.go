@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func withLineStylePlugins(t *testing.T, plugins map[string]string) {
+	t.Helper()
+	dir := t.TempDir()
+	for name, src := range plugins {
+		os.WriteFile(filepath.Join(dir, name), []byte(src), 0o644)
+	}
+	oldDir, oldPlugins := lineStylePluginsDir, lineStylePlugins
+	lineStylePluginsDir = dir
+	t.Cleanup(func() { lineStylePluginsDir, lineStylePlugins = oldDir, oldPlugins })
+}
+
+func TestLineStylePlugins(t *testing.T) {
+	withLineStylePlugins(t, map[string]string{
+		"fancy-taper.py": "def apply(linestyle, args):\n    pass\n",
+		"ink.py":         "def postprocess(svg_path, args):\n    pass\n",
+		"README.txt":     "not a plugin",
+	})
+	if err := loadLineStylePlugins(); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	handleLineStylePlugins(w, httptest.NewRequest(http.MethodGet, "/line-style-plugins", nil))
+	var resp struct{ Plugins []LineStylePlugin }
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if len(resp.Plugins) != 2 || resp.Plugins[0].Name != "fancy-taper" || len(resp.Plugins[0].Digest) != 16 {
+		t.Fatalf("unexpected plugins %+v", resp.Plugins)
+	}
+
+	req := RenderRequest{LineStylePlugin: "fancy-taper"}
+	opts, err := req.options()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.LineStylePluginDigest != resp.Plugins[0].Digest {
+		t.Errorf("expected the plugin's digest in the options, got %+v", opts)
+	}
+	req = RenderRequest{LineStylePlugin: "../ink"}
+	if _, err := req.options(); err == nil || !strings.Contains(err.Error(), "unknown line style plugin") {
+		t.Errorf("expected an unknown plugin error, got %v", err)
+	}
+
+	// The script gets the plugin's path
+	capture := withFakeBlender(t)
+	input := filepath.Join(t.TempDir(), "3001.dat")
+	os.WriteFile(input, []byte("0 Brick 2 x 4\n"), 0o644)
+	if _, _, err := renderFile(context.Background(), "contract", input, opts); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(capture)
+	var args map[string]string
+	json.Unmarshal(data, &args)
+	if args["line_style_plugin"] != filepath.Join(lineStylePluginsDir, "fancy-taper.py") {
+		t.Errorf("unexpected plugin argument %q", args["line_style_plugin"])
+	}
+
+	// A node whose copy differs won't render it
+	opts.LineStylePluginDigest = "0000000000000000"
+	if _, _, err := renderFile(context.Background(), "contract", input, opts); err == nil || !strings.Contains(err.Error(), "plugin unavailable") {
+		t.Errorf("expected a plugin mismatch, got %v", err)
+	}
+}
+
+func TestLineStylePluginNames(t *testing.T) {
+	withLineStylePlugins(t, map[string]string{"Fancy Taper.py": ""})
+	if err := loadLineStylePlugins(); err == nil {
+		t.Error("expected a bad plugin name to fail")
+	}
+	withLineStylePlugins(t, nil)
+	if err := loadLineStylePlugins(); err == nil {
+		t.Error("expected an empty plugin directory to fail")
+	}
+}
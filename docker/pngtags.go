@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/draw"
+	"image/png"
+)
+
+// PNG outputs are tagged for print workflows, which reject untagged images:
+// an sRGB chunk (with the gAMA and cHRM values the PNG spec pairs with it,
+// for readers that predate sRGB) and the render's metadata as tEXt chunks.
+// rsvg-convert writes 8 bits per channel; depth=16 re-encodes at 16.
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// The PNG bit depth in a depth query parameter
+func parsePNGDepth(value string) (int, error) {
+	switch value {
+	case "", "8":
+		return 8, nil
+	case "16":
+		return 16, nil
+	}
+	return 0, fmt.Errorf("depth must be 8 or 16")
+}
+
+// Tag a PNG as sRGB with a render's metadata, at the given bit depth
+func tagPNG(data []byte, meta RenderMetadata, depth int) ([]byte, error) {
+	if depth == 16 {
+		img, err := png.Decode(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		deep := image.NewNRGBA64(img.Bounds())
+		draw.Draw(deep, deep.Bounds(), img, img.Bounds().Min, draw.Src)
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, deep); err != nil {
+			return nil, err
+		}
+		data = buf.Bytes()
+	}
+
+	// Rendering intent 0 (perceptual); gamma 1/2.2 and the sRGB white point
+	// and primaries, scaled by 100000
+	chunks := [][]byte{
+		pngChunk("sRGB", []byte{0}),
+		pngChunk("gAMA", binary.BigEndian.AppendUint32(nil, 45455)),
+		pngChunk("cHRM", appendUint32s(nil, 31270, 32900, 64000, 33000, 30000, 60000, 15000, 6000)),
+	}
+	for _, kv := range meta.pngText() {
+		chunks = append(chunks, pngChunk("tEXt", append(append(latin1(kv[0]), 0), latin1(kv[1])...)))
+	}
+	return insertPNGChunks(data, chunks), nil
+}
+
+// Add chunks after a PNG's header chunk, where color space chunks belong
+func insertPNGChunks(data []byte, chunks [][]byte) []byte {
+	// The signature and a 13-byte IHDR chunk: length, type, data, CRC
+	headerEnd := len(pngSignature) + 4 + 4 + 13 + 4
+	if len(data) < headerEnd || !bytes.HasPrefix(data, pngSignature) || string(data[12:16]) != "IHDR" {
+		return data
+	}
+	out := append([]byte{}, data[:headerEnd]...)
+	for _, c := range chunks {
+		out = append(out, c...)
+	}
+	return append(out, data[headerEnd:]...)
+}
+
+func pngChunk(kind string, data []byte) []byte {
+	chunk := binary.BigEndian.AppendUint32(nil, uint32(len(data)))
+	chunk = append(chunk, kind...)
+	chunk = append(chunk, data...)
+	return binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+}
+
+func appendUint32s(b []byte, values ...uint32) []byte {
+	for _, v := range values {
+		b = binary.BigEndian.AppendUint32(b, v)
+	}
+	return b
+}
+
+// tEXt is Latin-1 by the spec; anything else is replaced
+func latin1(s string) []byte {
+	b := make([]byte, 0, len(s))
+	for _, r := range s {
+		if r == 0 || r > 0xff {
+			r = '?'
+		}
+		b = append(b, byte(r))
+	}
+	return b
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+)
+
+func TestParsePNGDepth(t *testing.T) {
+	for value, want := range map[string]int{"": 8, "8": 8, "16": 16} {
+		if got, err := parsePNGDepth(value); err != nil || got != want {
+			t.Errorf("parsePNGDepth(%q) = %d, %v", value, got, err)
+		}
+	}
+	for _, value := range []string{"1", "32", "deep"} {
+		if _, err := parsePNGDepth(value); err == nil {
+			t.Errorf("expected an error for %q", value)
+		}
+	}
+}
+
+func TestTagPNG(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, 2, 2))
+	src.Set(1, 1, color.NRGBA{R: 0xff, A: 0xff})
+	var buf bytes.Buffer
+	png.Encode(&buf, src)
+	meta := renderMetadata("3001", RenderOptions{FillColor: "white", GhostFile: "/tmp/ghost.ldr"})
+
+	for _, depth := range []int{8, 16} {
+		out, err := tagPNG(buf.Bytes(), meta, depth)
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, err := png.Decode(bytes.NewReader(out))
+		if err != nil {
+			t.Fatalf("tagged PNG doesn't decode: %v", err)
+		}
+		if _, deep := img.(*image.NRGBA64); deep != (depth == 16) {
+			t.Errorf("depth %d: decoded as %T", depth, img)
+		}
+		if r, _, _, _ := img.At(1, 1).RGBA(); r != 0xffff {
+			t.Errorf("depth %d: pixel changed to %v", depth, img.At(1, 1))
+		}
+		// Color space chunks come right after IHDR, before the image data
+		srgb := bytes.Index(out, []byte("sRGB\x00"))
+		if srgb != 8+25+4 || bytes.Index(out, []byte("IDAT")) < srgb {
+			t.Errorf("depth %d: sRGB chunk at %d", depth, srgb)
+		}
+		for _, want := range []string{"gAMA", "cHRM", "tEXtTitle\x003001", "tEXtSoftware\x00lego-part-renderer ", `"FillColor":"white"`} {
+			if !bytes.Contains(out, []byte(want)) {
+				t.Errorf("depth %d: missing %q", depth, want)
+			}
+		}
+		if bytes.Contains(out, []byte("ghost.ldr")) {
+			t.Error("expected temp paths left out")
+		}
+	}
+}
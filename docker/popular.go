@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Part requests are counted per part and option set, so that after a render
+// script or library upgrade has invalidated the cache, the most requested
+// renders can be queued for prewarming without an operator listing them.
+// The counts are kept in STATE_DIR/popular.json so they survive deploys.
+
+var (
+	// PREWARM_POPULAR is how many of the most requested renders to warm on
+	// a version change (0 disables the scheduler)
+	prewarmPopular      = getEnvInt("PREWARM_POPULAR", 0)
+	prewarmCheckMinutes = getEnvInt("PREWARM_CHECK_MINUTES", 10)
+)
+
+const (
+	popularFile       = "popular.json"
+	warmedVersionFile = "warmed-version"
+	// Beyond this many distinct renders, one-off requests are forgotten
+	popularMaxEntries = 20000
+)
+
+type popularEntry struct {
+	PartNumber string        `json:"partNumber"`
+	Options    RenderOptions `json:"options"`
+	Count      int64         `json:"count"`
+}
+
+var popular = struct {
+	sync.Mutex
+	entries map[string]*popularEntry
+}{entries: make(map[string]*popularEntry)}
+
+// Count a request for a part render
+func recordPartRequest(partNumber string, opts RenderOptions) {
+	key := renderRequestKey(partNumber, opts)
+	popular.Lock()
+	defer popular.Unlock()
+	if e, ok := popular.entries[key]; ok {
+		e.Count++
+		return
+	}
+	if len(popular.entries) >= popularMaxEntries {
+		for k, e := range popular.entries {
+			if e.Count <= 1 {
+				delete(popular.entries, k)
+			}
+		}
+	}
+	popular.entries[key] = &popularEntry{partNumber, opts, 1}
+}
+
+// The n most requested renders, most requested first
+func topPopular(n int) []popularEntry {
+	popular.Lock()
+	entries := make([]popularEntry, 0, len(popular.entries))
+	for _, e := range popular.entries {
+		entries = append(entries, *e)
+	}
+	popular.Unlock()
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Count != entries[j].Count {
+			return entries[i].Count > entries[j].Count
+		}
+		return entries[i].PartNumber < entries[j].PartNumber
+	})
+	if len(entries) > n {
+		entries = entries[:n]
+	}
+	return entries
+}
+
+func savePopular(dir string) error {
+	popular.Lock()
+	entries := make([]*popularEntry, 0, len(popular.entries))
+	for _, e := range popular.entries {
+		entries = append(entries, e)
+	}
+	data, err := json.Marshal(entries)
+	popular.Unlock()
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(dir, popularFile+".tmp")
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, popularFile))
+}
+
+// Load saved counts; a missing file is an empty history
+func loadPopular(dir string) error {
+	data, err := os.ReadFile(filepath.Join(dir, popularFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var entries []popularEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return err
+	}
+	popular.Lock()
+	defer popular.Unlock()
+	for i := range entries {
+		e := entries[i]
+		popular.entries[renderRequestKey(e.PartNumber, e.Options)] = &e
+	}
+	return nil
+}
+
+// Queue the n most requested renders if the render version has changed
+// since the last warm-up. Returns the current version and how many renders
+// were queued.
+func warmPopular(dir string, n int, lastVersion string) (string, int) {
+	version := refreshRenderVersion()
+	if version == lastVersion {
+		return version, 0
+	}
+	queued := 0
+	for _, e := range topPopular(n) {
+		if !renderCache.has(renderCacheKey(e.PartNumber, e.Options)) && enqueuePrewarm(prewarmJob{partNumber: e.PartNumber, opts: e.Options}) {
+			queued++
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, warmedVersionFile), []byte(version), 0o644); err != nil {
+		log.Printf("Failed to record warmed render version: %v", err)
+	}
+	log.Printf("Render version %s: queued %d popular renders", version, queued)
+	return version, queued
+}
+
+// Periodically save the request counts and warm the popular renders after a
+// version change. Runs from main when PREWARM_POPULAR and STATE_DIR are set.
+func runPopularScheduler(dir string, n int, interval time.Duration) {
+	if err := loadPopular(dir); err != nil {
+		log.Printf("Failed to load popular parts: %v", err)
+	}
+	last, _ := os.ReadFile(filepath.Join(dir, warmedVersionFile))
+	version := string(last)
+	for {
+		version, _ = warmPopular(dir, n, version)
+		time.Sleep(interval)
+		if err := savePopular(dir); err != nil {
+			log.Printf("Failed to save popular parts: %v", err)
+		}
+	}
+}
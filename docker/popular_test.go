@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func resetPopular(t *testing.T) {
+	t.Helper()
+	popular.Lock()
+	old := popular.entries
+	popular.entries = make(map[string]*popularEntry)
+	popular.Unlock()
+	t.Cleanup(func() {
+		popular.Lock()
+		popular.entries = old
+		popular.Unlock()
+	})
+}
+
+func TestTopPopular(t *testing.T) {
+	resetPopular(t)
+	thin := RenderOptions{Thickness: 1}
+	thick := RenderOptions{Thickness: 4}
+	for i := 0; i < 3; i++ {
+		recordPartRequest("3003", thin)
+	}
+	recordPartRequest("3001", thin)
+	recordPartRequest("3001", thick)
+	recordPartRequest("3001", thick)
+	// Part numbers are matched case-insensitively, like the library
+	recordPartRequest("3003", thin)
+
+	top := topPopular(2)
+	if len(top) != 2 || top[0].PartNumber != "3003" || top[0].Count != 4 || top[1].Options != thick {
+		t.Errorf("unexpected ranking %+v", top)
+	}
+
+	dir := t.TempDir()
+	if err := savePopular(dir); err != nil {
+		t.Fatal(err)
+	}
+	resetPopular(t)
+	if err := loadPopular(dir); err != nil {
+		t.Fatal(err)
+	}
+	if got := topPopular(10); len(got) != 3 || got[0].Count != 4 {
+		t.Errorf("counts did not survive a save and load: %+v", got)
+	}
+}
+
+func TestWarmPopular(t *testing.T) {
+	withFakeBlender(t)
+	withTestLibrary(t, map[string]string{"3001": "0 Brick 2 x 4\n", "3003": "0 Brick 2 x 2\n"})
+	withRenderCache(t)
+	withPrewarmStopped(t)
+	resetPopular(t)
+	old := prewarmPopular
+	prewarmPopular = 10
+	t.Cleanup(func() { prewarmPopular = old })
+	refreshRenderVersion()
+
+	req := RenderRequest{}
+	opts, _ := req.options()
+	// Interactive renders are counted, prewarm renders aren't
+	renderPart(context.Background(), "3001", opts)
+	renderPart(withLowPriority(context.Background()), "3003", opts)
+	if top := topPopular(10); len(top) != 1 || top[0].PartNumber != "3001" {
+		t.Fatalf("unexpected counts %+v", top)
+	}
+
+	dir := t.TempDir()
+	version, queued := warmPopular(dir, 10, "")
+	if queued != 0 {
+		t.Errorf("the popular render is cached, but %d were queued", queued)
+	}
+	if saved, _ := os.ReadFile(filepath.Join(dir, warmedVersionFile)); string(saved) != version {
+		t.Errorf("warmed version %q not recorded", saved)
+	}
+
+	// A library update changes the version and invalidates the cache
+	os.WriteFile(filepath.Join(ldrawPath, "LDConfig.ldr"), []byte(testLDConfig+"0 // updated\n"), 0o644)
+	next, queued := warmPopular(dir, 10, version)
+	if next == version || queued != 1 {
+		t.Errorf("expected one render queued for the new version %s, got %d", next, queued)
+	}
+	if _, queued := warmPopular(dir, 10, next); queued != 0 {
+		t.Error("an unchanged version should queue nothing")
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// POST /render/prepare turns a set of render options into a short hash, and
+// GET /r/{part}/{hash}.svg renders with them. The GET URL has no query
+// string, so any CDN can cache it as-is.
+//
+// The hash is the first 16 hex digits of the SHA-256 of the normalized
+// options (every default filled in) as JSON, so requests that differ only
+// in spelling (a default given explicitly, edge type order) share a hash.
+// Prepared options are kept in memory and, with STATE_DIR, in
+// STATE_DIR/params so links survive restarts. Memory holds the
+// PREPARED_PARAMS_MAX most recently used sets; those unused for
+// PREPARED_PARAMS_TTL are forgotten, files and all, by an hourly sweep.
+
+const paramsHashLength = 16
+
+var paramsHashPattern = regexp.MustCompile(`^[0-9a-f]{16}$`)
+
+var (
+	preparedParamsMax = getEnvInt("PREPARED_PARAMS_MAX", 10000)
+	preparedParamsTTL = getEnvDuration("PREPARED_PARAMS_TTL", 90*24*time.Hour)
+)
+
+var preparedParams = struct {
+	sync.Mutex
+	// Most recently used at the front
+	order  *list.List
+	byHash map[string]*list.Element
+}{order: list.New(), byHash: make(map[string]*list.Element)}
+
+type preparedEntry struct {
+	hash     string
+	opts     RenderOptions
+	lastUsed time.Time
+}
+
+type PrepareResponse struct {
+	Hash string `json:"hash"`
+	// URLTemplate has a {part} placeholder; URL is filled in when the
+	// request names a part
+	URLTemplate string `json:"urlTemplate"`
+	URL         string `json:"url,omitempty"`
+}
+
+func paramsHash(opts RenderOptions) string {
+	params, _ := json.Marshal(opts)
+	sum := sha256.Sum256(params)
+	return hex.EncodeToString(sum[:])[:paramsHashLength]
+}
+
+func paramsPath(hash string) string {
+	return filepath.Join(stateDir, "params", hash+".json")
+}
+
+// Keep a parameter set in memory as the most recently used, evicting the
+// least recently used past PREPARED_PARAMS_MAX; they stay on disk. Returns
+// whether it was already there. Callers hold the preparedParams lock.
+func rememberParamsLocked(hash string, opts RenderOptions) bool {
+	if el, ok := preparedParams.byHash[hash]; ok {
+		el.Value.(*preparedEntry).lastUsed = time.Now()
+		preparedParams.order.MoveToFront(el)
+		return true
+	}
+	preparedParams.byHash[hash] = preparedParams.order.PushFront(&preparedEntry{hash, opts, time.Now()})
+	for preparedParams.order.Len() > max(preparedParamsMax, 1) {
+		el := preparedParams.order.Back()
+		preparedParams.order.Remove(el)
+		delete(preparedParams.byHash, el.Value.(*preparedEntry).hash)
+	}
+	return false
+}
+
+// Remember a parameter set and return its hash
+func prepareParams(opts RenderOptions) (string, error) {
+	hash := paramsHash(opts)
+	preparedParams.Lock()
+	known := rememberParamsLocked(hash, opts)
+	preparedParams.Unlock()
+
+	if !known && stateDir != "" {
+		data, _ := json.Marshal(opts)
+		if err := writeFileAtomic(paramsPath(hash), data); err != nil {
+			return "", fmt.Errorf("saving parameters: %w", err)
+		}
+	}
+	return hash, nil
+}
+
+func lookupParams(hash string) (RenderOptions, bool) {
+	preparedParams.Lock()
+	el, ok := preparedParams.byHash[hash]
+	if ok {
+		rememberParamsLocked(hash, el.Value.(*preparedEntry).opts)
+	}
+	preparedParams.Unlock()
+	if ok {
+		return el.Value.(*preparedEntry).opts, true
+	}
+	if stateDir == "" {
+		return RenderOptions{}, false
+	}
+
+	var opts RenderOptions
+	data, err := os.ReadFile(paramsPath(hash))
+	if err != nil || json.Unmarshal(data, &opts) != nil || paramsHash(opts) != hash {
+		return RenderOptions{}, false
+	}
+	// The file's modification time is when it was last loaded, for the sweep
+	now := time.Now()
+	os.Chtimes(paramsPath(hash), now, now)
+	preparedParams.Lock()
+	rememberParamsLocked(hash, opts)
+	preparedParams.Unlock()
+	return opts, true
+}
+
+// Forget parameter sets unused for PREPARED_PARAMS_TTL, in memory and under
+// STATE_DIR/params. A file older than that whose set was used in memory
+// since is kept, dated to that use.
+func sweepPreparedParams(now time.Time) {
+	cutoff := now.Add(-preparedParamsTTL)
+	used := map[string]time.Time{}
+	var forgotten []string
+	preparedParams.Lock()
+	for hash, el := range preparedParams.byHash {
+		entry := el.Value.(*preparedEntry)
+		if entry.lastUsed.Before(cutoff) {
+			preparedParams.order.Remove(el)
+			delete(preparedParams.byHash, hash)
+			forgotten = append(forgotten, hash)
+		} else {
+			used[hash] = entry.lastUsed
+		}
+	}
+	preparedParams.Unlock()
+	if stateDir == "" {
+		return
+	}
+
+	for _, hash := range forgotten {
+		os.Remove(paramsPath(hash))
+	}
+	entries, err := os.ReadDir(filepath.Join(stateDir, "params"))
+	if err != nil {
+		return
+	}
+	removed := 0
+	for _, e := range entries {
+		hash, ok := strings.CutSuffix(e.Name(), ".json")
+		info, err := e.Info()
+		if !ok || err != nil || !info.ModTime().Before(cutoff) {
+			continue
+		}
+		if lastUsed, ok := used[hash]; ok {
+			os.Chtimes(paramsPath(hash), lastUsed, lastUsed)
+		} else if os.Remove(paramsPath(hash)) == nil {
+			removed++
+		}
+	}
+	if n := removed + len(forgotten); n > 0 {
+		log.Printf("Forgot %d prepared parameter sets unused for %s", n, preparedParamsTTL)
+	}
+}
+
+func runPreparedParamsSweeper(interval time.Duration) {
+	for range time.Tick(interval) {
+		sweepPreparedParams(time.Now())
+	}
+}
+
+// Prepare endpoint
+func handleRenderPrepare(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		sendError(w, http.StatusMethodNotAllowed, "Method not allowed", "")
+		return
+	}
+
+	var req RenderRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	opts, err := req.options()
+	if err != nil {
+		sendValidationError(w, err)
+		return
+	}
+
+	hash, err := prepareParams(opts)
+	if err != nil {
+		sendError(w, http.StatusInternalServerError, "Failed to prepare parameters", err.Error())
+		return
+	}
+	resp := PrepareResponse{Hash: hash, URLTemplate: "/r/{part}/" + hash + ".svg"}
+	if req.PartNumber != "" {
+		resp.URL = "/r/" + url.PathEscape(req.PartNumber) + "/" + hash + ".svg"
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// Render endpoint for prepared parameters
+func handlePreparedRender(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		sendError(w, http.StatusMethodNotAllowed, "Method not allowed", "")
+		return
+	}
+	hash, ok := strings.CutSuffix(r.PathValue("file"), ".svg")
+	if !ok || !paramsHashPattern.MatchString(hash) {
+		sendError(w, http.StatusNotFound, "Not found", "Prepared renders are served as /r/{part}/{hash}.svg")
+		return
+	}
+	opts, ok := lookupParams(hash)
+	if !ok {
+		sendError(w, http.StatusNotFound, "Unknown parameter hash", "POST the parameters to /render/prepare first")
+		return
+	}
+
+	start := time.Now()
+	setPartHeaders(w, r.PathValue("part"), opts)
+	svg, renderDuration, cacheKey, err := renderPartKeyed(r.Context(), r.PathValue("part"), opts)
+	if err != nil {
+		sendRenderError(w, err)
+		return
+	}
+	log.Printf("Total request duration: %.2fs", time.Since(start).Seconds())
+	sendRender(w, r, svg, renderDuration, cacheKey)
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func resetPreparedParams(t *testing.T) {
+	t.Helper()
+	preparedParams.Lock()
+	oldOrder, oldByHash := preparedParams.order, preparedParams.byHash
+	preparedParams.order, preparedParams.byHash = list.New(), make(map[string]*list.Element)
+	preparedParams.Unlock()
+	t.Cleanup(func() {
+		preparedParams.Lock()
+		preparedParams.order, preparedParams.byHash = oldOrder, oldByHash
+		preparedParams.Unlock()
+	})
+}
+
+func prepare(t *testing.T, body string) PrepareResponse {
+	t.Helper()
+	w := httptest.NewRecorder()
+	handleRenderPrepare(w, httptest.NewRequest(http.MethodPost, "/render/prepare", strings.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("prepare %s: %d %s", body, w.Code, w.Body)
+	}
+	var resp PrepareResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	return resp
+}
+
+func TestRenderPrepare(t *testing.T) {
+	resetPreparedParams(t)
+	a := prepare(t, `{"thickness": 3}`)
+	// Defaults spelled out hash the same as defaults left out
+	b := prepare(t, `{"partNumber": "3001", "thickness": 3, "fillColor": "white", "edgeTypes": {"silhouette": true}}`)
+	if a.Hash != b.Hash || len(a.Hash) != paramsHashLength {
+		t.Errorf("equivalent options should share a hash: %q, %q", a.Hash, b.Hash)
+	}
+	if b.URL != "/r/3001/"+b.Hash+".svg" || a.URL != "" || a.URLTemplate != "/r/{part}/"+a.Hash+".svg" {
+		t.Errorf("unexpected URLs %+v %+v", a, b)
+	}
+	if c := prepare(t, `{"thickness": 4}`); c.Hash == a.Hash {
+		t.Error("different options should hash differently")
+	}
+
+	w := httptest.NewRecorder()
+	handleRenderPrepare(w, httptest.NewRequest(http.MethodPost, "/render/prepare", strings.NewReader(`{"thickness": 99}`)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for invalid options, got %d", w.Code)
+	}
+}
+
+func TestPreparedRender(t *testing.T) {
+	capture := withFakeBlender(t)
+	withTestLibrary(t, map[string]string{"3001": "0 Brick 2 x 4\n"})
+	resetPreparedParams(t)
+	old := stateDir
+	stateDir = t.TempDir()
+	t.Cleanup(func() { stateDir = old })
+
+	resp := prepare(t, `{"partNumber": "3001", "thickness": 3.5}`)
+	// Prepared parameters are read back from STATE_DIR after a restart
+	resetPreparedParams(t)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/r/{part}/{file}", handlePreparedRender)
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w
+	}
+
+	w := get(resp.URL)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "image/svg+xml" || w.Header().Get("ETag") == "" {
+		t.Fatalf("GET %s: %d %s", resp.URL, w.Code, w.Body)
+	}
+	var args map[string]string
+	data, _ := os.ReadFile(capture)
+	json.Unmarshal(data, &args)
+	if args["thickness"] != "3.5" {
+		t.Errorf("rendered with thickness %q", args["thickness"])
+	}
+
+	for path, want := range map[string]int{
+		"/r/3001/0123456789abcdef.svg":  http.StatusNotFound,
+		"/r/3001/" + resp.Hash:          http.StatusNotFound,
+		"/r/9999/" + resp.Hash + ".svg": http.StatusNotFound,
+	} {
+		if w := get(path); w.Code != want {
+			t.Errorf("GET %s: expected %d, got %d", path, want, w.Code)
+		}
+	}
+}
+
+func TestPreparedParamsBounded(t *testing.T) {
+	resetPreparedParams(t)
+	old, oldDir := preparedParamsMax, stateDir
+	preparedParamsMax, stateDir = 2, t.TempDir()
+	t.Cleanup(func() { preparedParamsMax, stateDir = old, oldDir })
+
+	a := prepare(t, `{"thickness": 1}`)
+	b := prepare(t, `{"thickness": 2}`)
+	lookupParams(a.Hash)
+	c := prepare(t, `{"thickness": 3}`)
+	// b was least recently used, so memory lets it go but the file stays
+	preparedParams.Lock()
+	_, aKept := preparedParams.byHash[a.Hash]
+	_, bKept := preparedParams.byHash[b.Hash]
+	n := preparedParams.order.Len()
+	preparedParams.Unlock()
+	if n != 2 || !aKept || bKept {
+		t.Errorf("expected a and c in memory, got %d entries (a %v, b %v)", n, aKept, bKept)
+	}
+	if _, ok := lookupParams(b.Hash); !ok {
+		t.Error("expected an evicted set to load from STATE_DIR")
+	}
+
+	// Sets unused for PREPARED_PARAMS_TTL are forgotten, files and all;
+	// c is used since, in memory, with its file still dated before
+	stale := time.Now().Add(-preparedParamsTTL - time.Hour)
+	preparedParams.Lock()
+	for _, el := range preparedParams.byHash {
+		el.Value.(*preparedEntry).lastUsed = stale
+	}
+	preparedParams.Unlock()
+	for _, hash := range []string{a.Hash, b.Hash, c.Hash} {
+		os.Chtimes(paramsPath(hash), stale, stale)
+	}
+	lookupParams(c.Hash)
+	sweepPreparedParams(time.Now())
+
+	entries, _ := os.ReadDir(filepath.Join(stateDir, "params"))
+	if len(entries) != 1 || entries[0].Name() != c.Hash+".json" {
+		t.Fatalf("expected only c's file left, got %v", entries)
+	}
+	if info, _ := entries[0].Info(); info.ModTime().Before(time.Now().Add(-time.Minute)) {
+		t.Error("expected c's file dated to its last use")
+	}
+	for _, hash := range []string{a.Hash, b.Hash} {
+		if _, ok := lookupParams(hash); ok {
+			t.Errorf("expected %s forgotten", hash)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Prewarm jobs fill the render cache in the background. A single worker
+// takes them in order and holds off while any interactive render is running,
+// so warming the cache after a deploy never competes with user traffic.
+
+const (
+	prewarmQueueSize = 10000
+	// How often an idle-waiting worker checks for interactive renders
+	prewarmBackoff = 500 * time.Millisecond
+)
+
+type prewarmJob struct {
+	partNumber string
+	opts       RenderOptions
+	// Set by enqueuePrewarm
+	queued     time.Time
+	generation int64
+}
+
+var (
+	prewarmQueue      = make(chan prewarmJob, prewarmQueueSize)
+	prewarmWorkerOnce sync.Once
+	// Renders in flight for requests (as opposed to prewarm jobs)
+	foregroundRenders atomic.Int64
+
+	// Jobs queued or rendering, and a signal when there are none
+	prewarmMu      sync.Mutex
+	prewarmPending int
+	prewarmIdle    = sync.NewCond(&prewarmMu)
+	// Bumped by stopPrewarm; the worker skips jobs queued before it
+	prewarmGeneration atomic.Int64
+)
+
+type lowPriorityKey struct{}
+
+// Mark a context's renders as background work that interactive renders
+// take precedence over
+func withLowPriority(ctx context.Context) context.Context {
+	return context.WithValue(ctx, lowPriorityKey{}, true)
+}
+
+func isLowPriority(ctx context.Context) bool {
+	low, _ := ctx.Value(lowPriorityKey{}).(bool)
+	return low
+}
+
+type PrewarmRequest struct {
+	Parts []string `json:"parts"`
+	// Options are the parameter sets each part is rendered with; omitted,
+	// parts are rendered with the /render defaults
+	Options []RenderRequest `json:"options"`
+}
+
+type PrewarmResponse struct {
+	// Queued renders, and those skipped because they are already cached
+	Queued int `json:"queued"`
+	Cached int `json:"cached"`
+	// Renders that didn't fit in the queue; retry them once it drains
+	Dropped int      `json:"dropped"`
+	Missing []string `json:"missing,omitempty"`
+	// Jobs waiting in the queue, including this request's
+	Pending int `json:"pending"`
+}
+
+// Prewarm endpoint
+func handlePrewarm(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		sendError(w, http.StatusMethodNotAllowed, "Method not allowed", "")
+		return
+	}
+	if renderCache == nil {
+		sendError(w, http.StatusConflict, "No render cache configured", "Set STATE_DIR to enable the render cache")
+		return
+	}
+
+	var req PrewarmRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	if len(req.Parts) == 0 {
+		sendError(w, http.StatusBadRequest, "parts is required", "")
+		return
+	}
+	if len(req.Options) == 0 {
+		req.Options = []RenderRequest{{}}
+	}
+	if n := len(req.Parts) * len(req.Options); n > prewarmQueueSize {
+		sendError(w, http.StatusBadRequest, "Too many renders", fmt.Sprintf("%d parts x %d option sets exceeds %d", len(req.Parts), len(req.Options), prewarmQueueSize))
+		return
+	}
+
+	optionSets := make([]RenderOptions, len(req.Options))
+	var errs fieldErrors
+	for i, o := range req.Options {
+		opts, err := o.options()
+		errs.merge(fmt.Sprintf("options[%d]", i), err)
+		optionSets[i] = opts
+	}
+	if err := errs.err(); err != nil {
+		sendValidationError(w, err)
+		return
+	}
+
+	var resp PrewarmResponse
+	for _, part := range uniqueStrings(req.Parts) {
+		if findPartFile(part) == "" {
+			resp.Missing = append(resp.Missing, part)
+			continue
+		}
+		for _, opts := range optionSets {
+			switch {
+			case renderCache.has(renderCacheKey(part, opts)):
+				resp.Cached++
+			case enqueuePrewarm(prewarmJob{partNumber: part, opts: opts}):
+				resp.Queued++
+			default:
+				recordRejected("queue_full")
+				resp.Dropped++
+			}
+		}
+	}
+	resp.Pending = len(prewarmQueue)
+	log.Printf("Prewarm: queued %d, cached %d, dropped %d, missing %d", resp.Queued, resp.Cached, resp.Dropped, len(resp.Missing))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// Add a job without blocking; false when the queue is full
+func enqueuePrewarm(job prewarmJob) bool {
+	prewarmWorkerOnce.Do(func() { go runPrewarmWorker() })
+	job.queued = time.Now()
+	job.generation = prewarmGeneration.Load()
+	prewarmMu.Lock()
+	defer prewarmMu.Unlock()
+	select {
+	case prewarmQueue <- job:
+		prewarmPending++
+		return true
+	default:
+		return false
+	}
+}
+
+func prewarmJobDone() {
+	prewarmMu.Lock()
+	defer prewarmMu.Unlock()
+	if prewarmPending--; prewarmPending == 0 {
+		prewarmIdle.Broadcast()
+	}
+}
+
+// Drop the queued prewarm jobs and wait for the one rendering, if any, so
+// nothing of the worker's outlives a shutdown or a test. Returns how many
+// were dropped.
+func stopPrewarm() int {
+	prewarmGeneration.Add(1)
+	dropped := 0
+	prewarmMu.Lock()
+	defer prewarmMu.Unlock()
+	for {
+		select {
+		case <-prewarmQueue:
+			prewarmPending--
+			dropped++
+		default:
+			for prewarmPending > 0 {
+				prewarmIdle.Wait()
+			}
+			return dropped
+		}
+	}
+}
+
+// What the prewarm worker is doing, for the admin dashboard
+var prewarmState atomic.Value
+
+func prewarmWorkerState() string {
+	if s, ok := prewarmState.Load().(string); ok {
+		return s
+	}
+	return "not started"
+}
+
+func runPrewarmWorker() {
+	ctx := withLowPriority(context.Background())
+	prewarmState.Store("idle")
+	for job := range prewarmQueue {
+		runPrewarmJob(ctx, job)
+		prewarmState.Store("idle")
+		prewarmJobDone()
+	}
+}
+
+func runPrewarmJob(ctx context.Context, job prewarmJob) {
+	stopped := func() bool { return job.generation != prewarmGeneration.Load() }
+	for !stopped() && (foregroundRenders.Load() > 0 || draining()) {
+		if draining() {
+			prewarmState.Store("paused for drain")
+		} else {
+			prewarmState.Store("waiting for requests to finish")
+		}
+		time.Sleep(prewarmBackoff)
+	}
+	// The same part may have been rendered since it was queued
+	if stopped() || renderCache.has(renderCacheKey(job.partNumber, job.opts)) {
+		return
+	}
+	prewarmState.Store("rendering " + job.partNumber)
+	recordQueueWait(time.Since(job.queued))
+	prewarmBusy.Store(true)
+	if _, _, err := renderPart(ctx, job.partNumber, job.opts); err != nil {
+		log.Printf("Prewarm render of %s failed: %v", job.partNumber, err)
+	}
+	prewarmBusy.Store(false)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Stop the prewarm worker's jobs when the test ends, before the library
+// and cache set up ahead of this are restored
+func withPrewarmStopped(t *testing.T) {
+	t.Cleanup(func() { stopPrewarm() })
+}
+
+func TestPrewarm(t *testing.T) {
+	withFakeBlender(t)
+	withTestLibrary(t, map[string]string{"3001": "0 Brick 2 x 4\n", "3003": "0 Brick 2 x 2\n"})
+	cache := withRenderCache(t)
+	withPrewarmStopped(t)
+
+	post := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handlePrewarm(w, httptest.NewRequest(http.MethodPost, "/admin/prewarm", strings.NewReader(body)))
+		return w
+	}
+
+	w := post(`{"parts": ["3001", "3003", "9999", "3001"], "options": [{}, {"thickness": 4}]}`)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d: %s", w.Code, w.Body)
+	}
+	var resp PrewarmResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if resp.Queued != 4 || resp.Cached != 0 || len(resp.Missing) != 1 || resp.Missing[0] != "9999" {
+		t.Errorf("unexpected response %+v", resp)
+	}
+
+	thick := RenderRequest{Thickness: 4}
+	opts, _ := thick.options()
+	key := renderCacheKey("3003", opts)
+	for deadline := time.Now().Add(10 * time.Second); !cache.has(key); time.Sleep(20 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("prewarm render never reached the cache")
+		}
+	}
+	for len(prewarmQueue) > 0 {
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	w = post(`{"parts": ["3001"]}`)
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if resp.Queued != 0 || resp.Cached != 1 {
+		t.Errorf("the default render should already be cached: %+v", resp)
+	}
+
+	if w := post(`{"parts": ["3001"], "options": [{"thickness": 99}]}`); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "options[0]") {
+		t.Errorf("expected a 400 naming the bad option set, got %d: %s", w.Code, w.Body)
+	}
+	if w := post(`{}`); w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 without parts, got %d", w.Code)
+	}
+
+	renderCache = nil
+	if w := post(`{"parts": ["3001"]}`); w.Code != http.StatusConflict {
+		t.Errorf("expected 409 without a cache, got %d", w.Code)
+	}
+}
+
+func TestPrewarmYieldsToRequests(t *testing.T) {
+	withFakeBlender(t)
+	withTestLibrary(t, map[string]string{"3001": "0 Brick 2 x 4\n"})
+	cache := withRenderCache(t)
+	withPrewarmStopped(t)
+
+	req := RenderRequest{Thickness: 7}
+	opts, _ := req.options()
+	key := renderCacheKey("3001", opts)
+
+	foregroundRenders.Add(1)
+	enqueuePrewarm(prewarmJob{partNumber: "3001", opts: opts})
+	time.Sleep(prewarmBackoff / 2)
+	if cache.has(key) {
+		t.Error("prewarm should wait for the interactive render")
+	}
+	foregroundRenders.Add(-1)
+
+	for deadline := time.Now().Add(10 * time.Second); !cache.has(key); time.Sleep(20 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("prewarm never resumed")
+		}
+	}
+}
+
+func TestStopPrewarm(t *testing.T) {
+	withFakeBlender(t)
+	withTestLibrary(t, map[string]string{"3001": "0 Brick 2 x 4\n"})
+	cache := withRenderCache(t)
+	withPrewarmStopped(t)
+
+	req := RenderRequest{Thickness: 5}
+	opts, _ := req.options()
+	foregroundRenders.Add(1)
+	defer foregroundRenders.Add(-1)
+	enqueuePrewarm(prewarmJob{partNumber: "3001", opts: opts})
+	enqueuePrewarm(prewarmJob{partNumber: "3001", opts: RenderOptions{Thickness: 6}})
+	time.Sleep(prewarmBackoff / 2)
+
+	// One job is waiting in the worker, the other in the queue
+	if dropped := stopPrewarm(); dropped != 1 {
+		t.Errorf("dropped %d jobs, want 1", dropped)
+	}
+	if len(prewarmQueue) != 0 || cache.has(renderCacheKey("3001", opts)) {
+		t.Error("expected no job left to render")
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"regexp"
+)
+
+// Inventories list printed and patterned parts ("3068bp06", "973pb001",
+// "3001pr0001") that the library often hasn't modeled. With printFallback,
+// a printed part the library doesn't have renders as its base part
+// ("3068b") instead of failing, and the response says so in
+// X-Part-Fallback.
+
+// A part number with a print or pattern suffix: a "p" code after the base
+// part's number (and any variant letter)
+var printedPartPattern = regexp.MustCompile(`(?i)^(.*\d[a-z]?)p[a-z0-9]+$`)
+
+// The base part of a printed part number
+func printBase(partNumber string) (string, bool) {
+	m := printedPartPattern.FindStringSubmatch(partNumber)
+	if m == nil {
+		return "", false
+	}
+	return m[1], true
+}
+
+// Resolve a part for a render with opts: as resolvePart does, in the
+// library opts render from, then with a missing printed part's base part if
+// the options allow it. fallback says whether the base part was used.
+func resolvePartFor(partNumber string, opts RenderOptions) (string, string, bool, error) {
+	root := libraryPath(opts.LibraryVersion)
+	clean, partFile, err := resolveLibraryPart(root, partNumber)
+	var rerr *RenderError
+	if err == nil || !opts.PrintFallback || !errors.As(err, &rerr) || rerr.Status != http.StatusNotFound {
+		return clean, partFile, false, err
+	}
+	base, _ := cleanPartNumber(partNumber)
+	for {
+		var ok bool
+		if base, ok = printBase(base); !ok {
+			return "", "", false, err
+		}
+		if clean, partFile, berr := resolveLibraryPart(root, base); berr == nil {
+			return clean, partFile, true, nil
+		}
+	}
+}
+
+// The base part a render with opts falls back to, or "" if it doesn't
+func partFallback(partNumber string, opts RenderOptions) string {
+	if !opts.PrintFallback {
+		return ""
+	}
+	clean, _, fallback, err := resolvePartFor(partNumber, opts)
+	if err != nil || !fallback {
+		return ""
+	}
+	return clean
+}
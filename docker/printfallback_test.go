@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPrintBase(t *testing.T) {
+	for part, want := range map[string]string{
+		"3068bp06":   "3068b",
+		"973pb001":   "973",
+		"3001pr0001": "3001",
+		"3626bpa1":   "3626b",
+		"3001":       "",
+		"plate":      "",
+	} {
+		if got, _ := printBase(part); got != want {
+			t.Errorf("printBase(%q) = %q, want %q", part, got, want)
+		}
+	}
+}
+
+func TestResolvePrintFallback(t *testing.T) {
+	withTestLibrary(t, map[string]string{"3068b": "0 Tile 2 x 2\n", "973": "0 Torso\n"})
+	fallback := RenderOptions{PrintFallback: true}
+
+	if _, _, _, err := resolvePartFor("3068bp06", RenderOptions{}); err == nil {
+		t.Error("expected a missing print to fail without printFallback")
+	}
+	for part, want := range map[string]string{"3068bp06": "3068b", "973pb001pr01": "973"} {
+		got, _, used, err := resolvePartFor(part, fallback)
+		if err != nil || got != want || !used {
+			t.Errorf("%s resolved to %q (fallback %v, %v), want %s", part, got, used, err, want)
+		}
+	}
+	if got, _, used, _ := resolvePartFor("3068b", fallback); got != "3068b" || used {
+		t.Errorf("a part the library has shouldn't fall back, got %q", got)
+	}
+	if _, _, _, err := resolvePartFor("3069bp01", fallback); err == nil {
+		t.Error("expected a print of a missing base part to fail")
+	}
+}
+
+func TestRenderPrintFallback(t *testing.T) {
+	withFakeBlender(t)
+	withTestLibrary(t, map[string]string{"3068b": "0 Tile 2 x 2\n"})
+	cache := withRenderCache(t)
+
+	render := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handleRender(w, httptest.NewRequest(http.MethodPost, "/render", bytes.NewReader([]byte(body))))
+		return w
+	}
+	if w := render(`{"partNumber": "3068bp06"}`); w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 without printFallback, got %d", w.Code)
+	}
+	w := render(`{"partNumber": "3068bp06", "printFallback": true}`)
+	if w.Code != http.StatusOK || w.Header().Get("X-Part-Fallback") != "3068b" {
+		t.Fatalf("status %d, X-Part-Fallback %q", w.Code, w.Header().Get("X-Part-Fallback"))
+	}
+	// Shared with plain renders of the base part
+	opts, _ := (&RenderRequest{}).options()
+	if !cache.has(renderCacheKey("3068b", opts)) {
+		t.Error("expected the base part's render to be cached without printFallback in its key")
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Each API key can keep custom parts in a private overlay library under
+// STATE_DIR/private-parts, for MOC designers who want to render their own
+// elements without publishing them: PUT /account/parts/{name} uploads one,
+// GET /account/parts lists them, and DELETE removes one. A key's renders
+// look parts up in its overlay before the shared library. The overlay's
+// files are inlined into the render's input as MPD subfiles, as a Stud.io
+// archive's custom parts are (see model.go), so the shared library stays
+// untouched, and the renders are cached under a digest of them.
+const (
+	privatePartsDir = "private-parts"
+	// Largest single part file
+	privatePartMaxBytes = 4 << 20
+)
+
+// Bytes of private parts per key, unless the key sets privatePartsBytes
+var privatePartsBytes = int64(getEnvInt("PRIVATE_PARTS_BYTES", 50<<20))
+
+// Uploads and deletes run one at a time, so quotas hold
+var privatePartsMu sync.Mutex
+
+type PrivatePart struct {
+	Name     string    `json:"name"`
+	Bytes    int64     `json:"bytes"`
+	Modified time.Time `json:"modified"`
+}
+
+type PrivatePartsResponse struct {
+	Parts []PrivatePart `json:"parts"`
+	Bytes int64         `json:"bytes"`
+	Quota int64         `json:"quota"`
+}
+
+// A key's overlay library, with its files under parts/
+func privateLibraryPath(key *apiKey) string {
+	sum := sha256.Sum256([]byte(key.Name))
+	return filepath.Join(stateDir, privatePartsDir, sanitizeFilename(key.Name)+"-"+hex.EncodeToString(sum[:4]))
+}
+
+func privatePartsQuota(key *apiKey) int64 {
+	if key.PrivatePartsBytes > 0 {
+		return key.PrivatePartsBytes
+	}
+	return privatePartsBytes
+}
+
+// Resolve a render's part: from the calling key's private parts, then as
+// resolvePartFor does. private says the part is the key's own.
+func resolveRequestPart(ctx context.Context, partNumber string, opts RenderOptions) (string, string, bool, error) {
+	if key := apiKeyFromContext(ctx); key != nil && stateDir != "" {
+		if clean, ok := cleanPartNumber(partNumber); ok {
+			if file := findLibraryPart(privateLibraryPath(key), strings.ToLower(clean)); file != "" {
+				return strings.ToLower(clean), file, true, nil
+			}
+		}
+	}
+	clean, partFile, _, err := resolvePartFor(partNumber, opts)
+	return clean, partFile, false, err
+}
+
+// A private part as an MPD model: the part, then every private file it
+// uses, directly or through another, as a subfile
+func privatePartModel(ctx context.Context, partNumber, partFile string) ([]byte, error) {
+	root := privateLibraryPath(apiKeyFromContext(ctx))
+	var mpd bytes.Buffer
+	seen := map[string]bool{partNumber: true}
+	queue := []string{partNumber}
+	files := map[string]string{partNumber: partFile}
+	for len(queue) > 0 {
+		name := queue[0]
+		queue = queue[1:]
+		content, err := os.ReadFile(files[name])
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(&mpd, "0 FILE %s.dat\n", strings.ReplaceAll(name, "/", `\`))
+		mpd.Write(bytes.TrimRight(content, "\r\n"))
+		mpd.WriteString("\n0 NOFILE\n")
+
+		scanner := bufio.NewScanner(bytes.NewReader(content))
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) < 15 || fields[0] != "1" {
+				continue
+			}
+			sub := partNumberFromRef(strings.Join(fields[14:], " "))
+			if seen[sub] {
+				continue
+			}
+			seen[sub] = true
+			if file := findLibraryPart(root, sub); file != "" {
+				files[sub] = file
+				queue = append(queue, sub)
+			}
+		}
+	}
+	return mpd.Bytes(), nil
+}
+
+// Render a private part's model, written to a temp file for Blender
+func renderPrivatePart(ctx context.Context, partNumber string, model []byte, opts RenderOptions) ([]byte, time.Duration, error) {
+	f, err := os.CreateTemp("", "private-*.mpd")
+	if err != nil {
+		recordError()
+		return nil, 0, &RenderError{http.StatusInternalServerError, "Failed to create temp file", err.Error()}
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(model)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		recordError()
+		return nil, 0, &RenderError{http.StatusInternalServerError, "Failed to write temp file", err.Error()}
+	}
+	return renderFile(ctx, partNumber, f.Name(), opts)
+}
+
+// The digest of a private part's model, which its cache key includes
+func privatePartDigest(model []byte) string {
+	sum := sha256.Sum256(model)
+	return hex.EncodeToString(sum[:16])
+}
+
+// The calling key for a private parts endpoint, or nil after sending the
+// error response
+func privatePartsKey(w http.ResponseWriter, r *http.Request) *apiKey {
+	if apiKeys == nil {
+		sendError(w, http.StatusNotFound, "API keys are disabled", "Set API_KEYS_FILE to enable them")
+		return nil
+	}
+	if stateDir == "" {
+		sendError(w, http.StatusConflict, "No state directory configured", "Set STATE_DIR to enable private parts")
+		return nil
+	}
+	return apiKeyFromContext(r.Context())
+}
+
+func handlePrivateParts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		sendError(w, http.StatusMethodNotAllowed, "Method not allowed", "")
+		return
+	}
+	key := privatePartsKey(w, r)
+	if key == nil {
+		return
+	}
+	parts, used, err := listPrivateParts(privateLibraryPath(key))
+	if err != nil {
+		sendError(w, http.StatusInternalServerError, "Listing private parts failed", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(PrivatePartsResponse{Parts: parts, Bytes: used, Quota: privatePartsQuota(key)})
+}
+
+// A key's private parts, sorted by name, and their total size
+func listPrivateParts(root string) ([]PrivatePart, int64, error) {
+	parts := []PrivatePart{}
+	var used int64
+	partsRoot := filepath.Join(root, "parts")
+	err := filepath.WalkDir(partsRoot, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !strings.HasSuffix(p, ".dat") {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(partsRoot, p)
+		parts = append(parts, PrivatePart{strings.TrimSuffix(filepath.ToSlash(rel), ".dat"), info.Size(), info.ModTime().UTC()})
+		used += info.Size()
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, 0, err
+	}
+	sort.Slice(parts, func(i, j int) bool { return parts[i].Name < parts[j].Name })
+	return parts, used, nil
+}
+
+// GET, PUT, or DELETE one of the calling key's private parts
+func handlePrivatePart(w http.ResponseWriter, r *http.Request) {
+	key := privatePartsKey(w, r)
+	if key == nil {
+		return
+	}
+	name, ok := cleanPartNumber(r.PathValue("name"))
+	if !ok {
+		sendError(w, http.StatusBadRequest, "Invalid part name", fmt.Sprintf("%q is not an LDraw part number", r.PathValue("name")))
+		return
+	}
+	name = strings.ToLower(strings.TrimSuffix(name, ".dat"))
+	file := filepath.Join(privateLibraryPath(key), "parts", filepath.FromSlash(name)+".dat")
+
+	switch r.Method {
+	case http.MethodGet:
+		data, err := os.ReadFile(file)
+		if err != nil {
+			sendError(w, http.StatusNotFound, "Private part not found", name)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write(data)
+	case http.MethodPut:
+		putPrivatePart(w, r, key, name, file)
+	case http.MethodDelete:
+		privatePartsMu.Lock()
+		err := os.Remove(file)
+		privatePartsMu.Unlock()
+		if os.IsNotExist(err) {
+			sendError(w, http.StatusNotFound, "Private part not found", name)
+			return
+		}
+		if err != nil {
+			sendError(w, http.StatusInternalServerError, "Deleting private part failed", err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		sendError(w, http.StatusMethodNotAllowed, "Method not allowed", "")
+	}
+}
+
+func putPrivatePart(w http.ResponseWriter, r *http.Request, key *apiKey, name, file string) {
+	data, err := readUpload(w, r, privatePartMaxBytes)
+	if err != nil {
+		sendError(w, http.StatusBadRequest, "Invalid upload", err.Error())
+		return
+	}
+	if !isLDrawText(data) {
+		sendError(w, http.StatusBadRequest, "Not an LDraw part file", "")
+		return
+	}
+	if isMPD(data) {
+		sendError(w, http.StatusBadRequest, "Upload subfiles as parts of their own", "A private part can't be an MPD file")
+		return
+	}
+
+	privatePartsMu.Lock()
+	defer privatePartsMu.Unlock()
+	_, used, err := listPrivateParts(privateLibraryPath(key))
+	if err != nil {
+		sendError(w, http.StatusInternalServerError, "Listing private parts failed", err.Error())
+		return
+	}
+	status := http.StatusCreated
+	if info, err := os.Stat(file); err == nil {
+		used -= info.Size()
+		status = http.StatusOK
+	}
+	if quota := privatePartsQuota(key); used+int64(len(data)) > quota {
+		sendError(w, http.StatusRequestEntityTooLarge, "Private parts quota exceeded",
+			fmt.Sprintf("Key %s may keep %d bytes of private parts and has %d", key.Name, quota, used))
+		return
+	}
+	if err := writeFileAtomic(file, data); err != nil {
+		sendError(w, http.StatusInternalServerError, "Saving private part failed", err.Error())
+		return
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		sendError(w, http.StatusInternalServerError, "Saving private part failed", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(PrivatePart{name, info.Size(), info.ModTime().UTC()})
+}
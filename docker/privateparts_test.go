@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Enable private parts for keys k1 ("moc studio", 200 bytes) and k2
+func withPrivateParts(t *testing.T) {
+	t.Helper()
+	withAPIKeys(t, `[{"key": "k1", "name": "moc studio", "privatePartsBytes": 200}, {"key": "k2", "name": "other"}]`)
+	old := stateDir
+	stateDir = t.TempDir()
+	t.Cleanup(func() { stateDir = old })
+}
+
+func privatePartsRequest(method, path, key, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	r.Header.Set("X-API-Key", key)
+	routes().ServeHTTP(w, r)
+	return w
+}
+
+func TestPrivateParts(t *testing.T) {
+	withPrivateParts(t)
+	wing := "0 MOC Wing\n1 16 0 0 0 1 0 0 0 1 0 0 0 1 s\\moc-wing-s01.dat\n"
+
+	for _, c := range []struct {
+		method, path, body string
+		want               int
+	}{
+		{http.MethodPut, "/account/parts/moc-wing", wing, http.StatusCreated},
+		{http.MethodPut, "/account/parts/MOC-Wing.dat", wing, http.StatusOK},
+		{http.MethodPut, "/account/parts/s/moc-wing-s01", "0 ~MOC Wing Edge\n2 24 0 0 0 1 0 0\n", http.StatusCreated},
+		{http.MethodPut, "/account/parts/notes", "Not LDraw\n", http.StatusBadRequest},
+		{http.MethodPut, "/account/parts/moc-model", "0 FILE main.ldr\n1 16 0 0 0 1 0 0 0 1 0 0 0 1 3001.dat\n", http.StatusBadRequest},
+		{http.MethodPut, "/account/parts/.hidden", wing, http.StatusBadRequest},
+		{http.MethodPut, "/account/parts/moc-tail", "0 MOC Tail\n" + strings.Repeat("2 24 0 0 0 1 0 0\n", 8), http.StatusRequestEntityTooLarge},
+	} {
+		if w := privatePartsRequest(c.method, c.path, "k1", c.body); w.Code != c.want {
+			t.Errorf("%s %s: status %d, want %d: %s", c.method, c.path, w.Code, c.want, w.Body)
+		}
+	}
+
+	var list PrivatePartsResponse
+	json.Unmarshal(privatePartsRequest(http.MethodGet, "/account/parts", "k1", "").Body.Bytes(), &list)
+	if len(list.Parts) != 2 || list.Parts[0].Name != "moc-wing" || list.Parts[1].Name != "s/moc-wing-s01" || list.Quota != 200 {
+		t.Fatalf("unexpected private parts %+v", list)
+	}
+	if list.Bytes != list.Parts[0].Bytes+list.Parts[1].Bytes {
+		t.Errorf("bytes %d isn't the parts' total", list.Bytes)
+	}
+	if w := privatePartsRequest(http.MethodGet, "/account/parts/moc-wing", "k1", ""); w.Body.String() != wing {
+		t.Errorf("GET returned %q", w.Body)
+	}
+
+	// Other keys see none of them
+	json.Unmarshal(privatePartsRequest(http.MethodGet, "/account/parts", "k2", "").Body.Bytes(), &list)
+	if len(list.Parts) != 0 || list.Quota != privatePartsBytes {
+		t.Errorf("another key sees %+v", list)
+	}
+	if w := privatePartsRequest(http.MethodGet, "/account/parts/moc-wing", "", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("status %d without a key, want 401", w.Code)
+	}
+
+	if w := privatePartsRequest(http.MethodDelete, "/account/parts/moc-wing", "k1", ""); w.Code != http.StatusNoContent {
+		t.Errorf("DELETE status %d", w.Code)
+	}
+	if w := privatePartsRequest(http.MethodDelete, "/account/parts/moc-wing", "k1", ""); w.Code != http.StatusNotFound {
+		t.Errorf("second DELETE status %d, want 404", w.Code)
+	}
+}
+
+func TestPrivatePartModel(t *testing.T) {
+	withPrivateParts(t)
+	privatePartsRequest(http.MethodPut, "/account/parts/moc-wing", "k1", "0 MOC Wing\n1 16 0 0 0 1 0 0 0 1 0 0 0 1 S\\moc-wing-s01.dat\n1 16 0 0 0 1 0 0 0 1 0 0 0 1 3001.dat\n")
+	privatePartsRequest(http.MethodPut, "/account/parts/s/moc-wing-s01", "k1", "0 ~MOC Wing Edge\n1 16 0 0 0 1 0 0 0 1 0 0 0 1 moc-wing.dat\n")
+
+	ctx := context.WithValue(context.Background(), apiKeyContextKey{}, apiKeys["k1"])
+	part, file, private, err := resolveRequestPart(ctx, "MOC-Wing", RenderOptions{})
+	if err != nil || part != "moc-wing" || !private {
+		t.Fatalf("resolved to %s (%s, private %v, %v)", part, file, private, err)
+	}
+	model, err := privatePartModel(ctx, part, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The shared part stays a reference, and the loop back ends
+	want := "0 FILE moc-wing.dat\n0 MOC Wing\n1 16 0 0 0 1 0 0 0 1 0 0 0 1 S\\moc-wing-s01.dat\n1 16 0 0 0 1 0 0 0 1 0 0 0 1 3001.dat\n0 NOFILE\n" +
+		"0 FILE s\\moc-wing-s01.dat\n0 ~MOC Wing Edge\n1 16 0 0 0 1 0 0 0 1 0 0 0 1 moc-wing.dat\n0 NOFILE\n"
+	if string(model) != want {
+		t.Errorf("model:\n%s\nwant:\n%s", model, want)
+	}
+}
+
+func TestRenderPrivatePart(t *testing.T) {
+	withFakeBlender(t)
+	withTestLibrary(t, map[string]string{"3001": "0 Brick 2 x 4\n"})
+	cache := withRenderCache(t)
+	withPrivateParts(t)
+	privatePartsRequest(http.MethodPut, "/account/parts/3001", "k1", "0 Brick 2 x 4 (prototype)\n")
+
+	render := func(key, part string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/render", bytes.NewReader([]byte(`{"partNumber": "`+part+`"}`)))
+		r.Header.Set("X-API-Key", key)
+		requireAPIKey(handleRender)(w, r)
+		return w
+	}
+	if w := render("k1", "3001"); w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	// The private part renders in place of the shared one, cached apart
+	opts, _ := (&RenderRequest{}).options()
+	if cache.has(renderCacheKey("3001", opts)) {
+		t.Error("expected the private part's render cached apart from the shared part's")
+	}
+	if w := render("k2", "3001"); w.Code != http.StatusOK || w.Header().Get("X-Cache") != "MISS" {
+		t.Errorf("another key's render: status %d, X-Cache %s", w.Code, w.Header().Get("X-Cache"))
+	}
+	if !cache.has(renderCacheKey("3001", opts)) {
+		t.Error("expected another key to render the shared part")
+	}
+
+	privatePartsRequest(http.MethodPut, "/account/parts/moc-wing", "k1", "0 MOC Wing\n")
+	if w := render("k2", "moc-wing"); w.Code != http.StatusNotFound {
+		t.Errorf("another key's render of a private part: status %d, want 404", w.Code)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+)
+
+// Render profiles are named presets of render options, chosen with
+// "profile" on any render request; options given in the request override
+// the profile's. A few are built in, and RENDER_PROFILES_FILE, a JSON
+// object of name to options, adds more or replaces them. Profiles are
+// resolved where the render options are, so queue and dispatch workers need
+// the same file.
+var renderProfilesFile = getEnv("RENDER_PROFILES_FILE", "")
+
+const builtinProfilesJSON = `{
+	"catalog": {
+		"resolutionX": 512, "resolutionY": 512, "padding": 0.05,
+		"fillColor": "white", "strokeColor": "#1b1b1b"
+	},
+	"instructions": {
+		"thickness": 3, "strokeColor": "black", "creaseAngle": 120, "padding": 0.02,
+		"curveTolerance": 0.5,
+		"edgeTypes": {"silhouette": true, "crease": true, "border": true, "contour": false}
+	},
+	"dark-docs": {
+		"colorScheme": "dark", "thickness": 1.5, "resolutionX": 768, "resolutionY": 768
+	}
+}`
+
+// Profiles by name
+var renderProfiles = mustParseProfiles(builtinProfilesJSON)
+
+func mustParseProfiles(data string) map[string]RenderRequest {
+	var profiles map[string]RenderRequest
+	if err := json.Unmarshal([]byte(data), &profiles); err != nil {
+		panic(err)
+	}
+	return profiles
+}
+
+// Load RENDER_PROFILES_FILE over the built-in profiles and check them all
+// at startup
+func validateProfiles() error {
+	if renderProfilesFile != "" {
+		data, err := os.ReadFile(renderProfilesFile)
+		if err != nil {
+			return err
+		}
+		var profiles map[string]RenderRequest
+		if err := json.Unmarshal(data, &profiles); err != nil {
+			return fmt.Errorf("parsing %s: %w", renderProfilesFile, err)
+		}
+		for name, p := range profiles {
+			renderProfiles[name] = p
+		}
+	}
+	for name, p := range renderProfiles {
+		if name == "" {
+			return fmt.Errorf("a profile needs a name")
+		}
+		if p.PartNumber != "" || p.Profile != "" {
+			return fmt.Errorf("profile %s: partNumber and profile can't be set in a profile", name)
+		}
+		if _, err := p.options(); err != nil {
+			return fmt.Errorf("profile %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// The request with its profile's options filled in under its own
+func (req RenderRequest) withProfile() (RenderRequest, error) {
+	profile, ok := renderProfiles[req.Profile]
+	if !ok {
+		return req, fmt.Errorf("unknown profile %q (see GET /profiles)", req.Profile)
+	}
+	mergeUnset(reflect.ValueOf(&req).Elem(), reflect.ValueOf(profile))
+	return req, nil
+}
+
+// Set dst's zero fields from base, merging nested option structs (edge
+// types) field by field. Pointers from base are shared, not copied; a
+// request's options are never modified in place.
+func mergeUnset(dst, base reflect.Value) {
+	for i := 0; i < dst.NumField(); i++ {
+		f, b := dst.Field(i), base.Field(i)
+		switch {
+		case f.IsZero():
+			f.Set(b)
+		case f.Kind() == reflect.Pointer && f.Elem().Kind() == reflect.Struct && !b.IsNil():
+			merged := reflect.New(f.Elem().Type())
+			merged.Elem().Set(f.Elem())
+			mergeUnset(merged.Elem(), b.Elem())
+			f.Set(merged)
+		}
+	}
+}
+
+// Profiles endpoint
+func handleProfiles(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		sendError(w, http.StatusMethodNotAllowed, "Method not allowed", "")
+		return
+	}
+	names := make([]string, 0, len(renderProfiles))
+	for name := range renderProfiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	list := make([]json.RawMessage, 0, len(names))
+	for _, name := range names {
+		// Only the options the profile sets; a zero thickness is the default
+		var fields map[string]any
+		data, _ := json.Marshal(renderProfiles[name])
+		json.Unmarshal(data, &fields)
+		for k, v := range fields {
+			if v == nil || v == "" || (k == "thickness" && v == float64(0)) {
+				delete(fields, k)
+			}
+		}
+		data, _ = json.Marshal(map[string]any{"name": name, "options": fields})
+		list = append(list, data)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"profiles": list})
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func withProfiles(t *testing.T) {
+	t.Helper()
+	old := renderProfiles
+	renderProfiles = mustParseProfiles(builtinProfilesJSON)
+	t.Cleanup(func() { renderProfiles = old })
+}
+
+func TestBuiltinProfilesValidate(t *testing.T) {
+	withProfiles(t)
+	if err := validateProfiles(); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"catalog", "instructions", "dark-docs"} {
+		if _, ok := renderProfiles[name]; !ok {
+			t.Errorf("missing built-in profile %s", name)
+		}
+	}
+}
+
+func TestRenderProfileOverrides(t *testing.T) {
+	withProfiles(t)
+	var req RenderRequest
+	json.Unmarshal([]byte(`{"partNumber":"3001","profile":"instructions","thickness":4,"cameraLatitude":0,"edgeTypes":{"contour":true}}`), &req)
+	opts, err := req.options()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The request's options win; the profile fills in the rest
+	if opts.Thickness != 4 || opts.CameraLatitude != 0 || opts.CreaseAngle != 120 || opts.StrokeColor != "black" || opts.CurveTolerance != 0.5 {
+		t.Errorf("unexpected options %+v", opts)
+	}
+	if !strings.Contains(opts.EdgeTypes, "contour") || !strings.Contains(opts.EdgeTypes, "crease") {
+		t.Errorf("expected edge types merged, got %s", opts.EdgeTypes)
+	}
+	if *req.EdgeTypes.Contour != true || req.EdgeTypes.Crease != nil {
+		t.Errorf("the request's own edge types were modified: %+v", req.EdgeTypes)
+	}
+
+	req = RenderRequest{Profile: "nope"}
+	_, err = req.options()
+	if fe, ok := err.(fieldErrors); !ok || fe[0].Field != "profile" {
+		t.Errorf("expected a profile field error, got %v", err)
+	}
+}
+
+func TestRenderProfilesFile(t *testing.T) {
+	withProfiles(t)
+	old := renderProfilesFile
+	t.Cleanup(func() { renderProfilesFile = old })
+	renderProfilesFile = filepath.Join(t.TempDir(), "profiles.json")
+
+	os.WriteFile(renderProfilesFile, []byte(`{"catalog":{"resolutionX":256,"resolutionY":256},"poster":{"resolutionX":4096,"resolutionY":4096,"thickness":1}}`), 0o644)
+	if err := validateProfiles(); err != nil {
+		t.Fatal(err)
+	}
+	if *renderProfiles["catalog"].ResolutionX != 256 || renderProfiles["poster"].Thickness != 1 || renderProfiles["dark-docs"].ColorScheme != "dark" {
+		t.Errorf("expected the file's profiles over the built-ins, got %+v", renderProfiles)
+	}
+
+	w := httptest.NewRecorder()
+	handleProfiles(w, httptest.NewRequest(http.MethodGet, "/profiles", nil))
+	var resp struct {
+		Profiles []struct {
+			Name    string
+			Options map[string]any
+		}
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if len(resp.Profiles) != 4 || resp.Profiles[0].Name != "catalog" || len(resp.Profiles[0].Options) != 2 {
+		t.Errorf("unexpected profile list %s", w.Body.String())
+	}
+
+	for _, bad := range []string{
+		`{"big":{"resolutionX":99999}}`,
+		`{"fixed":{"partNumber":"3001"}}`,
+		`not json`,
+	} {
+		renderProfiles = mustParseProfiles(builtinProfilesJSON)
+		os.WriteFile(renderProfilesFile, []byte(bad), 0o644)
+		if err := validateProfiles(); err == nil {
+			t.Errorf("%s: expected an error", bad)
+		}
+	}
+}
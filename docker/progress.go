@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strconv"
+	"strings"
+)
+
+// render_part.py reports how far along it is with lines on stdout:
+//
+//	PROGRESS <phase> <percent>
+//
+// where phase is import, prepare, freestyle, or export (see
+// testdata/render_contract.json). Renders whose context carries a progress
+// callback have those lines passed to it as they arrive; the server adds a
+// postprocess phase of its own once Blender exits.
+const progressMarker = "PROGRESS "
+
+type progressFunc func(phase string, percent int)
+
+type progressKey struct{}
+
+// Have ctx's renders report their progress to fn
+func withProgress(ctx context.Context, fn progressFunc) context.Context {
+	return context.WithValue(ctx, progressKey{}, fn)
+}
+
+func reportProgress(ctx context.Context, phase string, percent int) {
+	renderDebugFrom(ctx).mark(phase)
+	if fn, ok := ctx.Value(progressKey{}).(progressFunc); ok {
+		fn(phase, percent)
+	}
+}
+
+// Parse a progress line, without its newline
+func parseProgress(line string) (string, int, bool) {
+	rest, ok := strings.CutPrefix(strings.TrimSpace(line), progressMarker)
+	if !ok {
+		return "", 0, false
+	}
+	phase, pct, ok := strings.Cut(rest, " ")
+	percent, err := strconv.Atoi(pct)
+	if !ok || phase == "" || err != nil || percent < 0 || percent > 100 {
+		return "", 0, false
+	}
+	return phase, percent, true
+}
+
+// Watches Blender's stdout for progress lines
+type progressWriter struct {
+	ctx     context.Context
+	partial []byte
+	// The current line was too long to be a marker
+	skip bool
+}
+
+func (w *progressWriter) Write(p []byte) (int, error) {
+	w.partial = append(w.partial, p...)
+	for {
+		i := bytes.IndexByte(w.partial, '\n')
+		if i < 0 {
+			break
+		}
+		if phase, percent, ok := parseProgress(string(w.partial[:i])); ok && !w.skip {
+			reportProgress(w.ctx, phase, percent)
+		}
+		w.partial, w.skip = w.partial[i+1:], false
+	}
+	// Blender's other output can have long lines; a marker never does
+	if len(w.partial) > 256 {
+		w.partial, w.skip = w.partial[:0], true
+	}
+	return len(p), nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestParseProgress(t *testing.T) {
+	for line, want := range map[string]string{
+		"PROGRESS import 0":       "import 0",
+		"PROGRESS freestyle 50\r": "freestyle 50",
+		"PROGRESS export 101":     "",
+		"PROGRESS export":         "",
+		"PROGRESS  50":            "",
+		"Importing 3001.dat...":   "",
+		"Fra:1 PROGRESS x 5":      "",
+	} {
+		got := ""
+		if phase, percent, ok := parseProgress(line); ok {
+			got = fmt.Sprintf("%s %d", phase, percent)
+		}
+		if got != want {
+			t.Errorf("%q: got %q, want %q", line, got, want)
+		}
+	}
+}
+
+func TestProgressWriter(t *testing.T) {
+	var got []string
+	ctx := withProgress(context.Background(), func(phase string, percent int) {
+		got = append(got, fmt.Sprintf("%s %d", phase, percent))
+	})
+	w := &progressWriter{ctx: ctx}
+	// Markers split across writes, and one at the end of an overlong line
+	for _, chunk := range []string{"Importing...\nPROG", "RESS import 0\nPROGRESS prepare 30\n", strings.Repeat("x", 300), "PROGRESS export 85\n", "PROGRESS export 90\n"} {
+		w.Write([]byte(chunk))
+	}
+	if strings.Join(got, ",") != "import 0,prepare 30,export 90" {
+		t.Errorf("unexpected progress %v", got)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Rendering responses say which pipeline produced them, so a cached
+// artifact can be traced back to it: X-Library-Version (the LDraw release),
+// X-Blender-Version, X-Render-Script-Hash (the script's SHA-256),
+// X-Render-Version (the render cache's hash of both; see cache.go), and on
+// single-part renders X-Cache, HIT for a render this request didn't run
+// Blender for and MISS otherwise. /version reports the same facts.
+
+// Blender's version by binary, once it has answered; running it per
+// request would cost more than most cached renders
+var blenderVersions = struct {
+	sync.Mutex
+	byBin map[string]string
+}{byBin: map[string]string{}}
+
+// The render script's hash, kept until the file changes
+var scriptHash = struct {
+	sync.Mutex
+	path    string
+	modTime time.Time
+	size    int64
+	sum     string
+}{}
+
+// Set the provenance headers on a rendering route's responses
+func withProvenance(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		h.Set("X-Library-Version", libraryVersion())
+		h.Set("X-Blender-Version", cachedBlenderVersion(r.Context()))
+		if sum := renderScriptHash(); sum != "" {
+			h.Set("X-Render-Script-Hash", sum)
+		}
+		h.Set("X-Render-Version", renderVersion())
+		handler(w, r)
+	}
+}
+
+// X-Cache for a single part's render duration, which is 0 when it came
+// from the cache or an identical render already running
+func setCacheHeader(w http.ResponseWriter, renderDuration time.Duration) {
+	if renderDuration == 0 {
+		w.Header().Set("X-Cache", "HIT")
+	} else {
+		w.Header().Set("X-Cache", "MISS")
+	}
+}
+
+func cachedBlenderVersion(ctx context.Context) string {
+	bin := blenderBin
+	blenderVersions.Lock()
+	v, ok := blenderVersions.byBin[bin]
+	blenderVersions.Unlock()
+	if ok {
+		return v
+	}
+	// Failures aren't kept: Blender may only have been slow to start
+	if v = blenderVersion(ctx); v != "unknown" {
+		blenderVersions.Lock()
+		blenderVersions.byBin[bin] = v
+		blenderVersions.Unlock()
+	}
+	return v
+}
+
+func renderScriptHash() string {
+	info, err := os.Stat(renderScript)
+	if err != nil {
+		return ""
+	}
+	scriptHash.Lock()
+	defer scriptHash.Unlock()
+	if scriptHash.path != renderScript || !scriptHash.modTime.Equal(info.ModTime()) || scriptHash.size != info.Size() {
+		scriptHash.path, scriptHash.modTime, scriptHash.size = renderScript, info.ModTime(), info.Size()
+		scriptHash.sum = fileSHA256(renderScript)
+	}
+	return scriptHash.sum
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestProvenanceHeaders(t *testing.T) {
+	withFakeBlender(t)
+	withTestLibrary(t, map[string]string{"3001": "0 Brick 2 x 4\n"})
+	withRenderCache(t)
+	srv := httptest.NewServer(routes())
+	defer srv.Close()
+
+	body, _ := json.Marshal(RenderRequest{PartNumber: "3001"})
+	for _, want := range []string{"MISS", "HIT"} {
+		resp, err := http.Post(srv.URL+"/render", "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("status %d", resp.StatusCode)
+		}
+		if got := resp.Header.Get("X-Cache"); got != want {
+			t.Errorf("expected X-Cache %s, got %q", want, got)
+		}
+		if got := resp.Header.Get("X-Blender-Version"); got != "Blender 4.1.1 (fake)" {
+			t.Errorf("unexpected X-Blender-Version %q", got)
+		}
+		if resp.Header.Get("X-Library-Version") == "" || resp.Header.Get("X-Render-Version") != renderVersion() {
+			t.Errorf("missing library or render version in %v", resp.Header)
+		}
+		if got := resp.Header.Get("X-Render-Script-Hash"); got != fileSHA256(renderScript) {
+			t.Errorf("expected X-Render-Script-Hash %q, got %q", fileSHA256(renderScript), got)
+		}
+	}
+}
+
+func TestRenderScriptHash(t *testing.T) {
+	script := filepath.Join(t.TempDir(), "render_part.py")
+	os.WriteFile(script, []byte("one\n"), 0o644)
+	old := renderScript
+	renderScript = script
+	t.Cleanup(func() { renderScript = old })
+
+	first := renderScriptHash()
+	if first != fileSHA256(script) {
+		t.Fatalf("got %q", first)
+	}
+	os.WriteFile(script, []byte("two, longer\n"), 0o644)
+	os.Chtimes(script, time.Now().Add(time.Minute), time.Now().Add(time.Minute))
+	if second := renderScriptHash(); second == first || second != fileSHA256(script) {
+		t.Errorf("expected the hash to follow the edited script, got %q", second)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Latency percentiles over sliding windows, since the histograms' bucket
+// bounds are too coarse to see a p99 regression and their counts never
+// forget. Each latency goes into a sketch of logarithmic buckets (after
+// DDSketch) a fixed ratio apart, so any quantile is within
+// quantileAccuracy of the true value however many are observed. Sketches
+// are kept per minute for a day; a window's percentiles merge its minutes.
+const (
+	quantileAccuracy = 0.01
+	// Latencies at or below this are counted as it
+	quantileMinSeconds = 1e-4
+	quantileSlots      = 24 * 60
+)
+
+var (
+	quantileGamma = (1 + quantileAccuracy) / (1 - quantileAccuracy)
+	// The percentiles reported, and the windows they're reported over
+	latencyQuantiles = []float64{0.5, 0.95, 0.99}
+	latencyWindows   = []struct {
+		name string
+		span time.Duration
+	}{{"5m", 5 * time.Minute}, {"1h", time.Hour}, {"24h", 24 * time.Hour}}
+)
+
+// A sliding-window quantile sketch. Like histogram, it isn't safe for
+// concurrent use; the ones in Metrics are guarded by its lock.
+type quantileSketch struct {
+	// A ring of per-minute sketches, indexed by Unix minute
+	slots [quantileSlots]quantileSlot
+}
+
+type quantileSlot struct {
+	minute int64
+	// Observations by bucket index; see quantileBucket
+	counts map[int]int64
+	count  int64
+}
+
+func newQuantileSketch() *quantileSketch {
+	return &quantileSketch{}
+}
+
+// The bucket a latency falls in: bucket i holds (gamma^(i-1), gamma^i]
+func quantileBucket(seconds float64) int {
+	return int(math.Ceil(math.Log(math.Max(seconds, quantileMinSeconds)) / math.Log(quantileGamma)))
+}
+
+// A bucket's representative value, within quantileAccuracy of all of it
+func quantileValue(bucket int) float64 {
+	return 2 * math.Pow(quantileGamma, float64(bucket)) / (quantileGamma + 1)
+}
+
+func (q *quantileSketch) observe(now time.Time, seconds float64) {
+	minute := now.Unix() / 60
+	slot := &q.slots[minute%quantileSlots]
+	if slot.minute != minute || slot.counts == nil {
+		*slot = quantileSlot{minute: minute, counts: map[int]int64{}}
+	}
+	slot.counts[quantileBucket(seconds)]++
+	slot.count++
+}
+
+type LatencyPercentiles struct {
+	Count int64 `json:"count"`
+	// Seconds, or null with nothing observed in the window
+	P50 *float64 `json:"p50"`
+	P95 *float64 `json:"p95"`
+	P99 *float64 `json:"p99"`
+}
+
+// The percentiles of the latencies observed in the window ending now,
+// counting the current minute as a whole
+func (q *quantileSketch) percentiles(now time.Time, span time.Duration) LatencyPercentiles {
+	newest := now.Unix() / 60
+	oldest := newest - int64(span/time.Minute) + 1
+	counts := map[int]int64{}
+	var total int64
+	for i := range q.slots {
+		slot := &q.slots[i]
+		if slot.count == 0 || slot.minute < oldest || slot.minute > newest {
+			continue
+		}
+		for bucket, n := range slot.counts {
+			counts[bucket] += n
+		}
+		total += slot.count
+	}
+	p := LatencyPercentiles{Count: total}
+	if total == 0 {
+		return p
+	}
+	buckets := make([]int, 0, len(counts))
+	for bucket := range counts {
+		buckets = append(buckets, bucket)
+	}
+	sort.Ints(buckets)
+	values := make([]*float64, len(latencyQuantiles))
+	for i, quantile := range latencyQuantiles {
+		// The rank of the quantile's observation, counting from 0
+		rank := int64(quantile * float64(total-1))
+		var seen int64
+		for _, bucket := range buckets {
+			if seen += counts[bucket]; seen > rank {
+				v := quantileValue(bucket)
+				values[i] = &v
+				break
+			}
+		}
+	}
+	p.P50, p.P95, p.P99 = values[0], values[1], values[2]
+	return p
+}
+
+// The percentiles over every window, by window name
+func (q *quantileSketch) snapshot(now time.Time) map[string]LatencyPercentiles {
+	windows := map[string]LatencyPercentiles{}
+	for _, w := range latencyWindows {
+		windows[w.name] = q.percentiles(now, w.span)
+	}
+	return windows
+}
+
+// Write the percentiles over every window as a Prometheus gauge with window
+// and quantile labels. A summary can't be used: it has no window label.
+func (q *quantileSketch) writePrometheus(w io.Writer, now time.Time, name, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s gauge\n", name)
+	for _, window := range latencyWindows {
+		p := q.percentiles(now, window.span)
+		for i, v := range []*float64{p.P50, p.P95, p.P99} {
+			if v != nil {
+				fmt.Fprintf(w, "%s{window=\"%s\",quantile=\"%s\"} %g\n", name, window.name, strconv.FormatFloat(latencyQuantiles[i], 'g', -1, 64), *v)
+			}
+		}
+	}
+}
+
+// Record how long a rendering request took from arrival to response
+func recordRequestLatency(d time.Duration) {
+	metrics.Lock()
+	metrics.RequestLatency.observe(time.Now(), d.Seconds())
+	metrics.Unlock()
+
+	for _, s := range metricsSinks {
+		s.Timing("request_duration", d)
+	}
+}
+
+// Time a rendering route's requests, end to end
+func withLatency(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		handler(w, r)
+		recordRequestLatency(time.Since(start))
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQuantileSketch(t *testing.T) {
+	q := newQuantileSketch()
+	now := time.Date(2024, 5, 1, 12, 0, 30, 0, time.UTC)
+	for i := 1; i <= 1000; i++ {
+		q.observe(now, float64(i)/100)
+	}
+	p := q.percentiles(now, 5*time.Minute)
+	if p.Count != 1000 {
+		t.Fatalf("expected 1000 observations, got %d", p.Count)
+	}
+	for _, c := range []struct {
+		got  *float64
+		want float64
+	}{{p.P50, 5}, {p.P95, 9.5}, {p.P99, 9.9}} {
+		if c.got == nil || math.Abs(*c.got-c.want)/c.want > 2*quantileAccuracy {
+			t.Errorf("expected about %g, got %v", c.want, c.got)
+		}
+	}
+
+	// An hour on, the 5 minute window is empty but the day still counts them
+	later := now.Add(time.Hour)
+	q.observe(later, 60)
+	if p := q.percentiles(later, 5*time.Minute); p.Count != 1 || *p.P99 < 59 {
+		t.Errorf("unexpected 5m window %+v", p)
+	}
+	if p := q.percentiles(later, 24*time.Hour); p.Count != 1001 {
+		t.Errorf("expected 1001 observations in the day, got %d", p.Count)
+	}
+	// A day on, the ring slot is reused
+	q.observe(now.Add(24*time.Hour), 1)
+	if p := q.percentiles(now.Add(24*time.Hour), 24*time.Hour); p.Count != 2 {
+		t.Errorf("expected the old minute to be replaced, got %d observations", p.Count)
+	}
+
+	if p := newQuantileSketch().percentiles(now, time.Hour); p.Count != 0 || p.P50 != nil {
+		t.Errorf("expected no percentiles without observations, got %+v", p)
+	}
+}
+
+func TestLatencyPercentilesMetrics(t *testing.T) {
+	handler := withLatency(func(w http.ResponseWriter, r *http.Request) {})
+	handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/render", nil))
+
+	w := httptest.NewRecorder()
+	handleMetrics(w, httptest.NewRequest(http.MethodGet, "/metrics?format=prometheus", nil))
+	for _, line := range []string{
+		"# TYPE lego_renderer_render_duration_quantile_seconds gauge",
+		`lego_renderer_request_duration_quantile_seconds{window="5m",quantile="0.99"} `,
+		`lego_renderer_request_duration_quantile_seconds{window="24h",quantile="0.5"} `,
+	} {
+		if !strings.Contains(w.Body.String(), line) {
+			t.Errorf("Prometheus output is missing %q", line)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	handleMetrics(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	var resp MetricsResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if p := resp.LatencyPercentiles["request"]["1h"]; p.Count == 0 || p.P50 == nil {
+		t.Errorf("unexpected request percentiles %+v", p)
+	}
+	if _, ok := resp.LatencyPercentiles["render"]["24h"]; !ok {
+		t.Errorf("missing render percentiles in %v", resp.LatencyPercentiles)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image/png"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// /render returns PNG with format png. With units mm, dpi sets the pixel
+// size from the part's real size, so "this plate at 300 DPI actual size"
+// needs no LDU math from the caller; the PNG records the DPI in a pHYs
+// chunk so print software places it at that size. Without dpi, rsvg-convert
+// uses 96 DPI, the CSS pixel.
+const (
+	minRasterDPI = 10
+	maxRasterDPI = 2400
+	// Longest side of a raster render, in pixels
+	maxRasterPixels = 8192
+)
+
+// The output format and DPI a render request asks for
+func (req *RenderRequest) output(opts RenderOptions) (format string, dpi float64, err error) {
+	var errs fieldErrors
+	format = req.Format
+	if format == "" {
+		format = "svg"
+	}
+	if format != "svg" && format != "png" {
+		errs.add("format", "format must be svg or png")
+	}
+	if req.DPI != nil {
+		dpi = *req.DPI
+		switch {
+		case format != "png":
+			errs.add("dpi", "dpi needs format png")
+		case opts.Units != "mm":
+			errs.add("dpi", "dpi sizes renders with physical dimensions; set units mm")
+		case dpi < minRasterDPI || dpi > maxRasterDPI:
+			errs.add("dpi", "dpi must be between %d and %d", minRasterDPI, maxRasterDPI)
+		}
+	}
+	return format, dpi, errs.err()
+}
+
+// Convert a part render to PNG at a DPI (0 for rsvg-convert's default),
+// tagged with its metadata
+func rasterizeRender(ctx context.Context, subject string, svg []byte, opts RenderOptions, dpi float64) ([]byte, error) {
+	factor := scriptSupersample(opts.Supersample)
+	w, h := rasterSize(svg, dpi)
+	if w*factor > maxRasterPixels || h*factor > maxRasterPixels {
+		return nil, &RenderError{http.StatusBadRequest, "Image too large",
+			fmt.Sprintf("the PNG would be rasterized at %dx%d pixels; the limit is %d on a side", w*factor, h*factor, maxRasterPixels)}
+	}
+	data, err := convertSVGAt(ctx, "png", [][]byte{svg}, dpi, float64(factor))
+	if err == nil && factor > 1 {
+		data, err = downscalePNG(data, factor)
+	}
+	if err != nil {
+		return nil, &RenderError{http.StatusInternalServerError, "PNG conversion failed", err.Error()}
+	}
+	png, err := tagPNG(data, renderMetadata(subject, opts), 8)
+	if err != nil {
+		return nil, &RenderError{http.StatusInternalServerError, "PNG conversion failed", err.Error()}
+	}
+	if dpi > 0 {
+		// Pixels per meter on both axes, unit 1 (the meter)
+		ppm := uint32(math.Round(dpi / 0.0254))
+		png = insertPNGChunks(png, [][]byte{pngChunk("pHYs", append(appendUint32s(nil, ppm, ppm), 1))})
+	}
+	return png, nil
+}
+
+// The pixel size rsvg-convert gives a render at a DPI (0 for its 96), from
+// its root's width and height in millimeters, or its pixel size otherwise
+func rasterSize(svg []byte, dpi float64) (int, int) {
+	if dpi == 0 {
+		dpi = 96
+	}
+	attrs := svgRootAttrs(svg)
+	wmm, wok := strings.CutSuffix(attrs["width"], "mm")
+	hmm, hok := strings.CutSuffix(attrs["height"], "mm")
+	if wok && hok {
+		w, werr := strconv.ParseFloat(wmm, 64)
+		h, herr := strconv.ParseFloat(hmm, 64)
+		if werr == nil && herr == nil {
+			return int(math.Ceil(w / 25.4 * dpi)), int(math.Ceil(h / 25.4 * dpi))
+		}
+	}
+	w, h := svgSize(svg)
+	return int(math.Ceil(w)), int(math.Ceil(h))
+}
+
+// Average a supersampled PNG down by factor
+func downscalePNG(data []byte, factor int) ([]byte, error) {
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, downscaleImage(img, factor)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestRenderOutput(t *testing.T) {
+	f := func(v float64) *float64 { return &v }
+	mm := RenderOptions{Units: "mm"}
+	format, dpi, err := (&RenderRequest{Format: "png", DPI: f(300)}).output(mm)
+	if err != nil || format != "png" || dpi != 300 {
+		t.Errorf("got %s at %g, %v", format, dpi, err)
+	}
+	if format, _, err := (&RenderRequest{}).output(RenderOptions{Units: "px"}); err != nil || format != "svg" {
+		t.Errorf("expected svg by default, got %s, %v", format, err)
+	}
+	for _, tt := range []struct {
+		req  RenderRequest
+		opts RenderOptions
+	}{
+		{RenderRequest{Format: "jpeg"}, mm},
+		{RenderRequest{DPI: f(300)}, mm},
+		{RenderRequest{Format: "png", DPI: f(300)}, RenderOptions{Units: "px"}},
+		{RenderRequest{Format: "png", DPI: f(5000)}, mm},
+	} {
+		if _, _, err := tt.req.output(tt.opts); err == nil {
+			t.Errorf("expected an error for %+v", tt.req)
+		}
+	}
+}
+
+func TestRasterSize(t *testing.T) {
+	plate := []byte(`<svg height="25.4mm" viewBox="0 0 1024 512" width="50.8mm"></svg>`)
+	if w, h := rasterSize(plate, 300); w != 600 || h != 300 {
+		t.Errorf("got %dx%d at 300 DPI", w, h)
+	}
+	if w, h := rasterSize(plate, 0); w != 192 || h != 96 {
+		t.Errorf("got %dx%d at the default DPI", w, h)
+	}
+	if w, h := rasterSize([]byte(`<svg height="512" width="1024"></svg>`), 300); w != 1024 || h != 512 {
+		t.Errorf("expected pixel sizes kept, got %dx%d", w, h)
+	}
+
+	_, err := rasterizeRender(context.Background(), "3001", plate, RenderOptions{}, maxRasterDPI*2)
+	var re *RenderError
+	if !errors.As(err, &re) || re.Status != http.StatusBadRequest {
+		t.Errorf("expected oversized PNGs refused, got %v", err)
+	}
+}
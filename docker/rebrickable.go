@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Rebrickable integration is enabled by setting REBRICKABLE_API_KEY
+var (
+	rebrickableAPIKey = getEnv("REBRICKABLE_API_KEY", "")
+	rebrickableAPIURL = getEnv("REBRICKABLE_API_URL", "https://rebrickable.com/api/v3")
+)
+
+const rebrickableCacheTTL = time.Hour
+
+type rebrickablePage struct {
+	Next    string `json:"next"`
+	Results []struct {
+		Part struct {
+			PartNum     string `json:"part_num"`
+			ExternalIDs struct {
+				LDraw []string `json:"LDraw"`
+			} `json:"external_ids"`
+		} `json:"part"`
+		Color struct {
+			ID          int `json:"id"`
+			ExternalIDs struct {
+				LDraw struct {
+					ExtIDs []int `json:"ext_ids"`
+				} `json:"LDraw"`
+			} `json:"external_ids"`
+		} `json:"color"`
+		Quantity int  `json:"quantity"`
+		IsSpare  bool `json:"is_spare"`
+	} `json:"results"`
+}
+
+type cachedInventory struct {
+	items   []InventoryItem
+	fetched time.Time
+}
+
+var (
+	inventoryCacheMu sync.Mutex
+	inventoryCache   = make(map[string]cachedInventory)
+)
+
+// Set render endpoint: /sets/{setNumber}/render
+func handleSetRender(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		sendError(w, http.StatusMethodNotAllowed, "Method not allowed", "")
+		return
+	}
+	if rebrickableAPIKey == "" {
+		sendError(w, http.StatusNotImplemented, "Rebrickable integration is not configured", "Set REBRICKABLE_API_KEY to enable set rendering")
+		return
+	}
+
+	setNumber := r.PathValue("setNumber")
+	if !strings.Contains(setNumber, "-") {
+		// Rebrickable set numbers carry a version suffix
+		setNumber += "-1"
+	}
+
+	// POST accepts contact sheet options; items come from the set inventory
+	var req ContactSheetRequest
+	if r.Method == http.MethodPost && r.ContentLength != 0 {
+		if !decodeJSON(w, r, &req) {
+			return
+		}
+	}
+	query := r.URL.Query()
+	if format := query.Get("format"); format != "" {
+		req.Format = format
+	}
+	if page := query.Get("page"); page != "" {
+		n, err := strconv.Atoi(page)
+		if err != nil {
+			sendError(w, http.StatusBadRequest, "page must be an integer", "")
+			return
+		}
+		req.Page = n
+	}
+	if req.Title == "" {
+		req.Title = "Set " + setNumber
+	}
+
+	items, err := fetchSetInventory(r.Context(), setNumber, query.Get("includeSpares") == "true")
+	if err != nil {
+		sendRenderError(w, err)
+		return
+	}
+	req.Items = items
+
+	base, err := req.validate()
+	if err != nil {
+		sendValidationError(w, err)
+		return
+	}
+	writeContactSheet(w, r, req, base)
+}
+
+// Fetch a set inventory from Rebrickable, mapped to LDraw part numbers and
+// color codes. Inventories are cached in memory for an hour.
+func fetchSetInventory(ctx context.Context, setNumber string, includeSpares bool) ([]InventoryItem, error) {
+	cacheKey := fmt.Sprintf("%s|%t", setNumber, includeSpares)
+	inventoryCacheMu.Lock()
+	cached, ok := inventoryCache[cacheKey]
+	inventoryCacheMu.Unlock()
+	if ok && time.Since(cached.fetched) < rebrickableCacheTTL {
+		return cached.items, nil
+	}
+
+	// Merge lines that map to the same LDraw part/color
+	type lineKey struct {
+		part  string
+		color int
+	}
+	quantities := make(map[lineKey]int)
+	var order []lineKey
+
+	next := fmt.Sprintf("%s/lego/sets/%s/parts/?page_size=1000", strings.TrimSuffix(rebrickableAPIURL, "/"), url.PathEscape(setNumber))
+	for next != "" {
+		var page rebrickablePage
+		if err := fetchRebrickable(ctx, next, &page); err != nil {
+			var re *RenderError
+			if errors.As(err, &re) && re.Status == http.StatusNotFound {
+				return nil, &RenderError{http.StatusNotFound, "Set not found", "Rebrickable has no inventory for this set"}
+			}
+			return nil, err
+		}
+		for _, res := range page.Results {
+			if res.IsSpare && !includeSpares {
+				continue
+			}
+			key := lineKey{mapRebrickablePart(res.Part.PartNum, res.Part.ExternalIDs.LDraw), res.Color.ID}
+			if ids := res.Color.ExternalIDs.LDraw.ExtIDs; len(ids) > 0 {
+				key.color = ids[0]
+			}
+			if _, seen := quantities[key]; !seen {
+				order = append(order, key)
+			}
+			quantities[key] += res.Quantity
+		}
+		next = page.Next
+	}
+
+	items := make([]InventoryItem, 0, len(order))
+	for _, key := range order {
+		color := key.color
+		items = append(items, InventoryItem{PartNumber: key.part, Color: &color, Quantity: quantities[key]})
+	}
+	log.Printf("Fetched inventory for set %s: %d lines", setNumber, len(items))
+
+	inventoryCacheMu.Lock()
+	inventoryCache[cacheKey] = cachedInventory{items: items, fetched: time.Now()}
+	inventoryCacheMu.Unlock()
+	return items, nil
+}
+
+// Fetch and decode one Rebrickable API response
+func fetchRebrickable(ctx context.Context, pageURL string, v any) error {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, pageURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "key "+rebrickableAPIKey)
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return &RenderError{http.StatusBadGateway, "Rebrickable request failed", err.Error()}
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return &RenderError{http.StatusNotFound, "Not found on Rebrickable", pageURL}
+	case resp.StatusCode != http.StatusOK:
+		return &RenderError{http.StatusBadGateway, "Rebrickable request failed", resp.Status}
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return &RenderError{http.StatusBadGateway, "Invalid Rebrickable response", err.Error()}
+	}
+	return nil
+}
+
+// Look up the LDraw number for a BrickLink part number. Returns "" when
+// Rebrickable doesn't know the part.
+func rebrickablePartForBrickLink(ctx context.Context, brickLinkID string) (string, error) {
+	var page struct {
+		Results []struct {
+			PartNum     string `json:"part_num"`
+			ExternalIDs struct {
+				LDraw []string `json:"LDraw"`
+			} `json:"external_ids"`
+		} `json:"results"`
+	}
+	u := fmt.Sprintf("%s/lego/parts/?bricklink_id=%s&inc_part_details=1", strings.TrimSuffix(rebrickableAPIURL, "/"), url.QueryEscape(brickLinkID))
+	if err := fetchRebrickable(ctx, u, &page); err != nil {
+		return "", err
+	}
+	if len(page.Results) == 0 {
+		return "", nil
+	}
+	return mapRebrickablePart(page.Results[0].PartNum, page.Results[0].ExternalIDs.LDraw), nil
+}
+
+// Fetch Rebrickable's color list as a BrickLink color ID to LDraw code map
+func rebrickableBrickLinkColors(ctx context.Context) (map[int]int, error) {
+	var page struct {
+		Results []struct {
+			ExternalIDs struct {
+				BrickLink struct {
+					ExtIDs []int `json:"ext_ids"`
+				} `json:"BrickLink"`
+				LDraw struct {
+					ExtIDs []int `json:"ext_ids"`
+				} `json:"LDraw"`
+			} `json:"external_ids"`
+		} `json:"results"`
+	}
+	u := strings.TrimSuffix(rebrickableAPIURL, "/") + "/lego/colors/?page_size=1000"
+	if err := fetchRebrickable(ctx, u, &page); err != nil {
+		return nil, err
+	}
+	colors := make(map[int]int)
+	for _, c := range page.Results {
+		if len(c.ExternalIDs.LDraw.ExtIDs) == 0 {
+			continue
+		}
+		for _, bl := range c.ExternalIDs.BrickLink.ExtIDs {
+			colors[bl] = c.ExternalIDs.LDraw.ExtIDs[0]
+		}
+	}
+	return colors, nil
+}
+
+// Map a Rebrickable part number to its LDraw equivalent. Rebrickable numbers
+// mostly follow LDraw already; its external ID list covers the exceptions
+// (prints, molds, and assemblies numbered differently).
+func mapRebrickablePart(partNum string, ldrawIDs []string) string {
+	if len(ldrawIDs) > 0 && ldrawIDs[0] != "" {
+		return ldrawIDs[0]
+	}
+	return partNum
+}
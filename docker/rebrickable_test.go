@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFetchSetInventory(t *testing.T) {
+	var srvURL string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Authorization"); got != "key test-key" {
+			t.Errorf("unexpected Authorization header %q", got)
+		}
+		if r.URL.Query().Get("page") == "2" {
+			fmt.Fprint(w, `{"next": null, "results": [
+				{"part": {"part_num": "3001", "external_ids": {}}, "color": {"id": 4, "external_ids": {}}, "quantity": 2, "is_spare": false},
+				{"part": {"part_num": "3024", "external_ids": {}}, "color": {"id": 15, "external_ids": {}}, "quantity": 1, "is_spare": true}
+			]}`)
+			return
+		}
+		fmt.Fprintf(w, `{"next": "%s/lego/sets/75192-1/parts/?page=2", "results": [
+			{"part": {"part_num": "3001", "external_ids": {"LDraw": ["3001"]}}, "color": {"id": 4, "external_ids": {"LDraw": {"ext_ids": [4]}}}, "quantity": 3, "is_spare": false},
+			{"part": {"part_num": "3626cpr0001", "external_ids": {"LDraw": ["3626cp01"]}}, "color": {"id": 14, "external_ids": {"LDraw": {"ext_ids": [14]}}}, "quantity": 1, "is_spare": false}
+		]}`, srvURL)
+	}))
+	defer srv.Close()
+	srvURL = srv.URL
+
+	oldURL, oldKey := rebrickableAPIURL, rebrickableAPIKey
+	rebrickableAPIURL, rebrickableAPIKey = srv.URL, "test-key"
+	defer func() { rebrickableAPIURL, rebrickableAPIKey = oldURL, oldKey }()
+
+	items, err := fetchSetInventory(context.Background(), "75192-1", false)
+	if err != nil {
+		t.Fatalf("fetchSetInventory: %v", err)
+	}
+
+	want := []struct {
+		part     string
+		color    int
+		quantity int
+	}{
+		{"3001", 4, 5},
+		{"3626cp01", 14, 1},
+	}
+	if len(items) != len(want) {
+		t.Fatalf("expected %d items, got %d: %+v", len(want), len(items), items)
+	}
+	for i, w := range want {
+		got := items[i]
+		if got.PartNumber != w.part || *got.Color != w.color || got.Quantity != w.quantity {
+			t.Errorf("item %d: got %s/%d x%d, want %s/%d x%d", i, got.PartNumber, *got.Color, got.Quantity, w.part, w.color, w.quantity)
+		}
+	}
+}
+
+func TestFetchSetInventoryNotFound(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+
+	oldURL, oldKey := rebrickableAPIURL, rebrickableAPIKey
+	rebrickableAPIURL, rebrickableAPIKey = srv.URL, "test-key"
+	defer func() { rebrickableAPIURL, rebrickableAPIKey = oldURL, oldKey }()
+
+	_, err := fetchSetInventory(context.Background(), "0000-1", false)
+	re, ok := err.(*RenderError)
+	if !ok || re.Status != http.StatusNotFound {
+		t.Fatalf("expected 404 RenderError, got %v", err)
+	}
+}
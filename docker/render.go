@@ -0,0 +1,757 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RenderOptions is a validated render request with all defaults applied.
+// It holds everything the render script needs apart from the input file.
+type RenderOptions struct {
+	Thickness       float64
+	FillColor       string
+	FillOpacity     float64
+	StrokeColor     string
+	CameraLatitude  float64
+	CameraLongitude float64
+	ResolutionX     int
+	ResolutionY     int
+	Padding         float64
+	CreaseAngle     float64
+	EdgeTypes       string
+	Normalize       string
+	// EdgeColors is "type=color" pairs (types as in EdgeTypes) joined by
+	// ";", in EdgeTypes order; see edgecolors.go
+	EdgeColors string
+	// GhostFile is an optional second model drawn in the ghost style in the
+	// same frame, and ObjectsFile holds parts drawn as separate objects in
+	// colors of their own (see objects.go). They're set by model renders,
+	// never from a request.
+	GhostFile   string
+	ObjectsFile string
+	// FillMode is "uniform" (every fill is FillColor) or "ldraw" (fills use
+	// the model's LDraw colors). Set by model renders with color overrides.
+	FillMode string
+	// CurveTolerance is the Bézier fitting tolerance in pixels (0 is off)
+	CurveTolerance float64
+	// Finish and FinishColor style the fills for an LDraw material finish;
+	// see applyFinish
+	Finish      string
+	FinishColor string
+	// ColorScheme is applied to the script's output; see applyColorScheme
+	ColorScheme string
+	// Style is a built-in look, SketchJitter the sketch style's line
+	// wander in pixels, and ToonBands the toon style's shading steps; see
+	// style.go
+	Style        string
+	SketchJitter float64
+	ToonBands    int
+	// LineTaper, LineFade, CreaseWeight, BackboneStretch, DashPattern, and
+	// LinePressure are the request's lineStyle modifiers; see linestyle.go
+	LineTaper       float64
+	LineFade        float64
+	CreaseWeight    float64
+	BackboneStretch float64
+	DashPattern     string
+	LinePressure    float64
+	// LineStylePlugin and its digest, so an edited plugin misses the cache;
+	// see plugins.go
+	LineStylePlugin       string
+	LineStylePluginDigest string
+	// Hatching and AmbientOcclusion have the script export face shading
+	// and an occlusion pass; see hatching.go and occlusion.go
+	Hatching         bool
+	AmbientOcclusion string
+	// Annotate classes the output's line sets and paths; see annotate.go
+	Annotate bool
+	// CSSVariables sets the output's colors through CSS custom properties;
+	// see theme.go
+	CSSVariables bool
+	// Metadata embeds a description of the render; see metadata.go
+	Metadata bool
+	// Precision is the decimal places kept in path data, at most the
+	// canonical 3; see canonical.go
+	Precision int
+	// RootSize and PreserveAspectRatio set the output's root sizing
+	// attributes; see rootsize.go
+	RootSize            string
+	PreserveAspectRatio string
+	// Units is px, or mm for the part's real size; see units.go
+	Units string
+	// Supersample is the stroke sampling and raster oversampling factor;
+	// see supersample.go
+	Supersample int
+	// Mirror is none or the LDraw axes the model is reflected across; see
+	// mirror.go
+	Mirror string
+	// Transform is the model's pose as a 3x3 matrix on the LDraw axes,
+	// row by row, or empty; see transform.go
+	Transform string
+	// SectionPlane is the cut's origin and unit normal on the LDraw axes,
+	// or empty; see section.go
+	SectionPlane string
+	// HiddenEdgeOpacity, when above 0, draws the edges behind faces at that
+	// opacity, dashed by HiddenEdgeDash; see hiddenedges.go
+	HiddenEdgeOpacity float64
+	HiddenEdgeDash    string
+	// BFC and Condlines are the import-stage controls; see condlines.go
+	BFC       string
+	Condlines string
+	// DepthCueTint, when set, fades strokes toward it with depth by up to
+	// DepthCueStrength; see depthcue.go
+	DepthCueTint     string
+	DepthCueStrength float64
+	// PrintFallback allows a missing printed part's base part instead; it's
+	// cleared once the part is found, so it doesn't split the cache
+	PrintFallback bool
+	// LibraryVersion is the library snapshot to render from, or empty for
+	// LDRAW_PATH; see library.go
+	LibraryVersion string
+	// PrivatePartDigest identifies a private part's files, set when one is
+	// rendered; see privateparts.go
+	PrivatePartDigest string
+}
+
+// RenderError describes a failed render in terms of the HTTP response it
+// should produce.
+type RenderError struct {
+	Status  int
+	Message string
+	Detail  string
+}
+
+func (e *RenderError) Error() string {
+	if e.Detail == "" {
+		return e.Message
+	}
+	return e.Message + ": " + e.Detail
+}
+
+// A part number cleaned up, and the library file it names, following
+// "~Moved to" stubs (see moved.go)
+func resolvePart(partNumber string) (string, string, error) {
+	return resolveLibraryPart(ldrawPath, partNumber)
+}
+
+// Resolve a part as resolvePart does, in the library at root
+func resolveLibraryPart(root, partNumber string) (string, string, error) {
+	clean, ok := cleanPartNumber(partNumber)
+	if !ok {
+		return "", "", &RenderError{http.StatusBadRequest, "Invalid partNumber", fmt.Sprintf("%q is not an LDraw part number", partNumber)}
+	}
+	partFile := findLibraryPart(root, clean)
+	if partFile == "" {
+		log.Printf("Part not found: %s", clean)
+		return "", "", &RenderError{http.StatusNotFound, "Part not found", fmt.Sprintf("Part %s not found in LDraw library", clean)}
+	}
+	clean, partFile = followMoves(root, clean, partFile)
+	return clean, partFile, nil
+}
+
+// Apply defaults and validate ranges
+func (req *RenderRequest) options() (RenderOptions, error) {
+	var errs fieldErrors
+	if req.Profile != "" {
+		merged, err := req.withProfile()
+		if err != nil {
+			errs.add("profile", "%v", err)
+			return RenderOptions{}, errs.err()
+		}
+		req = &merged
+	}
+	fillColor, err := validateColorField("fillColor", req.FillColor)
+	if err != nil {
+		errs.add("fillColor", "%v", err)
+	}
+	strokeColor, err := validateColorField("strokeColor", req.StrokeColor)
+	if err != nil {
+		errs.add("strokeColor", "%v", err)
+	}
+
+	opts := RenderOptions{
+		Thickness:       req.Thickness,
+		FillColor:       fillColor,
+		FillOpacity:     1.0,
+		StrokeColor:     strokeColor,
+		CameraLatitude:  30.0,
+		CameraLongitude: 45.0,
+		ResolutionX:     1024,
+		ResolutionY:     1024,
+		Padding:         0.03,
+		CreaseAngle:     135.0,
+	}
+
+	if opts.Thickness == 0 {
+		opts.Thickness = 2.0
+	}
+	if opts.Thickness < 0.5 || opts.Thickness > 20.0 {
+		errs.add("thickness", "thickness must be between 0.5 and 20.0")
+	}
+
+	// An LDraw color supplies the fill, opacity, and finish that aren't
+	// given explicitly
+	if req.Color != nil {
+		if c, ok := lookupColor(*req.Color); !ok {
+			errs.add("color", "color %d is not a known LDraw color code", *req.Color)
+		} else {
+			if opts.FillColor == "" {
+				opts.FillColor = c.Value
+			}
+			if c.Alpha < 255 {
+				opts.FillOpacity = float64(c.Alpha) / 255
+			}
+			opts.Finish, opts.FinishColor = c.Finish, c.FinishValue
+		}
+	}
+
+	opts.Style = req.Style
+	if !validStyle(opts.Style) {
+		errs.add("style", "style must be one of %s", strings.Join(renderStyles, ", "))
+	}
+	applyStyleDefaults(&opts, req)
+	if req.SketchJitter != nil {
+		opts.SketchJitter = *req.SketchJitter
+		if opts.Style != "sketch" {
+			errs.add("sketchJitter", "sketchJitter needs style sketch")
+		} else if opts.SketchJitter < 0 || opts.SketchJitter > 10 {
+			errs.add("sketchJitter", "sketchJitter must be between 0 and 10")
+		}
+	}
+	if req.ToonBands != nil {
+		opts.ToonBands = *req.ToonBands
+		if opts.Style != "toon" {
+			errs.add("toonBands", "toonBands needs style toon")
+		} else if opts.ToonBands < 2 || opts.ToonBands > 8 {
+			errs.add("toonBands", "toonBands must be between 2 and 8")
+		}
+	}
+	if req.LineStyle != nil {
+		errs.merge("lineStyle", req.LineStyle.apply(&opts))
+	}
+	if req.LineStylePlugin != "" {
+		if p, err := lookupLineStylePlugin(req.LineStylePlugin); err != nil {
+			errs.add("lineStylePlugin", "%v", err)
+		} else {
+			opts.LineStylePlugin, opts.LineStylePluginDigest = p.Name, p.Digest
+		}
+	}
+	opts.Hatching = req.Hatching != nil && *req.Hatching
+	opts.Annotate = req.Annotate != nil && *req.Annotate
+	opts.CSSVariables = req.CSSVariables != nil && *req.CSSVariables
+	opts.Metadata = req.Metadata != nil && *req.Metadata
+	opts.PrintFallback = req.PrintFallback != nil && *req.PrintFallback
+	opts.LibraryVersion = req.LibraryVersion
+	if err := checkLibraryVersion(req.LibraryVersion); err != nil {
+		errs.add("libraryVersion", "%v", err)
+	}
+	opts.AmbientOcclusion = req.AmbientOcclusion
+	switch {
+	case opts.AmbientOcclusion != "" && opts.AmbientOcclusion != "raster" && opts.AmbientOcclusion != "fills":
+		errs.add("ambientOcclusion", "ambientOcclusion must be raster or fills")
+	case opts.AmbientOcclusion == "raster" && opts.Style != "toon":
+		errs.add("ambientOcclusion", "ambientOcclusion raster needs a raster style (toon)")
+	case opts.AmbientOcclusion == "fills" && opts.Style == "toon":
+		errs.add("ambientOcclusion", "toon renders are shaded in the raster; use ambientOcclusion raster")
+	}
+	if opts.FillColor == "" {
+		opts.FillColor = "white"
+	}
+
+	if req.FillOpacity != nil {
+		opts.FillOpacity = *req.FillOpacity
+	}
+	if opts.FillOpacity < 0 || opts.FillOpacity > 1.0 {
+		errs.add("fillOpacity", "fillOpacity must be between 0 and 1")
+	}
+
+	if opts.StrokeColor == "" {
+		opts.StrokeColor = "currentColor"
+	}
+
+	if req.CameraLatitude != nil {
+		opts.CameraLatitude = *req.CameraLatitude
+	}
+	if req.CameraLongitude != nil {
+		opts.CameraLongitude = *req.CameraLongitude
+	}
+	if req.ResolutionX != nil {
+		opts.ResolutionX = *req.ResolutionX
+	}
+	if req.ResolutionY != nil {
+		opts.ResolutionY = *req.ResolutionY
+	}
+	if req.Padding != nil {
+		opts.Padding = *req.Padding
+	}
+	if req.CreaseAngle != nil {
+		opts.CreaseAngle = *req.CreaseAngle
+	}
+
+	if opts.CameraLatitude < -90 || opts.CameraLatitude > 90 {
+		errs.add("cameraLatitude", "cameraLatitude must be between -90 and 90")
+	}
+	if opts.CameraLongitude < -360 || opts.CameraLongitude > 360 {
+		errs.add("cameraLongitude", "cameraLongitude must be between -360 and 360")
+	}
+	if opts.ResolutionX < 64 || opts.ResolutionX > 4096 {
+		errs.add("resolutionX", "resolutionX must be between 64 and 4096")
+	}
+	if opts.ResolutionY < 64 || opts.ResolutionY > 4096 {
+		errs.add("resolutionY", "resolutionY must be between 64 and 4096")
+	}
+	if opts.Padding < 0 || opts.Padding > 0.5 {
+		errs.add("padding", "padding must be between 0 and 0.5")
+	}
+	if opts.CreaseAngle < 0 || opts.CreaseAngle > 180 {
+		errs.add("creaseAngle", "creaseAngle must be between 0 and 180")
+	}
+
+	opts.EdgeTypes = buildEdgeTypes(req.EdgeTypes)
+	if req.EdgeColors != nil {
+		errs.merge("edgeColors", req.EdgeColors.apply(&opts))
+	}
+	opts.ColorScheme = req.ColorScheme
+	if opts.ColorScheme == "" {
+		opts.ColorScheme = "light"
+	}
+	if opts.ColorScheme != "light" && opts.ColorScheme != "dark" && opts.ColorScheme != "auto" {
+		errs.add("colorScheme", "colorScheme must be light, dark, or auto")
+	} else if opts.ColorScheme != "light" && opts.Style != "" {
+		errs.add("colorScheme", "colorScheme can't be combined with a style")
+	}
+
+	if req.Transform != nil {
+		errs.merge("transform", req.Transform.apply(&opts))
+	}
+	if req.DepthCue != nil {
+		errs.merge("depthCue", req.DepthCue.apply(&opts, req.StrokeColor != ""))
+	}
+	errs.merge("", applyImportModes(&opts, req.BFC, req.Condlines))
+	errs.merge("", applyHiddenEdges(&opts, req.ShowHiddenEdges, req.HiddenEdgeStyle))
+	if req.SectionPlane != nil {
+		errs.merge("sectionPlane", req.SectionPlane.apply(&opts))
+	}
+	if opts.Mirror, err = parseMirror(req.Mirror); err != nil {
+		errs.add("mirror", "%v", err)
+	}
+
+	opts.Supersample = 1
+	if req.Supersample != nil {
+		opts.Supersample = *req.Supersample
+	}
+	if opts.Supersample < 1 || opts.Supersample > maxSupersample {
+		errs.add("supersample", "supersample must be between 1 and %d", maxSupersample)
+	}
+
+	opts.Precision = canonicalPrecision
+	if req.Precision != nil {
+		opts.Precision = *req.Precision
+	}
+	if opts.Precision < 0 || opts.Precision > canonicalPrecision {
+		errs.add("precision", "precision must be between 0 and %d", canonicalPrecision)
+	}
+
+	opts.RootSize = req.RootSize
+	if opts.RootSize == "" {
+		opts.RootSize = "fixed"
+	}
+	opts.PreserveAspectRatio = req.PreserveAspectRatio
+	if !validRootSize(opts.RootSize) {
+		errs.add("rootSize", "rootSize must be fixed, scalable, or responsive")
+	} else if opts.PreserveAspectRatio != "" && opts.RootSize == "fixed" {
+		errs.add("preserveAspectRatio", "preserveAspectRatio needs a viewBox; use rootSize scalable or responsive")
+	}
+	if opts.PreserveAspectRatio != "" && !preserveAspectRatioPattern.MatchString(opts.PreserveAspectRatio) {
+		errs.add("preserveAspectRatio", "preserveAspectRatio must be none or an alignment such as xMidYMid, optionally followed by meet or slice")
+	}
+	opts.Units = req.Units
+	if opts.Units == "" {
+		opts.Units = "px"
+	}
+	if opts.Units != "px" && opts.Units != "mm" {
+		errs.add("units", "units must be px or mm")
+	} else if opts.Units == "mm" && opts.RootSize == "responsive" {
+		errs.add("units", "units mm needs a width and height; use rootSize fixed or scalable")
+	}
+
+	if req.CurveTolerance != nil {
+		opts.CurveTolerance = *req.CurveTolerance
+	}
+	if opts.CurveTolerance < 0 || opts.CurveTolerance > 10 {
+		errs.add("curveTolerance", "curveTolerance must be between 0 and 10")
+	}
+
+	opts.FillMode = "uniform"
+	opts.Normalize = "auto"
+	if req.NormalizeOrientation != nil && !*req.NormalizeOrientation {
+		opts.Normalize = "off"
+	}
+	return opts, errs.err()
+}
+
+// Render a part from the LDraw library to SVG, through the render cache when
+// one is configured and sharing identical renders already running (see
+// coalesce.go). Metrics are updated here so that every caller (single
+// renders, sheets, batches) is counted the same way.
+func renderPart(ctx context.Context, partNumber string, opts RenderOptions) ([]byte, time.Duration, error) {
+	svg, d, _, err := renderPartKeyed(ctx, partNumber, opts)
+	return svg, d, err
+}
+
+// renderPart, also returning the render's cache key ("" if it failed
+// before it had one)
+func renderPartKeyed(ctx context.Context, partNumber string, opts RenderOptions) ([]byte, time.Duration, string, error) {
+	partNumber, partFile, private, err := resolveRequestPart(ctx, partNumber, opts)
+	opts.PrintFallback = false
+	var model []byte
+	if err == nil && private {
+		if model, err = privatePartModel(ctx, partNumber, partFile); err != nil {
+			err = &RenderError{http.StatusInternalServerError, "Reading private part failed", err.Error()}
+		}
+		opts.PrivatePartDigest = privatePartDigest(model)
+	}
+	if err != nil {
+		recordError()
+		recordKeyUsage(ctx, func(u *usageDay) { u.Errors++ })
+		return nil, 0, "", err
+	}
+	// Overrides, popularity, and render history are the shared library's
+	if !private {
+		opts = applyPartOverride(partNumber, opts)
+	}
+
+	if prewarmPopular > 0 && !isLowPriority(ctx) && !private {
+		recordPartRequest(partNumber, opts)
+	}
+	key := renderCacheKey(partNumber, opts)
+	// Replays read only from the cache, or render afresh (see replay.go), as
+	// debug renders do (see debug.go)
+	mode, debug := replayMode(ctx), renderDebugFrom(ctx)
+	debug.setPartFile(partFile)
+	if debug != nil {
+		mode = replayFresh
+	}
+	if mode != replayFresh {
+		if svg, ok := renderCache.get(key); ok {
+			recordKeyUsage(ctx, func(u *usageDay) { u.CacheHits++ })
+			return svg, 0, key, nil
+		}
+	}
+	if mode == replayCached {
+		return nil, 0, key, &RenderError{http.StatusNotFound, "Not cached", fmt.Sprintf("No cached render of %s with these options", partNumber)}
+	}
+	// Each caller pays for its render before it can join another's, so a
+	// quota failure is always the caller's own
+	if err := chargeRender(ctx); err != nil {
+		recordKeyUsage(ctx, func(u *usageDay) { u.Errors++ })
+		return nil, 0, key, err
+	}
+	ctx = withRenderCharged(ctx)
+	// A dispatched render waits on a worker that may be this node, whose own
+	// render of the key mustn't wait on it in turn. Replays render here, with
+	// this node's pipeline.
+	flight, dispatch := key, shouldDispatch(ctx) && mode == "" && !private
+	if dispatch {
+		flight = "dispatch/" + key
+	}
+	render := func() ([]byte, time.Duration, error) {
+		var svg []byte
+		var d time.Duration
+		var err error
+		if dispatch {
+			svg, d, err = dispatchRender(ctx, partNumber, opts)
+		} else {
+			if private {
+				svg, d, err = renderPrivatePart(ctx, partNumber, model, opts)
+			} else {
+				svg, d, err = renderFile(ctx, partNumber, partFile, opts)
+			}
+			if err == nil && opts.Annotate {
+				svg = annotatePart(svg, partNumber)
+			}
+			if err == nil && opts.Metadata {
+				svg = embedSVGMetadata(svg, renderMetadata(partNumber, opts))
+			}
+		}
+		if err == nil && mode == "" {
+			if err := renderCache.put(key, svg); err != nil {
+				log.Printf("Failed to cache render of %s: %v", partNumber, err)
+			}
+			if !private {
+				recordPartRender(partNumber, partFile, d, len(svg))
+			}
+		}
+		return svg, d, err
+	}
+	// Another request's render wouldn't be this one's to debug
+	if debug != nil {
+		svg, d, err := render()
+		return svg, d, key, err
+	}
+	svg, d, err := coalesceRender(ctx, flight, render)
+	return svg, d, key, err
+}
+
+// Render an arbitrary LDraw file (part or model) to SVG with Blender,
+// metered against the request's API key and shown on the admin dashboard.
+func renderFile(ctx context.Context, label, inputFile string, opts RenderOptions) ([]byte, time.Duration, error) {
+	if err := chargeRender(ctx); err != nil {
+		return nil, 0, err
+	}
+	start := time.Now()
+	done := trackRender(ctx, label)
+	svg, d, err := blenderRender(ctx, label, inputFile, opts)
+	done(svg, err)
+	recordKeyUsage(ctx, func(u *usageDay) {
+		u.ComputeSeconds += time.Since(start).Seconds()
+		if err != nil {
+			u.Errors++
+		}
+	})
+	return svg, d, err
+}
+
+func blenderRender(ctx context.Context, label, inputFile string, opts RenderOptions) ([]byte, time.Duration, error) {
+	pluginFile, err := lineStylePluginFile(opts)
+	if err != nil {
+		recordError()
+		return nil, 0, err
+	}
+	// Each render works in its own directory; see sandbox.go
+	ws, err := newBlenderWorkspace(inputFile, opts.GhostFile, opts.ObjectsFile, pluginFile)
+	if err != nil {
+		log.Printf("Failed to create render workspace: %v", err)
+		recordError()
+		return nil, 0, &RenderError{http.StatusInternalServerError, "Failed to create temp file", err.Error()}
+	}
+	defer ws.remove()
+
+	// Render with Blender
+	log.Printf("Rendering %s (thickness=%.1f, camera=%.1f/%.1f, res=%dx%d, padding=%.3f, crease=%.1f, edges=%s, fill=%s, opacity=%.2f, stroke=%s, normalize=%s)",
+		label, opts.Thickness, opts.CameraLatitude, opts.CameraLongitude, opts.ResolutionX, opts.ResolutionY,
+		opts.Padding, opts.CreaseAngle, opts.EdgeTypes, opts.FillColor, opts.FillOpacity, opts.StrokeColor, opts.Normalize)
+	renderStart := time.Now()
+	debug := renderDebugFrom(ctx)
+	debug.mark("blender")
+	defer debug.finish()
+
+	if !isLowPriority(ctx) {
+		foregroundRenders.Add(1)
+		defer foregroundRenders.Add(-1)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 120*time.Second)
+	defer cancel()
+
+	// Outputs besides the SVG, for post-processing
+	shadingFile, rasterFile, occlusionFile, frameFile := "", "", "", ""
+	if opts.Hatching || opts.AmbientOcclusion == "fills" {
+		shadingFile = ws.shading
+	}
+	if opts.Style == "toon" {
+		rasterFile = ws.raster
+	}
+	if opts.AmbientOcclusion != "" {
+		occlusionFile = ws.occlusion
+	}
+	if opts.Units == "mm" {
+		frameFile = ws.frame
+	}
+	bfc, condlines := scriptImportModes(opts)
+	args := []string{
+		"--background",
+		"--python", renderScript,
+		"--",
+		ws.input,
+		ws.output,
+		libraryPath(opts.LibraryVersion),
+		fmt.Sprintf("%.1f", opts.Thickness),
+		opts.FillColor,
+		fmt.Sprintf("%f", opts.CameraLatitude),
+		fmt.Sprintf("%f", opts.CameraLongitude),
+		strconv.Itoa(opts.ResolutionX),
+		strconv.Itoa(opts.ResolutionY),
+		fmt.Sprintf("%f", opts.Padding),
+		fmt.Sprintf("%f", opts.CreaseAngle),
+		opts.EdgeTypes,
+		fmt.Sprintf("%f", opts.FillOpacity),
+		opts.StrokeColor,
+		opts.Normalize,
+		ws.ghost,
+		opts.FillMode,
+		scriptLineStyle(opts.Style),
+		fmt.Sprintf("%f", opts.SketchJitter),
+		shadingFile,
+		rasterFile,
+		strconv.Itoa(scriptToonBands(opts.ToonBands)),
+		occlusionFile,
+		fmt.Sprintf("%f", opts.LineTaper),
+		fmt.Sprintf("%f", opts.LineFade),
+		fmt.Sprintf("%f", opts.CreaseWeight),
+		fmt.Sprintf("%f", opts.BackboneStretch),
+		scriptDashPattern(opts.DashPattern),
+		ws.plugin,
+		scriptColorEdgeTypes(opts),
+		ws.objects,
+		frameFile,
+		strconv.Itoa(scriptSupersample(opts.Supersample)),
+		scriptMirror(opts.Mirror),
+		scriptTransform(opts.Transform),
+		scriptSectionPlane(opts.SectionPlane),
+		fmt.Sprintf("%f", opts.HiddenEdgeOpacity),
+		scriptDashPattern(opts.HiddenEdgeDash),
+		bfc,
+		condlines,
+		fmt.Sprintf("%f", opts.LinePressure),
+		scriptDepthCue(opts),
+	}
+
+	svgContent, err := runBlender(ctx, label, ws, args)
+	if be, ok := err.(*BlenderError); ok && be.Cause == causeSegfault && ctx.Err() == nil {
+		log.Printf("Blender crashed rendering %s, retrying once", label)
+		svgContent, err = runBlender(ctx, label, ws, args)
+	}
+	if errors.Is(err, context.Canceled) {
+		log.Printf("Render of %s cancelled", label)
+		return nil, 0, err
+	}
+	var extras renderExtras
+	if err == nil {
+		extras, err = readRenderExtras(opts, shadingFile, rasterFile, occlusionFile, frameFile)
+	}
+	if err != nil {
+		recordError()
+		return nil, 0, err
+	}
+
+	renderDuration := time.Since(renderStart)
+	log.Printf("Rendered %s in %.2fs", label, renderDuration.Seconds())
+
+	recordRender(renderDuration)
+
+	reportProgress(ctx, "postprocess", 95)
+	postStart := time.Now()
+	svgContent = fitSVGCurves(canonicalizeSVG(svgContent), opts.CurveTolerance)
+	svgContent = applyDepthCue(svgContent, opts)
+	svgContent = applyEdgeColors(svgContent, opts.EdgeColors)
+	if opts.Annotate {
+		svgContent = applyAnnotations(svgContent, readObjectRefs(ws.objects))
+	}
+	svgContent = applyFaceShading(applyFinish(svgContent, opts), extras.shading, extras.occlusion, opts)
+	svgContent = applySectionHatch(svgContent, opts)
+	svgContent = applyColorScheme(svgContent, opts.ColorScheme)
+	svgContent = applyStyle(svgContent, opts.Style, extras.raster)
+	if opts.CSSVariables {
+		svgContent = applyCSSVariables(svgContent)
+	}
+	svgContent = applyPrecision(svgContent, opts.Precision)
+	svgContent = applyRootSize(svgContent, opts.RootSize, opts.PreserveAspectRatio, extras.mmPerPixel)
+	recordPostprocess(time.Since(postStart))
+	return svgContent, renderDuration, nil
+}
+
+// The outputs a render asked the script for besides its SVG
+type renderExtras struct {
+	shading   *faceShading
+	raster    []byte
+	occlusion image.Image
+	// The model size of a pixel, for units mm
+	mmPerPixel float64
+}
+
+// Read the extra outputs the script was given paths for, with ambient
+// occlusion multiplied into the raster when asked
+func readRenderExtras(opts RenderOptions, shadingFile, rasterFile, occlusionFile, frameFile string) (renderExtras, error) {
+	var extras renderExtras
+	var err error
+	if shadingFile != "" {
+		extras.shading, err = readFaceShading(shadingFile)
+	}
+	if err == nil && rasterFile != "" {
+		extras.raster, err = os.ReadFile(rasterFile)
+	}
+	if err == nil && occlusionFile != "" {
+		extras.occlusion, err = readOcclusion(occlusionFile)
+	}
+	if err == nil && frameFile != "" {
+		extras.mmPerPixel, err = readMMPerPixel(frameFile)
+	}
+	if err == nil && opts.AmbientOcclusion == "raster" {
+		extras.raster, err = occludeRaster(extras.raster, extras.occlusion)
+	}
+	if err != nil {
+		log.Printf("Failed to read render outputs: %v", err)
+		return renderExtras{}, &RenderError{http.StatusInternalServerError, "Failed to read output", err.Error()}
+	}
+	return extras, nil
+}
+
+// Run Blender once and read its SVG, classifying any failure
+func runBlender(ctx context.Context, label string, ws *blenderWorkspace, args []string) ([]byte, error) {
+	cmd := blenderCommand(ctx, ws, args)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = io.MultiWriter(&stdout, &progressWriter{ctx: ctx})
+	cmd.Stderr = &stderr
+
+	runErr := cmd.Run()
+	renderDebugFrom(ctx).recordRun(args, stdout.String(), stderr.String())
+	var svg []byte
+	if runErr == nil {
+		var err error
+		svg, err = os.ReadFile(ws.output)
+		if err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to read rendered SVG: %v", err)
+			return nil, &RenderError{http.StatusInternalServerError, "Failed to read output", err.Error()}
+		}
+		if len(svg) > 0 {
+			return svg, nil
+		}
+		// A clean exit without an SVG is classified like a failure
+	}
+
+	if errors.Is(ctx.Err(), context.Canceled) {
+		// Killed because its job was cancelled; not Blender's failure
+		return nil, ctx.Err()
+	}
+	output := stdout.String() + stderr.String()
+	cause := classifyBlenderFailure(ctx, runErr, output)
+	recordBlenderFailure(cause)
+	detail := outputTail(stderr.String(), 20)
+	if detail == "" {
+		detail = outputTail(stdout.String(), 20)
+	}
+	if cause == causeTimeout {
+		detail = fmt.Sprintf("Part %s", label)
+	}
+	log.Printf("Render failed for %s (%s): %s", label, cause, detail)
+	return nil, newBlenderError(cause, detail)
+}
+
+// Helper: send the HTTP response for an error returned by the render pipeline
+func sendRenderError(w http.ResponseWriter, err error) {
+	status, resp := renderErrorResponse(err)
+	sendErrorResponse(w, status, resp)
+}
+
+// The status code and response body for a render error
+func renderErrorResponse(err error) (int, ErrorResponse) {
+	var re *RenderError
+	if errors.As(err, &re) {
+		return re.Status, ErrorResponse{Error: re.Message, Detail: re.Detail}
+	}
+	var be *BlenderError
+	if errors.As(err, &be) {
+		return http.StatusInternalServerError, ErrorResponse{Error: be.Message, Detail: be.Detail, Cause: be.Cause}
+	}
+	return http.StatusInternalServerError, ErrorResponse{Error: "Rendering failed", Detail: err.Error()}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"unicode/utf8"
+)
+
+// POST /admin/replay/{auditId} runs a request from the audit log again, so
+// a regression after a Blender or script upgrade can be triaged from the
+// request a customer reported. It runs twice: once answered only from the
+// render cache, which gives the original output back if it's still cached,
+// and once rendered afresh by this node, bypassing the cache without
+// touching it. Replays aren't metered against the key or audited.
+const (
+	replayCached = "cached"
+	replayFresh  = "fresh"
+	// Outputs differing over more than this many lines aren't diffed
+	replayMaxDiffLines = 2000
+)
+
+type replayModeKey struct{}
+
+func withReplayMode(ctx context.Context, mode string) context.Context {
+	return context.WithValue(ctx, replayModeKey{}, mode)
+}
+
+// replayCached, replayFresh, or "" outside a replay
+func replayMode(ctx context.Context) string {
+	mode, _ := ctx.Value(replayModeKey{}).(string)
+	return mode
+}
+
+type ReplayOutput struct {
+	Status       int    `json:"status"`
+	ContentType  string `json:"contentType,omitempty"`
+	OutputSHA256 string `json:"outputSha256,omitempty"`
+	ETag         string `json:"etag,omitempty"`
+	// The response body: text as is, anything else base64-encoded
+	Body       string `json:"body,omitempty"`
+	BodyBase64 []byte `json:"bodyBase64,omitempty"`
+}
+
+type ReplayResponse struct {
+	Entry AuditEntry `json:"entry"`
+	// The output as the render cache still has it, if it matches the
+	// audited one, and as rendered now
+	Original *ReplayOutput `json:"original"`
+	Replay   ReplayOutput  `json:"replay"`
+	// Whether the replay is byte-for-byte what was served (by ETag, which
+	// ignores compression)
+	Identical bool `json:"identical"`
+	// The lines only in the original ("-") or the replay ("+"), with the
+	// original available and both text
+	Diff []string `json:"diff,omitempty"`
+}
+
+func handleReplay(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		sendError(w, http.StatusMethodNotAllowed, "Method not allowed", "")
+		return
+	}
+	if auditLogPath == "" {
+		sendError(w, http.StatusConflict, "Audit log is disabled", "Set AUDIT_LOG to enable it")
+		return
+	}
+	id := r.PathValue("auditId")
+	entries, err := readAuditLog(auditLogPath, func(e AuditEntry) bool { return e.ID == id }, 1)
+	if err != nil {
+		sendError(w, http.StatusInternalServerError, "Reading audit log failed", err.Error())
+		return
+	}
+	if len(entries) == 0 {
+		sendError(w, http.StatusNotFound, "Audit entry not found", id)
+		return
+	}
+	entry := entries[0]
+	if entry.BodySize > 0 && entry.Body == nil {
+		sendError(w, http.StatusConflict, "Request can't be replayed", "Its body was too large or not JSON, so the audit log only has its hash")
+		return
+	}
+	token := ""
+	if entry.Key != "" && apiKeys != nil {
+		for value, k := range apiKeys {
+			if k.Name == entry.Key {
+				token = value
+			}
+		}
+		if token == "" {
+			sendError(w, http.StatusConflict, "Request can't be replayed", "Its API key "+entry.Key+" no longer exists")
+			return
+		}
+	}
+
+	run := func(mode string) ReplayOutput {
+		target := entry.Path
+		if entry.Query != "" {
+			target += "?" + entry.Query
+		}
+		req := httptest.NewRequest(entry.Method, target, bytes.NewReader(entry.Body))
+		req = req.WithContext(withReplayMode(r.Context(), mode))
+		if entry.Body != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		if token != "" {
+			req.Header.Set("X-API-Key", token)
+		}
+		rec := httptest.NewRecorder()
+		routes().ServeHTTP(rec, req)
+		out := ReplayOutput{
+			Status:      rec.Code,
+			ContentType: rec.Header().Get("Content-Type"),
+			ETag:        strings.Trim(rec.Header().Get("ETag"), `"`),
+		}
+		if body := rec.Body.Bytes(); len(body) > 0 {
+			sum := sha256.Sum256(body)
+			out.OutputSHA256 = hex.EncodeToString(sum[:])
+			if utf8.Valid(body) {
+				out.Body = string(body)
+			} else {
+				out.BodyBase64 = body
+			}
+		}
+		return out
+	}
+
+	resp := ReplayResponse{Entry: entry, Replay: run(replayFresh)}
+	// Responses without an ETag (PNGs) are compared by hash; the replay
+	// is never compressed, so that only works if the original wasn't either
+	if entry.ETag != "" {
+		resp.Identical = resp.Replay.ETag == entry.ETag
+	} else {
+		resp.Identical = resp.Replay.OutputSHA256 == entry.OutputSHA256
+	}
+	if cached := run(replayCached); cached.Status == http.StatusOK && entry.ETag != "" && cached.ETag == entry.ETag {
+		resp.Original = &cached
+	}
+	if resp.Original != nil && resp.Original.Body != "" && resp.Replay.Body != "" && !resp.Identical {
+		resp.Diff = diffLines(resp.Original.Body, resp.Replay.Body)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// The lines only in a ("-") or only in b ("+"), in order, from their
+// longest common subsequence; nil if they differ over too many to diff
+func diffLines(a, b string) []string {
+	as, bs := strings.Split(a, "\n"), strings.Split(b, "\n")
+	// Only the middle, between the lines they start and end with, differs
+	for len(as) > 0 && len(bs) > 0 && as[0] == bs[0] {
+		as, bs = as[1:], bs[1:]
+	}
+	for len(as) > 0 && len(bs) > 0 && as[len(as)-1] == bs[len(bs)-1] {
+		as, bs = as[:len(as)-1], bs[:len(bs)-1]
+	}
+	if len(as) > replayMaxDiffLines || len(bs) > replayMaxDiffLines {
+		return nil
+	}
+	// lcs[i][j] is the common subsequence length of as[i:] and bs[j:]
+	lcs := make([][]int32, len(as)+1)
+	for i := range lcs {
+		lcs[i] = make([]int32, len(bs)+1)
+	}
+	for i := len(as) - 1; i >= 0; i-- {
+		for j := len(bs) - 1; j >= 0; j-- {
+			if as[i] == bs[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+	diff := []string{}
+	i, j := 0, 0
+	for i < len(as) || j < len(bs) {
+		switch {
+		case i < len(as) && j < len(bs) && as[i] == bs[j]:
+			i, j = i+1, j+1
+		case i < len(as) && (j == len(bs) || lcs[i+1][j] >= lcs[i][j+1]):
+			diff = append(diff, "-"+as[i])
+			i++
+		default:
+			diff = append(diff, "+"+bs[j])
+			j++
+		}
+	}
+	return diff
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func TestReplay(t *testing.T) {
+	withFakeBlender(t)
+	withTestLibrary(t, map[string]string{"3001": "0 Brick 2 x 4\n"})
+	withRenderCache(t)
+	withAPIKeys(t, `[{"name": "acme", "key": "k-acme"}]`)
+	withAuditLog(t)
+	oldAdmin := adminToken
+	adminToken = "secret"
+	t.Cleanup(func() { adminToken = oldAdmin })
+	srv := httptest.NewServer(routes())
+	defer srv.Close()
+
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+"/render", bytes.NewReader([]byte(`{"partNumber": "3001"}`)))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-API-Key", "k-acme")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	entries, _ := readAuditLog(auditLogPath, func(AuditEntry) bool { return true }, 10)
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 audit entry, got %d", len(entries))
+	}
+	rendersBefore := monthlyRenders("acme", entries[0].Time)
+
+	replay := func(id string) (*http.Response, ReplayResponse) {
+		req, _ := http.NewRequest(http.MethodPost, srv.URL+"/admin/replay/"+id, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var body ReplayResponse
+		json.NewDecoder(resp.Body).Decode(&body)
+		return resp, body
+	}
+	r, body := replay(entries[0].ID)
+	if r.StatusCode != http.StatusOK {
+		t.Fatalf("status %d", r.StatusCode)
+	}
+	if !body.Identical || body.Replay.Status != http.StatusOK || body.Replay.ETag != entries[0].ETag {
+		t.Errorf("expected an identical replay, got %+v", body.Replay)
+	}
+	if body.Original == nil || body.Original.ETag != entries[0].ETag || body.Diff != nil {
+		t.Errorf("expected the cached original and no diff, got %+v", body.Original)
+	}
+	if n := monthlyRenders("acme", entries[0].Time); n != rendersBefore {
+		t.Errorf("replays were metered: %d renders, was %d", n, rendersBefore)
+	}
+	// The replay itself is audited, but not the renders it ran
+	entries, _ = readAuditLog(auditLogPath, func(AuditEntry) bool { return true }, 10)
+	if len(entries) != 2 || entries[1].Path != "/admin/replay/"+entries[0].ID {
+		t.Errorf("unexpected audit log %+v", entries)
+	}
+
+	if r, _ := replay("no-such-entry"); r.StatusCode != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown entry, got %d", r.StatusCode)
+	}
+	appendAuditEntry(AuditEntry{ID: "uploaded", Method: http.MethodPost, Path: "/render/model", BodySize: 1 << 20, BodySHA256: "abc"})
+	if r, _ := replay("uploaded"); r.StatusCode != http.StatusConflict {
+		t.Errorf("expected 409 for a request without its body, got %d", r.StatusCode)
+	}
+}
+
+func TestDiffLines(t *testing.T) {
+	got := diffLines("<svg>\n<path d=\"M0 0\"/>\n<path d=\"M1 1\"/>\n</svg>", "<svg>\n<path d=\"M0 0\"/>\n<path d=\"M2 2\"/>\n<circle/>\n</svg>")
+	want := []string{`-<path d="M1 1"/>`, `+<path d="M2 2"/>`, "+<circle/>"}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got := diffLines("a\nb", "a\nb"); len(got) != 0 {
+		t.Errorf("expected no differences, got %q", got)
+	}
+}
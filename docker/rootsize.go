@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// rootSize picks the root <svg> a render gets for where it's embedded:
+//
+//	fixed        width and height, as rendered (the default)
+//	scalable     width, height, and a viewBox, so CSS can resize it
+//	responsive   a viewBox only, filling its container
+//
+// Email clients need fixed sizes; inline SVG and CSS backgrounds scale
+// with a viewBox. preserveAspectRatio sets how a viewBox fits a box of
+// another shape, so it needs scalable or responsive.
+var rootSizes = []string{"fixed", "scalable", "responsive"}
+
+var (
+	preserveAspectRatioPattern = regexp.MustCompile(`^(?:none|x(?:Min|Mid|Max)Y(?:Min|Mid|Max)(?: (?:meet|slice))?)$`)
+	svgSizeAttrPattern         = regexp.MustCompile(`\s(?:width|height|viewBox|preserveAspectRatio)="[^"]*"`)
+)
+
+func validRootSize(size string) bool {
+	for _, s := range rootSizes {
+		if s == size {
+			return true
+		}
+	}
+	return false
+}
+
+// Rewrite a rendered SVG's root sizing attributes. Given mmPerPixel, the
+// width and height are in millimeters, with a viewBox to scale the drawing
+// to them; see units.go.
+func applyRootSize(svg []byte, rootSize, preserveAspectRatio string, mmPerPixel float64) []byte {
+	if (rootSize == "" || rootSize == "fixed") && mmPerPixel == 0 {
+		return svg
+	}
+	m := svgRootPattern.FindSubmatchIndex(svg)
+	if m == nil {
+		return svg
+	}
+	w, h := svgSize(svg)
+	sizing := fmt.Sprintf(` viewBox="0 0 %g %g"`, w, h)
+	switch {
+	case mmPerPixel > 0:
+		sizing = fmt.Sprintf(` width="%smm" height="%smm"`, formatMillimeters(w*mmPerPixel), formatMillimeters(h*mmPerPixel)) + sizing
+	case rootSize != "responsive":
+		sizing = fmt.Sprintf(` width="%g" height="%g"`, w, h) + sizing
+	}
+	if preserveAspectRatio != "" {
+		sizing += ` preserveAspectRatio="` + preserveAspectRatio + `"`
+	}
+	out := make([]byte, 0, len(svg)+len(sizing))
+	out = append(out, svg[:m[2]]...)
+	out = append(out, svgSizeAttrPattern.ReplaceAll(svg[m[2]:m[3]], nil)...)
+	out = append(out, sizing...)
+	return append(out, svg[m[3]:]...)
+}
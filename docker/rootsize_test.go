@@ -0,0 +1,49 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRootSizeRender(t *testing.T) {
+	svg := renderWithFakeBlender(t, RenderRequest{RootSize: "responsive", PreserveAspectRatio: "xMinYMin slice"})
+	root := svgRootPattern.FindString(svg)
+	if !strings.Contains(root, ` viewBox="0 0 1024 1024" preserveAspectRatio="xMinYMin slice"`) {
+		t.Errorf("expected a viewBox root: %s", root)
+	}
+	if attrs := svgRootAttrs([]byte(svg)); attrs["width"] != "" || attrs["height"] != "" {
+		t.Errorf("expected no width or height: %s", root)
+	}
+	if w, h := svgSize([]byte(svg)); w != 1024 || h != 1024 {
+		t.Errorf("size from the viewBox is %gx%g", w, h)
+	}
+}
+
+func TestApplyRootSize(t *testing.T) {
+	svg := `<svg xmlns="http://www.w3.org/2000/svg" height="300" version="1.1" width="400"><path stroke-width="2" /></svg>`
+	if got := string(applyRootSize([]byte(svg), "fixed", "", 0)); got != svg {
+		t.Errorf("expected fixed roots unchanged: %s", got)
+	}
+	got := string(applyRootSize([]byte(svg), "scalable", "none", 0))
+	want := `<svg xmlns="http://www.w3.org/2000/svg" version="1.1" width="400" height="300" viewBox="0 0 400 300" preserveAspectRatio="none"><path stroke-width="2" /></svg>`
+	if got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestRootSizeValidation(t *testing.T) {
+	for _, req := range []RenderRequest{
+		{RootSize: "fluid"},
+		{PreserveAspectRatio: "xMidYMid"},
+		{RootSize: "responsive", PreserveAspectRatio: "center"},
+		{RootSize: "scalable", PreserveAspectRatio: "none slice"},
+	} {
+		if _, err := req.options(); err == nil {
+			t.Errorf("expected an error for %+v", req)
+		}
+	}
+	req := RenderRequest{RootSize: "scalable", PreserveAspectRatio: "xMaxYMid meet"}
+	if _, err := req.options(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+// stepRotation is a parsed `0 ROTSTEP x y z [REL|ADD|ABS]` or
+// `0 ROTSTEP END` meta command. Angles are degrees about the LDraw axes.
+type stepRotation struct {
+	X, Y, Z float64
+	Mode    string
+}
+
+func parseRotStep(args []string) (stepRotation, bool) {
+	if len(args) == 1 && strings.EqualFold(args[0], "END") {
+		return stepRotation{Mode: "END"}, true
+	}
+	if len(args) != 3 && len(args) != 4 {
+		return stepRotation{}, false
+	}
+	var angles [3]float64
+	for i := range angles {
+		v, err := strconv.ParseFloat(args[i], 64)
+		if err != nil {
+			return stepRotation{}, false
+		}
+		angles[i] = v
+	}
+	rot := stepRotation{X: angles[0], Y: angles[1], Z: angles[2], Mode: "REL"}
+	if len(args) == 4 {
+		rot.Mode = strings.ToUpper(args[3])
+		if rot.Mode != "REL" && rot.Mode != "ADD" && rot.Mode != "ABS" {
+			return stepRotation{}, false
+		}
+	}
+	return rot, true
+}
+
+// Render options for every step, with ROTSTEP view changes applied to the
+// camera. A view persists until the next ROTSTEP: REL rotates the default
+// view, ABS rotates the front view, ADD rotates the current view, and END
+// returns to the default view. The camera has no roll, so a rotation that
+// would roll the view only moves the camera position.
+func (m instructionModel) stepViews(opts RenderOptions) []RenderOptions {
+	defaultView := cameraDirection(opts.CameraLatitude, opts.CameraLongitude)
+	frontView := [3]float64{0, 0, -1}
+	view := defaultView
+
+	views := make([]RenderOptions, len(m.steps))
+	for i, step := range m.steps {
+		for _, rot := range step.views {
+			switch rot.Mode {
+			case "END":
+				view = defaultView
+			case "ABS":
+				view = rot.apply(frontView)
+			case "REL":
+				view = rot.apply(defaultView)
+			case "ADD":
+				view = rot.apply(view)
+			}
+		}
+		views[i] = opts
+		views[i].CameraLatitude, views[i].CameraLongitude = cameraAngles(view)
+	}
+	return views
+}
+
+// Rotating the model by R is rotating the camera by R's inverse. R applies
+// the X, then Y, then Z rotation, so the inverse undoes them in reverse.
+func (rot stepRotation) apply(d [3]float64) [3]float64 {
+	d = rotateAxis(d, 2, -rot.Z)
+	d = rotateAxis(d, 1, -rot.Y)
+	return rotateAxis(d, 0, -rot.X)
+}
+
+func rotateAxis(d [3]float64, axis int, degrees float64) [3]float64 {
+	s, c := math.Sincos(degrees * math.Pi / 180)
+	i, j := (axis+1)%3, (axis+2)%3
+	out := d
+	out[i] = d[i]*c - d[j]*s
+	out[j] = d[i]*s + d[j]*c
+	return out
+}
+
+// Camera direction (from the model toward the camera) in LDraw coordinates
+// for the render script's latitude/longitude. The script works in Blender
+// coordinates, where LDraw (x, y, z) is (x, z, -y).
+func cameraDirection(lat, lon float64) [3]float64 {
+	latR, lonR := lat*math.Pi/180, lon*math.Pi/180
+	bx := math.Cos(latR) * math.Sin(lonR)
+	by := -math.Cos(latR) * math.Cos(lonR)
+	bz := math.Sin(latR)
+	return [3]float64{bx, -bz, by}
+}
+
+func cameraAngles(d [3]float64) (float64, float64) {
+	bx, by, bz := d[0], d[2], -d[1]
+	n := math.Sqrt(bx*bx + by*by + bz*bz)
+	lat := math.Asin(math.Max(-1, math.Min(1, bz/n))) * 180 / math.Pi
+	lon := 0.0
+	if math.Abs(bx) > 1e-9 || math.Abs(by) > 1e-9 {
+		lon = math.Atan2(bx, -by) * 180 / math.Pi
+	}
+	return roundAngle(lat), roundAngle(lon)
+}
+
+// Round away float noise so that e.g. a 90° turn renders at exactly 90°
+func roundAngle(a float64) float64 {
+	a = math.Round(a*1e6) / 1e6
+	if a == 0 {
+		return 0
+	}
+	return a
+}
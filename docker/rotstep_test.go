@@ -0,0 +1,79 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestParseRotStep(t *testing.T) {
+	tests := []struct {
+		args []string
+		want stepRotation
+		ok   bool
+	}{
+		{[]string{"END"}, stepRotation{Mode: "END"}, true},
+		{[]string{"10", "20", "30"}, stepRotation{10, 20, 30, "REL"}, true},
+		{[]string{"0", "-90", "0", "abs"}, stepRotation{0, -90, 0, "ABS"}, true},
+		{[]string{"0", "45", "0", "ADD"}, stepRotation{0, 45, 0, "ADD"}, true},
+		{[]string{"0", "45"}, stepRotation{}, false},
+		{[]string{"0", "x", "0"}, stepRotation{}, false},
+		{[]string{"0", "0", "0", "SPIN"}, stepRotation{}, false},
+	}
+	for _, tt := range tests {
+		got, ok := parseRotStep(tt.args)
+		if ok != tt.ok || got != tt.want {
+			t.Errorf("parseRotStep(%v) = %+v, %t; want %+v, %t", tt.args, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestCameraAnglesRoundTrip(t *testing.T) {
+	for _, c := range [][2]float64{{30, 45}, {0, 0}, {-45, 120}, {60, -170}} {
+		lat, lon := cameraAngles(cameraDirection(c[0], c[1]))
+		if math.Abs(lat-c[0]) > 1e-6 || math.Abs(lon-c[1]) > 1e-6 {
+			t.Errorf("round trip of %v gave %g/%g", c, lat, lon)
+		}
+	}
+}
+
+func TestStepViews(t *testing.T) {
+	// ROTSTEP ends the step before it and sets that step's view
+	model := parseSteps([]byte(`1 4 0 0 0 1 0 0 0 1 0 0 0 1 3001.dat
+0 STEP
+1 4 0 -24 0 1 0 0 0 1 0 0 0 1 3001.dat
+0 ROTSTEP 0 0 0 ABS
+1 4 0 -48 0 1 0 0 0 1 0 0 0 1 3001.dat
+0 ROTSTEP 0 90 0 ABS
+1 4 0 -72 0 1 0 0 0 1 0 0 0 1 3001.dat
+0 STEP
+0 ROTSTEP 0 0 0 ABS
+1 4 0 -96 0 1 0 0 0 1 0 0 0 1 3001.dat
+0 ROTSTEP 0 45 0 ADD
+1 4 0 -120 0 1 0 0 0 1 0 0 0 1 3001.dat
+0 ROTSTEP 0 45 0 ADD
+1 4 0 -144 0 1 0 0 0 1 0 0 0 1 3001.dat
+0 ROTSTEP END
+`))
+	req := RenderRequest{}
+	opts, _ := req.options()
+	views := model.stepViews(opts)
+
+	want := [][2]float64{
+		{30, 45}, // default view
+		{0, 0},   // front
+		{0, 90},  // side
+		{0, 90},  // view persists across STEP
+		{0, 45},  // ABS from an empty step, then ADD
+		{0, 90},  // ADD accumulates
+		{30, 45}, // END
+	}
+	if len(views) != len(want) {
+		t.Fatalf("expected %d steps, got %d", len(want), len(views))
+	}
+	for i, w := range want {
+		lat, lon := views[i].CameraLatitude, math.Abs(views[i].CameraLongitude)
+		if math.Abs(lat-w[0]) > 1e-6 || math.Abs(lon-w[1]) > 1e-6 {
+			t.Errorf("step %d: got %g/%g, want %g/±%g", i+1, views[i].CameraLatitude, views[i].CameraLongitude, w[0], w[1])
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// Blender runs Python and reads whatever LDraw file it's given, so it can
+// be confined. BLENDER_UID (and BLENDER_GID, default the same) run it as
+// another user. BLENDER_SANDBOX=bwrap also runs it under bubblewrap with no
+// network, a read-only view of the system, the LDraw library, the render
+// script and addons, and a tmpfs /tmp holding only the render's workspace.
+// Either way each render gets its own workspace directory, and input files
+// from outside the library (uploaded models, ghost and objects files) are
+// copied into it so the sandboxed user can read them.
+var (
+	blenderSandbox = getEnv("BLENDER_SANDBOX", "")
+	bwrapBin       = getEnv("BWRAP_BIN", "bwrap")
+	blenderUID     = getEnvInt("BLENDER_UID", -1)
+	blenderGID     = getEnvInt("BLENDER_GID", -1)
+)
+
+func sandboxed() bool {
+	return blenderSandbox != "" || blenderUID >= 0
+}
+
+// Check the sandbox configuration at startup
+func validateSandbox() error {
+	switch blenderSandbox {
+	case "":
+	case "bwrap":
+		if _, err := exec.LookPath(bwrapBin); err != nil {
+			return fmt.Errorf("BLENDER_SANDBOX=bwrap but %s is not installed: %w", bwrapBin, err)
+		}
+	default:
+		return fmt.Errorf("unknown BLENDER_SANDBOX %q (want bwrap or empty)", blenderSandbox)
+	}
+	if blenderUID >= 0 && os.Geteuid() != 0 {
+		return fmt.Errorf("BLENDER_UID needs the server to run as root")
+	}
+	return nil
+}
+
+// A render's private working directory
+type blenderWorkspace struct {
+	dir string
+	// Paths Blender is given, which may be copies inside dir
+	input, ghost, objects, plugin, output string
+	// Where the script writes face shading, the toon raster, the
+	// occlusion pass, and the camera framing when asked to
+	shading, raster, occlusion, frame string
+}
+
+func newBlenderWorkspace(inputFile, ghostFile, objectsFile, pluginFile string) (*blenderWorkspace, error) {
+	dir, err := os.MkdirTemp("", "render-*")
+	if err != nil {
+		return nil, err
+	}
+	ws := &blenderWorkspace{dir: dir, input: inputFile, ghost: ghostFile, objects: objectsFile, plugin: pluginFile,
+		output: filepath.Join(dir, "render.svg"), shading: filepath.Join(dir, "shading.json"),
+		raster: filepath.Join(dir, "raster.png"), occlusion: filepath.Join(dir, "occlusion.png"),
+		frame: filepath.Join(dir, "frame.json")}
+	if !sandboxed() {
+		return ws, nil
+	}
+
+	if ws.input, err = ws.stage(inputFile, "input"); err == nil {
+		ws.ghost, err = ws.stage(ghostFile, "ghost")
+	}
+	if err == nil {
+		ws.objects, err = ws.stage(objectsFile, "objects")
+	}
+	if err == nil {
+		ws.plugin, err = ws.stage(pluginFile, "plugin")
+	}
+	if err == nil && blenderUID >= 0 {
+		gid := blenderGID
+		if gid < 0 {
+			gid = blenderUID
+		}
+		err = filepath.Walk(dir, func(path string, _ os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			return os.Lchown(path, blenderUID, gid)
+		})
+	}
+	if err != nil {
+		ws.remove()
+		return nil, err
+	}
+	return ws, nil
+}
+
+// Copy a file from outside the LDraw libraries into the workspace, keeping
+// its extension (the importer goes by it)
+func (ws *blenderWorkspace) stage(path, name string) (string, error) {
+	if path == "" || insideDir(ldrawPath, path) || ldrawLibraries != "" && insideDir(ldrawLibraries, path) {
+		return path, nil
+	}
+	src, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	staged := filepath.Join(ws.dir, name+filepath.Ext(path))
+	dst, err := os.OpenFile(staged, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return "", err
+	}
+	return staged, dst.Close()
+}
+
+func (ws *blenderWorkspace) remove() {
+	os.RemoveAll(ws.dir)
+}
+
+// Whether path is dir or inside it, after resolving symlinks
+func insideDir(dir, path string) bool {
+	resolve := func(p string) string {
+		if abs, err := filepath.Abs(p); err == nil {
+			p = abs
+		}
+		if real, err := filepath.EvalSymlinks(p); err == nil {
+			p = real
+		}
+		return p
+	}
+	rel, err := filepath.Rel(resolve(dir), resolve(path))
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// The command that runs Blender with args in a workspace, sandboxed as
+// configured
+func blenderCommand(ctx context.Context, ws *blenderWorkspace, args []string) *exec.Cmd {
+	var cmd *exec.Cmd
+	if blenderSandbox == "bwrap" {
+		cmd = exec.CommandContext(ctx, bwrapBin, append(bwrapArgs(ws), args...)...)
+	} else {
+		cmd = exec.CommandContext(ctx, blenderBin, args...)
+	}
+	if sandboxed() {
+		cmd.Dir = ws.dir
+		cmd.Env = blenderEnv(ws)
+	}
+	if blenderUID >= 0 {
+		gid := blenderGID
+		if gid < 0 {
+			gid = blenderUID
+		}
+		cmd.SysProcAttr = &syscall.SysProcAttr{Credential: &syscall.Credential{Uid: uint32(blenderUID), Gid: uint32(gid)}}
+	}
+	return cmd
+}
+
+// The only variables a sandboxed Blender sees, so the server's secrets
+// (URL_SIGNING_KEY, ADMIN_TOKEN, storage credentials) stay out of it
+var blenderEnvAllowed = []string{
+	"PATH", "LANG", "LC_ALL", "TZ",
+	"BLENDER_USER_SCRIPTS", "BLENDER_SYSTEM_SCRIPTS", "BLENDER_SYSTEM_DATAFILES", "LDRAW_PATH",
+}
+
+// A sandboxed Blender's environment: the allowed variables that are set,
+// with HOME the workspace
+func blenderEnv(ws *blenderWorkspace) []string {
+	env := []string{"HOME=" + ws.dir}
+	for _, name := range blenderEnvAllowed {
+		if v, ok := os.LookupEnv(name); ok {
+			env = append(env, name+"="+v)
+		}
+	}
+	return env
+}
+
+// bubblewrap arguments up to and including the Blender executable
+func bwrapArgs(ws *blenderWorkspace) []string {
+	bin := blenderBin
+	if path, err := exec.LookPath(blenderBin); err == nil {
+		bin, _ = filepath.Abs(path)
+	}
+	args := []string{
+		"--die-with-parent",
+		"--new-session",
+		"--unshare-all",
+		"--ro-bind", "/usr", "/usr",
+	}
+	for _, dir := range []string{"/bin", "/sbin", "/lib", "/lib32", "/lib64", "/etc", "/opt"} {
+		args = append(args, "--ro-bind-try", dir, dir)
+	}
+	args = append(args,
+		"--proc", "/proc",
+		"--dev", "/dev",
+		"--tmpfs", "/tmp",
+		"--ro-bind", filepath.Dir(bin), filepath.Dir(bin),
+		"--ro-bind", ldrawPath, ldrawPath,
+		"--ro-bind", renderScript, renderScript,
+	)
+	if ldrawLibraries != "" {
+		args = append(args, "--ro-bind-try", ldrawLibraries, ldrawLibraries)
+	}
+	if scripts := os.Getenv("BLENDER_USER_SCRIPTS"); scripts != "" {
+		args = append(args, "--ro-bind-try", scripts, scripts)
+	}
+	return append(args,
+		"--bind", ws.dir, ws.dir,
+		"--setenv", "HOME", ws.dir,
+		"--chdir", ws.dir,
+		"--",
+		bin,
+	)
+}
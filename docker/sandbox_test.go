@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func withSandbox(t *testing.T, mode string, uid int) {
+	t.Helper()
+	oldMode, oldUID, oldGID := blenderSandbox, blenderUID, blenderGID
+	blenderSandbox, blenderUID, blenderGID = mode, uid, -1
+	t.Cleanup(func() { blenderSandbox, blenderUID, blenderGID = oldMode, oldUID, oldGID })
+}
+
+func TestInsideDir(t *testing.T) {
+	root := t.TempDir()
+	lib := filepath.Join(root, "ldraw")
+	os.MkdirAll(filepath.Join(lib, "parts"), 0o755)
+	os.Symlink("/etc", filepath.Join(lib, "parts", "escape"))
+
+	for path, want := range map[string]bool{
+		lib:                                     true,
+		filepath.Join(lib, "parts", "3001.dat"): true,
+		filepath.Join(lib, "..", "secret"):      false,
+		filepath.Join(root, "ldraw-other", "x"): false,
+		filepath.Join(lib, "parts", "escape"):   false,
+		filepath.Join(lib, "parts", "..", "p"):  true,
+		"/etc/passwd":                           false,
+	} {
+		if got := insideDir(lib, path); got != want {
+			t.Errorf("insideDir(%q): got %v, want %v", path, got, want)
+		}
+	}
+}
+
+func TestBlenderWorkspaceStagesInputs(t *testing.T) {
+	lib := withTestLibrary(t, map[string]string{"3001": "0 Brick 2 x 4\n"})
+	withSandbox(t, "bwrap", os.Getuid())
+	old := ldrawPath
+	ldrawPath = lib
+	t.Cleanup(func() { ldrawPath = old })
+
+	upload := filepath.Join(t.TempDir(), "model.mpd")
+	os.WriteFile(upload, []byte("0 FILE main.ldr\n"), 0o600)
+	part := filepath.Join(lib, "parts", "3001.dat")
+
+	ws, err := newBlenderWorkspace(upload, part, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.remove()
+	if ws.input != filepath.Join(ws.dir, "input.mpd") {
+		t.Errorf("uploaded model should be copied into the workspace, got %s", ws.input)
+	}
+	if data, _ := os.ReadFile(ws.input); string(data) != "0 FILE main.ldr\n" {
+		t.Errorf("staged copy has %q", data)
+	}
+	if ws.ghost != part {
+		t.Errorf("library files should be used in place, got %s", ws.ghost)
+	}
+	if filepath.Dir(ws.output) != ws.dir {
+		t.Errorf("output %s is outside the workspace", ws.output)
+	}
+
+	ws.remove()
+	if _, err := os.Stat(ws.dir); !os.IsNotExist(err) {
+		t.Error("workspace should be removed")
+	}
+}
+
+func TestBwrapArgs(t *testing.T) {
+	withSandbox(t, "bwrap", -1)
+	ws := &blenderWorkspace{dir: "/tmp/render-1"}
+	args := bwrapArgs(ws)
+	joined := strings.Join(args, " ")
+	for _, want := range []string{
+		"--unshare-all",
+		"--die-with-parent",
+		"--tmpfs /tmp",
+		"--ro-bind " + ldrawPath + " " + ldrawPath,
+		"--ro-bind " + renderScript + " " + renderScript,
+		"--bind /tmp/render-1 /tmp/render-1",
+		"--chdir /tmp/render-1",
+	} {
+		if !strings.Contains(joined, want) {
+			t.Errorf("missing %q in %s", want, joined)
+		}
+	}
+	if i := slices.Index(args, "--"); i != len(args)-2 {
+		t.Errorf("expected the Blender binary right after --, got %v", args[i:])
+	}
+	if slices.Contains(args, "--share-net") {
+		t.Error("the sandbox must not have network access")
+	}
+}
+
+func TestBlenderCommandRunsAsUser(t *testing.T) {
+	withSandbox(t, "", 1234)
+	ws := &blenderWorkspace{dir: t.TempDir()}
+	cmd := blenderCommand(context.Background(), ws, []string{"--version"})
+	if cmd.SysProcAttr == nil || cmd.SysProcAttr.Credential.Uid != 1234 || cmd.SysProcAttr.Credential.Gid != 1234 {
+		t.Errorf("expected uid and gid 1234, got %+v", cmd.SysProcAttr)
+	}
+	if cmd.Dir != ws.dir || !slices.Contains(cmd.Env, "HOME="+ws.dir) {
+		t.Errorf("expected Blender to run in and with HOME set to the workspace")
+	}
+}
+
+func TestBlenderCommandEnv(t *testing.T) {
+	withSandbox(t, "", 1234)
+	secrets := []string{"URL_SIGNING_KEY", "ADMIN_TOKEN", "AWS_SECRET_ACCESS_KEY", "REBRICKABLE_API_KEY", "WEBHOOK_SECRET"}
+	for _, name := range secrets {
+		t.Setenv(name, "secret")
+	}
+	t.Setenv("BLENDER_USER_SCRIPTS", "/opt/blender/scripts")
+	ws := &blenderWorkspace{dir: t.TempDir()}
+	cmd := blenderCommand(context.Background(), ws, []string{"--version"})
+	for _, kv := range cmd.Env {
+		name, _, _ := strings.Cut(kv, "=")
+		if slices.Contains(secrets, name) {
+			t.Errorf("%s reached the sandboxed Blender", name)
+		}
+	}
+	if !slices.Contains(cmd.Env, "BLENDER_USER_SCRIPTS=/opt/blender/scripts") || !slices.Contains(cmd.Env, "PATH="+os.Getenv("PATH")) {
+		t.Errorf("expected PATH and BLENDER_USER_SCRIPTS passed through, got %v", cmd.Env)
+	}
+}
+
+func TestValidateSandbox(t *testing.T) {
+	withSandbox(t, "docker", -1)
+	if validateSandbox() == nil {
+		t.Error("unknown sandbox mode should be rejected")
+	}
+	old := bwrapBin
+	bwrapBin = "definitely-not-bwrap"
+	t.Cleanup(func() { bwrapBin = old })
+	withSandbox(t, "bwrap", -1)
+	if validateSandbox() == nil {
+		t.Error("missing bwrap should be rejected")
+	}
+	withSandbox(t, "", -1)
+	if err := validateSandbox(); err != nil {
+		t.Errorf("no sandbox should be valid, got %v", err)
+	}
+}
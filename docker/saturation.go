@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// Saturation signals for autoscaling: how much work is waiting, how much
+// is running, and how many requests were turned away for lack of capacity.
+// Queue depths and active renders are read when /metrics is scraped;
+// rejections are counted as they happen.
+
+// Why a request was turned away: a key's concurrency limit or monthly
+// quota, a full prewarm queue, an unreachable job queue, or a dispatcher
+// with no workers
+var rejectionReasons = []string{"concurrency", "quota", "queue_full", "queue_unavailable", "no_workers"}
+
+// The queues work waits in: prewarm renders, jobs this node submitted to
+// the job queue, and renders waiting for a dispatcher worker
+var queueNames = []string{"prewarm", "jobs", "dispatch"}
+
+type SaturationMetrics struct {
+	QueueDepth map[string]int `json:"queue_depth"`
+	// Blender renders running on this node, interactive and prewarm
+	ActiveRenders int64 `json:"active_renders"`
+	// Workers registered with this node's dispatcher, and those rendering
+	DispatchWorkers     *int `json:"dispatch_workers,omitempty"`
+	DispatchWorkersBusy *int `json:"dispatch_workers_busy,omitempty"`
+}
+
+// Record a request rejected for lack of capacity
+func recordRejected(reason string) {
+	metrics.Lock()
+	metrics.Rejected[reason]++
+	metrics.Unlock()
+
+	for _, s := range metricsSinks {
+		s.Count("requests_rejected", 1, "reason:"+reason)
+	}
+}
+
+// Record how long a queued job or dispatched render waited for a worker
+func recordJobQueueWait(d time.Duration) {
+	metrics.Lock()
+	metrics.JobQueueWait.observe(d.Seconds())
+	metrics.Unlock()
+
+	for _, s := range metricsSinks {
+		s.Timing("job_queue_wait", d)
+	}
+}
+
+// The current queue depths and active renders. Callers must not hold the
+// metrics lock: the jobs and dispatcher locks are taken while it's held
+// elsewhere.
+func saturation() SaturationMetrics {
+	s := SaturationMetrics{
+		QueueDepth:    map[string]int{"prewarm": len(prewarmQueue), "jobs": 0, "dispatch": 0},
+		ActiveRenders: foregroundRenders.Load(),
+	}
+	if prewarmBusy.Load() {
+		s.ActiveRenders++
+	}
+
+	jobs.Lock()
+	for _, job := range jobs.byID {
+		if job.Status == jobQueued {
+			s.QueueDepth["jobs"]++
+		}
+	}
+	jobs.Unlock()
+
+	if d := activeDispatcher; d != nil {
+		d.mu.Lock()
+		workers, busy := len(d.workers), 0
+		for _, w := range d.workers {
+			if len(w.assigned) > 0 {
+				busy++
+			}
+		}
+		s.QueueDepth["dispatch"] = len(d.pending)
+		d.mu.Unlock()
+		s.DispatchWorkers, s.DispatchWorkersBusy = &workers, &busy
+	}
+	return s
+}
+
+// Write saturation metrics in the Prometheus text exposition format.
+// Callers hold the metrics read lock.
+func (s SaturationMetrics) writePrometheus(w io.Writer, rejected map[string]int64) {
+	fmt.Fprintf(w, "# HELP lego_renderer_queue_depth Work waiting in each queue.\n")
+	fmt.Fprintf(w, "# TYPE lego_renderer_queue_depth gauge\n")
+	for _, q := range queueNames {
+		fmt.Fprintf(w, "lego_renderer_queue_depth{queue=\"%s\"} %d\n", q, s.QueueDepth[q])
+	}
+	fmt.Fprintf(w, "# HELP lego_renderer_active_renders Blender renders running on this node.\n")
+	fmt.Fprintf(w, "# TYPE lego_renderer_active_renders gauge\n")
+	fmt.Fprintf(w, "lego_renderer_active_renders %d\n", s.ActiveRenders)
+	if s.DispatchWorkers != nil {
+		fmt.Fprintf(w, "# HELP lego_renderer_dispatch_workers Workers registered with the dispatcher.\n")
+		fmt.Fprintf(w, "# TYPE lego_renderer_dispatch_workers gauge\n")
+		fmt.Fprintf(w, "lego_renderer_dispatch_workers %d\n", *s.DispatchWorkers)
+		fmt.Fprintf(w, "# HELP lego_renderer_dispatch_workers_busy Dispatcher workers with renders assigned.\n")
+		fmt.Fprintf(w, "# TYPE lego_renderer_dispatch_workers_busy gauge\n")
+		fmt.Fprintf(w, "lego_renderer_dispatch_workers_busy %d\n", *s.DispatchWorkersBusy)
+	}
+	fmt.Fprintf(w, "# HELP lego_renderer_requests_rejected_total Requests turned away for lack of capacity, by reason.\n")
+	fmt.Fprintf(w, "# TYPE lego_renderer_requests_rejected_total counter\n")
+	for _, reason := range rejectionReasons {
+		fmt.Fprintf(w, "lego_renderer_requests_rejected_total{reason=\"%s\"} %d\n", reason, rejected[reason])
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSaturationQueueDepth(t *testing.T) {
+	jobs.Lock()
+	jobs.byID["saturation-queued"] = &queuedJob{JobStatus: JobStatus{Status: jobQueued}}
+	jobs.byID["saturation-running"] = &queuedJob{JobStatus: JobStatus{Status: jobRunning}}
+	jobs.Unlock()
+	t.Cleanup(func() {
+		jobs.Lock()
+		delete(jobs.byID, "saturation-queued")
+		delete(jobs.byID, "saturation-running")
+		jobs.Unlock()
+	})
+
+	s := saturation()
+	if s.QueueDepth["jobs"] != 1 || s.QueueDepth["dispatch"] != 0 {
+		t.Errorf("unexpected queue depths %v", s.QueueDepth)
+	}
+	if s.DispatchWorkers != nil {
+		t.Errorf("expected no dispatcher workers without a dispatcher, got %d", *s.DispatchWorkers)
+	}
+
+	d, _ := withDispatcher(t)
+	d.register("w1", 1)
+	s = saturation()
+	if s.DispatchWorkers == nil || *s.DispatchWorkers != 1 || *s.DispatchWorkersBusy != 0 {
+		t.Errorf("unexpected dispatcher workers %+v", s)
+	}
+}
+
+func TestRequestsRejected(t *testing.T) {
+	d, _ := withDispatcher(t)
+	before := rejectedCount("no_workers")
+	_, _, err := d.render(context.Background(), "3001", RenderOptions{})
+	if err == nil {
+		t.Fatal("expected a render without workers to fail")
+	}
+	if n := rejectedCount("no_workers"); n != before+1 {
+		t.Errorf("expected %d no_workers rejections, got %d", before+1, n)
+	}
+
+	w := httptest.NewRecorder()
+	handleMetrics(w, httptest.NewRequest(http.MethodGet, "/metrics?format=prometheus", nil))
+	for _, line := range []string{
+		"# TYPE lego_renderer_queue_depth gauge",
+		`lego_renderer_queue_depth{queue="prewarm"} `,
+		"# TYPE lego_renderer_active_renders gauge",
+		"lego_renderer_dispatch_workers 0",
+		`lego_renderer_requests_rejected_total{reason="quota"} `,
+		"# TYPE lego_renderer_job_queue_wait_seconds histogram",
+	} {
+		if !strings.Contains(w.Body.String(), line) {
+			t.Errorf("Prometheus output is missing %q", line)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	handleMetrics(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	var resp MetricsResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.RequestsRejected["no_workers"] != before+1 || len(resp.RequestsRejected) != len(rejectionReasons) {
+		t.Errorf("unexpected rejections %v", resp.RequestsRejected)
+	}
+	if len(resp.QueueDepth) != len(queueNames) {
+		t.Errorf("unexpected queue depths %v", resp.QueueDepth)
+	}
+}
+
+func rejectedCount(reason string) int64 {
+	metrics.RLock()
+	defer metrics.RUnlock()
+	return metrics.Rejected[reason]
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Scenes place library parts without an MPD file: POST /render/scene
+// takes the parts with their colors and transforms, writes them as the
+// type 1 lines of an LDraw model, and renders that like /render/model.
+const (
+	sceneMaxParts = 100
+	// Positions are in LDraw units; a 48 x 48 baseplate is 960 across
+	sceneMaxOffset = 100000
+	// Parts without a color of their own in a scene that colors some
+	sceneDefaultColor = 15
+)
+
+// SceneRequest is the body of /render/scene: the /render options (without
+// partNumber) plus the parts to place
+type SceneRequest struct {
+	RenderRequest
+	Parts []ScenePart `json:"parts"`
+}
+
+// ScenePart places a library part. Position is in LDraw units on LDraw's
+// axes (-Y is up), and Rotation is in degrees about X, then Y, then Z.
+type ScenePart struct {
+	PartNumber string     `json:"partNumber"`
+	Color      *int       `json:"color"`
+	Position   [3]float64 `json:"position"`
+	Rotation   [3]float64 `json:"rotation"`
+}
+
+// Scene render endpoint: render library parts placed together as one model
+func handleRenderScene(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		sendError(w, http.StatusMethodNotAllowed, "Method not allowed", "")
+		return
+	}
+
+	var req SceneRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	var errs fieldErrors
+	if req.PartNumber != "" {
+		errs.add("partNumber", "scenes place parts with parts[].partNumber")
+	}
+	if len(req.Parts) == 0 || len(req.Parts) > sceneMaxParts {
+		errs.add("parts", "parts must list 1 to %d parts", sceneMaxParts)
+	}
+	opts, err := req.options()
+	errs.merge("", err)
+	format, dpi, err := req.output(opts)
+	errs.merge("", err)
+	errs.merge("", validateSceneParts(req.Parts))
+	if err := errs.err(); err != nil {
+		sendValidationError(w, err)
+		return
+	}
+
+	model, colored, err := buildSceneModel(req.Parts, req.Color)
+	if err != nil {
+		sendRenderError(w, err)
+		return
+	}
+	if colored {
+		opts.FillMode = "ldraw"
+	}
+	// The parts are where the caller put them
+	opts.Normalize = "off"
+
+	modelFile, _, _, cleanup, err := writeModelFile(model, nil)
+	if err != nil {
+		recordError()
+		sendError(w, http.StatusInternalServerError, "Failed to write model", err.Error())
+		return
+	}
+	defer cleanup()
+
+	label := fmt.Sprintf("scene of %d parts", len(req.Parts))
+	start := time.Now()
+	svgContent, renderDuration, err := renderFile(r.Context(), label, modelFile, opts)
+	if err != nil {
+		sendRenderError(w, err)
+		return
+	}
+	log.Printf("Total request duration: %.2fs", time.Since(start).Seconds())
+	if opts.Metadata {
+		svgContent = embedSVGMetadata(svgContent, renderMetadata(label, opts))
+	}
+
+	w.Header().Set("X-Render-Duration", fmt.Sprintf("%.2fs", renderDuration.Seconds()))
+	if format == "png" {
+		png, err := rasterizeRender(r.Context(), label, svgContent, opts, dpi)
+		if err != nil {
+			sendRenderError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(png)
+		return
+	}
+	w.Header().Set("Content-Type", "image/svg+xml")
+	writeSVG(w, r, svgContent)
+}
+
+func validateSceneParts(parts []ScenePart) error {
+	var errs fieldErrors
+	for i, p := range parts {
+		field := fmt.Sprintf("parts[%d]", i)
+		if _, ok := cleanPartNumber(p.PartNumber); !ok {
+			errs.add(field+".partNumber", "%q is not an LDraw part number", p.PartNumber)
+		}
+		if p.Color != nil {
+			if _, ok := lookupColor(*p.Color); !ok {
+				errs.add(field+".color", "%d is not a known LDraw color code", *p.Color)
+			}
+		}
+		for _, v := range p.Position {
+			if math.Abs(v) > sceneMaxOffset {
+				errs.add(field+".position", "position must be within %d LDU of the origin", sceneMaxOffset)
+				break
+			}
+		}
+	}
+	return errs.err()
+}
+
+// Write a scene's parts as an LDraw model, reporting whether any has a
+// color of its own. Parts without one take the request's color, or white,
+// when some are colored, and the main color (16) otherwise.
+func buildSceneModel(parts []ScenePart, color *int) ([]byte, bool, error) {
+	colored := false
+	for _, p := range parts {
+		colored = colored || p.Color != nil
+	}
+	var b strings.Builder
+	b.WriteString("0 Scene\n0 Name: scene.ldr\n")
+	for _, p := range parts {
+		ref, err := scenePartReference(p.PartNumber)
+		if err != nil {
+			return nil, false, err
+		}
+		code := 16
+		switch {
+		case p.Color != nil:
+			code = *p.Color
+		case colored && color != nil:
+			code = *color
+		case colored:
+			code = sceneDefaultColor
+		}
+		m := rotationMatrix(p.Rotation)
+		fmt.Fprintf(&b, "1 %d %s %s %s", code, ldrawNumber(p.Position[0]), ldrawNumber(p.Position[1]), ldrawNumber(p.Position[2]))
+		for _, v := range m {
+			b.WriteString(" " + ldrawNumber(v))
+		}
+		b.WriteString(" " + ref + "\n")
+	}
+	return []byte(b.String()), colored, nil
+}
+
+// The subfile reference for a library part, as LDraw writes it
+// ("3001.dat", "s\3001s01.dat")
+func scenePartReference(partNumber string) (string, error) {
+	path := findPartFile(partNumber)
+	if path == "" {
+		return "", &RenderError{http.StatusNotFound, "Part not found", fmt.Sprintf("Part %s not found in LDraw library", partNumber)}
+	}
+	for _, dir := range []string{"parts", "p"} {
+		if rel, err := filepath.Rel(filepath.Join(ldrawPath, dir), path); err == nil && !strings.HasPrefix(rel, "..") {
+			return strings.ReplaceAll(filepath.ToSlash(rel), "/", `\`), nil
+		}
+	}
+	return filepath.Base(path), nil
+}
+
+// The row-major rotation matrix for rotations in degrees about X, then Y,
+// then Z
+func rotationMatrix(degrees [3]float64) [9]float64 {
+	sx, cx := math.Sincos(degrees[0] * math.Pi / 180)
+	sy, cy := math.Sincos(degrees[1] * math.Pi / 180)
+	sz, cz := math.Sincos(degrees[2] * math.Pi / 180)
+	// Rz * Ry * Rx
+	return [9]float64{
+		cz * cy, cz*sy*sx - sz*cx, cz*sy*cx + sz*sx,
+		sz * cy, sz*sy*sx + cz*cx, sz*sy*cx - cz*sx,
+		-sy, cy * sx, cy * cx,
+	}
+}
+
+// A number for an LDraw line, rounded past floating-point noise
+func ldrawNumber(v float64) string {
+	s := strconv.FormatFloat(math.Round(v*1e6)/1e6, 'f', -1, 64)
+	if s == "-0" {
+		s = "0"
+	}
+	return s
+}
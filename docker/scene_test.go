@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBuildSceneModel(t *testing.T) {
+	dir := withTestLibrary(t, map[string]string{"3001": "0 Brick 2 x 4\n", "s/3001s01": "0 ~Brick 2 x 4 Subpart\n"})
+	os.WriteFile(filepath.Join(dir, "p", "stud.dat"), []byte("0 Stud\n"), 0o644)
+	red := 4
+	model, colored, err := buildSceneModel([]ScenePart{
+		{PartNumber: "3001", Color: &red, Position: [3]float64{0, -24, 0}},
+		{PartNumber: "s/3001s01", Rotation: [3]float64{0, 90, 0}},
+		{PartNumber: "stud", Position: [3]float64{40, 0, -10}, Rotation: [3]float64{0, 0, 180}},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"1 4 0 -24 0 1 0 0 0 1 0 0 0 1 3001.dat",
+		`1 15 0 0 0 0 0 1 0 1 0 -1 0 0 s\3001s01.dat`,
+		"1 15 40 0 -10 -1 0 0 0 -1 0 0 0 1 stud.dat",
+	}
+	for _, line := range want {
+		if !strings.Contains(string(model), line+"\n") {
+			t.Errorf("missing %q in:\n%s", line, model)
+		}
+	}
+	if !colored {
+		t.Error("expected the scene reported as colored")
+	}
+
+	model, colored, _ = buildSceneModel([]ScenePart{{PartNumber: "3001"}}, nil)
+	if colored || !strings.Contains(string(model), "1 16 0 0 0 ") {
+		t.Errorf("expected uncolored scenes in the main color:\n%s", model)
+	}
+}
+
+func TestRenderScene(t *testing.T) {
+	withFakeBlender(t)
+	withTestLibrary(t, map[string]string{"3001": "0 Brick 2 x 4\n", "3003": "0 Brick 2 x 2\n"})
+
+	for _, tt := range []struct {
+		body   string
+		status int
+	}{
+		{`{"parts":[{"partNumber":"3001"},{"partNumber":"3003","color":4,"position":[0,-24,0],"rotation":[0,45,0]}]}`, http.StatusOK},
+		{`{"parts":[{"partNumber":"3001"},{"partNumber":"9999"}]}`, http.StatusNotFound},
+		{`{"parts":[]}`, http.StatusBadRequest},
+		{`{"partNumber":"3001","parts":[{"partNumber":"3001"}]}`, http.StatusBadRequest},
+		{`{"parts":[{"partNumber":"3001","color":9999}]}`, http.StatusBadRequest},
+		{`{"parts":[{"partNumber":"3001","position":[0,0,1e9]}]}`, http.StatusBadRequest},
+	} {
+		w := httptest.NewRecorder()
+		routes().ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/render/scene", strings.NewReader(tt.body)))
+		if w.Code != tt.status {
+			t.Errorf("%s: status %d, want %d: %s", tt.body, w.Code, tt.status, w.Body.String())
+		}
+		if w.Code == http.StatusOK && !strings.Contains(w.Body.String(), "<svg") {
+			t.Errorf("expected an SVG, got %s", w.Body.String())
+		}
+	}
+}
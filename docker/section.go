@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strings"
+)
+
+// A request's sectionPlane cuts the model away on one side of a plane, for
+// the insides exterior views hide: Technic pin holes, anti-stud tubes,
+// hollow studs. render_part.py caps the cut and marks the cut faces' fills
+// data-section="1"; the server hatches them like an engineering section.
+// The plane is on the LDraw axes of the model as framed, after orientation
+// normalization, transform, and mirror; its normal points at the side cut
+// away, usually toward the camera.
+type SectionPlane struct {
+	Origin [3]float64 `json:"origin"`
+	Normal [3]float64 `json:"normal"`
+}
+
+// The fills render_part.py marks as cut faces
+var svgSectionFillPattern = regexp.MustCompile(`<path\b[^>]*\sdata-section="1"[^>]*>`)
+
+// Check a section plane and copy it into opts, with a unit normal
+func (p *SectionPlane) apply(opts *RenderOptions) error {
+	var errs fieldErrors
+	for _, v := range p.Origin {
+		if math.IsNaN(v) || math.Abs(v) > sceneMaxOffset {
+			errs.add("origin", "origin must be within %d LDU of the origin", sceneMaxOffset)
+			break
+		}
+	}
+	length := math.Sqrt(p.Normal[0]*p.Normal[0] + p.Normal[1]*p.Normal[1] + p.Normal[2]*p.Normal[2])
+	if !(length > 1e-9) || math.IsInf(length, 0) {
+		errs.add("normal", "normal must be a nonzero vector")
+	}
+	if err := errs.err(); err != nil {
+		return err
+	}
+	values := make([]string, 0, 6)
+	for _, v := range p.Origin {
+		values = append(values, ldrawNumber(v))
+	}
+	for _, v := range p.Normal {
+		values = append(values, ldrawNumber(v/length))
+	}
+	opts.SectionPlane = strings.Join(values, ",")
+	return nil
+}
+
+// The section_plane argument render_part.py takes: origin and normal, or
+// none
+func scriptSectionPlane(plane string) string {
+	if plane == "" {
+		return "none"
+	}
+	return plane
+}
+
+// Hatch a sectioned render's cut faces: their fill under diagonal lines in
+// the stroke color, like the hatching's first band, at 45 degrees the
+// other way so the two read apart
+func applySectionHatch(svg []byte, opts RenderOptions) []byte {
+	if opts.SectionPlane == "" {
+		return svg
+	}
+	root := svgRootPattern.FindIndex(svg)
+	if root == nil || !svgSectionFillPattern.Match(svg) {
+		return svg
+	}
+	id := "section-" + colorID(opts.FillColor) + "-" + colorID(opts.StrokeColor)
+	spacing := math.Max(4, 3*opts.Thickness)
+	defs := fmt.Sprintf(`<defs><pattern id="%s" width="%g" height="%g" patternUnits="userSpaceOnUse" patternTransform="rotate(-45)">`+
+		`<rect width="%g" height="%g" fill="%s" /><path d="M %g 0 L %g %g" fill="none" stroke="%s" stroke-width="%g" /></pattern></defs>`,
+		id, spacing, spacing, spacing, spacing, escapeXML(opts.FillColor), spacing/2, spacing/2, spacing,
+		escapeXML(opts.StrokeColor), math.Max(0.5, opts.Thickness/2))
+
+	out := make([]byte, 0, len(svg)+len(defs)+1)
+	out = append(out, svg[:root[1]]...)
+	out = append(out, '\n')
+	out = append(out, defs...)
+	out = append(out, svgSectionFillPattern.ReplaceAllFunc(svg[root[1]:], func(tag []byte) []byte {
+		return svgFillAttrPattern.ReplaceAll(tag, []byte(` fill="url(#`+id+`)"`))
+	})...)
+	return out
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSectionPlane(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		plane SectionPlane
+		want  string
+	}{
+		{"unit normal", SectionPlane{Normal: [3]float64{1, 0, 0}}, "0,0,0,1,0,0"},
+		{"scaled normal", SectionPlane{Origin: [3]float64{10, -24, 0}, Normal: [3]float64{0, 3, 4}}, "10,-24,0,0,0.6,0.8"},
+		{"zero normal", SectionPlane{}, ""},
+		{"far origin", SectionPlane{Origin: [3]float64{1e9, 0, 0}, Normal: [3]float64{0, 0, 1}}, ""},
+	} {
+		var opts RenderOptions
+		err := tt.plane.apply(&opts)
+		if (err == nil) != (tt.want != "") || opts.SectionPlane != tt.want {
+			t.Errorf("%s: got %q, %v", tt.name, opts.SectionPlane, err)
+		}
+	}
+}
+
+func TestSectionedRender(t *testing.T) {
+	withFakeBlender(t)
+	input := filepath.Join(t.TempDir(), "3001.dat")
+	os.WriteFile(input, []byte("0 Brick 2 x 4\n"), 0o644)
+
+	req := RenderRequest{StrokeColor: "black", SectionPlane: &SectionPlane{Normal: [3]float64{0, 0, -1}}}
+	opts, err := req.options()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _, err := renderFile(context.Background(), "contract", input, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	svg := string(data)
+	if err := checkSVG(data); err != nil {
+		t.Error(err)
+	}
+	if !strings.Contains(svg, `<pattern id="section-white-black"`) || !strings.Contains(svg, `fill="url(#section-white-black)"`) {
+		t.Fatalf("expected the cut face hatched:\n%s", svg)
+	}
+	if strings.Count(svg, "url(#section-") != 1 {
+		t.Errorf("expected only the cut face hatched:\n%s", svg)
+	}
+
+	// Without a plane nothing is marked
+	opts.SectionPlane = ""
+	if data, _, _ := renderFile(context.Background(), "contract", input, opts); strings.Contains(string(data), "section") {
+		t.Errorf("unexpected section:\n%s", data)
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+type SelfTestCheck struct {
+	Name         string  `json:"name"`
+	Status       string  `json:"status"`
+	DurationSecs float64 `json:"duration_seconds"`
+	Detail       string  `json:"detail,omitempty"`
+}
+
+type SelfTestReport struct {
+	Passed       bool            `json:"passed"`
+	DurationSecs float64         `json:"duration_seconds"`
+	Checks       []SelfTestCheck `json:"checks"`
+}
+
+// A self-test check returns a short detail on success. Returning a
+// skipCheck error marks the check as skipped rather than failed.
+type selfTestCase struct {
+	name string
+	run  func(ctx context.Context) (string, error)
+}
+
+type skipCheck string
+
+func (s skipCheck) Error() string { return string(s) }
+
+// A tiny two-brick model exercising the LDraw model import path
+const selfTestModel = `0 Self-test model
+0 Name: selftest.ldr
+1 4 0 0 0 1 0 0 0 1 0 0 0 1 3001.dat
+1 1 0 -24 0 1 0 0 0 1 0 0 0 1 3003.dat
+`
+
+// The curated suite, in run order
+func selfTests() []selfTestCase {
+	return []selfTestCase{
+		{"simple part (3024)", func(ctx context.Context) (string, error) {
+			return selfTestRenderPart(ctx, "3024", RenderRequest{})
+		}},
+		{"complex part (6133)", func(ctx context.Context) (string, error) {
+			return selfTestRenderPart(ctx, "6133", RenderRequest{})
+		}},
+		{"translucent part (4740)", func(ctx context.Context) (string, error) {
+			opacity := 0.5
+			return selfTestRenderPart(ctx, "4740", RenderRequest{FillOpacity: &opacity})
+		}},
+		{"model", selfTestRenderModel},
+		{"format: svg", func(ctx context.Context) (string, error) {
+			return selfTestRenderPart(ctx, "3001", RenderRequest{})
+		}},
+		{"format: pdf", func(ctx context.Context) (string, error) {
+			return selfTestConvert(ctx, "pdf", []byte("%PDF-"))
+		}},
+		{"cache round-trip", func(ctx context.Context) (string, error) {
+			if renderCache == nil {
+				return "", skipCheck("no render cache configured")
+			}
+			key := renderCacheKey("selftest", RenderOptions{Thickness: -1})
+			want := []byte(time.Now().UTC().Format(time.RFC3339Nano))
+			if err := renderCache.put(key, want); err != nil {
+				return "", err
+			}
+			defer func() {
+				renderCache.store.remove(renderCache.path(key))
+				for _, encoding := range supportedEncodings() {
+					renderCache.store.remove(renderCache.encodedPath(key, svgHash(want), encoding))
+				}
+			}()
+			if got, ok := renderCache.get(key); !ok || string(got) != string(want) {
+				return "", errors.New("cached entry did not read back")
+			}
+			return fmt.Sprintf("wrote and read %s", renderCache.store), nil
+		}},
+	}
+}
+
+// Self-test endpoint
+func handleSelfTest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		sendError(w, http.StatusMethodNotAllowed, "Method not allowed", "")
+		return
+	}
+
+	report := runSelfTests(r.Context(), selfTests())
+	log.Printf("Self-test finished: passed=%t in %.2fs", report.Passed, report.DurationSecs)
+
+	w.Header().Set("Content-Type", "application/json")
+	if !report.Passed {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(report)
+}
+
+func runSelfTests(ctx context.Context, cases []selfTestCase) SelfTestReport {
+	start := time.Now()
+	report := SelfTestReport{Passed: true}
+	for _, c := range cases {
+		checkStart := time.Now()
+		detail, err := c.run(ctx)
+		check := SelfTestCheck{Name: c.name, Status: "pass", Detail: detail}
+
+		var skip skipCheck
+		switch {
+		case errors.As(err, &skip):
+			check.Status = "skip"
+			check.Detail = skip.Error()
+		case err != nil:
+			check.Status = "fail"
+			check.Detail = err.Error()
+			report.Passed = false
+		}
+		check.DurationSecs = time.Since(checkStart).Seconds()
+		report.Checks = append(report.Checks, check)
+	}
+	report.DurationSecs = time.Since(start).Seconds()
+	return report
+}
+
+func selfTestRenderPart(ctx context.Context, partNumber string, req RenderRequest) (string, error) {
+	opts, err := req.options()
+	if err != nil {
+		return "", err
+	}
+	svg, d, err := renderPart(ctx, partNumber, opts)
+	if err != nil {
+		return "", err
+	}
+	if err := checkSVG(svg); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d bytes in %.2fs", len(svg), d.Seconds()), nil
+}
+
+func selfTestRenderModel(ctx context.Context) (string, error) {
+	tmp, err := os.CreateTemp("", "selftest-*.ldr")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	tmp.WriteString(selfTestModel)
+	tmp.Close()
+
+	req := RenderRequest{}
+	opts, _ := req.options()
+	svg, d, err := renderFile(ctx, "self-test model", tmp.Name(), opts)
+	if err != nil {
+		return "", err
+	}
+	if err := checkSVG(svg); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d bytes in %.2fs", len(svg), d.Seconds()), nil
+}
+
+// Render a part and convert it, checking the output's magic bytes
+func selfTestConvert(ctx context.Context, format string, magic []byte) (string, error) {
+	req := RenderRequest{}
+	opts, _ := req.options()
+	svg, _, err := renderPart(ctx, "3024", opts)
+	if err != nil {
+		return "", err
+	}
+	out, err := convertSVG(ctx, format, [][]byte{svg})
+	if err != nil {
+		return "", err
+	}
+	if !bytes.HasPrefix(out, magic) {
+		return "", fmt.Errorf("output is not a valid %s file", format)
+	}
+	return fmt.Sprintf("%d bytes", len(out)), nil
+}
+
+// Check that a rendered SVG is well-formed and contains line art
+func checkSVG(svg []byte) error {
+	dec := xml.NewDecoder(bytes.NewReader(svg))
+	root, paths := "", 0
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("output is not well-formed SVG: %v", err)
+		}
+		if el, ok := tok.(xml.StartElement); ok {
+			if root == "" {
+				root = el.Name.Local
+			}
+			if el.Name.Local == "path" {
+				paths++
+			}
+		}
+	}
+	if root != "svg" {
+		return fmt.Errorf("output root element is %q, not svg", root)
+	}
+	if paths == 0 {
+		return errors.New("output contains no paths")
+	}
+	return nil
+}
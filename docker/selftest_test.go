@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestRunSelfTests(t *testing.T) {
+	report := runSelfTests(context.Background(), []selfTestCase{
+		{"ok", func(ctx context.Context) (string, error) { return "fine", nil }},
+		{"skipped", func(ctx context.Context) (string, error) { return "", skipCheck("not configured") }},
+		{"broken", func(ctx context.Context) (string, error) { return "", errors.New("boom") }},
+	})
+
+	if report.Passed {
+		t.Error("expected report to fail")
+	}
+	want := []string{"pass", "skip", "fail"}
+	for i, c := range report.Checks {
+		if c.Status != want[i] {
+			t.Errorf("check %s: got status %s, want %s", c.Name, c.Status, want[i])
+		}
+	}
+}
+
+func TestCheckSVG(t *testing.T) {
+	if err := checkSVG([]byte(`<svg xmlns="http://www.w3.org/2000/svg"><path d="M 0,0 1,1" /></svg>`)); err != nil {
+		t.Errorf("valid SVG rejected: %v", err)
+	}
+	for _, bad := range []string{`<svg><path></svg>`, `<html></html>`, `<svg xmlns="http://www.w3.org/2000/svg"></svg>`} {
+		if err := checkSVG([]byte(bad)); err == nil {
+			t.Errorf("expected %q to be rejected", bad)
+		}
+	}
+}
@@ -1,15 +1,17 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
 	"sync"
@@ -20,19 +22,54 @@ import (
 var (
 	ldrawPath    = getEnv("LDRAW_PATH", "/usr/share/ldraw/ldraw")
 	renderScript = "/app/render_part.py"
+	blenderBin   = getEnv("BLENDER_BIN", "blender")
 	port         = getEnv("PORT", "8080")
 )
 
 // Metrics
 type Metrics struct {
 	sync.RWMutex
-	RendersTotal       int64
-	Errors             int64
-	RenderDurationSum  float64
-	RenderDurationNano int64
+	RendersTotal int64
+	Errors       int64
+	// Renders answered by joining an identical one already running
+	RendersCoalesced int64
+	// Blender render, prewarm queue wait, and SVG post-processing times
+	RenderDuration *histogram
+	QueueWait      *histogram
+	Postprocess    *histogram
+	// Blender failures by cause
+	BlenderFailures map[string]int64
+	// Render cache lookups and in-memory evictions
+	CacheMemoryHits      int64
+	CacheDiskHits        int64
+	CacheMisses          int64
+	CacheMemoryEvictions int64
+	// Queued jobs cancelled before they finished, finished ones forgotten,
+	// and the bytes of results dropped with them
+	JobsCancelled     int64
+	JobsExpired       int64
+	JobBytesReclaimed int64
+	// How long queued jobs and dispatched renders waited for a worker, and
+	// requests turned away for lack of capacity by reason; see saturation.go
+	JobQueueWait *histogram
+	Rejected     map[string]int64
+	// Blender render and end-to-end request latencies over sliding windows;
+	// see quantiles.go
+	RenderLatency  *quantileSketch
+	RequestLatency *quantileSketch
 }
 
-var metrics = &Metrics{}
+var metrics = &Metrics{
+	RenderDuration: newHistogram(renderDurationBuckets),
+	QueueWait:      newHistogram(queueWaitBuckets),
+	Postprocess:    newHistogram(postprocessBuckets),
+	JobQueueWait:   newHistogram(queueWaitBuckets),
+
+	BlenderFailures: make(map[string]int64),
+	Rejected:        make(map[string]int64),
+	RenderLatency:   newQuantileSketch(),
+	RequestLatency:  newQuantileSketch(),
+}
 
 // Request/Response types
 type RenderRequest struct {
@@ -48,6 +85,88 @@ type RenderRequest struct {
 	Padding         *float64   `json:"padding"`
 	CreaseAngle     *float64   `json:"creaseAngle"`
 	EdgeTypes       *EdgeTypes `json:"edgeTypes"`
+	// Color is an LDraw color code supplying the fill color, opacity, and
+	// material finish unless fillColor or fillOpacity are given
+	Color *int `json:"color"`
+	// NormalizeOrientation snaps parts authored at an odd angle onto the
+	// LDraw axes before framing (default true)
+	NormalizeOrientation *bool `json:"normalizeOrientation"`
+	// CurveTolerance refits edges as Bézier curves within this many pixels
+	// (default 0: keep Freestyle's polylines)
+	CurveTolerance *float64 `json:"curveTolerance"`
+	// ColorScheme is light (default), dark, or auto (dark styles under a
+	// prefers-color-scheme media query)
+	ColorScheme string `json:"colorScheme"`
+	// Style is a built-in look (blueprint, sketch, or toon); see style.go
+	Style string `json:"style"`
+	// SketchJitter is how far sketch lines wander, in pixels (default 2)
+	SketchJitter *float64 `json:"sketchJitter"`
+	// ToonBands is the number of shading steps in toon renders (default 3)
+	ToonBands *int `json:"toonBands"`
+	// EdgeColors strokes edge types in colors of their own; see
+	// edgecolors.go
+	EdgeColors *EdgeColors `json:"edgeColors"`
+	// LineStyle sets Freestyle line modifiers; see linestyle.go
+	LineStyle *LineStyle `json:"lineStyle"`
+	// LineStylePlugin names an operator's line style script; see plugins.go
+	LineStylePlugin string `json:"lineStylePlugin"`
+	// Hatching shades faces by their angle to the light with hatch
+	// patterns; see hatching.go
+	Hatching *bool `json:"hatching"`
+	// AmbientOcclusion darkens crevices: raster (into the toon raster) or
+	// fills (baked into per-face gradients); see occlusion.go
+	AmbientOcclusion string `json:"ambientOcclusion"`
+	// Annotate adds classes and data attributes to line sets and paths;
+	// see annotate.go
+	Annotate *bool `json:"annotate"`
+	// CSSVariables sets colors through CSS custom properties with the
+	// literal colors as fallbacks; see theme.go
+	CSSVariables *bool `json:"cssVariables"`
+	// Metadata embeds what was rendered, how, and by what; see metadata.go
+	Metadata *bool `json:"metadata"`
+	// Precision is the decimal places in path coordinates (default 3)
+	Precision *int `json:"precision"`
+	// RootSize is fixed (default), scalable, or responsive, and
+	// PreserveAspectRatio fits a viewBox root; see rootsize.go
+	RootSize            string `json:"rootSize"`
+	PreserveAspectRatio string `json:"preserveAspectRatio"`
+	// Units is px (default) or mm, for width and height at the part's
+	// real size; see units.go
+	Units string `json:"units"`
+	// Supersample samples strokes and rasterizes PNGs this many times as
+	// finely (default 1); see supersample.go
+	Supersample *int `json:"supersample"`
+	// Mirror reflects the model across LDraw axes: none (default) or some
+	// of x, y, and z; see mirror.go
+	Mirror string `json:"mirror"`
+	// Transform poses the model with a matrix, or rotation and scale; see
+	// transform.go
+	Transform *ModelTransform `json:"transform"`
+	// SectionPlane cuts the model away on one side of a plane and hatches
+	// the cut; see section.go
+	SectionPlane *SectionPlane `json:"sectionPlane"`
+	// ShowHiddenEdges draws the edges behind faces, styled by
+	// HiddenEdgeStyle; see hiddenedges.go
+	ShowHiddenEdges *bool            `json:"showHiddenEdges"`
+	HiddenEdgeStyle *HiddenEdgeStyle `json:"hiddenEdgeStyle"`
+	// BFC (recalculate or ldraw) and Condlines (mesh or smooth) control face
+	// winding and curved-surface outlines; see condlines.go
+	BFC       string `json:"bfc"`
+	Condlines string `json:"condlines"`
+	// DepthCue fades strokes toward a tint with camera depth; see
+	// depthcue.go
+	DepthCue *DepthCue `json:"depthCue"`
+	// PrintFallback renders the base part for a printed part the library
+	// doesn't have; see printfallback.go
+	PrintFallback *bool `json:"printFallback"`
+	// LibraryVersion renders from a library snapshot; see library.go
+	LibraryVersion string `json:"libraryVersion,omitempty"`
+	// Format is svg (default) or png, which DPI sizes for units mm; see
+	// raster.go. Only /render takes them.
+	Format string   `json:"format,omitempty"`
+	DPI    *float64 `json:"dpi,omitempty"`
+	// Profile names a preset of these options; see profiles.go
+	Profile string `json:"profile,omitempty"`
 }
 
 type EdgeTypes struct {
@@ -61,38 +180,152 @@ type EdgeTypes struct {
 }
 
 type HealthResponse struct {
-	Status              string `json:"status"`
-	BlenderAvailable    bool   `json:"blender_available"`
-	LDrawAvailable      bool   `json:"ldraw_available"`
-	TempDirWritable     bool   `json:"temp_dir_writable"`
+	Status           string `json:"status"`
+	BlenderAvailable bool   `json:"blender_available"`
+	LDrawAvailable   bool   `json:"ldraw_available"`
+	TempDirWritable  bool   `json:"temp_dir_writable"`
 }
 
 type MetricsResponse struct {
-	RendersTotal           int64   `json:"renders_total"`
-	Errors                 int64   `json:"errors"`
-	AvgRenderDurationSecs  float64 `json:"avg_render_duration_seconds"`
+	RendersTotal          int64            `json:"renders_total"`
+	Errors                int64            `json:"errors"`
+	RendersCoalesced      int64            `json:"renders_coalesced"`
+	AvgRenderDurationSecs float64          `json:"avg_render_duration_seconds"`
+	RenderDuration        HistogramMetrics `json:"render_duration_seconds"`
+	QueueWait             HistogramMetrics `json:"queue_wait_seconds"`
+	Postprocess           HistogramMetrics `json:"postprocess_seconds"`
+	BlenderFailures       map[string]int64 `json:"blender_failures"`
+	Cache                 *CacheMetrics    `json:"cache,omitempty"`
+	JobsCancelled         int64            `json:"jobs_cancelled"`
+	JobsExpired           int64            `json:"jobs_expired"`
+	JobBytesReclaimed     int64            `json:"job_bytes_reclaimed"`
+	JobQueueWait          HistogramMetrics `json:"job_queue_wait_seconds"`
+	RequestsRejected      map[string]int64 `json:"requests_rejected"`
+	SaturationMetrics
+	// Percentiles by latency ("render" or "request") and window
+	LatencyPercentiles map[string]map[string]LatencyPercentiles `json:"latency_percentiles"`
+}
+
+type CacheMetrics struct {
+	MemoryHits      int64 `json:"memory_hits"`
+	DiskHits        int64 `json:"disk_hits"`
+	Misses          int64 `json:"misses"`
+	MemoryEvictions int64 `json:"memory_evictions"`
+	MemoryEntries   int   `json:"memory_entries"`
+	MemoryBytes     int64 `json:"memory_bytes"`
 }
 
 type ErrorResponse struct {
 	Error  string `json:"error"`
 	Detail string `json:"detail,omitempty"`
+	// Cause classifies Blender failures; see crash.go
+	Cause string `json:"cause,omitempty"`
+	// Fields lists every invalid request field; see validation.go
+	Fields []FieldError `json:"fields,omitempty"`
 }
 
 func main() {
+	log.SetOutput(io.MultiWriter(os.Stderr, errorLog))
 	log.Printf("Starting LEGO Part Renderer Service")
 	log.Printf("LDraw library: %s", ldrawPath)
 	log.Printf("Render script: %s", renderScript)
 
-	http.HandleFunc("/", handleRoot)
-	http.HandleFunc("/render", handleRender)
-	http.HandleFunc("/health", handleHealth)
-	http.HandleFunc("/metrics", handleMetrics)
+	initMetricsSinks()
+
+	if err := validateSandbox(); err != nil {
+		log.Fatalf("Blender sandbox: %v", err)
+	}
+	if err := validateTLS(); err != nil {
+		log.Fatalf("TLS: %v", err)
+	}
+	if err := validateQueue(); err != nil {
+		log.Fatalf("Job queue: %v", err)
+	}
+	if err := validateDispatch(); err != nil {
+		log.Fatalf("Dispatch: %v", err)
+	}
+	if err := loadLineStylePlugins(); err != nil {
+		log.Fatalf("Line style plugins: %v", err)
+	}
+	if err := validateProfiles(); err != nil {
+		log.Fatalf("Render profiles: %v", err)
+	}
+	if err := loadPartOverrides(); err != nil {
+		log.Fatalf("Part overrides: %v", err)
+	}
+	if err := validateResultStore(); err != nil {
+		log.Fatalf("Result store: %v", err)
+	}
+	if err := openAuditLog(); err != nil {
+		log.Fatalf("Audit log: %v", err)
+	}
+	if results != nil {
+		log.Printf("Result store: %s", results)
+	}
+	if sandboxed() {
+		log.Printf("Blender sandbox: %q, uid %d", blenderSandbox, blenderUID)
+	}
+
+	if apiKeysFile != "" {
+		keys, err := loadAPIKeys(apiKeysFile)
+		if err != nil {
+			log.Fatalf("Loading API keys failed: %v", err)
+		}
+		apiKeys = keys
+		log.Printf("API keys: %d", len(keys))
+	}
+
+	if stateDir != "" {
+		if err := migrateState(stateDir, migrations); err != nil {
+			log.Fatalf("State migration failed: %v", err)
+		}
+		if err := loadUsage(stateDir); err != nil {
+			log.Printf("Loading usage failed: %v", err)
+		}
+		go runUsageSaver(stateDir, usageSaveInterval)
+		if err := loadRenderHistory(stateDir); err != nil {
+			log.Printf("Loading render history failed: %v", err)
+		}
+		go runRenderHistorySaver(stateDir, usageSaveInterval)
+		if prewarmPopular > 0 {
+			go runPopularScheduler(stateDir, prewarmPopular, time.Duration(prewarmCheckMinutes)*time.Minute)
+		}
+	}
+	go runPreparedParamsSweeper(time.Hour)
+
+	if queueMode != "" {
+		if err := startJobQueue(); err != nil {
+			log.Fatalf("Job queue: %v", err)
+		}
+		log.Printf("Job queue: %s via %s", queueMode, queueSubject)
+	}
+	if dispatchMode != "" {
+		startDispatch()
+		log.Printf("Dispatch: %s", dispatchMode)
+	}
 
 	addr := ":" + port
-	log.Printf("Server listening on %s", addr)
-	if err := http.ListenAndServe(addr, logRequest(http.DefaultServeMux)); err != nil {
+	server := newServer(addr, logRequest(routes()))
+	var err error
+	if server.TLSConfig, err = tlsConfig(); err != nil {
+		log.Fatalf("TLS setup failed: %v", err)
+	}
+	drained := make(chan struct{})
+	go func() {
+		shutdownOnSignal(server)
+		close(drained)
+	}()
+	if server.TLSConfig != nil {
+		log.Printf("Server listening on %s (HTTPS)", addr)
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		log.Printf("Server listening on %s", addr)
+		err = server.ListenAndServe()
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
 		log.Fatalf("Server failed: %v", err)
 	}
+	<-drained
 }
 
 // Logging middleware
@@ -115,9 +348,53 @@ func handleRoot(w http.ResponseWriter, r *http.Request) {
 		"service": "LEGO Part Renderer",
 		"version": "1.0.0",
 		"endpoints": map[string]string{
-			"POST /render":  "Render a part as SVG",
-			"GET /health":   "Health check",
-			"GET /metrics":  "Service metrics",
+			"POST /render":                   "Render a part as SVG",
+			"GET /health":                    "Health check",
+			"GET /metrics":                   "Service metrics",
+			"POST /render/sheet":             "Render a set inventory as a contact sheet (SVG or PDF)",
+			"POST /render/wantedlist":        "Render a BrickLink wanted list (XML) as a contact sheet or ZIP",
+			"GET /sets/{setNumber}/render":   "Render a Rebrickable set inventory as a contact sheet",
+			"POST /admin/selftest":           "Run the deployment smoke-test suite (admin)",
+			"POST /render/model":             "Render an uploaded LDraw, Stud.io (.io), or LDCad model as SVG",
+			"POST /render/model/bom":         "Extract an uploaded model's parts list as JSON or render it as a sheet",
+			"POST /render/model/steps":       "Render one instruction page per model STEP as PDF, ZIP, or SVG",
+			"GET /atlas":                     "Render many part thumbnails into one sprite image with a JSON coordinate map",
+			"POST /render/colorways":         "Render one part in many colors from a single render",
+			"GET /og/{partNumber}.png":       "Render a 1200x630 social preview card for a part",
+			"POST /admin/prewarm":            "Queue background renders to warm the render cache (admin)",
+			"POST /admin/library/update":     "Merge an official LDraw parts update archive into the library (admin)",
+			"GET /libraries":                 "The current LDraw library and the snapshots libraryVersion can choose",
+			"POST /render/prepare":           "Hash render options for a cacheable /r/{part}/{hash}.svg URL",
+			"GET /r/{part}/{hash}.svg":       "Render a part with prepared options",
+			"GET /parts/{number}/estimate":   "Predicted render time and SVG size for a part",
+			"GET /parts/{number}/stats":      "A part's triangles, quads, subfiles, primitives, and bounding box",
+			"GET /parts/{number}/dimensions": "A part's size in LDU, millimeters, studs, and plates",
+			"POST /render/validate":          "Check a /render request and resolve its part and options without rendering",
+			"GET /s/{part}.svg":              "Render a part from a signed, expiring URL",
+			"POST /admin/sign":               "Mint a signed render URL (admin)",
+			"GET /account/usage":             "Render usage and limits for the calling API key",
+			"GET /account/parts":             "The calling API key's private custom parts and quota",
+			"PUT /account/parts/{name}":      "Upload a private custom part, rendered before the shared library's (GET and DELETE too)",
+			"GET /admin/usage":               "Renders, errors, cache hits, and compute seconds per API key",
+			"GET /admin/audit":               "Search the audit log of rendering requests (admin, AUDIT_LOG)",
+			"POST /admin/replay/{auditId}":   "Re-run an audited request with the current pipeline and diff the outputs (admin)",
+			"GET /admin":                     "Operator dashboard: queue, workers, recent renders, error log",
+			"POST /jobs":                     "Queue a render for the worker fleet (QUEUE_MODE=api)",
+			"GET /jobs/{id}":                 "Status of a queued render",
+			"GET /jobs/{id}/result":          "SVG of a finished queued render",
+			"DELETE /jobs/{id}":              "Cancel a queued or running render",
+			"GET /profiles":                  "Named render option presets, chosen with \"profile\"",
+			"GET /line-style-plugins":        "Operator line style scripts, chosen with \"lineStylePlugin\"",
+			"GET /readyz":                    "Readiness check; fails while draining",
+			"GET /version":                   "Service build, Blender version, render script hash, and LDraw library inventory",
+			"POST /admin/drain":              "Start draining, or GET its progress (admin)",
+			"gRPC Dispatcher":                "Render worker registration, heartbeats, and job pulls (DISPATCH_MODE=dispatcher); see renderer.proto",
+			"GET /dispatch/workers":          "Registered workers and pending dispatched renders",
+			"POST /render/batch":             "Render many parts, streaming each result as NDJSON as it finishes",
+			"gRPC Renderer":                  "RenderBatch: /render/batch as a server-streaming RPC; see renderer.proto",
+			"GET /admin/webhooks/deliveries": "Recent job webhook deliveries and their attempts (admin)",
+			"GET /admin/deadletter":          "Jobs that failed for good, after any retries (admin)",
+			"POST /admin/deadletter/requeue": "Requeue dead-lettered jobs, all or ?part= or by /{id}/requeue (admin)",
 		},
 	}
 
@@ -133,206 +410,68 @@ func handleRender(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Parse request
-	var req RenderRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		sendError(w, http.StatusBadRequest, "Invalid JSON", err.Error())
+	var body debugRenderRequest
+	if !decodeJSON(w, r, &body) {
 		return
 	}
+	req := body.RenderRequest
 
 	// Validate
-	if req.PartNumber == "" {
-		sendError(w, http.StatusBadRequest, "partNumber is required", "")
-		return
-	}
-
-	if req.Thickness == 0 {
-		req.Thickness = 2.0
-	}
-	if req.Thickness < 0.5 || req.Thickness > 20.0 {
-		sendError(w, http.StatusBadRequest, "thickness must be between 0.5 and 20.0", "")
-		return
-	}
-
-	if req.FillColor == "" {
-		req.FillColor = "white"
-	}
-
-	fillOpacity := 1.0
-	if req.FillOpacity != nil {
-		fillOpacity = *req.FillOpacity
-	}
-	if fillOpacity < 0 || fillOpacity > 1.0 {
-		sendError(w, http.StatusBadRequest, "fillOpacity must be between 0 and 1", "")
-		return
-	}
-
-	if req.StrokeColor == "" {
-		req.StrokeColor = "currentColor"
-	}
-
-	// Apply defaults for optional fields
-	cameraLat := 30.0
-	if req.CameraLatitude != nil {
-		cameraLat = *req.CameraLatitude
-	}
-	cameraLon := 45.0
-	if req.CameraLongitude != nil {
-		cameraLon = *req.CameraLongitude
-	}
-	resX := 1024
-	if req.ResolutionX != nil {
-		resX = *req.ResolutionX
-	}
-	resY := 1024
-	if req.ResolutionY != nil {
-		resY = *req.ResolutionY
-	}
-	padding := 0.03
-	if req.Padding != nil {
-		padding = *req.Padding
-	}
-	creaseAngle := 135.0
-	if req.CreaseAngle != nil {
-		creaseAngle = *req.CreaseAngle
-	}
-
-	// Validate ranges
-	if cameraLat < -90 || cameraLat > 90 {
-		sendError(w, http.StatusBadRequest, "cameraLatitude must be between -90 and 90", "")
-		return
-	}
-	if cameraLon < -360 || cameraLon > 360 {
-		sendError(w, http.StatusBadRequest, "cameraLongitude must be between -360 and 360", "")
-		return
-	}
-	if resX < 64 || resX > 4096 {
-		sendError(w, http.StatusBadRequest, "resolutionX must be between 64 and 4096", "")
-		return
-	}
-	if resY < 64 || resY > 4096 {
-		sendError(w, http.StatusBadRequest, "resolutionY must be between 64 and 4096", "")
-		return
-	}
-	if padding < 0 || padding > 0.5 {
-		sendError(w, http.StatusBadRequest, "padding must be between 0 and 0.5", "")
+	opts, format, dpi, err := body.validate()
+	if err != nil {
+		sendValidationError(w, err)
 		return
 	}
-	if creaseAngle < 0 || creaseAngle > 180 {
-		sendError(w, http.StatusBadRequest, "creaseAngle must be between 0 and 180", "")
+	setPartHeaders(w, req.PartNumber, opts)
+	if body.Debug {
+		sendDebugRender(w, r, req.PartNumber, opts)
 		return
 	}
 
-	// Build edge types string
-	edgeTypes := buildEdgeTypes(req.EdgeTypes)
-
-
 	start := time.Now()
 
-	// Find part file
-	partFile := findPartFile(req.PartNumber)
-	if partFile == "" {
-		log.Printf("Part not found: %s", req.PartNumber)
-		metrics.Lock()
-		metrics.Errors++
-		metrics.Unlock()
-		sendError(w, http.StatusNotFound, "Part not found", fmt.Sprintf("Part %s not found in LDraw library", req.PartNumber))
-		return
-	}
-
-	// Create temp file for output
-	tmpFile, err := os.CreateTemp("", "render-*.svg")
+	svgContent, renderDuration, cacheKey, err := renderPartKeyed(r.Context(), req.PartNumber, opts)
 	if err != nil {
-		log.Printf("Failed to create temp file: %v", err)
-		metrics.Lock()
-		metrics.Errors++
-		metrics.Unlock()
-		sendError(w, http.StatusInternalServerError, "Failed to create temp file", err.Error())
+		sendRenderError(w, err)
 		return
 	}
-	outputPath := tmpFile.Name()
-	tmpFile.Close()
-	defer os.Remove(outputPath)
-
-	// Render with Blender
-	log.Printf("Rendering %s (thickness=%.1f, camera=%.1f/%.1f, res=%dx%d, padding=%.3f, crease=%.1f, edges=%s, fill=%s, opacity=%.2f, stroke=%s)",
-		req.PartNumber, req.Thickness, cameraLat, cameraLon, resX, resY, padding, creaseAngle, edgeTypes, req.FillColor, fillOpacity, req.StrokeColor)
-	renderStart := time.Now()
-
-	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
-	defer cancel()
-
-	cmd := exec.CommandContext(ctx,
-		"blender",
-		"--background",
-		"--python", renderScript,
-		"--",
-		partFile,
-		outputPath,
-		ldrawPath,
-		fmt.Sprintf("%.1f", req.Thickness),
-		req.FillColor,
-		fmt.Sprintf("%f", cameraLat),
-		fmt.Sprintf("%f", cameraLon),
-		strconv.Itoa(resX),
-		strconv.Itoa(resY),
-		fmt.Sprintf("%f", padding),
-		fmt.Sprintf("%f", creaseAngle),
-		edgeTypes,
-		fmt.Sprintf("%f", fillOpacity),
-		req.StrokeColor,
-	)
-
-	var stderr bytes.Buffer
-	cmd.Stderr = &stderr
-
-	if err := cmd.Run(); err != nil {
-		errMsg := stderr.String()
-		if ctx.Err() == context.DeadlineExceeded {
-			log.Printf("Render timeout for %s", req.PartNumber)
-			metrics.Lock()
-			metrics.Errors++
-			metrics.Unlock()
-			sendError(w, http.StatusInternalServerError, "Rendering timed out", fmt.Sprintf("Part %s", req.PartNumber))
+	if format == "png" {
+		png, err := rasterizeRender(r.Context(), req.PartNumber, svgContent, opts, dpi)
+		if err != nil {
+			sendRenderError(w, err)
 			return
 		}
-
-		log.Printf("Render failed for %s: %s", req.PartNumber, errMsg)
-		metrics.Lock()
-		metrics.Errors++
-		metrics.Unlock()
-		sendError(w, http.StatusInternalServerError, "Rendering failed", errMsg)
-		return
-	}
-
-	renderDuration := time.Since(renderStart)
-	log.Printf("Rendered %s in %.2fs", req.PartNumber, renderDuration.Seconds())
-
-	// Update metrics
-	metrics.Lock()
-	metrics.RendersTotal++
-	metrics.RenderDurationSum += renderDuration.Seconds()
-	metrics.RenderDurationNano += renderDuration.Nanoseconds()
-	metrics.Unlock()
-
-	// Read SVG content
-	svgContent, err := os.ReadFile(outputPath)
-	if err != nil {
-		log.Printf("Failed to read rendered SVG: %v", err)
-		metrics.Lock()
-		metrics.Errors++
-		metrics.Unlock()
-		sendError(w, http.StatusInternalServerError, "Failed to read output", err.Error())
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		w.Header().Set("X-Render-Duration", fmt.Sprintf("%.2fs", renderDuration.Seconds()))
+		setCacheHeader(w, renderDuration)
+		w.Write(png)
 		return
 	}
 
 	totalDuration := time.Since(start)
 	log.Printf("Total request duration: %.2fs", totalDuration.Seconds())
 
-	// Return SVG
+	sendRender(w, r, svgContent, renderDuration, cacheKey)
+}
+
+// Helper: send a part render with its caching headers (immutable unless the
+// caller set Cache-Control), answering conditional requests with 304.
+// cacheKey is the render's key in the render cache, or "" if it has none.
+func sendRender(w http.ResponseWriter, r *http.Request, svgContent []byte, renderDuration time.Duration, cacheKey string) {
 	w.Header().Set("Content-Type", "image/svg+xml")
-	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	if w.Header().Get("Cache-Control") == "" {
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	}
 	w.Header().Set("X-Render-Duration", fmt.Sprintf("%.2fs", renderDuration.Seconds()))
-	w.Write(svgContent)
+	setCacheHeader(w, renderDuration)
+	etag := svgETag(svgContent)
+	w.Header().Set("ETag", etag)
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	writeCachedSVG(w, r, svgContent, cacheKey)
 }
 
 // Health check endpoint
@@ -342,7 +481,7 @@ func handleHealth(w http.ResponseWriter, r *http.Request) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	cmd := exec.CommandContext(ctx, "blender", "--version")
+	cmd := exec.CommandContext(ctx, blenderBin, "--version")
 	if err := cmd.Run(); err == nil {
 		blenderAvailable = true
 	}
@@ -385,18 +524,51 @@ func handleHealth(w http.ResponseWriter, r *http.Request) {
 
 // Metrics endpoint
 func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if wantsPrometheus(r) {
+		writePrometheusMetrics(w)
+		return
+	}
+
+	sat := saturation()
 	metrics.RLock()
 	defer metrics.RUnlock()
 
-	avgDuration := 0.0
-	if metrics.RendersTotal > 0 {
-		avgDuration = metrics.RenderDurationSum / float64(metrics.RendersTotal)
-	}
-
 	response := MetricsResponse{
 		RendersTotal:          metrics.RendersTotal,
 		Errors:                metrics.Errors,
-		AvgRenderDurationSecs: avgDuration,
+		RendersCoalesced:      metrics.RendersCoalesced,
+		AvgRenderDurationSecs: metrics.RenderDuration.mean(),
+		RenderDuration:        metrics.RenderDuration.snapshot(),
+		QueueWait:             metrics.QueueWait.snapshot(),
+		Postprocess:           metrics.Postprocess.snapshot(),
+		BlenderFailures:       make(map[string]int64),
+		JobsCancelled:         metrics.JobsCancelled,
+		JobsExpired:           metrics.JobsExpired,
+		JobBytesReclaimed:     metrics.JobBytesReclaimed,
+		JobQueueWait:          metrics.JobQueueWait.snapshot(),
+		RequestsRejected:      make(map[string]int64),
+		SaturationMetrics:     sat,
+		LatencyPercentiles: map[string]map[string]LatencyPercentiles{
+			"render":  metrics.RenderLatency.snapshot(time.Now()),
+			"request": metrics.RequestLatency.snapshot(time.Now()),
+		},
+	}
+	for cause, n := range metrics.BlenderFailures {
+		response.BlenderFailures[cause] = n
+	}
+	for _, reason := range rejectionReasons {
+		response.RequestsRejected[reason] = metrics.Rejected[reason]
+	}
+	if renderCache != nil {
+		entries, bytes := renderCache.memoryStats()
+		response.Cache = &CacheMetrics{
+			MemoryHits:      metrics.CacheMemoryHits,
+			DiskHits:        metrics.CacheDiskHits,
+			Misses:          metrics.CacheMisses,
+			MemoryEvictions: metrics.CacheMemoryEvictions,
+			MemoryEntries:   entries,
+			MemoryBytes:     bytes,
+		}
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -467,29 +639,50 @@ func buildEdgeTypes(et *EdgeTypes) string {
 	return strings.Join(types, ",")
 }
 
-// Find part file in LDraw library
+// Part numbers are LDraw file names without ".dat", optionally under a
+// subdirectory of parts/ or p/ ("s/3001s01", "48/1-4cyli"). Each path
+// element starts with a letter or digit, which rules out "..", hidden
+// files, and absolute paths.
+var partNumberPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*(?:/[A-Za-z0-9][A-Za-z0-9_.-]*)*$`)
+
+const maxPartNumberLength = 64
+
+// Check a part number and return it with LDraw's backslash separators (as
+// in subpart references like "s\3001s01") turned into slashes
+func cleanPartNumber(partNumber string) (string, bool) {
+	partNumber = strings.ReplaceAll(partNumber, `\`, "/")
+	if len(partNumber) > maxPartNumberLength || !partNumberPattern.MatchString(partNumber) {
+		return "", false
+	}
+	return partNumber, true
+}
+
+// Find part file in LDraw library. Invalid part numbers, and files that
+// resolve (through symlinks) outside the library, are never found.
 func findPartFile(partNumber string) string {
+	return findLibraryPart(ldrawPath, partNumber)
+}
+
+// Find a part's file in the library at root
+func findLibraryPart(root, partNumber string) string {
+	partNumber, ok := cleanPartNumber(partNumber)
+	if !ok {
+		return ""
+	}
 	variations := []string{
 		partNumber + ".dat",
 		strings.ToLower(partNumber) + ".dat",
 		strings.ToUpper(partNumber) + ".dat",
 	}
 
-	// Check parts/ directory
-	partsDir := filepath.Join(ldrawPath, "parts")
-	for _, variant := range variations {
-		path := filepath.Join(partsDir, variant)
-		if _, err := os.Stat(path); err == nil {
-			return path
-		}
-	}
-
-	// Check p/ directory (primitives)
-	pDir := filepath.Join(ldrawPath, "p")
-	for _, variant := range variations {
-		path := filepath.Join(pDir, variant)
-		if _, err := os.Stat(path); err == nil {
-			return path
+	// Check parts/ directory, then p/ (primitives)
+	for _, dir := range []string{"parts", "p"} {
+		dir = filepath.Join(root, dir)
+		for _, variant := range variations {
+			path := filepath.Join(dir, filepath.FromSlash(variant))
+			if info, err := os.Stat(path); err == nil && info.Mode().IsRegular() && insideDir(dir, path) {
+				return path
+			}
 		}
 	}
 
@@ -498,13 +691,12 @@ func findPartFile(partNumber string) string {
 
 // Helper: send JSON error response
 func sendError(w http.ResponseWriter, statusCode int, message, detail string) {
+	sendErrorResponse(w, statusCode, ErrorResponse{Error: message, Detail: detail})
+}
+
+func sendErrorResponse(w http.ResponseWriter, statusCode int, response ErrorResponse) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(statusCode)
-
-	response := ErrorResponse{
-		Error:  message,
-		Detail: detail,
-	}
 	json.NewEncoder(w).Encode(response)
 }
 
@@ -515,3 +707,25 @@ func getEnv(key, defaultValue string) string {
 	}
 	return defaultValue
 }
+
+// Helper: get integer environment variable with default
+func getEnvInt(key string, defaultValue int) int {
+	if value := os.Getenv(key); value != "" {
+		if n, err := strconv.Atoi(value); err == nil {
+			return n
+		}
+		log.Printf("Ignoring invalid %s=%q", key, value)
+	}
+	return defaultValue
+}
+
+// Helper: get a duration environment variable ("30s", "5m") with default
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	if value := os.Getenv(key); value != "" {
+		if d, err := time.ParseDuration(value); err == nil && d > 0 {
+			return d
+		}
+		log.Printf("Ignoring invalid %s=%q", key, value)
+	}
+	return defaultValue
+}
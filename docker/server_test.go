@@ -107,3 +107,75 @@ func TestRenderGoldenFiles(t *testing.T) {
 		})
 	}
 }
+
+func TestCleanPartNumber(t *testing.T) {
+	valid := map[string]string{
+		"3001":         "3001",
+		"973pb1234c01": "973pb1234c01",
+		"4-4cyli":      "4-4cyli",
+		`s\3001s01`:    "s/3001s01",
+		"48/1-4cyli":   "48/1-4cyli",
+		"u9001_x.1":    "u9001_x.1",
+	}
+	for in, want := range valid {
+		if got, ok := cleanPartNumber(in); !ok || got != want {
+			t.Errorf("cleanPartNumber(%q) = %q, %v; want %q", in, got, ok, want)
+		}
+	}
+	for _, in := range []string{
+		"",
+		"../../etc/passwd",
+		`..\..\etc\passwd`,
+		"/etc/passwd",
+		`\etc\passwd`,
+		"s/../../../etc/passwd",
+		"s/./3001",
+		".hidden",
+		"s//3001",
+		"3001/",
+		"3001\x00",
+		"3001 ",
+		"C:3001",
+		"%2e%2e/etc",
+		strings.Repeat("a", maxPartNumberLength+1),
+	} {
+		if got, ok := cleanPartNumber(in); ok {
+			t.Errorf("cleanPartNumber(%q) accepted as %q", in, got)
+		}
+	}
+}
+
+func TestFindPartFileStaysInLibrary(t *testing.T) {
+	dir := withTestLibrary(t, map[string]string{"3001": "0 Brick 2 x 4\n", "s/3001s01": "0 ~Subpart\n"})
+	outside := t.TempDir()
+	os.WriteFile(filepath.Join(outside, "secret.dat"), []byte("0 secret\n"), 0o644)
+	os.WriteFile(filepath.Join(dir, "secret.dat"), []byte("0 secret\n"), 0o644)
+	os.Symlink(filepath.Join(outside, "secret.dat"), filepath.Join(dir, "parts", "escape.dat"))
+	os.Symlink(outside, filepath.Join(dir, "parts", "linked"))
+
+	if got := findPartFile("3001"); got != filepath.Join(dir, "parts", "3001.dat") {
+		t.Errorf("findPartFile(3001) = %q", got)
+	}
+	if got := findPartFile(`s\3001s01`); got != filepath.Join(dir, "parts", "s", "3001s01.dat") {
+		t.Errorf(`findPartFile(s\3001s01) = %q`, got)
+	}
+	for _, in := range []string{"../secret", "../../" + filepath.Base(outside) + "/secret", filepath.Join(outside, "secret"), "escape", "linked/secret", "s"} {
+		if got := findPartFile(in); got != "" {
+			t.Errorf("findPartFile(%q) = %q, expected not found", in, got)
+		}
+	}
+}
+
+func TestRenderRejectsInvalidPartNumber(t *testing.T) {
+	withTestLibrary(t, nil)
+	rec := httptest.NewRecorder()
+	handleRender(rec, httptest.NewRequest(http.MethodPost, "/render", strings.NewReader(`{"partNumber":"../../etc/passwd"}`)))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d: %s", rec.Code, rec.Body)
+	}
+	var resp ErrorResponse
+	json.NewDecoder(rec.Body).Decode(&resp)
+	if resp.Error != "Invalid partNumber" {
+		t.Errorf("unexpected error %+v", resp)
+	}
+}
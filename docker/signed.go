@@ -0,0 +1,169 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Signed URLs let a backend hand browsers links to specific renders without
+// the browser being able to ask for anything else. A link carries its
+// render options, an expiry, and an HMAC-SHA256 signature over both made
+// with URL_SIGNING_KEY:
+//
+//	/s/{part}.svg?params=<base64url JSON>&expires=<unix seconds>&signature=<hex>
+//
+// The signature covers "GET\n" + path + "\n" + expires + "\n" + params, so
+// backends can mint links themselves or call POST /admin/sign.
+var urlSigningKey = getEnv("URL_SIGNING_KEY", "")
+
+const (
+	defaultSignedTTL = time.Hour
+	maxSignedTTL     = 365 * 24 * time.Hour
+)
+
+type SignRequest struct {
+	Render RenderRequest `json:"render"`
+	// ExpiresIn is the link lifetime in seconds (default 3600)
+	ExpiresIn int `json:"expiresIn"`
+}
+
+type SignResponse struct {
+	URL       string    `json:"url"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+func signRenderURL(key, path, expires, params string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	fmt.Fprintf(mac, "GET\n%s\n%s\n%s", path, expires, params)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Build a signed URL for a render request that expires at the given time
+func signedRenderURL(key string, req RenderRequest, expires time.Time) string {
+	path := "/s/" + url.PathEscape(req.PartNumber) + ".svg"
+	req.PartNumber = ""
+	data, _ := json.Marshal(req)
+	params := base64.RawURLEncoding.EncodeToString(data)
+	exp := strconv.FormatInt(expires.Unix(), 10)
+
+	q := url.Values{}
+	q.Set("params", params)
+	q.Set("expires", exp)
+	q.Set("signature", signRenderURL(key, path, exp, params))
+	return path + "?" + q.Encode()
+}
+
+// Check a signed request and return the render request it carries
+func verifySignedRender(key string, r *http.Request, now time.Time) (RenderRequest, *RenderError) {
+	var req RenderRequest
+	q := r.URL.Query()
+	params, exp, sig := q.Get("params"), q.Get("expires"), q.Get("signature")
+
+	want := signRenderURL(key, r.URL.EscapedPath(), exp, params)
+	if !hmac.Equal([]byte(sig), []byte(want)) {
+		return req, &RenderError{http.StatusForbidden, "Invalid signature", ""}
+	}
+	expires, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil || now.Unix() > expires {
+		return req, &RenderError{http.StatusForbidden, "Link expired", ""}
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(params)
+	if err == nil {
+		err = json.Unmarshal(data, &req)
+	}
+	if err != nil {
+		return req, &RenderError{http.StatusBadRequest, "Invalid params", err.Error()}
+	}
+	req.PartNumber, _ = strings.CutSuffix(r.PathValue("file"), ".svg")
+	return req, nil
+}
+
+// Signed render endpoint
+func handleSignedRender(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		sendError(w, http.StatusMethodNotAllowed, "Method not allowed", "")
+		return
+	}
+	if urlSigningKey == "" {
+		sendError(w, http.StatusForbidden, "Signed URLs are disabled", "Set URL_SIGNING_KEY to enable them")
+		return
+	}
+	if !strings.HasSuffix(r.PathValue("file"), ".svg") {
+		sendError(w, http.StatusNotFound, "Not found", "Signed renders are served as /s/{part}.svg")
+		return
+	}
+
+	now := time.Now()
+	req, rerr := verifySignedRender(urlSigningKey, r, now)
+	if rerr != nil {
+		sendRenderError(w, rerr)
+		return
+	}
+	opts, err := req.options()
+	if err != nil {
+		sendValidationError(w, err)
+		return
+	}
+
+	setPartHeaders(w, req.PartNumber, opts)
+	svg, renderDuration, cacheKey, err := renderPartKeyed(r.Context(), req.PartNumber, opts)
+	if err != nil {
+		sendRenderError(w, err)
+		return
+	}
+	log.Printf("Total request duration: %.2fs", time.Since(now).Seconds())
+
+	// Shared caches may keep the response until the link expires, no longer
+	expires, _ := strconv.ParseInt(r.URL.Query().Get("expires"), 10, 64)
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", max(expires-now.Unix(), 0)))
+	sendRender(w, r, svg, renderDuration, cacheKey)
+}
+
+// Sign endpoint: mint a signed URL for a render
+func handleSign(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		sendError(w, http.StatusMethodNotAllowed, "Method not allowed", "")
+		return
+	}
+	if urlSigningKey == "" {
+		sendError(w, http.StatusConflict, "Signed URLs are disabled", "Set URL_SIGNING_KEY to enable them")
+		return
+	}
+
+	var req SignRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	var errs fieldErrors
+	if req.Render.PartNumber == "" {
+		errs.add("render.partNumber", "render.partNumber is required")
+	}
+	_, err := req.Render.options()
+	errs.merge("render", err)
+	ttl := defaultSignedTTL
+	if req.ExpiresIn != 0 {
+		ttl = time.Duration(req.ExpiresIn) * time.Second
+	}
+	if ttl <= 0 || ttl > maxSignedTTL {
+		errs.add("expiresIn", "expiresIn must be between 1 second and 365 days")
+	}
+	if err := errs.err(); err != nil {
+		sendValidationError(w, err)
+		return
+	}
+
+	expires := time.Now().Add(ttl).Truncate(time.Second)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(SignResponse{signedRenderURL(urlSigningKey, req.Render, expires), expires.UTC()})
+}
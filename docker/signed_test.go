@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func withSigningKey(t *testing.T, key string) {
+	t.Helper()
+	old := urlSigningKey
+	urlSigningKey = key
+	t.Cleanup(func() { urlSigningKey = old })
+}
+
+func TestSignedRender(t *testing.T) {
+	capture := withFakeBlender(t)
+	withTestLibrary(t, map[string]string{"3001": "0 Brick 2 x 4\n"})
+	withSigningKey(t, "secret")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/s/{file}", handleSignedRender)
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w
+	}
+
+	link := signedRenderURL("secret", RenderRequest{PartNumber: "3001", Thickness: 4}, time.Now().Add(time.Minute))
+	w := get(link)
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET %s: %d %s", link, w.Code, w.Body)
+	}
+	if cc := w.Header().Get("Cache-Control"); !strings.HasPrefix(cc, "public, max-age=") || strings.Contains(cc, "immutable") {
+		t.Errorf("caching should end with the link, got %q", cc)
+	}
+	var args map[string]string
+	data, _ := os.ReadFile(capture)
+	json.Unmarshal(data, &args)
+	if args["thickness"] != "4.0" {
+		t.Errorf("rendered with thickness %q", args["thickness"])
+	}
+
+	u, _ := url.Parse(link)
+	tampered := func(f func(q url.Values)) string {
+		q := u.Query()
+		f(q)
+		return u.Path + "?" + q.Encode()
+	}
+	for name, path := range map[string]string{
+		"other part":   strings.Replace(link, "/s/3001.svg", "/s/3003.svg", 1),
+		"other params": tampered(func(q url.Values) { q.Set("params", "e30") }),
+		"later expiry": tampered(func(q url.Values) { q.Set("expires", "99999999999") }),
+		"wrong key":    signedRenderURL("other", RenderRequest{PartNumber: "3001"}, time.Now().Add(time.Minute)),
+		"expired":      signedRenderURL("secret", RenderRequest{PartNumber: "3001"}, time.Now().Add(-time.Minute)),
+		"unsigned":     "/s/3001.svg",
+	} {
+		if w := get(path); w.Code != http.StatusForbidden {
+			t.Errorf("%s: expected 403, got %d", name, w.Code)
+		}
+	}
+
+	withSigningKey(t, "")
+	if w := get(link); w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "disabled") {
+		t.Errorf("expected signed URLs to be disabled, got %d %s", w.Code, w.Body)
+	}
+}
+
+func TestHandleSign(t *testing.T) {
+	withSigningKey(t, "secret")
+	sign := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handleSign(w, httptest.NewRequest(http.MethodPost, "/admin/sign", strings.NewReader(body)))
+		return w
+	}
+
+	w := sign(`{"render": {"partNumber": "3001", "fillColor": "red"}, "expiresIn": 60}`)
+	var resp SignResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if w.Code != http.StatusOK || !strings.HasPrefix(resp.URL, "/s/3001.svg?") {
+		t.Fatalf("unexpected response %d %s", w.Code, w.Body)
+	}
+	if d := time.Until(resp.ExpiresAt); d < 50*time.Second || d > 61*time.Second {
+		t.Errorf("expiry %v is not a minute away", resp.ExpiresAt)
+	}
+
+	u, _ := url.Parse(resp.URL)
+	r := httptest.NewRequest(http.MethodGet, resp.URL, nil)
+	r.SetPathValue("file", "3001.svg")
+	req, rerr := verifySignedRender("secret", r, time.Now())
+	if rerr != nil || req.PartNumber != "3001" || req.FillColor != "red" {
+		t.Errorf("minted URL %s did not verify: %+v %v", u, req, rerr)
+	}
+
+	for _, body := range []string{`{"render": {}}`, `{"render": {"partNumber": "3001", "thickness": 99}}`, `{"render": {"partNumber": "3001"}, "expiresIn": -5}`} {
+		if w := sign(body); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", body, w.Code)
+		}
+	}
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Instruction page layout in SVG user units (px)
+const (
+	stepPageMargin     = 24.0
+	stepPageHeader     = 48.0
+	stepImageSize      = 800.0
+	stepCalloutThumb   = 72.0
+	stepCalloutCell    = 96.0
+	stepCalloutLabel   = 20.0
+	stepCalloutPadding = 12.0
+	stepMaxSteps       = 200
+)
+
+type StepsRequest struct {
+	Title string `json:"title"`
+	// HighlightNewParts adds a callout listing the parts added in each
+	// step (default true)
+	HighlightNewParts *bool `json:"highlightNewParts"`
+	// Render holds the render options for step images
+	Render *RenderRequest `json:"render"`
+	// Submodel names an MPD submodel to build instead of the main model
+	Submodel string `json:"submodel"`
+}
+
+// instructionModel is a model split at its STEP meta commands. Only the
+// main file is split; submodels are added whole in the step that places them.
+type instructionModel struct {
+	// mainName is the main file's MPD name, or "" for a plain LDR file
+	mainName string
+	steps    []modelStep
+	// subfiles holds the MPD text following the main file
+	subfiles string
+}
+
+type modelStep struct {
+	lines []string
+	// views holds the ROTSTEP view changes applied at this step, in order
+	views []stepRotation
+}
+
+// Instructions endpoint: upload a model and render one page per step
+func handleRenderSteps(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		sendError(w, http.StatusMethodNotAllowed, "Method not allowed", "")
+		return
+	}
+
+	data, err := readUpload(w, r, modelMaxBytes)
+	if err != nil {
+		sendError(w, http.StatusBadRequest, "Invalid upload", err.Error())
+		return
+	}
+	if len(data) == 0 {
+		sendError(w, http.StatusBadRequest, "Model file is required", "")
+		return
+	}
+
+	var req StepsRequest
+	if opts := r.FormValue("options"); opts != "" {
+		if err := json.Unmarshal([]byte(opts), &req); err != nil {
+			sendError(w, http.StatusBadRequest, "Invalid options JSON", err.Error())
+			return
+		}
+	}
+	render := RenderRequest{}
+	if req.Render != nil {
+		render = *req.Render
+	}
+	opts, err := render.options()
+	if err != nil {
+		sendValidationError(w, err)
+		return
+	}
+	thumbOpts, err := thumbnailOptions(render)
+	if err != nil {
+		sendError(w, http.StatusBadRequest, err.Error(), "")
+		return
+	}
+	highlight := req.HighlightNewParts == nil || *req.HighlightNewParts
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "pdf"
+	}
+	if format != "pdf" && format != "zip" && format != "svg" {
+		sendError(w, http.StatusBadRequest, "format must be pdf, zip, or svg", "")
+		return
+	}
+
+	normalized, modelFormat, err := normalizeModel(data)
+	if err != nil {
+		sendError(w, http.StatusBadRequest, "Unsupported model file", err.Error())
+		return
+	}
+	if req.Submodel != "" {
+		if normalized, err = selectSubmodel(normalized, req.Submodel); err != nil {
+			sendRenderError(w, err)
+			return
+		}
+	}
+	model := parseSteps(normalized)
+	total := len(model.steps)
+	if total == 0 {
+		sendError(w, http.StatusUnprocessableEntity, "Model contains no parts", "")
+		return
+	}
+	if total > stepMaxSteps {
+		sendError(w, http.StatusBadRequest, fmt.Sprintf("Model has %d steps; at most %d are supported", total, stepMaxSteps), "")
+		return
+	}
+
+	// SVG output is a single step page; PDF and ZIP contain every step
+	first, last := 0, total
+	if format == "svg" {
+		step := 1
+		if s := r.URL.Query().Get("step"); s != "" {
+			if step, err = strconv.Atoi(s); err != nil {
+				sendError(w, http.StatusBadRequest, "step must be an integer", "")
+				return
+			}
+		}
+		if step < 1 || step > total {
+			sendError(w, http.StatusBadRequest, fmt.Sprintf("step must be between 1 and %d", total), "")
+			return
+		}
+		first, last = step-1, step
+	}
+
+	start := time.Now()
+	views := model.stepViews(opts)
+	var pages [][]byte
+	for i := first; i < last; i++ {
+		page, err := renderStepPage(r.Context(), model, i, req.Title, views[i], thumbOpts, highlight)
+		if err != nil {
+			if r.Context().Err() != nil {
+				log.Printf("Step rendering cancelled: %v", r.Context().Err())
+				return
+			}
+			sendRenderError(w, err)
+			return
+		}
+		pages = append(pages, page)
+	}
+	log.Printf("Instructions for uploaded %s model: %d of %d steps in %.2fs", modelFormat, len(pages), total, time.Since(start).Seconds())
+
+	w.Header().Set("X-Model-Format", modelFormat)
+	w.Header().Set("X-Total-Steps", strconv.Itoa(total))
+
+	switch format {
+	case "svg":
+		w.Header().Set("Content-Type", "image/svg+xml")
+		writeSVG(w, r, pages[0])
+	case "zip":
+		var buf bytes.Buffer
+		zw := zip.NewWriter(&buf)
+		for i, page := range pages {
+			f, err := zw.Create(fmt.Sprintf("step-%03d.svg", i+1))
+			if err != nil {
+				sendError(w, http.StatusInternalServerError, "Failed to build archive", err.Error())
+				return
+			}
+			f.Write(page)
+		}
+		if err := zw.Close(); err != nil {
+			sendError(w, http.StatusInternalServerError, "Failed to build archive", err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", `attachment; filename="instructions.zip"`)
+		w.Write(buf.Bytes())
+	case "pdf":
+		pdf, err := convertSVG(r.Context(), "pdf", pages)
+		if err != nil {
+			log.Printf("Instructions PDF conversion failed: %v", err)
+			sendError(w, http.StatusInternalServerError, "PDF conversion failed", err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/pdf")
+		w.Write(pdf)
+	}
+}
+
+// Thumbnail render options: the step render options at contact sheet size
+func thumbnailOptions(render RenderRequest) (RenderOptions, error) {
+	thumbRes := 256
+	render.ResolutionX = &thumbRes
+	render.ResolutionY = &thumbRes
+	return render.options()
+}
+
+// Render step i (zero-based) with all geometry placed so far, plus a
+// callout of the parts it adds
+func renderStepPage(ctx context.Context, model instructionModel, i int, title string, opts, thumbOpts RenderOptions, highlight bool) ([]byte, error) {
+	modelFile, ghostFile, _, cleanup, err := writeModelFile(model.stepModel(0, i+1), nil)
+	if err != nil {
+		return nil, &RenderError{http.StatusInternalServerError, "Failed to write model", err.Error()}
+	}
+	defer cleanup()
+	opts.GhostFile = ghostFile
+
+	svg, _, err := renderFile(ctx, fmt.Sprintf("step %d/%d", i+1, len(model.steps)), modelFile, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var callout []InventoryItem
+	var thumbs map[string]thumbnail
+	if highlight {
+		callout = extractBOM(model.stepModel(i, i+1)).items()
+		thumbs = renderItems(ctx, callout, thumbOpts)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+	}
+	return buildStepPage(title, i+1, len(model.steps), svg, callout, thumbs, thumbOpts), nil
+}
+
+// Split a normalized model into steps. A step ends at each STEP or ROTSTEP
+// meta command; a ROTSTEP also sets the view for the step it ends. Steps
+// that don't change the model are dropped.
+func parseSteps(model []byte) instructionModel {
+	var m instructionModel
+	var current []string
+	inMain := !isMPD(model)
+	mainDone := false
+	var rest strings.Builder
+
+	// View changes from ROTSTEPs that ended an empty step apply to the
+	// next step with geometry
+	var pending []stepRotation
+	flush := func(rot *stepRotation) {
+		if rot != nil {
+			pending = append(pending, *rot)
+		}
+		switch {
+		case changesModel(current):
+			m.steps = append(m.steps, modelStep{lines: current, views: pending})
+			pending = nil
+		case len(m.steps) > 0:
+			// Keep meta lines from an empty step with the previous step
+			last := &m.steps[len(m.steps)-1]
+			last.lines = append(last.lines, current...)
+		default:
+			// Header lines before the first part carry into step 1
+			return
+		}
+		current = nil
+	}
+
+	for _, line := range strings.Split(string(model), "\n") {
+		fields := strings.Fields(line)
+		isMeta := len(fields) >= 2 && fields[0] == "0"
+
+		if isMeta && (fields[1] == "FILE" || fields[1] == "NOFILE") {
+			if inMain {
+				flush(nil)
+				inMain, mainDone = false, true
+				if fields[1] == "NOFILE" {
+					continue
+				}
+			} else if !mainDone && fields[1] == "FILE" {
+				m.mainName = strings.Join(fields[2:], " ")
+				inMain = true
+				continue
+			}
+		}
+		if !inMain {
+			if mainDone {
+				rest.WriteString(line)
+				rest.WriteByte('\n')
+			}
+			continue
+		}
+		if isMeta && fields[1] == "STEP" {
+			flush(nil)
+			continue
+		}
+		if isMeta && fields[1] == "ROTSTEP" {
+			rot, ok := parseRotStep(fields[2:])
+			if !ok {
+				log.Printf("Ignoring malformed ROTSTEP: %s", strings.TrimSpace(line))
+				flush(nil)
+				continue
+			}
+			flush(&rot)
+			continue
+		}
+		current = append(current, line)
+	}
+	if inMain {
+		flush(nil)
+	}
+	m.subfiles = rest.String()
+	return m
+}
+
+// A step changes the model if it places geometry, ghosted or not, or
+// retrieves a buffer to remove a temporary assembly
+func changesModel(lines []string) bool {
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) > 0 && strings.Contains("12345", fields[0]) && len(fields[0]) == 1 {
+			return true
+		}
+		if len(fields) >= 3 && fields[0] == "0" && fields[1] == "GHOST" {
+			return true
+		}
+		if len(fields) >= 4 && fields[0] == "0" && fields[1] == "BUFEXCHG" && strings.EqualFold(fields[3], "RETRIEVE") {
+			return true
+		}
+	}
+	return false
+}
+
+// Build a standalone model containing the lines of steps [from, to)
+func (m instructionModel) stepModel(from, to int) []byte {
+	var b strings.Builder
+	if m.mainName != "" {
+		fmt.Fprintf(&b, "0 FILE %s\n", m.mainName)
+	}
+	for _, step := range m.steps[from:to] {
+		for _, line := range step.lines {
+			b.WriteString(line)
+			b.WriteByte('\n')
+		}
+	}
+	if m.mainName != "" {
+		b.WriteString("0 NOFILE\n")
+		b.WriteString(m.subfiles)
+	}
+	return []byte(b.String())
+}
+
+// Build one instruction page as an SVG document
+func buildStepPage(title string, step, totalSteps int, image []byte, callout []InventoryItem, thumbs map[string]thumbnail, thumbOpts RenderOptions) []byte {
+	width := 2*stepPageMargin + stepImageSize
+	perRow := int(math.Floor((stepImageSize - 2*stepCalloutPadding) / stepCalloutCell))
+	calloutHeight := 0.0
+	if len(callout) > 0 {
+		rows := (len(callout) + perRow - 1) / perRow
+		calloutHeight = 2*stepCalloutPadding + float64(rows)*(stepCalloutThumb+stepCalloutLabel) + stepPageMargin
+	}
+	height := 2*stepPageMargin + stepPageHeader + calloutHeight + stepImageSize
+
+	var b strings.Builder
+	b.WriteString(svgDocumentStart(width, height))
+	fmt.Fprintf(&b, `<rect width="100%%" height="100%%" fill="white" />`+"\n")
+	fmt.Fprintf(&b, `<text x="%g" y="%g" font-family="sans-serif" font-size="28" font-weight="bold" fill="black">%d</text>`+"\n",
+		stepPageMargin, stepPageMargin+28, step)
+	if title != "" {
+		fmt.Fprintf(&b, `<text x="%g" y="%g" font-family="sans-serif" font-size="14" fill="#666666" text-anchor="middle">%s</text>`+"\n",
+			width/2, stepPageMargin+24, escapeXML(title))
+	}
+	fmt.Fprintf(&b, `<text x="%g" y="%g" font-family="sans-serif" font-size="12" fill="#666666" text-anchor="end">Step %d of %d</text>`+"\n",
+		width-stepPageMargin, stepPageMargin+24, step, totalSteps)
+
+	y := stepPageMargin + stepPageHeader
+	if len(callout) > 0 {
+		boxHeight := calloutHeight - stepPageMargin
+		fmt.Fprintf(&b, `<rect x="%g" y="%g" width="%g" height="%g" rx="8" fill="#f4f4f4" stroke="#999999" />`+"\n",
+			stepPageMargin, y, stepImageSize, boxHeight)
+		for i, item := range callout {
+			x := stepPageMargin + stepCalloutPadding + float64(i%perRow)*stepCalloutCell
+			cy := y + stepCalloutPadding + float64(i/perRow)*(stepCalloutThumb+stepCalloutLabel)
+			thumb := thumbs[itemKey(item, thumbOpts)]
+			if thumb.err == nil && thumb.svg != nil {
+				b.WriteString(embedSVG(thumb.svg, x+(stepCalloutCell-stepCalloutThumb)/2, cy, stepCalloutThumb, stepCalloutThumb))
+				b.WriteString("\n")
+			} else {
+				fmt.Fprintf(&b, `<text x="%g" y="%g" font-family="sans-serif" font-size="11" fill="#cc0000" text-anchor="middle">%s</text>`+"\n",
+					x+stepCalloutCell/2, cy+stepCalloutThumb/2, escapeXML(item.PartNumber))
+			}
+			fmt.Fprintf(&b, `<text x="%g" y="%g" font-family="sans-serif" font-size="13" font-weight="bold" fill="black" text-anchor="middle">%d×</text>`+"\n",
+				x+stepCalloutCell/2, cy+stepCalloutThumb+14, item.Quantity)
+		}
+		y += calloutHeight
+	}
+
+	b.WriteString(embedSVG(image, stepPageMargin, y, stepImageSize, stepImageSize))
+	b.WriteString("\n</svg>\n")
+	return []byte(b.String())
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const testStepsMPD = `0 FILE house.ldr
+0 House
+0 Name: house.ldr
+1 4 0 0 0 1 0 0 0 1 0 0 0 1 3001.dat
+1 4 40 0 0 1 0 0 0 1 0 0 0 1 3001.dat
+0 STEP
+0 STEP
+1 15 0 -24 0 1 0 0 0 1 0 0 0 1 roof.ldr
+0 ROTSTEP 0 90 0 REL
+1 1 0 -48 0 1 0 0 0 1 0 0 0 1 3003.dat
+0 STEP
+0 NOFILE
+0 FILE roof.ldr
+1 16 0 0 0 1 0 0 0 1 0 0 0 1 3003.dat
+0 STEP
+1 16 0 0 0 1 0 0 0 1 0 0 0 1 3003.dat
+0 NOFILE
+`
+
+func TestParseSteps(t *testing.T) {
+	m := parseSteps([]byte(testStepsMPD))
+	if m.mainName != "house.ldr" {
+		t.Errorf("unexpected main name %q", m.mainName)
+	}
+	if len(m.steps) != 3 {
+		t.Fatalf("expected 3 steps, got %d", len(m.steps))
+	}
+	if !strings.Contains(m.steps[0].lines[0], "0 House") {
+		t.Errorf("header should carry into step 1: %v", m.steps[0].lines)
+	}
+
+	// Submodels are placed whole, so their own STEPs don't split the main model
+	cumulative := string(m.stepModel(0, 2))
+	if !strings.HasPrefix(cumulative, "0 FILE house.ldr\n") || !strings.Contains(cumulative, "roof.ldr") ||
+		strings.Contains(cumulative, "1 1 0 -48") || !strings.Contains(cumulative, "0 FILE roof.ldr") {
+		t.Errorf("unexpected cumulative model:\n%s", cumulative)
+	}
+	if strings.Contains(cumulative, "3003.dat\n0 STEP\n0 NOFILE\n0 NOFILE") {
+		t.Errorf("duplicate NOFILE in cumulative model:\n%s", cumulative)
+	}
+
+	added := extractBOM(m.stepModel(1, 2))
+	if len(added.Parts) != 1 || added.Parts[0].PartNumber != "3003" || added.Parts[0].Quantity != 2 || added.Parts[0].Color != 15 {
+		t.Errorf("unexpected parts added in step 2: %+v", added.Parts)
+	}
+}
+
+func TestParseStepsPlainLDR(t *testing.T) {
+	m := parseSteps([]byte("0 Two bricks\n1 4 0 0 0 1 0 0 0 1 0 0 0 1 3001.dat\n0 STEP\n1 4 0 -24 0 1 0 0 0 1 0 0 0 1 3001.dat\n0 STEP\n"))
+	if m.mainName != "" || len(m.steps) != 2 {
+		t.Fatalf("expected 2 plain steps, got %+v", m)
+	}
+	if got := string(m.stepModel(0, 2)); strings.Contains(got, "FILE") || strings.Count(got, "3001.dat") != 2 {
+		t.Errorf("unexpected cumulative model:\n%s", got)
+	}
+}
+
+func TestRenderStepsSVG(t *testing.T) {
+	withFakeBlender(t)
+	withTestLibrary(t, map[string]string{"3001": "0 Brick 2 x 4\n", "3003": "0 Brick 2 x 2\n"})
+
+	req := httptest.NewRequest(http.MethodPost, "/render/model/steps?format=svg&step=3", strings.NewReader(testStepsMPD))
+	rec := httptest.NewRecorder()
+	handleRenderSteps(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if got := rec.Header().Get("X-Total-Steps"); got != "3" {
+		t.Errorf("X-Total-Steps: got %q", got)
+	}
+	body := rec.Body.String()
+	if !strings.Contains(body, "Step 3 of 3") || !strings.Contains(body, "1×") {
+		t.Errorf("page is missing the step label or callout:\n%s", body)
+	}
+	dec := xml.NewDecoder(strings.NewReader(body))
+	for {
+		if _, err := dec.Token(); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("page is not well-formed: %v", err)
+		}
+	}
+}
+
+func TestRenderStepsRejectsBadStep(t *testing.T) {
+	withTestLibrary(t, nil)
+	req := httptest.NewRequest(http.MethodPost, "/render/model/steps?format=svg&step=9", strings.NewReader(testStepsMPD))
+	rec := httptest.NewRecorder()
+	handleRenderSteps(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400, got %d", rec.Code)
+	}
+}
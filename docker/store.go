@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Render results (cached renders and finished job outputs) live in a result
+// store. By default that's STATE_DIR on local disk, or nothing without it.
+// RESULT_STORE moves them to a bucket shared by every node:
+// s3://bucket/prefix for Amazon S3 or an S3-compatible server (S3_ENDPOINT),
+// and gs://bucket/prefix for Google Cloud Storage through its S3-compatible
+// XML API with HMAC keys. A path or file:// URL names another directory.
+var (
+	resultStoreURL = getEnv("RESULT_STORE", "")
+	s3Endpoint     = getEnv("S3_ENDPOINT", "")
+	awsRegion      = getEnv("AWS_REGION", "us-east-1")
+	// With a bucket store, job and batch results can be handed out as
+	// presigned URLs valid this long instead of being sent through the API
+	// node; unset sends the bytes
+	resultURLTTL = getEnvDuration("RESULT_URL_TTL", 0)
+)
+
+// SigV4 presigned URLs are valid for at most a week
+const maxResultURLTTL = 7 * 24 * time.Hour
+
+// What render results are kept in. Keys are slash-separated relative paths.
+type resultStore interface {
+	get(key string) ([]byte, error)
+	put(key string, data []byte, contentType string) error
+	has(key string) (bool, error)
+	remove(key string) error
+	// Where results are kept, for logs
+	String() string
+}
+
+// Stores that can hand clients a URL to download a result from directly
+type presigner interface {
+	presign(key string, ttl time.Duration) (string, error)
+}
+
+// The store for this node; nil when results aren't kept
+var results = newDefaultResultStore(stateDir)
+
+// Returned by get for keys that aren't stored
+var errNotStored = errors.New("not in result store")
+
+func newDefaultResultStore(stateDir string) resultStore {
+	if stateDir == "" {
+		return nil
+	}
+	return dirStore{dir: stateDir}
+}
+
+// Open the store named by RESULT_STORE at startup, replacing the default
+func validateResultStore() error {
+	if resultStoreURL != "" {
+		store, err := openResultStore(resultStoreURL)
+		if err != nil {
+			return err
+		}
+		results = store
+		renderCache = newRenderCache(store)
+	}
+	if resultURLTTL > 0 {
+		if _, ok := results.(presigner); !ok {
+			return errors.New("RESULT_URL_TTL needs an s3:// or gs:// RESULT_STORE")
+		}
+		if resultURLTTL > maxResultURLTTL {
+			return fmt.Errorf("RESULT_URL_TTL can be at most %s", maxResultURLTTL)
+		}
+	}
+	return nil
+}
+
+// Whether results are handed out as presigned URLs
+func presignedResults() bool {
+	_, ok := results.(presigner)
+	return ok && resultURLTTL > 0
+}
+
+// A presigned URL for a stored result, and when it stops working
+func resultURL(key string) (string, time.Time, error) {
+	expires := time.Now().Add(resultURLTTL).UTC().Truncate(time.Second)
+	u, err := results.(presigner).presign(key, resultURLTTL)
+	return u, expires, err
+}
+
+func openResultStore(rawURL string) (resultStore, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("RESULT_STORE: %w", err)
+	}
+	prefix := strings.Trim(u.Path, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	switch u.Scheme {
+	case "", "file":
+		if u.Path == "" {
+			return nil, errors.New("RESULT_STORE: no directory given")
+		}
+		return dirStore{dir: u.Path}, nil
+	case "s3":
+		if u.Host == "" {
+			return nil, errors.New("RESULT_STORE: no bucket given")
+		}
+		creds := s3Credentials{os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"), os.Getenv("AWS_SESSION_TOKEN")}
+		if creds.accessKey == "" || creds.secretKey == "" {
+			return nil, errors.New("RESULT_STORE: s3:// needs AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+		}
+		return newBucketStore(u.Scheme, u.Host, prefix, s3Endpoint, awsRegion, creds)
+	case "gs":
+		if u.Host == "" {
+			return nil, errors.New("RESULT_STORE: no bucket given")
+		}
+		creds := s3Credentials{accessKey: os.Getenv("GCS_HMAC_ACCESS_ID"), secretKey: os.Getenv("GCS_HMAC_SECRET")}
+		if creds.accessKey == "" || creds.secretKey == "" {
+			return nil, errors.New("RESULT_STORE: gs:// needs GCS_HMAC_ACCESS_ID and GCS_HMAC_SECRET")
+		}
+		return newBucketStore(u.Scheme, u.Host, prefix, "https://storage.googleapis.com", "auto", creds)
+	default:
+		return nil, fmt.Errorf("RESULT_STORE: unsupported scheme %q (want s3, gs, or a directory)", u.Scheme)
+	}
+}
+
+// A directory on local disk
+type dirStore struct {
+	dir string
+}
+
+func (s dirStore) path(key string) string {
+	return filepath.Join(s.dir, filepath.FromSlash(key))
+}
+
+func (s dirStore) get(key string) ([]byte, error) {
+	data, err := os.ReadFile(s.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errNotStored
+	}
+	return data, err
+}
+
+func (s dirStore) put(key string, data []byte, _ string) error {
+	return writeFileAtomic(s.path(key), data)
+}
+
+func (s dirStore) has(key string) (bool, error) {
+	_, err := os.Stat(s.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s dirStore) remove(key string) error {
+	err := os.Remove(s.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (s dirStore) String() string {
+	return s.dir
+}
+
+type s3Credentials struct {
+	accessKey, secretKey, sessionToken string
+}
+
+// An S3 bucket, or anything that speaks its API with Signature Version 4
+type bucketStore struct {
+	scheme, bucket, prefix string
+	// Objects are at base + key
+	base   *url.URL
+	region string
+	creds  s3Credentials
+	client *http.Client
+}
+
+// With no endpoint, AWS's regional virtual-hosted URLs are used; an
+// endpoint (MinIO, GCS) is addressed path-style
+func newBucketStore(scheme, bucket, prefix, endpoint, region string, creds s3Credentials) (*bucketStore, error) {
+	base := fmt.Sprintf("https://%s.s3.%s.amazonaws.com/", bucket, region)
+	if endpoint != "" {
+		base = strings.TrimSuffix(endpoint, "/") + "/" + bucket + "/"
+	}
+	u, err := url.Parse(base + prefix)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("bad storage endpoint %q", endpoint)
+	}
+	return &bucketStore{
+		scheme: scheme, bucket: bucket, prefix: prefix,
+		base: u, region: region, creds: creds,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+func (s *bucketStore) String() string {
+	return s.scheme + "://" + s.bucket + "/" + s.prefix
+}
+
+func (s *bucketStore) objectURL(key string) *url.URL {
+	u := *s.base
+	u.Path += key
+	return &u
+}
+
+func (s *bucketStore) do(method, key string, body []byte, contentType string) (*http.Response, error) {
+	req, err := http.NewRequest(method, s.objectURL(key).String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	signV4(req, body, s.region, s.creds, time.Now())
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 && resp.StatusCode != http.StatusNotFound {
+		defer resp.Body.Close()
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("%s %s: %s: %s", method, s.objectURL(key).Redacted(), resp.Status, bytes.TrimSpace(detail))
+	}
+	return resp, nil
+}
+
+func (s *bucketStore) get(key string) ([]byte, error) {
+	resp, err := s.do(http.MethodGet, key, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errNotStored
+	}
+	return io.ReadAll(resp.Body)
+}
+
+func (s *bucketStore) put(key string, data []byte, contentType string) error {
+	resp, err := s.do(http.MethodPut, key, data, contentType)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("bucket %s not found", s.bucket)
+	}
+	return nil
+}
+
+func (s *bucketStore) has(key string) (bool, error) {
+	resp, err := s.do(http.MethodHead, key, nil, "")
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode != http.StatusNotFound, nil
+}
+
+// Deleting a missing object succeeds
+func (s *bucketStore) remove(key string) error {
+	resp, err := s.do(http.MethodDelete, key, nil, "")
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *bucketStore) presign(key string, ttl time.Duration) (string, error) {
+	return presignV4(s.objectURL(key), http.MethodGet, s.region, s.creds, time.Now(), ttl), nil
+}
+
+const sigV4Algorithm = "AWS4-HMAC-SHA256"
+
+// Sign a request with AWS Signature Version 4, covering the host and every
+// header already set
+func signV4(req *http.Request, body []byte, region string, creds s3Credentials, now time.Time) {
+	now = now.UTC()
+	payloadHash := sha256Hex(body)
+	req.Header.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if creds.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.sessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	canonicalRequest, signedHeaders := sigV4CanonicalRequest(req.Method, req.URL, headers, payloadHash)
+	scope := sigV4Scope(now, region)
+	signature := sigV4Signature(creds.secretKey, now, region, scope, canonicalRequest)
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		sigV4Algorithm, creds.accessKey, scope, signedHeaders, signature))
+}
+
+// A URL anyone can fetch until ttl has passed, with the signature in its
+// query string. Only the host is signed, so any client can use it.
+func presignV4(u *url.URL, method, region string, creds s3Credentials, now time.Time, ttl time.Duration) string {
+	now = now.UTC()
+	scope := sigV4Scope(now, region)
+	signed := *u
+	query := signed.Query()
+	query.Set("X-Amz-Algorithm", sigV4Algorithm)
+	query.Set("X-Amz-Credential", creds.accessKey+"/"+scope)
+	query.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	query.Set("X-Amz-Expires", fmt.Sprint(int(ttl.Seconds())))
+	query.Set("X-Amz-SignedHeaders", "host")
+	if creds.sessionToken != "" {
+		query.Set("X-Amz-Security-Token", creds.sessionToken)
+	}
+	signed.RawQuery = sigV4Query(query)
+	canonicalRequest, _ := sigV4CanonicalRequest(method, &signed, map[string]string{"host": u.Host}, "UNSIGNED-PAYLOAD")
+	signed.RawQuery += "&X-Amz-Signature=" + sigV4Signature(creds.secretKey, now, region, scope, canonicalRequest)
+	return signed.String()
+}
+
+// The canonical form of a request, and the headers it signs
+func sigV4CanonicalRequest(method string, u *url.URL, headers map[string]string, payloadHash string) (string, string) {
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+	return strings.Join([]string{
+		method,
+		sigV4EscapePath(u.Path),
+		sigV4Query(u.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n"), signedHeaders
+}
+
+func sigV4Scope(now time.Time, region string) string {
+	return now.Format("20060102") + "/" + region + "/s3/aws4_request"
+}
+
+func sigV4Signature(secretKey string, now time.Time, region, scope, canonicalRequest string) string {
+	stringToSign := sigV4Algorithm + "\n" + now.Format("20060102T150405Z") + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+	key := hmacSHA256([]byte("AWS4"+secretKey), now.Format("20060102"))
+	for _, part := range []string{region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// URI-encode everything but unreserved characters, as SigV4 requires
+func sigV4Escape(s string) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-_.~", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func sigV4EscapePath(path string) string {
+	if path == "" {
+		return "/"
+	}
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		segments[i] = sigV4Escape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+func sigV4Query(query url.Values) string {
+	pairs := make([]string, 0, len(query))
+	for name, values := range query {
+		for _, value := range values {
+			pairs = append(pairs, sigV4Escape(name)+"="+sigV4Escape(value))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
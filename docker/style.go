@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+)
+
+// Styles are whole looks built on top of the render options: the colors
+// Blender draws with, plus post-processing of its output.
+//
+// blueprint draws white lines over blueprint-blue faces on a blue
+// background with a faint grid, like a technical drawing. sketch has
+// render_part.py draw hand-drawn lines with Freestyle modifiers: strokes
+// that wander by SketchJitter pixels, vary in weight, and overshoot their
+// corners. toon is cel shading like printed building instructions:
+// render_part.py also renders a raster of flat colors in ToonBands steps of
+// light, which goes under the outline in place of the flat fills.
+// wireframe has render_part.py draw every mesh edge in place of the edge
+// types, for part authors reviewing geometry; with a fill opacity below 1
+// the edges behind are drawn too, dimmed as for translucent parts.
+const (
+	blueprintBackground = "#1d4f91"
+	blueprintFill       = "#1d4f91"
+	blueprintStroke     = "#ffffff"
+	// Minor grid lines every blueprintGrid pixels, major ones every fifth
+	blueprintGrid = 32
+)
+
+var renderStyles = []string{"blueprint", "sketch", "toon", "wireframe"}
+
+// Lines wander this many pixels, and toon renders shade in this many
+// steps, unless the request says otherwise
+const (
+	defaultSketchJitter = 2.0
+	defaultToonBands    = 3
+)
+
+func validStyle(style string) bool {
+	for _, s := range renderStyles {
+		if s == style {
+			return true
+		}
+	}
+	return style == ""
+}
+
+// Fill in a style's colors where the request didn't choose its own
+func applyStyleDefaults(opts *RenderOptions, req *RenderRequest) {
+	switch opts.Style {
+	case "blueprint":
+		if req.FillColor == "" && req.Color == nil {
+			opts.FillColor = blueprintFill
+		}
+		if req.StrokeColor == "" {
+			opts.StrokeColor = blueprintStroke
+		}
+	case "sketch":
+		opts.SketchJitter = defaultSketchJitter
+	case "toon":
+		opts.ToonBands = defaultToonBands
+	}
+}
+
+// The line_style argument render_part.py takes for a style
+func scriptLineStyle(style string) string {
+	if style == "sketch" || style == "wireframe" {
+		return style
+	}
+	return "clean"
+}
+
+// The toon_bands argument render_part.py takes; it's ignored without a
+// raster but must still be in range
+func scriptToonBands(bands int) int {
+	if bands == 0 {
+		return defaultToonBands
+	}
+	return bands
+}
+
+// Apply a validated style to a rendered SVG, with the raster the script
+// rendered for it, if any
+func applyStyle(svg []byte, style string, raster []byte) []byte {
+	switch style {
+	case "blueprint":
+		return applyBlueprint(svg)
+	case "toon":
+		return applyToon(svg, raster)
+	}
+	return svg
+}
+
+// Embed the toon raster between the Edges fills and strokes, the way
+// hatching goes
+func applyToon(svg, raster []byte) []byte {
+	edges := bytes.Index(svg, []byte(`id="ViewLayer_Edges"`))
+	if raster == nil || edges < 0 {
+		return svg
+	}
+	strokes := svgStrokesGroupPattern.FindIndex(svg[edges:])
+	if strokes == nil {
+		return svg
+	}
+	at := edges + strokes[0]
+	image := `<image height="100%" href="data:image/png;base64,` + base64.StdEncoding.EncodeToString(raster) +
+		`" width="100%" x="0" y="0" />` + "\n"
+	out := make([]byte, 0, len(svg)+len(image))
+	out = append(out, svg[:at]...)
+	out = append(out, image...)
+	return append(out, svg[at:]...)
+}
+
+func applyBlueprint(svg []byte) []byte {
+	loc := svgRootPattern.FindIndex(svg)
+	if loc == nil {
+		return svg
+	}
+	minor, major := blueprintGrid, blueprintGrid*5
+	defs := fmt.Sprintf(`<defs><pattern id="blueprint-grid-minor" width="%d" height="%d" patternUnits="userSpaceOnUse">`+
+		`<path d="M %d 0 L 0 0 0 %d" fill="none" stroke="%s" stroke-opacity="0.12" stroke-width="1" /></pattern>`+
+		`<pattern id="blueprint-grid" width="%d" height="%d" patternUnits="userSpaceOnUse">`+
+		`<rect width="%d" height="%d" fill="url(#blueprint-grid-minor)" />`+
+		`<path d="M %d 0 L 0 0 0 %d" fill="none" stroke="%s" stroke-opacity="0.25" stroke-width="1.5" /></pattern></defs>`,
+		minor, minor, minor, minor, blueprintStroke,
+		major, major, major, major, major, major, blueprintStroke)
+	background := `<rect width="100%" height="100%" fill="` + blueprintBackground + `" />` +
+		`<rect width="100%" height="100%" fill="url(#blueprint-grid)" />`
+
+	// The grid replaces the render's own background, or goes under
+	// everything when it has none
+	if bg := svgBackgroundPattern.FindIndex(svg); bg != nil {
+		svg = append(svg[:bg[0]:bg[0]], append([]byte(background), svg[bg[1]:]...)...)
+		background = ""
+	}
+	out := make([]byte, 0, len(svg)+len(defs)+len(background)+2)
+	out = append(out, svg[:loc[1]]...)
+	out = append(out, '\n')
+	out = append(out, defs...)
+	out = append(out, background...)
+	return append(out, svg[loc[1]:]...)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBlueprintStyle(t *testing.T) {
+	req := RenderRequest{Style: "blueprint"}
+	opts, err := req.options()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.FillColor != blueprintFill || opts.StrokeColor != blueprintStroke {
+		t.Errorf("expected blueprint colors, got fill %s stroke %s", opts.FillColor, opts.StrokeColor)
+	}
+	// The request's own colors win
+	req = RenderRequest{Style: "blueprint", StrokeColor: "#ffcc00"}
+	if opts, _ := req.options(); opts.StrokeColor != "#ffcc00" || opts.FillColor != blueprintFill {
+		t.Errorf("expected the request's stroke over the style's, got %+v", opts)
+	}
+
+	svg := string(applyStyle([]byte(`<svg xmlns="http://www.w3.org/2000/svg" width="64" height="64">
+    <rect width="100%" height="100%" fill="white" /><g><path fill="none" stroke="#ffffff" d="M 0 0 L 1 1" /></g>
+</svg>`), "blueprint", nil))
+	if strings.Contains(svg, `fill="white"`) || !strings.Contains(svg, `<rect width="100%" height="100%" fill="`+blueprintBackground+`" />`) {
+		t.Errorf("expected the background turned blue:\n%s", svg)
+	}
+	grid := strings.Index(svg, `fill="url(#blueprint-grid)"`)
+	if grid < 0 || grid > strings.Index(svg, "<g>") || !strings.Contains(svg, `<pattern id="blueprint-grid"`) {
+		t.Errorf("expected a grid under the drawing:\n%s", svg)
+	}
+
+	// Without a background of its own, the render gets one
+	svg = string(applyStyle([]byte(`<svg width="64" height="64"><g /></svg>`), "blueprint", nil))
+	if !strings.Contains(svg, `</defs><rect width="100%" height="100%" fill="`+blueprintBackground+`" />`) {
+		t.Errorf("expected a background added:\n%s", svg)
+	}
+}
+
+func TestSketchStyle(t *testing.T) {
+	req := RenderRequest{Style: "sketch"}
+	opts, err := req.options()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.SketchJitter != defaultSketchJitter || scriptLineStyle(opts.Style) != "sketch" || opts.StrokeColor != "currentColor" {
+		t.Errorf("unexpected sketch options %+v", opts)
+	}
+	if scriptLineStyle("blueprint") != "clean" {
+		t.Errorf("blueprint lines should be clean")
+	}
+}
+
+func TestWireframeStyle(t *testing.T) {
+	req := RenderRequest{Style: "wireframe"}
+	opts, err := req.options()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if scriptLineStyle(opts.Style) != "wireframe" || opts.StrokeColor != "currentColor" {
+		t.Errorf("unexpected wireframe options %+v", opts)
+	}
+}
+
+func TestToonStyle(t *testing.T) {
+	withFakeBlender(t)
+	input := filepath.Join(t.TempDir(), "3001.dat")
+	os.WriteFile(input, []byte("0 Brick 2 x 4\n"), 0o644)
+
+	bands := 5
+	req := RenderRequest{Style: "toon", ToonBands: &bands}
+	opts, err := req.options()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _, err := renderFile(context.Background(), "contract", input, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	svg := string(data)
+	image, strokes := strings.Index(svg, `<image height="100%" href="data:image/png;base64,`), strings.Index(svg, `id="strokes"`)
+	if image < strings.Index(svg, `id="fills"`) || strokes < image {
+		t.Errorf("expected the raster between the fills and strokes:\n%s", svg)
+	}
+	if err := checkSVG(data); err != nil {
+		t.Error(err)
+	}
+	if opts, _ := (&RenderRequest{Style: "toon"}).options(); opts.ToonBands != defaultToonBands {
+		t.Errorf("expected %d bands by default, got %d", defaultToonBands, opts.ToonBands)
+	}
+}
+
+func TestStyleValidates(t *testing.T) {
+	jitter := func(v float64) *float64 { return &v }
+	bands := func(v int) *int { return &v }
+	for _, req := range []RenderRequest{
+		{Style: "watercolor"},
+		{Style: "blueprint", ColorScheme: "dark"},
+		{SketchJitter: jitter(1)},
+		{Style: "sketch", SketchJitter: jitter(11)},
+		{ToonBands: bands(3)},
+		{Style: "toon", ToonBands: bands(1)},
+		{Style: "toon", ToonBands: bands(9)},
+	} {
+		if _, err := req.options(); err == nil {
+			t.Errorf("%+v: expected an error", req)
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"image"
+	"image/color"
+)
+
+// supersample samples Freestyle's strokes more finely, for smoother curves
+// in SVG output, and rasterizes PNG output at that many times the size
+// before averaging it back down, for cleaner antialiasing of thin lines.
+// Both cost time and memory, so the server caps the factor.
+var maxSupersample = min(getEnvInt("MAX_SUPERSAMPLE", 4), 8)
+
+// The supersample argument render_part.py takes; options the request
+// didn't set are 1
+func scriptSupersample(factor int) int {
+	return max(factor, 1)
+}
+
+// Average each factor x factor block of an image into one pixel
+func downscaleImage(img image.Image, factor int) *image.RGBA {
+	b := img.Bounds()
+	out := image.NewRGBA(image.Rect(0, 0, (b.Dx()+factor-1)/factor, (b.Dy()+factor-1)/factor))
+	for y := 0; y < out.Rect.Dy(); y++ {
+		for x := 0; x < out.Rect.Dx(); x++ {
+			// Premultiplied, so transparent pixels don't darken edges
+			var r, g, bl, a, n uint32
+			for sy := b.Min.Y + y*factor; sy < min(b.Min.Y+(y+1)*factor, b.Max.Y); sy++ {
+				for sx := b.Min.X + x*factor; sx < min(b.Min.X+(x+1)*factor, b.Max.X); sx++ {
+					pr, pg, pb, pa := img.At(sx, sy).RGBA()
+					r, g, bl, a, n = r+pr, g+pg, bl+pb, a+pa, n+1
+				}
+			}
+			out.SetRGBA(x, y, color.RGBA{uint8(r / n >> 8), uint8(g / n >> 8), uint8(bl / n >> 8), uint8(a / n >> 8)})
+		}
+	}
+	return out
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestDownscaleImage(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, 5, 2))
+	// A half-covered block of opaque red, and a lone pixel past the edge
+	src.Set(0, 0, color.NRGBA{R: 255, A: 255})
+	src.Set(1, 0, color.NRGBA{R: 255, A: 255})
+	src.Set(4, 1, color.NRGBA{B: 255, A: 255})
+	out := downscaleImage(src, 2)
+	if out.Rect.Dx() != 3 || out.Rect.Dy() != 1 {
+		t.Fatalf("got %v", out.Rect)
+	}
+	if got := out.RGBAAt(0, 0); got.R < 126 || got.R > 128 || got.A < 126 || got.A > 128 || got.G != 0 {
+		t.Errorf("expected half-transparent red, got %v", got)
+	}
+	if got := out.RGBAAt(2, 0); got.B < 126 || got.B > 128 {
+		t.Errorf("expected the partial block averaged over its own pixels, got %v", got)
+	}
+}
+
+func TestSupersampleValidation(t *testing.T) {
+	for _, n := range []int{0, maxSupersample + 1} {
+		req := RenderRequest{Supersample: &n}
+		if _, err := req.options(); err == nil {
+			t.Errorf("expected an error for supersample %d", n)
+		}
+	}
+	n := maxSupersample
+	req := RenderRequest{Supersample: &n}
+	if opts, err := req.options(); err != nil || opts.Supersample != n {
+		t.Errorf("got %d, %v", opts.Supersample, err)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// rsvg-convert turns composed SVG pages into PDF or PNG output
+var rsvgConvert = getEnv("RSVG_CONVERT", "rsvg-convert")
+
+var (
+	svgRootPattern = regexp.MustCompile(`(?s)<svg\b([^>]*)>`)
+	svgAttrPattern = regexp.MustCompile(`([\w:-]+)="([^"]*)"`)
+)
+
+// Return the attributes of the root <svg> element
+func svgRootAttrs(svg []byte) map[string]string {
+	attrs := make(map[string]string)
+	m := svgRootPattern.FindSubmatch(svg)
+	if m == nil {
+		return attrs
+	}
+	for _, a := range svgAttrPattern.FindAllSubmatch(m[1], -1) {
+		attrs[string(a[1])] = string(a[2])
+	}
+	return attrs
+}
+
+// Return the pixel width and height of a rendered SVG, from its viewBox when
+// it has one (its width and height may be in other units), falling back to
+// 1024x1024
+func svgSize(svg []byte) (float64, float64) {
+	attrs := svgRootAttrs(svg)
+	if box := strings.Fields(attrs["viewBox"]); len(box) == 4 {
+		attrs["width"], attrs["height"] = box[2], box[3]
+	}
+	w, err := strconv.ParseFloat(strings.TrimSuffix(attrs["width"], "px"), 64)
+	if err != nil || w <= 0 {
+		w = 1024
+	}
+	h, err := strconv.ParseFloat(strings.TrimSuffix(attrs["height"], "px"), 64)
+	if err != nil || h <= 0 {
+		h = 1024
+	}
+	return w, h
+}
+
+// Return the markup inside the root <svg> element
+func svgInner(svg []byte) []byte {
+	loc := svgRootPattern.FindIndex(svg)
+	if loc == nil {
+		return nil
+	}
+	inner := svg[loc[1]:]
+	if end := bytes.LastIndex(inner, []byte("</svg>")); end >= 0 {
+		inner = inner[:end]
+	}
+	return inner
+}
+
+// Embed a rendered SVG as a nested <svg> scaled into the given box
+func embedSVG(svg []byte, x, y, w, h float64) string {
+	vw, vh := svgSize(svg)
+	return fmt.Sprintf(`<svg x="%.2f" y="%.2f" width="%.2f" height="%.2f" viewBox="0 0 %g %g" preserveAspectRatio="xMidYMid meet">%s</svg>`,
+		x, y, w, h, vw, vh, svgInner(svg))
+}
+
+// Start a composed SVG document. The inkscape namespace is declared so that
+// embedded Freestyle output stays well-formed.
+func svgDocumentStart(w, h float64) string {
+	return fmt.Sprintf(`<?xml version='1.0' encoding='utf-8'?>
+<svg xmlns="http://www.w3.org/2000/svg" xmlns:inkscape="http://www.inkscape.org/namespaces/inkscape" version="1.1" width="%g" height="%g" viewBox="0 0 %g %g">
+`, w, h, w, h)
+}
+
+// Helper: escape text for use in SVG/XML content and attributes
+func escapeXML(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// Convert one or more SVG pages to PDF (multi-page) or PNG (single page)
+func convertSVG(ctx context.Context, format string, pages [][]byte) ([]byte, error) {
+	return convertSVGAt(ctx, format, pages, 0, 1)
+}
+
+// Convert SVG pages at a DPI, which sizes physical units (0 is
+// rsvg-convert's default of 96), scaled by zoom
+func convertSVGAt(ctx context.Context, format string, pages [][]byte, dpi, zoom float64) ([]byte, error) {
+	if format != "pdf" && len(pages) != 1 {
+		return nil, fmt.Errorf("%s output supports a single page, got %d", format, len(pages))
+	}
+
+	dir, err := os.MkdirTemp("", "convert-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	outputPath := filepath.Join(dir, "output."+format)
+	args := []string{"-f", format, "-o", outputPath}
+	if dpi > 0 {
+		args = append(args, "--dpi-x", strconv.FormatFloat(dpi, 'f', -1, 64), "--dpi-y", strconv.FormatFloat(dpi, 'f', -1, 64))
+	}
+	if zoom != 1 {
+		args = append(args, "--zoom", strconv.FormatFloat(zoom, 'f', -1, 64))
+	}
+	for i, page := range pages {
+		pagePath := filepath.Join(dir, fmt.Sprintf("page-%04d.svg", i+1))
+		if err := os.WriteFile(pagePath, page, 0o644); err != nil {
+			return nil, err
+		}
+		args = append(args, pagePath)
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, rsvgConvert, args...)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%s conversion failed: %v: %s", format, err, stderr.String())
+	}
+	return os.ReadFile(outputPath)
+}
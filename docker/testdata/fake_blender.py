@@ -0,0 +1,243 @@
+#!/usr/bin/env python3
+"""Stand-in for `blender` in the render contract tests.
+
+Invoked exactly like Blender (`--background --python <script> -- <args>`),
+it checks every argument against render_contract.json instead of rendering,
+then writes a minimal SVG shaped like render_part.py's output with the
+received values filled in, so the Go side can check it parses them back.
+
+`--version` answers like Blender does, for the provenance headers.
+
+Set FAKE_BLENDER_CAPTURE to a path to also dump the parsed arguments as JSON,
+and FAKE_BLENDER_SLEEP to a number of seconds to stall before writing the SVG.
+"""
+
+import json
+import math
+import os
+import re
+import sys
+import struct
+import time
+import zlib
+
+CONTRACT = os.path.join(os.path.dirname(os.path.abspath(__file__)), "render_contract.json")
+
+
+def fail(msg):
+    print(f"contract violation: {msg}", file=sys.stderr)
+    sys.exit(2)
+
+
+def check_number(spec, raw, parse):
+    try:
+        value = parse(raw)
+    except ValueError:
+        fail(f"{spec['name']}: {raw!r} is not a valid {spec['type']}")
+    if isinstance(value, float) and not math.isfinite(value):
+        fail(f"{spec['name']}: {raw!r} is not finite")
+    if "min" in spec and value < spec["min"]:
+        fail(f"{spec['name']}: {value} is below {spec['min']}")
+    if "max" in spec and value > spec["max"]:
+        fail(f"{spec['name']}: {value} is above {spec['max']}")
+    return value
+
+
+def check_arg(spec, raw):
+    name = spec["name"]
+    if "pattern" in spec and not re.match(spec["pattern"], raw):
+        fail(f"{name}: {raw!r} does not match {spec['pattern']}")
+
+    kind = spec["type"]
+    if kind == "path" or kind == "optional_path":
+        if not raw:
+            if kind == "optional_path":
+                return raw
+            fail(f"{name}: empty path")
+        if spec.get("mustExist") and not os.path.exists(raw):
+            fail(f"{name}: {raw} does not exist")
+        return raw
+    if kind == "float":
+        return check_number(spec, raw, float)
+    if kind == "int":
+        return check_number(spec, raw, int)
+    if kind == "color":
+        if not raw or any(c.isspace() for c in raw):
+            fail(f"{name}: {raw!r} is not a color")
+        return raw
+    if kind == "edge_types":
+        if raw == "none":
+            return raw
+        for edge in raw.split(","):
+            if edge not in spec["values"]:
+                fail(f"{name}: unknown edge type {edge!r}")
+        return raw
+    if kind == "dash_pattern":
+        if raw == "none":
+            return raw
+        lengths = raw.split(",")
+        if len(lengths) % 2 or len(lengths) > spec["maxLengths"]:
+            fail(f"{name}: {raw!r} is not dash, gap pairs")
+        for length in lengths:
+            check_number(spec, length, int)
+        return raw
+    if kind == "matrix":
+        if raw == "none":
+            return raw
+        entries = raw.split(",")
+        if len(entries) != spec["size"]:
+            fail(f"{name}: {raw!r} is not {spec['size']} numbers")
+        for entry in entries:
+            check_number(spec, entry, float)
+        return raw
+    if kind == "enum":
+        if raw not in spec["values"]:
+            fail(f"{name}: {raw!r} is not one of {spec['values']}")
+        return raw
+    fail(f"{name}: unknown type {kind!r} in contract")
+
+
+def write_png(path, width, height, pixel):
+    """A PNG of the given size, with pixel(x, y) giving each (r, g, b, a)."""
+    def chunk(kind, data):
+        return struct.pack(">I", len(data)) + kind + data + struct.pack(">I", zlib.crc32(kind + data))
+    rows = b"".join(b"\0" + b"".join(bytes(pixel(x, y)) for x in range(width)) for y in range(height))
+    with open(path, "wb") as f:
+        f.write(b"\x89PNG\r\n\x1a\n")
+        f.write(chunk(b"IHDR", struct.pack(">IIBBBBB", width, height, 8, 6, 0, 0, 0)))
+        f.write(chunk(b"IDAT", zlib.compress(rows)))
+        f.write(chunk(b"IEND", b""))
+
+
+def main():
+    argv = sys.argv[1:]
+    if argv == ["--version"]:
+        print("Blender 4.1.1 (fake)")
+        return
+    if argv[:2] != ["--background", "--python"] or len(argv) < 4 or argv[3] != "--":
+        fail(f"expected --background --python <script> --, got {argv[:4]}")
+    args = argv[4:]
+
+    with open(CONTRACT) as f:
+        contract = json.load(f)
+    specs = contract["args"]
+    if len(args) != len(specs):
+        fail(f"expected {len(specs)} arguments, got {len(args)}: {args}")
+
+    parsed = {spec["name"]: check_arg(spec, raw) for spec, raw in zip(specs, args)}
+    for phase, percent in zip(contract["progress"]["phases"], (0, 30, 50, 85)):
+        print(f"{contract['progress']['marker']} {phase} {percent}", flush=True)
+
+    capture = os.environ.get("FAKE_BLENDER_CAPTURE")
+    if capture:
+        with open(capture, "w") as f:
+            json.dump({spec["name"]: raw for spec, raw in zip(specs, args)}, f)
+    time.sleep(float(os.environ.get("FAKE_BLENDER_SLEEP", "0")))
+
+    ghost = ""
+    if parsed["ghost_file"]:
+        ghost = f"""<g id="ViewLayer_GhostEdges" inkscape:groupmode="lineset" inkscape:label="ViewLayer_GhostEdges">
+        <g inkscape:groupmode="layer" inkscape:label="fills" id="fills">
+            <path fill_rule="evenodd" stroke="none" fill-opacity="{float(parsed['fill_opacity']) * 0.5:.4f}" fill="{parsed['fill_color']}" d=" M 20.000, 20.000 30.000, 20.000 30.000, 30.000  z " />
+        </g>
+        <g inkscape:groupmode="layer" id="strokes" inkscape:label="strokes">
+            <path fill="none" stroke-width="{parsed['thickness']}" stroke-linecap="butt" stroke-opacity="0.5" stroke-dasharray="6,4" stroke="{parsed['stroke_color']}" stroke-linejoin="round" d=" M 20.000, 20.000 30.000, 30.000 " />
+        </g>
+    </g>"""
+
+    # One stroke-only group per individually colored edge type
+    colored = ""
+    if parsed["color_edge_types"] != "none":
+        for edge_type in parsed["color_edge_types"].split(","):
+            colored += f"""<g id="ViewLayer_ColorEdges_{edge_type}" inkscape:groupmode="lineset" inkscape:label="ViewLayer_ColorEdges_{edge_type}">
+        <g inkscape:groupmode="layer" id="strokes" inkscape:label="strokes">
+            <path fill="none" stroke-width="{parsed['thickness']}" stroke-linecap="butt" stroke-opacity="1.0" stroke="{parsed['stroke_color']}" stroke-linejoin="round" d=" M 0.000, 0.000 10.000, 0.000 " />
+        </g>
+    </g>"""
+
+    # One group per separate object, in the object's colors
+    objects = ""
+    if parsed["objects_file"]:
+        with open(parsed["objects_file"]) as f:
+            manifest = json.load(f)
+        spec = contract["objects"]
+        for name in spec["rootAttributes"]:
+            if name not in manifest:
+                fail(f"objects_file: missing {name}")
+        for o in manifest["objects"]:
+            for name in spec["objectAttributes"]:
+                if name not in o:
+                    fail(f"objects_file: object missing {name}")
+            for name in o:
+                if name not in spec["objectAttributes"] + spec["optionalObjectAttributes"]:
+                    fail(f"objects_file: unexpected object attribute {name}")
+            objects += f"""<g id="ViewLayer_ObjectEdges_{o['id']}" inkscape:groupmode="lineset" inkscape:label="ViewLayer_ObjectEdges_{o['id']}">
+        <g inkscape:groupmode="layer" inkscape:label="fills" id="fills">
+            <path fill_rule="evenodd" stroke="none" fill-opacity="{parsed['fill_opacity']}" fill="{o.get('fill') or parsed['fill_color']}" d=" M 40.000, 40.000 50.000, 40.000 50.000, 50.000  z " />
+        </g>
+        <g inkscape:groupmode="layer" id="strokes" inkscape:label="strokes">
+            <path fill="none" stroke-width="{parsed['thickness']}" stroke-linecap="butt" stroke-opacity="1.0" stroke="{o.get('stroke') or parsed['stroke_color']}" stroke-linejoin="round" d=" M 40.000, 40.000 50.000, 50.000 " />
+        </g>
+    </g>"""
+
+    # The cut faces, in the fill color and marked
+    section = ""
+    if parsed["section_plane"] != "none":
+        section = f"""
+            <path fill_rule="evenodd" stroke="none" fill-opacity="{parsed['fill_opacity']}" fill="{parsed['fill_color']}" {contract['output']['sectionFillAttribute']}="1" d=" M 0.000, 10.000 10.000, 10.000 5.000, 5.000  z " />"""
+
+    # A far stroke, halfway back, in the depth cue's gray
+    depth = ""
+    if parsed["depth_cue"] == "on":
+        depth = f"""
+            <path fill="none" stroke-width="{parsed['thickness']}" stroke-linecap="butt" stroke-opacity="1.0" stroke="rgb(128, 128, 128)" stroke-linejoin="round" d=" M 10.000, 0.000 0.000, 10.000 " />"""
+
+    # Edges behind faces, for translucent fills or when asked for
+    hidden = ""
+    if parsed["fill_opacity"] < 1 or parsed["hidden_edge_opacity"] > 0:
+        alpha = parsed["hidden_edge_opacity"] or parsed["fill_opacity"] or 1.0
+        hidden = f"""<g id="ViewLayer_HiddenEdges" inkscape:groupmode="lineset" inkscape:label="ViewLayer_HiddenEdges">
+        <g inkscape:groupmode="layer" id="strokes" inkscape:label="strokes">
+            <path fill="none" stroke-width="{parsed['thickness']}" stroke-linecap="butt" stroke-opacity="{alpha}" stroke="{parsed['stroke_color']}" stroke-linejoin="round" d=" M 0.000, 10.000 10.000, 0.000 " />
+        </g>
+    </g>"""
+
+    if parsed["shading_file"]:
+        # Back to front: a dark face behind a lit one
+        with open(parsed["shading_file"], "w") as f:
+            json.dump({"width": int(parsed["resolution_x"]), "height": int(parsed["resolution_y"]), "faces": [
+                {"points": [0, 0, 10, 0, 10, 10], "shade": 0.1},
+                {"points": [0, 0, 10, 10, 0, 10], "shade": 0.9},
+            ]}, f)
+
+    if parsed["frame_file"]:
+        # A 2 x 4 brick (80 LDU long) across half the frame
+        with open(parsed["frame_file"], "w") as f:
+            json.dump({"lduPerPixel": 160 / max(parsed["resolution_x"], parsed["resolution_y"])}, f)
+
+    if parsed["raster_file"]:
+        write_png(parsed["raster_file"], parsed["resolution_x"], parsed["resolution_y"], lambda x, y: (255, 255, 255, 255))
+    if parsed["ao_file"]:
+        # Open on the left, darkening across to half occluded at x = 10
+        def occlusion(x, y):
+            v = 255 - min(x, 10) * 128 // 10
+            return (v, v, v, 255)
+        write_png(parsed["ao_file"], parsed["resolution_x"], parsed["resolution_y"], occlusion)
+
+    with open(parsed["output_svg"], "w") as f:
+        f.write(f"""<?xml version='1.0' encoding='utf-8'?>
+<svg xmlns="http://www.w3.org/2000/svg" xmlns:inkscape="http://www.inkscape.org/namespaces/inkscape" version="1.1" width="{parsed['resolution_x']}" height="{parsed['resolution_y']}">
+    <rect width="100%" height="100%" fill="white" /><g id="ViewLayer_Edges" inkscape:groupmode="lineset" inkscape:label="ViewLayer_Edges">
+        <g inkscape:groupmode="layer" inkscape:label="fills" id="fills">
+            <path fill_rule="evenodd" stroke="none" fill-opacity="{parsed['fill_opacity']}" fill="{parsed['fill_color']}" d=" M 0.000, 0.000 10.000, 0.000 10.000, 10.000  z " />{section}
+        </g>
+        <g inkscape:groupmode="layer" id="strokes" inkscape:label="strokes">
+            <path fill="none" stroke-width="{parsed['thickness']}" stroke-linecap="butt" stroke-opacity="1.0" stroke="{parsed['stroke_color']}" stroke-linejoin="round" d=" M 0.000, 0.000 10.000, 10.000 " />{depth}
+        </g>
+    </g>{hidden}{colored}{ghost}{objects}
+</svg>
+""")
+
+
+if __name__ == "__main__":
+    main()
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+)
+
+// With cssVariables, a render's colors are set through CSS custom
+// properties, so an embedding page can re-theme one cached SVG:
+//
+//	--part-fill, --part-stroke               fills and strokes
+//	--part-stroke-<type>                     edgeColors' colored edge types
+//	--part-object-<id>-fill, -stroke         separate objects
+//	--part-background                        the background
+//
+// Each element keeps its literal fill and stroke attributes and gets a style
+// of var(--name, literal) over them, so renderers without custom property
+// support draw the same colors. Pattern and gradient fills are left alone.
+var (
+	svgPaintedPattern     = regexp.MustCompile(`<(?:path|rect)\b[^>]*>`)
+	svgPaintAttrPattern   = regexp.MustCompile(`\s(fill|stroke)="([^"]*)"`)
+	svgStyleAttrPattern   = regexp.MustCompile(`\sstyle="([^"]*)"`)
+	svgLinesetNamePattern = regexp.MustCompile(`\bid="ViewLayer_([^"]+)"`)
+)
+
+func applyCSSVariables(svg []byte) []byte {
+	linesets := svgLinesetNamePattern.FindAllSubmatchIndex(svg, -1)
+	var b bytes.Buffer
+	last := 0
+	for _, loc := range svgPaintedPattern.FindAllIndex(svg, -1) {
+		el := svg[loc[0]:loc[1]]
+		// The line set the element is in, if any, is the last one started
+		name := ""
+		for _, m := range linesets {
+			if m[0] > loc[0] {
+				break
+			}
+			name = string(svg[m[2]:m[3]])
+		}
+		rect := bytes.HasPrefix(el, []byte("<rect"))
+
+		var decls []string
+		for _, a := range svgPaintAttrPattern.FindAllSubmatch(el, -1) {
+			prop, value := string(a[1]), string(a[2])
+			if value == "none" || strings.HasPrefix(value, "url(") {
+				continue
+			}
+			decls = append(decls, prop+": var("+cssVariable(name, rect, prop)+", "+value+")")
+		}
+		if len(decls) == 0 {
+			continue
+		}
+		b.Write(svg[last:loc[0]])
+		b.Write(withStyle(el, strings.Join(decls, "; ")))
+		last = loc[1]
+	}
+	b.Write(svg[last:])
+	return b.Bytes()
+}
+
+// The custom property for an element's fill or stroke, by the
+// ViewLayer_<name> line set it's in (if any)
+func cssVariable(lineset string, rect bool, prop string) string {
+	switch {
+	case rect && lineset == "":
+		return "--part-background"
+	case strings.HasPrefix(lineset, "ColorEdges_") && prop == "stroke":
+		return "--part-stroke-" + strings.ReplaceAll(strings.TrimPrefix(lineset, "ColorEdges_"), "_", "-")
+	case strings.HasPrefix(lineset, "ObjectEdges_"):
+		return "--part-object-" + strings.TrimPrefix(lineset, "ObjectEdges_") + "-" + prop
+	}
+	return "--part-" + prop
+}
+
+// Add declarations to an element's style, after any it already has
+func withStyle(el []byte, decls string) []byte {
+	if m := svgStyleAttrPattern.FindSubmatchIndex(el); m != nil {
+		style := strings.TrimRight(string(el[m[2]:m[3]]), "; ")
+		if style != "" {
+			style += "; "
+		}
+		return append(append(append([]byte{}, el[:m[2]]...), style+escapeXML(decls)...), el[m[3]:]...)
+	}
+	name := bytes.IndexAny(el, " \t\n/>")
+	return append(append(append([]byte{}, el[:name]...), ` style="`+escapeXML(decls)+`"`...), el[name:]...)
+}
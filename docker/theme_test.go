@@ -0,0 +1,36 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCSSVariablesRender(t *testing.T) {
+	on := true
+	svg := renderWithFakeBlender(t, RenderRequest{CSSVariables: &on, FillColor: "#4a90d9", StrokeColor: "black",
+		EdgeColors: &EdgeColors{Crease: "red"}})
+	for _, want := range []string{
+		`<rect style="fill: var(--part-background, white)"`,
+		`style="fill: var(--part-fill, #4a90d9)"`,
+		`style="stroke: var(--part-stroke, black)"`,
+		`style="stroke: var(--part-stroke-crease, red)"`,
+		// The literal colors stay for renderers without custom properties
+		`stroke="black"`,
+	} {
+		if !strings.Contains(svg, want) {
+			t.Errorf("missing %s:\n%s", want, svg)
+		}
+	}
+}
+
+func TestApplyCSSVariables(t *testing.T) {
+	svg := `<svg><g id="ViewLayer_ObjectEdges_2"><path style="opacity: 0.5;" fill="red" stroke="none" d="M 0 0" />` +
+		`<path fill="url(#hatch-1)" stroke="none" d="M 0 0" /></g></svg>`
+	got := string(applyCSSVariables([]byte(svg)))
+	if !strings.Contains(got, `style="opacity: 0.5; fill: var(--part-object-2-fill, red)"`) {
+		t.Errorf("expected the object fill added to the existing style: %s", got)
+	}
+	if !strings.Contains(got, `<path fill="url(#hatch-1)"`) {
+		t.Errorf("expected pattern fills left alone: %s", got)
+	}
+}
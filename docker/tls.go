@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TLS is terminated here when a small deployment has no proxy in front:
+// either from TLS_CERT_FILE and TLS_KEY_FILE, reloaded when the files change
+// so certbot-style renewals are picked up, or from ACME for TLS_DOMAINS
+// (see acme.go). Without either the server speaks plain HTTP.
+var (
+	tlsCertFile   = getEnv("TLS_CERT_FILE", "")
+	tlsKeyFile    = getEnv("TLS_KEY_FILE", "")
+	tlsDomains    = splitList(getEnv("TLS_DOMAINS", ""))
+	acmeDirectory = getEnv("ACME_DIRECTORY", letsEncryptDirectory)
+	acmeEmail     = getEnv("ACME_EMAIL", "")
+	// Where ACME http-01 challenges are answered and plain HTTP is
+	// redirected to HTTPS
+	httpPort = getEnv("HTTP_PORT", "80")
+)
+
+// Split a comma-separated list, dropping blanks
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// Check the TLS configuration at startup
+func validateTLS() error {
+	if (tlsCertFile == "") != (tlsKeyFile == "") {
+		return errors.New("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	if tlsCertFile != "" && len(tlsDomains) > 0 {
+		return errors.New("set either TLS_CERT_FILE or TLS_DOMAINS, not both")
+	}
+	if len(tlsDomains) > 0 && stateDir == "" {
+		return errors.New("TLS_DOMAINS needs STATE_DIR to keep the ACME account and certificate")
+	}
+	for _, d := range tlsDomains {
+		if strings.ContainsAny(d, "/:* ") {
+			return fmt.Errorf("TLS_DOMAINS: %q is not a host name (wildcards need the dns-01 challenge, which isn't supported)", d)
+		}
+	}
+	return nil
+}
+
+// The TLS config for the configured certificate source, or nil for plain
+// HTTP. ACME also starts the challenge listener and renewals.
+func tlsConfig() (*tls.Config, error) {
+	switch {
+	case tlsCertFile != "":
+		certs := &certFiles{cert: tlsCertFile, key: tlsKeyFile}
+		if _, err := certs.getCertificate(nil); err != nil {
+			return nil, err
+		}
+		return &tls.Config{GetCertificate: certs.getCertificate, MinVersion: tls.VersionTLS12}, nil
+
+	case len(tlsDomains) > 0:
+		m, err := newACMEManager(filepath.Join(stateDir, "acme"), acmeDirectory, acmeEmail, tlsDomains)
+		if err != nil {
+			return nil, err
+		}
+		go func() {
+			log.Printf("ACME challenges and HTTPS redirects on :%s", httpPort)
+			if err := newServer(":"+httpPort, &m.challenges).ListenAndServe(); err != nil {
+				log.Fatalf("ACME challenge listener failed: %v", err)
+			}
+		}()
+		go m.run(acmeCheckInterval)
+		return &tls.Config{GetCertificate: m.getCertificate, MinVersion: tls.VersionTLS12}, nil
+	}
+	return nil, nil
+}
+
+// A certificate and key loaded from files, reloaded when either changes
+type certFiles struct {
+	cert, key string
+
+	mu      sync.Mutex
+	current *tls.Certificate
+	modTime time.Time
+	checked time.Time
+}
+
+// How often handshakes look at the files' modification times
+const certFilesCheckInterval = 10 * time.Second
+
+func (c *certFiles) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.current != nil && time.Since(c.checked) < certFilesCheckInterval {
+		return c.current, nil
+	}
+	c.checked = time.Now()
+
+	var latest time.Time
+	for _, path := range []string{c.cert, c.key} {
+		info, err := os.Stat(path)
+		if err != nil {
+			if c.current != nil {
+				return c.current, nil
+			}
+			return nil, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	if c.current != nil && !latest.After(c.modTime) {
+		return c.current, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.cert, c.key)
+	if err != nil {
+		if c.current != nil {
+			// Mid-rotation the cert and key may not match yet
+			log.Printf("Reloading TLS certificate failed, keeping the old one: %v", err)
+			return c.current, nil
+		}
+		return nil, err
+	}
+	if c.current != nil {
+		log.Printf("Reloaded TLS certificate from %s", c.cert)
+	}
+	c.current, c.modTime = &cert, latest
+	return c.current, nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// Write a self-signed certificate and key for name
+func writeTestCertificate(t *testing.T, certPath, keyPath, name string) {
+	t.Helper()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644)
+	os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+}
+
+func withTLSConfig(t *testing.T, certFile, keyFile string, domains []string, state string) {
+	t.Helper()
+	oldCert, oldKey, oldDomains, oldState := tlsCertFile, tlsKeyFile, tlsDomains, stateDir
+	tlsCertFile, tlsKeyFile, tlsDomains, stateDir = certFile, keyFile, domains, state
+	t.Cleanup(func() { tlsCertFile, tlsKeyFile, tlsDomains, stateDir = oldCert, oldKey, oldDomains, oldState })
+}
+
+func TestSplitList(t *testing.T) {
+	if got := splitList(" a.example, ,b.example,"); !slices.Equal(got, []string{"a.example", "b.example"}) {
+		t.Errorf("splitList = %q", got)
+	}
+	if got := splitList(""); got != nil {
+		t.Errorf("expected nil for an empty list, got %q", got)
+	}
+}
+
+func TestValidateTLS(t *testing.T) {
+	tests := []struct {
+		name             string
+		cert, key, state string
+		domains          []string
+		ok               bool
+	}{
+		{"plain HTTP", "", "", "", nil, true},
+		{"cert files", "c.pem", "k.pem", "", nil, true},
+		{"cert without key", "c.pem", "", "", nil, false},
+		{"acme", "", "", "/state", []string{"bricks.example"}, true},
+		{"acme without state", "", "", "", []string{"bricks.example"}, false},
+		{"both", "c.pem", "k.pem", "/state", []string{"bricks.example"}, false},
+		{"wildcard", "", "", "/state", []string{"*.bricks.example"}, false},
+	}
+	for _, tt := range tests {
+		withTLSConfig(t, tt.cert, tt.key, tt.domains, tt.state)
+		if err := validateTLS(); (err == nil) != tt.ok {
+			t.Errorf("%s: validateTLS() = %v", tt.name, err)
+		}
+	}
+}
+
+func TestCertFilesReload(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeTestCertificate(t, certPath, keyPath, "one.example")
+	withTLSConfig(t, certPath, keyPath, nil, "")
+	if config, err := tlsConfig(); err != nil || config == nil || config.GetCertificate == nil {
+		t.Fatalf("tlsConfig() = %v, %v", config, err)
+	}
+
+	certs := &certFiles{cert: certPath, key: keyPath}
+	commonName := func() string {
+		t.Helper()
+		// Skip the wait between checks of the files
+		certs.checked = time.Time{}
+		cert, err := certs.getCertificate(nil)
+		if err != nil {
+			t.Fatalf("getCertificate: %v", err)
+		}
+		leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+		return leaf.Subject.CommonName
+	}
+	if name := commonName(); name != "one.example" {
+		t.Fatalf("got certificate for %s", name)
+	}
+
+	// A renewal written over the files is picked up
+	writeTestCertificate(t, certPath, keyPath, "two.example")
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certPath, later, later)
+	if name := commonName(); name != "two.example" {
+		t.Errorf("expected the renewed certificate, got %s", name)
+	}
+
+	// A half-written rotation keeps the old certificate
+	os.WriteFile(keyPath, []byte("not a key"), 0o600)
+	later = later.Add(time.Minute)
+	os.Chtimes(keyPath, later, later)
+	if name := commonName(); name != "two.example" {
+		t.Errorf("expected the previous certificate to be kept, got %s", name)
+	}
+
+	withTLSConfig(t, filepath.Join(dir, "missing.pem"), keyPath, nil, "")
+	if _, err := tlsConfig(); err == nil {
+		t.Error("expected an error for a missing certificate file")
+	}
+}
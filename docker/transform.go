@@ -0,0 +1,95 @@
+package main
+
+import (
+	"math"
+	"strings"
+)
+
+// A request's transform poses the model before it's framed, for views
+// camera angles can't give: a minifig arm raised, a tile stood on edge.
+// It's a 4x4 matrix, row-major on the LDraw axes (-Y is up) as in a type 1
+// line, or rotation and scale, applied in that order. Renders frame the
+// model wherever it ends up, so a matrix's translation is ignored. The
+// transform comes after orientation normalization and before mirror, and
+// applies to ghosts and separate objects alike.
+type ModelTransform struct {
+	Matrix []float64 `json:"matrix"`
+	// Rotation is in degrees about X, then Y, then Z, as in scenes
+	Rotation *[3]float64 `json:"rotation"`
+	// Scale is per axis
+	Scale *[3]float64 `json:"scale"`
+}
+
+const (
+	// The largest magnitude of a transform's entries or scale factors
+	maxTransformEntry = 100
+	// Transforms squashing the model flatter than this are refused
+	minTransformDeterminant = 1e-6
+)
+
+// Check a transform and copy its 3x3 linear part into opts
+func (t *ModelTransform) apply(opts *RenderOptions) error {
+	var errs fieldErrors
+	var m [9]float64
+	switch {
+	case t.Matrix != nil && (t.Rotation != nil || t.Scale != nil):
+		errs.add("matrix", "set matrix, or rotation and scale, not both")
+	case t.Matrix != nil:
+		if len(t.Matrix) != 16 {
+			errs.add("matrix", "matrix must be 16 numbers, a 4x4 matrix row by row")
+			break
+		}
+		if t.Matrix[12] != 0 || t.Matrix[13] != 0 || t.Matrix[14] != 0 || t.Matrix[15] != 1 {
+			errs.add("matrix", "matrix's last row must be 0 0 0 1")
+		}
+		for row := 0; row < 3; row++ {
+			copy(m[row*3:row*3+3], t.Matrix[row*4:row*4+3])
+		}
+	default:
+		m = [9]float64{1, 0, 0, 0, 1, 0, 0, 0, 1}
+		if t.Rotation != nil {
+			m = rotationMatrix(*t.Rotation)
+		}
+		if t.Scale != nil {
+			for col, s := range t.Scale {
+				if s == 0 || math.Abs(s) > maxTransformEntry {
+					errs.add("scale", "scale factors must be nonzero and at most %d", maxTransformEntry)
+					break
+				}
+				for row := 0; row < 3; row++ {
+					m[row*3+col] *= s
+				}
+			}
+		}
+	}
+	if err := errs.err(); err != nil {
+		return err
+	}
+
+	for _, v := range m {
+		if math.IsNaN(v) || math.Abs(v) > maxTransformEntry {
+			errs.add("matrix", "matrix entries must be at most %d", maxTransformEntry)
+			return errs.err()
+		}
+	}
+	det := m[0]*(m[4]*m[8]-m[5]*m[7]) - m[1]*(m[3]*m[8]-m[5]*m[6]) + m[2]*(m[3]*m[7]-m[4]*m[6])
+	if math.Abs(det) < minTransformDeterminant {
+		errs.add("matrix", "the transform flattens the model")
+		return errs.err()
+	}
+	entries := make([]string, len(m))
+	for i, v := range m {
+		entries[i] = ldrawNumber(v)
+	}
+	opts.Transform = strings.Join(entries, ",")
+	return nil
+}
+
+// The transform argument render_part.py takes: the 3x3 matrix row by row,
+// or none
+func scriptTransform(transform string) string {
+	if transform == "" {
+		return "none"
+	}
+	return transform
+}
@@ -0,0 +1,30 @@
+package main
+
+import "testing"
+
+func TestModelTransform(t *testing.T) {
+	v := func(x, y, z float64) *[3]float64 { return &[3]float64{x, y, z} }
+	for _, tt := range []struct {
+		name      string
+		transform ModelTransform
+		want      string
+		ok        bool
+	}{
+		{"matrix", ModelTransform{Matrix: []float64{0, 0, 1, 10, 0, 1, 0, -24, -1, 0, 0, 0, 0, 0, 0, 1}}, "0,0,1,0,1,0,-1,0,0", true},
+		{"rotation", ModelTransform{Rotation: v(0, 90, 0)}, "0,0,1,0,1,0,-1,0,0", true},
+		{"scale", ModelTransform{Scale: v(1, -1, 2)}, "1,0,0,0,-1,0,0,0,2", true},
+		{"rotation and scale", ModelTransform{Rotation: v(90, 0, 0), Scale: v(2, 1, 1)}, "2,0,0,0,0,-1,0,1,0", true},
+		{"both kinds", ModelTransform{Matrix: make([]float64, 16), Scale: v(1, 1, 1)}, "", false},
+		{"short matrix", ModelTransform{Matrix: []float64{1, 0, 0, 0, 1, 0, 0, 0, 1}}, "", false},
+		{"projective", ModelTransform{Matrix: []float64{1, 0, 0, 0, 0, 1, 0, 0, 0, 0, 1, 0, 0, 0, 1, 1}}, "", false},
+		{"flat", ModelTransform{Matrix: []float64{1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 1}}, "", false},
+		{"zero scale", ModelTransform{Scale: v(1, 0, 1)}, "", false},
+		{"huge scale", ModelTransform{Scale: v(1000, 1, 1)}, "", false},
+	} {
+		var opts RenderOptions
+		err := tt.transform.apply(&opts)
+		if (err == nil) != tt.ok || opts.Transform != tt.want {
+			t.Errorf("%s: got %q, %v", tt.name, opts.Transform, err)
+		}
+	}
+}
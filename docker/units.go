@@ -0,0 +1,40 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+)
+
+// With units mm, a render's width and height are in millimeters at the
+// part's real size, so diagrams print true to scale. render_part.py
+// reports the model size of a pixel in LDraw units in its frame_file,
+// and an LDraw unit is 0.4 mm. The drawing keeps its pixel coordinates
+// under a viewBox, so everything composing renders (sheets, atlases) sees
+// the same sizes as before.
+const mmPerLDU = 0.4
+
+// Read the script's frame file as millimeters per pixel
+func readMMPerPixel(path string) (float64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	var frame struct {
+		LDUPerPixel float64 `json:"lduPerPixel"`
+	}
+	if err := json.Unmarshal(data, &frame); err != nil {
+		return 0, fmt.Errorf("frame file: %w", err)
+	}
+	if frame.LDUPerPixel <= 0 || math.IsInf(frame.LDUPerPixel, 0) {
+		return 0, fmt.Errorf("frame file: lduPerPixel %g is not a scale", frame.LDUPerPixel)
+	}
+	return frame.LDUPerPixel * mmPerLDU, nil
+}
+
+// Millimeters to a hundredth, which is finer than printers go
+func formatMillimeters(mm float64) string {
+	return strconv.FormatFloat(math.Round(mm*100)/100, 'f', -1, 64)
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestUnitsRender(t *testing.T) {
+	svg := renderWithFakeBlender(t, RenderRequest{Units: "mm"})
+	root := svgRootPattern.FindString(svg)
+	// The fake frames 160 LDU across the picture: 64 mm
+	if !strings.Contains(root, ` width="64mm" height="64mm" viewBox="0 0 1024 1024"`) {
+		t.Errorf("expected millimeter sizes: %s", root)
+	}
+	if w, h := svgSize([]byte(svg)); w != 1024 || h != 1024 {
+		t.Errorf("pixel size is %gx%g", w, h)
+	}
+}
+
+func TestReadMMPerPixel(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "frame.json")
+	os.WriteFile(path, []byte(`{"lduPerPixel": 0.125}`), 0o644)
+	if got, err := readMMPerPixel(path); err != nil || got != 0.05 {
+		t.Errorf("got %g, %v", got, err)
+	}
+	os.WriteFile(path, []byte(`{"lduPerPixel": 0}`), 0o644)
+	if _, err := readMMPerPixel(path); err == nil {
+		t.Error("expected an error for a zero scale")
+	}
+}
+
+func TestUnitsValidation(t *testing.T) {
+	for _, req := range []RenderRequest{{Units: "in"}, {Units: "mm", RootSize: "responsive"}} {
+		if _, err := req.options(); err == nil {
+			t.Errorf("expected an error for %+v", req)
+		}
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Usage is counted per API key and UTC day: Blender renders, failed
+// renders, cache hits, and the seconds spent in renders. It backs the
+// monthly quotas and GET /admin/usage. With STATE_DIR it's saved to
+// STATE_DIR/usage.json once a minute, so a crash loses at most a minute of
+// counts. Days older than usageRetentionDays are dropped when saving.
+const (
+	usageSaveInterval  = time.Minute
+	usageRetentionDays = 400
+	defaultUsageDays   = 30
+)
+
+type usageDay struct {
+	Renders        int64   `json:"renders"`
+	Errors         int64   `json:"errors,omitempty"`
+	CacheHits      int64   `json:"cacheHits,omitempty"`
+	ComputeSeconds float64 `json:"computeSeconds,omitempty"`
+}
+
+func (u *usageDay) add(other *usageDay) {
+	u.Renders += other.Renders
+	u.Errors += other.Errors
+	u.CacheHits += other.CacheHits
+	u.ComputeSeconds += other.ComputeSeconds
+}
+
+// Usage by key name, then by day ("2006-01-02")
+var usage = struct {
+	sync.Mutex
+	byKey map[string]map[string]*usageDay
+	dirty bool
+}{byKey: make(map[string]map[string]*usageDay)}
+
+func usagePath(dir string) string {
+	return filepath.Join(dir, "usage.json")
+}
+
+// The counters for a key on the day containing now, created on first use.
+// Marks the usage as needing a save.
+func usageDayLocked(name string, now time.Time) *usageDay {
+	days := usage.byKey[name]
+	if days == nil {
+		days = make(map[string]*usageDay)
+		usage.byKey[name] = days
+	}
+	day := now.UTC().Format("2006-01-02")
+	if days[day] == nil {
+		days[day] = &usageDay{}
+	}
+	usage.dirty = true
+	return days[day]
+}
+
+// Update the counters of the request's key; requests without a key, and
+// replays, aren't metered
+func recordKeyUsage(ctx context.Context, update func(u *usageDay)) {
+	key := apiKeyFromContext(ctx)
+	if key == nil || replayMode(ctx) != "" {
+		return
+	}
+	usage.Lock()
+	update(usageDayLocked(key.Name, time.Now()))
+	usage.Unlock()
+}
+
+// Renders a key has used in the month containing now
+func monthlyRenders(name string, now time.Time) int64 {
+	usage.Lock()
+	defer usage.Unlock()
+	return monthlyRendersLocked(name, now)
+}
+
+func monthlyRendersLocked(name string, now time.Time) int64 {
+	month := now.UTC().Format("2006-01")
+	var total int64
+	for day, u := range usage.byKey[name] {
+		if strings.HasPrefix(day, month) {
+			total += u.Renders
+		}
+	}
+	return total
+}
+
+// Totals per key for the days from..to (inclusive, "2006-01-02")
+func usageBetween(from, to string) map[string]*usageDay {
+	usage.Lock()
+	defer usage.Unlock()
+	totals := make(map[string]*usageDay)
+	for name, days := range usage.byKey {
+		for day, u := range days {
+			if day < from || day > to {
+				continue
+			}
+			if totals[name] == nil {
+				totals[name] = &usageDay{}
+			}
+			totals[name].add(u)
+		}
+	}
+	return totals
+}
+
+func saveUsage(dir string) error {
+	usage.Lock()
+	cutoff := time.Now().UTC().AddDate(0, 0, -usageRetentionDays).Format("2006-01-02")
+	for name, days := range usage.byKey {
+		for day := range days {
+			if day < cutoff {
+				delete(days, day)
+			}
+		}
+		if len(days) == 0 {
+			delete(usage.byKey, name)
+		}
+	}
+	data, err := json.Marshal(usage.byKey)
+	usage.dirty = false
+	usage.Unlock()
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(usagePath(dir), data)
+}
+
+// Load saved usage; a missing file is no usage yet
+func loadUsage(dir string) error {
+	data, err := os.ReadFile(usagePath(dir))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	byKey := make(map[string]map[string]*usageDay)
+	if err := json.Unmarshal(data, &byKey); err != nil {
+		return err
+	}
+	usage.Lock()
+	usage.byKey = byKey
+	usage.dirty = false
+	usage.Unlock()
+	return nil
+}
+
+// Save usage whenever it has changed, every interval
+func runUsageSaver(dir string, interval time.Duration) {
+	for range time.Tick(interval) {
+		usage.Lock()
+		dirty := usage.dirty
+		usage.Unlock()
+		if !dirty {
+			continue
+		}
+		if err := saveUsage(dir); err != nil {
+			log.Printf("Failed to save usage: %v", err)
+		}
+	}
+}
+
+type KeyUsage struct {
+	Name           string  `json:"name"`
+	Renders        int64   `json:"renders"`
+	Errors         int64   `json:"errors"`
+	CacheHits      int64   `json:"cacheHits"`
+	ComputeSeconds float64 `json:"computeSeconds"`
+}
+
+type UsageReport struct {
+	From string     `json:"from"`
+	To   string     `json:"to"`
+	Keys []KeyUsage `json:"keys"`
+}
+
+// The report window from ?from and ?to (dates, inclusive) or ?days (ending
+// today, default 30)
+func usageWindow(q url.Values, now time.Time) (string, string, bool) {
+	to := now.UTC().Format("2006-01-02")
+	if v := q.Get("to"); v != "" {
+		if _, err := time.Parse("2006-01-02", v); err != nil {
+			return "", "", false
+		}
+		to = v
+	}
+	if v := q.Get("from"); v != "" {
+		if _, err := time.Parse("2006-01-02", v); err != nil || v > to {
+			return "", "", false
+		}
+		return v, to, true
+	}
+	days := defaultUsageDays
+	if v := q.Get("days"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > usageRetentionDays {
+			return "", "", false
+		}
+		days = n
+	}
+	end, _ := time.Parse("2006-01-02", to)
+	return end.AddDate(0, 0, 1-days).Format("2006-01-02"), to, true
+}
+
+// Usage report endpoint
+func handleUsage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		sendError(w, http.StatusMethodNotAllowed, "Method not allowed", "")
+		return
+	}
+	from, to, ok := usageWindow(r.URL.Query(), time.Now())
+	if !ok {
+		sendError(w, http.StatusBadRequest, "Invalid window",
+			"Use days=1-"+strconv.Itoa(usageRetentionDays)+", or from and to as YYYY-MM-DD")
+		return
+	}
+
+	totals := usageBetween(from, to)
+	// Configured keys are listed even when they've been idle
+	for _, key := range apiKeys {
+		if totals[key.Name] == nil {
+			totals[key.Name] = &usageDay{}
+		}
+	}
+	report := UsageReport{From: from, To: to, Keys: []KeyUsage{}}
+	for name, u := range totals {
+		report.Keys = append(report.Keys, KeyUsage{name, u.Renders, u.Errors, u.CacheHits, u.ComputeSeconds})
+	}
+	sort.Slice(report.Keys, func(i, j int) bool { return report.Keys[i].Name < report.Keys[j].Name })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
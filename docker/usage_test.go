@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUsagePersistence(t *testing.T) {
+	withAPIKeys(t, `[]`)
+	dir := t.TempDir()
+	now := time.Now().UTC()
+	today := now.Format("2006-01-02")
+	usage.byKey["team-a"] = map[string]*usageDay{
+		today:        {Renders: 2, Errors: 1, CacheHits: 5, ComputeSeconds: 12.5},
+		"2001-01-01": {Renders: 3},
+	}
+	if err := saveUsage(dir); err != nil {
+		t.Fatal(err)
+	}
+	usage.byKey = make(map[string]map[string]*usageDay)
+	if err := loadUsage(dir); err != nil {
+		t.Fatal(err)
+	}
+	if n := monthlyRenders("team-a", now); n != 2 {
+		t.Errorf("expected 2 renders this month, got %d", n)
+	}
+	if _, ok := usage.byKey["team-a"]["2001-01-01"]; ok {
+		t.Error("days past the retention period should be dropped")
+	}
+	if got := *usage.byKey["team-a"][today]; got != (usageDay{2, 1, 5, 12.5}) {
+		t.Errorf("loaded %+v", got)
+	}
+	if err := loadUsage(t.TempDir()); err != nil {
+		t.Errorf("a missing usage file should be fine: %v", err)
+	}
+}
+
+func TestUsageWindow(t *testing.T) {
+	now := time.Date(2026, 3, 10, 15, 0, 0, 0, time.UTC)
+	for query, want := range map[string]string{
+		"":                              "2026-02-09..2026-03-10",
+		"days=1":                        "2026-03-10..2026-03-10",
+		"days=7&to=2026-02-28":          "2026-02-22..2026-02-28",
+		"from=2026-01-01":               "2026-01-01..2026-03-10",
+		"from=2026-01-01&to=2026-01-31": "2026-01-01..2026-01-31",
+		"days=0":                        "invalid",
+		"days=1000":                     "invalid",
+		"from=2026-02-01&to=2026-01-01": "invalid",
+		"to=yesterday":                  "invalid",
+	} {
+		q, _ := url.ParseQuery(query)
+		from, to, ok := usageWindow(q, now)
+		got := from + ".." + to
+		if !ok {
+			got = "invalid"
+		}
+		if got != want {
+			t.Errorf("%q: got %s, want %s", query, got, want)
+		}
+	}
+}
+
+func TestHandleUsage(t *testing.T) {
+	withFakeBlender(t)
+	withTestLibrary(t, map[string]string{"3001": "0 Brick 2 x 4\n"})
+	withRenderCache(t)
+	withAPIKeys(t, `[{"key":"k1","name":"team-a"},{"key":"k2","name":"team-b"}]`)
+
+	render := requireAPIKey(handleRender)
+	for _, part := range []string{"3001", "3001", "9999"} {
+		r := httptest.NewRequest(http.MethodPost, "/render", strings.NewReader(`{"partNumber":"`+part+`"}`))
+		r.Header.Set("X-API-Key", "k1")
+		render(httptest.NewRecorder(), r)
+	}
+
+	w := httptest.NewRecorder()
+	handleUsage(w, httptest.NewRequest(http.MethodGet, "/admin/usage?days=7", nil))
+	var report UsageReport
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+		t.Fatalf("%d %s", w.Code, w.Body)
+	}
+	if report.To != time.Now().UTC().Format("2006-01-02") || len(report.Keys) != 2 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	a, b := report.Keys[0], report.Keys[1]
+	if a.Name != "team-a" || a.Renders != 1 || a.CacheHits != 1 || a.Errors != 1 || a.ComputeSeconds <= 0 {
+		t.Errorf("unexpected usage for team-a: %+v", a)
+	}
+	if b != (KeyUsage{Name: "team-b"}) {
+		t.Errorf("idle keys should be listed with no usage, got %+v", b)
+	}
+
+	w = httptest.NewRecorder()
+	handleUsage(w, httptest.NewRequest(http.MethodGet, "/admin/usage?days=x", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("bad window: expected 400, got %d", w.Code)
+	}
+}
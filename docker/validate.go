@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+)
+
+// POST /render/validate takes a /render body and checks it as /render
+// would, resolving the part and any LDraw color, without running Blender.
+// It answers with the options the render would run with, so integrations
+// can be built against it without waiting on renders or using up quota.
+type ValidateResponse struct {
+	PartNumber string `json:"partNumber"`
+	// The part's file, relative to the LDraw library, or to the calling
+	// key's private parts if Private (see privateparts.go)
+	PartFile string `json:"partFile"`
+	Private  bool   `json:"private,omitempty"`
+	Format   string `json:"format"`
+	// The PNG's DPI, if given
+	DPI float64 `json:"dpi,omitempty"`
+	// The LDraw color the request's color code resolved to
+	Color   *LDrawColor   `json:"color,omitempty"`
+	Options RenderOptions `json:"options"`
+	// Whether the render cache already has this render
+	Cached bool `json:"cached"`
+}
+
+// Check a /render body, returning its options, output format, and DPI
+func (body *debugRenderRequest) validate() (RenderOptions, string, float64, error) {
+	req := &body.RenderRequest
+	var errs fieldErrors
+	if req.PartNumber == "" {
+		errs.add("partNumber", "partNumber is required")
+	}
+	opts, err := req.options()
+	errs.merge("", err)
+	format, dpi, err := req.output(opts)
+	errs.merge("", err)
+	if body.Debug && format != "svg" {
+		errs.add("debug", "debug returns the SVG in JSON; it needs format svg")
+	}
+	return opts, format, dpi, errs.err()
+}
+
+func handleRenderValidate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		sendError(w, http.StatusMethodNotAllowed, "Method not allowed", "")
+		return
+	}
+
+	var body debugRenderRequest
+	if !decodeJSON(w, r, &body) {
+		return
+	}
+	opts, format, dpi, err := body.validate()
+	if err != nil {
+		sendValidationError(w, err)
+		return
+	}
+	partNumber, partFile, private, err := resolveRequestPart(r.Context(), body.PartNumber, opts)
+	if err != nil {
+		sendRenderError(w, err)
+		return
+	}
+	setPartHeaders(w, body.PartNumber, opts)
+
+	// As renderPart has them
+	opts.PrintFallback = false
+	root := libraryPath(opts.LibraryVersion)
+	if private {
+		model, err := privatePartModel(r.Context(), partNumber, partFile)
+		if err != nil {
+			sendError(w, http.StatusInternalServerError, "Reading private part failed", err.Error())
+			return
+		}
+		opts.PrivatePartDigest = privatePartDigest(model)
+		root = privateLibraryPath(apiKeyFromContext(r.Context()))
+	} else {
+		opts = applyPartOverride(partNumber, opts)
+	}
+	resp := ValidateResponse{PartNumber: partNumber, Format: format, DPI: dpi, Options: opts, Private: private}
+	if rel, err := filepath.Rel(root, partFile); err == nil {
+		resp.PartFile = filepath.ToSlash(rel)
+	}
+	if body.Color != nil {
+		c, _ := lookupColor(*body.Color)
+		resp.Color = &c
+	}
+	resp.Cached = renderCache.has(renderCacheKey(partNumber, opts))
+	resp.Options.GhostFile, resp.Options.ObjectsFile = "", ""
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestRenderValidate(t *testing.T) {
+	capture := withFakeBlender(t)
+	withTestLibrary(t, map[string]string{"3001": "0 Brick 2 x 4\n"})
+	withRenderCache(t)
+
+	validate := func(body string) (int, ValidateResponse, ErrorResponse) {
+		w := httptest.NewRecorder()
+		handleRenderValidate(w, httptest.NewRequest(http.MethodPost, "/render/validate", bytes.NewReader([]byte(body))))
+		var resp ValidateResponse
+		var e ErrorResponse
+		if w.Code == http.StatusOK {
+			json.Unmarshal(w.Body.Bytes(), &resp)
+		} else {
+			json.Unmarshal(w.Body.Bytes(), &e)
+		}
+		return w.Code, resp, e
+	}
+
+	status, resp, _ := validate(`{"partNumber": "3001", "color": 47, "format": "png"}`)
+	if status != http.StatusOK {
+		t.Fatalf("status %d", status)
+	}
+	if resp.PartNumber != "3001" || resp.PartFile != "parts/3001.dat" || resp.Format != "png" {
+		t.Errorf("unexpected response %+v", resp)
+	}
+	if resp.Color == nil || resp.Color.Name != "Trans_Clear" || resp.Options.FillColor != "#FCFCFC" || resp.Options.FillOpacity != 128.0/255 {
+		t.Errorf("color 47 not resolved: %+v, %+v", resp.Color, resp.Options)
+	}
+	if resp.Options.Thickness != 2 || resp.Cached {
+		t.Errorf("expected defaults and no cached render, got %+v", resp)
+	}
+	if _, err := os.Stat(capture); err == nil {
+		t.Error("validating ran Blender")
+	}
+
+	if status, _, e := validate(`{"partNumber": "3001", "color": 9999, "thickness": 50}`); status != http.StatusBadRequest || len(e.Fields) != 2 {
+		t.Errorf("expected 400 with two field errors, got %d %+v", status, e)
+	}
+	if status, _, _ := validate(`{"partNumber": "9999"}`); status != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown part, got %d", status)
+	}
+	if status, _, _ := validate(`{"partNumber": "../secret"}`); status != http.StatusBadRequest {
+		t.Errorf("expected 400 for an invalid part number, got %d", status)
+	}
+}
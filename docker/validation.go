@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// JSON request bodies are capped at MAX_REQUEST_BYTES and decoded strictly:
+// unknown fields and trailing data are errors, so a misspelled option fails
+// loudly instead of silently rendering with the default. Validation collects
+// every problem with a request and reports them together in "fields".
+var maxRequestBytes = int64(getEnvInt("MAX_REQUEST_BYTES", 1<<20))
+
+// FieldError is one problem with a request field
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// The problems found validating a request, in field order
+type fieldErrors []FieldError
+
+func (e *fieldErrors) add(field, format string, args ...any) {
+	*e = append(*e, FieldError{field, fmt.Sprintf(format, args...)})
+}
+
+// Add the problems in err (a fieldErrors or any other error) under prefix,
+// e.g. "render" or "options[2]"
+func (e *fieldErrors) merge(prefix string, err error) {
+	if err == nil {
+		return
+	}
+	var sub fieldErrors
+	if !errors.As(err, &sub) {
+		sub = fieldErrors{{Message: err.Error()}}
+	}
+	for _, fe := range sub {
+		if prefix != "" {
+			fe.Message = prefix + ": " + fe.Message
+			if fe.Field == "" {
+				fe.Field = prefix
+			} else {
+				fe.Field = prefix + "." + fe.Field
+			}
+		}
+		*e = append(*e, fe)
+	}
+}
+
+func (e fieldErrors) Error() string {
+	messages := make([]string, len(e))
+	for i, fe := range e {
+		messages[i] = fe.Message
+	}
+	return strings.Join(messages, "; ")
+}
+
+// The collected problems as an error, or nil if there weren't any
+func (e fieldErrors) err() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
+// Helper: send a 400 for a validation error, listing each field's problem
+func sendValidationError(w http.ResponseWriter, err error) {
+	resp := ErrorResponse{Error: err.Error()}
+	var errs fieldErrors
+	if errors.As(err, &errs) {
+		resp.Fields = errs
+	}
+	sendErrorResponse(w, http.StatusBadRequest, resp)
+}
+
+// Helper: decode a JSON request body into v, sending the error response and
+// returning false if it's too large or isn't valid for v
+func decodeJSON(w http.ResponseWriter, r *http.Request, v any) bool {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestBytes))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(v)
+	if err == nil && dec.Decode(&json.RawMessage{}) != io.EOF {
+		err = errors.New("unexpected data after the JSON value")
+	}
+
+	var tooLarge *http.MaxBytesError
+	switch {
+	case err == nil:
+		return true
+	case errors.As(err, &tooLarge):
+		sendError(w, http.StatusRequestEntityTooLarge, "Request body too large", fmt.Sprintf("JSON bodies are limited to %d bytes", tooLarge.Limit))
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		field := strings.Trim(strings.TrimPrefix(err.Error(), "json: unknown field "), `"`)
+		sendErrorResponse(w, http.StatusBadRequest, ErrorResponse{
+			Error:  "Unknown field " + field,
+			Fields: []FieldError{{field, "unknown field"}},
+		})
+	default:
+		resp := ErrorResponse{Error: "Invalid JSON", Detail: err.Error()}
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) && typeErr.Field != "" {
+			resp.Fields = []FieldError{{typeErr.Field, "must be " + jsonTypeName(typeErr.Type.Kind().String())}}
+		}
+		sendErrorResponse(w, http.StatusBadRequest, resp)
+	}
+	return false
+}
+
+// A JSON name for a Go kind, for type errors
+func jsonTypeName(kind string) string {
+	switch {
+	case strings.HasPrefix(kind, "int"), strings.HasPrefix(kind, "uint"), strings.HasPrefix(kind, "float"):
+		return "a number"
+	case kind == "string":
+		return "a string"
+	case kind == "bool":
+		return "a boolean"
+	case kind == "slice" || kind == "array":
+		return "an array"
+	default:
+		return "an object"
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func postRender(t *testing.T, body string) (int, ErrorResponse) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	handleRender(rec, httptest.NewRequest(http.MethodPost, "/render", strings.NewReader(body)))
+	var resp ErrorResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("decode error response: %v", err)
+	}
+	return rec.Code, resp
+}
+
+func TestDecodeJSONRejectsUnknownFields(t *testing.T) {
+	code, resp := postRender(t, `{"partNumber":"3001","thicknes":3}`)
+	if code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", code)
+	}
+	if resp.Error != "Unknown field thicknes" || len(resp.Fields) != 1 || resp.Fields[0].Field != "thicknes" {
+		t.Errorf("unexpected response %+v", resp)
+	}
+}
+
+func TestDecodeJSONRejectsTrailingData(t *testing.T) {
+	code, resp := postRender(t, `{"partNumber":"3001"} {"partNumber":"3002"}`)
+	if code != http.StatusBadRequest || resp.Error != "Invalid JSON" {
+		t.Errorf("expected 400 Invalid JSON, got %d %+v", code, resp)
+	}
+}
+
+func TestDecodeJSONTypeError(t *testing.T) {
+	code, resp := postRender(t, `{"partNumber":"3001","thickness":"thick"}`)
+	if code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", code)
+	}
+	if len(resp.Fields) != 1 || resp.Fields[0].Field != "thickness" || resp.Fields[0].Message != "must be a number" {
+		t.Errorf("unexpected fields %+v", resp.Fields)
+	}
+}
+
+func TestDecodeJSONBodyLimit(t *testing.T) {
+	old := maxRequestBytes
+	maxRequestBytes = 64
+	t.Cleanup(func() { maxRequestBytes = old })
+
+	code, resp := postRender(t, `{"partNumber":"`+strings.Repeat("3", 100)+`"}`)
+	if code != http.StatusRequestEntityTooLarge || resp.Error != "Request body too large" {
+		t.Errorf("expected 413, got %d %+v", code, resp)
+	}
+}
+
+func TestRenderReportsEveryInvalidField(t *testing.T) {
+	code, resp := postRender(t, `{"thickness":50,"padding":2,"fillColor":"bogus","colorScheme":"neon"}`)
+	if code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", code)
+	}
+	var fields []string
+	for _, fe := range resp.Fields {
+		fields = append(fields, fe.Field)
+	}
+	if got, want := strings.Join(fields, ","), "partNumber,fillColor,thickness,padding,colorScheme"; got != want {
+		t.Errorf("fields = %s, want %s", got, want)
+	}
+	if !strings.HasPrefix(resp.Error, "partNumber is required; ") {
+		t.Errorf("expected the messages joined in field order, got %q", resp.Error)
+	}
+}
+
+func TestContactSheetReportsNestedFields(t *testing.T) {
+	req := ContactSheetRequest{
+		Items:   []InventoryItem{{PartNumber: "3001"}, {Quantity: -1}},
+		Columns: 99,
+		Render:  &RenderRequest{Thickness: 50},
+	}
+	_, err := req.validate()
+	errs, ok := err.(fieldErrors)
+	if !ok {
+		t.Fatalf("expected fieldErrors, got %v", err)
+	}
+	var fields []string
+	for _, fe := range errs {
+		fields = append(fields, fe.Field)
+	}
+	if got, want := strings.Join(fields, ","), "items[1].partNumber,items[1].quantity,columns,render.thickness"; got != want {
+		t.Errorf("fields = %s, want %s", got, want)
+	}
+	if last := errs[len(errs)-1].Message; last != "render: thickness must be between 0.5 and 20.0" {
+		t.Errorf("unexpected nested message %q", last)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+// GET /version reports everything a render depends on, so two servers
+// that render differently can be compared at a glance: the service build,
+// the Blender it runs, the render script, and the LDraw library.
+type VersionResponse struct {
+	Service struct {
+		Version string `json:"version"`
+		// The VCS revision and commit time Go stamped the binary with, if
+		// it was built from a checkout
+		Revision  string `json:"revision,omitempty"`
+		BuildTime string `json:"buildTime,omitempty"`
+		Modified  bool   `json:"modified,omitempty"`
+		GoVersion string `json:"goVersion"`
+	} `json:"service"`
+	// The first line of blender --version, or "unknown"
+	Blender string `json:"blender"`
+	Script  struct {
+		Path   string `json:"path"`
+		SHA256 string `json:"sha256"`
+	} `json:"script"`
+	Library struct {
+		Path    string `json:"path"`
+		Version string `json:"version"`
+		// Files directly in parts/, not counting subparts
+		Parts int `json:"parts"`
+	} `json:"library"`
+	// The render cache's version of the script and library; see cache.go
+	RenderVersion string `json:"renderVersion"`
+}
+
+func handleVersion(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		sendError(w, http.StatusMethodNotAllowed, "Method not allowed", "")
+		return
+	}
+
+	var resp VersionResponse
+	resp.Service.Version, resp.Service.GoVersion = serviceVersion, runtime.Version()
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				resp.Service.Revision = s.Value
+			case "vcs.time":
+				resp.Service.BuildTime = s.Value
+			case "vcs.modified":
+				resp.Service.Modified = s.Value == "true"
+			}
+		}
+	}
+	resp.Blender = blenderVersion(r.Context())
+	resp.Script.Path, resp.Script.SHA256 = renderScript, fileSHA256(renderScript)
+	resp.Library.Path, resp.Library.Version, resp.Library.Parts = ldrawPath, libraryVersion(), libraryPartCount()
+	resp.RenderVersion = renderVersion()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// The first line of blender --version ("Blender 4.1.1")
+func blenderVersion(ctx context.Context) string {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, blenderBin, "--version").Output()
+	if err != nil {
+		return "unknown"
+	}
+	line, _, _ := strings.Cut(strings.TrimSpace(string(out)), "\n")
+	return strings.TrimSpace(line)
+}
+
+// A file's SHA-256 in hex, or "" if it can't be read
+func fileSHA256(path string) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// The part files in the library's parts directory
+func libraryPartCount() int {
+	return libraryPartCountOf(ldrawPath)
+}
+
+// The part files in the parts directory of the library at root
+func libraryPartCountOf(root string) int {
+	entries, err := os.ReadDir(filepath.Join(root, "parts"))
+	if err != nil {
+		return 0
+	}
+	n := 0
+	for _, e := range entries {
+		if !e.IsDir() && strings.EqualFold(filepath.Ext(e.Name()), ".dat") {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVersion(t *testing.T) {
+	withTestLibrary(t, map[string]string{"3001": "0 Brick 2 x 4\n", "3003": "0 Brick 2 x 2\n", "s/3001s01": "0 ~Brick 2 x 4 Subpart\n"})
+	dir := t.TempDir()
+	script := filepath.Join(dir, "render_part.py")
+	os.WriteFile(script, []byte("print('render')\n"), 0o644)
+	blender := filepath.Join(dir, "blender")
+	os.WriteFile(blender, []byte("#!/bin/sh\necho 'Blender 4.1.1'\necho 'build date: 2024-04-15'\n"), 0o755)
+	oldScript, oldBlender := renderScript, blenderBin
+	renderScript, blenderBin = script, blender
+	t.Cleanup(func() { renderScript, blenderBin = oldScript, oldBlender })
+
+	w := httptest.NewRecorder()
+	handleVersion(w, httptest.NewRequest(http.MethodGet, "/version", nil))
+	var resp VersionResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Blender != "Blender 4.1.1" {
+		t.Errorf("unexpected Blender version %q", resp.Blender)
+	}
+	if resp.Library.Parts != 2 || resp.Library.Version == "" {
+		t.Errorf("unexpected library %+v", resp.Library)
+	}
+	if resp.Script.SHA256 != fileSHA256(script) || len(resp.Script.SHA256) != 64 {
+		t.Errorf("unexpected script checksum %q", resp.Script.SHA256)
+	}
+	if resp.Service.Version != serviceVersion || resp.Service.GoVersion == "" || resp.RenderVersion == "" {
+		t.Errorf("unexpected service info %+v", resp.Service)
+	}
+
+	blenderBin = filepath.Join(dir, "missing")
+	w = httptest.NewRecorder()
+	handleVersion(w, httptest.NewRequest(http.MethodGet, "/version", nil))
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if resp.Blender != "unknown" {
+		t.Errorf("expected an unknown Blender version, got %q", resp.Blender)
+	}
+}
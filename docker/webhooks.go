@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Jobs submitted with a callbackUrl are reported there when they finish: a
+// POST of the job's status, signed with WEBHOOK_SECRET so the receiver can
+// tell it came from us. The signature is an HMAC-SHA256 over
+// timestamp + "\n" + body, sent as
+//
+//	X-Webhook-Timestamp: <unix seconds>
+//	X-Webhook-Signature: sha256=<hex>
+//
+// Receivers should reject old timestamps to stop replays. Network errors,
+// 408, 429, and 5xx responses are retried with exponential backoff (with
+// jitter) up to WEBHOOK_MAX_ATTEMPTS; other responses are final. Retries
+// are held in memory, so a restart abandons them. Recent deliveries are
+// listed at GET /admin/webhooks/deliveries.
+//
+// Callback URLs come from API key holders, so they may not reach this
+// network: hosts resolving to loopback, private, link-local, or unspecified
+// addresses are refused when the job is submitted, and again when
+// connecting, so a DNS answer that changes in between doesn't get through.
+// WEBHOOK_ALLOW_PRIVATE=true lifts this for receivers inside the network.
+var (
+	webhookSecret        = getEnv("WEBHOOK_SECRET", "")
+	webhookMaxAttempts   = getEnvInt("WEBHOOK_MAX_ATTEMPTS", 8)
+	webhookRetryDelay    = getEnvDuration("WEBHOOK_RETRY_DELAY", 5*time.Second)
+	webhookMaxRetryDelay = getEnvDuration("WEBHOOK_MAX_RETRY_DELAY", 10*time.Minute)
+	webhookTimeout       = getEnvDuration("WEBHOOK_TIMEOUT", 10*time.Second)
+	webhookAllowPrivate  = getEnv("WEBHOOK_ALLOW_PRIVATE", "") == "true"
+)
+
+// Deliveries kept for the admin log
+const webhookLogSize = 500
+
+const (
+	webhookPending   = "pending"
+	webhookDelivered = "delivered"
+	webhookFailed    = "failed"
+)
+
+// The body of a webhook POST
+type WebhookEvent struct {
+	ID    string    `json:"id"`
+	Event string    `json:"event"`
+	Job   JobStatus `json:"job"`
+}
+
+type WebhookAttempt struct {
+	At         time.Time `json:"at"`
+	StatusCode int       `json:"statusCode,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Seconds    float64   `json:"seconds"`
+}
+
+type WebhookDelivery struct {
+	ID          string           `json:"id"`
+	Event       string           `json:"event"`
+	JobID       string           `json:"jobId"`
+	URL         string           `json:"url"`
+	Status      string           `json:"status"`
+	CreatedAt   time.Time        `json:"createdAt"`
+	NextAttempt *time.Time       `json:"nextAttempt,omitempty"`
+	Attempts    []WebhookAttempt `json:"attempts"`
+}
+
+// Recent deliveries, oldest first
+var webhookLog = struct {
+	sync.Mutex
+	deliveries []*WebhookDelivery
+}{}
+
+var webhookClient = &http.Client{
+	Timeout: webhookTimeout,
+	// No proxy, so the address checked is the one connected to
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: webhookTimeout,
+			Control: func(network, address string, _ syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				if ip := net.ParseIP(host); ip == nil || !webhookAddrAllowed(ip) {
+					return fmt.Errorf("webhook address %s is not allowed", host)
+				}
+				return nil
+			},
+		}).DialContext,
+		TLSHandshakeTimeout: webhookTimeout,
+	},
+	// A redirected POST would turn into a GET; treat it as a failure
+	CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+}
+
+// Whether webhooks may be sent to ip
+func webhookAddrAllowed(ip net.IP) bool {
+	return webhookAllowPrivate || !(ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsUnspecified())
+}
+
+// Check a job's callback URL, resolving its host
+func validateCallbackURL(raw string) error {
+	if webhookSecret == "" {
+		return fmt.Errorf("callbackUrl needs WEBHOOK_SECRET to be set on the server")
+	}
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("callbackUrl must be an absolute http or https URL")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, u.Hostname())
+	if err != nil {
+		return fmt.Errorf("callbackUrl host %s does not resolve", u.Hostname())
+	}
+	for _, addr := range addrs {
+		if !webhookAddrAllowed(addr.IP) {
+			return fmt.Errorf("callbackUrl host %s resolves to %s, which is not allowed", u.Hostname(), addr.IP)
+		}
+	}
+	return nil
+}
+
+func signWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s\n", timestamp)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Report a finished job to its callback URL in the background
+func sendJobWebhook(callbackURL string, status JobStatus) {
+	delivery := &WebhookDelivery{
+		ID:        newJobID(),
+		Event:     "job." + status.Status,
+		JobID:     status.ID,
+		URL:       callbackURL,
+		Status:    webhookPending,
+		CreatedAt: time.Now().UTC(),
+		Attempts:  []WebhookAttempt{},
+	}
+	body, _ := json.Marshal(WebhookEvent{ID: delivery.ID, Event: delivery.Event, Job: status})
+
+	webhookLog.Lock()
+	webhookLog.deliveries = append(webhookLog.deliveries, delivery)
+	if n := len(webhookLog.deliveries); n > webhookLogSize {
+		webhookLog.deliveries = append([]*WebhookDelivery(nil), webhookLog.deliveries[n-webhookLogSize:]...)
+	}
+	webhookLog.Unlock()
+	go deliverWebhook(delivery, body)
+}
+
+func deliverWebhook(delivery *WebhookDelivery, body []byte) {
+	for attempt := 1; ; attempt++ {
+		a, retry := postWebhook(delivery, body)
+		webhookLog.Lock()
+		delivery.Attempts = append(delivery.Attempts, a)
+		delivery.NextAttempt = nil
+		switch {
+		case a.Error == "":
+			delivery.Status = webhookDelivered
+		case !retry || attempt >= webhookMaxAttempts:
+			delivery.Status = webhookFailed
+		}
+		if delivery.Status != webhookPending {
+			webhookLog.Unlock()
+			if delivery.Status == webhookFailed {
+				log.Printf("Webhook %s for job %s failed after %d attempts: %s", delivery.ID, delivery.JobID, attempt, a.Error)
+			}
+			return
+		}
+		delay := webhookBackoff(attempt)
+		next := time.Now().Add(delay).UTC()
+		delivery.NextAttempt = &next
+		webhookLog.Unlock()
+		time.Sleep(delay)
+	}
+}
+
+// One delivery attempt, and whether a failure is worth retrying
+func postWebhook(delivery *WebhookDelivery, body []byte) (WebhookAttempt, bool) {
+	start := time.Now()
+	a := WebhookAttempt{At: start.UTC()}
+	req, err := http.NewRequest(http.MethodPost, delivery.URL, bytes.NewReader(body))
+	if err != nil {
+		a.Error = err.Error()
+		return a, false
+	}
+	timestamp := strconv.FormatInt(start.Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "lego-renderer-webhooks")
+	req.Header.Set("X-Webhook-Id", delivery.ID)
+	req.Header.Set("X-Webhook-Event", delivery.Event)
+	req.Header.Set("X-Webhook-Timestamp", timestamp)
+	req.Header.Set("X-Webhook-Signature", signWebhook(webhookSecret, timestamp, body))
+
+	resp, err := webhookClient.Do(req)
+	a.Seconds = time.Since(start).Seconds()
+	if err != nil {
+		a.Error = err.Error()
+		return a, true
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+	a.StatusCode = resp.StatusCode
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return a, false
+	}
+	a.Error = resp.Status
+	code := resp.StatusCode
+	return a, code == http.StatusRequestTimeout || code == http.StatusTooManyRequests || code >= 500
+}
+
+// The wait after a failed attempt: doubling from WEBHOOK_RETRY_DELAY up to
+// WEBHOOK_MAX_RETRY_DELAY, less up to half at random so receivers coming
+// back from an outage aren't hit by every retry at once
+func webhookBackoff(attempt int) time.Duration {
+	delay := webhookRetryDelay
+	for i := 1; i < attempt && delay < webhookMaxRetryDelay; i++ {
+		delay *= 2
+	}
+	delay = min(delay, webhookMaxRetryDelay)
+	return delay - time.Duration(rand.Int64N(int64(delay)/2+1))
+}
+
+// Webhook delivery log endpoint. ?job= and ?status= filter it.
+func handleWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		sendError(w, http.StatusMethodNotAllowed, "Method not allowed", "")
+		return
+	}
+	job, status := r.URL.Query().Get("job"), r.URL.Query().Get("status")
+
+	list := []WebhookDelivery{}
+	webhookLog.Lock()
+	for i := len(webhookLog.deliveries) - 1; i >= 0; i-- {
+		d := webhookLog.deliveries[i]
+		if (job == "" || d.JobID == job) && (status == "" || d.Status == status) {
+			copied := *d
+			copied.Attempts = append([]WebhookAttempt(nil), d.Attempts...)
+			list = append(list, copied)
+		}
+	}
+	webhookLog.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"deliveries": list})
+}
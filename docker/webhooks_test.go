@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func withWebhooks(t *testing.T) {
+	t.Helper()
+	oldSecret, oldDelay, oldAttempts, oldPrivate := webhookSecret, webhookRetryDelay, webhookMaxAttempts, webhookAllowPrivate
+	// The test receivers listen on loopback
+	webhookSecret, webhookRetryDelay, webhookMaxAttempts, webhookAllowPrivate = "hook-secret", time.Millisecond, 3, true
+	t.Cleanup(func() {
+		webhookSecret, webhookRetryDelay, webhookMaxAttempts, webhookAllowPrivate = oldSecret, oldDelay, oldAttempts, oldPrivate
+		webhookLog.Lock()
+		webhookLog.deliveries = nil
+		webhookLog.Unlock()
+	})
+}
+
+// A receiver that fails its first few calls and records the rest
+type webhookReceiver struct {
+	mu       sync.Mutex
+	failures int
+	calls    int
+	events   []WebhookEvent
+	headers  []http.Header
+}
+
+func (h *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.calls++
+	if h.calls <= h.failures {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	if r.Header.Get("X-Webhook-Signature") != signWebhook("hook-secret", r.Header.Get("X-Webhook-Timestamp"), body) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	var event WebhookEvent
+	json.Unmarshal(body, &event)
+	h.events = append(h.events, event)
+	h.headers = append(h.headers, r.Header)
+}
+
+func waitForDelivery(t *testing.T, jobID string) WebhookDelivery {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		w := httptest.NewRecorder()
+		handleWebhookDeliveries(w, httptest.NewRequest(http.MethodGet, "/admin/webhooks/deliveries?job="+jobID, nil))
+		var resp struct{ Deliveries []WebhookDelivery }
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		if len(resp.Deliveries) == 1 && resp.Deliveries[0].Status != webhookPending {
+			return resp.Deliveries[0]
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("no finished delivery for %s: %+v", jobID, resp.Deliveries)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestJobWebhookRetriesUntilDelivered(t *testing.T) {
+	withWebhooks(t)
+	withJobQueue(t)
+	receiver := &webhookReceiver{failures: 2}
+	srv := httptest.NewServer(receiver)
+	defer srv.Close()
+
+	status := submitJob(t, `{"partNumber":"3001","callbackUrl":"`+srv.URL+`/hook"}`)
+	update, _ := json.Marshal(jobUpdate{ID: status.ID, Status: jobDone, Worker: "w1", SVG: "<svg/>", RenderSeconds: 1})
+	handleJobUpdate("", update)
+
+	delivery := waitForDelivery(t, status.ID)
+	if delivery.Status != webhookDelivered || len(delivery.Attempts) != 3 || delivery.Attempts[0].StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected delivery on the third attempt, got %+v", delivery)
+	}
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+	if len(receiver.events) != 1 {
+		t.Fatalf("expected one signed event, got %d", len(receiver.events))
+	}
+	event, header := receiver.events[0], receiver.headers[0]
+	if event.Event != "job.done" || event.Job.ID != status.ID || event.Job.Status != jobDone || event.ID != delivery.ID {
+		t.Errorf("unexpected event %+v", event)
+	}
+	if header.Get("X-Webhook-Id") != delivery.ID || header.Get("X-Webhook-Event") != "job.done" {
+		t.Errorf("unexpected headers %v", header)
+	}
+}
+
+func TestJobWebhookGivesUp(t *testing.T) {
+	withWebhooks(t)
+	withJobQueue(t)
+	receiver := &webhookReceiver{failures: 100}
+	srv := httptest.NewServer(receiver)
+	defer srv.Close()
+
+	status := submitJob(t, `{"partNumber":"3001","callbackUrl":"`+srv.URL+`"}`)
+	update, _ := json.Marshal(jobUpdate{ID: status.ID, Status: jobFailed, StatusCode: http.StatusNotFound, Error: &ErrorResponse{Error: "Part not found"}})
+	handleJobUpdate("", update)
+
+	delivery := waitForDelivery(t, status.ID)
+	if delivery.Status != webhookFailed || len(delivery.Attempts) != webhookMaxAttempts || delivery.Event != "job.failed" {
+		t.Errorf("expected %d failed attempts, got %+v", webhookMaxAttempts, delivery)
+	}
+
+	// Client errors aren't retried
+	receiver.mu.Lock()
+	receiver.failures = 0
+	receiver.mu.Unlock()
+	webhookSecret = "rotated"
+	status = submitJob(t, `{"partNumber":"3001","callbackUrl":"`+srv.URL+`"}`)
+	handleJobUpdate("", []byte(`{"id":"`+status.ID+`","status":"done","svg":"<svg/>"}`))
+	if delivery := waitForDelivery(t, status.ID); delivery.Status != webhookFailed || len(delivery.Attempts) != 1 {
+		t.Errorf("expected a 401 to fail at once, got %+v", delivery)
+	}
+}
+
+func TestJobCallbackURLValidates(t *testing.T) {
+	withJobQueue(t)
+	old := webhookSecret
+	t.Cleanup(func() { webhookSecret = old })
+	for secret, body := range map[string]string{
+		"":  `{"partNumber":"3001","callbackUrl":"https://example.com/hook"}`,
+		"s": `{"partNumber":"3001","callbackUrl":"ftp://example.com/hook"}`,
+	} {
+		webhookSecret = secret
+		w := callJobs(http.MethodPost, "/jobs", body)
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "callbackUrl") {
+			t.Errorf("%s: expected a callbackUrl error, got %d %s", body, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestCallbackURLRefusesInternalAddresses(t *testing.T) {
+	withWebhooks(t)
+	webhookAllowPrivate = false
+	for _, u := range []string{
+		"http://127.0.0.1:8080/hook",
+		"http://localhost/hook",
+		"http://169.254.169.254/latest/meta-data/",
+		"http://10.0.0.5/hook",
+		"http://192.168.1.1/hook",
+		"http://[::1]/hook",
+		"http://[fe80::1]/hook",
+		"http://0.0.0.0/hook",
+	} {
+		if err := validateCallbackURL(u); err == nil || !strings.Contains(err.Error(), "not allowed") {
+			t.Errorf("%s: expected it to be refused, got %v", u, err)
+		}
+	}
+	if err := validateCallbackURL("http://203.0.113.7/hook"); err != nil {
+		t.Errorf("public address refused: %v", err)
+	}
+
+	// A host that passed validation and now resolves inward is refused on
+	// connecting
+	srv := httptest.NewServer(&webhookReceiver{})
+	defer srv.Close()
+	resp, err := webhookClient.Post(srv.URL, "application/json", strings.NewReader("{}"))
+	if err == nil {
+		resp.Body.Close()
+	}
+	if err == nil || !strings.Contains(err.Error(), "not allowed") {
+		t.Errorf("expected the dial to be refused, got %v", err)
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	oldDelay, oldMax := webhookRetryDelay, webhookMaxRetryDelay
+	webhookRetryDelay, webhookMaxRetryDelay = time.Second, 10*time.Second
+	t.Cleanup(func() { webhookRetryDelay, webhookMaxRetryDelay = oldDelay, oldMax })
+	for attempt, want := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 10: 10 * time.Second} {
+		for range 20 {
+			if d := webhookBackoff(attempt); d < want/2 || d > want {
+				t.Errorf("attempt %d: %v outside [%v, %v]", attempt, d, want/2, want)
+			}
+		}
+	}
+}
@@ -1,3 +1,3 @@
 module lego-renderer
 
-go 1.22
+go 1.24
@@ -4,7 +4,13 @@ Render an LDraw part as an SVG line drawing using Blender Freestyle.
 Usage:
     blender --background --python render_part.py -- <input.dat> <output.svg> [ldraw_path] [thickness] \
         [fill_color] [camera_lat] [camera_lon] [res_x] [res_y] [padding] [crease_angle] [edge_types] \
-        [fill_opacity] [stroke_color]
+        [fill_opacity] [stroke_color] [normalize] [ghost_file] \
+        [fill_mode] [line_style] [sketch_jitter] [shading_file] [raster_file] [toon_bands] \
+        [ao_file] [line_taper] [line_fade] [crease_weight] [backbone_stretch] [dash_pattern] \
+        [line_style_plugin] [color_edge_types] [objects_file] [frame_file] [supersample] \
+        [mirror] [transform] [section_plane] \
+        [hidden_edge_opacity] [hidden_edge_dash] [bfc] [condlines] [line_pressure] \
+        [depth_cue]
 
 Arguments:
     input.dat      Path to the LDraw .dat part file
@@ -21,16 +27,84 @@ Arguments:
     edge_types     Comma-separated edge types (default: silhouette,crease,border)
     fill_opacity   Fill opacity 0.0-1.0 (default: 1.0); <1.0 enables hidden edge rendering
     stroke_color   Stroke color for lines (default: currentColor)
+    normalize      Orientation normalization: auto or off (default: auto)
+    ghost_file     Optional LDraw file drawn as ghosted helper parts in the same frame
+                   (translucent fill, dashed edges); empty for none
+    fill_mode      uniform (every fill is fill_color) or ldraw (fills use each part's
+                   LDraw color from LDConfig.ldr) (default: uniform)
+    line_style     clean, sketch for wobbly, overshooting, uneven hand-drawn lines, or
+                   wireframe for every mesh edge in place of edge_types (default: clean)
+    sketch_jitter  How far sketch lines wander from the edges, in pixels (default: 2)
+    shading_file   Optional path to write each visible face's outline and light level
+                   to as JSON, for the server's hatching; empty for none
+    raster_file    Optional path to also render a cel-shaded PNG to, flat colors in
+                   toon_bands steps of light with the lines left out; empty for none
+    toon_bands     Number of shading steps in the raster (default: 3)
+    ao_file        Optional path to write the ambient occlusion pass to as a PNG (white
+                   open, darker occluded, transparent off the part); empty for none
+    line_taper     Thin stroke ends to (1 - line_taper) of the thickness (default: 0)
+    line_fade      Fade stroke ends to (1 - line_fade) opacity (default: 0)
+    crease_weight  Thicken the sharpest creases by this many times the thickness (default: 0)
+    backbone_stretch  Extend both ends of every stroke by this many pixels (default: 0)
+    dash_pattern   Comma-separated dash and gap lengths in pixels, up to three pairs,
+                   or none (default: none)
+    line_style_plugin  Optional operator plugin script: its apply(linestyle, args) is
+                   called for each line set and postprocess(svg_path, args) on the
+                   finished SVG, when defined; empty for none
+    color_edge_types  Comma-separated edge types to also draw in a line set of their own,
+                   ViewLayer_ColorEdges_<type>, for the server to color, or none
+                   (default: none)
+    objects_file   Optional JSON file of placed parts drawn as objects of their own, each
+                   in its own fill and stroke color in a ViewLayer_ObjectEdges_<id> line
+                   set; empty for none
+    frame_file     Optional path to write the camera framing to as JSON: the model size
+                   of one pixel in LDraw units, for physical output units; empty for none
+    supersample    Sample strokes this many times as finely as Freestyle's default, for
+                   smoother curves (default: 1)
+    mirror         LDraw axes to reflect the model across, some of x, y, and z, or none
+                   (default: none)
+    transform      The model's pose, a 3x3 matrix on the LDraw axes as 9 comma-separated
+                   numbers row by row, or none (default: none)
+    section_plane  Cut the model away on one side of a plane, given as its origin and
+                   normal on the LDraw axes, 6 comma-separated numbers; the normal points
+                   at the side removed, and the cut faces' fills are marked
+                   data-section="1" (default: none)
+    hidden_edge_opacity  Draw the edges behind faces at this opacity even for opaque fills,
+                   in a ViewLayer_HiddenEdges line set over the visible ones; 0 leaves
+                   them to fill_opacity (default: 0)
+    hidden_edge_dash  Comma-separated dash and gap lengths for those hidden edges, or none
+                   (default: none)
+    bfc            recalculate to make face normals consistent after import, or ldraw to
+                   keep the winding the importer read from BFC statements (default:
+                   recalculate)
+    condlines      Where curved surfaces get outlines, as LDraw's conditional lines
+                   do: mesh for silhouettes on the mesh's edges, or smooth for
+                   silhouettes across faces from the smoothed normals (default: mesh)
+    line_pressure  Thicken strokes on curved surfaces by up to this many times the
+                   thickness, more the tighter the curve (default: 0)
+    depth_cue      on to draw the Edges line set's strokes in gray by camera depth,
+                   black nearest to white farthest, for the server to tint; or off
+                   (default: off)
 """
 
 import bpy
 import addon_utils
+import bmesh
+import html
+import importlib.util
+import json
 import sys
 import os
 import re
 import mathutils
 import xml.etree.ElementTree as ET
-from math import radians, atan, sqrt
+from bpy_extras.object_utils import world_to_camera_view
+from math import radians, atan, sqrt, cos
+
+
+def report_progress(phase, percent):
+    """Tell the server how far along the render is (see the contract's progress phases)."""
+    print(f"PROGRESS {phase} {percent}", flush=True)
 
 
 def parse_args():
@@ -59,6 +133,34 @@ def parse_args():
         "edge_types": argv[11] if len(argv) > 11 else "silhouette,crease,border",
         "fill_opacity": float(argv[12]) if len(argv) > 12 else 1.0,
         "stroke_color": argv[13] if len(argv) > 13 else "currentColor",
+        "normalize": argv[14] if len(argv) > 14 else "auto",
+        "ghost_file": argv[15] if len(argv) > 15 else "",
+        "fill_mode": argv[16] if len(argv) > 16 else "uniform",
+        "line_style": argv[17] if len(argv) > 17 else "clean",
+        "sketch_jitter": float(argv[18]) if len(argv) > 18 else 2.0,
+        "shading_file": argv[19] if len(argv) > 19 else "",
+        "raster_file": argv[20] if len(argv) > 20 else "",
+        "toon_bands": int(argv[21]) if len(argv) > 21 else 3,
+        "ao_file": argv[22] if len(argv) > 22 else "",
+        "line_taper": float(argv[23]) if len(argv) > 23 else 0.0,
+        "line_fade": float(argv[24]) if len(argv) > 24 else 0.0,
+        "crease_weight": float(argv[25]) if len(argv) > 25 else 0.0,
+        "backbone_stretch": float(argv[26]) if len(argv) > 26 else 0.0,
+        "dash_pattern": argv[27] if len(argv) > 27 else "none",
+        "line_style_plugin": argv[28] if len(argv) > 28 else "",
+        "color_edge_types": argv[29] if len(argv) > 29 else "none",
+        "objects_file": argv[30] if len(argv) > 30 else "",
+        "frame_file": argv[31] if len(argv) > 31 else "",
+        "supersample": int(argv[32]) if len(argv) > 32 else 1,
+        "mirror": argv[33] if len(argv) > 33 else "none",
+        "transform": argv[34] if len(argv) > 34 else "none",
+        "section_plane": argv[35] if len(argv) > 35 else "none",
+        "hidden_edge_opacity": float(argv[36]) if len(argv) > 36 else 0.0,
+        "hidden_edge_dash": argv[37] if len(argv) > 37 else "none",
+        "bfc": argv[38] if len(argv) > 38 else "recalculate",
+        "condlines": argv[39] if len(argv) > 39 else "mesh",
+        "line_pressure": float(argv[40]) if len(argv) > 40 else 0.0,
+        "depth_cue": argv[41] if len(argv) > 41 else "off",
     }
 
 
@@ -99,6 +201,91 @@ def import_ldraw_part(filepath, ldraw_path):
     )
 
 
+def normalize_orientation(obj, min_aligned_fraction=0.1):
+    """Snap a part authored at an odd angle back onto the LDraw axes.
+
+    Standard parts have a good share of their surface area on faces whose
+    normals lie along the principal axes (sides, bottoms, stud tops), even
+    slopes and round parts. A part with almost none is taken to be tilted:
+    it is rotated so its dominant face direction lies on the nearest axis,
+    then spun about that axis to square up the next dominant direction, and
+    finally re-origined to the center of its bounding-box base.
+
+    Aligned parts are left untouched. Framing works from the bounding box,
+    so re-origining alone would not change the render.
+    Returns True if the geometry was transformed.
+    """
+    mesh = obj.data
+    normal_matrix = obj.matrix_world.to_3x3().inverted_safe().transposed()
+    faces = []
+    for poly in mesh.polygons:
+        if poly.area > 0:
+            faces.append(((normal_matrix @ poly.normal).normalized(), poly.area))
+    total = sum(area for _, area in faces)
+    if total == 0:
+        return False
+
+    cos_tol = cos(radians(1.0))
+
+    def axis_aligned(n):
+        return max(abs(n.x), abs(n.y), abs(n.z)) >= cos_tol
+
+    aligned = sum(area for n, area in faces if axis_aligned(n))
+    if aligned / total >= min_aligned_fraction:
+        return False
+
+    def dominant(candidates):
+        # Cluster normals (ignoring sign) and return the heaviest direction
+        clusters = {}
+        for n, area in candidates:
+            if n.z < 0 or (n.z == 0 and (n.y < 0 or (n.y == 0 and n.x < 0))):
+                n = -n
+            key = (round(n.x, 2), round(n.y, 2), round(n.z, 2))
+            weight, vec = clusters.get(key, (0.0, mathutils.Vector()))
+            clusters[key] = (weight + area, vec + n * area)
+        if not clusters:
+            return None
+        return max(clusters.values(), key=lambda c: c[0])[1].normalized()
+
+    def nearest_axis(n):
+        axes = [mathutils.Vector(v) for v in ((1, 0, 0), (0, 1, 0), (0, 0, 1))]
+        axis = max(axes, key=lambda a: abs(n.dot(a)))
+        return axis if n.dot(axis) >= 0 else -axis
+
+    primary = dominant(faces)
+    target = nearest_axis(primary)
+    rotation = primary.rotation_difference(target).to_matrix()
+
+    # Square up the rotation about the primary axis using the heaviest
+    # remaining direction perpendicular to it
+    perpendicular = []
+    for n, area in faces:
+        n = rotation @ n
+        if abs(n.dot(target)) < 1 - cos_tol:
+            perpendicular.append((n, area))
+    secondary = dominant(perpendicular)
+    if secondary is not None:
+        snapped = nearest_axis(secondary - target * secondary.dot(target))
+        rotation = secondary.rotation_difference(snapped).to_matrix() @ rotation
+
+    matrix = obj.matrix_world.inverted() @ rotation.to_4x4() @ obj.matrix_world
+    mesh.transform(matrix)
+    mesh.update()
+    bpy.context.view_layer.update()
+
+    corners = [obj.matrix_world @ mathutils.Vector(c) for c in obj.bound_box]
+    base = mathutils.Vector((
+        (min(c.x for c in corners) + max(c.x for c in corners)) / 2,
+        (min(c.y for c in corners) + max(c.y for c in corners)) / 2,
+        min(c.z for c in corners),
+    ))
+    obj.location -= base
+    bpy.context.view_layer.update()
+
+    print(f"Normalized orientation: {aligned / total:.1%} of surface was axis-aligned")
+    return True
+
+
 def setup_camera(scene, padding=0.03, camera_lat=30.0, camera_lon=45.0):
     """Create an orthographic camera at a given angle, framed to fit all objects."""
     cam_data = bpy.data.cameras.new("IsoCam")
@@ -185,7 +372,248 @@ def setup_camera(scene, padding=0.03, camera_lat=30.0, camera_lon=45.0):
     cam_data.shift_y = -center_vy / scale
 
 
-def setup_freestyle(scene, thickness, crease_angle=135.0, edge_types="silhouette,crease,border", fill_opacity=1.0):
+def load_ldraw_colors(ldraw_path):
+    """Map LDraw color codes to (r, g, b) in 0-1 from LDConfig.ldr."""
+    colors = {}
+    try:
+        with open(os.path.join(ldraw_path, "LDConfig.ldr"), encoding="utf-8", errors="replace") as f:
+            for line in f:
+                fields = line.split()
+                if len(fields) < 7 or fields[:2] != ["0", "!COLOUR"]:
+                    continue
+                try:
+                    code = int(fields[fields.index("CODE") + 1])
+                    value = fields[fields.index("VALUE") + 1].lstrip("#")
+                    colors[code] = tuple(int(value[i:i + 2], 16) / 255.0 for i in (0, 2, 4))
+                except (ValueError, IndexError):
+                    continue
+    except OSError as e:
+        print(f"LDConfig.ldr not readable, keeping importer colors: {e}")
+    return colors
+
+
+def apply_ldraw_fills(scene, ldraw_path):
+    """Set each material's diffuse color to its LDraw color.
+
+    The SVG exporter fills with the material diffuse color. ImportLDraw
+    names materials Material_<code>_..., so the code is read from the name;
+    direct colors and unrecognized materials keep the importer's color.
+    """
+    colors = load_ldraw_colors(ldraw_path)
+    for obj in scene.objects:
+        if obj.type != 'MESH':
+            continue
+        for slot in obj.material_slots:
+            if not slot.material:
+                continue
+            m = re.match(r"Material_(\d+)", slot.material.name)
+            if m and int(m.group(1)) in colors:
+                slot.material.diffuse_color = colors[int(m.group(1))] + (1.0,)
+
+
+def material_color_key(material):
+    """The LDraw color a material was imported for, from its name."""
+    m = re.match(r"Material_([^_]+)", material.name)
+    return m.group(1) if m else material.name
+
+
+def merge_pattern_materials(obj):
+    """Detect sub-colored pattern geometry (printed parts) on the joined mesh.
+
+    Faces are re-pointed at one material slot per LDraw color, so the
+    importer's slope-texture variants of a color don't read as patterns.
+    Returns True if the mesh has faces in more than one color; meshes in a
+    single color are left untouched.
+    """
+    if obj is None or obj.type != 'MESH':
+        return False
+    canonical = {}
+    remap = {}
+    for i, slot in enumerate(obj.material_slots):
+        if slot.material:
+            remap[i] = canonical.setdefault(material_color_key(slot.material), i)
+    used = {remap.get(p.material_index, p.material_index) for p in obj.data.polygons}
+    if len(used) < 2:
+        return False
+    for p in obj.data.polygons:
+        p.material_index = remap.get(p.material_index, p.material_index)
+    print(f"Pattern geometry: faces in {len(used)} colors")
+    return True
+
+
+# Ghosted helper parts: fill opacity multiplier and edge dash pattern
+GHOST_OPACITY = 0.5
+GHOST_DASHARRAY = "6,4"
+
+
+def join_meshes(meshes, recalculate_normals=True):
+    """Join meshes into the first one and recalculate normals, unless they're
+    kept as the importer wound them."""
+    bpy.ops.object.select_all(action='DESELECT')
+    for o in meshes:
+        o.select_set(True)
+    if not meshes:
+        return None
+    bpy.context.view_layer.objects.active = meshes[0]
+    if len(meshes) > 1:
+        bpy.ops.object.join()
+    if not recalculate_normals:
+        return bpy.context.active_object
+    bpy.ops.object.mode_set(mode='EDIT')
+    bpy.ops.mesh.select_all(action='SELECT')
+    bpy.ops.mesh.normals_make_consistent(inside=False)
+    bpy.ops.object.mode_set(mode='OBJECT')
+    return bpy.context.active_object
+
+
+# ImportLDraw turns LDraw's -Y up onto Blender's +Z up: LDraw X, Y, and Z
+# are Blender's X, -Z, and Y
+LDRAW_TO_BLENDER = mathutils.Matrix(((1, 0, 0), (0, 0, 1), (0, -1, 0)))
+
+
+def transform_scene(scene, matrix):
+    """Apply a 3x3 matrix on the LDraw axes to every mesh, about the world
+    origin, reversing faces of reflected meshes so normals still point out."""
+    linear = LDRAW_TO_BLENDER @ matrix @ LDRAW_TO_BLENDER.inverted()
+    for o in scene.objects:
+        if o.type != 'MESH':
+            continue
+        o.data.transform(o.matrix_world.inverted() @ linear.to_4x4() @ o.matrix_world)
+        if linear.determinant() < 0:
+            bm = bmesh.new()
+            bm.from_mesh(o.data)
+            bmesh.ops.reverse_faces(bm, faces=bm.faces[:])
+            bm.to_mesh(o.data)
+            bm.free()
+        o.data.update()
+    bpy.context.view_layer.update()
+
+
+def parse_transform(value):
+    """The transform argument as a matrix: 9 numbers, row by row."""
+    entries = [float(v) for v in value.split(",")]
+    return mathutils.Matrix((entries[0:3], entries[3:6], entries[6:9]))
+
+
+def mirror_matrix(axes):
+    """The reflection across the given LDraw axes, some of "xyz"."""
+    return mathutils.Matrix.Diagonal([-1 if axis in axes else 1 for axis in "xyz"])
+
+
+# Cut faces get a material of their own in a color no LDraw color has, so
+# their fills can be found in the export
+SECTION_MATERIAL = "Section"
+SECTION_SENTINEL = (1.0, 0.0, 1.0, 1.0)
+
+
+def section_scene(scene, plane):
+    """Cut every mesh away on the side of a plane (origin and normal on the
+    LDraw axes) the normal points to, and cap the cut with faces in the
+    section material."""
+    values = [float(v) for v in plane.split(",")]
+    origin = LDRAW_TO_BLENDER @ mathutils.Vector(values[0:3])
+    normal = (LDRAW_TO_BLENDER @ mathutils.Vector(values[3:6])).normalized()
+    material = bpy.data.materials.new(SECTION_MATERIAL)
+    material.diffuse_color = SECTION_SENTINEL
+    for o in scene.objects:
+        if o.type != 'MESH':
+            continue
+        to_local = o.matrix_world.inverted()
+        bm = bmesh.new()
+        bm.from_mesh(o.data)
+        cut = bmesh.ops.bisect_plane(bm, geom=bm.verts[:] + bm.edges[:] + bm.faces[:], dist=1e-4,
+                                     plane_co=to_local @ origin,
+                                     plane_no=o.matrix_world.to_3x3().transposed() @ normal,
+                                     clear_outer=True)
+        edges = [e for e in cut["geom_cut"] if isinstance(e, bmesh.types.BMEdge)]
+        caps = bmesh.ops.triangle_fill(bm, use_beauty=True, use_dissolve=False, edges=edges)["geom"]
+        o.data.materials.append(material)
+        for f in caps:
+            if isinstance(f, bmesh.types.BMFace):
+                f.material_index = len(o.data.materials) - 1
+        bm.to_mesh(o.data)
+        bm.free()
+        o.data.update()
+    bpy.context.view_layer.update()
+
+
+def import_separately(scene, filepath, ldraw_path, name, recalculate_normals=True):
+    """Import a model as one mesh in a collection of its own, for a line set
+    of its own. The collection is a child of "Separate", which the other line
+    sets leave out."""
+    before = set(scene.objects)
+    import_ldraw_part(filepath, ldraw_path)
+
+    bpy.ops.object.select_all(action='DESELECT')
+    for o in scene.objects:
+        if o not in before:
+            o.select_set(True)
+    bpy.ops.object.duplicates_make_real()
+    meshes = [o for o in scene.objects if o not in before and o.type == 'MESH']
+    for o in meshes:
+        o.select_set(True)
+    # The importer links mesh data between copies of a part; make the new
+    # meshes single-user so joining them can't touch the main model
+    bpy.ops.object.make_single_user(object=True, obdata=True)
+    joined = join_meshes(meshes, recalculate_normals)
+    if joined is None:
+        return None
+
+    separate = bpy.data.collections.get("Separate")
+    if separate is None:
+        separate = bpy.data.collections.new("Separate")
+        scene.collection.children.link(separate)
+    collection = bpy.data.collections.new(name)
+    separate.children.link(collection)
+    for c in list(joined.users_collection):
+        c.objects.unlink(joined)
+    collection.objects.link(joined)
+    print(f"{name} mesh: {len(joined.data.vertices)} verts, {len(joined.data.polygons)} faces")
+    return collection
+
+
+def world_bbox_center(obj):
+    """The center of an object's bounding box in world space."""
+    corners = [obj.matrix_world @ mathutils.Vector(c) for c in obj.bound_box]
+    return sum(corners, mathutils.Vector()) / len(corners)
+
+
+def import_objects(scene, objects_file, ldraw_path, model=None, recalculate_normals=True):
+    """Import the placed parts the server split out of the model, each as
+    an Object_<id> collection. Objects with align "bbox" are moved so their
+    bounding box is centered on the model's. Returns (object, collection)
+    pairs."""
+    with open(objects_file, encoding="utf-8") as f:
+        objects = json.load(f)["objects"]
+    imported = []
+    work_dir = os.path.dirname(os.path.abspath(objects_file))
+    for o in objects:
+        path = os.path.join(work_dir, f"object-{o['id']}" + (".mpd" if o.get("mpd") else ".ldr"))
+        with open(path, "w", encoding="utf-8") as f:
+            f.write(o["model"])
+        collection = import_separately(scene, path, ldraw_path, f"Object_{o['id']}", recalculate_normals)
+        if collection is None:
+            continue
+        if o.get("align") == "bbox" and model is not None:
+            for joined in collection.objects:
+                joined.location += world_bbox_center(model) - world_bbox_center(joined)
+            bpy.context.view_layer.update()
+        imported.append((o, collection))
+    return imported
+
+
+def mark_all_edges(scene):
+    """Mark every mesh edge as a Freestyle edge, for the wireframe style's
+    edge_mark line set."""
+    for o in scene.objects:
+        if o.type == 'MESH':
+            for edge in o.data.edges:
+                edge.use_freestyle_mark = True
+
+
+def setup_freestyle(scene, thickness, crease_angle=135.0, edge_types="silhouette,crease,border", fill_opacity=1.0,
+                    hidden_edge_opacity=0.0, smooth_silhouettes=False,
+                    ghost_collection=None, pattern_edges=False, color_edge_types="none", objects=()):
     """Configure Freestyle for clean line drawing output."""
     scene.render.use_freestyle = True
 
@@ -193,6 +621,10 @@ def setup_freestyle(scene, thickness, crease_angle=135.0, edge_types="silhouette
     fs_settings = view_layer.freestyle_settings
     fs_settings.mode = 'EDITOR'
     fs_settings.crease_angle = radians(crease_angle)
+    # Freestyle finds silhouettes on face normals, so they fall on mesh
+    # edges as LDraw's conditional lines do; with smoothness they follow the
+    # smoothed normals across faces instead
+    fs_settings.use_smoothness = smooth_silhouettes
 
     # Clear existing linesets
     while len(fs_settings.linesets) > 0:
@@ -220,10 +652,32 @@ def setup_freestyle(scene, thickness, crease_angle=135.0, edge_types="silhouette
     ls.alpha = 1.0
     ls.thickness_position = 'CENTER'
 
+    # Edge types the server colors individually are drawn again on top, one
+    # stroke-only lineset each, so their paths can be told apart in the SVG
+    if color_edge_types != "none":
+        for edge_type in color_edge_types.split(","):
+            color_lineset = fs_settings.linesets.new(f"ColorEdges_{edge_type}")
+            for name in ("silhouette", "crease", "border", "contour", "external_contour", "edge_mark",
+                         "material_boundary"):
+                setattr(color_lineset, f"select_{name}", name == edge_type)
+            color_lineset.select_by_visibility = True
+            color_lineset.visibility = 'VISIBLE'
+            color_lineset.edge_type_combination = 'OR'
+            color_lineset.edge_type_negation = 'INCLUSIVE'
+
+            cls = color_lineset.linestyle
+            cls.thickness = thickness
+            cls.color = (0.0, 0.0, 0.0)
+            cls.alpha = 1.0
+            cls.thickness_position = 'CENTER'
+            cls.use_export_strokes = True
+            cls.use_export_fills = False
+
     # For transparent/translucent parts, add a second lineset for hidden (occluded) edges.
     # Hidden edges are dimmed proportionally to fill_opacity (seen through the material).
     # For fully transparent parts (fill_opacity=0), hidden edges are shown at full opacity.
-    if fill_opacity < 1.0:
+    # A hidden_edge_opacity draws them for opaque parts too, at that opacity.
+    if fill_opacity < 1.0 or hidden_edge_opacity > 0:
         hidden_lineset = fs_settings.linesets.new("HiddenEdges")
         hidden_lineset.select_silhouette = "silhouette" in enabled
         hidden_lineset.select_crease = "crease" in enabled
@@ -243,10 +697,354 @@ def setup_freestyle(scene, thickness, crease_angle=135.0, edge_types="silhouette
         # Fully transparent parts show hidden edges at full opacity;
         # translucent parts dim hidden edges to match the material's opacity.
         hls.alpha = 1.0 if fill_opacity == 0.0 else fill_opacity
+        if hidden_edge_opacity > 0:
+            hls.alpha = hidden_edge_opacity
         hls.thickness_position = 'CENTER'
         hls.use_export_strokes = True
         hls.use_export_fills = False
 
+    # Printed patterns are outlined along their color boundaries, at half
+    # the line thickness so they read as decoration rather than shape
+    if pattern_edges:
+        pattern_lineset = fs_settings.linesets.new("PatternEdges")
+        pattern_lineset.select_silhouette = False
+        pattern_lineset.select_crease = False
+        pattern_lineset.select_border = False
+        pattern_lineset.select_material_boundary = True
+        pattern_lineset.select_by_visibility = True
+        pattern_lineset.visibility = 'VISIBLE'
+        pattern_lineset.edge_type_combination = 'OR'
+        pattern_lineset.edge_type_negation = 'INCLUSIVE'
+
+        pls = pattern_lineset.linestyle
+        pls.thickness = max(0.5, thickness / 2)
+        pls.color = (0.0, 0.0, 0.0)
+        pls.alpha = 1.0
+        pls.thickness_position = 'CENTER'
+        pls.use_export_strokes = True
+        pls.use_export_fills = False
+
+    # Ghosted parts and separately colored objects get their own linesets
+    # so postprocessing can style them; the other linesets leave them out
+    separate = [("GhostEdges", ghost_collection)] if ghost_collection is not None else []
+    separate += [(f"ObjectEdges_{o['id']}", collection) for o, collection in objects]
+    if separate:
+        for existing in fs_settings.linesets:
+            existing.select_by_collection = True
+            existing.collection = bpy.data.collections["Separate"]
+            existing.collection_negation = 'EXCLUSIVE'
+
+    for name, collection in separate:
+        separate_lineset = fs_settings.linesets.new(name)
+        separate_lineset.select_silhouette = "silhouette" in enabled
+        separate_lineset.select_crease = "crease" in enabled
+        separate_lineset.select_border = "border" in enabled
+        separate_lineset.select_contour = "contour" in enabled
+        separate_lineset.select_external_contour = "external_contour" in enabled
+        separate_lineset.select_edge_mark = "edge_mark" in enabled
+        separate_lineset.select_material_boundary = "material_boundary" in enabled
+        separate_lineset.select_by_visibility = True
+        separate_lineset.visibility = 'VISIBLE'
+        separate_lineset.edge_type_combination = 'OR'
+        separate_lineset.edge_type_negation = 'INCLUSIVE'
+        separate_lineset.select_by_collection = True
+        separate_lineset.collection = collection
+        separate_lineset.collection_negation = 'INCLUSIVE'
+
+        sls = separate_lineset.linestyle
+        sls.thickness = thickness
+        sls.color = (0.0, 0.0, 0.0)
+        sls.alpha = 1.0
+        sls.thickness_position = 'CENTER'
+        sls.use_export_strokes = True
+        sls.use_export_fills = True
+
+
+def apply_sketch_style(linestyle, thickness, jitter):
+    """Make a line style look hand-drawn: strokes wander off the edge with
+    Perlin noise, vary in weight like pen pressure, and overshoot their
+    corners. jitter is the wander in pixels; the rest scales with it."""
+    if jitter <= 0:
+        return
+    noise = linestyle.geometry_modifiers.new(name="SketchNoise", type='PERLIN_NOISE_1D')
+    noise.amplitude = jitter
+    noise.frequency = 10.0
+    noise.octaves = 2
+
+    overshoot = linestyle.geometry_modifiers.new(name="SketchOvershoot", type='BACKBONE_STRETCHER')
+    overshoot.backbone_length = 2.0 * jitter + thickness
+
+    pressure = linestyle.thickness_modifiers.new(name="SketchPressure", type='NOISE')
+    pressure.amplitude = min(thickness * 0.6, jitter)
+    pressure.period = 40.0
+    pressure.use_asymmetric = True
+
+
+def end_taper_curve(modifier):
+    """Shape an along-stroke modifier's curve to 0 at both ends, 1 mid-stroke."""
+    points = modifier.curve.curves[0].points
+    points[0].location = (0.0, 0.0)
+    points[-1].location = (1.0, 0.0)
+    points.new(0.5, 1.0)
+    modifier.curve.update()
+
+
+def apply_line_modifiers(linestyle, thickness, crease_angle, taper=0.0, fade=0.0, crease_weight=0.0,
+                         backbone_stretch=0.0, dash_pattern="none", pressure=0.0, model_size=1.0):
+    """Add the request's lineStyle modifiers to a line style.
+
+    taper and fade thin and fade strokes toward both ends; crease_weight adds
+    up to that many thicknesses to creases, more the sharper they are (from
+    crease_angle, the sharpest Freestyle draws, down to 45 degrees);
+    backbone_stretch lengthens strokes past their ends; dash_pattern breaks
+    them into dashes; pressure adds up to that many thicknesses where the
+    surface curves, most where its radius is a tenth of model_size or less.
+    """
+    if taper > 0:
+        m = linestyle.thickness_modifiers.new(name="Taper", type='ALONG_STROKE')
+        m.blend = 'MULTIPLY'
+        m.mapping = 'CURVE'
+        m.value_min = 1.0 - taper
+        m.value_max = 1.0
+        end_taper_curve(m)
+    if fade > 0:
+        m = linestyle.alpha_modifiers.new(name="Fade", type='ALONG_STROKE')
+        m.blend = 'MULTIPLY'
+        m.mapping = 'CURVE'
+        m.influence = fade
+        end_taper_curve(m)
+    if crease_weight > 0:
+        m = linestyle.thickness_modifiers.new(name="CreaseWeight", type='CREASE_ANGLE')
+        m.blend = 'ADD'
+        m.angle_min = radians(45.0)
+        m.angle_max = radians(max(crease_angle, 45.0))
+        m.thickness_min = 0.0
+        m.thickness_max = crease_weight * thickness
+        # Sharper creases have smaller angles
+        m.invert = True
+    if pressure > 0:
+        m = linestyle.thickness_modifiers.new(name="Pressure", type='CURVATURE_3D')
+        m.blend = 'ADD'
+        m.curvature_min = 0.0
+        m.curvature_max = 10.0 / model_size
+        m.thickness_min = 0.0
+        m.thickness_max = pressure * thickness
+    if backbone_stretch > 0:
+        m = linestyle.geometry_modifiers.new(name="BackboneStretch", type='BACKBONE_STRETCHER')
+        m.backbone_length = backbone_stretch
+    if dash_pattern != "none":
+        set_dashes(linestyle, dash_pattern)
+
+
+def apply_depth_cue(scene, linestyle):
+    """Color a line style's strokes by distance from the camera across the
+    model's depth: black nearest, white farthest."""
+    to_camera = scene.camera.matrix_world.inverted()
+    depths = [-(to_camera @ (o.matrix_world @ mathutils.Vector(c))).z
+              for o in scene.objects if o.type == 'MESH' for c in o.bound_box]
+    if not depths:
+        return
+    m = linestyle.color_modifiers.new(name="DepthCue", type='DISTANCE_FROM_CAMERA')
+    m.blend = 'MIX'
+    m.range_min = min(depths)
+    m.range_max = max(max(depths), min(depths) + 1e-6)
+    m.color_ramp.elements[0].color = (0.0, 0.0, 0.0, 1.0)
+    m.color_ramp.elements[1].color = (1.0, 1.0, 1.0, 1.0)
+
+
+def set_dashes(linestyle, dash_pattern):
+    """Break a line style's strokes into dashes, given comma-separated dash
+    and gap lengths in pixels."""
+    lengths = [int(n) for n in dash_pattern.split(",")]
+    linestyle.use_dashed_line = True
+    for i, (dash, gap) in enumerate(zip(lengths[0::2], lengths[1::2]), start=1):
+        setattr(linestyle, f"dash{i}", dash)
+        setattr(linestyle, f"gap{i}", gap)
+
+
+# Freestyle's default distance between stroke vertices, in pixels
+FREESTYLE_SAMPLING = 5.0
+
+
+def load_plugin(path):
+    """Import an operator's line style plugin from its file."""
+    spec = importlib.util.spec_from_file_location("line_style_plugin", path)
+    plugin = importlib.util.module_from_spec(spec)
+    spec.loader.exec_module(plugin)
+    print(f"Loaded line style plugin: {path}")
+    return plugin
+
+
+# Hatching and toon light, in camera space: from the upper left, in front
+# of the part
+SHADING_LIGHT = mathutils.Vector((-0.5, 0.6, 0.62)).normalized()
+# How dark the darkest toon band is, as a fraction of the face color
+TOON_SHADOW = 0.45
+
+
+# ImportLDraw's realScale 1.0 is life size in meters: 1 LDU is 0.4 mm
+LDU_PER_UNIT = 2500
+
+
+def export_frame(scene, path):
+    """Write the model size of one pixel in LDraw units to path as JSON.
+
+    An orthographic camera's ortho_scale spans the larger side of the frame
+    with the default (auto) sensor fit, so the scale is the same anywhere in
+    the picture.
+    """
+    cam = scene.camera.data
+    res_x, res_y = scene.render.resolution_x, scene.render.resolution_y
+    span = {"HORIZONTAL": res_x, "VERTICAL": res_y}.get(cam.sensor_fit, max(res_x, res_y))
+    with open(path, "w") as f:
+        json.dump({"lduPerPixel": cam.ortho_scale * LDU_PER_UNIT / span}, f)
+    print(f"Frame written to: {path}")
+
+
+def export_face_shading(scene, obj, path, fill_mode="uniform"):
+    """Write the faces facing the camera to path as JSON, for hatching.
+
+    Each face has its outline in SVG pixels (a flat x, y list) and its
+    shade: the cosine between its normal and SHADING_LIGHT, 0 (dark) to 1
+    (lit). Faces are listed back to front, so drawing them in order paints
+    over the hidden ones. With per-part LDraw fills each also has its fill.
+    """
+    cam = scene.camera
+    res_x, res_y = scene.render.resolution_x, scene.render.resolution_y
+    to_camera = cam.matrix_world.to_3x3().inverted()
+    normal_matrix = obj.matrix_world.to_3x3().inverted().transposed()
+
+    faces = []
+    for poly in obj.data.polygons:
+        normal = (to_camera @ (normal_matrix @ poly.normal)).normalized()
+        # The camera looks down its -Z axis; faces pointing away are hidden
+        if normal.z <= 0:
+            continue
+        points, depth = [], 0.0
+        for index in poly.vertices:
+            v = world_to_camera_view(scene, cam, obj.matrix_world @ obj.data.vertices[index].co)
+            points += [round(v.x * res_x, 1), round((1 - v.y) * res_y, 1)]
+            depth += v.z
+        face = {"points": points, "shade": round(max(0.0, normal.dot(SHADING_LIGHT)), 3),
+                "depth": depth / len(poly.vertices)}
+        if fill_mode == "ldraw" and poly.material_index < len(obj.material_slots):
+            material = obj.material_slots[poly.material_index].material
+            if material:
+                face["fill"] = "#%02x%02x%02x" % tuple(round(c * 255) for c in material.diffuse_color[:3])
+        faces.append(face)
+
+    faces.sort(key=lambda f: -f["depth"])
+    for face in faces:
+        del face["depth"]
+    with open(path, "w") as f:
+        json.dump({"width": res_x, "height": res_y, "faces": faces}, f, separators=(",", ":"))
+    print(f"Face shading for {len(faces)} faces written to: {path}")
+
+
+def parse_hex_color(value):
+    """A #rgb or #rrggbb color as linear (r, g, b) in 0-1, or None."""
+    hex_digits = value.lstrip("#")
+    if not value.startswith("#") or len(hex_digits) not in (3, 6):
+        return None
+    if len(hex_digits) == 3:
+        hex_digits = "".join(c * 2 for c in hex_digits)
+    try:
+        srgb = [int(hex_digits[i:i + 2], 16) / 255.0 for i in (0, 2, 4)]
+    except ValueError:
+        return None
+    return tuple(c / 12.92 if c <= 0.04045 else ((c + 0.055) / 1.055) ** 2.4 for c in srgb)
+
+
+def setup_toon_shading(scene, bands, fill_color, fill_mode="uniform"):
+    """Give every material a flat, cel-shaded look for the raster.
+
+    Each surface emits its color darkened by how far it faces away from
+    SHADING_LIGHT, rounded down to one of bands steps, so the render needs
+    no lights and Cycles draws hard-edged bands. Uniform fills shade
+    fill_color when it's hex (white otherwise); LDraw fills their own color.
+    """
+    light = scene.camera.matrix_world.to_3x3() @ SHADING_LIGHT
+    uniform = parse_hex_color(fill_color) or (1.0, 1.0, 1.0)
+    for material in bpy.data.materials:
+        if fill_mode == "ldraw":
+            base = tuple(material.diffuse_color[:3])
+        else:
+            base = uniform
+        material.use_nodes = True
+        nodes, links = material.node_tree.nodes, material.node_tree.links
+        nodes.clear()
+
+        geometry = nodes.new("ShaderNodeNewGeometry")
+        facing = nodes.new("ShaderNodeVectorMath")
+        facing.operation = 'DOT_PRODUCT'
+        facing.inputs[1].default_value = light
+        links.new(geometry.outputs["Normal"], facing.inputs[0])
+
+        # band = min(floor(max(facing, 0) * bands), bands - 1) / (bands - 1)
+        value = facing.outputs["Value"]
+        for operation, operand in (('MAXIMUM', 0.0), ('MULTIPLY', float(bands)), ('FLOOR', None),
+                                   ('MINIMUM', float(bands - 1)), ('DIVIDE', float(max(bands - 1, 1)))):
+            math_node = nodes.new("ShaderNodeMath")
+            math_node.operation = operation
+            links.new(value, math_node.inputs[0])
+            if operand is not None:
+                math_node.inputs[1].default_value = operand
+            value = math_node.outputs["Value"]
+
+        mix = nodes.new("ShaderNodeMixRGB")
+        mix.inputs["Color1"].default_value = tuple(c * TOON_SHADOW for c in base) + (1.0,)
+        mix.inputs["Color2"].default_value = base + (1.0,)
+        links.new(value, mix.inputs["Fac"])
+        emission = nodes.new("ShaderNodeEmission")
+        links.new(mix.outputs["Color"], emission.inputs["Color"])
+        output = nodes.new("ShaderNodeOutputMaterial")
+        links.new(emission.outputs["Emission"], output.inputs["Surface"])
+
+    # Colors as given, antialiased, with the Freestyle lines kept out of the
+    # image (they're in the SVG)
+    scene.view_settings.view_transform = 'Standard'
+    scene.cycles.samples = 16
+    bpy.context.view_layer.freestyle_settings.as_render_pass = True
+
+
+def setup_occlusion_pass(scene, distance):
+    """Have the render produce Cycles' ambient occlusion pass.
+
+    distance is how far away geometry still occludes. The compositor sends
+    the pass, with the part's alpha, to the viewer node for
+    save_occlusion_pass, and the image itself on to the composite as before.
+    """
+    if scene.world is None:
+        scene.world = bpy.data.worlds.new("World")
+    scene.world.light_settings.distance = distance
+    bpy.context.view_layer.use_pass_ambient_occlusion = True
+    # A soft pass needs more than the single sample line art gets by on
+    scene.cycles.samples = max(scene.cycles.samples, 32)
+
+    scene.use_nodes = True
+    tree = scene.node_tree
+    tree.nodes.clear()
+    layers = tree.nodes.new("CompositorNodeRLayers")
+    composite = tree.nodes.new("CompositorNodeComposite")
+    tree.links.new(layers.outputs["Image"], composite.inputs["Image"])
+    set_alpha = tree.nodes.new("CompositorNodeSetAlpha")
+    tree.links.new(layers.outputs["AO"], set_alpha.inputs["Image"])
+    tree.links.new(layers.outputs["Alpha"], set_alpha.inputs["Alpha"])
+    viewer = tree.nodes.new("CompositorNodeViewer")
+    tree.links.new(set_alpha.outputs["Image"], viewer.inputs["Image"])
+
+
+def save_occlusion_pass(path):
+    """Write the occlusion pass left in the viewer node to path as a PNG."""
+    viewer = bpy.data.images["Viewer Node"]
+    width, height = viewer.size
+    image = bpy.data.images.new("Occlusion", width, height, alpha=True)
+    image.pixels = viewer.pixels[:]
+    image.filepath_raw = os.path.abspath(path)
+    image.file_format = 'PNG'
+    image.save()
+    print(f"Occlusion pass written to: {path}")
+
 
 def setup_svg_export(scene, lineset):
     """Configure the Freestyle SVG Exporter addon."""
@@ -262,16 +1060,28 @@ def setup_svg_export(scene, lineset):
     ls.use_export_fills = True
 
 
-def postprocess_svg(svg_path, fill_color, fill_opacity=1.0, stroke_color="currentColor"):
+def postprocess_svg(svg_path, fill_color, fill_opacity=1.0, stroke_color="currentColor", ghosted=False,
+                    fill_mode="uniform", objects=(), sectioned=False):
     """Replace Blender's hardcoded colors with configurable values."""
     with open(svg_path, "r") as f:
         content = f.read()
 
+    # The server validates colors, but they're still escaped here: they land
+    # in attribute values. Function replacements keep re.sub from reading
+    # backslashes in them.
+    fill_attr = f'fill="{html.escape(fill_color, quote=True)}"'
+    stroke_attr = f'stroke="{html.escape(stroke_color, quote=True)}"'
+
     # Replace Blender's white fill (from white material) with the requested fill color
-    content = re.sub(r'fill="rgb\(255,\s*255,\s*255\)"', f'fill="{fill_color}"', content)
+    if fill_mode == "uniform":
+        content = re.sub(r'fill="rgb\(255,\s*255,\s*255\)"', lambda _: fill_attr, content)
+
+    # Cut faces take the fill color too, marked for the server's hatching
+    if sectioned:
+        content = re.sub(r'fill="rgb\(255,\s*0,\s*255\)"', lambda _: fill_attr + ' data-section="1"', content)
 
     # Replace black strokes with the requested stroke color
-    content = re.sub(r'stroke="rgb\(0,\s*0,\s*0\)"', f'stroke="{stroke_color}"', content)
+    content = re.sub(r'stroke="rgb\(0,\s*0,\s*0\)"', lambda _: stroke_attr, content)
 
     # Apply fill opacity for transparent/translucent parts
     if fill_opacity < 1.0:
@@ -286,6 +1096,11 @@ def postprocess_svg(svg_path, fill_color, fill_opacity=1.0, stroke_color="curren
     if fill_opacity < 1.0:
         _reorder_svg_hidden_edges(svg_path)
 
+    if ghosted:
+        _style_svg_ghost(svg_path)
+    if objects:
+        _style_svg_objects(svg_path, objects)
+
 
 def _reorder_svg_hidden_edges(svg_path):
     """Move HiddenEdges lineset group before Edges group for correct z-ordering.
@@ -311,6 +1126,8 @@ def _reorder_svg_hidden_edges(svg_path):
         child_id = child.get("id", "")
         if "HiddenEdges" in child_id:
             hidden_group = child
+        elif any(s in child_id for s in ("GhostEdges", "PatternEdges", "ColorEdges", "ObjectEdges")):
+            continue
         elif "Edges" in child_id:
             edges_group = child
 
@@ -336,6 +1153,59 @@ def _reorder_svg_hidden_edges(svg_path):
     print("Reordered SVG groups: HiddenEdges moved before Edges for correct z-ordering")
 
 
+def _style_svg_ghost(svg_path):
+    """Draw the GhostEdges lineset translucent with dashed strokes."""
+    SVG_NS = "http://www.w3.org/2000/svg"
+    ET.register_namespace("", SVG_NS)
+    ET.register_namespace("inkscape", "http://www.inkscape.org/namespaces/inkscape")
+
+    tree = ET.parse(svg_path)
+    root = tree.getroot()
+    ghost_group = None
+    for child in root:
+        if "GhostEdges" in child.get("id", ""):
+            ghost_group = child
+    if ghost_group is None:
+        print("SVG ghost styling skipped: GhostEdges group not found")
+        return
+
+    for path in ghost_group.iter(f"{{{SVG_NS}}}path"):
+        if path.get("stroke") == "none":
+            opacity = float(path.get("fill-opacity", "1.0"))
+            path.set("fill-opacity", f"{opacity * GHOST_OPACITY:.4f}")
+        else:
+            path.set("stroke-opacity", f"{GHOST_OPACITY}")
+            path.set("stroke-dasharray", GHOST_DASHARRAY)
+
+    tree.write(svg_path, xml_declaration=True, encoding="unicode")
+    print("Styled ghosted parts: translucent fills, dashed strokes")
+
+
+def _style_svg_objects(svg_path, objects):
+    """Color each ObjectEdges lineset's fills and strokes as its object asks."""
+    SVG_NS = "http://www.w3.org/2000/svg"
+    ET.register_namespace("", SVG_NS)
+    ET.register_namespace("inkscape", "http://www.inkscape.org/namespaces/inkscape")
+
+    tree = ET.parse(svg_path)
+    root = tree.getroot()
+    colors = {f"ObjectEdges_{o['id']}": o for o in objects}
+    for child in root:
+        child_id = child.get("id", "")
+        o = next((o for name, o in colors.items() if child_id.endswith(name)), None)
+        if o is None:
+            continue
+        for path in child.iter(f"{{{SVG_NS}}}path"):
+            if path.get("stroke") == "none":
+                if o.get("fill"):
+                    path.set("fill", o["fill"])
+            elif o.get("stroke"):
+                path.set("stroke", o["stroke"])
+
+    tree.write(svg_path, xml_declaration=True, encoding="unicode")
+    print(f"Colored {len(objects)} separate objects")
+
+
 def add_svg_background(svg_path):
     """Insert a white background rect as the first child of the SVG root."""
     SVG_NS = "http://www.w3.org/2000/svg"
@@ -364,37 +1234,65 @@ def main():
     clear_scene()
 
     # Import LDraw part
+    report_progress("import", 0)
     print(f"Importing {args['input_file']}...")
     import_ldraw_part(args["input_file"], args["ldraw_path"])
 
+    report_progress("prepare", 30)
+
     # Make any collection instances into real geometry, join all meshes,
     # and recalculate normals — required for Freestyle to detect edges
     # on all ImportLDraw-imported parts.
     bpy.ops.object.select_all(action='SELECT')
     bpy.ops.object.duplicates_make_real()
-    bpy.ops.object.select_all(action='DESELECT')
-    meshes = [o for o in scene.objects if o.type == 'MESH']
-    for o in meshes:
-        o.select_set(True)
-    if meshes:
-        bpy.context.view_layer.objects.active = meshes[0]
-        if len(meshes) > 1:
-            bpy.ops.object.join()
-        bpy.ops.object.mode_set(mode='EDIT')
-        bpy.ops.mesh.select_all(action='SELECT')
-        bpy.ops.mesh.normals_make_consistent(inside=False)
-        bpy.ops.object.mode_set(mode='OBJECT')
-
-    obj = bpy.context.active_object
+    recalculate_normals = args["bfc"] == "recalculate"
+    obj = join_meshes([o for o in scene.objects if o.type == 'MESH'], recalculate_normals)
+    model = obj
+
     if obj and obj.type == 'MESH':
         print(f"Mesh: {len(obj.data.vertices)} verts, {len(obj.data.polygons)} faces")
-
-    # Set all materials to white for line-drawing look
-    for obj in scene.objects:
-        if obj.type == 'MESH':
-            for slot in obj.material_slots:
-                if slot.material:
-                    slot.material.diffuse_color = (1.0, 1.0, 1.0, 1.0)
+        # Ghosted parts and separate objects share the model's frame, so a
+        # model with them is left as authored
+        if args["normalize"] != "off" and not args["ghost_file"] and not args["objects_file"]:
+            normalize_orientation(obj)
+
+    if obj is not None and (args["ghost_file"] or args["objects_file"]):
+        # Keep the importer from reusing the joined mesh for later parts
+        obj.data.name = "Model"
+    ghost_collection = None
+    if args["ghost_file"]:
+        print(f"Importing ghosted parts from {args['ghost_file']}...")
+        ghost_collection = import_separately(scene, args["ghost_file"], args["ldraw_path"], "Ghost",
+                                             recalculate_normals)
+    objects = []
+    if args["objects_file"]:
+        print(f"Importing separate objects from {args['objects_file']}...")
+        objects = import_objects(scene, args["objects_file"], args["ldraw_path"], model=obj,
+                                 recalculate_normals=recalculate_normals)
+    if args["transform"] != "none":
+        transform_scene(scene, parse_transform(args["transform"]))
+    if args["mirror"] != "none":
+        transform_scene(scene, mirror_matrix(args["mirror"]))
+        print(f"Mirrored across {', '.join(args['mirror'])}")
+
+    has_patterns = merge_pattern_materials(obj)
+    edge_types = args["edge_types"]
+    if args["line_style"] == "wireframe":
+        mark_all_edges(scene)
+        edge_types = "edge_mark"
+    if args["section_plane"] != "none":
+        section_scene(scene, args["section_plane"])
+
+    # Set all materials to white for line-drawing look, or to their LDraw
+    # colors for per-part fills
+    if args["fill_mode"] == "ldraw":
+        apply_ldraw_fills(scene, args["ldraw_path"])
+    else:
+        for obj in scene.objects:
+            if obj.type == 'MESH':
+                for slot in obj.material_slots:
+                    if slot.material and not slot.material.name.startswith(SECTION_MATERIAL):
+                        slot.material.diffuse_color = (1.0, 1.0, 1.0, 1.0)
 
     # Configure render settings
     # Use Cycles (CPU) — EEVEE requires OpenGL which isn't available in WSL2 headless
@@ -414,13 +1312,43 @@ def main():
     # Setup Freestyle
     setup_freestyle(scene, args["thickness"],
                     crease_angle=args["crease_angle"],
-                    edge_types=args["edge_types"],
-                    fill_opacity=args["fill_opacity"])
+                    edge_types=edge_types,
+                    fill_opacity=args["fill_opacity"],
+                    hidden_edge_opacity=args["hidden_edge_opacity"],
+                    smooth_silhouettes=args["condlines"] == "smooth",
+                    ghost_collection=ghost_collection,
+                    pattern_edges=has_patterns,
+                    color_edge_types=args["color_edge_types"],
+                    objects=objects)
 
     # Setup SVG export
     fs_settings = bpy.context.view_layer.freestyle_settings
+    if args["line_style"] == "sketch":
+        for sketched in fs_settings.linesets:
+            apply_sketch_style(sketched.linestyle, args["thickness"], args["sketch_jitter"])
+    for styled in fs_settings.linesets:
+        apply_line_modifiers(styled.linestyle, args["thickness"], args["crease_angle"],
+                             taper=args["line_taper"], fade=args["line_fade"],
+                             crease_weight=args["crease_weight"], backbone_stretch=args["backbone_stretch"],
+                             dash_pattern=args["dash_pattern"], pressure=args["line_pressure"],
+                             model_size=max(model.dimensions) if model is not None else 1.0)
+    if args["depth_cue"] == "on":
+        apply_depth_cue(scene, fs_settings.linesets["Edges"].linestyle)
+    if args["hidden_edge_dash"] != "none" and "HiddenEdges" in fs_settings.linesets:
+        set_dashes(fs_settings.linesets["HiddenEdges"].linestyle, args["hidden_edge_dash"])
+    for styled in fs_settings.linesets:
+        styled.linestyle.sampling = FREESTYLE_SAMPLING / args["supersample"]
+    plugin = load_plugin(args["line_style_plugin"]) if args["line_style_plugin"] else None
+    if hasattr(plugin, "apply"):
+        for styled in fs_settings.linesets:
+            plugin.apply(styled.linestyle, args)
     lineset = fs_settings.linesets["Edges"]
     setup_svg_export(scene, lineset)
+    if args["raster_file"]:
+        setup_toon_shading(scene, args["toon_bands"], args["fill_color"], fill_mode=args["fill_mode"])
+    if args["ao_file"]:
+        # Occlusion reaches about a stud's width on a 2 x 4 brick
+        setup_occlusion_pass(scene, max(model.dimensions) * 0.2 if model is not None else 1.0)
 
     # Set output path - SVG exporter derives from render.filepath
     output_svg = os.path.abspath(args["output_svg"])
@@ -431,15 +1359,24 @@ def main():
     scene.render.filepath = os.path.join(output_dir, output_base)
 
     # Render (triggers SVG export as side-effect)
+    report_progress("freestyle", 50)
     print("Rendering...")
     bpy.ops.render.render(write_still=False)
+    report_progress("export", 85)
+    if args["raster_file"]:
+        bpy.data.images["Render Result"].save_render(os.path.abspath(args["raster_file"]))
+        print(f"Toon raster written to: {args['raster_file']}")
+    if args["ao_file"]:
+        save_occlusion_pass(args["ao_file"])
 
     # SVG exporter writes to <filepath>0001.svg
     expected_svg = os.path.join(output_dir, f"{output_base}0001.svg")
     if os.path.exists(expected_svg):
         if expected_svg != output_svg:
             os.rename(expected_svg, output_svg)
-        postprocess_svg(output_svg, args["fill_color"], args["fill_opacity"], args["stroke_color"])
+        postprocess_svg(output_svg, args["fill_color"], args["fill_opacity"], args["stroke_color"],
+                        ghosted=ghost_collection is not None, fill_mode=args["fill_mode"],
+                        objects=[o for o, _ in objects], sectioned=args["section_plane"] != "none")
         print(f"SVG written to: {output_svg}")
     else:
         print(f"Error: expected SVG not found at {expected_svg}")
@@ -450,6 +1387,13 @@ def main():
 
     # Post-process SVG: add white background for dark mode compatibility
     add_svg_background(output_svg)
+    if hasattr(plugin, "postprocess"):
+        plugin.postprocess(output_svg, args)
+
+    if args["shading_file"] and model is not None:
+        export_face_shading(scene, model, args["shading_file"], fill_mode=args["fill_mode"])
+    if args["frame_file"]:
+        export_frame(scene, args["frame_file"])
 
 
 if __name__ == "__main__":